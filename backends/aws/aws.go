@@ -0,0 +1,547 @@
+// Package aws implements a simpleblob storage backend for AWS S3 on top of
+// the official AWS SDK for Go v2. Credentials come from the default AWS
+// credential chain: the AWS_* environment variables, the shared config and
+// credentials files (profiles and SSO), IAM roles for service accounts (EKS
+// web identity), ECS task roles and EC2 instance profiles (IMDS).
+//
+// Unlike the generic 's3' backend, this does not require credentials in the
+// configuration file when running in AWS.
+package aws
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/c2h5oh/datasize"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/backends/httpclient"
+)
+
+const (
+	// TypeName is the name this backend is registered under
+	TypeName = "aws"
+
+	// DefaultRegion is used when no region is configured in the options,
+	// the environment or the shared config file
+	DefaultRegion = "us-east-1"
+
+	// DefaultInitTimeout is the default timeout for the initial bucket check
+	DefaultInitTimeout = 20 * time.Second
+
+	// DefaultPartSize is the default size of the parts of a multipart upload
+	DefaultPartSize = 64 * datasize.MB
+
+	// MinPartSize is the minimum part size S3 allows
+	MinPartSize = 5 * datasize.MB
+
+	// DefaultPartRetries is the default number of retries of a failed part
+	DefaultPartRetries = 3
+
+	// SSES3 and SSEKMS are the supported server-side encryption types
+	SSES3  = "AES256"
+	SSEKMS = "aws:kms"
+)
+
+// Options describes the storage options for the AWS S3 backend
+type Options struct {
+	// Bucket is the name of the S3 bucket (required)
+	Bucket string `yaml:"bucket"`
+
+	// Region is the AWS region of the bucket, e.g. 'eu-west-1'. If not set,
+	// the AWS_REGION environment variable or the region of the profile is
+	// used, falling back to 'us-east-1'.
+	Region string `yaml:"region"`
+
+	// EndpointURL overrides the default AWS S3 endpoint, for example to use
+	// a VPC endpoint. Use 'http://' for plain text connections.
+	EndpointURL string `yaml:"endpoint_url"`
+
+	// UsePathStyle forces path style bucket access instead of virtual host
+	// style access.
+	UsePathStyle bool `yaml:"use_path_style"`
+
+	// AccessKey, SecretKey and SessionToken are optional static credentials.
+	// If set, they are used instead of the default credential chain.
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    string `yaml:"secret_key"`
+	SessionToken string `yaml:"session_token"`
+
+	// CredentialsFile and Profile select the shared credentials file and the
+	// profile to use. By default, the AWS_SHARED_CREDENTIALS_FILE and
+	// AWS_PROFILE environment variables are used, falling back to
+	// ~/.aws/credentials and the 'default' profile. The profile is also
+	// looked up in the shared config file (~/.aws/config), which allows
+	// role_arn, credential_process and SSO profiles.
+	CredentialsFile string `yaml:"credentials_file"`
+	Profile         string `yaml:"profile"`
+
+	// DisableIAM disables the EC2 instance metadata service (IMDS), which
+	// provides the credentials of the EC2 instance profile. This avoids its
+	// connection timeouts outside of EC2. Web identity (EKS IRSA) and ECS
+	// task role credentials are configured through the environment and
+	// are still used.
+	DisableIAM bool `yaml:"disable_iam"`
+
+	// IAMEndpoint overrides the endpoint of the EC2 instance metadata
+	// service. This is only useful for testing.
+	IAMEndpoint string `yaml:"iam_endpoint"`
+
+	// CreateBucket creates the bucket if it does not exist yet.
+	CreateBucket bool `yaml:"create_bucket"`
+
+	// GlobalPrefix is prepended to all object names, e.g. 'lightningstream/'.
+	GlobalPrefix string `yaml:"global_prefix"`
+
+	// InitTimeout is the timeout for the initial bucket check on startup.
+	InitTimeout time.Duration `yaml:"init_timeout"`
+
+	// PartSize is the part size for multipart uploads, which are used for
+	// blobs larger than this (default: 64MB, minimum: 5MB). A failed part is
+	// retried on its own. When the upload fails, the uploaded parts are kept
+	// for an hour, and a retry to store the same data under the same name
+	// only uploads the missing parts. This does not work with encryption,
+	// because every attempt stores different encrypted data.
+	PartSize datasize.ByteSize `yaml:"part_size"`
+
+	// PartRetries is the number of times a failed part is retried before the
+	// upload fails (default: 3).
+	PartRetries int `yaml:"part_retries"`
+
+	// SSE enables server-side encryption of uploaded blobs with S3 managed
+	// keys ('AES256') or with KMS keys ('aws:kms'). By default, the default
+	// encryption of the bucket applies.
+	SSE string `yaml:"sse"`
+
+	// SSEKMSKeyID is the KMS key ID or ARN to use with 'aws:kms'. If not set,
+	// the AWS managed key for S3 is used.
+	SSEKMSKeyID string `yaml:"sse_kms_key_id"`
+
+	// ObjectLockMode and ObjectLockRetention set an S3 Object Lock retention
+	// on every uploaded blob. The mode is 'GOVERNANCE' or 'COMPLIANCE'. The
+	// bucket must have Object Lock enabled, which create_bucket does if set.
+	// Because Object Lock buckets are versioned, a cleanup delete only adds a
+	// delete marker and the locked version is kept until the retention
+	// expires. Use a lifecycle rule to expire noncurrent versions.
+	ObjectLockMode      string        `yaml:"object_lock_mode"`
+	ObjectLockRetention time.Duration `yaml:"object_lock_retention"`
+
+	// HTTP configures the proxy and TLS settings (proxy_url, no_proxy, tls
+	// and tls_min_version) of the S3 requests.
+	HTTP httpclient.Options `yaml:",inline"`
+}
+
+// Check validates the options
+func (o Options) Check() error {
+	if o.Bucket == "" {
+		return fmt.Errorf("aws storage.options: bucket is required")
+	}
+	if (o.AccessKey == "") != (o.SecretKey == "") {
+		return fmt.Errorf("aws storage.options: access_key and secret_key must be set together")
+	}
+	if o.PartSize != 0 && o.PartSize < MinPartSize {
+		return fmt.Errorf("aws storage.options: part_size: too small (minimum 5MB)")
+	}
+	if o.PartRetries < 0 {
+		return fmt.Errorf("aws storage.options: part_retries: cannot be negative")
+	}
+	if err := o.checkEndpoint(); err != nil {
+		return err
+	}
+	if err := o.HTTP.Check("aws storage.options"); err != nil {
+		return err
+	}
+	switch o.SSE {
+	case "", SSES3, SSEKMS:
+	default:
+		return fmt.Errorf("aws storage.options: sse: must be %q or %q", SSES3, SSEKMS)
+	}
+	if o.SSEKMSKeyID != "" && o.SSE != SSEKMS {
+		return fmt.Errorf("aws storage.options: sse_kms_key_id requires sse %q", SSEKMS)
+	}
+	switch types.ObjectLockMode(o.ObjectLockMode) {
+	case "":
+		if o.ObjectLockRetention != 0 {
+			return fmt.Errorf("aws storage.options: object_lock_retention requires object_lock_mode")
+		}
+	case types.ObjectLockModeGovernance, types.ObjectLockModeCompliance:
+		if o.ObjectLockRetention <= 0 {
+			return fmt.Errorf("aws storage.options: object_lock_retention: positive duration required")
+		}
+	default:
+		return fmt.Errorf("aws storage.options: object_lock_mode: must be %q or %q",
+			types.ObjectLockModeGovernance, types.ObjectLockModeCompliance)
+	}
+	return nil
+}
+
+// checkEndpoint checks the endpoint_url, if set
+func (o Options) checkEndpoint() error {
+	if o.EndpointURL == "" {
+		return nil
+	}
+	u, err := url.Parse(o.EndpointURL)
+	if err != nil {
+		return fmt.Errorf("aws storage.options: endpoint_url: %w", err)
+	}
+	switch u.Scheme {
+	case "https", "http":
+	default:
+		return fmt.Errorf(
+			"aws storage.options: endpoint_url: unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("aws storage.options: endpoint_url: missing host")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return fmt.Errorf("aws storage.options: endpoint_url: path not supported")
+	}
+	return nil
+}
+
+// loadOptions returns the options for config.LoadDefaultConfig. Anything that
+// is not configured is left to the default AWS config and credential chain.
+func (o Options) loadOptions() []func(*config.LoadOptions) error {
+	opts := []func(*config.LoadOptions) error{
+		config.WithDefaultRegion(DefaultRegion),
+	}
+	if o.Region != "" {
+		opts = append(opts, config.WithRegion(o.Region))
+	}
+	if o.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(o.Profile))
+	}
+	if o.CredentialsFile != "" {
+		opts = append(opts, config.WithSharedCredentialsFiles([]string{o.CredentialsFile}))
+	}
+	if o.AccessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(o.AccessKey, o.SecretKey, o.SessionToken)))
+	}
+	if o.DisableIAM {
+		opts = append(opts, config.WithEC2IMDSClientEnableState(imds.ClientDisabled))
+	}
+	if o.IAMEndpoint != "" {
+		opts = append(opts, config.WithEC2IMDSEndpoint(o.IAMEndpoint))
+	}
+	return opts
+}
+
+// uploadOptions are the options of a new upload
+type uploadOptions struct {
+	sse         types.ServerSideEncryption
+	sseKMSKeyID *string
+	lockMode    types.ObjectLockMode
+	retainUntil *time.Time
+
+	// sendMD5 adds a Content-MD5 header to the upload, which S3 requires for
+	// uploads with a retention
+	sendMD5 bool
+}
+
+// putObjectInput returns the input for a single request upload
+func (u uploadOptions) putObjectInput(bucket, key string, data []byte) *s3.PutObjectInput {
+	in := &s3.PutObjectInput{
+		Bucket:                    aws.String(bucket),
+		Key:                       aws.String(key),
+		Body:                      bytes.NewReader(data),
+		ContentLength:             aws.Int64(int64(len(data))),
+		ContentType:               aws.String("application/octet-stream"),
+		ServerSideEncryption:      u.sse,
+		SSEKMSKeyId:               u.sseKMSKeyID,
+		ObjectLockMode:            u.lockMode,
+		ObjectLockRetainUntilDate: u.retainUntil,
+	}
+	if u.sendMD5 {
+		in.ContentMD5 = aws.String(contentMD5(data))
+	}
+	return in
+}
+
+// createMultipartUploadInput returns the input to start a multipart upload
+func (u uploadOptions) createMultipartUploadInput(bucket, key string) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Bucket:                    aws.String(bucket),
+		Key:                       aws.String(key),
+		ContentType:               aws.String("application/octet-stream"),
+		ServerSideEncryption:      u.sse,
+		SSEKMSKeyId:               u.sseKMSKeyID,
+		ObjectLockMode:            u.lockMode,
+		ObjectLockRetainUntilDate: u.retainUntil,
+	}
+}
+
+// contentMD5 returns the value of a Content-MD5 header for the data
+func contentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Backend is the AWS S3 storage backend
+type Backend struct {
+	opt    Options
+	client *s3.Client
+	mp     *multipartUploader
+	now    func() time.Time
+}
+
+// New creates a new backend instance and checks if the bucket is accessible.
+func New(ctx context.Context, opt Options) (*Backend, error) {
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	if opt.InitTimeout == 0 {
+		opt.InitTimeout = DefaultInitTimeout
+	}
+	if opt.PartSize == 0 {
+		opt.PartSize = DefaultPartSize
+	}
+	if opt.PartRetries == 0 {
+		opt.PartRetries = DefaultPartRetries
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opt.loadOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("aws storage.options: %w", err)
+	}
+	// The proxy and TLS options only apply to S3, not to the requests for
+	// credentials, which can go to the link-local metadata service.
+	transport, err := opt.HTTP.Transport(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("aws storage.options: %w", err)
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.HTTPClient = &http.Client{Transport: transport}
+		o.UsePathStyle = opt.UsePathStyle
+		if opt.EndpointURL != "" {
+			o.BaseEndpoint = aws.String(opt.EndpointURL)
+		}
+	})
+
+	b := &Backend{
+		opt:    opt,
+		client: client,
+		mp: newMultipartUploader(client, opt.Bucket,
+			int(opt.PartSize), opt.PartRetries),
+		now: time.Now,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opt.InitTimeout)
+	defer cancel()
+	_, err = client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(opt.Bucket)})
+	if err == nil {
+		return b, nil
+	}
+	// HEAD requests have no body, so a missing bucket only has the NotFound
+	// status code
+	if !hasErrorCode(err, "NotFound", "NoSuchBucket") {
+		return nil, fmt.Errorf("aws: check bucket %q: %w", opt.Bucket, err)
+	}
+	if !opt.CreateBucket {
+		return nil, fmt.Errorf("aws: bucket %q does not exist", opt.Bucket)
+	}
+	in := &s3.CreateBucketInput{
+		Bucket:                     aws.String(opt.Bucket),
+		ObjectLockEnabledForBucket: aws.Bool(opt.ObjectLockMode != ""),
+	}
+	if cfg.Region != DefaultRegion {
+		// us-east-1 is the default location and cannot be passed explicitly
+		in.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(cfg.Region),
+		}
+	}
+	if _, err := client.CreateBucket(ctx, in); err != nil {
+		return nil, fmt.Errorf("aws: create bucket %q: %w", opt.Bucket, err)
+	}
+	return b, nil
+}
+
+// List returns the blobs with given prefix, ordered by name
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	var blobs simpleblob.BlobList
+	p := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.opt.Bucket),
+		Prefix: aws.String(b.opt.GlobalPrefix + prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			blobs = append(blobs, simpleblob.Blob{
+				Name: strings.TrimPrefix(aws.ToString(obj.Key), b.opt.GlobalPrefix),
+				Size: aws.ToInt64(obj.Size),
+			})
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, nil
+}
+
+// Load returns the contents of the named blob. If the blob does not exist,
+// os.ErrNotExist is returned.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	return b.get(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.opt.Bucket),
+		Key:    aws.String(b.opt.GlobalPrefix + name),
+	})
+}
+
+// LoadRange returns length bytes of the named blob, starting at offset,
+// using a range request
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("aws: invalid range %d+%d", offset, length)
+	}
+	return b.get(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.opt.Bucket),
+		Key:    aws.String(b.opt.GlobalPrefix + name),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+}
+
+// LoadVersion returns the contents of the named blob and its ETag as the
+// version for StoreIf
+func (b *Backend) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	return b.getVersion(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.opt.Bucket),
+		Key:    aws.String(b.opt.GlobalPrefix + name),
+	})
+}
+
+// get reads the object of a GetObject request
+func (b *Backend) get(ctx context.Context, in *s3.GetObjectInput) ([]byte, error) {
+	data, _, err := b.getVersion(ctx, in)
+	return data, err
+}
+
+// getVersion reads the object of a GetObject request and returns its ETag
+func (b *Backend) getVersion(ctx context.Context, in *s3.GetObjectInput) ([]byte, string, error) {
+	out, err := b.client.GetObject(ctx, in)
+	if err != nil {
+		return nil, "", convertError(err)
+	}
+	defer func() {
+		_ = out.Body.Close()
+	}()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", convertError(err)
+	}
+	return data, aws.ToString(out.ETag), nil
+}
+
+// Store stores the blob under the given name. Blobs larger than the part
+// size are stored with a resumable multipart upload.
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	opts := b.uploadOptions()
+	if len(data) > b.mp.partSize {
+		return b.mp.upload(ctx, b.opt.GlobalPrefix+name, data, opts)
+	}
+	_, err := b.client.PutObject(ctx, opts.putObjectInput(b.opt.Bucket, b.opt.GlobalPrefix+name, data))
+	return err
+}
+
+// StoreIf stores the blob if its ETag is version, or if it does not exist if
+// version is empty, using the If-Match and If-None-Match headers. AWS S3 and
+// MinIO support these, but other S3 implementations may ignore them.
+func (b *Backend) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	header, value := "If-None-Match", "*"
+	if version != "" {
+		header, value = "If-Match", version
+	}
+	in := b.uploadOptions().putObjectInput(b.opt.Bucket, b.opt.GlobalPrefix+name, data)
+	_, err := b.client.PutObject(ctx, in, s3.WithAPIOptions(smithyhttp.AddHeaderValue(header, value)))
+	if hasErrorCode(err, "PreconditionFailed", "ConditionalRequestConflict") {
+		return fmt.Errorf("%w: %v", conditional.ErrPreconditionFailed, err)
+	}
+	return err
+}
+
+// uploadOptions returns the options for a new upload, including the
+// encryption and the Object Lock retention counted from now.
+func (b *Backend) uploadOptions() uploadOptions {
+	opts := uploadOptions{
+		sse: types.ServerSideEncryption(b.opt.SSE),
+	}
+	if b.opt.SSEKMSKeyID != "" {
+		opts.sseKMSKeyID = aws.String(b.opt.SSEKMSKeyID)
+	}
+	if b.opt.ObjectLockMode != "" {
+		opts.lockMode = types.ObjectLockMode(b.opt.ObjectLockMode)
+		opts.retainUntil = aws.Time(b.now().Add(b.opt.ObjectLockRetention).UTC())
+		opts.sendMD5 = true
+	}
+	return opts
+}
+
+// Delete removes the named blob. Removing a blob that does not exist is not
+// an error.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.opt.Bucket),
+		Key:    aws.String(b.opt.GlobalPrefix + name),
+	})
+	if err != nil && convertError(err) != os.ErrNotExist {
+		return err
+	}
+	return nil
+}
+
+// hasErrorCode returns true if the error is an S3 error with one of the
+// given codes
+func hasErrorCode(err error, codes ...string) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, code := range codes {
+		if apiErr.ErrorCode() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// convertError converts a missing object error to os.ErrNotExist
+func convertError(err error) error {
+	if hasErrorCode(err, "NoSuchKey") {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func init() {
+	simpleblob.RegisterBackend(TypeName, func(ctx context.Context, p simpleblob.InitParams) (simpleblob.Interface, error) {
+		var opt Options
+		if err := p.OptionsThroughYAML(&opt); err != nil {
+			return nil, err
+		}
+		return New(ctx, opt)
+	})
+}
@@ -0,0 +1,170 @@
+package aws
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+)
+
+func TestOptions_Check(t *testing.T) {
+	require.Error(t, Options{}.Check())
+	require.NoError(t, Options{Bucket: "foo"}.Check())
+	require.Error(t, Options{Bucket: "foo", AccessKey: "a"}.Check())
+	require.NoError(t, Options{Bucket: "foo", AccessKey: "a", SecretKey: "b"}.Check())
+	require.NoError(t, Options{Bucket: "foo", EndpointURL: "http://localhost:9000"}.Check())
+	require.Error(t, Options{Bucket: "foo", EndpointURL: "ftp://example.com"}.Check())
+	require.Error(t, Options{Bucket: "foo", EndpointURL: "https://example.com/path"}.Check())
+	require.NoError(t, Options{Bucket: "foo", SSE: "AES256"}.Check())
+	require.NoError(t, Options{Bucket: "foo", SSE: "aws:kms", SSEKMSKeyID: "alias/dns"}.Check())
+	require.Error(t, Options{Bucket: "foo", SSE: "aes256"}.Check())
+	require.Error(t, Options{Bucket: "foo", SSE: "AES256", SSEKMSKeyID: "alias/dns"}.Check())
+	require.NoError(t, Options{Bucket: "foo", ObjectLockMode: "COMPLIANCE", ObjectLockRetention: time.Hour}.Check())
+	require.Error(t, Options{Bucket: "foo", ObjectLockMode: "COMPLIANCE"}.Check())
+	require.Error(t, Options{Bucket: "foo", ObjectLockMode: "LOCKED", ObjectLockRetention: time.Hour}.Check())
+	require.Error(t, Options{Bucket: "foo", ObjectLockRetention: time.Hour}.Check())
+}
+
+func TestBackend_uploadOptions(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := &Backend{now: func() time.Time { return now }}
+	in := b.uploadOptions().putObjectInput("bucket", "foo", []byte("data"))
+	assert.Empty(t, in.ServerSideEncryption)
+	assert.Empty(t, in.ObjectLockMode)
+	assert.Nil(t, in.ContentMD5)
+	assert.Equal(t, int64(4), aws.ToInt64(in.ContentLength))
+
+	o := Options{SSE: "aws:kms", SSEKMSKeyID: "alias/dns",
+		ObjectLockMode: "GOVERNANCE", ObjectLockRetention: 24 * time.Hour}
+	b = &Backend{opt: o, now: func() time.Time { return now }}
+	opts := b.uploadOptions()
+	in = opts.putObjectInput("bucket", "foo", []byte("aaaa"))
+	assert.Equal(t, types.ServerSideEncryptionAwsKms, in.ServerSideEncryption)
+	assert.Equal(t, "alias/dns", aws.ToString(in.SSEKMSKeyId))
+	assert.Equal(t, types.ObjectLockModeGovernance, in.ObjectLockMode)
+	assert.Equal(t, now.Add(24*time.Hour), aws.ToTime(in.ObjectLockRetainUntilDate))
+	assert.Equal(t, "dLhzN0VCANTTP4DEZj3F5Q==", aws.ToString(in.ContentMD5))
+
+	mp := opts.createMultipartUploadInput("bucket", "foo")
+	assert.Equal(t, types.ServerSideEncryptionAwsKms, mp.ServerSideEncryption)
+	assert.Equal(t, types.ObjectLockModeGovernance, mp.ObjectLockMode)
+}
+
+func TestOptions_loadOptions(t *testing.T) {
+	load := func(o Options) config.LoadOptions {
+		var lo config.LoadOptions
+		for _, f := range o.loadOptions() {
+			require.NoError(t, f(&lo))
+		}
+		return lo
+	}
+
+	lo := load(Options{Bucket: "foo"})
+	assert.Equal(t, DefaultRegion, lo.DefaultRegion)
+	assert.Empty(t, lo.Region)
+	assert.Nil(t, lo.Credentials)
+	assert.Equal(t, imds.ClientDefaultEnableState, lo.EC2IMDSClientEnableState)
+
+	lo = load(Options{Bucket: "foo", Region: "eu-west-1", Profile: "dns",
+		CredentialsFile: "/etc/creds", AccessKey: "a", SecretKey: "b", DisableIAM: true})
+	assert.Equal(t, "eu-west-1", lo.Region)
+	assert.Equal(t, "dns", lo.SharedConfigProfile)
+	assert.Equal(t, []string{"/etc/creds"}, lo.SharedCredentialsFiles)
+	require.IsType(t, credentials.StaticCredentialsProvider{}, lo.Credentials)
+	assert.Equal(t, "a", lo.Credentials.(credentials.StaticCredentialsProvider).Value.AccessKeyID)
+	assert.Equal(t, imds.ClientDisabled, lo.EC2IMDSClientEnableState)
+}
+
+// fakeS3 implements the object requests used for conditional writes, with
+// the MD5 of the content as the ETag
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	etag := func(data []byte) string {
+		sum := md5.Sum(data)
+		return `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+	const bucketPath = "/test"
+	if r.URL.Path == bucketPath {
+		return // HeadBucket
+	}
+	name := strings.TrimPrefix(r.URL.Path, bucketPath+"/")
+	data, exists := f.objects[name]
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		_, _ = w.Write(data)
+	case http.MethodPut:
+		ifMatch := r.Header.Get("If-Match")
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		if (ifNoneMatch == "*" && exists) || (ifMatch != "" && (!exists || ifMatch != etag(data))) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte(`<Error><Code>PreconditionFailed</Code></Error>`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[name] = body
+		w.Header().Set("ETag", etag(body))
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestBackend_StoreIf(t *testing.T) {
+	f := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ctx := context.Background()
+	b, err := New(ctx, Options{
+		Bucket:       "test",
+		Region:       "us-east-1",
+		EndpointURL:  srv.URL,
+		UsePathStyle: true,
+		AccessKey:    "a",
+		SecretKey:    "b",
+		DisableIAM:   true,
+		GlobalPrefix: "prefix/",
+	})
+	require.NoError(t, err)
+
+	_, _, err = b.LoadVersion(ctx, "lease")
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, b.StoreIf(ctx, "lease", []byte("v1"), ""))
+	assert.ErrorIs(t, b.StoreIf(ctx, "lease", []byte("v2"), ""), conditional.ErrPreconditionFailed)
+
+	data, version, err := b.LoadVersion(ctx, "lease")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+	assert.NotEmpty(t, version)
+	require.NoError(t, b.StoreIf(ctx, "lease", []byte("v2"), version))
+	assert.ErrorIs(t, b.StoreIf(ctx, "lease", []byte("v3"), version), conditional.ErrPreconditionFailed)
+	assert.Equal(t, "v2", string(f.objects["prefix/lease"]))
+}
@@ -0,0 +1,187 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// resumeTimeout is how long the parts of a failed multipart upload are kept
+// for a retry of the same upload. Older uploads are aborted.
+const resumeTimeout = time.Hour
+
+// multipartClient are the s3.Client methods used for multipart uploads
+type multipartClient interface {
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput,
+		optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput,
+		optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput,
+		optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput,
+		optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// pendingUpload is a multipart upload that failed and can be resumed
+type pendingUpload struct {
+	uploadID string
+	sum      [sha256.Size]byte     // of the complete blob
+	parts    []types.CompletedPart // ETag is nil for parts not uploaded yet
+	lastTry  time.Time
+}
+
+// multipartUploader uploads large blobs in parts. A failed part is retried
+// on its own, and a failed upload is remembered, so that a later Store of the
+// same blob only needs to upload the missing parts.
+type multipartUploader struct {
+	client      multipartClient
+	bucket      string
+	partSize    int
+	partRetries int
+	retryDelay  time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]*pendingUpload // by object name
+}
+
+func newMultipartUploader(client multipartClient, bucket string, partSize, partRetries int) *multipartUploader {
+	return &multipartUploader{
+		client:      client,
+		bucket:      bucket,
+		partSize:    partSize,
+		partRetries: partRetries,
+		retryDelay:  time.Second,
+		now:         time.Now,
+		pending:     make(map[string]*pendingUpload),
+	}
+}
+
+// upload uploads the data in parts of partSize. The opts are used to start
+// the upload, a resumed upload keeps the options it was started with.
+func (m *multipartUploader) upload(ctx context.Context, object string, data []byte, opts uploadOptions) error {
+	sum := sha256.Sum256(data)
+	p := m.resume(ctx, object, sum)
+	if p == nil {
+		out, err := m.client.CreateMultipartUpload(ctx, opts.createMultipartUploadInput(m.bucket, object))
+		if err != nil {
+			return fmt.Errorf("aws: start multipart upload of %q: %w", object, err)
+		}
+		nParts := (len(data) + m.partSize - 1) / m.partSize
+		p = &pendingUpload{
+			uploadID: aws.ToString(out.UploadId),
+			sum:      sum,
+			parts:    make([]types.CompletedPart, nParts),
+		}
+	}
+	p.lastTry = m.now()
+
+	for i := range p.parts {
+		if p.parts[i].ETag != nil {
+			continue // uploaded in an earlier attempt
+		}
+		start := i * m.partSize
+		end := start + m.partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		etag, err := m.uploadPart(ctx, object, p.uploadID, i+1, data[start:end], opts.sendMD5)
+		if err != nil {
+			m.keep(object, p)
+			return fmt.Errorf("aws: upload part %d/%d of %q: %w", i+1, len(p.parts), object, err)
+		}
+		p.parts[i] = types.CompletedPart{
+			PartNumber: aws.Int32(int32(i + 1)),
+			ETag:       etag,
+		}
+	}
+
+	_, err := m.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(m.bucket),
+		Key:             aws.String(object),
+		UploadId:        aws.String(p.uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: p.parts},
+	})
+	if err != nil {
+		m.keep(object, p)
+		return fmt.Errorf("aws: complete multipart upload of %q: %w", object, err)
+	}
+	return nil
+}
+
+// uploadPart uploads a single part, with retries, and returns its ETag. If
+// sendMD5 is set, the part is uploaded with a Content-MD5 header.
+func (m *multipartUploader) uploadPart(ctx context.Context, object, uploadID string, partID int, data []byte, sendMD5 bool) (etag *string, err error) {
+	var checksum *string
+	if sendMD5 {
+		checksum = aws.String(contentMD5(data))
+	}
+	for attempt := 0; attempt <= m.partRetries; attempt++ {
+		if attempt > 0 {
+			if err := utils.SleepContext(ctx, time.Duration(attempt)*m.retryDelay); err != nil {
+				return nil, err
+			}
+		}
+		var out *s3.UploadPartOutput
+		out, err = m.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(m.bucket),
+			Key:           aws.String(object),
+			UploadId:      aws.String(uploadID),
+			PartNumber:    aws.Int32(int32(partID)),
+			Body:          bytes.NewReader(data),
+			ContentLength: aws.Int64(int64(len(data))),
+			ContentMD5:    checksum,
+		})
+		if err == nil {
+			return out.ETag, nil
+		}
+	}
+	return nil, err
+}
+
+// resume returns the pending upload of this object if the data is the same.
+// Any other pending upload of this object and any pending upload that has
+// not been retried in time are aborted.
+func (m *multipartUploader) resume(ctx context.Context, object string, sum [sha256.Size]byte) *pendingUpload {
+	var p *pendingUpload
+	abort := make(map[string]*pendingUpload)
+
+	m.mu.Lock()
+	for name, pu := range m.pending {
+		switch {
+		case name == object && pu.sum == sum:
+			p = pu
+		case name == object || m.now().Sub(pu.lastTry) > resumeTimeout:
+			abort[name] = pu
+		default:
+			continue
+		}
+		delete(m.pending, name)
+	}
+	m.mu.Unlock()
+
+	for name, pu := range abort {
+		// Errors are ignored, a bucket lifecycle rule can clean these up
+		_, _ = m.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(m.bucket),
+			Key:      aws.String(name),
+			UploadId: aws.String(pu.uploadID),
+		})
+	}
+	return p
+}
+
+// keep remembers a failed upload for a later retry
+func (m *multipartUploader) keep(object string, p *pendingUpload) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[object] = p
+}
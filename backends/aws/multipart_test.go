@@ -0,0 +1,112 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient records multipart uploads and fails the configured parts once
+type fakeClient struct {
+	failParts map[int]int // part number -> remaining failures
+	uploads   int
+	aborted   []string
+	parts     map[int]string
+	md5s      map[int]string
+	completed []byte
+}
+
+func (f *fakeClient) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput,
+	optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.uploads++
+	f.parts = make(map[int]string)
+	f.md5s = make(map[int]string)
+	return &s3.CreateMultipartUploadOutput{
+		UploadId: aws.String(fmt.Sprintf("upload-%d", f.uploads)),
+	}, nil
+}
+
+func (f *fakeClient) UploadPart(ctx context.Context, params *s3.UploadPartInput,
+	optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	partID := int(aws.ToInt32(params.PartNumber))
+	if f.failParts[partID] > 0 {
+		f.failParts[partID]--
+		return nil, errors.New("connection reset")
+	}
+	b, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.parts[partID] = string(b)
+	f.md5s[partID] = aws.ToString(params.ContentMD5)
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", partID))}, nil
+}
+
+func (f *fakeClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput,
+	optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.completed = nil
+	for _, p := range params.MultipartUpload.Parts {
+		f.completed = append(f.completed, f.parts[int(aws.ToInt32(p.PartNumber))]...)
+	}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeClient) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput,
+	optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted = append(f.aborted, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestMultipartUploader(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("aaaabbbbccccdd")
+
+	f := &fakeClient{failParts: map[int]int{2: 1}}
+	m := newMultipartUploader(f, "bucket", 4, 1)
+	m.retryDelay = time.Millisecond
+
+	// Failed part is retried on its own
+	require.NoError(t, m.upload(ctx, "foo", data, uploadOptions{}))
+	assert.Equal(t, string(data), string(f.completed))
+	assert.Equal(t, 1, f.uploads)
+
+	// Failed upload is resumed on the next attempt
+	f.failParts = map[int]int{3: 2}
+	err := m.upload(ctx, "foo", data, uploadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "part 3/4")
+	f.parts[1] = "XXXX" // would show up if part 1 were not reused
+	require.NoError(t, m.upload(ctx, "foo", data, uploadOptions{}))
+	assert.Equal(t, "XXXXbbbbccccdd", string(f.completed))
+	assert.Equal(t, 2, f.uploads)
+	assert.Empty(t, f.aborted)
+
+	// Different data for the same name aborts the pending upload
+	f.failParts = map[int]int{1: 2}
+	require.Error(t, m.upload(ctx, "foo", data, uploadOptions{}))
+	require.NoError(t, m.upload(ctx, "foo", []byte("eeeeffff"), uploadOptions{}))
+	assert.Equal(t, "eeeeffff", string(f.completed))
+	assert.Equal(t, []string{"upload-3"}, f.aborted)
+
+	// Uploads that are not retried in time are aborted
+	f.failParts = map[int]int{1: 2}
+	require.Error(t, m.upload(ctx, "bar", data, uploadOptions{}))
+	now := time.Now()
+	m.now = func() time.Time { return now.Add(2 * resumeTimeout) }
+	require.NoError(t, m.upload(ctx, "foo", data, uploadOptions{}))
+	assert.Equal(t, []string{"upload-3", "upload-5"}, f.aborted)
+	assert.Empty(t, f.md5s[1])
+
+	// Parts are sent with a Content-MD5 when requested (Object Lock)
+	require.NoError(t, m.upload(ctx, "foo", []byte("aaaa1"), uploadOptions{sendMD5: true}))
+	assert.Equal(t, "dLhzN0VCANTTP4DEZj3F5Q==", f.md5s[1])
+	assert.Equal(t, "xMpCOKC5I4INzFCab3WEmw==", f.md5s[2])
+}
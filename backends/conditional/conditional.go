@@ -0,0 +1,57 @@
+// Package conditional defines an optional storage backend interface for
+// conditional writes, which only store a blob if nobody else wrote it since
+// it was loaded. It is used by the leases, see leader_election.
+//
+// Wrappers like the prefix and throttle backends implement the interface by
+// passing the call on, so whether conditional writes work is only known once
+// the first one is attempted.
+package conditional
+
+import (
+	"context"
+	"errors"
+
+	"github.com/PowerDNS/simpleblob"
+)
+
+// ErrUnsupported is returned for conditional writes to backends that cannot
+// do them
+var ErrUnsupported = errors.New("storage backend does not support conditional writes")
+
+// ErrPreconditionFailed is returned by StoreIf if the blob was written since
+// the version was loaded
+var ErrPreconditionFailed = errors.New("blob was changed since it was loaded")
+
+// Writer is implemented by storage backends that support conditional writes
+type Writer interface {
+	// LoadVersion loads the named blob and its version, an opaque string
+	// that changes whenever the blob is stored, like an ETag.
+	// If the blob does not exist, os.ErrNotExist is returned.
+	LoadVersion(ctx context.Context, name string) ([]byte, string, error)
+
+	// StoreIf stores the named blob if its current version is version, or
+	// if it does not exist if version is empty. Otherwise, an error wrapping
+	// ErrPreconditionFailed is returned.
+	StoreIf(ctx context.Context, name string, data []byte, version string) error
+}
+
+// LoadVersion loads the named blob and its version if the backend supports
+// conditional writes. Otherwise, ErrUnsupported is returned.
+func LoadVersion(ctx context.Context, st simpleblob.Interface, name string) ([]byte, string, error) {
+	w, ok := st.(Writer)
+	if !ok {
+		return nil, "", ErrUnsupported
+	}
+	return w.LoadVersion(ctx, name)
+}
+
+// StoreIf stores the named blob if its current version is version, or if it
+// does not exist if version is empty, if the backend supports conditional
+// writes. Otherwise, ErrUnsupported is returned.
+func StoreIf(ctx context.Context, st simpleblob.Interface, name string, data []byte, version string) error {
+	w, ok := st.(Writer)
+	if !ok {
+		return ErrUnsupported
+	}
+	return w.StoreIf(ctx, name, data, version)
+}
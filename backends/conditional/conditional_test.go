@@ -0,0 +1,62 @@
+package conditional
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// versioned uses a counter blob next to every blob as its version
+type versioned struct {
+	*memory.Backend
+}
+
+func (b versioned) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	data, err := b.Load(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	version, err := b.Load(ctx, name+".version")
+	return data, string(version), err
+}
+
+func (b versioned) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	_, cur, err := b.LoadVersion(ctx, name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if cur != version {
+		return ErrPreconditionFailed
+	}
+	n, _ := strconv.Atoi(cur)
+	if err := b.Store(ctx, name+".version", []byte(strconv.Itoa(n+1))); err != nil {
+		return err
+	}
+	return b.Store(ctx, name, data)
+}
+
+func TestStoreIf(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+
+	_, _, err := LoadVersion(ctx, st, "foo")
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.ErrorIs(t, StoreIf(ctx, st, "foo", []byte("v1"), ""), ErrUnsupported)
+
+	v := versioned{st}
+	_, _, err = LoadVersion(ctx, v, "foo")
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, StoreIf(ctx, v, "foo", []byte("v1"), ""))
+	assert.ErrorIs(t, StoreIf(ctx, v, "foo", []byte("v2"), ""), ErrPreconditionFailed)
+
+	data, version, err := LoadVersion(ctx, v, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+	require.NoError(t, StoreIf(ctx, v, "foo", []byte("v2"), version))
+	assert.ErrorIs(t, StoreIf(ctx, v, "foo", []byte("v3"), version), ErrPreconditionFailed)
+}
@@ -0,0 +1,634 @@
+// Package dedup implements a simpleblob.Interface wrapper that stores the
+// DBI blocks of framed snapshots in a shared content-addressed area of the
+// bucket, so that identical blocks are only uploaded and stored once.
+//
+// A framed snapshot is stored as a manifest under its own name. The manifest
+// lists the parts of the snapshot in order: small parts like the header,
+// Meta and index are included in the manifest, and every DBI block of at
+// least MinBlockSize refers to a block object named after its SHA-256 hash.
+// With a hash key, the block objects are named after the HMAC-SHA256 of the
+// block instead, so that their names do not reveal if a bucket contains a
+// block with known contents.
+// With PerDBI, all blocks of a DBI are stored as a single block object.
+// Loading the snapshot returns the original data, and List returns its
+// original size, so that ranged loads of the changed DBIs work like they do
+// for snapshots that are not deduplicated. Other blobs are stored as they
+// are.
+//
+// Before a block is used, a reference object is stored that names both the
+// block and the snapshot, so that the garbage collection can tell which
+// blocks are in use without loading any manifests. Blocks and references
+// are removed once they were found unused in two scans, see GC.
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+const (
+	// KeyPrefix is the prefix of all block and reference objects. These are
+	// not returned by List.
+	KeyPrefix = "_dedup__"
+
+	blockSuffix = ".blk"
+	refInfix    = ".ref."
+
+	// blockHeaderSize is the size of the header of a framed block, which is
+	// stored with the payload
+	blockHeaderSize = 9
+
+	// maxManifestSize is the maximum size of a manifest. Snapshots that would
+	// need a larger manifest are stored as they are. List only checks blobs
+	// up to this size for manifests.
+	maxManifestSize = 1 << 20
+
+	// maxCachedManifests is the number of manifests kept for ranged loads
+	maxCachedManifests = 32
+)
+
+// magicManifest is the prefix of a manifest, followed by the JSON manifest
+var magicManifest = []byte("LSDEDUP1\n")
+
+var (
+	metricBlocks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_storage_dedup_blocks_total",
+			Help: "Deduplicated snapshot blocks written, by result (stored or reused)",
+		},
+		[]string{"result"},
+	)
+	metricDeleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_storage_dedup_deleted_total",
+			Help: "Unused deduplicated blocks and references deleted, by kind",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricBlocks)
+	prometheus.MustRegister(metricDeleted)
+}
+
+// manifest describes how to reassemble a snapshot from its parts
+type manifest struct {
+	Size  int64  `json:"size"`
+	Parts []part `json:"parts"`
+}
+
+// part is either inline data or a reference to a block
+type part struct {
+	Data   []byte `json:"data,omitempty"`
+	Hash   string `json:"hash,omitempty"`   // hex SHA-256 or HMAC of the block
+	SHA256 string `json:"sha256,omitempty"` // hex SHA-256 if Hash is an HMAC
+	Size   int64  `json:"size,omitempty"`   // size of the block
+}
+
+func (p part) size() int64 {
+	if p.Hash == "" {
+		return int64(len(p.Data))
+	}
+	return p.Size
+}
+
+// listedBlob is the size of a blob as returned by List, and the size of the
+// snapshot if the blob is a manifest
+type listedBlob struct {
+	listedSize int64
+	size       int64
+}
+
+// Backend wraps a storage backend with deduplication
+type Backend struct {
+	st      simpleblob.Interface
+	conf    config.Dedup
+	hashKey []byte
+	l       logrus.FieldLogger
+
+	mu         sync.Mutex
+	known      map[string]time.Time  // blocks known to exist, by hash
+	candidates map[string]bool       // unused keys found by the last GC scan
+	listed     map[string]listedBlob // by name
+	manifests  map[string]*manifest  // by name, for ranged loads
+	lastGC     time.Time
+}
+
+// New wraps a storage backend with deduplication. If it is not enabled, the
+// backend is returned as is. If hashKey is set, block objects are named after
+// the HMAC of the block with this key. Instances can only share blocks if
+// they use the same key.
+func New(st simpleblob.Interface, conf config.Dedup, hashKey []byte) simpleblob.Interface {
+	if !conf.Enabled {
+		return st
+	}
+	return &Backend{
+		st:        st,
+		conf:      conf,
+		hashKey:   hashKey,
+		l:         logrus.WithField("component", "dedup"),
+		known:     make(map[string]time.Time),
+		listed:    make(map[string]listedBlob),
+		manifests: make(map[string]*manifest),
+		lastGC:    time.Now(),
+	}
+}
+
+// blockHash returns the hash of a block that its object is named after
+func (b *Backend) blockHash(data []byte) string {
+	if b.hashKey == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, b.hashKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func blockKey(hash string) string {
+	return KeyPrefix + hash + blockSuffix
+}
+
+func refKey(hash, name string) string {
+	return KeyPrefix + hash + refInfix + url.PathEscape(name)
+}
+
+// List returns the blobs with the given prefix, without the block and
+// reference objects. The size of a deduplicated snapshot is the size of the
+// snapshot, not of its manifest. This requires loading every new snapshot
+// that is small enough to be a manifest once.
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	ls, err := b.st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make(simpleblob.BlobList, 0, len(ls))
+	seen := make(map[string]bool, len(ls))
+	for _, blob := range ls {
+		if strings.HasPrefix(blob.Name, KeyPrefix) {
+			continue
+		}
+		seen[blob.Name] = true
+		if isSnapshotName(blob.Name) {
+			size, err := b.size(ctx, blob)
+			if errors.Is(err, os.ErrNotExist) {
+				continue // deleted since it was listed
+			}
+			if err != nil {
+				return nil, err
+			}
+			blob.Size = size
+		}
+		res = append(res, blob)
+	}
+
+	b.mu.Lock()
+	for name := range b.listed {
+		if strings.HasPrefix(name, prefix) && !seen[name] {
+			delete(b.listed, name)
+		}
+	}
+	b.mu.Unlock()
+	return res, nil
+}
+
+func isSnapshotName(name string) bool {
+	_, err := snapshot.ParseName(path.Base(name))
+	return err == nil
+}
+
+// size returns the size of the snapshot if the listed blob is a manifest,
+// or the listed size otherwise
+func (b *Backend) size(ctx context.Context, blob simpleblob.Blob) (int64, error) {
+	b.mu.Lock()
+	lb, found := b.listed[blob.Name]
+	b.mu.Unlock()
+	if found && lb.listedSize == blob.Size {
+		return lb.size, nil
+	}
+	lb = listedBlob{listedSize: blob.Size, size: blob.Size}
+	if blob.Size <= maxManifestSize {
+		m, err := b.loadManifest(ctx, blob.Name)
+		if err != nil {
+			return 0, err
+		}
+		if m != nil {
+			lb.size = m.Size
+		}
+	}
+	b.mu.Lock()
+	b.listed[blob.Name] = lb
+	b.mu.Unlock()
+	return lb.size, nil
+}
+
+// loadManifest loads the manifest stored under the name. It returns nil if
+// the blob is not a manifest.
+func (b *Backend) loadManifest(ctx context.Context, name string) (*manifest, error) {
+	data, err := b.st.Load(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(name, data)
+}
+
+func parseManifest(name string, data []byte) (*manifest, error) {
+	if !bytes.HasPrefix(data, magicManifest) {
+		return nil, nil
+	}
+	var m manifest
+	if err := json.Unmarshal(data[len(magicManifest):], &m); err != nil {
+		return nil, fmt.Errorf("dedup: manifest of %s: %w", name, err)
+	}
+	return &m, nil
+}
+
+// Load loads a blob, and reassembles it from its blocks if it was
+// deduplicated. The blocks are verified against their hash.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	data, err := b.st.Load(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return b.assemble(ctx, name, data)
+}
+
+// LoadVersion loads a blob like Load, and returns the version of the stored
+// blob, if the wrapped backend supports conditional writes
+func (b *Backend) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	data, version, err := conditional.LoadVersion(ctx, b.st, name)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err = b.assemble(ctx, name, data)
+	return data, version, err
+}
+
+// assemble returns the snapshot if data is a manifest, or data otherwise
+func (b *Backend) assemble(ctx context.Context, name string, data []byte) ([]byte, error) {
+	m, err := parseManifest(name, data)
+	if err != nil || m == nil {
+		return data, err
+	}
+	out := make([]byte, 0, m.Size)
+	for _, p := range m.Parts {
+		if p.Hash == "" {
+			out = append(out, p.Data...)
+			continue
+		}
+		blk, err := b.loadBlock(ctx, name, p)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, blk...)
+	}
+	if int64(len(out)) != m.Size {
+		return nil, fmt.Errorf("dedup: %s: size %d does not match manifest size %d: %w",
+			name, len(out), m.Size, snapshot.ErrCorrupt)
+	}
+	return out, nil
+}
+
+// loadBlock loads a whole block of the named snapshot, and verifies it
+// against its SHA-256 hash. This does not need the hash key, so blocks
+// stored by instances with another key can be loaded.
+func (b *Backend) loadBlock(ctx context.Context, name string, p part) ([]byte, error) {
+	blk, err := b.st.Load(ctx, blockKey(p.Hash))
+	if err != nil {
+		return nil, fmt.Errorf("dedup: block %s of %s: %w", p.Hash, name, err)
+	}
+	want := p.SHA256
+	if want == "" {
+		want = p.Hash
+	}
+	sum := sha256.Sum256(blk)
+	if hex.EncodeToString(sum[:]) != want || int64(len(blk)) != p.Size {
+		return nil, fmt.Errorf("dedup: block %s of %s: %w", p.Hash, name, snapshot.ErrCorrupt)
+	}
+	return blk, nil
+}
+
+// LoadRange loads part of a blob. For a deduplicated snapshot, the range is
+// assembled from the manifest and ranged loads of the blocks, if the wrapped
+// backend supports these, or otherwise whole blocks. For other blobs, the
+// call is passed on.
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	b.mu.Lock()
+	m := b.manifests[name]
+	lb, listed := b.listed[name]
+	b.mu.Unlock()
+	if m == nil && listed && lb.size == lb.listedSize {
+		return ranged.Load(ctx, b.st, name, offset, length)
+	}
+	if m == nil {
+		var err error
+		if m, err = b.loadManifest(ctx, name); err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return ranged.Load(ctx, b.st, name, offset, length)
+		}
+		b.mu.Lock()
+		if len(b.manifests) >= maxCachedManifests {
+			b.manifests = make(map[string]*manifest)
+		}
+		b.manifests[name] = m
+		b.mu.Unlock()
+	}
+	if offset < 0 || length < 0 || offset+length > m.Size {
+		return nil, fmt.Errorf("dedup: %s: range %d+%d out of bounds", name, offset, length)
+	}
+
+	out := make([]byte, 0, length)
+	end := offset + length
+	var pos int64 // offset of the current part in the snapshot
+	for _, p := range m.Parts {
+		pEnd := pos + p.size()
+		if pEnd <= offset || pos >= end {
+			pos = pEnd
+			continue
+		}
+		from, to := offset-pos, end-pos // within the part
+		if from < 0 {
+			from = 0
+		}
+		if to > p.size() {
+			to = p.size()
+		}
+		if p.Hash == "" {
+			out = append(out, p.Data[from:to]...)
+			pos = pEnd
+			continue
+		}
+		data, err := ranged.Load(ctx, b.st, blockKey(p.Hash), from, to-from)
+		if errors.Is(err, ranged.ErrUnsupported) {
+			var blk []byte
+			blk, err = b.loadBlock(ctx, name, p)
+			if err == nil {
+				data = blk[from:to]
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+		pos = pEnd
+	}
+	return out, nil
+}
+
+// Store stores a blob. Framed snapshots are stored as a manifest and their
+// DBI blocks, other blobs are stored as they are.
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	out, err := b.split(ctx, name, data)
+	if err != nil {
+		return err
+	}
+	return b.st.Store(ctx, name, out)
+}
+
+// StoreIf stores a blob like Store, if the wrapped backend supports
+// conditional writes. Only the manifest is stored conditionally.
+func (b *Backend) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	out, err := b.split(ctx, name, data)
+	if err != nil {
+		return err
+	}
+	return conditional.StoreIf(ctx, b.st, name, out, version)
+}
+
+// split stores the DBI blocks of a framed snapshot, and returns the manifest
+// to store under the name. Other blobs are returned as they are.
+func (b *Backend) split(ctx context.Context, name string, data []byte) ([]byte, error) {
+	b.mu.Lock()
+	delete(b.listed, name)
+	delete(b.manifests, name)
+	b.mu.Unlock()
+	if !snapshot.IsFramed(data) {
+		return data, nil
+	}
+	fr, err := snapshot.NewFramedReader(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("dedup: %s: %w", name, err)
+	}
+
+	m := manifest{Size: int64(len(data))}
+	var offset int64
+	for _, r := range b.blockRanges(fr.Index.Blocks) {
+		start, end := r[0], r[1]
+		if end-start < int64(b.conf.MinBlockSize) {
+			continue
+		}
+		if start > offset {
+			m.Parts = append(m.Parts, part{Data: data[offset:start]})
+		}
+		blkData := data[start:end]
+		p := part{Hash: b.blockHash(blkData), Size: end - start}
+		if b.hashKey != nil {
+			sum := sha256.Sum256(blkData)
+			p.SHA256 = hex.EncodeToString(sum[:])
+		}
+		if err := b.storeBlock(ctx, name, p.Hash, blkData); err != nil {
+			return nil, err
+		}
+		m.Parts = append(m.Parts, p)
+		offset = end
+	}
+	if offset < int64(len(data)) {
+		m.Parts = append(m.Parts, part{Data: data[offset:]})
+	}
+
+	mj, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(magicManifest)+len(mj) > maxManifestSize {
+		return data, nil
+	}
+	return append(append([]byte(nil), magicManifest...), mj...), nil
+}
+
+// blockRanges returns the start and end offsets of the DBI blocks to store
+// as separate block objects, including their headers, in order. With PerDBI,
+// consecutive blocks of the same DBI are combined.
+func (b *Backend) blockRanges(index []snapshot.FramedBlock) [][2]int64 {
+	blocks := make([]snapshot.FramedBlock, 0, len(index))
+	for _, blk := range index {
+		if blk.Kind == snapshot.BlockDBI {
+			blocks = append(blocks, blk)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Offset < blocks[j].Offset
+	})
+	var ranges [][2]int64
+	for i, blk := range blocks {
+		end := blk.Offset + blockHeaderSize + blk.Size
+		n := len(ranges)
+		if b.conf.PerDBI && i > 0 && blocks[i-1].Name == blk.Name && ranges[n-1][1] == blk.Offset {
+			ranges[n-1][1] = end
+			continue
+		}
+		ranges = append(ranges, [2]int64{blk.Offset, end})
+	}
+	return ranges
+}
+
+// storeBlock stores the reference of the named snapshot to a block, and the
+// block itself if it does not exist yet
+func (b *Backend) storeBlock(ctx context.Context, name, hash string, data []byte) error {
+	if err := b.st.Store(ctx, refKey(hash, name), nil); err != nil {
+		return err
+	}
+	now := time.Now()
+	b.mu.Lock()
+	t, known := b.known[hash]
+	b.mu.Unlock()
+	if known && now.Sub(t) < b.conf.GCInterval {
+		metricBlocks.WithLabelValues("reused").Inc()
+		return nil
+	}
+
+	key := blockKey(hash)
+	ls, err := b.st.List(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(ls) > 0 && ls[0].Name == key && ls[0].Size == int64(len(data)) {
+		metricBlocks.WithLabelValues("reused").Inc()
+	} else {
+		if err := b.st.Store(ctx, key, data); err != nil {
+			return err
+		}
+		metricBlocks.WithLabelValues("stored").Inc()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for h, t := range b.known {
+		if now.Sub(t) >= b.conf.GCInterval {
+			delete(b.known, h)
+		}
+	}
+	b.known[hash] = now
+	return nil
+}
+
+// Delete deletes a blob. Blocks that are no longer used are deleted later by
+// GC, which runs here once the gc_interval has passed.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	if err := b.st.Delete(ctx, name); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	delete(b.listed, name)
+	delete(b.manifests, name)
+	due := time.Since(b.lastGC) >= b.conf.GCInterval
+	if due {
+		b.lastGC = time.Now()
+	}
+	b.mu.Unlock()
+	if due {
+		if err := b.GC(ctx); err != nil {
+			b.l.WithError(err).Warn("Garbage collection of deduplicated blocks failed")
+		}
+	}
+	return nil
+}
+
+// GC scans the bucket for references to snapshots that no longer exist, and
+// for blocks without any reference to an existing snapshot. These are
+// deleted if they were also found unused by the previous scan, which gives
+// snapshots that are being stored time to store their manifest.
+func (b *Backend) GC(ctx context.Context) error {
+	ls, err := b.st.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, blob := range ls {
+		if !strings.HasPrefix(blob.Name, KeyPrefix) {
+			exists[blob.Name] = true
+		}
+	}
+	used := make(map[string]bool) // by hash
+	var refs, blocks []string
+	for _, blob := range ls {
+		key := blob.Name
+		if !strings.HasPrefix(key, KeyPrefix) {
+			continue
+		}
+		rest := key[len(KeyPrefix):]
+		if hash, escaped, isRef := strings.Cut(rest, refInfix); isRef {
+			name, err := url.PathUnescape(escaped)
+			if err == nil && exists[name] {
+				used[hash] = true
+			} else {
+				refs = append(refs, key)
+			}
+		} else if strings.HasSuffix(rest, blockSuffix) {
+			blocks = append(blocks, key)
+		}
+	}
+	var unused []string
+	for _, key := range blocks {
+		hash := strings.TrimSuffix(key[len(KeyPrefix):], blockSuffix)
+		if !used[hash] {
+			unused = append(unused, key)
+		}
+	}
+	unused = append(unused, refs...)
+
+	b.mu.Lock()
+	prev := b.candidates
+	b.candidates = make(map[string]bool, len(unused))
+	var toDelete []string
+	for _, key := range unused {
+		if prev[key] {
+			toDelete = append(toDelete, key)
+		} else {
+			b.candidates[key] = true
+		}
+	}
+	b.mu.Unlock()
+
+	for _, key := range toDelete {
+		if err := b.st.Delete(ctx, key); err != nil {
+			return err
+		}
+		kind := "ref"
+		if strings.HasSuffix(key, blockSuffix) {
+			kind = "block"
+			b.mu.Lock()
+			delete(b.known, strings.TrimSuffix(key[len(KeyPrefix):], blockSuffix))
+			b.mu.Unlock()
+		}
+		metricDeleted.WithLabelValues(kind).Inc()
+	}
+	if len(toDelete) > 0 {
+		b.l.WithField("deleted", len(toDelete)).Info("Deleted unused deduplicated blocks and references")
+	}
+	return nil
+}
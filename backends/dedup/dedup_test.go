@@ -0,0 +1,312 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/backends/fs"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+var testConf = config.Dedup{
+	Enabled:      true,
+	MinBlockSize: 1024,
+	GCInterval:   config.DefaultDedupGCInterval,
+}
+
+// writeSnapshot returns a framed snapshot with a shared DBI and a DBI with
+// content specific to the instance
+func writeSnapshot(t *testing.T, instance string, ts uint64) []byte {
+	var buf bytes.Buffer
+	sw, err := snapshot.NewStreamWriter(&buf, snapshot.Compression{Framed: true}, 3, 2)
+	require.NoError(t, err)
+	for _, dbi := range []string{"shared", instance} {
+		require.NoError(t, sw.StartDBI(dbi, 0, ""))
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, sw.Append(snapshot.KV{
+				Key:   []byte(fmt.Sprintf("key-%06d", i)),
+				Value: []byte(fmt.Sprintf("%s-value-%06d", dbi, i*7919%10007)),
+			}))
+		}
+		require.NoError(t, sw.EndDBI())
+	}
+	_, err = sw.Close(snapshot.Meta{
+		GenerationID:  "gen",
+		InstanceID:    instance,
+		TimestampNano: ts,
+		DatabaseName:  "db",
+	})
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+func testName(instance string, ts int64) string {
+	return snapshot.NameWithExtension("db", instance, "gen", time.Unix(ts, 0), snapshot.ExtensionGzip)
+}
+
+func countKeys(t *testing.T, st *memory.Backend, suffix string) int {
+	ls, err := st.List(context.Background(), KeyPrefix)
+	require.NoError(t, err)
+	n := 0
+	for _, name := range ls.Names() {
+		if strings.Contains(name, suffix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBackend(t *testing.T) {
+	tester.DoBackendTests(t, New(memory.New(), testConf, nil))
+
+	// Disabled
+	raw := memory.New()
+	assert.Equal(t, raw, New(raw, config.Dedup{}, nil))
+}
+
+func TestBackend_framed(t *testing.T) {
+	ctx := context.Background()
+	raw := memory.New()
+	st := New(raw, testConf, nil)
+
+	a1Name, a2Name, b1Name := testName("a", 1), testName("a", 2), testName("b", 1)
+	a1 := writeSnapshot(t, "a", 1)
+	a2 := writeSnapshot(t, "a", 2)
+	b1 := writeSnapshot(t, "b", 1)
+	stored := testutil.ToFloat64(metricBlocks.WithLabelValues("stored"))
+	reused := testutil.ToFloat64(metricBlocks.WithLabelValues("reused"))
+
+	require.NoError(t, st.Store(ctx, a1Name, a1))
+	require.NoError(t, st.Store(ctx, a2Name, a2))
+	require.NoError(t, st.Store(ctx, b1Name, b1))
+	assert.Equal(t, stored+3, testutil.ToFloat64(metricBlocks.WithLabelValues("stored")))
+	assert.Equal(t, reused+3, testutil.ToFloat64(metricBlocks.WithLabelValues("reused")))
+	assert.Equal(t, 3, countKeys(t, raw, blockSuffix))
+	assert.Equal(t, 6, countKeys(t, raw, refInfix))
+
+	// The manifest is stored under the snapshot name
+	manifestData, err := raw.Load(ctx, a1Name)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(manifestData, magicManifest))
+	assert.Less(t, len(manifestData), len(a1))
+
+	for name, data := range map[string][]byte{
+		a1Name: a1,
+		a2Name: a2,
+		b1Name: b1,
+	} {
+		loaded, err := st.Load(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, data, loaded, name)
+	}
+
+	// Block and reference objects are not listed
+	ls, err := st.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{a1Name, a2Name, b1Name}, ls.Names())
+	assert.Equal(t, int64(len(a1)), ls[0].Size)
+
+	// Ranged loads without ranged loads of the blocks
+	data, err := st.(ranged.Loader).LoadRange(ctx, a1Name, 10, int64(len(a1)-20))
+	require.NoError(t, err)
+	assert.Equal(t, a1[10:len(a1)-10], data)
+
+	// Corrupt blocks are detected
+	ls, err = raw.List(ctx, KeyPrefix)
+	require.NoError(t, err)
+	for _, name := range ls.Names() {
+		if strings.HasSuffix(name, blockSuffix) {
+			require.NoError(t, raw.Store(ctx, name, []byte("corrupt")))
+		}
+	}
+	_, err = st.Load(ctx, b1Name)
+	assert.ErrorIs(t, err, snapshot.ErrCorrupt)
+}
+
+func TestBackend_GC(t *testing.T) {
+	ctx := context.Background()
+	raw := memory.New()
+	st := New(raw, testConf, nil).(*Backend)
+	a1Name, b1Name := testName("a", 1), testName("b", 1)
+
+	require.NoError(t, st.Store(ctx, a1Name, writeSnapshot(t, "a", 1)))
+	require.NoError(t, st.Store(ctx, b1Name, writeSnapshot(t, "b", 1)))
+	require.NoError(t, st.Delete(ctx, a1Name))
+	assert.Equal(t, 3, countKeys(t, raw, blockSuffix))
+
+	// The first scan only records unused objects
+	require.NoError(t, st.GC(ctx))
+	assert.Equal(t, 3, countKeys(t, raw, blockSuffix))
+	assert.Equal(t, 4, countKeys(t, raw, refInfix))
+
+	// The second one deletes the block only used by the deleted snapshot,
+	// and its references
+	require.NoError(t, st.GC(ctx))
+	assert.Equal(t, 2, countKeys(t, raw, blockSuffix))
+	assert.Equal(t, 2, countKeys(t, raw, refInfix))
+
+	data, err := st.Load(ctx, b1Name)
+	require.NoError(t, err)
+	assert.Equal(t, writeSnapshot(t, "b", 1), data)
+}
+
+func TestBackend_hashKey(t *testing.T) {
+	ctx := context.Background()
+	raw := memory.New()
+	st := New(raw, testConf, []byte("key one"))
+	other := New(raw, testConf, []byte("key two"))
+	plain := New(raw, testConf, nil)
+
+	a1Name, b1Name := testName("a", 1), testName("b", 1)
+	a1 := writeSnapshot(t, "a", 1)
+	require.NoError(t, st.Store(ctx, a1Name, a1))
+	require.NoError(t, other.Store(ctx, b1Name, writeSnapshot(t, "b", 1)))
+
+	// The shared DBI is not shared between keys, and no block is named after
+	// its SHA-256 hash
+	assert.Equal(t, 4, countKeys(t, raw, blockSuffix))
+	m, err := plain.(*Backend).loadManifest(ctx, a1Name)
+	require.NoError(t, err)
+	for _, p := range m.Parts {
+		if p.Hash != "" {
+			assert.NotEqual(t, p.SHA256, p.Hash)
+			assert.Equal(t, 0, countKeys(t, raw, p.SHA256))
+		}
+	}
+
+	// Blocks are verified without the key
+	for _, st := range []simpleblob.Interface{st, other, plain} {
+		loaded, err := st.Load(ctx, a1Name)
+		require.NoError(t, err)
+		assert.Equal(t, a1, loaded)
+	}
+}
+
+// versioned adds conditional writes to a memory backend, with a single
+// version for all blobs
+type versioned struct {
+	*memory.Backend
+	version string
+}
+
+func (b *versioned) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	data, err := b.Load(ctx, name)
+	return data, b.version, err
+}
+
+func (b *versioned) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	if version != b.version {
+		return conditional.ErrPreconditionFailed
+	}
+	b.version += "+"
+	return b.Store(ctx, name, data)
+}
+
+func TestBackend_conditional(t *testing.T) {
+	ctx := context.Background()
+	_, _, err := conditional.LoadVersion(ctx, New(memory.New(), testConf, nil), "db.lease")
+	assert.ErrorIs(t, err, conditional.ErrUnsupported)
+
+	raw := &versioned{Backend: memory.New()}
+	st := New(raw, testConf, nil)
+
+	// Other blobs are passed on
+	require.NoError(t, conditional.StoreIf(ctx, st, "db.lease", []byte("lease"), ""))
+	data, version, err := conditional.LoadVersion(ctx, st, "db.lease")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("lease"), data)
+	assert.Equal(t, "+", version)
+	assert.ErrorIs(t, conditional.StoreIf(ctx, st, "db.lease", []byte("lease"), ""),
+		conditional.ErrPreconditionFailed)
+
+	// Snapshots are stored as a manifest
+	name := testName("a", 1)
+	a1 := writeSnapshot(t, "a", 1)
+	require.NoError(t, conditional.StoreIf(ctx, st, name, a1, version))
+	manifestData, err := raw.Load(ctx, name)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(manifestData, magicManifest))
+	data, version, err = conditional.LoadVersion(ctx, st, name)
+	require.NoError(t, err)
+	assert.Equal(t, a1, data)
+	assert.Equal(t, "++", version)
+}
+
+func TestBackend_perDBI(t *testing.T) {
+	ctx := context.Background()
+	raw, err := fs.New(fs.Options{RootPath: t.TempDir()})
+	require.NoError(t, err)
+	conf := testConf
+	conf.PerDBI = true
+	st := New(raw, conf, nil)
+
+	// Small chunks, so that every DBI has multiple blocks
+	var buf bytes.Buffer
+	sw, err := snapshot.NewStreamWriter(&buf, snapshot.Compression{Framed: true}, 3, 2)
+	require.NoError(t, err)
+	sw.ChunkSize = 4096
+	for _, dbi := range []string{"one", "two"} {
+		require.NoError(t, sw.StartDBI(dbi, 0, ""))
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, sw.Append(snapshot.KV{
+				Key:   []byte(fmt.Sprintf("key-%06d", i)),
+				Value: []byte(fmt.Sprintf("%s-value-%06d", dbi, i*7919%10007)),
+			}))
+		}
+		require.NoError(t, sw.EndDBI())
+	}
+	_, err = sw.Close(snapshot.Meta{GenerationID: "gen", InstanceID: "a", DatabaseName: "db"})
+	require.NoError(t, err)
+	data := buf.Bytes()
+
+	name := testName("a", 1)
+	require.NoError(t, st.Store(ctx, name, data))
+	ls, err := raw.List(ctx, KeyPrefix)
+	require.NoError(t, err)
+	var blocks []string
+	for _, key := range ls.Names() {
+		if strings.HasSuffix(key, blockSuffix) {
+			blocks = append(blocks, key)
+		}
+	}
+	assert.Len(t, blocks, 2, "one object per DBI")
+
+	// A partial snapshot with one DBI can be read with ranged loads, like the
+	// receiver does with storage_partial_downloads
+	ls, err = st.List(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{name}, ls.Names())
+	require.Equal(t, int64(len(data)), ls[0].Size)
+	fr, err := snapshot.NewFramedReader(&rangeReader{st: st, name: name}, ls[0].Size, nil)
+	require.NoError(t, err)
+	partial, err := fr.Partial([]string{"two"})
+	require.NoError(t, err)
+	snap, err := snapshot.LoadData(partial)
+	require.NoError(t, err)
+	for _, dbi := range snap.Databases {
+		assert.Equal(t, "two", dbi.Name())
+	}
+}
+
+type rangeReader struct {
+	st   simpleblob.Interface
+	name string
+}
+
+func (rr *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	data, err := ranged.Load(context.Background(), rr.st, rr.name, off, int64(len(p)))
+	return copy(p, data), err
+}
@@ -0,0 +1,356 @@
+// Package encryption implements a simpleblob.Interface wrapper that encrypts
+// all stored blobs on the client side and decrypts them when loaded.
+//
+// Two types of encryption are supported:
+//
+//   - "aes-gcm" uses a symmetric 256 bit key shared by all instances.
+//   - "age" uses age (https://age-encryption.org) X25519 recipients to encrypt
+//     and the corresponding identities to decrypt.
+//
+// The type of encryption is detected when a blob is loaded. Unencrypted blobs
+// can optionally be allowed to migrate an existing bucket.
+//
+// The name of a blob is authenticated together with its contents, so that a
+// blob cannot be replaced by a copy of another blob encrypted with the same
+// key. With aes-gcm the name is the additional data, and with age it is
+// stored in front of the data.
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/PowerDNS/simpleblob"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+var (
+	// magicAESGCM is the prefix of blobs encrypted with aes-gcm, followed
+	// by the nonce and the ciphertext.
+	magicAESGCM = []byte("LSAESGCM1\n")
+	// magicAge is the prefix of the age file format
+	magicAge = []byte("age-encryption.org/v1\n")
+)
+
+const (
+	// ageChunkSize and ageChunkOverhead describe the chunks of the age
+	// payload, which follows a 16 byte nonce after the header
+	ageChunkSize     = 64 * 1024
+	ageChunkOverhead = 16
+	ageNonceSize     = 16
+)
+
+// ErrNotEncrypted is returned when loading a blob that is not encrypted
+// and unencrypted blobs are not allowed.
+var ErrNotEncrypted = errors.New("encryption: blob is not encrypted")
+
+// Backend wraps a storage backend with encryption. Blobs are encrypted as a
+// whole, so it does not support ranged loads.
+type Backend struct {
+	st   simpleblob.Interface
+	conf config.Encryption
+
+	aead       cipher.AEAD // for aes-gcm
+	recipients []age.Recipient
+	identities []age.Identity
+	ageHeader  int64 // size of the age header for our recipients
+}
+
+// New wraps a storage backend with encryption. If the encryption type is
+// not set, the backend is returned as is.
+func New(st simpleblob.Interface, conf config.Encryption) (simpleblob.Interface, error) {
+	if conf.Type == "" {
+		return st, nil
+	}
+	b := &Backend{
+		st:   st,
+		conf: conf,
+	}
+	switch conf.Type {
+	case "aes-gcm":
+		key, err := loadKeyFile(conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+		b.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+	case "age":
+		var err error
+		b.identities, err = loadIdentityFile(conf.AgeIdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range conf.AgeRecipients {
+			r, err := age.ParseX25519Recipient(s)
+			if err != nil {
+				return nil, fmt.Errorf("encryption: age_recipients: %w", err)
+			}
+			b.recipients = append(b.recipients, r)
+		}
+		if len(b.recipients) == 0 {
+			// Encrypt to ourselves
+			for _, id := range b.identities {
+				if xid, ok := id.(*age.X25519Identity); ok {
+					b.recipients = append(b.recipients, xid.Recipient())
+				}
+			}
+		}
+		if len(b.recipients) == 0 {
+			return nil, fmt.Errorf("encryption: no age recipients")
+		}
+		// The header size only depends on the recipients, and the payload
+		// of an empty blob is a nonce and a single empty chunk
+		enc, err := b.encrypt("", nil)
+		if err != nil {
+			return nil, err
+		}
+		b.ageHeader = int64(len(enc)) - ageNonceSize - ageChunkOverhead - 2
+	default:
+		return nil, fmt.Errorf("encryption: unsupported type %q", conf.Type)
+	}
+	return b, nil
+}
+
+// loadKeyFile loads a 256 bit key stored as raw bytes or hex
+func loadKeyFile(fpath string) ([]byte, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: key_file: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption: key_file: expected 32 raw bytes or 64 hex characters")
+	}
+	return key, nil
+}
+
+// loadIdentityFile loads the age identities from a file
+func loadIdentityFile(fpath string) ([]age.Identity, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: age_identity_file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: age_identity_file: %w", err)
+	}
+	return ids, nil
+}
+
+// DeriveKey returns a 256 bit key for the given purpose, derived from the
+// secret key of the encryption, or nil if encryption is disabled. With age,
+// the key is derived from the identities, so instances only derive the same
+// key if they use the same identities.
+func DeriveKey(conf config.Encryption, purpose string) ([]byte, error) {
+	var secret []byte
+	switch conf.Type {
+	case "":
+		return nil, nil
+	case "aes-gcm":
+		key, err := loadKeyFile(conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		secret = key
+	case "age":
+		ids, err := loadIdentityFile(conf.AgeIdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if xid, ok := id.(*age.X25519Identity); ok {
+				secret = append(secret, xid.String()...)
+			}
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("encryption: no age X25519 identities")
+		}
+	default:
+		return nil, fmt.Errorf("encryption: unsupported type %q", conf.Type)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("lightningstream " + purpose))
+	return mac.Sum(nil), nil
+}
+
+// List returns the blobs of the underlying backend, with the sizes of the
+// decrypted blobs. These are calculated from the encrypted sizes, assuming
+// that the blobs are encrypted with the configured type and, for age, to the
+// same number of recipients.
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	ls, err := b.st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ls {
+		ls[i].Size = b.plainSize(ls[i].Name, ls[i].Size)
+	}
+	return ls, nil
+}
+
+// plainSize returns the size of the decrypted blob for the size of the
+// encrypted blob
+func (b *Backend) plainSize(name string, size int64) int64 {
+	if b.aead != nil {
+		size -= int64(len(magicAESGCM) + b.aead.NonceSize() + b.aead.Overhead())
+	} else {
+		size -= b.ageHeader + ageNonceSize
+		chunks := (size + ageChunkSize + ageChunkOverhead - 1) / (ageChunkSize + ageChunkOverhead)
+		size -= chunks*ageChunkOverhead + 2 + int64(len(name))
+	}
+	if size < 0 {
+		return 0 // not encrypted the way we expect
+	}
+	return size
+}
+
+// Load loads and decrypts a blob
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	data, err := b.st.Load(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return b.decrypt(name, data)
+}
+
+// Store encrypts and stores a blob
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	enc, err := b.encrypt(name, data)
+	if err != nil {
+		return err
+	}
+	return b.st.Store(ctx, name, enc)
+}
+
+// LoadVersion loads and decrypts a blob and returns the version of the
+// encrypted blob, if the wrapped backend supports conditional writes
+func (b *Backend) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	data, version, err := conditional.LoadVersion(ctx, b.st, name)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err = b.decrypt(name, data)
+	return data, version, err
+}
+
+// StoreIf encrypts and conditionally stores a blob, if the wrapped backend
+// supports it
+func (b *Backend) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	enc, err := b.encrypt(name, data)
+	if err != nil {
+		return err
+	}
+	return conditional.StoreIf(ctx, b.st, name, enc, version)
+}
+
+// Delete deletes a blob
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	return b.st.Delete(ctx, name)
+}
+
+// encrypt encrypts the data of the named blob
+func (b *Backend) encrypt(name string, data []byte) ([]byte, error) {
+	if b.aead != nil {
+		nonceSize := b.aead.NonceSize()
+		out := make([]byte, len(magicAESGCM)+nonceSize, len(magicAESGCM)+nonceSize+len(data)+b.aead.Overhead())
+		copy(out, magicAESGCM)
+		nonce := out[len(magicAESGCM):]
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return b.aead.Seal(out, nonce, data, []byte(name)), nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)+1024))
+	w, err := age.Encrypt(buf, b.recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	if _, err := w.Write(ageNamePrefix(name)); err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ageNamePrefix returns the name of a blob as stored in front of its data
+// with age, prefixed with its length
+func ageNamePrefix(name string) []byte {
+	out := make([]byte, 2, 2+len(name))
+	binary.BigEndian.PutUint16(out, uint16(len(name)))
+	return append(out, name...)
+}
+
+// decrypt decrypts the data of the named blob
+func (b *Backend) decrypt(name string, data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, magicAESGCM):
+		if b.aead == nil {
+			return nil, fmt.Errorf("encryption: blob encrypted with aes-gcm, but no key_file configured")
+		}
+		data = data[len(magicAESGCM):]
+		nonceSize := b.aead.NonceSize()
+		if len(data) < nonceSize {
+			return nil, fmt.Errorf("encryption: blob too short")
+		}
+		nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+		out, err := b.aead.Open(nil, nonce, ciphertext, []byte(name))
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+		return out, nil
+	case bytes.HasPrefix(data, magicAge):
+		if len(b.identities) == 0 {
+			return nil, fmt.Errorf("encryption: blob encrypted with age, but no age_identity_file configured")
+		}
+		r, err := age.Decrypt(bytes.NewReader(data), b.identities...)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, len(data)))
+		if _, err := io.Copy(buf, r); err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+		prefix := ageNamePrefix(name)
+		if !bytes.HasPrefix(buf.Bytes(), prefix) {
+			return nil, fmt.Errorf("encryption: blob was encrypted under a different name")
+		}
+		return buf.Bytes()[len(prefix):], nil
+	default:
+		if b.conf.AllowUnencrypted {
+			return data, nil
+		}
+		return nil, ErrNotEncrypted
+	}
+}
@@ -0,0 +1,195 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+func writeFile(t *testing.T, name, contents string) string {
+	fpath := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(fpath, []byte(contents), 0600))
+	return fpath
+}
+
+// versioned adds conditional writes to a memory backend, with a single
+// version for all blobs
+type versioned struct {
+	*memory.Backend
+	version string
+}
+
+func (b *versioned) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	data, err := b.Load(ctx, name)
+	return data, b.version, err
+}
+
+func (b *versioned) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	if version != b.version {
+		return conditional.ErrPreconditionFailed
+	}
+	b.version += "+"
+	return b.Store(ctx, name, data)
+}
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		conf  config.Encryption
+		magic []byte
+	}{
+		{
+			"aes-gcm",
+			config.Encryption{
+				Type:    "aes-gcm",
+				KeyFile: writeFile(t, "key", strings.Repeat("ab", 32)+"\n"),
+			},
+			magicAESGCM,
+		},
+		{
+			"age",
+			config.Encryption{
+				Type:            "age",
+				AgeIdentityFile: writeFile(t, "identity", id.String()+"\n"),
+			},
+			magicAge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := New(memory.New(), tt.conf)
+			require.NoError(t, err)
+			tester.DoBackendTests(t, st)
+
+			raw := memory.New()
+			st, err = New(raw, tt.conf)
+			require.NoError(t, err)
+
+			// Stored data is encrypted
+			data := []byte("secret record contents")
+			require.NoError(t, st.Store(ctx, "snap", data))
+			enc, err := raw.Load(ctx, "snap")
+			require.NoError(t, err)
+			assert.True(t, bytes.HasPrefix(enc, tt.magic))
+			assert.False(t, bytes.Contains(enc, data))
+
+			// Listed sizes are those of the decrypted blobs, also for age
+			// payloads with multiple chunks
+			large := bytes.Repeat([]byte("x"), 3*64*1024+1)
+			require.NoError(t, st.Store(ctx, "snap-large", large))
+			ls, err := st.List(ctx, "")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"snap", "snap-large"}, ls.Names())
+			assert.Equal(t, int64(len(data)), ls[0].Size)
+			assert.Equal(t, int64(len(large)), ls[1].Size)
+
+			loaded, err := st.Load(ctx, "snap")
+			require.NoError(t, err)
+			assert.Equal(t, data, loaded)
+
+			// The name is authenticated, so a blob cannot be copied to
+			// another name
+			require.NoError(t, raw.Store(ctx, "snap-copy", enc))
+			_, err = st.Load(ctx, "snap-copy")
+			assert.Error(t, err)
+
+			// Unencrypted data is rejected, unless explicitly allowed
+			require.NoError(t, raw.Store(ctx, "plain", data))
+			_, err = st.Load(ctx, "plain")
+			assert.ErrorIs(t, err, ErrNotEncrypted)
+
+			conf := tt.conf
+			conf.AllowUnencrypted = true
+			st, err = New(raw, conf)
+			require.NoError(t, err)
+			loaded, err = st.Load(ctx, "plain")
+			require.NoError(t, err)
+			assert.Equal(t, data, loaded)
+
+			// Conditional writes are passed on if supported
+			_, _, err = conditional.LoadVersion(ctx, st, "plain")
+			assert.ErrorIs(t, err, conditional.ErrUnsupported)
+			vraw := &versioned{Backend: memory.New()}
+			st, err = New(vraw, tt.conf)
+			require.NoError(t, err)
+			require.NoError(t, conditional.StoreIf(ctx, st, "lease", data, ""))
+			enc, err = vraw.Load(ctx, "lease")
+			require.NoError(t, err)
+			assert.True(t, bytes.HasPrefix(enc, tt.magic))
+			loaded, version, err := conditional.LoadVersion(ctx, st, "lease")
+			require.NoError(t, err)
+			assert.Equal(t, data, loaded)
+			assert.Equal(t, "+", version)
+			assert.ErrorIs(t, conditional.StoreIf(ctx, st, "lease", data, ""), conditional.ErrPreconditionFailed)
+		})
+	}
+}
+
+func TestBackend_wrongKey(t *testing.T) {
+	ctx := context.Background()
+	raw := memory.New()
+	st1, err := New(raw, config.Encryption{
+		Type:    "aes-gcm",
+		KeyFile: writeFile(t, "key", strings.Repeat("ab", 32)),
+	})
+	require.NoError(t, err)
+	st2, err := New(raw, config.Encryption{
+		Type:    "aes-gcm",
+		KeyFile: writeFile(t, "key", strings.Repeat("cd", 32)),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, st1.Store(ctx, "snap", []byte("foo")))
+	_, err = st2.Load(ctx, "snap")
+	assert.Error(t, err)
+
+	_, err = New(raw, config.Encryption{
+		Type:    "aes-gcm",
+		KeyFile: writeFile(t, "key", "too short"),
+	})
+	assert.Error(t, err)
+}
+
+func TestDeriveKey(t *testing.T) {
+	key, err := DeriveKey(config.Encryption{}, "dedup")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	for _, conf := range []config.Encryption{
+		{
+			Type:    "aes-gcm",
+			KeyFile: writeFile(t, "key", strings.Repeat("ab", 32)),
+		},
+		{
+			Type:            "age",
+			AgeIdentityFile: writeFile(t, "identity", id.String()+"\n"),
+		},
+	} {
+		key, err := DeriveKey(conf, "dedup")
+		require.NoError(t, err)
+		assert.Len(t, key, 32)
+		again, err := DeriveKey(conf, "dedup")
+		require.NoError(t, err)
+		assert.Equal(t, key, again)
+		other, err := DeriveKey(conf, "other")
+		require.NoError(t, err)
+		assert.NotEqual(t, key, other)
+	}
+}
@@ -0,0 +1,282 @@
+// Package failover implements a simpleblob.Interface wrapper that fails over
+// to a secondary storage backend while the primary one fails, and fails back
+// once the primary is healthy again.
+//
+// The health of the primary is tracked through the results of the storage
+// operations and through a listing that is used as a probe at a regular
+// interval. Failing operations are not retried on the secondary: the caller
+// retries them anyway, and the retry goes to the secondary after a failover.
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/backends/lazy"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/status/webhook"
+)
+
+// probePrefix is listed to probe a backend. It does not need to exist.
+const probePrefix = "__lightningstream_probe__"
+
+var (
+	metricActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_storage_failover_active",
+			Help: "Set to 1 while the secondary storage backend is in use",
+		},
+	)
+	metricSwitches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_storage_failover_switches_total",
+			Help: "Number of switches between storage backends, by the backend switched to",
+		},
+		[]string{"backend"},
+	)
+	metricProbeFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_storage_failover_probe_failures_total",
+			Help: "Number of failed health probes, by storage backend",
+		},
+		[]string{"backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricActive)
+	prometheus.MustRegister(metricSwitches)
+	prometheus.MustRegister(metricProbeFailures)
+}
+
+// Backend uses the primary storage backend, or the secondary one while the
+// primary fails
+type Backend struct {
+	primary   *lazy.Backend
+	secondary *lazy.Backend
+	conf      config.Failover
+	l         logrus.FieldLogger
+	check     chan struct{} // requests a probe before the next interval
+
+	mu          sync.Mutex
+	onSecondary bool // true while the secondary is in use
+	failures    int  // consecutive failures of the primary
+	successes   int  // consecutive successful probes of the primary after failover
+}
+
+// New opens a primary and secondary storage backend and starts probing the
+// primary until the context is cancelled. If the primary cannot be opened,
+// this counts as a failure, and we fail over right away if the secondary can
+// be opened. The backend that failed to open is opened again on its next use.
+func New(ctx context.Context, primary, secondary lazy.OpenFunc, conf config.Failover) (*Backend, error) {
+	b := &Backend{
+		primary:   lazy.New(ctx, primary),
+		secondary: lazy.New(ctx, secondary),
+		conf:      conf,
+		l:         logrus.WithField("component", "storage-failover"),
+		check:     make(chan struct{}, 1),
+	}
+	metricActive.Set(0)
+	if _, err := b.primary.Open(); err != nil {
+		if _, err2 := b.secondary.Open(); err2 != nil {
+			return nil, fmt.Errorf("primary: %v, secondary: %w", err, err2)
+		}
+		b.l.WithError(err).Error("Cannot open the primary storage")
+		b.failures = conf.FailureThreshold
+		b.update(ctx)
+	} else if _, err := b.secondary.Open(); err != nil {
+		b.l.WithError(err).Warn("Cannot open the secondary storage, will retry on failover")
+	}
+	go b.run(ctx)
+	return b, nil
+}
+
+// Secondary returns true while the secondary backend is in use
+func (b *Backend) Secondary() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.onSecondary
+}
+
+// List lists the blobs of the backend in use
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	st, secondary := b.active()
+	ls, err := st.List(ctx, prefix)
+	b.done(ctx, secondary, err)
+	return ls, err
+}
+
+// Load loads a blob from the backend in use
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	st, secondary := b.active()
+	data, err := st.Load(ctx, name)
+	b.done(ctx, secondary, err)
+	return data, err
+}
+
+// LoadRange loads part of a blob from the backend in use, if it supports it
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	st, secondary := b.active()
+	data, err := ranged.Load(ctx, st, name, offset, length)
+	if err == ranged.ErrUnsupported {
+		return nil, err
+	}
+	b.done(ctx, secondary, err)
+	return data, err
+}
+
+// Store stores a blob in the backend in use
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	st, secondary := b.active()
+	err := st.Store(ctx, name, data)
+	b.done(ctx, secondary, err)
+	return err
+}
+
+// Delete removes a blob from the backend in use
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	st, secondary := b.active()
+	err := st.Delete(ctx, name)
+	b.done(ctx, secondary, err)
+	return err
+}
+
+// active returns the backend to use
+func (b *Backend) active() (st *lazy.Backend, secondary bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.onSecondary {
+		return b.secondary, true
+	}
+	return b.primary, false
+}
+
+// done records the result of an operation on the primary. Missing blobs and
+// cancelled operations say nothing about the health of the backend.
+func (b *Backend) done(ctx context.Context, secondary bool, err error) {
+	if secondary || errors.Is(err, os.ErrNotExist) || ctx.Err() != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.onSecondary {
+		return // operation started before the failover
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.conf.FailureThreshold {
+		select {
+		case b.check <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run probes the primary at every interval, and right away when operations
+// reached the failure threshold
+func (b *Backend) run(ctx context.Context) {
+	ticker := time.NewTicker(b.conf.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.probePrimary(ctx)
+		case <-b.check:
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		b.update(ctx)
+	}
+}
+
+// probePrimary probes the primary and records the result
+func (b *Backend) probePrimary(ctx context.Context) {
+	err := b.probe(ctx, b.primary, "primary")
+	if ctx.Err() != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil && b.onSecondary:
+		b.successes++
+	case err == nil:
+		b.failures = 0
+	case b.onSecondary:
+		b.successes = 0
+	default:
+		b.failures++
+	}
+}
+
+// update fails over or back when the thresholds are reached
+func (b *Backend) update(ctx context.Context) {
+	b.mu.Lock()
+	onSecondary := b.onSecondary
+	failover := !onSecondary && b.failures >= b.conf.FailureThreshold
+	failback := onSecondary && b.successes >= b.conf.FailbackAfter
+	b.mu.Unlock()
+
+	switch {
+	case failover:
+		// Only fail over if the secondary works
+		if err := b.probe(ctx, b.secondary, "secondary"); err != nil {
+			b.l.WithError(err).Warn("Primary storage is failing, but cannot fail over to the secondary")
+			return
+		}
+		b.l.Warn("Primary storage is failing, failing over to the secondary")
+		b.set(true)
+	case failback:
+		b.l.Info("Primary storage is healthy again, failing back")
+		b.set(false)
+	}
+}
+
+// set switches the backend in use
+func (b *Backend) set(secondary bool) {
+	b.mu.Lock()
+	b.onSecondary = secondary
+	b.failures = 0
+	b.successes = 0
+	b.mu.Unlock()
+
+	name := "primary"
+	if secondary {
+		name = "secondary"
+		metricActive.Set(1)
+	} else {
+		metricActive.Set(0)
+	}
+	metricSwitches.WithLabelValues(name).Inc()
+	webhook.Notify(webhook.Event{
+		Event:   webhook.EventFailover,
+		Backend: name,
+	})
+}
+
+// probe lists a prefix that does not need to exist, with a timeout of the
+// probe interval
+func (b *Backend) probe(ctx context.Context, st *lazy.Backend, name string) error {
+	probeCtx, cancel := context.WithTimeout(ctx, b.conf.ProbeInterval)
+	defer cancel()
+	_, err := st.List(probeCtx, probePrefix)
+	if err != nil && ctx.Err() == nil {
+		metricProbeFailures.WithLabelValues(name).Inc()
+		b.l.WithError(err).WithField("backend", name).Debug("Storage probe failed")
+	}
+	return err
+}
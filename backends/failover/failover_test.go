@@ -0,0 +1,139 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"powerdns.com/platform/lightningstream/backends/lazy"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+var errDown = errors.New("connection refused")
+
+// flaky fails all operations while down is set
+type flaky struct {
+	simpleblob.Interface
+	down atomic.Bool
+}
+
+func (f *flaky) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	if f.down.Load() {
+		return nil, errDown
+	}
+	return f.Interface.List(ctx, prefix)
+}
+
+func (f *flaky) Store(ctx context.Context, name string, data []byte) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return f.Interface.Store(ctx, name, data)
+}
+
+func open(st simpleblob.Interface) lazy.OpenFunc {
+	return func(ctx context.Context) (simpleblob.Interface, error) {
+		return st, nil
+	}
+}
+
+func testConf() config.Failover {
+	return config.Failover{
+		Enabled:          true,
+		FailureThreshold: 2,
+		ProbeInterval:    10 * time.Millisecond,
+		FailbackAfter:    2,
+	}
+}
+
+func TestBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary := &flaky{Interface: memory.New()}
+	secondary := &flaky{Interface: memory.New()}
+	b, err := New(ctx, open(primary), open(secondary), testConf())
+	require.NoError(t, err)
+
+	require.NoError(t, b.Store(ctx, "a", []byte("a")))
+	_, err = primary.Load(ctx, "a")
+	require.NoError(t, err)
+	_, err = b.Load(ctx, "missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.False(t, b.Secondary())
+
+	// Failing operations trigger a failover
+	primary.down.Store(true)
+	require.Error(t, b.Store(ctx, "b", []byte("b")))
+	require.Error(t, b.Store(ctx, "b", []byte("b")))
+	require.Eventually(t, b.Secondary, time.Second, time.Millisecond)
+	require.NoError(t, b.Store(ctx, "b", []byte("b")))
+	_, err = secondary.Load(ctx, "b")
+	require.NoError(t, err)
+
+	// Fail back once the probes succeed again
+	primary.down.Store(false)
+	require.Eventually(t, func() bool { return !b.Secondary() }, time.Second, time.Millisecond)
+	ls, err := b.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ls.Names())
+}
+
+func TestBackend_secondaryDown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary := &flaky{Interface: memory.New()}
+	secondary := &flaky{Interface: memory.New()}
+	secondary.down.Store(true)
+	b, err := New(ctx, open(primary), open(secondary), testConf())
+	require.NoError(t, err)
+
+	// No failover to a secondary that fails as well
+	primary.down.Store(true)
+	for i := 0; i < 3; i++ {
+		require.Error(t, b.Store(ctx, "a", []byte("a")))
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, b.Secondary())
+
+	secondary.down.Store(false)
+	require.Eventually(t, b.Secondary, time.Second, time.Millisecond)
+}
+
+func TestNew_primaryUnavailable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var opened atomic.Int32
+	primary := func(ctx context.Context) (simpleblob.Interface, error) {
+		if opened.Inc() < 3 {
+			return nil, errDown
+		}
+		return memory.New(), nil
+	}
+	b, err := New(ctx, primary, open(memory.New()), testConf())
+	require.NoError(t, err)
+	assert.True(t, b.Secondary())
+
+	// The probes open the primary once it is available
+	require.Eventually(t, func() bool { return !b.Secondary() }, time.Second, time.Millisecond)
+
+	_, err = New(ctx, primary, func(ctx context.Context) (simpleblob.Interface, error) {
+		return nil, errDown
+	}, testConf())
+	require.NoError(t, err) // primary opens now
+
+	opened.Store(0)
+	_, err = New(ctx, primary, func(ctx context.Context) (simpleblob.Interface, error) {
+		return nil, errDown
+	}, testConf())
+	require.Error(t, err)
+}
@@ -0,0 +1,315 @@
+// Package fs implements a simpleblob storage backend that stores snapshots
+// as files in a local directory, for example on an NFS share or in a
+// directory that is synced to other hosts with rsync.
+//
+// Files are written to a temporary file first and then atomically renamed,
+// so that readers never see partially written snapshots. With the 'fsync'
+// option, the file and the directory are synced to disk before a store is
+// considered successful.
+//
+// A "/" in a blob name is a directory separator, like in the object keys of
+// S3, so that prefixes like "backups/" end up in their own subdirectory.
+// Directories are created as needed and removed again when they are empty.
+// A name cannot be used for both a blob and a directory.
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/PowerDNS/simpleblob"
+)
+
+const (
+	// TypeName is the name this backend is registered under
+	TypeName = "fs"
+
+	DefaultDirMask  = 0775
+	DefaultFileMask = 0664
+
+	// tmpPrefix is the prefix used for temporary files. Files starting with
+	// a dot are never returned by List.
+	tmpPrefix = ".tmp-"
+)
+
+// Options describes the storage options for the fs backend
+type Options struct {
+	// RootPath is the directory to store the snapshots in (required)
+	RootPath string `yaml:"root_path"`
+
+	// Fsync makes Store sync the file and the directory to disk before
+	// returning. This is slower, but ensures that a stored snapshot survives
+	// a crash or power loss.
+	Fsync bool `yaml:"fsync"`
+
+	// DirMask is the mode used when creating the root directory and its
+	// subdirectories
+	DirMask os.FileMode `yaml:"dir_mask"`
+
+	// FileMask is the mode used for new files
+	FileMask os.FileMode `yaml:"file_mask"`
+}
+
+// Check validates the options
+func (o Options) Check() error {
+	if o.RootPath == "" {
+		return fmt.Errorf("fs storage.options: root_path is required")
+	}
+	return nil
+}
+
+// Backend is the filesystem storage backend
+type Backend struct {
+	opt Options
+}
+
+// New creates a new backend instance. The root directory is created if it
+// does not exist yet.
+func New(opt Options) (*Backend, error) {
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	if opt.DirMask == 0 {
+		opt.DirMask = DefaultDirMask
+	}
+	if opt.FileMask == 0 {
+		opt.FileMask = DefaultFileMask
+	}
+	opt.RootPath = filepath.Clean(opt.RootPath)
+	if err := os.MkdirAll(opt.RootPath, opt.DirMask); err != nil {
+		return nil, fmt.Errorf("fs: create root_path: %w", err)
+	}
+	return &Backend{opt: opt}, nil
+}
+
+// allowedName returns true if the name is safe to use as a path relative to
+// the root directory. Every "/" separated part must be a valid filename.
+func allowedName(name string) bool {
+	if name == "" || strings.Contains(name, `\`) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// path returns the filesystem path of a blob name
+func (b *Backend) path(name string) string {
+	return filepath.Join(b.opt.RootPath, filepath.FromSlash(name))
+}
+
+// List returns the blobs with given prefix, ordered by name. Temporary files
+// and other hidden files are ignored. Only the subdirectories that can
+// contain names with the prefix are read.
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	var blobs simpleblob.BlobList
+	err := filepath.WalkDir(b.opt.RootPath, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != b.opt.RootPath {
+				return nil // removed since its parent was read
+			}
+			return err
+		}
+		if path == b.opt.RootPath {
+			return nil
+		}
+		rel, err := filepath.Rel(b.opt.RootPath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if entry.IsDir() {
+			dir := name + "/"
+			if !allowedName(name) || !(strings.HasPrefix(dir, prefix) || strings.HasPrefix(prefix, dir)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !allowedName(name) || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed since ReadDir
+			}
+			return err
+		}
+		blobs = append(blobs, simpleblob.Blob{
+			Name: name,
+			Size: info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, nil
+}
+
+// Load returns the contents of the named blob. If the blob does not exist,
+// os.ErrNotExist is returned.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	if !allowedName(name) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(b.path(name))
+	if os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+// LoadRange returns length bytes of the named blob, starting at offset
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	if !allowedName(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.Open(b.path(name))
+	if os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if err == io.EOF {
+		err = nil // short read, reported by the caller
+	}
+	return data[:n], err
+}
+
+// Store atomically stores the blob under the given name. Missing
+// directories are created.
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	if !allowedName(name) {
+		return fmt.Errorf("fs: invalid name: %q", name)
+	}
+	path := b.path(name)
+	dir := filepath.Dir(path)
+	created, err := b.mkdirAll(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, tmpPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	ok := false
+	defer func() {
+		if !ok {
+			_ = f.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chmod(b.opt.FileMask); err != nil {
+		return err
+	}
+	if b.opt.Fsync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	ok = true
+	if b.opt.Fsync {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+		// New directories are only persisted once their parents are synced
+		for _, d := range created {
+			if err := syncDir(filepath.Dir(d)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete removes the named blob, and the directories that are empty
+// afterwards. Removing a blob that does not exist is not an error.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	if !allowedName(name) {
+		return nil
+	}
+	path := b.path(name)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != b.opt.RootPath; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty, or already removed
+		}
+	}
+	return nil
+}
+
+// mkdirAll creates dir and its missing parents below the root directory, and
+// returns the directories it created.
+func (b *Backend) mkdirAll(dir string) (created []string, err error) {
+	var missing []string
+	for d := dir; d != b.opt.RootPath; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], b.opt.DirMask); err != nil {
+			if os.IsExist(err) {
+				continue // created by a concurrent store
+			}
+			return created, err
+		}
+		created = append(created, missing[i])
+	}
+	return created, nil
+}
+
+// syncDir syncs a directory, which persists renames and removals
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+func init() {
+	simpleblob.RegisterBackend(TypeName, func(ctx context.Context, p simpleblob.InitParams) (simpleblob.Interface, error) {
+		var opt Options
+		if err := p.OptionsThroughYAML(&opt); err != nil {
+			return nil, err
+		}
+		return New(opt)
+	})
+}
@@ -0,0 +1,102 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackend(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		b, err := New(Options{
+			RootPath: t.TempDir(),
+			Fsync:    fsync,
+		})
+		require.NoError(t, err)
+		tester.DoBackendTests(t, b)
+	}
+}
+
+func TestBackend_Store(t *testing.T) {
+	ctx := context.Background()
+	root := filepath.Join(t.TempDir(), "snapshots")
+	b, err := New(Options{
+		RootPath: root,
+		FileMask: 0600,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, b.Store(ctx, "foo", []byte("bar")))
+	st, err := os.Stat(filepath.Join(root, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), st.Mode().Perm())
+
+	// Leftover temporary files from an interrupted store are not listed
+	require.NoError(t, os.WriteFile(filepath.Join(root, tmpPrefix+"foo-123"), nil, 0644))
+	ls, err := b.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, ls.Names())
+
+	// Names that could escape the root are rejected
+	assert.Error(t, b.Store(ctx, "../foo", []byte("bar")))
+	assert.Error(t, b.Store(ctx, ".hidden", []byte("bar")))
+	_, err = b.Load(ctx, "../snapshots/foo")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBackend_subdirectories(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	b, err := New(Options{
+		RootPath: root,
+		Fsync:    true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, b.Store(ctx, "foo", []byte("1")))
+	require.NoError(t, b.Store(ctx, "backups/foo", []byte("22")))
+	require.NoError(t, b.Store(ctx, "backups/daily/foo", []byte("333")))
+	require.NoError(t, b.Store(ctx, "backups-foo", []byte("4444")))
+	_, err = os.Stat(filepath.Join(root, "backups", "daily", "foo"))
+	require.NoError(t, err)
+
+	data, err := b.Load(ctx, "backups/daily/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("333"), data)
+	data, err = b.LoadRange(ctx, "backups/foo", 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), data)
+
+	ls, err := b.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups-foo", "backups/daily/foo", "backups/foo", "foo"}, ls.Names())
+	ls, err = b.List(ctx, "backups/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/daily/foo", "backups/foo"}, ls.Names())
+	assert.Equal(t, int64(3), ls[0].Size)
+	ls, err = b.List(ctx, "backups/d")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/daily/foo"}, ls.Names())
+
+	// Empty directories are removed, but not the root
+	require.NoError(t, b.Delete(ctx, "backups/daily/foo"))
+	_, err = os.Stat(filepath.Join(root, "backups", "daily"))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, b.Delete(ctx, "backups/foo"))
+	_, err = os.Stat(filepath.Join(root, "backups"))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, b.Delete(ctx, "foo"))
+	require.NoError(t, b.Delete(ctx, "backups-foo"))
+	_, err = os.Stat(root)
+	assert.NoError(t, err)
+
+	// Empty and hidden path elements are rejected
+	for _, name := range []string{"/foo", "foo/", "foo//bar", "foo/.tmp-bar", "foo/../bar", `foo\bar`} {
+		assert.Error(t, b.Store(ctx, name, []byte("bar")), name)
+	}
+}
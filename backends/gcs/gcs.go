@@ -0,0 +1,384 @@
+// Package gcs implements a simpleblob storage backend for Google Cloud
+// Storage, using the GCS JSON API.
+//
+// Credentials are taken from a service account JSON key file, or from the
+// metadata server when running on GCE or on GKE with workload identity.
+// Objects can be encrypted with a customer-managed encryption key (CMEK) in
+// Cloud KMS.
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/backends/httpclient"
+)
+
+const (
+	// TypeName is the name this backend is registered under
+	TypeName = "gcs"
+
+	// DefaultEndpoint is the GCS JSON API endpoint
+	DefaultEndpoint = "https://storage.googleapis.com"
+
+	// DefaultInitTimeout is the default timeout for the initial bucket check
+	DefaultInitTimeout = 20 * time.Second
+
+	// DefaultRequestTimeout is the default timeout for a single request
+	DefaultRequestTimeout = 5 * time.Minute
+)
+
+// Options describes the storage options for the GCS backend
+type Options struct {
+	// Bucket is the name of the GCS bucket (required)
+	Bucket string `yaml:"bucket"`
+
+	// CredentialsFile is the path to a service account JSON key file. If not
+	// set, GOOGLE_APPLICATION_CREDENTIALS is used if set, and otherwise the
+	// metadata server, which supports GKE workload identity.
+	CredentialsFile string `yaml:"credentials_file"`
+
+	// KMSKeyName is the Cloud KMS key to encrypt new objects with (CMEK), in
+	// the form 'projects/P/locations/L/keyRings/R/cryptoKeys/K'. If not set,
+	// the bucket default encryption applies.
+	KMSKeyName string `yaml:"kms_key_name"`
+
+	// GlobalPrefix is prepended to all object names, e.g. 'lightningstream/'.
+	GlobalPrefix string `yaml:"global_prefix"`
+
+	// EndpointURL overrides the GCS API endpoint, e.g. for an emulator.
+	EndpointURL string `yaml:"endpoint_url"`
+
+	// MetadataURL overrides the metadata server token URL.
+	// This is only useful for testing.
+	MetadataURL string `yaml:"metadata_url"`
+
+	// NoAuth disables authentication, e.g. for an emulator.
+	NoAuth bool `yaml:"no_auth"`
+
+	// InitTimeout is the timeout for the initial bucket check on startup.
+	InitTimeout time.Duration `yaml:"init_timeout"`
+
+	// RequestTimeout is the timeout for a single API request.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+
+	// HTTP configures the proxy and TLS settings (proxy_url, no_proxy, tls
+	// and tls_min_version). These do not apply to the metadata server.
+	HTTP httpclient.Options `yaml:",inline"`
+}
+
+// Check validates the options
+func (o Options) Check() error {
+	if o.Bucket == "" {
+		return fmt.Errorf("gcs storage.options: bucket is required")
+	}
+	if o.EndpointURL != "" {
+		u, err := url.Parse(o.EndpointURL)
+		if err != nil {
+			return fmt.Errorf("gcs storage.options: endpoint_url: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("gcs storage.options: endpoint_url: unsupported scheme %q", u.Scheme)
+		}
+	}
+	if o.KMSKeyName != "" && !strings.HasPrefix(o.KMSKeyName, "projects/") {
+		return fmt.Errorf("gcs storage.options: kms_key_name: expected 'projects/.../cryptoKeys/...'")
+	}
+	if err := o.HTTP.Check("gcs storage.options"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Backend is the GCS storage backend
+type Backend struct {
+	opt      Options
+	endpoint string
+	client   *http.Client
+	tokens   *cachedTokenSource // nil if NoAuth
+}
+
+// New creates a new backend instance and checks if the bucket is accessible.
+func New(ctx context.Context, opt Options) (*Backend, error) {
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	if opt.InitTimeout == 0 {
+		opt.InitTimeout = DefaultInitTimeout
+	}
+	if opt.RequestTimeout == 0 {
+		opt.RequestTimeout = DefaultRequestTimeout
+	}
+	endpoint := opt.EndpointURL
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+
+	transport, err := opt.HTTP.Transport(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs storage.options: %w", err)
+	}
+
+	b := &Backend{
+		opt:      opt,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client: &http.Client{
+			Timeout:   opt.RequestTimeout,
+			Transport: transport,
+		},
+	}
+
+	if !opt.NoAuth {
+		credFile := opt.CredentialsFile
+		if credFile == "" {
+			credFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		var src tokenSource
+		if credFile != "" {
+			sa, err := newServiceAccountTokenSource(b.client, credFile)
+			if err != nil {
+				return nil, err
+			}
+			src = sa
+		} else {
+			// The link-local metadata server is never accessed through
+			// the configured proxy or with the custom TLS settings.
+			src = &metadataTokenSource{
+				client: &http.Client{Timeout: opt.RequestTimeout},
+				url:    opt.MetadataURL,
+			}
+		}
+		b.tokens = &cachedTokenSource{src: src}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opt.InitTimeout)
+	defer cancel()
+	u := b.endpoint + "/storage/v1/b/" + url.PathEscape(opt.Bucket) + "?fields=name"
+	if _, err := b.do(ctx, http.MethodGet, u, nil); err != nil {
+		return nil, fmt.Errorf("gcs: check bucket %q: %w", opt.Bucket, err)
+	}
+	return b, nil
+}
+
+// objectURL returns the JSON API URL for an object
+func (b *Backend) objectURL(name string) string {
+	return b.endpoint + "/storage/v1/b/" + url.PathEscape(b.opt.Bucket) +
+		"/o/" + url.PathEscape(b.opt.GlobalPrefix+name)
+}
+
+// do performs an authenticated API request and returns the response body.
+// A 404 status is returned as os.ErrNotExist.
+func (b *Backend) do(ctx context.Context, method, u string, body []byte) ([]byte, error) {
+	return b.doHeader(ctx, method, u, body, nil)
+}
+
+// doHeader performs a request with additional request headers
+func (b *Backend) doHeader(ctx context.Context, method, u string, body []byte, header http.Header) ([]byte, error) {
+	data, _, err := b.doRequest(ctx, method, u, body, header)
+	return data, err
+}
+
+// doRequest performs a request with additional request headers and also
+// returns the response headers. A 412 status is returned as an error
+// wrapping conditional.ErrPreconditionFailed.
+func (b *Backend) doRequest(ctx context.Context, method, u string, body []byte, header http.Header) ([]byte, http.Header, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.tokens != nil {
+		tok, err := b.tokens.Token(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, os.ErrNotExist
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, nil, fmt.Errorf("%w: %v", conditional.ErrPreconditionFailed, apiError(resp, data))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, apiError(resp, data)
+	}
+	return data, resp.Header, nil
+}
+
+// apiError converts an error response to an error
+func apiError(resp *http.Response, data []byte) error {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &e); err == nil && e.Error.Message != "" {
+		return fmt.Errorf("gcs: %s: %s", resp.Status, e.Error.Message)
+	}
+	return fmt.Errorf("gcs: %s", resp.Status)
+}
+
+// listResponse is the JSON API object list response
+type listResponse struct {
+	Items []struct {
+		Name string `json:"name"`
+		Size string `json:"size"` // int64 encoded as string
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// List returns the blobs with given prefix, ordered by name
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	var blobs simpleblob.BlobList
+	pageToken := ""
+	for {
+		q := url.Values{}
+		q.Set("prefix", b.opt.GlobalPrefix+prefix)
+		q.Set("fields", "items(name,size),nextPageToken")
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		u := b.endpoint + "/storage/v1/b/" + url.PathEscape(b.opt.Bucket) + "/o?" + q.Encode()
+		data, err := b.do(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		var lr listResponse
+		if err := json.Unmarshal(data, &lr); err != nil {
+			return nil, fmt.Errorf("gcs: list response: %w", err)
+		}
+		for _, item := range lr.Items {
+			size, err := strconv.ParseInt(item.Size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("gcs: list response: size of %q: %w", item.Name, err)
+			}
+			blobs = append(blobs, simpleblob.Blob{
+				Name: strings.TrimPrefix(item.Name, b.opt.GlobalPrefix),
+				Size: size,
+			})
+		}
+		if lr.NextPageToken == "" {
+			break
+		}
+		pageToken = lr.NextPageToken
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, nil
+}
+
+// Load returns the contents of the named blob. If the blob does not exist,
+// os.ErrNotExist is returned.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	return b.do(ctx, http.MethodGet, b.objectURL(name)+"?alt=media", nil)
+}
+
+// LoadRange returns length bytes of the named blob, starting at offset,
+// using a range request
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	return b.doHeader(ctx, http.MethodGet, b.objectURL(name)+"?alt=media", nil, header)
+}
+
+// LoadVersion returns the contents of the named blob and its generation as
+// the version for StoreIf
+func (b *Backend) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	data, header, err := b.doRequest(ctx, http.MethodGet, b.objectURL(name)+"?alt=media", nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	generation := header.Get("X-Goog-Generation")
+	if generation == "" {
+		return nil, "", fmt.Errorf("gcs: no generation returned for %q", name)
+	}
+	return data, generation, nil
+}
+
+// Store stores the blob under the given name
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	return b.store(ctx, name, data, url.Values{})
+}
+
+// StoreIf stores the blob if its generation is version, or if it does not
+// exist if version is empty, using the ifGenerationMatch precondition
+func (b *Backend) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	if version == "" {
+		version = "0" // does not exist
+	}
+	q := url.Values{}
+	q.Set("ifGenerationMatch", version)
+	return b.store(ctx, name, data, q)
+}
+
+// store uploads the blob with additional query parameters
+func (b *Backend) store(ctx context.Context, name string, data []byte, q url.Values) error {
+	q.Set("uploadType", "media")
+	q.Set("name", b.opt.GlobalPrefix+name)
+	if b.opt.KMSKeyName != "" {
+		q.Set("kmsKeyName", b.opt.KMSKeyName)
+	}
+	u := b.endpoint + "/upload/storage/v1/b/" + url.PathEscape(b.opt.Bucket) + "/o?" + q.Encode()
+	if data == nil {
+		data = []byte{}
+	}
+	_, err := b.do(ctx, http.MethodPost, u, data)
+	return err
+}
+
+// Delete removes the named blob. Removing a blob that does not exist is not
+// an error.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	_, err := b.do(ctx, http.MethodDelete, b.objectURL(name), nil)
+	if err != nil && err != os.ErrNotExist {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	simpleblob.RegisterBackend(TypeName, func(ctx context.Context, p simpleblob.InitParams) (simpleblob.Interface, error) {
+		var opt Options
+		if err := p.OptionsThroughYAML(&opt); err != nil {
+			return nil, err
+		}
+		return New(ctx, opt)
+	})
+}
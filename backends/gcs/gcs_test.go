@@ -0,0 +1,174 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+)
+
+// fakeGCS implements the subset of the GCS JSON API used by the backend
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	kms     map[string]string
+	gens    map[string]int64
+	lastGen int64
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		_ = json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: "secret-token",
+			ExpiresIn:   3600,
+		})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	const bucketPath = "/storage/v1/b/test"
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == http.MethodGet && path == bucketPath:
+		_, _ = w.Write([]byte(`{"name":"test"}`))
+	case r.Method == http.MethodGet && path == bucketPath+"/o":
+		prefix := r.URL.Query().Get("prefix")
+		var resp listResponse
+		var names []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			resp.Items = append(resp.Items, struct {
+				Name string `json:"name"`
+				Size string `json:"size"`
+			}{name, strconv.Itoa(len(f.objects[name]))})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	case r.Method == http.MethodPost && path == "/upload"+bucketPath+"/o":
+		data, _ := io.ReadAll(r.Body)
+		name := r.URL.Query().Get("name")
+		if match := r.URL.Query().Get("ifGenerationMatch"); match != "" &&
+			match != strconv.FormatInt(f.gens[name], 10) {
+			http.Error(w, `{"error":{"message":"precondition failed"}}`, http.StatusPreconditionFailed)
+			return
+		}
+		f.lastGen++
+		f.gens[name] = f.lastGen
+		f.objects[name] = data
+		f.kms[name] = r.URL.Query().Get("kmsKeyName")
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasPrefix(path, bucketPath+"/o/"):
+		name := strings.TrimPrefix(r.URL.Path, bucketPath+"/o/")
+		data, exists := f.objects[name]
+		if !exists {
+			http.Error(w, `{"error":{"message":"not found"}}`, http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(data[start : end+1])
+				return
+			}
+			w.Header().Set("X-Goog-Generation", strconv.FormatInt(f.gens[name], 10))
+			_, _ = w.Write(data)
+		case http.MethodDelete:
+			delete(f.objects, name)
+			delete(f.gens, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	f := &fakeGCS{
+		objects: make(map[string][]byte),
+		kms:     make(map[string]string),
+		gens:    make(map[string]int64),
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ctx := context.Background()
+	kmsKey := "projects/p/locations/l/keyRings/r/cryptoKeys/k"
+	b, err := New(ctx, Options{
+		Bucket:       "test",
+		EndpointURL:  srv.URL,
+		MetadataURL:  srv.URL + "/token",
+		GlobalPrefix: "prefix/",
+		KMSKeyName:   kmsKey,
+	})
+	require.NoError(t, err)
+
+	_, err = b.Load(ctx, "missing")
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, b.Store(ctx, "foo-2", []byte("bar")))
+	require.NoError(t, b.Store(ctx, "foo-1", []byte("hello")))
+	require.NoError(t, b.Store(ctx, "other", []byte("x")))
+	require.Equal(t, kmsKey, f.kms["prefix/foo-1"])
+
+	data, err := b.Load(ctx, "foo-1")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	data, err = b.LoadRange(ctx, "foo-1", 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, "ell", string(data))
+
+	ls, err := b.List(ctx, "foo-")
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-1", "foo-2"}, ls.Names())
+	require.Equal(t, int64(5), ls[0].Size)
+
+	require.NoError(t, b.Delete(ctx, "foo-1"))
+	require.NoError(t, b.Delete(ctx, "foo-1"))
+	ls, err = b.List(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-2", "other"}, ls.Names())
+
+	// Conditional writes
+	_, _, err = b.LoadVersion(ctx, "lease")
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, b.StoreIf(ctx, "lease", []byte("v1"), ""))
+	require.ErrorIs(t, b.StoreIf(ctx, "lease", []byte("v2"), ""), conditional.ErrPreconditionFailed)
+	data, version, err := b.LoadVersion(ctx, "lease")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(data))
+	require.NoError(t, b.StoreIf(ctx, "lease", []byte("v2"), version))
+	require.ErrorIs(t, b.StoreIf(ctx, "lease", []byte("v3"), version), conditional.ErrPreconditionFailed)
+	require.Equal(t, "v2", string(f.objects["prefix/lease"]))
+}
+
+func TestOptions_Check(t *testing.T) {
+	require.Error(t, Options{}.Check())
+	require.NoError(t, Options{Bucket: "foo"}.Check())
+	require.Error(t, Options{Bucket: "foo", EndpointURL: "ftp://x"}.Check())
+	require.Error(t, Options{Bucket: "foo", KMSKeyName: "invalid"}.Check())
+}
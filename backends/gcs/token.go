@@ -0,0 +1,231 @@
+package gcs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Scope is the OAuth2 scope requested for storage access
+	Scope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	// DefaultMetadataURL is the GCE/GKE metadata server token endpoint. On
+	// GKE with workload identity, this returns a token for the Google service
+	// account bound to the Kubernetes service account.
+	DefaultMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// tokenRefreshMargin is how long before expiry we refresh a token
+	tokenRefreshMargin = time.Minute
+)
+
+// token is an OAuth2 access token
+type token struct {
+	AccessToken string
+	Expiry      time.Time
+}
+
+// valid returns true if the token can still be used
+func (t token) valid() bool {
+	return t.AccessToken != "" && time.Now().Add(tokenRefreshMargin).Before(t.Expiry)
+}
+
+// tokenSource fetches new access tokens
+type tokenSource interface {
+	fetch(ctx context.Context) (token, error)
+}
+
+// cachedTokenSource caches a token until it is about to expire
+type cachedTokenSource struct {
+	src tokenSource
+
+	mu  sync.Mutex
+	tok token
+}
+
+// Token returns a valid access token
+func (c *cachedTokenSource) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tok.valid() {
+		return c.tok.AccessToken, nil
+	}
+	tok, err := c.src.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.tok = tok
+	return tok.AccessToken, nil
+}
+
+// tokenResponse is the OAuth2 token endpoint response
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// doTokenRequest performs a token request and parses the response
+func doTokenRequest(client *http.Client, req *http.Request) (token, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return token{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return token{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return token{}, fmt.Errorf("gcs: token request failed: %s: %s",
+			resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return token{}, fmt.Errorf("gcs: token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return token{}, fmt.Errorf("gcs: token response: no access_token")
+	}
+	return token{
+		AccessToken: tr.AccessToken,
+		Expiry:      time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// metadataTokenSource gets tokens from the metadata server. This is used for
+// GCE instance service accounts and GKE workload identity.
+type metadataTokenSource struct {
+	client *http.Client
+	url    string
+}
+
+func (m *metadataTokenSource) fetch(ctx context.Context) (token, error) {
+	u := m.url
+	if u == "" {
+		u = DefaultMetadataURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return token{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return doTokenRequest(m.client, req)
+}
+
+// serviceAccountKey is the relevant subset of a service account JSON key
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// serviceAccountTokenSource exchanges a signed JWT for an access token
+type serviceAccountTokenSource struct {
+	client *http.Client
+	key    serviceAccountKey
+	rsaKey *rsa.PrivateKey
+}
+
+// newServiceAccountTokenSource loads a service account JSON key file
+func newServiceAccountTokenSource(client *http.Client, path string) (*serviceAccountTokenSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: read credentials file: %w", err)
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("gcs: parse credentials file: %w", err)
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("gcs: credentials file: unsupported type %q", key.Type)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("gcs: credentials file: invalid private_key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("gcs: credentials file: private_key: %w", err)
+		}
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("gcs: credentials file: private_key is not an RSA key")
+	}
+	return &serviceAccountTokenSource{
+		client: client,
+		key:    key,
+		rsaKey: rsaKey,
+	}, nil
+}
+
+// assertion returns a signed JWT for the token exchange
+func (s *serviceAccountTokenSource) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": s.key.PrivateKeyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.key.ClientEmail,
+		"scope": Scope,
+		"aud":   s.key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	h := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+func (s *serviceAccountTokenSource) fetch(ctx context.Context) (token, error) {
+	jwt, err := s.assertion(time.Now())
+	if err != nil {
+		return token{}, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", jwt)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.key.TokenURI,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(s.client, req)
+}
@@ -0,0 +1,120 @@
+// Package httpclient configures the HTTP transport of the storage backends
+// that talk to a remote service, with support for an explicit proxy, custom
+// CA bundles, client certificates and a minimum TLS version.
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/PowerDNS/go-tlsconfig"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Options are the HTTP transport options of a storage backend. They are meant
+// to be inlined into the backend options.
+type Options struct {
+	// ProxyURL is the HTTP(S) proxy to use for all requests, for example
+	// 'http://proxy.example.com:3128'. If not set, the HTTPS_PROXY,
+	// HTTP_PROXY and NO_PROXY environment variables are used.
+	ProxyURL string `yaml:"proxy_url"`
+
+	// NoProxy is a comma separated list of hosts, domains and networks that
+	// are accessed without the proxy_url, in the NO_PROXY format.
+	NoProxy string `yaml:"no_proxy"`
+
+	// TLS allows customising the TLS configuration, like a custom CA bundle
+	// (ca_file) and a client certificate (cert_file and key_file).
+	// See https://github.com/PowerDNS/go-tlsconfig for the available options
+	TLS tlsconfig.Config `yaml:"tls"`
+
+	// TLSMinVersion is the minimum TLS version to accept: '1.0', '1.1',
+	// '1.2' or '1.3' (default: 1.2).
+	TLSMinVersion string `yaml:"tls_min_version"`
+}
+
+// tlsVersions maps the supported tls_min_version values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Check validates the options. The prefix is used in error messages.
+func (o Options) Check(prefix string) error {
+	if o.ProxyURL != "" {
+		u, err := url.Parse(o.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("%s: proxy_url: %w", prefix, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("%s: proxy_url: unsupported scheme %q", prefix, u.Scheme)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("%s: proxy_url: missing host", prefix)
+		}
+	} else if o.NoProxy != "" {
+		return fmt.Errorf("%s: no_proxy requires proxy_url", prefix)
+	}
+	if o.TLSMinVersion != "" {
+		if _, ok := tlsVersions[o.TLSMinVersion]; !ok {
+			return fmt.Errorf("%s: tls_min_version: must be one of 1.0, 1.1, 1.2 or 1.3", prefix)
+		}
+	}
+	return nil
+}
+
+// Transport returns a new transport for these options, based on the default
+// transport. The context controls the background reloading of certificates
+// when tls.watch_certs is set, so it must live as long as the transport.
+func (o Options) Transport(ctx context.Context) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if err := o.Apply(ctx, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Apply sets the proxy and TLS configuration of an existing transport,
+// keeping its other settings. See Transport for the context.
+func (o Options) Apply(ctx context.Context, t *http.Transport) error {
+	t.Proxy = o.proxy()
+
+	mgr, err := tlsconfig.NewManager(ctx, o.TLS, tlsconfig.Options{
+		IsClient: true,
+	})
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	tlsConfig, err := mgr.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+	if v, ok := tlsVersions[o.TLSMinVersion]; ok {
+		tlsConfig.MinVersion = v
+	}
+	t.TLSClientConfig = tlsConfig
+	return nil
+}
+
+// proxy returns the proxy function for the transport
+func (o Options) proxy() func(*http.Request) (*url.URL, error) {
+	if o.ProxyURL == "" {
+		return http.ProxyFromEnvironment
+	}
+	f := (&httpproxy.Config{
+		HTTPProxy:  o.ProxyURL,
+		HTTPSProxy: o.ProxyURL,
+		NoProxy:    o.NoProxy,
+	}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return f(req.URL)
+	}
+}
@@ -0,0 +1,91 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PowerDNS/go-tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestOptions_Check(t *testing.T) {
+	require.NoError(t, Options{}.Check("test"))
+	require.NoError(t, Options{ProxyURL: "http://proxy:3128", NoProxy: "10.0.0.0/8"}.Check("test"))
+	require.NoError(t, Options{TLSMinVersion: "1.3"}.Check("test"))
+	require.Error(t, Options{ProxyURL: "ftp://proxy"}.Check("test"))
+	require.Error(t, Options{ProxyURL: "http://"}.Check("test"))
+	require.Error(t, Options{NoProxy: "localhost"}.Check("test"))
+	err := Options{TLSMinVersion: "1.4"}.Check("test")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "test: tls_min_version")
+}
+
+func TestOptions_yaml(t *testing.T) {
+	var opt struct {
+		Bucket string  `yaml:"bucket"`
+		HTTP   Options `yaml:",inline"`
+	}
+	err := yaml.UnmarshalStrict([]byte(`
+bucket: foo
+proxy_url: http://proxy:3128
+tls:
+  ca_file: /etc/ssl/internal.pem
+tls_min_version: "1.3"
+`), &opt)
+	require.NoError(t, err)
+	assert.Equal(t, "http://proxy:3128", opt.HTTP.ProxyURL)
+	assert.Equal(t, "/etc/ssl/internal.pem", opt.HTTP.TLS.CAFile)
+	assert.Equal(t, "1.3", opt.HTTP.TLSMinVersion)
+}
+
+func TestOptions_Transport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, caPEM, 0600))
+
+	// Not trusted without the CA
+	tr, err := Options{}.Transport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), tr.TLSClientConfig.MinVersion)
+	_, err = (&http.Client{Transport: tr}).Get(srv.URL)
+	require.Error(t, err)
+
+	tr, err = Options{
+		TLS:           tlsconfig.Config{CAFile: caFile},
+		TLSMinVersion: "1.3",
+	}.Transport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tr.TLSClientConfig.MinVersion)
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Proxy with exceptions
+	tr, err = Options{ProxyURL: "http://proxy:3128", NoProxy: "internal.example.com"}.Transport(ctx)
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodGet, "https://s3.example.com/bucket", nil)
+	u, err := tr.Proxy(req)
+	require.NoError(t, err)
+	require.NotNil(t, u)
+	assert.Equal(t, "proxy:3128", u.Host)
+	req, _ = http.NewRequest(http.MethodGet, "https://internal.example.com/bucket", nil)
+	u, err = tr.Proxy(req)
+	require.NoError(t, err)
+	assert.Nil(t, u)
+}
@@ -0,0 +1,275 @@
+// Package layout implements a simpleblob.Interface wrapper that stores
+// snapshots under keys generated from a template, like
+// "{{.Prefix}}{{.DB}}/{{.Instance}}/{{.Name}}", so that multiple clusters and
+// databases can share a bucket with a layout that fits existing lifecycle
+// policies.
+package layout
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/PowerDNS/simpleblob"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// Fields are the fields that can be used in a template
+var Fields = []string{
+	"Prefix",     // part of the name up to and including the last '/', if any
+	"DB",         // LMDB name
+	"Instance",   // instance name
+	"Timestamp",  // snapshot timestamp as used in the name
+	"Generation", // generation ID
+	"Year",       // year of the snapshot timestamp (UTC)
+	"Month",      // month of the snapshot timestamp, 2 digits
+	"Day",        // day of the snapshot timestamp, 2 digits
+	"Name",       // snapshot name without the Prefix
+}
+
+// segment is either a literal or a field of a template
+type segment struct {
+	literal string
+	field   string
+}
+
+// Layout is a parsed key template
+type Layout struct {
+	tmpl     string
+	segments []segment
+}
+
+// Parse parses a key template. Fields are written as "{{.Field}}", other
+// template syntax is not supported. The template must end with "{{.Name}}",
+// preceded by a '/' or {{.Prefix}}, because the name is recovered from the
+// last part of the key when listing.
+func Parse(tmpl string) (*Layout, error) {
+	l := &Layout{tmpl: tmpl}
+	rest := tmpl
+	for rest != "" {
+		lit, after, found := strings.Cut(rest, "{{")
+		if lit != "" {
+			l.segments = append(l.segments, segment{literal: lit})
+		}
+		if !found {
+			break
+		}
+		action, after, found := strings.Cut(after, "}}")
+		if !found {
+			return nil, fmt.Errorf("layout %q: unclosed action", tmpl)
+		}
+		field := strings.TrimSpace(action)
+		if !strings.HasPrefix(field, ".") || !isField(field[1:]) {
+			return nil, fmt.Errorf("layout %q: unsupported action {{%s}}, supported fields: .%s",
+				tmpl, action, strings.Join(Fields, ", ."))
+		}
+		l.segments = append(l.segments, segment{field: field[1:]})
+		rest = after
+	}
+
+	// Check that the name can be recovered from the keys
+	n := len(l.segments)
+	if n == 0 || l.segments[n-1].field != "Name" {
+		return nil, fmt.Errorf("layout %q: must end with {{.Name}}", tmpl)
+	}
+	for _, name := range []string{
+		"main__instance__20230102-150405-123456789__G-0000000000000000.pb.gz",
+		"backups/main__instance__20230102-150405-123456789__G-0000000000000000.pb.gz",
+		"main.lease",
+	} {
+		key := l.Key(name)
+		if dir, _ := splitName(name); dir+lastPart(key) != name {
+			return nil, fmt.Errorf("layout %q: {{.Name}} must be preceded by a '/' or {{.Prefix}}", tmpl)
+		}
+	}
+	return l, nil
+}
+
+func isField(name string) bool {
+	for _, f := range Fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the template
+func (l *Layout) String() string {
+	return l.tmpl
+}
+
+// Key returns the storage key for a name. Names that are not snapshot names
+// are stored under the part of the template before the first field other
+// than Prefix.
+func (l *Layout) Key(name string) string {
+	dir, base := splitName(name)
+	ni, err := snapshot.ParseName(base)
+	if err != nil {
+		key, _ := l.render(map[string]string{"Prefix": dir})
+		return key + base
+	}
+	key, _ := l.render(map[string]string{
+		"Prefix":     dir,
+		"DB":         ni.SyncerName,
+		"Instance":   ni.InstanceID,
+		"Timestamp":  ni.TimestampString,
+		"Generation": ni.GenerationID,
+		"Year":       ni.Timestamp.Format("2006"),
+		"Month":      ni.Timestamp.Format("01"),
+		"Day":        ni.Timestamp.Format("02"),
+		"Name":       base,
+	})
+	return key
+}
+
+// ListPrefix returns the key prefix under which all keys of the names with
+// given prefix are stored. It renders the template as far as the fields are
+// known from the name prefix.
+func (l *Layout) ListPrefix(prefix string) string {
+	dir, base := splitName(prefix)
+	db, rest, found := strings.Cut(base, "__")
+	if !found || strings.Contains(db, ".") {
+		static, _ := l.render(map[string]string{"Prefix": dir})
+		if strings.Contains(base, ".") {
+			return static + base // cannot be a snapshot name
+		}
+		return static
+	}
+	// Snapshot names are DB__INSTANCE__TIMESTAMP__GENERATION...
+	fields := map[string]string{
+		"Prefix": dir,
+		"DB":     db,
+		"Name":   base, // only used if all fields before it are known
+	}
+	parts := strings.Split(rest, "__")
+	if len(parts) >= 2 {
+		fields["Instance"] = parts[0]
+		// The date can be known from a partial timestamp
+		ts := parts[1]
+		if len(ts) >= 4 {
+			fields["Year"] = ts[:4]
+		}
+		if len(ts) >= 6 {
+			fields["Month"] = ts[4:6]
+		}
+		if len(ts) >= 8 {
+			fields["Day"] = ts[6:8]
+		}
+	}
+	if len(parts) >= 3 {
+		fields["Timestamp"] = parts[1]
+	}
+	if len(parts) >= 4 {
+		fields["Generation"] = parts[2]
+	}
+	key, _ := l.render(fields)
+	return key
+}
+
+// render renders the template until the first field that is not in fields,
+// and returns false if it did not render the whole template.
+func (l *Layout) render(fields map[string]string) (string, bool) {
+	var sb strings.Builder
+	for _, seg := range l.segments {
+		if seg.field == "" {
+			sb.WriteString(seg.literal)
+			continue
+		}
+		v, ok := fields[seg.field]
+		if !ok {
+			return sb.String(), false
+		}
+		sb.WriteString(v)
+	}
+	return sb.String(), true
+}
+
+// splitName splits a name into the part up to and including the last '/',
+// and the rest.
+func splitName(name string) (dir, base string) {
+	i := strings.LastIndexByte(name, '/')
+	return name[:i+1], name[i+1:]
+}
+
+// lastPart returns the part of a key after the last '/'
+func lastPart(key string) string {
+	_, base := splitName(key)
+	return base
+}
+
+// Backend wraps a storage backend with a key layout
+type Backend struct {
+	st     simpleblob.Interface
+	layout *Layout
+}
+
+// New wraps a storage backend to store all blobs under the keys generated by
+// the layout. If the layout is nil, the backend is returned as is.
+func New(st simpleblob.Interface, layout *Layout) simpleblob.Interface {
+	if layout == nil {
+		return st
+	}
+	return &Backend{
+		st:     st,
+		layout: layout,
+	}
+}
+
+// List returns the blobs with the given name prefix, ordered by name. Keys
+// that do not match the layout are ignored, and so are the names under a
+// deeper '/' than the prefix, like the backups when listing "".
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	ls, err := b.st.List(ctx, b.layout.ListPrefix(prefix))
+	if err != nil {
+		return nil, err
+	}
+	dir, _ := splitName(prefix)
+	res := make(simpleblob.BlobList, 0, len(ls))
+	for _, blob := range ls {
+		name := dir + lastPart(blob.Name)
+		if !strings.HasPrefix(name, prefix) || b.layout.Key(name) != blob.Name {
+			continue
+		}
+		blob.Name = name
+		res = append(res, blob)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res, nil
+}
+
+// Load loads a blob
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	return b.st.Load(ctx, b.layout.Key(name))
+}
+
+// LoadRange loads part of a blob, if the wrapped backend supports it
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	return ranged.Load(ctx, b.st, b.layout.Key(name), offset, length)
+}
+
+// Store stores a blob
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	return b.st.Store(ctx, b.layout.Key(name), data)
+}
+
+// LoadVersion loads a blob and its version, if the wrapped backend supports
+// conditional writes
+func (b *Backend) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	return conditional.LoadVersion(ctx, b.st, b.layout.Key(name))
+}
+
+// StoreIf conditionally stores a blob, if the wrapped backend supports it
+func (b *Backend) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	return conditional.StoreIf(ctx, b.st, b.layout.Key(name), data, version)
+}
+
+// Delete deletes a blob
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	return b.st.Delete(ctx, b.layout.Key(name))
+}
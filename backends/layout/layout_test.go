@@ -0,0 +1,113 @@
+package layout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/fs"
+	"powerdns.com/platform/lightningstream/backends/prefix"
+)
+
+const (
+	snapA1 = "main__a__20230102-150405-000000001__G-0000000000000001.pb.gz"
+	snapA2 = "main__a__20230103-150405-000000001__G-0000000000000001.pb.gz"
+	snapB1 = "main__b__20230102-150405-000000001__G-0000000000000002.pb.gz"
+	snapO1 = "other__a__20230102-150405-000000001__G-0000000000000001.pb.gz"
+)
+
+func TestParse(t *testing.T) {
+	for _, tmpl := range []string{
+		"{{.Name}}",
+		"{{.Prefix}}{{.Name}}",
+		"cluster1/{{ .Prefix }}{{.DB}}/{{.Year}}/{{.Month}}/{{.Day}}/{{.Name}}",
+	} {
+		_, err := Parse(tmpl)
+		assert.NoError(t, err, tmpl)
+	}
+	for _, tmpl := range []string{
+		"",
+		"{{.DB}}",
+		"{{.DB}}{{.Name}}",
+		"x-{{.Name}}",
+		"{{.Prefix}}{{.Name}}/x",
+		"{{.Unknown}}/{{.Name}}",
+		"{{printf .Name}}",
+		"{{.Name",
+	} {
+		_, err := Parse(tmpl)
+		assert.Error(t, err, tmpl)
+	}
+}
+
+func TestLayout_Key(t *testing.T) {
+	l, err := Parse("cluster1/{{.Prefix}}{{.DB}}/{{.Instance}}/{{.Year}}-{{.Month}}/{{.Name}}")
+	require.NoError(t, err)
+	assert.Equal(t, "cluster1/main/a/2023-01/"+snapA1, l.Key(snapA1))
+	assert.Equal(t, "cluster1/backups/main/a/2023-01/"+snapA1, l.Key("backups/"+snapA1))
+	assert.Equal(t, "cluster1/main.lease", l.Key("main.lease"))
+	assert.Equal(t, "cluster1/dnssec/main.lease", l.Key("dnssec/main.lease"))
+
+	assert.Equal(t, "cluster1/", l.ListPrefix(""))
+	assert.Equal(t, "cluster1/", l.ListPrefix("main"))
+	assert.Equal(t, "cluster1/main.heartbeat__", l.ListPrefix("main.heartbeat__"))
+	assert.Equal(t, "cluster1/main/", l.ListPrefix("main__"))
+	assert.Equal(t, "cluster1/main/a/", l.ListPrefix("main__a__"))
+	assert.Equal(t, "cluster1/main/a/2023-01/main__a__20230102-",
+		l.ListPrefix("main__a__20230102-"))
+	assert.Equal(t, "cluster1/backups/main/", l.ListPrefix("backups/main__"))
+}
+
+func TestBackend(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testBackend(t, memory.New())
+	})
+	t.Run("fs", func(t *testing.T) {
+		raw, err := fs.New(fs.Options{RootPath: t.TempDir()})
+		require.NoError(t, err)
+		testBackend(t, raw)
+	})
+}
+
+func testBackend(t *testing.T, raw simpleblob.Interface) {
+	ctx := context.Background()
+	l, err := Parse("cluster1/{{.Prefix}}{{.DB}}/{{.Instance}}/{{.Name}}")
+	require.NoError(t, err)
+	st := New(raw, l)
+	tester.DoBackendTests(t, st)
+
+	for _, name := range []string{snapA2, snapA1, snapB1, snapO1, "main.lease"} {
+		require.NoError(t, st.Store(ctx, name, []byte(name)))
+	}
+	require.NoError(t, prefix.New(st, "backups/").Store(ctx, snapA1, []byte("backup")))
+	require.NoError(t, raw.Store(ctx, "cluster1/main/a/unrelated", []byte("x")))
+
+	data, err := raw.Load(ctx, "cluster1/main/b/"+snapB1)
+	require.NoError(t, err)
+	assert.Equal(t, snapB1, string(data))
+	data, err = st.Load(ctx, "backups/"+snapA1)
+	require.NoError(t, err)
+	assert.Equal(t, "backup", string(data))
+
+	ls, err := st.List(ctx, "main__")
+	require.NoError(t, err)
+	assert.Equal(t, []string{snapA1, snapA2, snapB1}, ls.Names())
+	ls, err = st.List(ctx, "main")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"main.lease", snapA1, snapA2, snapB1}, ls.Names())
+	ls, err = st.List(ctx, "backups/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/" + snapA1}, ls.Names())
+
+	require.NoError(t, st.Delete(ctx, snapA1))
+	ls, err = st.List(ctx, "main__a__")
+	require.NoError(t, err)
+	assert.Equal(t, []string{snapA2}, ls.Names())
+
+	// No layout
+	assert.Equal(t, raw, New(raw, nil))
+}
@@ -0,0 +1,88 @@
+// Package lazy implements a simpleblob.Interface wrapper that opens the
+// storage backend on first use, for backends that are optional at startup,
+// like a failover or replica backend.
+package lazy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/PowerDNS/simpleblob"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+)
+
+// OpenFunc opens a storage backend. The context must stay valid for the
+// lifetime of the backend.
+type OpenFunc func(ctx context.Context) (simpleblob.Interface, error)
+
+// Backend opens a backend on first use, and tries again on the next use if
+// that fails, so that a backend that cannot be reached at startup does not
+// prevent the use of the others.
+type Backend struct {
+	ctx  context.Context
+	open OpenFunc
+
+	mu sync.Mutex
+	st simpleblob.Interface
+}
+
+// New returns a backend that is opened on first use. The context is passed
+// to the open function.
+func New(ctx context.Context, open OpenFunc) *Backend {
+	return &Backend{ctx: ctx, open: open}
+}
+
+// Open opens the backend if needed and returns it
+func (l *Backend) Open() (simpleblob.Interface, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.st != nil {
+		return l.st, nil
+	}
+	st, err := l.open(l.ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.st = st
+	return st, nil
+}
+
+func (l *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	st, err := l.Open()
+	if err != nil {
+		return nil, err
+	}
+	return st.List(ctx, prefix)
+}
+
+func (l *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	st, err := l.Open()
+	if err != nil {
+		return nil, err
+	}
+	return st.Load(ctx, name)
+}
+
+func (l *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	st, err := l.Open()
+	if err != nil {
+		return nil, err
+	}
+	return ranged.Load(ctx, st, name, offset, length)
+}
+
+func (l *Backend) Store(ctx context.Context, name string, data []byte) error {
+	st, err := l.Open()
+	if err != nil {
+		return err
+	}
+	return st.Store(ctx, name, data)
+}
+
+func (l *Backend) Delete(ctx context.Context, name string) error {
+	st, err := l.Open()
+	if err != nil {
+		return err
+	}
+	return st.Delete(ctx, name)
+}
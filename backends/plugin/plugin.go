@@ -0,0 +1,410 @@
+// Package plugin implements a simpleblob storage backend that is provided by
+// an external plugin binary, so that storage backends can be added without
+// changing Lightning Stream itself.
+//
+// The plugin is started as a child process that keeps running. Requests are
+// written to its stdin and responses are read from its stdout as a stream of
+// JSON objects, see Request and Response. Anything the plugin writes to
+// stderr is passed on to our stderr. The plugin must exit when its stdin is
+// closed. If the plugin exits or does not respond within the timeout, it is
+// killed and started again for the next request.
+//
+// Plugins written in Go can use Serve to implement the protocol for any
+// simpleblob.Interface.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"golang.org/x/exp/slices"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+)
+
+const (
+	// TypeName is the name this backend is registered under
+	TypeName = "plugin"
+
+	// DefaultTimeout is the default time a plugin gets to respond to a
+	// request
+	DefaultTimeout = 5 * time.Minute
+)
+
+// Options describes the storage options for the plugin backend
+type Options struct {
+	// Command is the plugin binary to run (required)
+	Command string `yaml:"command"`
+
+	// Args are passed as command line arguments to the plugin
+	Args []string `yaml:"args"`
+
+	// Env are extra environment variables for the plugin in the form
+	// "KEY=value". The plugin inherits our own environment.
+	Env []string `yaml:"env"`
+
+	// Config is passed to the plugin in the init request
+	Config map[string]interface{} `yaml:"config"`
+
+	// Timeout is the time the plugin gets to respond to a request
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Check validates the options
+func (o Options) Check() error {
+	if o.Command == "" {
+		return fmt.Errorf("plugin storage.options: command is required")
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("plugin storage.options: timeout must not be negative")
+	}
+	return nil
+}
+
+// Backend is the plugin storage backend
+type Backend struct {
+	opt Options
+
+	mu sync.Mutex
+	p  *process // the current plugin process
+}
+
+// New starts the plugin and initializes it with the configured options
+func New(ctx context.Context, opt Options) (*Backend, error) {
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = DefaultTimeout
+	}
+	b := &Backend{opt: opt}
+	if _, err := b.process(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// process returns the plugin process, and starts it again if it exited
+func (b *Backend) process(ctx context.Context) (*process, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.p != nil && !b.p.exited() {
+		return b.p, nil
+	}
+	p, err := start(ctx, b.opt)
+	if err != nil {
+		return nil, err
+	}
+	b.p = p
+	return p, nil
+}
+
+// call sends a request to the plugin and waits for the response
+func (b *Backend) call(ctx context.Context, req *Request) (*Response, error) {
+	p, err := b.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.call(ctx, b.opt.Timeout, req)
+}
+
+// List returns the blobs with given prefix, ordered by name
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	res, err := b.call(ctx, &Request{Op: OpList, Name: prefix})
+	if err != nil {
+		return nil, err
+	}
+	blobs := make(simpleblob.BlobList, 0, len(res.Blobs))
+	for _, blob := range res.Blobs {
+		blobs = append(blobs, simpleblob.Blob{
+			Name: blob.Name,
+			Size: blob.Size,
+		})
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, nil
+}
+
+// Load returns the contents of the named blob. If the blob does not exist,
+// os.ErrNotExist is returned.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	res, err := b.call(ctx, &Request{Op: OpLoad, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return res.Data, nil
+}
+
+// LoadRange returns length bytes of the named blob, starting at offset, if
+// the plugin has the CapLoadRange capability
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	p, err := b.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(p.capabilities, CapLoadRange) {
+		return nil, ranged.ErrUnsupported
+	}
+	res, err := p.call(ctx, b.opt.Timeout, &Request{
+		Op:     OpLoadRange,
+		Name:   name,
+		Offset: offset,
+		Length: length,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Data, nil
+}
+
+// Store stores the blob under the given name
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	_, err := b.call(ctx, &Request{Op: OpStore, Name: name, Data: data})
+	return err
+}
+
+// Delete removes the named blob
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	_, err := b.call(ctx, &Request{Op: OpDelete, Name: name})
+	return err
+}
+
+// Close closes the stdin of the plugin and waits for it to exit. The plugin
+// is started again if the backend is used after Close.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	p := b.p
+	b.p = nil
+	b.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	_ = p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(b.opt.Timeout):
+		p.kill(fmt.Errorf("plugin: not exited after closing its stdin"))
+		<-p.done
+	}
+	return nil
+}
+
+// process is a running plugin process
+type process struct {
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	capabilities []string
+
+	writeMu sync.Mutex
+	enc     *json.Encoder
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *Response
+	reason  error         // why the process was killed, if it was
+	err     error         // why the process exited, set before done is closed
+	done    chan struct{} // closed when the process exited
+}
+
+// start starts the plugin and sends the init request
+func start(ctx context.Context, opt Options) (*process, error) {
+	// Not bound to the context, the process is used until it exits
+	cmd := exec.Command(opt.Command, opt.Args...)
+	cmd.Env = append(os.Environ(), opt.Env...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", EnvProtocol, ProtocolVersion))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("plugin: start %s: %w", opt.Command, err)
+	}
+	p := &process{
+		cmd:     cmd,
+		stdin:   stdin,
+		enc:     json.NewEncoder(stdin),
+		pending: make(map[uint64]chan *Response),
+		done:    make(chan struct{}),
+	}
+	go p.read(stdout)
+
+	res, err := p.call(ctx, opt.Timeout, &Request{
+		Op:       OpInit,
+		Protocol: ProtocolVersion,
+		Config:   jsonConfig(opt.Config),
+	})
+	if err == nil && res.Protocol != ProtocolVersion {
+		err = fmt.Errorf("plugin: unsupported protocol version %d, expected %d",
+			res.Protocol, ProtocolVersion)
+	}
+	if err != nil {
+		p.kill(err)
+		<-p.done
+		return nil, fmt.Errorf("plugin: init %s: %w", opt.Command, err)
+	}
+	p.capabilities = res.Capabilities
+	return p, nil
+}
+
+// read passes the responses to the pending calls until the plugin exits
+func (p *process) read(stdout io.Reader) {
+	dec := json.NewDecoder(bufio.NewReader(stdout))
+	var err error
+	for {
+		res := new(Response)
+		if err = dec.Decode(res); err != nil {
+			break
+		}
+		p.mu.Lock()
+		ch := p.pending[res.ID]
+		delete(p.pending, res.ID)
+		p.mu.Unlock()
+		if ch != nil {
+			ch <- res // buffered
+		}
+	}
+	// The stream cannot be recovered after invalid output
+	_ = p.cmd.Process.Kill()
+	waitErr := p.cmd.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.reason != nil:
+		err = p.reason
+	case err == io.EOF && waitErr != nil:
+		err = fmt.Errorf("plugin exited: %w", waitErr)
+	case err == io.EOF:
+		err = fmt.Errorf("plugin exited")
+	default:
+		err = fmt.Errorf("plugin: invalid response: %w", err)
+	}
+	p.err = err
+	close(p.done)
+}
+
+// exited returns true if the process exited
+func (p *process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill kills the process, which fails all pending calls with the reason
+func (p *process) kill(reason error) {
+	p.mu.Lock()
+	if p.reason == nil {
+		p.reason = reason
+	}
+	p.mu.Unlock()
+	_ = p.cmd.Process.Kill()
+}
+
+// call sends a request and waits for the response. A plugin that does not
+// respond within the timeout is killed, because it may be stuck.
+func (p *process) call(ctx context.Context, timeout time.Duration, req *Request) (*Response, error) {
+	ch := make(chan *Response, 1)
+	p.mu.Lock()
+	if p.exited() {
+		p.mu.Unlock()
+		return nil, p.err
+	}
+	p.nextID++
+	req.ID = p.nextID
+	p.pending[req.ID] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, req.ID)
+		p.mu.Unlock()
+	}()
+
+	timer := time.AfterFunc(timeout, func() {
+		p.kill(fmt.Errorf("plugin: %s timed out after %s", req.Op, timeout))
+	})
+	defer timer.Stop()
+
+	p.writeMu.Lock()
+	err := p.enc.Encode(req)
+	p.writeMu.Unlock()
+	if err != nil {
+		<-p.done // the plugin is gone, get the reason
+		return nil, p.err
+	}
+
+	select {
+	case res := <-ch:
+		if res.Error == "" {
+			return res, nil
+		}
+		if res.NotExist {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("plugin: %s %q: %s", req.Op, req.Name, res.Error)
+	case <-p.done:
+		return nil, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// jsonConfig converts the maps decoded from YAML in the config to maps with
+// string keys, which can be encoded as JSON
+func jsonConfig(config map[string]interface{}) map[string]interface{} {
+	if config == nil {
+		return nil
+	}
+	res := make(map[string]interface{}, len(config))
+	for k, v := range config {
+		res[k] = jsonValue(v)
+	}
+	return res
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			res[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return res
+	case map[string]interface{}:
+		return jsonConfig(v)
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, val := range v {
+			res[i] = jsonValue(val)
+		}
+		return res
+	}
+	return v
+}
+
+func init() {
+	simpleblob.RegisterBackend(TypeName, func(ctx context.Context, p simpleblob.InitParams) (simpleblob.Interface, error) {
+		var opt Options
+		if err := p.OptionsThroughYAML(&opt); err != nil {
+			return nil, err
+		}
+		return New(ctx, opt)
+	})
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/fs"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+)
+
+// envTestPlugin makes the test binary run as a plugin
+const envTestPlugin = "LIGHTNINGSTREAM_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envTestPlugin) != "" {
+		if err := Serve(context.Background(), os.Stdin, os.Stdout, openTestBackend); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// openTestBackend opens an fs backend in the root_path from the config
+func openTestBackend(ctx context.Context, config map[string]interface{}) (simpleblob.Interface, error) {
+	if msg, ok := config["fail"].(string); ok {
+		return nil, errors.New(msg)
+	}
+	if _, ok := config["nested"].(map[string]interface{}); !ok {
+		return nil, errors.New("nested config not passed as an object")
+	}
+	root, _ := config["root_path"].(string)
+	return fs.New(fs.Options{RootPath: root})
+}
+
+func testOptions(t *testing.T) Options {
+	return Options{
+		Command: os.Args[0],
+		Env:     []string{envTestPlugin + "=1"},
+		Config: map[string]interface{}{
+			"root_path": t.TempDir(),
+			"nested":    map[interface{}]interface{}{"foo": []interface{}{1, 2}},
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+func TestBackend(t *testing.T) {
+	b, err := New(context.Background(), testOptions(t))
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, b.Close())
+	}()
+	tester.DoBackendTests(t, b)
+}
+
+func TestBackend_LoadRange(t *testing.T) {
+	ctx := context.Background()
+	b, err := New(ctx, testOptions(t))
+	require.NoError(t, err)
+	defer func() {
+		_ = b.Close()
+	}()
+
+	require.NoError(t, b.Store(ctx, "foo", []byte("0123456789")))
+	data, err := ranged.Load(ctx, b, "foo", 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("234"), data)
+	_, err = ranged.Load(ctx, b, "bar", 2, 3)
+	assert.True(t, os.IsNotExist(err))
+
+	// Not advertised by the plugin
+	b.p.capabilities = nil
+	_, err = ranged.Load(ctx, b, "foo", 2, 3)
+	assert.ErrorIs(t, err, ranged.ErrUnsupported)
+}
+
+func TestBackend_restart(t *testing.T) {
+	ctx := context.Background()
+	b, err := New(ctx, testOptions(t))
+	require.NoError(t, err)
+	defer func() {
+		_ = b.Close()
+	}()
+	require.NoError(t, b.Store(ctx, "foo", []byte("bar")))
+
+	// Started again on the next request after it exits
+	p := b.p
+	require.NoError(t, p.cmd.Process.Kill())
+	<-p.done
+	data, err := b.Load(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), data)
+	assert.NotSame(t, p, b.p)
+
+	// Killed when it does not respond in time
+	p = b.p
+	b.opt.Timeout = time.Nanosecond
+	_, err = b.Load(ctx, "foo")
+	assert.ErrorContains(t, err, "timed out")
+	<-p.done
+	b.opt.Timeout = 10 * time.Second
+	_, err = b.Load(ctx, "foo")
+	assert.NoError(t, err)
+}
+
+func TestNew_errors(t *testing.T) {
+	ctx := context.Background()
+	opt := testOptions(t)
+	opt.Config["fail"] = "invalid bucket"
+	_, err := New(ctx, opt)
+	assert.ErrorContains(t, err, "invalid bucket")
+
+	opt = testOptions(t)
+	opt.Command = "/nonexistent/plugin"
+	_, err = New(ctx, opt)
+	assert.Error(t, err)
+
+	_, err = New(ctx, Options{})
+	assert.Error(t, err)
+}
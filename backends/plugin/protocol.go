@@ -0,0 +1,93 @@
+package plugin
+
+// ProtocolVersion is the version of the plugin protocol implemented by this
+// package. It is only increased for incompatible changes. New operations and
+// fields are added in a compatible way, with a capability where needed.
+const ProtocolVersion = 1
+
+// EnvProtocol is set in the environment of the plugin process to the
+// ProtocolVersion, so that a plugin can refuse to run with an incompatible
+// version before reading any request.
+const EnvProtocol = "LIGHTNINGSTREAM_PLUGIN_PROTOCOL"
+
+// Operations
+const (
+	// OpInit is the first request sent to a plugin, with the configured
+	// options in Config. The plugin responds with its Protocol version and
+	// optional Capabilities.
+	OpInit = "init"
+
+	// OpList lists the blobs with the prefix in Name
+	OpList = "list"
+
+	// OpLoad loads a blob. If the blob does not exist, the plugin responds
+	// with NotExist set.
+	OpLoad = "load"
+
+	// OpLoadRange loads Length bytes of a blob, starting at Offset. Only
+	// sent to plugins with the CapLoadRange capability.
+	OpLoadRange = "load_range"
+
+	// OpStore stores Data as a blob
+	OpStore = "store"
+
+	// OpDelete deletes a blob. Deleting a blob that does not exist is not an
+	// error.
+	OpDelete = "delete"
+)
+
+// Capabilities
+const (
+	// CapLoadRange is set by plugins that support OpLoadRange
+	CapLoadRange = "load_range"
+)
+
+// Request is a request sent to a plugin on its stdin as a JSON object.
+// Requests are sent without waiting for earlier responses, and a plugin may
+// respond in any order.
+type Request struct {
+	ID uint64 `json:"id"`
+	Op string `json:"op"`
+
+	// Name is the blob name, or the prefix for OpList
+	Name string `json:"name,omitempty"`
+
+	// Data is the blob data for OpStore, base64 encoded in the JSON
+	Data []byte `json:"data,omitempty"`
+
+	// Offset and Length are the range for OpLoadRange
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+
+	// Protocol and Config are only sent with OpInit
+	Protocol int                    `json:"protocol,omitempty"`
+	Config   map[string]interface{} `json:"config,omitempty"`
+}
+
+// Response is the response to a Request with the same ID, written by the
+// plugin to its stdout as a JSON object.
+type Response struct {
+	ID uint64 `json:"id"`
+
+	// Error is set if the operation failed
+	Error string `json:"error,omitempty"`
+
+	// NotExist is set with Error when the blob does not exist
+	NotExist bool `json:"not_exist,omitempty"`
+
+	// Blobs is the result of OpList
+	Blobs []Blob `json:"blobs,omitempty"`
+
+	// Data is the result of OpLoad and OpLoadRange
+	Data []byte `json:"data,omitempty"`
+
+	// Protocol and Capabilities are the result of OpInit
+	Protocol     int      `json:"protocol,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Blob is a listed blob
+type Blob struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/PowerDNS/simpleblob"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+)
+
+// OpenFunc opens the storage backend of a plugin with the config from the
+// init request
+type OpenFunc func(ctx context.Context, config map[string]interface{}) (simpleblob.Interface, error)
+
+// Serve implements the plugin side of the protocol for the storage backend
+// returned by open. It reads requests from r and writes the responses to w,
+// until r is closed. Requests are handled concurrently. A plugin binary
+// typically calls it with os.Stdin and os.Stdout, and writes its logs to
+// os.Stderr.
+func Serve(ctx context.Context, r io.Reader, w io.Writer, open OpenFunc) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	enc := json.NewEncoder(w)
+	var mu sync.Mutex
+	respond := func(res *Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(res) // nobody left to tell if this fails
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var st simpleblob.Interface
+	for {
+		req := new(Request)
+		if err := dec.Decode(req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("read request: %w", err)
+		}
+		if req.Op == OpInit {
+			res, opened := initialize(ctx, req, open)
+			if opened != nil {
+				st = opened
+			}
+			respond(res)
+			continue
+		}
+		if st == nil {
+			respond(&Response{ID: req.ID, Error: "plugin not initialized"})
+			continue
+		}
+		wg.Add(1)
+		go func(st simpleblob.Interface) {
+			defer wg.Done()
+			respond(handle(ctx, st, req))
+		}(st)
+	}
+}
+
+// initialize handles the init request
+func initialize(ctx context.Context, req *Request, open OpenFunc) (*Response, simpleblob.Interface) {
+	res := &Response{ID: req.ID}
+	if req.Protocol != ProtocolVersion {
+		res.Error = fmt.Sprintf("unsupported protocol version %d, expected %d",
+			req.Protocol, ProtocolVersion)
+		return res, nil
+	}
+	st, err := open(ctx, req.Config)
+	if err != nil {
+		res.Error = err.Error()
+		return res, nil
+	}
+	res.Protocol = ProtocolVersion
+	if _, ok := st.(ranged.Loader); ok {
+		res.Capabilities = append(res.Capabilities, CapLoadRange)
+	}
+	return res, st
+}
+
+// handle handles a storage request
+func handle(ctx context.Context, st simpleblob.Interface, req *Request) *Response {
+	res := &Response{ID: req.ID}
+	var err error
+	switch req.Op {
+	case OpList:
+		var blobs simpleblob.BlobList
+		blobs, err = st.List(ctx, req.Name)
+		for _, blob := range blobs {
+			res.Blobs = append(res.Blobs, Blob{Name: blob.Name, Size: blob.Size})
+		}
+	case OpLoad:
+		res.Data, err = st.Load(ctx, req.Name)
+	case OpLoadRange:
+		res.Data, err = ranged.Load(ctx, st, req.Name, req.Offset, req.Length)
+	case OpStore:
+		err = st.Store(ctx, req.Name, req.Data)
+	case OpDelete:
+		err = st.Delete(ctx, req.Name)
+	default:
+		err = fmt.Errorf("unknown operation: %q", req.Op)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		res.NotExist = errors.Is(err, os.ErrNotExist)
+	}
+	return res
+}
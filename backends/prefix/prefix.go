@@ -0,0 +1,86 @@
+// Package prefix implements a simpleblob.Interface wrapper that stores all
+// blobs under a fixed name prefix, so that multiple LMDBs can share a bucket
+// without seeing each other's snapshots.
+package prefix
+
+import (
+	"context"
+	"strings"
+
+	"github.com/PowerDNS/simpleblob"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+)
+
+// Backend wraps a storage backend with a name prefix
+type Backend struct {
+	st     simpleblob.Interface
+	prefix string
+}
+
+// New wraps a storage backend to prefix all names with prefix. The prefix
+// typically ends with a "/", which object stores show as a folder and the fs
+// backend stores as a subdirectory. If the prefix is empty, the backend is
+// returned as is.
+func New(st simpleblob.Interface, prefix string) simpleblob.Interface {
+	if prefix == "" {
+		return st
+	}
+	return &Backend{
+		st:     st,
+		prefix: prefix,
+	}
+}
+
+// List returns the blobs under the prefix, with the prefix removed from
+// their names.
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	ls, err := b.st.List(ctx, b.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make(simpleblob.BlobList, 0, len(ls))
+	for _, blob := range ls {
+		// Should always have the prefix, but do not trust backends with
+		// inexact prefix matching.
+		if !strings.HasPrefix(blob.Name, b.prefix) {
+			continue
+		}
+		blob.Name = blob.Name[len(b.prefix):]
+		res = append(res, blob)
+	}
+	return res, nil
+}
+
+// Load loads a blob under the prefix
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	return b.st.Load(ctx, b.prefix+name)
+}
+
+// LoadRange loads part of a blob under the prefix, if the wrapped backend
+// supports it
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	return ranged.Load(ctx, b.st, b.prefix+name, offset, length)
+}
+
+// Store stores a blob under the prefix
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	return b.st.Store(ctx, b.prefix+name, data)
+}
+
+// LoadVersion loads a blob under the prefix and its version, if the wrapped
+// backend supports conditional writes
+func (b *Backend) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	return conditional.LoadVersion(ctx, b.st, b.prefix+name)
+}
+
+// StoreIf conditionally stores a blob under the prefix, if the wrapped
+// backend supports it
+func (b *Backend) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	return conditional.StoreIf(ctx, b.st, b.prefix+name, data, version)
+}
+
+// Delete deletes a blob under the prefix
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	return b.st.Delete(ctx, b.prefix+name)
+}
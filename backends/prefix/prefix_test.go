@@ -0,0 +1,69 @@
+package prefix
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/backends/fs"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+)
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	raw := memory.New()
+	st := New(raw, "dnssec/")
+	tester.DoBackendTests(t, st)
+
+	require.NoError(t, raw.Store(ctx, "main__other", []byte("x")))
+	require.NoError(t, st.Store(ctx, "main__foo", []byte("y")))
+
+	// Stored under the prefix
+	data, err := raw.Load(ctx, "dnssec/main__foo")
+	require.NoError(t, err)
+	assert.Equal(t, "y", string(data))
+
+	// Blobs outside the prefix are not visible
+	ls, err := st.List(ctx, "main__")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"main__foo"}, ls.Names())
+
+	// Empty prefix
+	assert.Equal(t, raw, New(raw, ""))
+}
+
+func TestBackend_LoadRange(t *testing.T) {
+	ctx := context.Background()
+	raw := memory.New()
+	st := New(raw, "dnssec/")
+	require.NoError(t, st.Store(ctx, "main__foo", []byte("hello world")))
+
+	// The memory backend does not support ranged loads
+	_, err := ranged.Load(ctx, st, "main__foo", 6, 5)
+	assert.ErrorIs(t, err, ranged.ErrUnsupported)
+
+	fsb, err := fs.New(fs.Options{RootPath: t.TempDir()})
+	require.NoError(t, err)
+	st = New(fsb, "dnssec-")
+	require.NoError(t, st.Store(ctx, "main__foo", []byte("hello world")))
+	data, err := ranged.Load(ctx, st, "main__foo", 6, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+	_, err = ranged.Load(ctx, st, "main__foo", 8, 5)
+	assert.Error(t, err)
+}
+
+func TestBackend_StoreIf(t *testing.T) {
+	ctx := context.Background()
+	st := New(memory.New(), "dnssec/")
+
+	// The memory backend does not support conditional writes
+	assert.ErrorIs(t, conditional.StoreIf(ctx, st, "main.lease", []byte("x"), ""),
+		conditional.ErrUnsupported)
+	_, _, err := conditional.LoadVersion(ctx, st, "main.lease")
+	assert.ErrorIs(t, err, conditional.ErrUnsupported)
+}
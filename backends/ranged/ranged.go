@@ -0,0 +1,48 @@
+// Package ranged defines an optional storage backend interface for loading
+// part of a blob. It is used to download only the changed DBIs of framed
+// snapshots, see storage_partial_downloads.
+//
+// Wrappers like the prefix and throttle backends implement the interface by
+// passing the call on, so whether ranged loads work is only known once the
+// first one is attempted.
+package ranged
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/PowerDNS/simpleblob"
+)
+
+// ErrUnsupported is returned for ranged loads from backends that cannot
+// load part of a blob
+var ErrUnsupported = errors.New("storage backend does not support ranged loads")
+
+// Loader is implemented by storage backends that can load part of a blob
+type Loader interface {
+	// LoadRange loads length bytes of the named blob, starting at offset.
+	// If the blob does not exist, os.ErrNotExist is returned.
+	LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error)
+}
+
+// Load loads length bytes of the named blob, starting at offset, if the
+// backend supports it. Otherwise, ErrUnsupported is returned.
+func Load(ctx context.Context, st simpleblob.Interface, name string, offset, length int64) ([]byte, error) {
+	l, ok := st.(Loader)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range: offset %d, length %d", offset, length)
+	}
+	data, err := l.LoadRange(ctx, name, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("ranged load of %q returned %d bytes, expected %d",
+			name, len(data), length)
+	}
+	return data, nil
+}
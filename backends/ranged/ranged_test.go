@@ -0,0 +1,37 @@
+package ranged
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shortLoader returns one byte less than requested
+type shortLoader struct {
+	*memory.Backend
+}
+
+func (b shortLoader) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	data, err := b.Load(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return data[offset : offset+length-1], nil
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	require.NoError(t, st.Store(ctx, "foo", []byte("hello world")))
+
+	_, err := Load(ctx, st, "foo", 0, 5)
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	_, err = Load(ctx, shortLoader{st}, "foo", 6, 5)
+	assert.EqualError(t, err, `ranged load of "foo" returned 4 bytes, expected 5`)
+	_, err = Load(ctx, shortLoader{st}, "foo", -1, 5)
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+// Package replicate implements a simpleblob.Interface wrapper that stores
+// every blob in one or more replica backends as well, for example buckets in
+// other regions, so that the snapshot stream survives the loss of a region.
+//
+// Blobs are listed and loaded from the main backend only. Stores go to all
+// backends at the same time, and succeed when the main backend and enough
+// replicas to reach the quorum succeed. Deletes go to all backends, but only
+// a failure of the main backend is returned, because the cleanup retries the
+// delete only for blobs that it still lists in the main backend.
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+)
+
+var metricOperations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "lightningstream_storage_replica_operations_total",
+		Help: "Number of store and delete operations on replica storage backends, by replica, operation and result",
+	},
+	[]string{"replica", "operation", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(metricOperations)
+}
+
+// Replica is a named replica backend
+type Replica struct {
+	Name string
+	St   simpleblob.Interface
+}
+
+// Backend stores blobs in the main backend and all replicas
+type Backend struct {
+	st       simpleblob.Interface
+	replicas []Replica
+	quorum   int
+	l        logrus.FieldLogger
+}
+
+// New wraps the main backend with replicas. The quorum is the number of
+// backends, including the main backend, that must store a blob. Zero means
+// all backends.
+func New(st simpleblob.Interface, replicas []Replica, quorum int) *Backend {
+	if quorum <= 0 || quorum > len(replicas)+1 {
+		quorum = len(replicas) + 1
+	}
+	return &Backend{
+		st:       st,
+		replicas: replicas,
+		quorum:   quorum,
+		l:        logrus.WithField("component", "storage-replicate"),
+	}
+}
+
+// List lists the blobs in the main backend
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	return b.st.List(ctx, prefix)
+}
+
+// Load loads a blob from the main backend
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	return b.st.Load(ctx, name)
+}
+
+// LoadRange loads part of a blob from the main backend, if it supports it
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	return ranged.Load(ctx, b.st, name, offset, length)
+}
+
+// Store stores a blob in all backends at the same time, and waits for all of
+// them to finish
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	errs := b.all(ctx, "store", name, func(st simpleblob.Interface) error {
+		return st.Store(ctx, name, data)
+	})
+	mainErr := b.st.Store(ctx, name, data)
+	replicaErrs := <-errs
+	if mainErr != nil {
+		return mainErr
+	}
+	stored := 1
+	var firstErr error
+	for _, err := range replicaErrs {
+		if err == nil {
+			stored++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if stored < b.quorum {
+		return fmt.Errorf("replicate: stored in %d of %d backends, %d required: %w",
+			stored, len(b.replicas)+1, b.quorum, firstErr)
+	}
+	return nil
+}
+
+// Delete removes a blob from all backends. Only an error of the main backend
+// is returned.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	errs := b.all(ctx, "delete", name, func(st simpleblob.Interface) error {
+		return st.Delete(ctx, name)
+	})
+	err := b.st.Delete(ctx, name)
+	<-errs
+	return err
+}
+
+// all runs an operation on all replicas in the background and sends the
+// errors by replica index when they are done
+func (b *Backend) all(ctx context.Context, op, name string, f func(st simpleblob.Interface) error) <-chan []error {
+	ch := make(chan []error, 1)
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for i, r := range b.replicas {
+		wg.Add(1)
+		go func(i int, r Replica) {
+			defer wg.Done()
+			err := f(r.St)
+			errs[i] = err
+			result := "ok"
+			if err != nil {
+				result = "error"
+				if ctx.Err() == nil {
+					b.l.WithError(err).WithFields(logrus.Fields{
+						"replica": r.Name,
+						"name":    name,
+					}).Warnf("Replica %s failed", op)
+				}
+			}
+			metricOperations.WithLabelValues(r.Name, op, result).Inc()
+		}(i, r)
+	}
+	go func() {
+		wg.Wait()
+		ch <- errs
+	}()
+	return ch
+}
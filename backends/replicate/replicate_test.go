@@ -0,0 +1,82 @@
+package replicate
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errDown = errors.New("connection refused")
+
+// down fails all stores and deletes
+type down struct {
+	simpleblob.Interface
+}
+
+func (d down) Store(ctx context.Context, name string, data []byte) error {
+	return errDown
+}
+
+func (d down) Delete(ctx context.Context, name string) error {
+	return errDown
+}
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	main := memory.New()
+	r1 := memory.New()
+	r2 := memory.New()
+
+	b := New(main, []Replica{{Name: "r1", St: r1}, {Name: "r2", St: r2}}, 0)
+	require.NoError(t, b.Store(ctx, "a", []byte("a")))
+	for _, st := range []simpleblob.Interface{main, r1, r2} {
+		data, err := st.Load(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a"), data)
+	}
+
+	// Reads only use the main backend
+	require.NoError(t, r1.Store(ctx, "only-r1", []byte("x")))
+	ls, err := b.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ls.Names())
+	_, err = b.Load(ctx, "only-r1")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, b.Delete(ctx, "a"))
+	for _, st := range []simpleblob.Interface{main, r1, r2} {
+		_, err := st.Load(ctx, "a")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
+
+func TestBackend_quorum(t *testing.T) {
+	ctx := context.Background()
+	main := memory.New()
+	r1 := memory.New()
+	r2 := down{memory.New()}
+
+	// All backends required by default
+	b := New(main, []Replica{{Name: "r1", St: r1}, {Name: "r2", St: r2}}, 0)
+	err := b.Store(ctx, "a", []byte("a"))
+	require.ErrorIs(t, err, errDown)
+	assert.Contains(t, err.Error(), "stored in 2 of 3 backends, 3 required")
+
+	b = New(main, []Replica{{Name: "r1", St: r1}, {Name: "r2", St: r2}}, 2)
+	require.NoError(t, b.Store(ctx, "a", []byte("a")))
+	_, err = r1.Load(ctx, "a")
+	require.NoError(t, err)
+
+	// Replica delete failures are not returned
+	require.NoError(t, b.Delete(ctx, "a"))
+
+	// The main backend must always succeed
+	b = New(down{main}, []Replica{{Name: "r1", St: r1}, {Name: "r2", St: r2}}, 1)
+	require.ErrorIs(t, b.Store(ctx, "b", []byte("b")), errDown)
+}
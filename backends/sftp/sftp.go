@@ -0,0 +1,471 @@
+// Package sftp implements a simpleblob storage backend that stores snapshots
+// as files in a directory on an SSH server, using SFTP.
+//
+// The client authenticates with a private key, and the host key of the server
+// is verified against a known_hosts file. Files are uploaded under a
+// temporary name and then renamed, so that readers never see partially
+// written snapshots. The rename is atomic on servers that support the
+// posix-rename@openssh.com extension, like OpenSSH.
+//
+// A single SSH connection is shared by all operations. It is established
+// again on the next operation after it failed or an operation timed out.
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	sftpclient "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// TypeName is the name this backend is registered under
+	TypeName = "sftp"
+
+	// DefaultPort is the SSH port used if the address has none
+	DefaultPort = "22"
+
+	// DefaultFileMode is the mode of new files
+	DefaultFileMode = 0664
+
+	// DefaultConnectTimeout is the default timeout for establishing the SSH
+	// connection
+	DefaultConnectTimeout = 20 * time.Second
+
+	// DefaultRequestTimeout is the default timeout for a single operation
+	DefaultRequestTimeout = 5 * time.Minute
+
+	// tmpPrefix is the prefix used for temporary files. Files starting with
+	// a dot are never returned by List.
+	tmpPrefix = ".tmp-"
+
+	// posixRename is the SFTP extension for an atomic rename that replaces
+	// an existing file
+	posixRename = "posix-rename@openssh.com"
+)
+
+// Options describes the storage options for the sftp backend
+type Options struct {
+	// Address is the SSH server as 'host' or 'host:port' (required)
+	Address string `yaml:"address"`
+
+	// User is the SSH user name (required)
+	User string `yaml:"user"`
+
+	// PrivateKeyFile is the path to the private key in OpenSSH or PEM format
+	// (required)
+	PrivateKeyFile string `yaml:"private_key_file"`
+
+	// PrivateKeyPassphrase decrypts the private key, if it is encrypted
+	PrivateKeyPassphrase string `yaml:"private_key_passphrase"`
+
+	// KnownHostsFile is the known_hosts file with the host key of the server
+	// (required, unless insecure_ignore_host_key is set)
+	KnownHostsFile string `yaml:"known_hosts_file"`
+
+	// InsecureIgnoreHostKey disables the host key verification. Only use
+	// this for testing.
+	InsecureIgnoreHostKey bool `yaml:"insecure_ignore_host_key"`
+
+	// RootPath is the directory on the server to store the snapshots in
+	// (required). A relative path is relative to the login directory.
+	RootPath string `yaml:"root_path"`
+
+	// CreateRootPath creates the root_path if it does not exist
+	CreateRootPath bool `yaml:"create_root_path"`
+
+	// FileMode is the mode used for new files
+	FileMode os.FileMode `yaml:"file_mode"`
+
+	// Fsync makes Store sync the file to disk on the server before it is
+	// renamed. This requires the fsync@openssh.com extension.
+	Fsync bool `yaml:"fsync"`
+
+	// ConnectTimeout is the timeout for establishing the SSH connection.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+
+	// RequestTimeout is the timeout for a single operation. The connection
+	// is closed when it is exceeded.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+}
+
+// Check validates the options
+func (o Options) Check() error {
+	if o.Address == "" {
+		return fmt.Errorf("sftp storage.options: address is required")
+	}
+	if o.User == "" {
+		return fmt.Errorf("sftp storage.options: user is required")
+	}
+	if o.PrivateKeyFile == "" {
+		return fmt.Errorf("sftp storage.options: private_key_file is required")
+	}
+	if o.KnownHostsFile == "" && !o.InsecureIgnoreHostKey {
+		return fmt.Errorf("sftp storage.options: known_hosts_file is required")
+	}
+	if o.RootPath == "" {
+		return fmt.Errorf("sftp storage.options: root_path is required")
+	}
+	if o.FileMode > 0777 {
+		return fmt.Errorf("sftp storage.options: file_mode: invalid mode %o", o.FileMode)
+	}
+	return nil
+}
+
+// Backend is the SFTP storage backend
+type Backend struct {
+	opt     Options
+	address string
+	config  *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftpclient.Client
+}
+
+// New creates a new backend instance, connects to the server and checks the
+// root directory
+func New(ctx context.Context, opt Options) (*Backend, error) {
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	if opt.FileMode == 0 {
+		opt.FileMode = DefaultFileMode
+	}
+	if opt.ConnectTimeout == 0 {
+		opt.ConnectTimeout = DefaultConnectTimeout
+	}
+	if opt.RequestTimeout == 0 {
+		opt.RequestTimeout = DefaultRequestTimeout
+	}
+	address := opt.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultPort)
+	}
+
+	keyData, err := os.ReadFile(opt.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: private_key_file: %w", err)
+	}
+	var signer ssh.Signer
+	if opt.PrivateKeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(opt.PrivateKeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(keyData)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sftp: private_key_file: %w", err)
+	}
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !opt.InsecureIgnoreHostKey {
+		hostKeyCallback, err = knownhosts.New(opt.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("sftp: known_hosts_file: %w", err)
+		}
+	}
+
+	b := &Backend{
+		opt:     opt,
+		address: address,
+		config: &ssh.ClientConfig{
+			User:            opt.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         opt.ConnectTimeout,
+		},
+	}
+	err = b.do(ctx, func(c *sftpclient.Client) error {
+		if opt.CreateRootPath {
+			if err := c.MkdirAll(opt.RootPath); err != nil {
+				return err
+			}
+		}
+		st, err := c.Stat(opt.RootPath)
+		if err != nil {
+			return err
+		}
+		if !st.IsDir() {
+			return fmt.Errorf("not a directory")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sftp: check root_path %q: %w", opt.RootPath, err)
+	}
+	return b, nil
+}
+
+// connect returns the SFTP client, and connects to the server if there is
+// no connection
+func (b *Backend) connect(ctx context.Context) (*ssh.Client, *sftpclient.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client != nil {
+		return b.conn, b.client, nil
+	}
+	d := net.Dialer{Timeout: b.opt.ConnectTimeout}
+	nc, err := d.DialContext(ctx, "tcp", b.address)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The handshake is not bound to the context
+	_ = nc.SetDeadline(time.Now().Add(b.opt.ConnectTimeout))
+	sc, chans, reqs, err := ssh.NewClientConn(nc, b.address, b.config)
+	if err != nil {
+		_ = nc.Close()
+		return nil, nil, err
+	}
+	_ = nc.SetDeadline(time.Time{})
+	conn := ssh.NewClient(sc, chans, reqs)
+	client, err := sftpclient.NewClient(conn, sftpclient.UseConcurrentWrites(true))
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	b.conn = conn
+	b.client = client
+	return conn, client, nil
+}
+
+// disconnect closes the connection, if it is still the current one
+func (b *Backend) disconnect(conn *ssh.Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != conn {
+		return
+	}
+	_ = b.client.Close()
+	_ = conn.Close()
+	b.conn = nil
+	b.client = nil
+}
+
+// do runs an operation with the SFTP client. When the context is cancelled
+// or the request timeout is exceeded, the connection is closed to abort the
+// operation. After a connection error, the next operation connects again.
+func (b *Backend) do(ctx context.Context, op func(c *sftpclient.Client) error) error {
+	conn, client, err := b.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("sftp: connect to %s: %w", b.address, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.opt.RequestTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.disconnect(conn)
+		case <-done:
+		}
+	}()
+
+	err = op(client)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil && !isStatusError(err) {
+		b.disconnect(conn)
+	}
+	return err
+}
+
+// isStatusError returns true if the error was returned by the server for
+// the operation, instead of a connection failure
+func isStatusError(err error) bool {
+	var se *sftpclient.StatusError
+	return errors.As(err, &se) || os.IsNotExist(err) || os.IsPermission(err)
+}
+
+// allowedName returns true if the name is safe to use as a filename
+func allowedName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\`)
+}
+
+// path returns the path of a blob on the server
+func (b *Backend) path(name string) string {
+	return path.Join(b.opt.RootPath, name)
+}
+
+// List returns the blobs with given prefix, ordered by name. Temporary files
+// and other hidden files are ignored.
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	var blobs simpleblob.BlobList
+	err := b.do(ctx, func(c *sftpclient.Client) error {
+		entries, err := c.ReadDir(b.opt.RootPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Mode().IsRegular() || !allowedName(name) || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			blobs = append(blobs, simpleblob.Blob{
+				Name: name,
+				Size: entry.Size(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, nil
+}
+
+// Load returns the contents of the named blob. If the blob does not exist,
+// os.ErrNotExist is returned.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	if !allowedName(name) {
+		return nil, os.ErrNotExist
+	}
+	var buf bytes.Buffer
+	err := b.do(ctx, func(c *sftpclient.Client) error {
+		f, err := c.Open(b.path(name))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		_, err = f.WriteTo(&buf)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadRange returns length bytes of the named blob, starting at offset
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	if !allowedName(name) {
+		return nil, os.ErrNotExist
+	}
+	data := make([]byte, length)
+	var n int
+	err := b.do(ctx, func(c *sftpclient.Client) error {
+		f, err := c.Open(b.path(name))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		n, err = f.ReadAt(data, offset)
+		if err == io.EOF {
+			err = nil // short read, reported by the caller
+		}
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// Store stores the blob under the given name. The data is written to a
+// temporary file first, which is then renamed.
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	if !allowedName(name) {
+		return fmt.Errorf("sftp: invalid name: %q", name)
+	}
+	tmpPath := b.path(fmt.Sprintf("%s%s-%d", tmpPrefix, name, time.Now().UnixNano()))
+	return b.do(ctx, func(c *sftpclient.Client) (err error) {
+		f, err := c.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return err
+		}
+		ok := false
+		defer func() {
+			if !ok {
+				_ = f.Close()
+				_ = c.Remove(tmpPath)
+			}
+		}()
+
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+		if err := f.Chmod(b.opt.FileMode); err != nil {
+			return err
+		}
+		if b.opt.Fsync {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := b.rename(c, tmpPath, b.path(name)); err != nil {
+			return err
+		}
+		ok = true
+		return nil
+	})
+}
+
+// rename renames the temporary file, replacing an existing file. Without
+// the posix-rename extension, the existing file is removed first, because a
+// plain SFTP rename does not overwrite files.
+func (b *Backend) rename(c *sftpclient.Client, oldPath, newPath string) error {
+	if _, ok := c.HasExtension(posixRename); ok {
+		return c.PosixRename(oldPath, newPath)
+	}
+	if err := c.Remove(newPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return c.Rename(oldPath, newPath)
+}
+
+// Delete removes the named blob. Removing a blob that does not exist is not
+// an error.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	if !allowedName(name) {
+		return nil
+	}
+	err := b.do(ctx, func(c *sftpclient.Client) error {
+		return c.Remove(b.path(name))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	simpleblob.RegisterBackend(TypeName, func(ctx context.Context, p simpleblob.InitParams) (simpleblob.Interface, error) {
+		var opt Options
+		if err := p.OptionsThroughYAML(&opt); err != nil {
+			return nil, err
+		}
+		return New(ctx, opt)
+	})
+}
@@ -0,0 +1,194 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PowerDNS/simpleblob/tester"
+	sftpclient "github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is an SSH server with the SFTP subsystem that serves the local
+// filesystem
+type testServer struct {
+	addr           string
+	keyFile        string
+	knownHostsFile string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	dir := t.TempDir()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	require.NoError(t, err)
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authorized, err := ssh.NewPublicKey(clientPub)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "ls" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, assert.AnError
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(nc, config)
+		}
+	}()
+
+	s := &testServer{
+		addr:           ln.Addr().String(),
+		keyFile:        filepath.Join(dir, "id_ed25519"),
+		knownHostsFile: filepath.Join(dir, "known_hosts"),
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(clientPriv)
+	require.NoError(t, err)
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	require.NoError(t, os.WriteFile(s.keyFile, pem.EncodeToMemory(block), 0600))
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, hostSigner.PublicKey())
+	require.NoError(t, os.WriteFile(s.knownHostsFile, []byte(line+"\n"), 0644))
+	return s
+}
+
+func serveSSH(nc net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			_ = nch.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					server, err := sftpclient.NewServer(ch)
+					if err == nil {
+						_ = server.Serve()
+					}
+					_ = ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func (s *testServer) options(root string) Options {
+	return Options{
+		Address:        s.addr,
+		User:           "ls",
+		PrivateKeyFile: s.keyFile,
+		KnownHostsFile: s.knownHostsFile,
+		RootPath:       root,
+	}
+}
+
+func TestBackend(t *testing.T) {
+	s := newTestServer(t)
+	root := t.TempDir()
+	b, err := New(context.Background(), s.options(root))
+	require.NoError(t, err)
+	tester.DoBackendTests(t, b)
+
+	ctx := context.Background()
+	require.NoError(t, b.Store(ctx, "foo", []byte("0123456789")))
+	data, err := b.LoadRange(ctx, "foo", 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("234"), data)
+	st, err := os.Stat(filepath.Join(root, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(DefaultFileMode), st.Mode().Perm())
+
+	// Replaced atomically
+	require.NoError(t, b.Store(ctx, "foo", []byte("bar")))
+	data, err = b.Load(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), data)
+
+	// Leftover temporary files from an interrupted store are not listed
+	require.NoError(t, os.WriteFile(filepath.Join(root, tmpPrefix+"foo-123"), nil, 0644))
+	ls, err := b.List(ctx, "")
+	require.NoError(t, err)
+	assert.Contains(t, ls.Names(), "foo")
+	assert.NotContains(t, ls.Names(), tmpPrefix+"foo-123")
+
+	// Connects again after the connection was lost
+	b.mu.Lock()
+	_ = b.conn.Close()
+	b.mu.Unlock()
+	_, err = b.Load(ctx, "foo")
+	assert.Error(t, err)
+	data, err = b.Load(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), data)
+
+	// Names that could escape the root are rejected
+	assert.Error(t, b.Store(ctx, "../foo", []byte("bar")))
+	_, err = b.Load(ctx, "../foo")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNew_errors(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	// Root path is created when requested
+	opt := s.options(filepath.Join(t.TempDir(), "a", "b"))
+	_, err := New(ctx, opt)
+	assert.Error(t, err)
+	opt.CreateRootPath = true
+	_, err = New(ctx, opt)
+	assert.NoError(t, err)
+
+	// Unknown host key
+	opt = s.options(t.TempDir())
+	other := newTestServer(t)
+	opt.KnownHostsFile = other.knownHostsFile
+	_, err = New(ctx, opt)
+	assert.ErrorContains(t, err, "knownhosts: key is unknown")
+
+	// Wrong user
+	opt = s.options(t.TempDir())
+	opt.User = "root"
+	_, err = New(ctx, opt)
+	assert.ErrorContains(t, err, "unable to authenticate")
+
+	_, err = New(ctx, Options{Address: s.addr})
+	assert.Error(t, err)
+}
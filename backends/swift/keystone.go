@@ -0,0 +1,216 @@
+package swift
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshMargin is how long before its expiry a token is renewed
+const tokenRefreshMargin = 5 * time.Minute
+
+// keystoneAuth authenticates against the Keystone v3 identity API and caches
+// the token and the object-store endpoint from the service catalog
+type keystoneAuth struct {
+	client *http.Client
+	opt    Options
+
+	mu         sync.Mutex
+	token      string
+	expires    time.Time
+	storageURL string
+}
+
+// authRequest is the body of a POST /v3/auth/tokens request
+type authRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods               []string               `json:"methods"`
+			Password              *passwordIdentity      `json:"password,omitempty"`
+			ApplicationCredential *applicationCredential `json:"application_credential,omitempty"`
+		} `json:"identity"`
+		Scope *authScope `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+type passwordIdentity struct {
+	User struct {
+		ID       string  `json:"id,omitempty"`
+		Name     string  `json:"name,omitempty"`
+		Domain   *domain `json:"domain,omitempty"`
+		Password string  `json:"password"`
+	} `json:"user"`
+}
+
+type applicationCredential struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+type authScope struct {
+	Project struct {
+		ID     string  `json:"id,omitempty"`
+		Name   string  `json:"name,omitempty"`
+		Domain *domain `json:"domain,omitempty"`
+	} `json:"project"`
+}
+
+type domain struct {
+	Name string `json:"name"`
+}
+
+// authResponse is the part of the token response we use
+type authResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Catalog   []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				RegionID  string `json:"region_id"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+// newAuthRequest returns the token request for the configured credentials
+func (a *keystoneAuth) newAuthRequest() *authRequest {
+	o := a.opt
+	req := new(authRequest)
+	id := &req.Auth.Identity
+	if o.ApplicationCredentialID != "" {
+		id.Methods = []string{"application_credential"}
+		id.ApplicationCredential = &applicationCredential{
+			ID:     o.ApplicationCredentialID,
+			Secret: o.ApplicationCredentialSecret,
+		}
+		return req // scoped by the application credential
+	}
+	id.Methods = []string{"password"}
+	id.Password = new(passwordIdentity)
+	user := &id.Password.User
+	user.ID = o.UserID
+	user.Name = o.Username
+	user.Password = o.Password
+	if o.UserID == "" {
+		user.Domain = &domain{Name: o.UserDomainName}
+	}
+	if o.ProjectID != "" || o.ProjectName != "" {
+		req.Auth.Scope = new(authScope)
+		project := &req.Auth.Scope.Project
+		project.ID = o.ProjectID
+		project.Name = o.ProjectName
+		if o.ProjectID == "" {
+			project.Domain = &domain{Name: o.ProjectDomainName}
+		}
+	}
+	return req
+}
+
+// tokensURL returns the Keystone v3 token URL for the auth_url, which may or
+// may not include the version
+func (a *keystoneAuth) tokensURL() string {
+	u := strings.TrimSuffix(a.opt.AuthURL, "/")
+	if !strings.HasSuffix(u, "/v3") {
+		u += "/v3"
+	}
+	return u + "/auth/tokens"
+}
+
+// Token returns a valid token and the storage URL, and authenticates again
+// if the token expires soon
+func (a *keystoneAuth) Token(ctx context.Context) (token, storageURL string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expires) > tokenRefreshMargin {
+		return a.token, a.storageURL, nil
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return "", "", err
+	}
+	return a.token, a.storageURL, nil
+}
+
+// Invalidate forgets the token, after it was rejected
+func (a *keystoneAuth) Invalidate(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token == token {
+		a.token = ""
+	}
+}
+
+// authenticate requests a new token. Must be called with the lock held.
+func (a *keystoneAuth) authenticate(ctx context.Context) error {
+	body, err := json.Marshal(a.newAuthRequest())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.tokensURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("swift: keystone auth: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("swift: keystone auth: %w", err)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("swift: keystone auth: %s", resp.Status)
+	}
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return fmt.Errorf("swift: keystone auth: no X-Subject-Token in response")
+	}
+	var ar authResponse
+	if err := json.Unmarshal(data, &ar); err != nil {
+		return fmt.Errorf("swift: keystone auth response: %w", err)
+	}
+	storageURL := a.opt.StorageURL
+	if storageURL == "" {
+		storageURL, err = a.findEndpoint(&ar)
+		if err != nil {
+			return err
+		}
+	}
+	a.token = token
+	a.expires = ar.Token.ExpiresAt
+	a.storageURL = strings.TrimSuffix(storageURL, "/")
+	return nil
+}
+
+// findEndpoint returns the object-store endpoint from the service catalog for
+// the configured region and interface
+func (a *keystoneAuth) findEndpoint(ar *authResponse) (string, error) {
+	for _, svc := range ar.Token.Catalog {
+		if svc.Type != "object-store" {
+			continue
+		}
+		for _, ep := range svc.Endpoints {
+			if ep.Interface != a.opt.Interface {
+				continue
+			}
+			if a.opt.Region != "" && ep.Region != a.opt.Region && ep.RegionID != a.opt.Region {
+				continue
+			}
+			return ep.URL, nil
+		}
+	}
+	return "", fmt.Errorf("swift: no %s object-store endpoint in region %q in the service catalog",
+		a.opt.Interface, a.opt.Region)
+}
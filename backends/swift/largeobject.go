@@ -0,0 +1,119 @@
+package swift
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// sloSegment is an entry in a static large object manifest
+type sloSegment struct {
+	Path      string `json:"path"`
+	ETag      string `json:"etag"`
+	SizeBytes int    `json:"size_bytes"`
+}
+
+// segmentPrefix returns a unique prefix for the segments of a new large
+// object, following the naming of the swift command line client
+func (b *Backend) segmentPrefix(name string, size int) string {
+	return fmt.Sprintf("%s%s/%s/%d/%d/%d/", b.opt.GlobalPrefix, name, b.opt.LargeObjects,
+		time.Now().UnixNano(), size, b.opt.SegmentSize.Bytes())
+}
+
+// storeLarge uploads the data in segments to the segment container, and then
+// stores the manifest under the name. The segments are removed again if the
+// upload fails.
+func (b *Backend) storeLarge(ctx context.Context, name string, data []byte) (err error) {
+	if !b.segmentContainerCreated.Load() {
+		if err := b.createContainer(ctx, b.opt.SegmentContainer); err != nil {
+			return fmt.Errorf("swift: create segment container: %w", err)
+		}
+		b.segmentContainerCreated.Store(true)
+	}
+
+	prefix := b.segmentPrefix(name, len(data))
+	defer func() {
+		if err != nil {
+			// Best effort, the store is retried with a new prefix
+			_ = b.deleteSegments(context.Background(), b.opt.SegmentContainer, prefix)
+		}
+	}()
+
+	segmentSize := int(b.opt.SegmentSize.Bytes())
+	var segments []sloSegment
+	for i := 0; i*segmentSize < len(data); i++ {
+		end := (i + 1) * segmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		segment := data[i*segmentSize : end]
+		segmentName := fmt.Sprintf("%s%08d", prefix, i)
+		if err := b.put(ctx, b.opt.SegmentContainer, segmentName, segment); err != nil {
+			return fmt.Errorf("swift: store segment %d: %w", i, err)
+		}
+		sum := md5.Sum(segment)
+		segments = append(segments, sloSegment{
+			Path:      "/" + b.opt.SegmentContainer + "/" + segmentName,
+			ETag:      hex.EncodeToString(sum[:]),
+			SizeBytes: len(segment),
+		})
+	}
+
+	path := objectPath(b.opt.Container, b.opt.GlobalPrefix+name)
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if b.opt.LargeObjects == LargeObjectsDLO {
+		header.Set("X-Object-Manifest", objectPath(b.opt.SegmentContainer, prefix))
+		_, _, err = b.do(ctx, http.MethodPut, path, nil, header, []byte{})
+	} else {
+		var manifest []byte
+		manifest, err = json.Marshal(segments)
+		if err != nil {
+			return err
+		}
+		q := url.Values{}
+		q.Set("multipart-manifest", "put")
+		_, _, err = b.do(ctx, http.MethodPut, path, q, header, manifest)
+	}
+	if err != nil {
+		return fmt.Errorf("swift: store manifest: %w", err)
+	}
+	return nil
+}
+
+// deleteDLOSegments deletes the segments of a dynamic large object, given
+// its X-Object-Manifest header
+func (b *Backend) deleteDLOSegments(ctx context.Context, manifest string) error {
+	manifest, err := url.PathUnescape(manifest)
+	if err != nil {
+		return fmt.Errorf("swift: invalid X-Object-Manifest %q: %w", manifest, err)
+	}
+	container, prefix, ok := strings.Cut(manifest, "/")
+	if !ok || prefix == "" {
+		// Never delete a whole container because of an odd manifest
+		return fmt.Errorf("swift: invalid X-Object-Manifest %q", manifest)
+	}
+	return b.deleteSegments(ctx, container, prefix)
+}
+
+// deleteSegments deletes all segments with the prefix
+func (b *Backend) deleteSegments(ctx context.Context, container, prefix string) error {
+	entries, err := b.list(ctx, container, prefix)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		_, _, err := b.do(ctx, http.MethodDelete, objectPath(container, e.Name), nil, nil, nil)
+		if err != nil && err != os.ErrNotExist {
+			return err
+		}
+	}
+	return nil
+}
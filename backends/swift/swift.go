@@ -0,0 +1,433 @@
+// Package swift implements a simpleblob storage backend for OpenStack Swift,
+// using the Swift object storage API with Keystone v3 authentication.
+//
+// Snapshots larger than the segment size are stored as large objects: the
+// data is uploaded in segments to a separate segment container, followed by
+// a manifest under the snapshot name. Static large objects (SLO) are used by
+// default, dynamic large objects (DLO) are available for clusters without the
+// SLO middleware. Loading a large object returns the concatenated segments,
+// and deleting it also deletes its segments.
+package swift
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/c2h5oh/datasize"
+	"go.uber.org/atomic"
+	"powerdns.com/platform/lightningstream/backends/httpclient"
+)
+
+const (
+	// TypeName is the name this backend is registered under
+	TypeName = "swift"
+
+	// DefaultSegmentSize is the default size of large object segments
+	DefaultSegmentSize = datasize.GB
+
+	// DefaultInitTimeout is the default timeout for the initial container
+	// check
+	DefaultInitTimeout = 20 * time.Second
+
+	// DefaultRequestTimeout is the default timeout for a single request
+	DefaultRequestTimeout = 5 * time.Minute
+
+	// Large object types
+	LargeObjectsSLO = "slo"
+	LargeObjectsDLO = "dlo"
+
+	// listLimit is the maximum number of objects per listing request
+	listLimit = 10000
+)
+
+// Options describes the storage options for the Swift backend
+type Options struct {
+	// AuthURL is the Keystone identity endpoint, with or without '/v3'
+	// (required)
+	AuthURL string `yaml:"auth_url"`
+
+	// Password authentication, with the user by ID or by name and domain
+	Username       string `yaml:"username"`
+	UserID         string `yaml:"user_id"`
+	UserDomainName string `yaml:"user_domain_name"`
+	Password       string `yaml:"password"`
+
+	// The project to scope the token to, by ID or by name and domain
+	ProjectName       string `yaml:"project_name"`
+	ProjectID         string `yaml:"project_id"`
+	ProjectDomainName string `yaml:"project_domain_name"`
+
+	// Application credential authentication, instead of a password
+	ApplicationCredentialID     string `yaml:"application_credential_id"`
+	ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+
+	// Region and Interface select the object-store endpoint in the service
+	// catalog. The interface is 'public' (default), 'internal' or 'admin'.
+	Region    string `yaml:"region"`
+	Interface string `yaml:"interface"`
+
+	// StorageURL overrides the object-store endpoint from the service
+	// catalog, like 'https://swift.example.com/v1/AUTH_project'.
+	StorageURL string `yaml:"storage_url"`
+
+	// Container is the name of the container (required)
+	Container string `yaml:"container"`
+
+	// CreateContainer creates the container if it does not exist
+	CreateContainer bool `yaml:"create_container"`
+
+	// SegmentContainer is the container for the segments of large objects
+	// (default: the container name with a '_segments' suffix). It is created
+	// when the first large object is stored.
+	SegmentContainer string `yaml:"segment_container"`
+
+	// SegmentSize is the size of the segments of large objects. Snapshots up
+	// to this size are stored as a single object.
+	SegmentSize datasize.ByteSize `yaml:"segment_size"`
+
+	// LargeObjects is the type of large objects to create: 'slo' (default)
+	// or 'dlo'. Both types are loaded and deleted regardless of this option.
+	LargeObjects string `yaml:"large_objects"`
+
+	// GlobalPrefix is prepended to all object names, e.g. 'lightningstream/'.
+	GlobalPrefix string `yaml:"global_prefix"`
+
+	// InitTimeout is the timeout for the initial container check on startup.
+	InitTimeout time.Duration `yaml:"init_timeout"`
+
+	// RequestTimeout is the timeout for a single API request.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+
+	// HTTP configures the proxy and TLS settings (proxy_url, no_proxy, tls
+	// and tls_min_version). These apply to Keystone and Swift.
+	HTTP httpclient.Options `yaml:",inline"`
+}
+
+// Check validates the options
+func (o Options) Check() error {
+	if o.AuthURL == "" {
+		return fmt.Errorf("swift storage.options: auth_url is required")
+	}
+	if o.Container == "" {
+		return fmt.Errorf("swift storage.options: container is required")
+	}
+	if o.SegmentContainer != "" && o.SegmentContainer == o.Container {
+		return fmt.Errorf("swift storage.options: segment_container must differ from the container")
+	}
+	if o.ApplicationCredentialID != "" {
+		if o.ApplicationCredentialSecret == "" {
+			return fmt.Errorf("swift storage.options: application_credential_secret is required")
+		}
+	} else if (o.Username == "" && o.UserID == "") || o.Password == "" {
+		return fmt.Errorf("swift storage.options: username or user_id and password, " +
+			"or application_credential_id are required")
+	}
+	switch o.LargeObjects {
+	case "", LargeObjectsSLO, LargeObjectsDLO:
+	default:
+		return fmt.Errorf("swift storage.options: large_objects: must be 'slo' or 'dlo'")
+	}
+	switch o.Interface {
+	case "", "public", "internal", "admin":
+	default:
+		return fmt.Errorf("swift storage.options: interface: must be 'public', 'internal' or 'admin'")
+	}
+	if err := o.HTTP.Check("swift storage.options"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Backend is the Swift storage backend
+type Backend struct {
+	opt    Options
+	client *http.Client
+	auth   *keystoneAuth
+
+	segmentContainerCreated atomic.Bool
+}
+
+// New creates a new backend instance, authenticates and checks if the
+// container is accessible.
+func New(ctx context.Context, opt Options) (*Backend, error) {
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	if opt.UserDomainName == "" {
+		opt.UserDomainName = "Default"
+	}
+	if opt.ProjectDomainName == "" {
+		opt.ProjectDomainName = "Default"
+	}
+	if opt.Interface == "" {
+		opt.Interface = "public"
+	}
+	if opt.SegmentContainer == "" {
+		opt.SegmentContainer = opt.Container + "_segments"
+	}
+	if opt.SegmentSize == 0 {
+		opt.SegmentSize = DefaultSegmentSize
+	}
+	if opt.LargeObjects == "" {
+		opt.LargeObjects = LargeObjectsSLO
+	}
+	if opt.InitTimeout == 0 {
+		opt.InitTimeout = DefaultInitTimeout
+	}
+	if opt.RequestTimeout == 0 {
+		opt.RequestTimeout = DefaultRequestTimeout
+	}
+
+	transport, err := opt.HTTP.Transport(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("swift storage.options: %w", err)
+	}
+	client := &http.Client{
+		Timeout:   opt.RequestTimeout,
+		Transport: transport,
+	}
+	b := &Backend{
+		opt:    opt,
+		client: client,
+		auth:   &keystoneAuth{client: client, opt: opt},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opt.InitTimeout)
+	defer cancel()
+	_, _, err = b.do(ctx, http.MethodHead, containerPath(opt.Container), nil, nil, nil)
+	if err == os.ErrNotExist && opt.CreateContainer {
+		err = b.createContainer(ctx, opt.Container)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("swift: check container %q: %w", opt.Container, err)
+	}
+	return b, nil
+}
+
+// containerPath returns the escaped path of a container
+func containerPath(container string) string {
+	return url.PathEscape(container)
+}
+
+// objectPath returns the escaped path of an object. Slashes in the name are
+// kept as they are, to get readable paths in proxy logs.
+func objectPath(container, name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return containerPath(container) + "/" + strings.Join(parts, "/")
+}
+
+// createContainer creates a container. Creating a container that exists is
+// not an error.
+func (b *Backend) createContainer(ctx context.Context, container string) error {
+	_, _, err := b.do(ctx, http.MethodPut, containerPath(container), nil, nil, []byte{})
+	return err
+}
+
+// do performs an authenticated request for a path relative to the storage
+// URL, and returns the response headers and body. A 404 status is returned as
+// os.ErrNotExist. When the token is rejected, the request is retried once
+// with a new token.
+func (b *Backend) do(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (http.Header, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		token, storageURL, err := b.auth.Token(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		u := storageURL + "/" + path
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("X-Auth-Token", token)
+		resp, err := b.client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			b.auth.Invalidate(token)
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, nil, os.ErrNotExist
+		case resp.StatusCode < 200 || resp.StatusCode >= 300:
+			return nil, nil, apiError(method, resp, data)
+		}
+		return resp.Header, data, nil
+	}
+}
+
+// apiError converts an error response to an error
+func apiError(method string, resp *http.Response, data []byte) error {
+	msg := strings.TrimSpace(string(data))
+	if len(msg) > 200 || strings.HasPrefix(msg, "<") {
+		msg = "" // HTML error pages are not useful in logs
+	}
+	if msg != "" {
+		return fmt.Errorf("swift: %s: %s: %s", method, resp.Status, msg)
+	}
+	return fmt.Errorf("swift: %s: %s", method, resp.Status)
+}
+
+// listEntry is an object in a container listing
+type listEntry struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// list returns all objects in a container with the given prefix
+func (b *Backend) list(ctx context.Context, container, prefix string) ([]listEntry, error) {
+	var entries []listEntry
+	marker := ""
+	for {
+		q := url.Values{}
+		q.Set("format", "json")
+		q.Set("prefix", prefix)
+		q.Set("limit", fmt.Sprint(listLimit))
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		_, data, err := b.do(ctx, http.MethodGet, containerPath(container), q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []listEntry
+		if len(data) > 0 { // 204 for an empty container
+			if err := json.Unmarshal(data, &page); err != nil {
+				return nil, fmt.Errorf("swift: list response: %w", err)
+			}
+		}
+		if len(page) == 0 {
+			break
+		}
+		entries = append(entries, page...)
+		marker = page[len(page)-1].Name
+	}
+	return entries, nil
+}
+
+// List returns the blobs with given prefix, ordered by name. The size of a
+// dynamic large object is listed as 0.
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	entries, err := b.list(ctx, b.opt.Container, b.opt.GlobalPrefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make(simpleblob.BlobList, 0, len(entries))
+	for _, e := range entries {
+		blobs = append(blobs, simpleblob.Blob{
+			Name: strings.TrimPrefix(e.Name, b.opt.GlobalPrefix),
+			Size: e.Bytes,
+		})
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, nil
+}
+
+// Load returns the contents of the named blob. If the blob does not exist,
+// os.ErrNotExist is returned.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	_, data, err := b.do(ctx, http.MethodGet, objectPath(b.opt.Container, b.opt.GlobalPrefix+name), nil, nil, nil)
+	return data, err
+}
+
+// LoadRange returns length bytes of the named blob, starting at offset,
+// using a range request
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	_, data, err := b.do(ctx, http.MethodGet, objectPath(b.opt.Container, b.opt.GlobalPrefix+name), nil, header, nil)
+	return data, err
+}
+
+// Store stores the blob under the given name, as a large object if it is
+// larger than the segment size
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	if uint64(len(data)) > b.opt.SegmentSize.Bytes() {
+		return b.storeLarge(ctx, name, data)
+	}
+	return b.put(ctx, b.opt.Container, b.opt.GlobalPrefix+name, data)
+}
+
+// put stores a single object, which Swift verifies against its MD5 checksum
+func (b *Backend) put(ctx context.Context, container, name string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	sum := md5.Sum(data)
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("ETag", hex.EncodeToString(sum[:]))
+	_, _, err := b.do(ctx, http.MethodPut, objectPath(container, name), nil, header, data)
+	return err
+}
+
+// Delete removes the named blob, including the segments of a large object.
+// Removing a blob that does not exist is not an error.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	path := objectPath(b.opt.Container, b.opt.GlobalPrefix+name)
+	header, _, err := b.do(ctx, http.MethodHead, path, nil, nil, nil)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var q url.Values
+	if strings.EqualFold(header.Get("X-Static-Large-Object"), "true") {
+		q = url.Values{}
+		q.Set("multipart-manifest", "delete") // also deletes the segments
+	}
+	_, _, err = b.do(ctx, http.MethodDelete, path, q, nil, nil)
+	if err != nil && err != os.ErrNotExist {
+		return err
+	}
+	if manifest := header.Get("X-Object-Manifest"); manifest != "" {
+		return b.deleteDLOSegments(ctx, manifest)
+	}
+	return nil
+}
+
+func init() {
+	simpleblob.RegisterBackend(TypeName, func(ctx context.Context, p simpleblob.InitParams) (simpleblob.Interface, error) {
+		var opt Options
+		if err := p.OptionsThroughYAML(&opt); err != nil {
+			return nil, err
+		}
+		return New(ctx, opt)
+	})
+}
@@ -0,0 +1,329 @@
+package swift
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+)
+
+// fakeObject is an object stored in fakeSwift
+type fakeObject struct {
+	data     []byte
+	slo      []sloSegment // static large object manifest
+	manifest string       // dynamic large object manifest
+}
+
+// fakeSwift implements the subset of the Keystone v3 and Swift APIs used by
+// the backend
+type fakeSwift struct {
+	mu         sync.Mutex
+	url        string
+	token      string
+	auths      int
+	containers map[string]map[string]*fakeObject
+}
+
+func newFakeSwift() *fakeSwift {
+	return &fakeSwift{
+		containers: map[string]map[string]*fakeObject{
+			"test": {},
+		},
+	}
+}
+
+func (f *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/identity/v3/auth/tokens" {
+		var ar authRequest
+		_ = json.NewDecoder(r.Body).Decode(&ar)
+		pw := ar.Auth.Identity.Password
+		if pw == nil || pw.User.Name != "user" || pw.User.Password != "secret" ||
+			ar.Auth.Scope == nil || ar.Auth.Scope.Project.Name != "project" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		f.auths++
+		f.token = fmt.Sprintf("token-%d", f.auths)
+		var resp authResponse
+		resp.Token.ExpiresAt = time.Now().Add(time.Hour)
+		_ = json.Unmarshal([]byte(`{"token":{"catalog":[
+			{"type":"identity","endpoints":[{"interface":"public","region":"one","url":"http://wrong"}]},
+			{"type":"object-store","endpoints":[
+				{"interface":"public","region":"two","url":"http://wrong"},
+				{"interface":"internal","region":"one","url":"http://wrong"},
+				{"interface":"public","region":"one","url":"`+f.url+`/v1/AUTH_project"}]}]}}`), &resp)
+		w.Header().Set("X-Subject-Token", f.token)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != f.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/AUTH_project/")
+	containerName, name, _ := strings.Cut(path, "/")
+	container, exists := f.containers[containerName]
+	if name == "" {
+		switch r.Method {
+		case http.MethodPut:
+			if !exists {
+				f.containers[containerName] = make(map[string]*fakeObject)
+			}
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodHead:
+			if !exists {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			f.serveList(w, r, container)
+		}
+		return
+	}
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		obj := &fakeObject{data: data}
+		if q.Get("multipart-manifest") == "put" {
+			_ = json.Unmarshal(data, &obj.slo)
+		}
+		obj.manifest = r.Header.Get("X-Object-Manifest")
+		container[name] = obj
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		obj := container[name]
+		if obj == nil {
+			http.NotFound(w, r)
+			return
+		}
+		data := f.objectData(obj)
+		if obj.slo != nil {
+			w.Header().Set("X-Static-Large-Object", "True")
+		}
+		if obj.manifest != "" {
+			w.Header().Set("X-Object-Manifest", obj.manifest)
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[start : end+1]
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		obj := container[name]
+		if obj == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if q.Get("multipart-manifest") == "delete" {
+			for _, s := range obj.slo {
+				segContainer, segName, _ := strings.Cut(strings.TrimPrefix(s.Path, "/"), "/")
+				delete(f.containers[segContainer], segName)
+			}
+		}
+		delete(container, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeSwift) serveList(w http.ResponseWriter, r *http.Request, container map[string]*fakeObject) {
+	q := r.URL.Query()
+	var entries []listEntry
+	for name, obj := range container {
+		if strings.HasPrefix(name, q.Get("prefix")) && name > q.Get("marker") {
+			entries = append(entries, listEntry{Name: name, Bytes: int64(len(obj.data))})
+		}
+	}
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > 2 {
+		entries = entries[:2] // test the paging
+	}
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+// objectData returns the data of an object, or the concatenated segments of
+// a large object
+func (f *fakeSwift) objectData(obj *fakeObject) []byte {
+	switch {
+	case obj.slo != nil:
+		var data []byte
+		for _, s := range obj.slo {
+			segContainer, segName, _ := strings.Cut(strings.TrimPrefix(s.Path, "/"), "/")
+			data = append(data, f.containers[segContainer][segName].data...)
+		}
+		return data
+	case obj.manifest != "":
+		manifest, _ := url.PathUnescape(obj.manifest)
+		segContainer, prefix, _ := strings.Cut(manifest, "/")
+		var names []string
+		for name := range f.containers[segContainer] {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		var data []byte
+		for _, name := range names {
+			data = append(data, f.containers[segContainer][name].data...)
+		}
+		return data
+	}
+	return obj.data
+}
+
+func newTestBackend(t *testing.T, f *fakeSwift, opt Options) *Backend {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+	opt.AuthURL = srv.URL + "/identity"
+	opt.Username = "user"
+	opt.Password = "secret"
+	opt.ProjectName = "project"
+	opt.Region = "one"
+	opt.Container = "test"
+	b, err := New(context.Background(), opt)
+	require.NoError(t, err)
+	return b
+}
+
+func TestBackend(t *testing.T) {
+	f := newFakeSwift()
+	b := newTestBackend(t, f, Options{GlobalPrefix: "prefix/"})
+	tester.DoBackendTests(t, b)
+
+	ctx := context.Background()
+	require.NoError(t, b.Store(ctx, "foo", []byte("0123456789")))
+	data, err := ranged.Load(ctx, b, "foo", 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("234"), data)
+	assert.Contains(t, f.containers["test"], "prefix/foo")
+
+	// A rejected token is renewed
+	f.mu.Lock()
+	f.token = "revoked"
+	f.mu.Unlock()
+	_, err = b.Load(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, 2, f.auths)
+}
+
+func TestBackend_largeObjects(t *testing.T) {
+	for _, typ := range []string{LargeObjectsSLO, LargeObjectsDLO} {
+		t.Run(typ, func(t *testing.T) {
+			f := newFakeSwift()
+			b := newTestBackend(t, f, Options{
+				SegmentSize:  4 * datasize.B,
+				LargeObjects: typ,
+			})
+			ctx := context.Background()
+
+			data := []byte("0123456789")
+			require.NoError(t, b.Store(ctx, "large", data))
+			assert.Len(t, f.containers["test_segments"], 3)
+			require.NoError(t, b.Store(ctx, "small", []byte("0123")))
+			assert.Len(t, f.containers["test_segments"], 3)
+
+			ls, err := b.List(ctx, "")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"large", "small"}, ls.Names())
+			loaded, err := b.Load(ctx, "large")
+			require.NoError(t, err)
+			assert.Equal(t, data, loaded)
+			loaded, err = b.LoadRange(ctx, "large", 3, 3)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("345"), loaded)
+
+			// The segments are deleted with the manifest
+			require.NoError(t, b.Delete(ctx, "large"))
+			assert.Empty(t, f.containers["test_segments"])
+			_, err = b.Load(ctx, "large")
+			assert.True(t, os.IsNotExist(err))
+			require.NoError(t, b.Delete(ctx, "large"))
+		})
+	}
+}
+
+func TestNew_errors(t *testing.T) {
+	f := newFakeSwift()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	f.url = srv.URL
+	opt := Options{
+		AuthURL:     srv.URL + "/identity/v3/",
+		Username:    "user",
+		Password:    "wrong",
+		ProjectName: "project",
+		Container:   "test",
+	}
+	ctx := context.Background()
+	_, err := New(ctx, opt)
+	assert.ErrorContains(t, err, "401")
+
+	opt.Password = "secret"
+	opt.Region = "three"
+	_, err = New(ctx, opt)
+	assert.ErrorContains(t, err, "no public object-store endpoint")
+
+	opt.Region = "one"
+	opt.Container = "missing"
+	_, err = New(ctx, opt)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	opt.CreateContainer = true
+	_, err = New(ctx, opt)
+	assert.NoError(t, err)
+
+	opt.SegmentContainer = opt.Container
+	_, err = New(ctx, opt)
+	assert.Error(t, err)
+	_, err = New(ctx, Options{AuthURL: srv.URL, Container: "test"})
+	assert.Error(t, err)
+}
+
+func TestKeystoneAuth_applicationCredential(t *testing.T) {
+	a := &keystoneAuth{opt: Options{
+		AuthURL:                     "https://keystone.example.com/v3",
+		ApplicationCredentialID:     "id",
+		ApplicationCredentialSecret: "secret",
+	}}
+	assert.Equal(t, "https://keystone.example.com/v3/auth/tokens", a.tokensURL())
+	body, err := json.Marshal(a.newAuthRequest())
+	require.NoError(t, err)
+	assert.True(t, bytes.Contains(body, []byte(`"methods":["application_credential"]`)), string(body))
+	assert.False(t, bytes.Contains(body, []byte(`"scope"`)), string(body))
+}
@@ -0,0 +1,177 @@
+// Package throttle implements a simpleblob.Interface wrapper that limits the
+// average upload and download rate, so that syncing large snapshots does not
+// saturate a network link shared with other traffic.
+//
+// The simpleblob interface transfers whole blobs, so a single transfer still
+// runs at the full speed of the link. After a transfer of n bytes, the next
+// transfer in the same direction is delayed until n/rate seconds after the
+// previous one started, which limits the average rate over multiple transfers.
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/prometheus/client_golang/prometheus"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+var metricThrottledSeconds = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "lightningstream_storage_throttled_seconds_total",
+		Help: "Time spent waiting for the storage transfer rate limit per direction",
+	},
+	[]string{"direction"},
+)
+
+func init() {
+	prometheus.MustRegister(metricThrottledSeconds)
+}
+
+// Backend wraps a storage backend with rate limits
+type Backend struct {
+	st   simpleblob.Interface
+	up   *limiter
+	down *limiter
+}
+
+// New wraps a storage backend with rate limits. If no limits are configured,
+// the backend is returned as is.
+func New(st simpleblob.Interface, conf config.Throttle) simpleblob.Interface {
+	if conf.UploadRate == 0 && conf.DownloadRate == 0 {
+		return st
+	}
+	return &Backend{
+		st:   st,
+		up:   newLimiter("upload", conf.UploadRate.Bytes()),
+		down: newLimiter("download", conf.DownloadRate.Bytes()),
+	}
+}
+
+// List is not throttled, because listings are small
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	return b.st.List(ctx, prefix)
+}
+
+// Load loads a blob once the download rate allows it. The size of a blob is
+// only known after the download, so it delays the next download.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	if err := b.down.wait(ctx); err != nil {
+		return nil, err
+	}
+	data, err := b.st.Load(ctx, name)
+	b.down.add(len(data))
+	return data, err
+}
+
+// LoadRange loads part of a blob once the download rate allows it, if the
+// wrapped backend supports it
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	if _, ok := b.st.(ranged.Loader); !ok {
+		return nil, ranged.ErrUnsupported
+	}
+	if err := b.down.wait(ctx); err != nil {
+		return nil, err
+	}
+	data, err := ranged.Load(ctx, b.st, name, offset, length)
+	b.down.add(len(data))
+	return data, err
+}
+
+// Store stores a blob once the upload rate allows it
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	if err := b.up.wait(ctx); err != nil {
+		return err
+	}
+	b.up.add(len(data))
+	return b.st.Store(ctx, name, data)
+}
+
+// LoadVersion loads a blob and its version once the download rate allows
+// it, if the wrapped backend supports conditional writes
+func (b *Backend) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	if _, ok := b.st.(conditional.Writer); !ok {
+		return nil, "", conditional.ErrUnsupported
+	}
+	if err := b.down.wait(ctx); err != nil {
+		return nil, "", err
+	}
+	data, version, err := conditional.LoadVersion(ctx, b.st, name)
+	b.down.add(len(data))
+	return data, version, err
+}
+
+// StoreIf conditionally stores a blob once the upload rate allows it, if the
+// wrapped backend supports it
+func (b *Backend) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	if _, ok := b.st.(conditional.Writer); !ok {
+		return conditional.ErrUnsupported
+	}
+	if err := b.up.wait(ctx); err != nil {
+		return err
+	}
+	b.up.add(len(data))
+	return conditional.StoreIf(ctx, b.st, name, data, version)
+}
+
+// Delete is not throttled
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	return b.st.Delete(ctx, name)
+}
+
+// limiter tracks when the next transfer in one direction may start
+type limiter struct {
+	direction string
+	rate      float64 // bytes per second, 0 for unlimited
+
+	mu   sync.Mutex
+	next time.Time
+
+	// For tests
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newLimiter(direction string, rate uint64) *limiter {
+	return &limiter{
+		direction: direction,
+		rate:      float64(rate),
+		now:       time.Now,
+		sleep:     utils.SleepContext,
+	}
+}
+
+// wait blocks until a new transfer may start
+func (l *limiter) wait(ctx context.Context) error {
+	if l.rate == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	d := l.next.Sub(l.now())
+	l.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	metricThrottledSeconds.WithLabelValues(l.direction).Add(d.Seconds())
+	return l.sleep(ctx, d)
+}
+
+// add records a transfer of n bytes, which delays the next transfer by the
+// time the transfer would take at the configured rate.
+func (l *limiter) add(n int) {
+	if l.rate == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := l.now()
+	if l.next.After(start) {
+		start = l.next // concurrent transfers queue up
+	}
+	l.next = start.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+}
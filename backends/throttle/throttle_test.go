@@ -0,0 +1,56 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+func TestBackend(t *testing.T) {
+	st := New(memory.New(), config.Throttle{UploadRate: 1 << 30, DownloadRate: 1 << 30})
+	tester.DoBackendTests(t, st)
+
+	// No limits
+	raw := memory.New()
+	assert.Equal(t, raw, New(raw, config.Throttle{}))
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	var slept []time.Duration
+	l := newLimiter("upload", 1000) // 1000 bytes/s
+	l.now = func() time.Time { return now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	// First transfer does not wait
+	require.NoError(t, l.wait(ctx))
+	l.add(500)
+	assert.Empty(t, slept)
+
+	// Next one waits for the remainder of the time the previous one takes
+	now = now.Add(100 * time.Millisecond)
+	require.NoError(t, l.wait(ctx))
+	assert.Equal(t, []time.Duration{400 * time.Millisecond}, slept)
+	l.add(2000)
+
+	// No wait once enough time has passed
+	now = now.Add(3 * time.Second)
+	require.NoError(t, l.wait(ctx))
+	assert.Len(t, slept, 1)
+
+	// Unlimited
+	l = newLimiter("download", 0)
+	l.add(1 << 30)
+	require.NoError(t, l.wait(ctx))
+}
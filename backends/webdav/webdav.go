@@ -0,0 +1,343 @@
+// Package webdav implements a simpleblob storage backend that stores
+// snapshots as files in a collection on a WebDAV server, like Nextcloud or
+// Apache mod_dav.
+//
+// Files are uploaded under a temporary name and then moved to their final
+// name, so that readers never see partially written snapshots.
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"powerdns.com/platform/lightningstream/backends/httpclient"
+)
+
+const (
+	// TypeName is the name this backend is registered under
+	TypeName = "webdav"
+
+	// DefaultInitTimeout is the default timeout for the initial collection
+	// check
+	DefaultInitTimeout = 20 * time.Second
+
+	// DefaultRequestTimeout is the default timeout for a single request
+	DefaultRequestTimeout = 5 * time.Minute
+
+	// tmpPrefix is the prefix used for temporary files. Files starting with
+	// a dot are never returned by List.
+	tmpPrefix = ".tmp-"
+)
+
+// Options describes the storage options for the WebDAV backend
+type Options struct {
+	// URL is the URL of the collection to store the snapshots in, like
+	// 'https://cloud.example.com/remote.php/dav/files/ls/snapshots/'
+	// (required)
+	URL string `yaml:"url"`
+
+	// Username and Password for basic authentication
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// BearerToken is sent as an 'Authorization: Bearer' header instead
+	BearerToken string `yaml:"bearer_token"`
+
+	// CreateCollection creates the collection if it does not exist. Its
+	// parent collection must exist.
+	CreateCollection bool `yaml:"create_collection"`
+
+	// InitTimeout is the timeout for the initial collection check on
+	// startup.
+	InitTimeout time.Duration `yaml:"init_timeout"`
+
+	// RequestTimeout is the timeout for a single request.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+
+	// HTTP configures the proxy and TLS settings (proxy_url, no_proxy, tls
+	// and tls_min_version).
+	HTTP httpclient.Options `yaml:",inline"`
+}
+
+// Check validates the options
+func (o Options) Check() error {
+	if o.URL == "" {
+		return fmt.Errorf("webdav storage.options: url is required")
+	}
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return fmt.Errorf("webdav storage.options: url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webdav storage.options: url: unsupported scheme %q", u.Scheme)
+	}
+	if o.BearerToken != "" && o.Username != "" {
+		return fmt.Errorf("webdav storage.options: username and bearer_token are mutually exclusive")
+	}
+	if err := o.HTTP.Check("webdav storage.options"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Backend is the WebDAV storage backend
+type Backend struct {
+	opt    Options
+	base   *url.URL // the collection, with a trailing slash
+	client *http.Client
+}
+
+// New creates a new backend instance and checks if the collection exists
+func New(ctx context.Context, opt Options) (*Backend, error) {
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	if opt.InitTimeout == 0 {
+		opt.InitTimeout = DefaultInitTimeout
+	}
+	if opt.RequestTimeout == 0 {
+		opt.RequestTimeout = DefaultRequestTimeout
+	}
+	base, err := url.Parse(opt.URL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		base.RawPath = ""
+	}
+
+	transport, err := opt.HTTP.Transport(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("webdav storage.options: %w", err)
+	}
+	b := &Backend{
+		opt:  opt,
+		base: base,
+		client: &http.Client{
+			Timeout:   opt.RequestTimeout,
+			Transport: transport,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opt.InitTimeout)
+	defer cancel()
+	_, err = b.propfind(ctx, "0")
+	if err == os.ErrNotExist && opt.CreateCollection {
+		_, err = b.do(ctx, "MKCOL", b.base.String(), nil, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("webdav: check collection %q: %w", b.base.Redacted(), err)
+	}
+	return b, nil
+}
+
+// fileURL returns the URL of a file in the collection
+func (b *Backend) fileURL(name string) string {
+	return b.base.ResolveReference(&url.URL{Path: name}).String()
+}
+
+// allowedName returns true if the name is safe to use as a filename
+func allowedName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\`)
+}
+
+// do performs an authenticated request and returns the response body. A 404
+// status is returned as os.ErrNotExist.
+func (b *Backend) do(ctx context.Context, method, u string, header http.Header, body []byte) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	switch {
+	case b.opt.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+b.opt.BearerToken)
+	case b.opt.Username != "":
+		req.SetBasicAuth(b.opt.Username, b.opt.Password)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("webdav: %s: %s", method, resp.Status)
+	}
+	return data, nil
+}
+
+// multistatus is the PROPFIND response
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				ContentLength string `xml:"DAV: getcontentlength"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfindBody requests only the properties we use
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:getcontentlength/><d:resourcetype/></d:prop></d:propfind>`
+
+// propfind returns the properties of the collection, and of its members for
+// depth "1"
+func (b *Backend) propfind(ctx context.Context, depth string) (*multistatus, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	data, err := b.do(ctx, "PROPFIND", b.base.String(), header, []byte(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	var ms multistatus
+	if err := xml.Unmarshal(data, &ms); err != nil {
+		return nil, fmt.Errorf("webdav: propfind response: %w", err)
+	}
+	return &ms, nil
+}
+
+// List returns the blobs with given prefix, ordered by name. Temporary files
+// and other hidden files are ignored.
+func (b *Backend) List(ctx context.Context, prefix string) (simpleblob.BlobList, error) {
+	ms, err := b.propfind(ctx, "1")
+	if err != nil {
+		return nil, err
+	}
+	var blobs simpleblob.BlobList
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("webdav: propfind response: %w", err)
+		}
+		name := path.Base(href.Path)
+		if strings.HasSuffix(href.Path, "/") || !allowedName(name) || !strings.HasPrefix(name, prefix) {
+			continue // the collection itself, or a subcollection
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") || ps.Prop.ResourceType.Collection != nil {
+				continue
+			}
+			size, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("webdav: propfind response: size of %q: %w", name, err)
+			}
+			blobs = append(blobs, simpleblob.Blob{
+				Name: name,
+				Size: size,
+			})
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, nil
+}
+
+// Load returns the contents of the named blob. If the blob does not exist,
+// os.ErrNotExist is returned.
+func (b *Backend) Load(ctx context.Context, name string) ([]byte, error) {
+	if !allowedName(name) {
+		return nil, os.ErrNotExist
+	}
+	return b.do(ctx, http.MethodGet, b.fileURL(name), nil, nil)
+}
+
+// LoadRange returns length bytes of the named blob, starting at offset,
+// using a range request
+func (b *Backend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	if !allowedName(name) {
+		return nil, os.ErrNotExist
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	return b.do(ctx, http.MethodGet, b.fileURL(name), header, nil)
+}
+
+// Store stores the blob under the given name. The data is uploaded under a
+// temporary name first, which is then moved to the name.
+func (b *Backend) Store(ctx context.Context, name string, data []byte) error {
+	if !allowedName(name) {
+		return fmt.Errorf("webdav: invalid name: %q", name)
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	tmpURL := b.fileURL(fmt.Sprintf("%s%s-%d", tmpPrefix, name, time.Now().UnixNano()))
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if _, err := b.do(ctx, http.MethodPut, tmpURL, header, data); err != nil {
+		return err
+	}
+	header = http.Header{}
+	header.Set("Destination", b.fileURL(name))
+	header.Set("Overwrite", "T")
+	if _, err := b.do(ctx, "MOVE", tmpURL, header, nil); err != nil {
+		_, _ = b.do(ctx, http.MethodDelete, tmpURL, nil, nil)
+		return err
+	}
+	return nil
+}
+
+// Delete removes the named blob. Removing a blob that does not exist is not
+// an error.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	if !allowedName(name) {
+		return nil
+	}
+	_, err := b.do(ctx, http.MethodDelete, b.fileURL(name), nil, nil)
+	if err != nil && err != os.ErrNotExist {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	simpleblob.RegisterBackend(TypeName, func(ctx context.Context, p simpleblob.InitParams) (simpleblob.Interface, error) {
+		var opt Options
+		if err := p.OptionsThroughYAML(&opt); err != nil {
+			return nil, err
+		}
+		return New(ctx, opt)
+	})
+}
@@ -0,0 +1,90 @@
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/PowerDNS/simpleblob/tester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, webdav.FileSystem) {
+	fs := webdav.NewMemFS()
+	require.NoError(t, fs.Mkdir(context.Background(), "/dav", 0755))
+	h := &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "ls" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, fs
+}
+
+func TestBackend(t *testing.T) {
+	srv, fs := newTestServer(t)
+	ctx := context.Background()
+	b, err := New(ctx, Options{
+		URL:              srv.URL + "/dav/snapshots",
+		Username:         "ls",
+		Password:         "secret",
+		CreateCollection: true,
+	})
+	require.NoError(t, err)
+	tester.DoBackendTests(t, b)
+
+	require.NoError(t, b.Store(ctx, "foo:1", []byte("0123456789")))
+	data, err := b.LoadRange(ctx, "foo:1", 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("234"), data)
+
+	// Replaced by a move
+	require.NoError(t, b.Store(ctx, "foo:1", []byte("bar")))
+	data, err = b.Load(ctx, "foo:1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), data)
+
+	// Temporary files and subcollections are not listed
+	f, err := fs.OpenFile(ctx, "/dav/snapshots/"+tmpPrefix+"foo-123", os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.Mkdir(ctx, "/dav/snapshots/foo-dir", 0755))
+	ls, err := b.List(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo:1"}, ls.Names())
+	assert.Equal(t, int64(3), ls[0].Size)
+
+	assert.Error(t, b.Store(ctx, "../foo", []byte("bar")))
+	_, err = b.Load(ctx, "../foo")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNew_errors(t *testing.T) {
+	srv, _ := newTestServer(t)
+	ctx := context.Background()
+	opt := Options{
+		URL:      srv.URL + "/dav/missing/",
+		Username: "ls",
+		Password: "secret",
+	}
+	_, err := New(ctx, opt)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	opt.URL = srv.URL + "/dav/"
+	opt.Password = "wrong"
+	_, err = New(ctx, opt)
+	assert.ErrorContains(t, err, "401")
+
+	_, err = New(ctx, Options{URL: "ftp://example.com/"})
+	assert.Error(t, err)
+}
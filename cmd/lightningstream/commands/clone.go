@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(cloneCmd)
+	cloneCmd.Flags().String("lmdb", "",
+		"Configured LMDB to clone, optional if only one is configured")
+	cloneCmd.Flags().String("target", "",
+		"Path of the new LMDB to create, which must not exist yet")
+}
+
+var cloneCmd = &cobra.Command{
+	Use:   "clone --target PATH",
+	Short: "Bootstrap a new LMDB from the latest snapshots in storage",
+	Long: `Bootstrap a new LMDB from the latest snapshots in storage.
+
+Creates a new LMDB at the target path and loads the latest snapshot of every
+instance, exactly like a new instance would during its first sync. The new
+LMDB uses the options of the configured LMDB, and has the headers or shadow
+databases that the sync needs, so that it is a ready to serve replica that
+a new instance can start syncing with right away. With lmdb_persist_sync_state
+enabled, that sync does not load the same snapshots again.
+
+This is the same as a restore without a time limit. Nothing is written to the
+storage backend.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(rootCtx)
+		defer cancel()
+
+		lmdbName, err := cmd.Flags().GetString("lmdb")
+		if err != nil {
+			return err
+		}
+		target, err := cmd.Flags().GetString("target")
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			return fmt.Errorf("--target is required")
+		}
+		return restoreLMDB(ctx, lmdbName, target, "", time.Time{})
+	},
+}
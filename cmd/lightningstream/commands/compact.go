@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/c2h5oh/datasize"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/syncer"
+)
+
+func init() {
+	rootCmd.AddCommand(compactCmd)
+	compactCmd.Flags().String("lmdb", "",
+		"Only compact this configured LMDB")
+	compactCmd.Flags().Duration("tombstone-retention", 0,
+		"Purge deleted entries older than this before compacting, 0 to keep them (default tombstone_gc.retention if tombstone_gc is enabled)")
+}
+
+func compactLMDB(name string, lc config.LMDB, retention time.Duration) error {
+	l := logrus.WithField("db", name)
+	env, err := lmdbenv.NewWithOptions(lc.Path, lc.Options)
+	if err != nil {
+		return err
+	}
+	envClosed := false
+	defer func() {
+		if !envClosed {
+			_ = env.Close()
+		}
+	}()
+
+	dataFile, err := lmdbenv.DataFile(env)
+	if err != nil {
+		return err
+	}
+	before, err := os.Stat(dataFile)
+	if err != nil {
+		return err
+	}
+
+	if retention > 0 {
+		t0 := time.Now()
+		cutoff := t0.Add(-retention)
+		var n int
+		err = env.Update(func(txn *lmdb.Txn) error {
+			var err error
+			n, err = syncer.PurgeTombstones(txn, name, lc, cutoff)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("purge tombstones: %w", err)
+		}
+		l.WithFields(logrus.Fields{
+			"purged":     n,
+			"cutoff":     cutoff.UTC().Format(time.RFC3339),
+			"time_total": time.Since(t0).Round(time.Millisecond),
+		}).Info("Purged tombstones")
+	}
+
+	t0 := time.Now()
+	if err := lmdbenv.Compact(env); err != nil {
+		return err
+	}
+	envClosed = true
+	if err := env.Close(); err != nil {
+		return err
+	}
+	after, err := os.Stat(dataFile)
+	if err != nil {
+		return err
+	}
+	l.WithFields(logrus.Fields{
+		"size_before": datasize.ByteSize(before.Size()).HumanReadable(),
+		"size_after":  datasize.ByteSize(after.Size()).HumanReadable(),
+		"time_total":  time.Since(t0).Round(time.Millisecond),
+	}).Info("Compacted")
+	return nil
+}
+
+var compactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Offline compaction of the LMDBs, optionally purging old deleted entries",
+	Long: `Offline compaction of the LMDBs, optionally purging old deleted entries.
+
+Writes a compacted copy of every configured LMDB without free pages, like
+'mdb_copy -c', and atomically replaces the data file with it. Before the copy,
+deleted entries (tombstones) older than the retention are purged from the
+shadow databases, or from the main databases if the schema tracks changes.
+
+This is intended for maintenance windows. No other process, including
+Lightning Stream and the application, may have the LMDB open while it runs,
+because they would keep using the old data file and lose any later writes.
+The command fails if another process is found in the LMDB reader lock table.
+
+Unlike the tombstone GC, this command cannot check if all other instances
+have merged the deletions, so the retention must be long enough for that.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lmdbName, err := cmd.Flags().GetString("lmdb")
+		if err != nil {
+			return err
+		}
+		retention, err := cmd.Flags().GetDuration("tombstone-retention")
+		if err != nil {
+			return err
+		}
+		if !cmd.Flags().Changed("tombstone-retention") && conf.TombstoneGC.Enabled {
+			retention = conf.TombstoneGC.Retention
+		}
+		if retention < 0 {
+			return fmt.Errorf("--tombstone-retention: cannot be negative")
+		}
+
+		var names []string
+		if lmdbName != "" {
+			if _, exists := conf.LMDBs[lmdbName]; !exists {
+				return fmt.Errorf("lmdb %q not found in config", lmdbName)
+			}
+			names = append(names, lmdbName)
+		} else {
+			for name := range conf.LMDBs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+
+		var failed bool
+		for _, name := range names {
+			if err := compactLMDB(name, conf.LMDBs[name], retention); err != nil {
+				logrus.WithError(err).WithField("db", name).Error("LMDB compact error")
+				failed = true
+			}
+		}
+		if failed {
+			return fmt.Errorf("compaction failed for one or more LMDBs")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,173 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().BoolP("local", "l", false,
+		"Read local snapshot files instead of remote snapshots")
+	diffCmd.Flags().String("lmdb", "",
+		"Compare the snapshot against the current contents of this configured LMDB")
+	diffCmd.Flags().StringP("dbi", "d", "", "Only compare the DBI with this exact name")
+	diffCmd.Flags().BoolP("summary", "s", false, "Only print the number of differences per DBI")
+}
+
+// diffCounts counts the differences of a single DBI by kind
+type diffCounts map[snapshot.DiffKind]int
+
+var diffCmd = &cobra.Command{
+	Use:   "diff SNAPSHOT [SNAPSHOT]",
+	Short: "Compare two snapshots, or a snapshot against an LMDB",
+	Long: `Compare two snapshots, or a snapshot against an LMDB.
+
+Reports the entries that were added, removed or changed per DBI, with their
+timestamps. Entries that only differ in their timestamp are reported
+separately. When comparing against an LMDB with --lmdb, the LMDB data is read
+as it would be included in a snapshot created now, which requires a short
+write transaction for LMDBs with shadow databases that is always aborted.`,
+	Args:         cobra.RangeArgs(1, 2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithTimeout(rootCtx, time.Minute)
+		defer cancel()
+
+		local, err := cmd.Flags().GetBool("local")
+		if err != nil {
+			return err
+		}
+		lmdbName, err := cmd.Flags().GetString("lmdb")
+		if err != nil {
+			return err
+		}
+		dbiName, err := cmd.Flags().GetString("dbi")
+		if err != nil {
+			return err
+		}
+		summary, err := cmd.Flags().GetBool("summary")
+		if err != nil {
+			return err
+		}
+		if (lmdbName == "") == (len(args) == 1) {
+			return fmt.Errorf("either pass two snapshots, or one snapshot and --lmdb")
+		}
+
+		a, err := loadSnapshot(ctx, args[0], local)
+		if err != nil {
+			return err
+		}
+		var dbisB []*snapshot.DBI
+		if lmdbName != "" {
+			dbisB, err = readLMDBForDiff(lmdbName)
+		} else {
+			var b *snapshot.Snapshot
+			b, err = loadSnapshot(ctx, args[1], local)
+			if b != nil {
+				dbisB = b.Databases
+			}
+		}
+		if err != nil {
+			return err
+		}
+		dbisA := a.Databases
+		if dbiName != "" {
+			filter := func(item *snapshot.DBI, index int) bool {
+				return item.Name() == dbiName
+			}
+			dbisA = lo.Filter(dbisA, filter)
+			dbisB = lo.Filter(dbisB, filter)
+		}
+
+		// Buffered output speeds things up
+		out := bufio.NewWriter(os.Stdout)
+		defer out.Flush()
+		outf := func(sfmt string, args ...any) {
+			_, _ = fmt.Fprintf(out, sfmt, args...)
+		}
+
+		var names []string
+		counts := make(map[string]diffCounts)
+		lastDBI := ""
+		err = snapshot.Diff(dbisA, dbisB, func(e snapshot.DiffEntry) error {
+			if counts[e.DBI] == nil {
+				counts[e.DBI] = make(diffCounts)
+				names = append(names, e.DBI)
+			}
+			counts[e.DBI][e.Kind]++
+			if summary {
+				return nil
+			}
+			if e.DBI != lastDBI {
+				outf("\n### %s\n\n", e.DBI)
+				lastDBI = e.DBI
+			}
+			switch e.Kind {
+			case snapshot.DiffAdded:
+				outf("+ %s\n", diffKV(e.B))
+			case snapshot.DiffRemoved:
+				outf("- %s\n", diffKV(e.A))
+			default:
+				outf("~ %s\n    -> %s\n", diffKV(e.A), diffKV(e.B))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		outf("\n")
+		if len(names) == 0 {
+			outf("No differences\n")
+			return nil
+		}
+		tw := tabwriter.NewWriter(out, 2, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "DBI\tADDED\tREMOVED\tCHANGED\tTIMESTAMP ONLY")
+		for _, name := range names {
+			c := counts[name]
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", name,
+				c[snapshot.DiffAdded], c[snapshot.DiffRemoved],
+				c[snapshot.DiffChanged], c[snapshot.DiffTimestamp])
+		}
+		return tw.Flush()
+	},
+}
+
+// diffKV formats an entry for the diff output
+func diffKV(kv snapshot.KV) string {
+	s := fmt.Sprintf("%s  =  %s  (%s",
+		utils.DisplayASCII(kv.Key),
+		utils.DisplayASCII(kv.Value),
+		header.Timestamp(kv.TimestampNano).Time().Format(time.RFC3339Nano))
+	if header.Flags(kv.Flags).IsDeleted() {
+		s += ", deleted"
+	}
+	return s + ")"
+}
+
+// readLMDBForDiff reads a configured LMDB as it would be included in a snapshot
+func readLMDBForDiff(name string) ([]*snapshot.DBI, error) {
+	lc, exists := conf.LMDBs[name]
+	if !exists {
+		return nil, fmt.Errorf("lmdb %q not found in config", name)
+	}
+	env, err := lmdbenv.NewWithOptions(lc.Path, lc.Options)
+	if err != nil {
+		return nil, err
+	}
+	defer env.Close()
+	return syncer.ReadSnapshotDBIs(env, lc)
+}
@@ -12,18 +12,21 @@ import (
 	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/lmdbenv"
 	"powerdns.com/platform/lightningstream/syncer"
+	"powerdns.com/platform/lightningstream/syncer/pdns"
 	"powerdns.com/platform/lightningstream/utils"
 )
 
 var (
 	dumpName string
 	dumpHide bool
+	dumpPDNS bool
 )
 
 func init() {
 	rootCmd.AddCommand(dumpCmd)
 	dumpCmd.Flags().BoolVarP(&dumpHide, "hide", "H", false, "Hide private lightningstream databases")
 	dumpCmd.Flags().StringVarP(&dumpName, "name", "n", "", "Only dump given database name")
+	dumpCmd.Flags().BoolVar(&dumpPDNS, "pdns", false, "Describe the keys of the PowerDNS LMDB backend schema")
 }
 
 func dumpLMDB(name string, lc config.LMDB) error {
@@ -57,10 +60,18 @@ func dumpLMDB(name string, lc config.LMDB) error {
 			}
 
 			for _, item := range items {
-				fmt.Printf("%s  =  %s\n",
+				fmt.Printf("%s  =  %s",
 					utils.DisplayASCII(item.Key),
 					utils.DisplayASCII(item.Val),
 				)
+				if dumpPDNS {
+					// Shadow DBIs have the same keys as their main DBI
+					mainName := strings.TrimPrefix(dbiName, syncer.SyncDBIShadowPrefix)
+					if k, ok := pdns.ParseKey(mainName, item.Key); ok {
+						fmt.Printf("  # %s", k)
+					}
+				}
+				fmt.Println()
 			}
 		}
 
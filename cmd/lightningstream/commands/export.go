@@ -0,0 +1,393 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/lmdbenv/mdbdump"
+	"powerdns.com/platform/lightningstream/syncer"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().String("lmdb", "",
+		"Configured LMDB to export, optional if only one is configured")
+	exportCmd.Flags().StringP("output", "o", "",
+		"Path of the new LMDB or file to create, which must not exist yet, or - for stdout with the text formats")
+	exportCmd.Flags().StringP("format", "f", "lmdb",
+		"Output format: lmdb, mdb_dump, json or csv")
+	exportCmd.Flags().Bool("strip-headers", false,
+		"Remove the Lightning Stream headers from the values and skip deleted entries")
+	exportCmd.Flags().StringP("dbi", "d", "", "Only export the DBI with this exact name")
+	exportCmd.Flags().String("key-encoding", "hex",
+		"Encoding of the keys with json and csv: hex, base64 or ascii")
+	exportCmd.Flags().String("value-encoding", "hex",
+		"Encoding of the values with json and csv: hex, base64 or ascii")
+}
+
+// exportEncodings are the key and value encodings for the json and csv formats
+var exportEncodings = map[string]func([]byte) string{
+	"hex":    hex.EncodeToString,
+	"base64": base64.StdEncoding.EncodeToString,
+	"ascii":  utils.EscapeASCII,
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export --output PATH",
+	Short: "Export the synced DBIs of an LMDB to a new LMDB, mdb_dump, JSON or CSV file",
+	Long: `Export the synced DBIs of an LMDB to a new LMDB, mdb_dump, JSON or CSV file.
+
+Copies all synced DBIs of the configured LMDB, with their flags, to a new LMDB
+at the output path, or writes them in the text format of mdb_dump with
+--format mdb_dump, which mdb_load can read. Use --dbi to only export a single
+DBI.
+
+For ad-hoc analysis and audits, --format json writes every entry as a JSON
+object on a separate line, and --format csv writes a CSV file with a header
+row. Both have the DBI name, key, value, timestamp and deleted flag of every
+entry, as they would be included in a snapshot created now. The encoding of
+the keys and values is set with --key-encoding and --value-encoding: hex,
+base64, or ascii, which keeps safe ascii characters and escapes all other
+bytes like \x00. Reading an LMDB without schema_tracks_changes for these
+formats requires a short write transaction that is always aborted.
+
+With --strip-headers, the headers that Lightning Stream adds to every value
+of an LMDB with schema_tracks_changes are removed, and entries that are
+marked as deleted are skipped. The result has the native schema of the
+application, for tools that do not understand the headers. LMDBs without
+schema_tracks_changes keep their headers in the shadow databases, which are
+never exported. With json and csv, only the deleted entries are skipped.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lmdbName, err := cmd.Flags().GetString("lmdb")
+		if err != nil {
+			return err
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return err
+		}
+		stripHeaders, err := cmd.Flags().GetBool("strip-headers")
+		if err != nil {
+			return err
+		}
+		if output == "" {
+			return fmt.Errorf("--output is required")
+		}
+		dbiName, err := cmd.Flags().GetString("dbi")
+		if err != nil {
+			return err
+		}
+		keyEncoding, err := cmd.Flags().GetString("key-encoding")
+		if err != nil {
+			return err
+		}
+		valueEncoding, err := cmd.Flags().GetString("value-encoding")
+		if err != nil {
+			return err
+		}
+		switch format {
+		case "lmdb", "mdb_dump", "json", "csv":
+		default:
+			return fmt.Errorf("--format: unsupported format %q", format)
+		}
+		encodeKey, ok := exportEncodings[keyEncoding]
+		if !ok {
+			return fmt.Errorf("--key-encoding: unsupported encoding %q", keyEncoding)
+		}
+		encodeValue, ok := exportEncodings[valueEncoding]
+		if !ok {
+			return fmt.Errorf("--value-encoding: unsupported encoding %q", valueEncoding)
+		}
+		if format == "lmdb" && output == "-" {
+			return fmt.Errorf("--format lmdb cannot be written to stdout")
+		}
+		if lmdbName == "" {
+			if len(conf.LMDBs) != 1 {
+				return fmt.Errorf("multiple LMDBs configured, please select one with --lmdb")
+			}
+			for name := range conf.LMDBs {
+				lmdbName = name
+			}
+		}
+		lc, exists := conf.LMDBs[lmdbName]
+		if !exists {
+			return fmt.Errorf("lmdb %q not found in config", lmdbName)
+		}
+		if stripHeaders && !lc.SchemaTracksChanges && (format == "lmdb" || format == "mdb_dump") {
+			logrus.WithField("db", lmdbName).Info(
+				"Values have no headers without schema_tracks_changes, nothing to strip")
+		}
+		if output != "-" {
+			if _, err := os.Stat(output); !os.IsNotExist(err) {
+				return fmt.Errorf("output %q already exists", output)
+			}
+		}
+
+		env, err := lmdbenv.NewWithOptions(lc.Path, lc.Options)
+		if err != nil {
+			return err
+		}
+		defer env.Close()
+
+		var counts map[string]int
+		switch format {
+		case "lmdb":
+			counts, err = exportToLMDB(env, lc, output, stripHeaders, dbiName)
+		case "mdb_dump":
+			counts, err = exportToMDBDump(env, lc, output, stripHeaders, dbiName)
+		default:
+			rows := &exportRows{
+				format:      format,
+				skipDeleted: stripHeaders,
+				encodeKey:   encodeKey,
+				encodeValue: encodeValue,
+			}
+			counts, err = rows.export(env, lc, output, dbiName)
+		}
+		if err != nil {
+			return err
+		}
+		if dbiName != "" {
+			if _, found := counts[dbiName]; !found {
+				return fmt.Errorf("dbi %q not found or not synced", dbiName)
+			}
+			counts = map[string]int{dbiName: counts[dbiName]}
+		}
+		for name, n := range counts {
+			logrus.WithFields(logrus.Fields{
+				"db":      lmdbName,
+				"dbi":     name,
+				"entries": n,
+			}).Info("Exported")
+		}
+		return nil
+	},
+}
+
+// exportToLMDB exports the LMDB to a new LMDB at the output path, with the
+// options of the configured LMDB
+func exportToLMDB(env *lmdb.Env, lc config.LMDB, output string, stripHeaders bool, dbiName string) (map[string]int, error) {
+	opt := lc.Options
+	opt.Create = true
+	outEnv, err := lmdbenv.NewWithOptions(output, opt)
+	if err != nil {
+		return nil, err
+	}
+	defer outEnv.Close()
+
+	var counts map[string]int
+	err = env.View(func(txn *lmdb.Txn) error {
+		return outEnv.Update(func(outTxn *lmdb.Txn) error {
+			var err error
+			e := filterExporter(&lmdbExporter{txn: outTxn}, dbiName)
+			counts, err = syncer.Export(txn, lc, stripHeaders, e)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, outEnv.Sync(true)
+}
+
+// exportToMDBDump exports the LMDB in the mdb_dump format to a new file at
+// the output path, or to stdout
+func exportToMDBDump(env *lmdb.Env, lc config.LMDB, output string, stripHeaders bool, dbiName string) (map[string]int, error) {
+	var counts map[string]int
+	err := exportToFile(output, func(out io.Writer) error {
+		w := mdbdump.NewWriter(out)
+		err := env.View(func(txn *lmdb.Txn) error {
+			var err error
+			counts, err = syncer.Export(txn, lc, stripHeaders, filterExporter(w, dbiName))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+	return counts, err
+}
+
+// exportToFile calls write with a new file at the output path, or stdout
+func exportToFile(output string, write func(out io.Writer) error) error {
+	if output == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if err := write(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// exportRows exports the entries of an LMDB as rows in the json or csv
+// format
+type exportRows struct {
+	format      string
+	skipDeleted bool
+	encodeKey   func([]byte) string
+	encodeValue func([]byte) string
+}
+
+// exportRow is an entry as written by the json export format
+type exportRow struct {
+	DBI       string `json:"dbi"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Timestamp string `json:"timestamp"`
+	Deleted   bool   `json:"deleted"`
+}
+
+func (r *exportRows) export(env *lmdb.Env, lc config.LMDB, output, dbiName string) (map[string]int, error) {
+	dbis, err := syncer.ReadSnapshotDBIs(env, lc)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	err = exportToFile(output, func(out io.Writer) error {
+		// Buffered output speeds things up
+		bw := bufio.NewWriter(out)
+		var write func(row exportRow) error
+		var flush func() error
+		if r.format == "json" {
+			enc := json.NewEncoder(bw)
+			write = func(row exportRow) error {
+				return enc.Encode(row)
+			}
+			flush = bw.Flush
+		} else {
+			cw := csv.NewWriter(bw)
+			if err := cw.Write([]string{"dbi", "key", "value", "timestamp", "deleted"}); err != nil {
+				return err
+			}
+			write = func(row exportRow) error {
+				return cw.Write([]string{row.DBI, row.Key, row.Value, row.Timestamp,
+					strconv.FormatBool(row.Deleted)})
+			}
+			flush = func() error {
+				cw.Flush()
+				if err := cw.Error(); err != nil {
+					return err
+				}
+				return bw.Flush()
+			}
+		}
+
+		for _, dbi := range dbis {
+			if dbiName != "" && dbi.Name() != dbiName {
+				continue
+			}
+			if _, exists := counts[dbi.Name()]; !exists {
+				counts[dbi.Name()] = 0
+			}
+			dbi.ResetCursor()
+			for {
+				e, err := dbi.Next()
+				if err != nil {
+					if err != io.EOF {
+						return err
+					}
+					break
+				}
+				deleted := header.Flags(e.Flags).IsDeleted()
+				if deleted && r.skipDeleted {
+					continue
+				}
+				err = write(exportRow{
+					DBI:       dbi.Name(),
+					Key:       r.encodeKey(e.Key),
+					Value:     r.encodeValue(e.Value),
+					Timestamp: header.Timestamp(e.TimestampNano).Time().Format(time.RFC3339Nano),
+					Deleted:   deleted,
+				})
+				if err != nil {
+					return err
+				}
+				counts[dbi.Name()]++
+			}
+		}
+		return flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// filterExporter returns an Exporter that only passes the DBI with the given
+// name to e, or e itself if the name is empty
+func filterExporter(e syncer.Exporter, dbiName string) syncer.Exporter {
+	if dbiName == "" {
+		return e
+	}
+	return &dbiFilterExporter{Exporter: e, dbiName: dbiName}
+}
+
+// dbiFilterExporter only passes a single DBI to the Exporter it wraps
+type dbiFilterExporter struct {
+	syncer.Exporter
+	dbiName string
+	skip    bool
+}
+
+func (e *dbiFilterExporter) StartDBI(name string, flags uint) error {
+	e.skip = name != e.dbiName
+	if e.skip {
+		return nil
+	}
+	return e.Exporter.StartDBI(name, flags)
+}
+
+func (e *dbiFilterExporter) Put(key, val []byte) error {
+	if e.skip {
+		return nil
+	}
+	return e.Exporter.Put(key, val)
+}
+
+// lmdbExporter writes the exported DBIs to an LMDB
+type lmdbExporter struct {
+	txn *lmdb.Txn
+	dbi lmdb.DBI
+}
+
+func (e *lmdbExporter) StartDBI(name string, flags uint) error {
+	dbi, err := e.txn.OpenDBI(name, flags|lmdb.Create)
+	if err != nil {
+		return err
+	}
+	e.dbi = dbi
+	return nil
+}
+
+func (e *lmdbExporter) Put(key, val []byte) error {
+	return e.txn.Put(e.dbi, key, val, 0)
+}
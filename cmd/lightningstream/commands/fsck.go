@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/syncer"
+)
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+	fsckCmd.Flags().String("lmdb", "",
+		"Only check this configured LMDB")
+	fsckCmd.Flags().Bool("repair", false,
+		"Repair the issues that can be fixed")
+}
+
+// fsckLMDB checks an LMDB and returns the number of issues that remain
+func fsckLMDB(ctx context.Context, name string, lc config.LMDB, repair bool) (int, error) {
+	l := logrus.WithField("db", name)
+	env, err := lmdbenv.NewWithOptions(lc.Path, lc.Options)
+	if err != nil {
+		return 0, err
+	}
+	defer env.Close()
+
+	var issues []syncer.FsckIssue
+	check := func(txn *lmdb.Txn) error {
+		var err error
+		issues, err = syncer.Fsck(ctx, txn, name, lc, repair)
+		return err
+	}
+	if repair {
+		err = env.Update(check)
+	} else {
+		err = env.View(check)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := 0
+	for _, issue := range issues {
+		li := l.WithField("dbi", issue.DBIName).WithField("fixable", issue.Fixable)
+		if issue.Entries > 0 {
+			li = li.WithField("entries", issue.Entries)
+		}
+		if issue.Repaired {
+			li.Info("Repaired: " + issue.Problem)
+			continue
+		}
+		remaining++
+		li.Warn(issue.Problem)
+	}
+	if len(issues) == 0 {
+		l.Info("No issues found")
+	}
+	return remaining, nil
+}
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check the LMDBs for consistency with Lightning Stream invariants",
+	Long: `Check the LMDBs for consistency with Lightning Stream invariants.
+
+The following is checked for every configured LMDB:
+
+- With schema_tracks_changes, every entry of a synced DBI starts with a valid
+  header with a timestamp.
+- Without, every shadow DBI belongs to a synced main DBI, every shadow entry
+  has a valid header, and the shadow DBIs contain all changes of the main DBIs.
+- There are no other DBIs with the '_sync' prefix.
+
+Changes that are not synced to the shadow DBIs yet are normal while the
+application is writing and Lightning Stream is running.
+
+With --repair, the shadow DBIs are updated with the pending changes, and stray
+'_sync' DBIs are dropped. Entries without a valid header cannot be repaired.
+
+The command exits with an error if any issues remain.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lmdbName, err := cmd.Flags().GetString("lmdb")
+		if err != nil {
+			return err
+		}
+		repair, err := cmd.Flags().GetBool("repair")
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		if lmdbName != "" {
+			if _, exists := conf.LMDBs[lmdbName]; !exists {
+				return fmt.Errorf("lmdb %q not found in config", lmdbName)
+			}
+			names = append(names, lmdbName)
+		} else {
+			for name := range conf.LMDBs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+
+		var failed bool
+		for _, name := range names {
+			remaining, err := fsckLMDB(rootCtx, name, conf.LMDBs[name], repair)
+			if err != nil {
+				logrus.WithError(err).WithField("db", name).Error("LMDB check error")
+				failed = true
+				continue
+			}
+			if remaining > 0 {
+				failed = true
+			}
+		}
+		if failed {
+			return fmt.Errorf("issues found in one or more LMDBs")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/lmdbenv/mdbdump"
+	"powerdns.com/platform/lightningstream/syncer"
+)
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().String("lmdb", "",
+		"Configured LMDB to import into, optional if only one is configured")
+	importCmd.Flags().String("mdb-dump", "",
+		"Import the output of mdb_dump from this file, or - for stdin")
+	importCmd.Flags().String("from", "",
+		"Import all DBIs of the plain LMDB at this path")
+	importCmd.Flags().String("timestamp", "",
+		"Timestamp for the headers in RFC 3339 format (default now)")
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import (--mdb-dump FILE | --from PATH)",
+	Short: "Import entries from mdb_dump output or a plain LMDB into a synced LMDB",
+	Long: `Import entries from mdb_dump output or a plain LMDB into a synced LMDB.
+
+Reads the output of mdb_dump, in the default or the printable format and
+with or without -a, or all DBIs of an existing LMDB that was written without
+Lightning Stream, and writes the entries into the configured LMDB. This seeds
+a new deployment from a legacy database.
+
+The imported entries get a header with the given timestamp. With
+schema_tracks_changes, the header is added to the values. Otherwise, the
+values are written as is and the shadow databases are updated in the same
+transaction. Use a timestamp in the past if other instances already have
+newer data for the same keys. Existing entries with the same keys are
+overwritten, other entries are kept.
+
+DBIs that are not synced, like the main DBI of mdb_dump output without -a
+and the DBIs excluded in the configuration, are skipped. DBIs with flags for
+duplicate values, like MDB_DUPSORT, are not supported with
+schema_tracks_changes.
+
+All entries are written in a single transaction.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(rootCtx)
+		defer cancel()
+
+		lmdbName, err := cmd.Flags().GetString("lmdb")
+		if err != nil {
+			return err
+		}
+		dumpPath, err := cmd.Flags().GetString("mdb-dump")
+		if err != nil {
+			return err
+		}
+		fromPath, err := cmd.Flags().GetString("from")
+		if err != nil {
+			return err
+		}
+		tsString, err := cmd.Flags().GetString("timestamp")
+		if err != nil {
+			return err
+		}
+		if (dumpPath == "") == (fromPath == "") {
+			return fmt.Errorf("either pass --mdb-dump or --from")
+		}
+		ts := time.Now()
+		if tsString != "" {
+			ts, err = time.Parse(time.RFC3339Nano, tsString)
+			if err != nil {
+				return fmt.Errorf("--timestamp: %w", err)
+			}
+		}
+		if lmdbName == "" {
+			if len(conf.LMDBs) != 1 {
+				return fmt.Errorf("multiple LMDBs configured, please select one with --lmdb")
+			}
+			for name := range conf.LMDBs {
+				lmdbName = name
+			}
+		}
+		lc, exists := conf.LMDBs[lmdbName]
+		if !exists {
+			return fmt.Errorf("lmdb %q not found in config", lmdbName)
+		}
+
+		// The source is read within the write transaction, so it must be
+		// opened before.
+		var read func(im *syncer.Importer) error
+		if dumpPath != "" {
+			var r io.Reader = os.Stdin
+			if dumpPath != "-" {
+				f, err := os.Open(dumpPath)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+				r = f
+			}
+			read = func(im *syncer.Importer) error {
+				return mdbdump.Read(r, im)
+			}
+		} else {
+			srcEnv, err := lmdbenv.NewWithOptions(fromPath, lmdbenv.Options{
+				EnvFlags: lmdb.Readonly,
+			})
+			if err != nil {
+				return err
+			}
+			defer srcEnv.Close()
+			read = func(im *syncer.Importer) error {
+				return srcEnv.View(func(txn *lmdb.Txn) error {
+					_, err := syncer.Export(txn, config.LMDB{}, false, im)
+					return err
+				})
+			}
+		}
+
+		env, err := lmdbenv.NewWithOptions(lc.Path, lc.Options)
+		if err != nil {
+			return err
+		}
+		defer env.Close()
+
+		var im *syncer.Importer
+		err = env.Update(func(txn *lmdb.Txn) error {
+			im = syncer.NewImporter(txn, lc, header.TimestampFromTime(ts))
+			if err := read(im); err != nil {
+				return err
+			}
+			return im.Finish(ctx)
+		})
+		if err != nil {
+			return err
+		}
+		l := logrus.WithField("db", lmdbName)
+		for _, dbiName := range im.Skipped {
+			l.WithField("dbi", dbiName).Warn("Skipped DBI that is not synced")
+		}
+		for dbiName, n := range im.Counts {
+			l.WithFields(logrus.Fields{
+				"dbi":      dbiName,
+				"imported": n,
+			}).Info("Imported")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/syncer"
+)
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.AddCommand(migrateAddHeadersCmd)
+	migrateAddHeadersCmd.Flags().String("lmdb", "",
+		"Configured LMDB to migrate")
+	migrateAddHeadersCmd.Flags().String("timestamp", "",
+		"Timestamp for the headers in RFC 3339 format (default now)")
+	_ = migrateAddHeadersCmd.MarkFlagRequired("lmdb")
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrate existing LMDBs to the format used by Lightning Stream",
+	Run: func(cmd *cobra.Command, args []string) {
+		_ = cmd.Help()
+	},
+}
+
+var migrateAddHeadersCmd = &cobra.Command{
+	Use:   "add-headers",
+	Short: "Add headers to the values of an LMDB that was written without them",
+	Long: `Add headers to the values of an LMDB that was written without them.
+
+Rewrites every value in the synced DBIs of an LMDB that is configured with
+schema_tracks_changes, but was written by an application without Lightning
+Stream support, so that it starts with a header with the given timestamp.
+This onboards an existing deployment without a dump and restore.
+
+The values are not checked for an existing header, so this must be done only
+once for an LMDB, while no other process has it open. Use a timestamp in the
+past if other instances already have newer data for the same keys.
+
+DBIs with flags for duplicate values, like MDB_DUPSORT, are not supported with
+schema_tracks_changes and cause the migration to fail.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lmdbName, err := cmd.Flags().GetString("lmdb")
+		if err != nil {
+			return err
+		}
+		lc, exists := conf.LMDBs[lmdbName]
+		if !exists {
+			return fmt.Errorf("lmdb %q not found in config", lmdbName)
+		}
+		if !lc.SchemaTracksChanges {
+			return fmt.Errorf("lmdb %q: headers are only used with schema_tracks_changes", lmdbName)
+		}
+		tsString, err := cmd.Flags().GetString("timestamp")
+		if err != nil {
+			return err
+		}
+		ts := time.Now()
+		if tsString != "" {
+			ts, err = time.Parse(time.RFC3339Nano, tsString)
+			if err != nil {
+				return fmt.Errorf("--timestamp: %w", err)
+			}
+		}
+
+		env, err := lmdbenv.NewWithOptions(lc.Path, lc.Options)
+		if err != nil {
+			return err
+		}
+		defer env.Close()
+
+		var counts map[string]int
+		err = env.Update(func(txn *lmdb.Txn) error {
+			var err error
+			counts, err = syncer.AddHeaders(txn, lc, header.TimestampFromTime(ts))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for dbiName, n := range counts {
+			logrus.WithFields(logrus.Fields{
+				"db":      lmdbName,
+				"dbi":     dbiName,
+				"updated": n,
+			}).Info("Added headers")
+		}
+		return nil
+	},
+}
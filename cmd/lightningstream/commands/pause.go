@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/status"
+)
+
+// handlePauseSignals pauses syncing in both directions for all LMDBs on
+// SIGUSR1, and resumes it on SIGUSR2. The admin API can pause a single
+// direction or LMDB.
+func handlePauseSignals(ctx context.Context) error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(ch)
+
+	for {
+		var sig os.Signal
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case sig = <-ch:
+		}
+		pause := sig == syscall.SIGUSR1
+		if pause {
+			logrus.Info("Received SIGUSR1, pausing sync")
+		} else {
+			logrus.Info("Received SIGUSR2, resuming sync")
+		}
+		for _, c := range status.Controllers() {
+			if pause {
+				c.Pause(true, true)
+			} else {
+				c.Resume(true, true)
+			}
+		}
+	}
+}
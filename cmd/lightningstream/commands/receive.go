@@ -3,6 +3,7 @@ package commands
 import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/syncer"
 )
 
 func init() {
@@ -15,7 +16,7 @@ var receiveCmd = &cobra.Command{
 	Use:   "receive",
 	Short: "Like sync, but never write snapshots",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := runSync(true); err != nil {
+		if err := runSync(syncer.Options{ReceiveOnly: true}); err != nil {
 			logrus.WithError(err).Fatal("Error")
 		}
 	},
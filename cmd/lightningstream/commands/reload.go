@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/config/logger"
+	"powerdns.com/platform/lightningstream/syncer"
+)
+
+// handleReloads reloads the config file on every SIGHUP until the context is
+// cancelled. The log settings and the settings that syncer.Syncer.Reload
+// supports are applied to the running syncers, and newly added LMDBs are
+// started. All other changes require a restart, which is logged.
+func handleReloads(ctx context.Context, syncers map[string]*syncer.Syncer, startSyncer func(c config.Config, name string, lc config.LMDB) error) error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	current := conf
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+		logrus.Info("Received SIGHUP, reloading configuration")
+		newConf, err := loadConfig()
+		if err != nil {
+			logrus.WithError(err).Error("Reload failed, keeping the current configuration")
+			continue
+		}
+		newConf.OnlyOnce = current.OnlyOnce
+
+		logger.Configure(newConf.Log)
+		for _, s := range syncers {
+			s.Reload(newConf)
+		}
+		for name, lc := range newConf.LMDBs {
+			if _, running := syncers[name]; running {
+				if !reflect.DeepEqual(lc, current.LMDBs[name]) {
+					logrus.WithField("db", name).Warn(
+						"Changed LMDB settings only take effect after a restart")
+				}
+				continue
+			}
+			logrus.WithField("db", name).Info("Starting syncer for new LMDB")
+			if err := startSyncer(newConf, name, lc); err != nil {
+				logrus.WithError(err).WithField("db", name).Error("Starting syncer failed")
+			}
+		}
+		for name := range syncers {
+			if _, exists := newConf.LMDBs[name]; !exists {
+				logrus.WithField("db", name).Warn(
+					"Removed LMDB keeps running until the next restart")
+			}
+		}
+		if restartRequired(current, newConf) {
+			logrus.Warn("Some of the changed settings only take effect after a restart")
+		}
+		if logConfig {
+			logrus.Infof("Effective configuration:\n%s\n", newConf.String())
+		}
+		current = newConf
+	}
+}
+
+// restartRequired returns true if settings were changed that cannot be
+// reloaded.
+func restartRequired(oldConf, newConf config.Config) bool {
+	newConf.Log = oldConf.Log
+	newConf.LMDBPollInterval = oldConf.LMDBPollInterval
+	newConf.StoragePollInterval = oldConf.StoragePollInterval
+	newConf.StorageForceSnapshotInterval = oldConf.StorageForceSnapshotInterval
+	newConf.Storage.Cleanup = oldConf.Storage.Cleanup
+	newConf.LMDBs = oldConf.LMDBs // checked separately
+	return !reflect.DeepEqual(oldConf, newConf)
+}
@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/backends/prefix"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer"
+)
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().String("lmdb", "",
+		"Configured LMDB to restore, optional if only one is configured")
+	restoreCmd.Flags().StringP("time", "t", "",
+		"Restore the state as of this time (RFC 3339, e.g. 2023-01-02T15:04:05Z)")
+	restoreCmd.Flags().StringP("output", "o", "",
+		"Path of the new LMDB to create, which must not exist yet")
+	restoreCmd.Flags().String("prefix", "",
+		"Restore from the snapshots under this prefix, e.g. the backup.prefix")
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore --time TIME --output PATH",
+	Short: "Restore the state of an LMDB at a point in time into a new LMDB",
+	Long: `Restore the state of an LMDB at a point in time into a new LMDB.
+
+Creates a new LMDB at the output path and loads the newest snapshot of every
+instance that is not newer than the given time, exactly like a new instance
+would during its first sync, but ignoring all newer snapshots. This can be
+used to recover data that was accidentally deleted, as long as the cleaner
+has not yet removed the snapshots from before the deletion.
+
+To restore from scheduled backups instead, pass the backup prefix with
+--prefix.
+
+The new LMDB uses the options of the configured LMDB and includes the
+shadow databases, so that it can be put in place of the original LMDB.
+Nothing is written to the storage backend.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(rootCtx)
+		defer cancel()
+
+		lmdbName, err := cmd.Flags().GetString("lmdb")
+		if err != nil {
+			return err
+		}
+		timeStr, err := cmd.Flags().GetString("time")
+		if err != nil {
+			return err
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		snapshotPrefix, err := cmd.Flags().GetString("prefix")
+		if err != nil {
+			return err
+		}
+		if timeStr == "" || output == "" {
+			return fmt.Errorf("--time and --output are required")
+		}
+		until, err := time.Parse(time.RFC3339Nano, timeStr)
+		if err != nil {
+			return fmt.Errorf("--time: %w", err)
+		}
+		return restoreLMDB(ctx, lmdbName, output, snapshotPrefix, until)
+	},
+}
+
+// restoreLMDB creates a new LMDB at the output path and loads the newest
+// snapshot of every instance that is not newer than until into it. A zero
+// until loads the latest snapshots.
+func restoreLMDB(ctx context.Context, lmdbName, output, snapshotPrefix string, until time.Time) error {
+	if lmdbName == "" {
+		if len(conf.LMDBs) != 1 {
+			return fmt.Errorf("multiple LMDBs configured, please select one with --lmdb")
+		}
+		for name := range conf.LMDBs {
+			lmdbName = name
+		}
+	}
+	lc, exists := conf.LMDBs[lmdbName]
+	if !exists {
+		return fmt.Errorf("lmdb %q not found in config", lmdbName)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		return fmt.Errorf("output %q already exists", output)
+	}
+
+	st, err := getStorage(ctx)
+	if err != nil {
+		return err
+	}
+	st = prefix.New(st, lc.StoragePrefix+snapshotPrefix)
+
+	// Check upfront that there is something to restore, the syncer
+	// would happily finish with an empty LMDB.
+	ls, err := st.List(ctx, lmdbName+"__")
+	if err != nil {
+		return err
+	}
+	var n int
+	for _, name := range ls.Names() {
+		ni, err := snapshot.ParseName(name)
+		if err != nil || (!until.IsZero() && ni.Timestamp.After(until)) {
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		if until.IsZero() {
+			return fmt.Errorf("no snapshots found for lmdb %q", lmdbName)
+		}
+		return fmt.Errorf("no snapshots found for lmdb %q at or before %s",
+			lmdbName, until.Format(time.RFC3339))
+	}
+
+	lc.Path = output
+	lc.Options.Create = true
+	conf.OnlyOnce = true
+
+	l := logrus.WithField("db", lmdbName)
+	env, err := syncer.OpenEnv(l, lc)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := env.Close(); err != nil {
+			l.WithError(err).Error("Env close failed")
+		}
+	}()
+
+	opt := syncer.Options{
+		ReceiveOnly: true,
+		Until:       until,
+	}
+	s, err := syncer.New(lmdbName, env, st, conf, lc, opt)
+	if err != nil {
+		return err
+	}
+	if until.IsZero() {
+		l.Info("Restoring the latest state")
+	} else {
+		l.WithField("until", until.Format(time.RFC3339Nano)).Info("Restoring")
+	}
+	if err := s.Sync(ctx); err != nil {
+		return err
+	}
+	l.WithField("output", output).Info("Restore complete")
+	return nil
+}
@@ -5,13 +5,17 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"go.uber.org/atomic"
 	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/config/logger"
+	"powerdns.com/platform/lightningstream/utils/membudget"
 )
 
 const (
@@ -33,6 +37,9 @@ var (
 	// These are ste by Execute
 	rootCtx    context.Context
 	rootCancel context.CancelFunc
+
+	// shutdownRequested is set when a SIGTERM or SIGINT was received
+	shutdownRequested atomic.Bool
 )
 
 const (
@@ -66,32 +73,13 @@ var rootCmd = &cobra.Command{
 	Short: "This tool syncs one or more LMDB databases with an S3 bucket",
 	Long:  rootHelp,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		conf = config.Default()
-		conf.Version = version
-		err := conf.LoadYAMLFile(configFile, true)
+		var err error
+		conf, err = loadConfig()
 		if err != nil {
-			logrus.Fatalf("Load config file %q: %v", configFile, err)
-		}
-		// Also check at this stage. A config must always be valid, even if you
-		// later override some items.
-		if err := conf.Check(); err != nil {
-			logrus.Fatalf("Config file error: %v", err)
-		}
-
-		if conf.Storage.RootPath != "" {
-			logrus.Warn("storage.root_path is deprecated and will be removed, " +
-				"use storage.options.root_path instead")
-			conf.Storage.Options["root_path"] = conf.Storage.RootPath
-		}
-
-		conf.Log = conf.Log.Merge(logger.FlagConfig)
-		if debug {
-			conf.Log.Level = "debug"
-		}
-		if instanceName != "" {
-			conf.Instance = instanceName
+			logrus.Fatal(err)
 		}
 		logger.Configure(conf.Log)
+		membudget.Shared().SetLimit(int64(conf.MemoryBudget.Bytes()))
 		ensureMinimumPID()
 		logrus.WithField("version", version).Debug("Running")
 		if logConfig {
@@ -105,6 +93,36 @@ var rootCmd = &cobra.Command{
 	Version: version,
 }
 
+// loadConfig loads and checks the config file, and applies the overrides from
+// the command line flags.
+func loadConfig() (config.Config, error) {
+	c := config.Default()
+	c.Version = version
+	if err := c.LoadYAMLFile(configFile, true); err != nil {
+		return c, fmt.Errorf("load config file %q: %w", configFile, err)
+	}
+	// Also check at this stage. A config must always be valid, even if you
+	// later override some items.
+	if err := c.Check(); err != nil {
+		return c, fmt.Errorf("config file error: %w", err)
+	}
+
+	if c.Storage.RootPath != "" {
+		logrus.Warn("storage.root_path is deprecated and will be removed, " +
+			"use storage.options.root_path instead")
+		c.Storage.Options["root_path"] = c.Storage.RootPath
+	}
+
+	c.Log = c.Log.Merge(logger.FlagConfig)
+	if debug {
+		c.Log.Level = "debug"
+	}
+	if instanceName != "" {
+		c.Instance = instanceName
+	}
+	return c, nil
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "lightningstream.yaml", "Config file")
 	rootCmd.PersistentFlags().BoolVar(&logConfig, "log-config", false, "Log the evaluated configuration on startup")
@@ -117,9 +135,27 @@ func init() {
 	logger.RegisterFlagsWith(rootCmd.PersistentFlags().StringVar)
 }
 
+// handleSignals cancels the root context on the first SIGTERM or SIGINT, which
+// allows the syncers to write a final snapshot within the shutdown_timeout.
+// A second signal exits immediately.
+func handleSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-ch
+		logrus.WithField("signal", sig).Info("Shutting down, send the signal again to exit immediately")
+		shutdownRequested.Store(true)
+		rootCancel()
+		sig = <-ch
+		logrus.WithField("signal", sig).Warn("Exiting immediately")
+		os.Exit(1)
+	}()
+}
+
 func Execute() {
 	rootCtx, rootCancel = context.WithCancel(context.Background())
 	defer rootCancel()
+	handleSignals()
 	if err := rootCmd.Execute(); err != nil {
 		if errors.Is(err, context.Canceled) && timeout > 0 {
 			logrus.Error("Context cancelled, likely due to timeout")
@@ -0,0 +1,23 @@
+package commands
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/syncer"
+)
+
+func init() {
+	rootCmd.AddCommand(sendCmd)
+	sendCmd.Flags().BoolVar(&onlyOnce, "only-once", false, "Only do a single run and exit")
+	sendCmd.Flags().StringVar(&markerFile, "wait-for-marker-file", "", "Marker file to wait for in storage before starting syncers")
+}
+
+var sendCmd = &cobra.Command{
+	Use:   "send",
+	Short: "Like sync, but never load remote snapshots",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runSync(syncer.Options{SendOnly: true}); err != nil {
+			logrus.WithError(err).Fatal("Error")
+		}
+	},
+}
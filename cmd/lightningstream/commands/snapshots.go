@@ -2,12 +2,15 @@ package commands
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"text/tabwriter"
 	"time"
 
 	"github.com/PowerDNS/simpleblob"
@@ -33,7 +36,9 @@ func init() {
 
 	snapshotsCmd.AddCommand(snapshotsDumpCmd)
 	snapshotsDumpCmd.Flags().StringP("format", "f", "debug",
-		"Output format, one of: 'debug' (default), 'text' (same)")
+		"Output format, one of: 'debug' (default), 'text' (same), 'hex' (like debug, "+
+			"but with hex keys and values), 'summary' (only DBI stats), "+
+			"'json' (one JSON object per entry, with hex keys and values)")
 	snapshotsDumpCmd.Flags().StringP("dbi", "d", "", "Only output DBI with this exact name")
 	snapshotsDumpCmd.Flags().BoolP("local", "l", false,
 		"Dump a local file instead of a remote snapshot")
@@ -46,6 +51,12 @@ func init() {
 	snapshotsPutCmd.Flags().StringP("name", "n", "",
 		"Name to store the snapshot as, if different from the local name")
 	snapshotsPutCmd.Flags().Bool("force", false, "Force the use of an invalid snapshot name")
+
+	snapshotsDictSamplesCmd.Flags().StringP("output", "o", "dict-samples",
+		"Output directory for the samples")
+	snapshotsDictSamplesCmd.Flags().Int("sample-size", 128*1024,
+		"Size of each sample in bytes")
+	snapshotsCmd.AddCommand(snapshotsDictSamplesCmd)
 }
 
 var snapshotsCmd = &cobra.Command{
@@ -65,7 +76,7 @@ var snapshotsListCmd = &cobra.Command{
 		ctx, cancel := context.WithTimeout(rootCtx, time.Minute)
 		defer cancel()
 
-		st, err := simpleblob.GetBackend(ctx, conf.Storage.Type, conf.Storage.Options)
+		st, err := getStorage(ctx)
 		if err != nil {
 			return err
 		}
@@ -111,7 +122,7 @@ var snapshotsRemoveCmd = &cobra.Command{
 		ctx, cancel := context.WithTimeout(rootCtx, time.Minute)
 		defer cancel()
 
-		st, err := simpleblob.GetBackend(ctx, conf.Storage.Type, conf.Storage.Options)
+		st, err := getStorage(ctx)
 		if err != nil {
 			return err
 		}
@@ -133,7 +144,9 @@ var snapshotsDumpCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		if format != "debug" && format != "text" {
+		switch format {
+		case "debug", "text", "hex", "summary", "json":
+		default:
 			return fmt.Errorf("output format not supported: %s", format)
 		}
 		dbiName, err := cmd.Flags().GetString("dbi")
@@ -145,24 +158,7 @@ var snapshotsDumpCmd = &cobra.Command{
 			return err
 		}
 
-		// Load snapshot
-		var data []byte
-		if local {
-			data, err = os.ReadFile(args[0])
-			if err != nil {
-				return err
-			}
-		} else {
-			st, err := simpleblob.GetBackend(ctx, conf.Storage.Type, conf.Storage.Options)
-			if err != nil {
-				return err
-			}
-			data, err = st.Load(ctx, args[0])
-			if err != nil {
-				return err
-			}
-		}
-		snap, err := snapshot.LoadData(data)
+		snap, err := loadSnapshot(ctx, args[0], local)
 		if err != nil {
 			return err
 		}
@@ -181,47 +177,192 @@ var snapshotsDumpCmd = &cobra.Command{
 			_, _ = fmt.Fprintf(out, sfmt, args...)
 		}
 
-		switch format {
-		case "debug", "text":
-			databases := snap.Databases
-			snap.Databases = nil
-			j, err := json.MarshalIndent(snap, "", "  ")
-			if err != nil {
-				return err
-			}
-			outf("%s\n", string(j))
-
-			// Print DBI contents
-			now := time.Now()
-			for _, dbi := range databases {
-				outf("\n### %s (transform=%q, flags=%q)\n\n",
-					dbi.Name(), dbi.Transform(), dbiflags.Flags(dbi.Flags()))
-				dbi.ResetCursor()
-				for {
-					e, err := dbi.Next()
-					if err != nil {
-						if err != io.EOF {
-							return err
-						}
-						break
+		if format == "json" {
+			return dumpSnapshotJSON(out, snap.Databases)
+		}
+
+		databases := snap.Databases
+		snap.Databases = nil
+		j, err := json.MarshalIndent(snap, "", "  ")
+		if err != nil {
+			return err
+		}
+		outf("%s\n", string(j))
+
+		if format == "summary" {
+			return dumpSnapshotSummary(out, databases)
+		}
+
+		display := utils.DisplayASCII
+		if format == "hex" {
+			display = hex.EncodeToString
+		}
+
+		// Print DBI contents
+		now := time.Now()
+		for _, dbi := range databases {
+			outf("\n### %s (transform=%q, flags=%q)\n\n",
+				dbi.Name(), dbi.Transform(), dbiflags.Flags(dbi.Flags()))
+			dbi.ResetCursor()
+			for {
+				e, err := dbi.Next()
+				if err != nil {
+					if err != io.EOF {
+						return err
 					}
-					t := header.Timestamp(e.TimestampNano).Time()
-					outf("%s  =  %s  (%s, %s ago; flags=%02x)\n",
-						utils.DisplayASCII(e.Key),
-						utils.DisplayASCII(e.Value),
-						t,
-						now.Sub(t).Round(time.Second),
-						e.Flags,
-					)
+					break
 				}
+				t := header.Timestamp(e.TimestampNano).Time()
+				outf("%s  =  %s  (%s, %s ago; flags=%02x)\n",
+					display(e.Key),
+					display(e.Value),
+					t,
+					now.Sub(t).Round(time.Second),
+					e.Flags,
+				)
 			}
-			return nil
-		default:
-			panic("unhandled output format: " + format)
 		}
+		return nil
 	},
 }
 
+// dbiSummary contains stats for all chunks of a DBI in a snapshot
+type dbiSummary struct {
+	name      string
+	flags     uint64
+	transform string
+	chunks    int
+	entries   int
+	deleted   int
+	first     header.Timestamp
+	last      header.Timestamp
+}
+
+// dumpSnapshotSummary writes the entry counts and timestamp ranges per DBI
+func dumpSnapshotSummary(w io.Writer, databases []*snapshot.DBI) error {
+	var summaries []*dbiSummary
+	byName := make(map[string]*dbiSummary)
+	for _, dbi := range databases {
+		sum := byName[dbi.Name()]
+		if sum == nil {
+			sum = &dbiSummary{
+				name:      dbi.Name(),
+				flags:     dbi.Flags(),
+				transform: dbi.Transform(),
+			}
+			byName[dbi.Name()] = sum
+			summaries = append(summaries, sum)
+		}
+		sum.chunks++
+		dbi.ResetCursor()
+		for {
+			e, err := dbi.Next()
+			if err != nil {
+				if err != io.EOF {
+					return err
+				}
+				break
+			}
+			sum.entries++
+			if header.Flags(e.Flags).IsDeleted() {
+				sum.deleted++
+			}
+			ts := header.Timestamp(e.TimestampNano)
+			if sum.first == 0 || ts < sum.first {
+				sum.first = ts
+			}
+			if ts > sum.last {
+				sum.last = ts
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 2, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "\nDBI\tFLAGS\tTRANSFORM\tCHUNKS\tENTRIES\tDELETED\tOLDEST\tNEWEST")
+	for _, sum := range summaries {
+		oldest, newest := "-", "-"
+		if sum.entries > 0 {
+			oldest = sum.first.Time().Format(time.RFC3339Nano)
+			newest = sum.last.Time().Format(time.RFC3339Nano)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+			sum.name,
+			dbiflags.Flags(sum.flags),
+			sum.transform,
+			sum.chunks,
+			sum.entries,
+			sum.deleted,
+			oldest,
+			newest,
+		)
+	}
+	return tw.Flush()
+}
+
+// jsonEntry is a snapshot entry as written by the json dump format
+type jsonEntry struct {
+	DBI       string `json:"dbi"`
+	Key       string `json:"key"`   // hex encoded
+	Value     string `json:"value"` // hex encoded
+	Timestamp string `json:"timestamp"`
+	Flags     uint32 `json:"flags"`
+}
+
+// dumpSnapshotJSON writes every entry as a JSON object on a separate line
+func dumpSnapshotJSON(w io.Writer, databases []*snapshot.DBI) error {
+	enc := json.NewEncoder(w)
+	for _, dbi := range databases {
+		dbi.ResetCursor()
+		for {
+			e, err := dbi.Next()
+			if err != nil {
+				if err != io.EOF {
+					return err
+				}
+				break
+			}
+			err = enc.Encode(jsonEntry{
+				DBI:       dbi.Name(),
+				Key:       hex.EncodeToString(e.Key),
+				Value:     hex.EncodeToString(e.Value),
+				Timestamp: header.Timestamp(e.TimestampNano).Time().Format(time.RFC3339Nano),
+				Flags:     e.Flags,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadSnapshot loads a snapshot from storage, or from a local file if local
+// is set.
+func loadSnapshot(ctx context.Context, name string, local bool) (*snapshot.Snapshot, error) {
+	var data []byte
+	var err error
+	if local {
+		data, err = os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		st, err := getStorage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err = st.Load(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dict, err := conf.Storage.Compression.LoadDictionary()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.LoadData(data, dict)
+}
+
 var snapshotsGetCmd = &cobra.Command{
 	Use:          "get",
 	Short:        "Download a snapshot",
@@ -239,7 +380,7 @@ var snapshotsGetCmd = &cobra.Command{
 			outName = args[0]
 		}
 
-		st, err := simpleblob.GetBackend(ctx, conf.Storage.Type, conf.Storage.Options)
+		st, err := getStorage(ctx)
 		if err != nil {
 			return err
 		}
@@ -282,7 +423,7 @@ var snapshotsPutCmd = &cobra.Command{
 			logrus.WithError(err).Warn("Invalid snapshot name forced")
 		}
 
-		st, err := simpleblob.GetBackend(ctx, conf.Storage.Type, conf.Storage.Options)
+		st, err := getStorage(ctx)
 		if err != nil {
 			return err
 		}
@@ -295,6 +436,79 @@ var snapshotsPutCmd = &cobra.Command{
 	},
 }
 
+var snapshotsDictSamplesCmd = &cobra.Command{
+	Use:   "dict-samples",
+	Short: "Write uncompressed samples of snapshots for zstd dictionary training",
+	Long: `Write uncompressed samples of snapshots for zstd dictionary training.
+
+The samples can be used to train a dictionary with the zstd command line tool:
+
+    zstd --train dict-samples/* -o snapshots.dict
+
+and then configured with 'storage.compression.dictionary_file'.
+`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithTimeout(rootCtx, 10*time.Minute)
+		defer cancel()
+
+		outDir, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		sampleSize, err := cmd.Flags().GetInt("sample-size")
+		if err != nil {
+			return err
+		}
+		if sampleSize < 1 {
+			return fmt.Errorf("sample-size must be positive")
+		}
+		if err := os.MkdirAll(outDir, 0777); err != nil {
+			return err
+		}
+		dict, err := conf.Storage.Compression.LoadDictionary()
+		if err != nil {
+			return err
+		}
+
+		st, err := getStorage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range args {
+			data, err := st.Load(ctx, name)
+			if err != nil {
+				return err
+			}
+			snap, err := snapshot.LoadData(data, dict)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			buf := bytes.NewBuffer(nil)
+			if _, err := snap.WriteTo(buf); err != nil {
+				return err
+			}
+			pb := buf.Bytes()
+			n := 0
+			for len(pb) > 0 {
+				sample := pb
+				if len(sample) > sampleSize {
+					sample = sample[:sampleSize]
+				}
+				pb = pb[len(sample):]
+				fpath := filepath.Join(outDir, fmt.Sprintf("%s.%06d", name, n))
+				if err := os.WriteFile(fpath, sample, 0666); err != nil {
+					return err
+				}
+				n++
+			}
+			logrus.WithField("snapshot_name", name).WithField("samples", n).Info("Wrote samples")
+		}
+		return nil
+	},
+}
+
 func sortByTime(list simpleblob.BlobList) {
 	slices.SortFunc(list, func(a, b simpleblob.Blob) bool {
 		na, errA := snapshot.ParseName(a.Name)
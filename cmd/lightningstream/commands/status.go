@@ -0,0 +1,218 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob"
+	"github.com/c2h5oh/datasize"
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/backends/prefix"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringP("url", "u", "",
+		"Base URL of the HTTP server of a running instance to fetch health and readiness from, like http://localhost:8500")
+	statusCmd.Flags().Bool("no-pending", false,
+		"Do not count the pending shadow changes, which requires reading all data")
+}
+
+// instanceStatus summarizes the snapshots of a single instance in storage
+type instanceStatus struct {
+	count  int
+	size   int64
+	newest snapshot.NameInfo
+}
+
+func statusForLMDB(ctx context.Context, st simpleblob.Interface, name string, lc config.LMDB, pending bool) error {
+	fmt.Printf("LMDB %q (%s)\n", name, lc.Path)
+
+	// Snapshots in storage, grouped by instance
+	list, err := st.List(ctx, name+"__")
+	if err != nil {
+		return err
+	}
+	instances := make(map[string]*instanceStatus)
+	for _, blob := range list {
+		ni, err := snapshot.ParseName(blob.Name)
+		if err != nil || ni.SyncerName != name {
+			continue
+		}
+		is := instances[ni.InstanceID]
+		if is == nil {
+			is = &instanceStatus{}
+			instances[ni.InstanceID] = is
+		}
+		is.count++
+		is.size += blob.Size
+		if ni.Timestamp.After(is.newest.Timestamp) {
+			is.newest = ni
+		}
+	}
+	var ids []string
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	ownID := syncer.SafeInstanceID(conf.Instance)
+	now := time.Now()
+	fmt.Printf("  Instances in storage: %d\n", len(ids))
+	if len(ids) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "    INSTANCE\tSNAPSHOTS\tSIZE\tNEWEST\tAGE\tTYPE\tGENERATION")
+		for _, id := range ids {
+			is := instances[id]
+			typ := "full"
+			if is.newest.IsDelta() {
+				typ = "delta"
+			}
+			own := ""
+			if id == ownID {
+				own = " (this)"
+			}
+			_, _ = fmt.Fprintf(tw, "    %s%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+				id, own,
+				is.count,
+				datasize.ByteSize(is.size).HumanReadable(),
+				is.newest.Timestamp.Format(time.RFC3339),
+				now.Sub(is.newest.Timestamp).Round(time.Second),
+				typ,
+				is.newest.GenerationID,
+			)
+		}
+		_ = tw.Flush()
+	}
+
+	// Local state
+	fmt.Printf("  Local instance: %s\n", ownID)
+	if own, ok := instances[ownID]; ok {
+		fmt.Printf("  Local generation: %s\n", own.newest.GenerationID)
+	} else {
+		fmt.Printf("  Local generation: none (no snapshots stored)\n")
+	}
+
+	env, err := lmdbenv.NewWithOptions(lc.Path, lc.Options)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	return env.View(func(txn *lmdb.Txn) error {
+		fmt.Printf("  Local LMDB txn ID: %d\n", txn.ID())
+		if lc.SchemaTracksChanges {
+			fmt.Printf("  Pending shadow changes: n/a (schema_tracks_changes)\n")
+			return nil
+		}
+		if !pending {
+			return nil
+		}
+		counts, err := syncer.PendingShadowChanges(txn, lc)
+		if err != nil {
+			return err
+		}
+		var dbiNames []string
+		var total int
+		for dbiName, n := range counts {
+			dbiNames = append(dbiNames, dbiName)
+			total += n
+		}
+		sort.Strings(dbiNames)
+		fmt.Printf("  Pending shadow changes: %d\n", total)
+		for _, dbiName := range dbiNames {
+			if n := counts[dbiName]; n > 0 {
+				fmt.Printf("    %s: %d\n", dbiName, n)
+			}
+		}
+		return nil
+	})
+}
+
+// statusFromURL prints the readiness and health status of a running instance
+func statusFromURL(ctx context.Context, baseURL string) error {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	for _, path := range []string{"/readyz", "/healthz"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Running instance %s: %s\n", path, resp.Status)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	return nil
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Print the sync status of all LMDBs and the instances in storage",
+	Long: `Print the sync status of all LMDBs and the instances in storage.
+
+For every LMDB this lists the instances that have snapshots in storage with
+their newest snapshot, the local generation, the last local transaction ID,
+and the number of local changes that have not been synced to the shadow
+databases yet.
+
+With --url, the readiness and health checks of a running instance are
+fetched from its HTTP server to show its current errors.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithTimeout(rootCtx, time.Minute)
+		defer cancel()
+
+		baseURL, err := cmd.Flags().GetString("url")
+		if err != nil {
+			return err
+		}
+		noPending, err := cmd.Flags().GetBool("no-pending")
+		if err != nil {
+			return err
+		}
+
+		st, err := getStorage(ctx)
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		for name := range conf.LMDBs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lc := conf.LMDBs[name]
+			if err := statusForLMDB(ctx, prefix.New(st, lc.StoragePrefix), name, lc, !noPending); err != nil {
+				return fmt.Errorf("lmdb %s: %w", name, err)
+			}
+		}
+
+		if baseURL != "" {
+			return statusFromURL(ctx, baseURL)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/PowerDNS/simpleblob"
+	"powerdns.com/platform/lightningstream/backends/dedup"
+	"powerdns.com/platform/lightningstream/backends/encryption"
+	"powerdns.com/platform/lightningstream/backends/failover"
+	"powerdns.com/platform/lightningstream/backends/layout"
+	"powerdns.com/platform/lightningstream/backends/lazy"
+	"powerdns.com/platform/lightningstream/backends/replicate"
+	"powerdns.com/platform/lightningstream/backends/throttle"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+// getStorage returns the configured storage backend, wrapped with the
+// encryption, failover to a secondary backend, replication, the key layout,
+// rate limits and deduplication if enabled.
+func getStorage(ctx context.Context) (simpleblob.Interface, error) {
+	st, err := getBackend(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return wrapStorage(ctx, st)
+}
+
+// wrapStorage wraps a backend returned by getBackend with replication, the
+// key layout, rate limits and deduplication if enabled. The replicas are
+// encrypted like the backend.
+func wrapStorage(ctx context.Context, st simpleblob.Interface) (simpleblob.Interface, error) {
+	if rp := conf.Storage.Replication; len(rp.Replicas) > 0 {
+		var replicas []replicate.Replica
+		for i, r := range rp.Replicas {
+			r := r
+			name := rp.ReplicaName(i)
+			replicas = append(replicas, replicate.Replica{
+				Name: name,
+				St: lazy.New(ctx, func(ctx context.Context) (simpleblob.Interface, error) {
+					st, err := simpleblob.GetBackend(ctx, r.Type, r.Options)
+					if err == nil {
+						st, err = encryption.New(st, r.Encryption.Or(conf.Storage.Encryption))
+					}
+					if err != nil {
+						return nil, fmt.Errorf("storage.replication: %s: %w", name, err)
+					}
+					return st, nil
+				}),
+			})
+		}
+		st = replicate.New(st, replicas, rp.Quorum)
+	}
+	if conf.Storage.Layout != "" {
+		l, err := layout.Parse(conf.Storage.Layout)
+		if err != nil {
+			return nil, fmt.Errorf("storage.layout: %w", err)
+		}
+		st = layout.New(st, l)
+	}
+	st = throttle.New(st, conf.Storage.Throttle)
+	var hashKey []byte
+	if conf.Storage.Dedup.Enabled {
+		// Object names are not encrypted, so with encryption the blocks
+		// are named after an HMAC instead of their hash
+		var err error
+		hashKey, err = encryption.DeriveKey(conf.Storage.Encryption, "dedup")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dedup.New(st, conf.Storage.Dedup, hashKey), nil
+}
+
+// getBackend returns the configured storage backend, or the failover between
+// the primary and secondary backends if enabled. Every backend is wrapped
+// with its encryption, if enabled.
+func getBackend(ctx context.Context) (simpleblob.Interface, error) {
+	newBackend := func(ctx context.Context, typ string, options map[string]interface{}, enc config.Encryption) (simpleblob.Interface, error) {
+		st, err := simpleblob.GetBackend(ctx, typ, options)
+		if err != nil {
+			return nil, err
+		}
+		return encryption.New(st, enc)
+	}
+	fo := conf.Storage.Failover
+	primary := func(ctx context.Context) (simpleblob.Interface, error) {
+		return newBackend(ctx, conf.Storage.Type, conf.Storage.Options, conf.Storage.Encryption)
+	}
+	if !fo.Enabled {
+		return primary(ctx)
+	}
+	secondary := func(ctx context.Context) (simpleblob.Interface, error) {
+		st, err := newBackend(ctx, fo.Type, fo.Options, fo.Encryption.Or(conf.Storage.Encryption))
+		if err != nil {
+			return nil, fmt.Errorf("storage.failover: %w", err)
+		}
+		return st, nil
+	}
+	return failover.New(ctx, primary, secondary, fo)
+}
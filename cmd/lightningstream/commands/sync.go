@@ -2,49 +2,108 @@ package commands
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"time"
 
-	"github.com/PowerDNS/simpleblob"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/wojas/go-healthz"
 	"golang.org/x/sync/errgroup"
+	"powerdns.com/platform/lightningstream/backends/encryption"
+	"powerdns.com/platform/lightningstream/backends/prefix"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/sidecar"
 	"powerdns.com/platform/lightningstream/status"
+	"powerdns.com/platform/lightningstream/status/systemd"
+	"powerdns.com/platform/lightningstream/status/webhook"
 	"powerdns.com/platform/lightningstream/syncer"
+	"powerdns.com/platform/lightningstream/syncer/changefeed"
+	"powerdns.com/platform/lightningstream/syncer/conflict"
+	"powerdns.com/platform/lightningstream/syncer/pdns"
+	"powerdns.com/platform/lightningstream/syncer/peer"
+	"powerdns.com/platform/lightningstream/syncer/storageevents"
+	"powerdns.com/platform/lightningstream/tracing"
 	"powerdns.com/platform/lightningstream/utils"
 )
 
 var (
 	onlyOnce   bool
+	dryRun     bool
+	verifyOnly bool
 	markerFile string
 )
 
 func init() {
 	rootCmd.AddCommand(syncCmd)
 	syncCmd.Flags().BoolVar(&onlyOnce, "only-once", false, "Only do a single run and exit")
+	syncCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Do a single run that logs what would be loaded and stored, without changing the LMDB or the storage")
+	syncCmd.Flags().BoolVar(&verifyOnly, "verify-only", false, "Do a single run that compares the LMDB against the merged remote snapshots and reports the differences, without changing anything")
 	syncCmd.Flags().StringVar(&markerFile, "wait-for-marker-file", "", "Marker file to wait for in storage before starting syncers")
 }
 
-func runSync(receiveOnly bool) error {
+func runSync(mode syncer.Options) error {
 	ctx, cancel := context.WithCancel(rootCtx)
 	defer cancel()
 
-	if onlyOnce {
+	if onlyOnce || mode.DryRun {
 		conf.OnlyOnce = true
 	}
+	if len(wrapArgs) > 0 && conf.OnlyOnce {
+		return fmt.Errorf("a wrapped command cannot be combined with only-once")
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, conf.Tracing, conf.Instance, version)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The root context may already be cancelled at this point
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logrus.WithError(err).Warn("Tracing shutdown failed")
+		}
+	}()
 
-	st, err := simpleblob.GetBackend(ctx, conf.Storage.Type, conf.Storage.Options)
+	rawSt, err := getBackend(ctx)
 	if err != nil {
 		return err
 	}
-	logrus.WithField("storage_type", conf.Storage.Type).Info("Storage backend initialised")
+	st, err := wrapStorage(ctx, rawSt)
+	if err != nil {
+		return err
+	}
+	logrus.WithField("storage_type", conf.Storage.Type).
+		WithField("encryption", conf.Storage.Encryption.Type).
+		Info("Storage backend initialised")
 	status.SetStorage(st)
+	webhook.Start(ctx, conf.Webhooks, conf.Instance)
+	if !conf.OnlyOnce {
+		sidecar.Start(ctx, conf.Sidecar)
+		if err := storageevents.Start(ctx, conf.Storage.Events); err != nil {
+			return err
+		}
+		if err := peer.Start(ctx, conf.Peer); err != nil {
+			return err
+		}
+		if err := changefeed.Start(ctx, conf.ChangeFeed); err != nil {
+			return err
+		}
+		if err := changefeed.StartImport(ctx, conf.ChangeImport, lo.Keys(conf.LMDBs)); err != nil {
+			return err
+		}
+		pdns.Start(ctx, conf.PDNS)
+	}
 
 	// If enabled, wait for marker file to be present in storage before starting syncers
 	if markerFile != "" {
 		logrus.Infof("waiting for marker file '%s' to be present in storage", markerFile)
 		for {
-			if _, err := st.Load(ctx, markerFile); err == nil {
+			// The marker file is not a snapshot and never encrypted
+			if _, err := rawSt.Load(ctx, markerFile); err == nil || errors.Is(err, encryption.ErrNotEncrypted) {
 				logrus.Infof("marker file '%s' found, proceeding", markerFile)
 				break
 			} else {
@@ -61,8 +120,21 @@ func runSync(receiveOnly bool) error {
 		}
 	}
 
+	var conflictLog *conflict.AuditLog
+	if conf.ConflictLog != "" && !mode.DryRun {
+		conflictLog, err = conflict.OpenAuditLog(conf.ConflictLog)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = conflictLog.Close()
+		}()
+	}
+
 	eg, ctx := errgroup.WithContext(ctx)
-	for name, lc := range conf.LMDBs {
+	var caughtUp []<-chan struct{}
+	syncers := make(map[string]*syncer.Syncer)
+	startSyncer := func(c config.Config, name string, lc config.LMDB) error {
 		l := logrus.WithField("db", name)
 		env, err := syncer.OpenEnv(l, lc)
 		if err != nil {
@@ -70,29 +142,47 @@ func runSync(receiveOnly bool) error {
 		}
 
 		opt := syncer.Options{
-			ReceiveOnly: receiveOnly,
+			ReceiveOnly: mode.ReceiveOnly || lc.ReceiveOnly,
+			SendOnly:    mode.SendOnly || lc.SendOnly,
+			DryRun:      mode.DryRun,
+			VerifyOnly:  mode.VerifyOnly,
+			ConflictLog: conflictLog,
 		}
-		s, err := syncer.New(name, env, st, conf, lc, opt)
+		s, err := syncer.New(name, env, prefix.New(st, lc.StoragePrefix), c, lc, opt)
 		if err != nil {
+			_ = env.Close()
 			return err
 		}
+		syncers[name] = s
 
 		eg.Go(func() error {
 			defer func() {
-				if err := env.Close(); err != nil {
+				// The syncer reopens the env after an auto compaction
+				if err := s.Env().Close(); err != nil {
 					l.WithError(err).Error("Env close failed")
 				}
 			}()
 			err := s.Sync(ctx)
 			if err != nil {
 				if err == context.Canceled {
-					l.Error("Sync cancelled")
+					if shutdownRequested.Load() {
+						l.Info("Sync stopped")
+					} else {
+						l.Error("Sync cancelled")
+					}
 					return err
 				}
 				l.WithError(err).Error("Sync failed")
 			}
 			return err
 		})
+		return nil
+	}
+	for name, lc := range conf.LMDBs {
+		if err := startSyncer(conf, name, lc); err != nil {
+			return err
+		}
+		caughtUp = append(caughtUp, syncers[name].CaughtUp())
 	}
 
 	healthz.AddBuildInfo()
@@ -107,15 +197,54 @@ func runSync(receiveOnly bool) error {
 		logrus.Info("Not starting the HTTP server, because OnlyOnce is set")
 	}
 
+	if len(wrapArgs) > 0 {
+		eg.Go(func() error {
+			return runWrapped(ctx, caughtUp, wrapArgs)
+		})
+	}
+
+	if !conf.OnlyOnce {
+		eg.Go(func() error {
+			return handleReloads(ctx, syncers, startSyncer)
+		})
+		eg.Go(func() error {
+			return handlePauseSignals(ctx)
+		})
+		go systemd.Run(ctx, caughtUp)
+	}
+
 	logrus.Info("All syncers running")
-	return eg.Wait()
+	err = eg.Wait()
+	if errors.Is(err, context.Canceled) && shutdownRequested.Load() {
+		logrus.Info("Shutdown complete")
+		return nil
+	}
+	return err
 }
 
 var syncCmd = &cobra.Command{
-	Use:   "sync",
+	Use:   "sync [-- command [args...]]",
 	Short: "Continuous bidirectional syncing",
+	Long: `Continuous bidirectional syncing.
+
+If a command is given after '--', it is started as a child process once all
+LMDBs have loaded the remote snapshots that existed at startup. Lightning Stream
+exits when the child exits, and stops the child with a SIGTERM on shutdown.
+
+A SIGUSR1 pauses syncing in both directions, for example during bulk LMDB
+maintenance, and a SIGUSR2 resumes it. No snapshots are stored while paused,
+so that half-finished changes are not sent to other instances. The pause state
+is reported by /healthz, and the admin API can pause a single direction.
+
+With --verify-only, the remote snapshots are merged in transactions that are
+always aborted, and the keys whose merged state differs from the LMDB are
+reported per DBI. Nothing is written to the LMDB or the storage. The command
+exits with an error if there are differences, which can be used to validate a
+migration before cutting over.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := runSync(false); err != nil {
+		wrapArgs = args
+		mode := syncer.Options{DryRun: dryRun || verifyOnly, VerifyOnly: verifyOnly}
+		if err := runSync(mode); err != nil {
 			logrus.WithError(err).Fatal("Error")
 		}
 	},
@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringP("prefix", "p", "", "Only verify snapshots with this prefix")
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the integrity of all snapshots in storage",
+	Long: `Downloads and fully decodes every snapshot in storage, and verifies the
+checksums embedded in it. Snapshots written by older versions do not have
+checksums, these are only checked for decoding errors. If public keys are
+configured in storage.signing, the snapshot signatures are verified as well.
+
+The command exits with an error if any snapshot is corrupt.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(rootCtx)
+		defer cancel()
+
+		prefix, err := cmd.Flags().GetString("prefix")
+		if err != nil {
+			return err
+		}
+		st, err := getStorage(ctx)
+		if err != nil {
+			return err
+		}
+		dict, err := conf.Storage.Compression.LoadDictionary()
+		if err != nil {
+			return err
+		}
+		verifier, err := conf.Storage.Signing.LoadVerifier()
+		if err != nil {
+			return err
+		}
+
+		list, err := st.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		var nOK, nUnchecked, nCorrupt int
+		for _, blob := range list {
+			if _, err := snapshot.ParseName(blob.Name); err != nil {
+				continue // not a snapshot
+			}
+			data, err := st.Load(ctx, blob.Name)
+			if err != nil {
+				return err
+			}
+			result := "ok"
+			checked, err := snapshot.Verify(data, verifier, dict)
+			switch {
+			case err != nil:
+				result = fmt.Sprintf("CORRUPT: %v", err)
+				nCorrupt++
+			case !checked:
+				result = "ok (no checksums)"
+				nUnchecked++
+			default:
+				nOK++
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\n", blob.Name, result)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Printf("\n%d verified, %d without checksums, %d corrupt\n",
+			nOK, nUnchecked, nCorrupt)
+		if nCorrupt > 0 {
+			return fmt.Errorf("%d corrupt snapshots found", nCorrupt)
+		}
+		return nil
+	},
+}
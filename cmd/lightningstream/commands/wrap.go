@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// wrapArgs is the command to start once all syncers have caught up, as
+// passed after '--' on the sync command line.
+var wrapArgs []string
+
+// runWrapped waits until all syncers have loaded the remote snapshots that
+// existed at startup, and then starts the wrapped command. This guarantees
+// that a service like PowerDNS never serves stale data after a fresh deploy.
+// When the wrapped command exits, an error is returned to stop the syncers.
+// When the context is cancelled, the wrapped command receives a SIGTERM.
+func runWrapped(ctx context.Context, caughtUp []<-chan struct{}, args []string) error {
+	l := logrus.WithField("component", "wrap").WithField("command", args[0])
+	l.Info("Waiting for all syncers to catch up before starting wrapped command")
+	for _, ch := range caughtUp {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	l.Info("All syncers caught up, starting wrapped command")
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("wrapped command: %w", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Info("Stopping wrapped command")
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+	if ctx.Err() != nil {
+		l.WithError(err).Info("Wrapped command stopped")
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("wrapped command exited: %w", err)
+	}
+	return fmt.Errorf("wrapped command exited")
+}
@@ -4,10 +4,18 @@ import (
 	"powerdns.com/platform/lightningstream/cmd/lightningstream/commands"
 
 	// Register storage backends
-	_ "github.com/PowerDNS/simpleblob/backends/fs"
 	_ "github.com/PowerDNS/simpleblob/backends/memory"
 	_ "github.com/PowerDNS/simpleblob/backends/s3"
 
+	// Register storage backends provided by this repo
+	_ "powerdns.com/platform/lightningstream/backends/aws"
+	_ "powerdns.com/platform/lightningstream/backends/fs"
+	_ "powerdns.com/platform/lightningstream/backends/gcs"
+	_ "powerdns.com/platform/lightningstream/backends/plugin"
+	_ "powerdns.com/platform/lightningstream/backends/sftp"
+	_ "powerdns.com/platform/lightningstream/backends/swift"
+	_ "powerdns.com/platform/lightningstream/backends/webdav"
+
 	// Expose pprof in the webserver
 	_ "net/http/pprof"
 )
@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -14,8 +18,17 @@ import (
 
 	"powerdns.com/platform/lightningstream/config/logger"
 	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/sidecar"
+	"powerdns.com/platform/lightningstream/snapshot"
 	"powerdns.com/platform/lightningstream/status/healthtracker"
 	"powerdns.com/platform/lightningstream/status/starttracker"
+	"powerdns.com/platform/lightningstream/status/webhook"
+	"powerdns.com/platform/lightningstream/syncer/changefeed"
+	"powerdns.com/platform/lightningstream/syncer/pdns"
+	"powerdns.com/platform/lightningstream/syncer/peer"
+	"powerdns.com/platform/lightningstream/syncer/schema"
+	"powerdns.com/platform/lightningstream/syncer/storageevents"
+	"powerdns.com/platform/lightningstream/utils/cron"
 )
 
 const (
@@ -35,6 +48,26 @@ const (
 	// after failure.
 	DefaultStorageRetryInterval = 5 * time.Second
 
+	// DefaultStorageLoadRetryAttempts is the default number of attempts
+	// within a single snapshot download.
+	DefaultStorageLoadRetryAttempts = 3
+
+	// DefaultStorageLoadRetryBackoff is the default delay before the first
+	// retry of a snapshot download, which doubles for every next retry.
+	DefaultStorageLoadRetryBackoff = time.Second
+
+	// DefaultStorageLoadRetryJitter is the default random fraction added to
+	// or removed from retry delays.
+	DefaultStorageLoadRetryJitter = 0.2
+
+	// DefaultStorageLoadRetryBreakerThreshold is the default number of
+	// consecutive failed download attempts that opens the circuit breaker.
+	DefaultStorageLoadRetryBreakerThreshold = 10
+
+	// DefaultStorageLoadRetryBreakerCooldown is the default time the circuit
+	// breaker stays open.
+	DefaultStorageLoadRetryBreakerCooldown = time.Minute
+
 	// DefaultStorageRetryCount is the number of times to retry a storage operation
 	// after failure, before giving up.
 	DefaultStorageRetryCount = 100
@@ -50,6 +83,164 @@ const (
 	// DefaultMemoryDecompressedSnapshots is the number of decompressed snapshots
 	// we can keep in memory.
 	DefaultMemoryDecompressedSnapshots = 3
+
+	// DefaultMemorySnapshotChunkSize is the amount of uncompressed DBI data
+	// buffered at a time while writing a snapshot.
+	DefaultMemorySnapshotChunkSize = 16 * datasize.MB
+
+	// DefaultStorageHashTreeChunkSize is the default maximum amount of
+	// uncompressed DBI data in a chunk of the hash tree.
+	DefaultStorageHashTreeChunkSize = 1 * datasize.MB
+
+	// DefaultStartupDownloadWorkers is the default number of snapshots that
+	// are downloaded concurrently while catching up at startup.
+	DefaultStartupDownloadWorkers = 4
+
+	// DefaultSnapshotReadWorkers is the default number of DBIs that are read
+	// concurrently while writing a snapshot.
+	DefaultSnapshotReadWorkers = 1
+
+	// DefaultShutdownTimeout is the default time allowed to finish the
+	// current load and write a final snapshot on shutdown.
+	DefaultShutdownTimeout = 30 * time.Second
+
+	// DefaultLMDBLoadBatchSize is the amount of uncompressed snapshot data
+	// applied to the LMDB in a single write transaction.
+	DefaultLMDBLoadBatchSize = 256 * datasize.MB
+
+	// DefaultDeltaSnapshotsFullInterval is the default maximum time between
+	// full snapshots when delta snapshots are enabled.
+	DefaultDeltaSnapshotsFullInterval = time.Hour
+
+	// DefaultDeltaSnapshotsMaxDeltas is the default maximum number of delta
+	// snapshots between full snapshots.
+	DefaultDeltaSnapshotsMaxDeltas = 100
+
+	// DefaultDeltaSnapshotsMaxSizeRatio is the default delta to full snapshot
+	// size ratio that triggers a new full snapshot.
+	DefaultDeltaSnapshotsMaxSizeRatio = 0.5
+
+	// DefaultTombstoneGCInterval is the default interval between tombstone
+	// GC runs.
+	DefaultTombstoneGCInterval = time.Hour
+
+	// DefaultBulkLoadBatchSize is the default amount of uncompressed snapshot
+	// data applied in a single write transaction during a bulk load.
+	DefaultBulkLoadBatchSize = 1 * datasize.GB
+
+	// DefaultBulkLoadMinInstances is the default minimum number of instances
+	// with snapshots for a bulk load.
+	DefaultBulkLoadMinInstances = 2
+
+	// DefaultSnapshotTriggerChanges is the default number of LMDB write
+	// transactions that trigger a snapshot with snapshot_trigger.
+	DefaultSnapshotTriggerChanges = 100
+
+	// DefaultSnapshotTriggerMaxDelay is the default maximum time local
+	// changes wait for a snapshot with snapshot_trigger.
+	DefaultSnapshotTriggerMaxDelay = 30 * time.Second
+
+	// DefaultSnapshotTriggerMinInterval is the default minimum time between
+	// snapshots with snapshot_trigger.
+	DefaultSnapshotTriggerMinInterval = 5 * time.Second
+
+	// DefaultAutoCompactionInterval is the default interval between checks
+	// of the LMDB fragmentation for auto compaction.
+	DefaultAutoCompactionInterval = time.Hour
+
+	// DefaultAutoCompactionThreshold is the default fraction of free pages
+	// in the LMDB data file that triggers an auto compaction.
+	DefaultAutoCompactionThreshold = 0.5
+
+	// DefaultAutoCompactionMinFreeSize is the default minimum size of the
+	// free pages for an auto compaction.
+	DefaultAutoCompactionMinFreeSize = 128 * datasize.MB
+
+	// DefaultDedupMinBlockSize is the default size below which blocks are
+	// not deduplicated.
+	DefaultDedupMinBlockSize = 4 * datasize.KB
+
+	// DefaultDedupGCInterval is the default interval between scans for
+	// unreferenced deduplicated blocks.
+	DefaultDedupGCInterval = time.Hour
+
+	// DefaultTombstoneGCRetention is the default minimum age of deleted
+	// entries before they are purged.
+	DefaultTombstoneGCRetention = 7 * 24 * time.Hour
+
+	// DefaultBackupSchedule is the default cron schedule of full backups,
+	// daily at 03:00 UTC.
+	DefaultBackupSchedule = "0 3 * * *"
+
+	// DefaultBackupPrefix is the default prefix of the backup snapshot names
+	DefaultBackupPrefix = "backups/"
+
+	// DefaultBackupKeepLast is the default number of backups to keep
+	DefaultBackupKeepLast = 7
+
+	// DefaultCompactionInterval is the default interval between compaction runs
+	DefaultCompactionInterval = time.Hour
+
+	// DefaultCompactionStaleInterval is the default time since the last
+	// snapshot of an instance after which it is compacted.
+	DefaultCompactionStaleInterval = 30 * 24 * time.Hour
+
+	// DefaultCompactionInstance is the default instance name of the
+	// consolidated snapshots written by the compaction.
+	DefaultCompactionInstance = "compacted"
+
+	// DefaultLeaderElectionLeaseDuration is the default time a leader lease
+	// is valid without being renewed.
+	DefaultLeaderElectionLeaseDuration = time.Minute
+
+	// DefaultLeaderElectionSettleDelay is the default time between writing a
+	// lease and reading it back.
+	DefaultLeaderElectionSettleDelay = 2 * time.Second
+
+	// DefaultHeartbeatInterval is the default interval between heartbeats
+	DefaultHeartbeatInterval = time.Minute
+
+	// DefaultHeartbeatDeadAfter is the default age of the last heartbeat
+	// after which an instance is no longer considered alive.
+	DefaultHeartbeatDeadAfter = 5 * time.Minute
+
+	// DefaultFailoverFailureThreshold is the default number of consecutive
+	// failures of the primary storage backend before failing over
+	DefaultFailoverFailureThreshold = 3
+
+	// DefaultFailoverProbeInterval is the default interval between health
+	// probes of the primary storage backend
+	DefaultFailoverProbeInterval = 10 * time.Second
+
+	// DefaultFailoverFailbackAfter is the default number of consecutive
+	// successful probes of the primary before failing back
+	DefaultFailoverFailbackAfter = 6
+
+	// DefaultHeartbeatRemoveAfter is the default age of the last heartbeat
+	// after which the heartbeat of an instance is removed.
+	DefaultHeartbeatRemoveAfter = 7 * 24 * time.Hour
+
+	// DefaultConvergenceInterval is the default interval between
+	// convergence checks
+	DefaultConvergenceInterval = 5 * time.Minute
+
+	// DefaultConvergenceWindow is the default time the instances may have
+	// different data before a DBI is considered not converged.
+	DefaultConvergenceWindow = 30 * time.Minute
+
+	// DefaultConvergenceStaleAfter is the default age of the last digest of
+	// an instance after which it is ignored.
+	DefaultConvergenceStaleAfter = 15 * time.Minute
+
+	// DefaultHybridClockMaxSkew is the default maximum time a remote snapshot
+	// timestamp can be ahead of the local clock before we warn about it.
+	DefaultHybridClockMaxSkew = time.Minute
+
+	// DefaultTracingEndpoint is the default OTLP/HTTP collector endpoint
+	DefaultTracingEndpoint = "localhost:4318"
+
+	// DefaultTracingServiceName is the default service name reported in traces
+	DefaultTracingServiceName = "lightningstream"
 )
 
 var (
@@ -97,17 +288,48 @@ var (
 		// ReportHealthz controls whether or not healthz's 'startup_[db name]' metadata field will be used to store the status of the startup sequence for each db
 		// This can be used to prevent unwanted activity before Lightning Stream has completed an initial sync
 		ReportMetadata: true,
+		// CatchUpBarrier makes healthz fail right away until the initial sync has completed
+		CatchUpBarrier: false,
+	}
+
+	// DefaultHealthSnapshotAge is the default for the check on the age of the newest applied remote snapshot
+	DefaultHealthSnapshotAge = HealthSnapshotAge{
+		// EvaluationInterval is the interval between healthz evaluation of the snapshot age
+		EvaluationInterval: 5 * time.Second,
+		// WarnAge and ErrorAge are disabled by default, because the acceptable
+		// age depends on how often other instances write snapshots.
 	}
 )
 
 // Config is the config root object
 type Config struct {
-	Instance string          `yaml:"instance"`
-	LMDBs    map[string]LMDB `yaml:"lmdbs"`
-	Storage  Storage         `yaml:"storage"`
-	HTTP     HTTP            `yaml:"http"`
-	Log      logger.Config   `yaml:"log"`
-	Health   Health          `yaml:"health"`
+	Instance string           `yaml:"instance"`
+	LMDBs    map[string]LMDB  `yaml:"lmdbs"`
+	Storage  Storage          `yaml:"storage"`
+	HTTP     HTTP             `yaml:"http"`
+	Log      logger.Config    `yaml:"log"`
+	Health   Health           `yaml:"health"`
+	Tracing  Tracing          `yaml:"tracing"`
+	Webhooks []webhook.Config `yaml:"webhooks"`
+	Sidecar  sidecar.Config   `yaml:"sidecar"`
+
+	// Peer streams stored snapshots directly to other instances, for
+	// sub-second replication latencies. The storage remains the source of
+	// truth and the fallback when peers are not connected.
+	Peer peer.Config `yaml:"peer"`
+
+	// ChangeFeed publishes every local change to NATS or Kafka, for
+	// downstream systems that consume a real-time feed of the data changes.
+	ChangeFeed changefeed.Config `yaml:"change_feed"`
+
+	// ChangeImport applies changes made by external systems, received from
+	// NATS, Kafka or HTTP, to the local LMDBs.
+	ChangeImport changefeed.ImportConfig `yaml:"change_import"`
+
+	// PDNS integrates with the PowerDNS Authoritative server that serves the
+	// LMDBs, to flush its caches and notify secondaries for the zones changed
+	// by remote snapshots.
+	PDNS pdns.Config `yaml:"pdns"`
 
 	// LMDBPollInterval is the minimum time between checking for new LMDB
 	// transactions. The check itself is fast, but this also serves to rate limit
@@ -136,11 +358,45 @@ type Config struct {
 	// If set, StorageRetryCount will be ignored, and we retry forever
 	StorageRetryForever bool `yaml:"storage_retry_forever"`
 
+	// StorageLoadRetry configures the retries within a snapshot download.
+	StorageLoadRetry StorageLoadRetry `yaml:"storage_load_retry"`
+
 	// StorageForceSnapshotInterval sets the interval to force a snapshot write
 	// even if no LMDB changes were detected, to make sure we occasionally write
 	// a fresh snapshot.
 	StorageForceSnapshotInterval time.Duration `yaml:"storage_force_snapshot_interval"`
 
+	// StorageSkipUnchangedSnapshots skips storing a snapshot when its data is
+	// identical to the last snapshot stored, which happens when an LMDB
+	// transaction did not change any synced data, for example in an excluded
+	// DBI. Snapshots forced by storage_force_snapshot_interval are always
+	// stored.
+	StorageSkipUnchangedSnapshots bool `yaml:"storage_skip_unchanged_snapshots"`
+
+	// SnapshotTrigger configures when snapshots of local changes are written.
+	SnapshotTrigger SnapshotTrigger `yaml:"snapshot_trigger"`
+
+	// StorageVerifyChecksums enables verification of the snapshot checksums
+	// right after a download, before any of its data is merged. Snapshots
+	// that fail verification are ignored as corrupt.
+	StorageVerifyChecksums bool `yaml:"storage_verify_checksums"`
+
+	// StoragePartialDownloads enables downloading only the DBIs of a framed
+	// snapshot that changed since the last snapshot of the same instance
+	// that was loaded, using ranged loads. Other snapshots, and all snapshots
+	// when the storage backend does not support ranged loads or encryption
+	// is enabled, are downloaded in full.
+	StoragePartialDownloads bool `yaml:"storage_partial_downloads"`
+
+	// StorageHashTree includes a checksum of every chunk of a DBI in framed
+	// snapshots, with the DBIs split into key ranges of at most
+	// StorageHashTreeChunkSize at keys selected by their hash, so that
+	// unchanged key ranges keep the same checksum. With
+	// StoragePartialDownloads, receivers then only download the chunks that
+	// changed of a DBI that changed.
+	StorageHashTree          bool              `yaml:"storage_hash_tree"`
+	StorageHashTreeChunkSize datasize.ByteSize `yaml:"storage_hash_tree_chunk_size"`
+
 	// MemoryDownloadedSnapshots defines how many downloaded compressed snapshots
 	// we are allowed to keep in memory for each database (minimum: 1, default: 3).
 	// Setting this higher allows us to keep downloading snapshots for different
@@ -150,16 +406,118 @@ type Config struct {
 	// Increasing this can speed up processing at the cost of memory.
 	MemoryDownloadedSnapshots int `yaml:"memory_downloaded_snapshots"`
 
-	// MemoryDecompressedSnapshots defines how many decompressed snapshots
-	// we are allowed to keep in memory for each database (minimum: 1, default: 2).
-	// Keep in mind that decompressed snapshots are typically 3-10x larger than
-	// the downloaded compressed snapshots.
+	// MemoryDecompressedSnapshots defines how many downloaded snapshots
+	// we are allowed to keep in memory for each database while they wait to
+	// be loaded (minimum: 1, default: 2).
+	// Snapshots are only decompressed while they are being loaded.
 	// Increasing this can speed up processing at the cost of memory.
 	MemoryDecompressedSnapshots int `yaml:"memory_decompressed_snapshots"`
 
+	// MemoryBudget limits the total size of the compressed snapshot data
+	// that all syncers hold in memory (default: 0, no limit). Downloads wait
+	// while the budget is used up, and downloaded snapshots that are waiting
+	// to be loaded are spilled to a temporary file in MemorySpillDir when
+	// other downloads are waiting. A snapshot larger than the budget is only
+	// downloaded when nothing else is held in memory.
+	MemoryBudget datasize.ByteSize `yaml:"memory_budget"`
+
+	// MemorySpillDir is the directory for spilled snapshots (default: the
+	// system temporary directory)
+	MemorySpillDir string `yaml:"memory_spill_dir"`
+
+	// MemoryStagingThreshold is the compressed size from which a snapshot is
+	// decompressed to a temporary staging file in MemorySpillDir before it
+	// is merged, instead of decompressing its DBIs into memory (default: 0,
+	// never). The staging file needs as much disk space as the uncompressed
+	// snapshot.
+	MemoryStagingThreshold datasize.ByteSize `yaml:"memory_staging_threshold"`
+
+	// StartupDownloadWorkers is the number of snapshots that are downloaded
+	// and verified concurrently while catching up at startup (default: 4).
+	// Once all snapshots that existed at startup have been loaded,
+	// MemoryDownloadedSnapshots applies. Every worker can hold a downloaded
+	// compressed snapshot in memory.
+	StartupDownloadWorkers int `yaml:"startup_download_workers"`
+
+	// MemorySnapshotChunkSize is the amount of uncompressed DBI data that is
+	// buffered at a time while writing a snapshot (default: 16MB). DBI entries
+	// are directly compressed in chunks of this size, instead of first reading
+	// the whole DBI into memory.
+	MemorySnapshotChunkSize datasize.ByteSize `yaml:"memory_snapshot_chunk_size"`
+
+	// SnapshotReadWorkers is the number of DBIs that are read concurrently
+	// while writing a snapshot, each in its own read transaction (default: 1).
+	// This is only supported for LMDBs with schema_tracks_changes enabled.
+	// DBIs read ahead of the one being compressed are held in memory.
+	SnapshotReadWorkers int `yaml:"snapshot_read_workers"`
+
+	// LMDBLoadBatchSize is the amount of uncompressed snapshot data that is
+	// applied to the LMDB in a single write transaction (default: 256MB).
+	// Larger snapshots are applied in multiple transactions. Without
+	// schema_tracks_changes, every transaction also updates the main DBIs
+	// from the shadow DBIs it changed, unless LMDBLoadStaging is enabled.
+	// Set to 0 to always apply a snapshot in a single transaction.
+	LMDBLoadBatchSize datasize.ByteSize `yaml:"lmdb_load_batch_size"`
+
+	// LMDBLoadBatchEntries limits the number of snapshot entries that are
+	// applied to the LMDB in a single write transaction, in addition to
+	// the LMDBLoadBatchSize (default: 0, no limit). A lower number shortens
+	// the time the write lock is held by a single transaction. The entries
+	// of a single key are never split over transactions.
+	LMDBLoadBatchEntries int `yaml:"lmdb_load_batch_entries"`
+
+	// LMDBLoadStaging stages snapshots that are applied in multiple
+	// transactions in the private _sync_staging DBI. Only the entries that
+	// differ from the local ones are staged, and the last transaction merges
+	// them, so that the application sees the snapshot applied at once, and
+	// that transaction holds the write lock for a time that depends on the
+	// number of changed entries instead of the size of the snapshot.
+	// Snapshots that fit in a single batch are merged in one transaction.
+	// Not used during a bulk load.
+	LMDBLoadStaging bool `yaml:"lmdb_load_staging"`
+
+	// LMDBPersistSyncState records the last snapshot applied from every
+	// instance in the _sync_state DBI of the LMDB, so that snapshots that
+	// were already applied are not downloaded and merged again after a
+	// restart. This shortens the startup with many instances or large
+	// snapshots.
+	LMDBPersistSyncState bool `yaml:"lmdb_persist_sync_state"`
+
 	// LMDBScrapeSmaps enabled the scraping of /proc/smaps for LMDB stats
 	LMDBScrapeSmaps bool `yaml:"lmdb_scrape_smaps"`
 
+	// LMDBBulkLoad configures the initial bulk load of an empty LMDB
+	LMDBBulkLoad BulkLoad `yaml:"lmdb_bulk_load"`
+
+	// LMDBDurability configures the fsync of the LMDB per sync phase
+	LMDBDurability Durability `yaml:"lmdb_durability"`
+
+	// LMDBAutoCompaction configures the compaction of fragmented LMDBs
+	LMDBAutoCompaction AutoCompaction `yaml:"lmdb_auto_compaction"`
+
+	// TombstoneGC configures the periodic removal of old deleted entries.
+	TombstoneGC TombstoneGC `yaml:"tombstone_gc"`
+
+	// HybridClock configures the timestamps used for local changes.
+	HybridClock HybridClock `yaml:"hybrid_clock"`
+
+	// Backup configures scheduled full backups to a separate prefix.
+	Backup Backup `yaml:"backup"`
+
+	// SplitBrainAction is what to do when multiple processes use the same
+	// instance name at the same time: "warn" (default) or "refuse" to load
+	// the snapshots with that instance name until this is resolved.
+	SplitBrainAction string `yaml:"split_brain_action"`
+
+	// ConflictLog is the path of an append-only file with a JSON line for
+	// every remote entry that differed from the local entry (default: none).
+	ConflictLog string `yaml:"conflict_log"`
+
+	// ShutdownTimeout is the time allowed on SIGTERM or SIGINT to finish the
+	// snapshot load in progress, and to write a final snapshot of any local
+	// changes that were not written yet. Set to 0 to exit immediately.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
 	// OnlyOnce requests the program to exit ofter once batch has been completed,
 	// e.g. after the initial listing of snapshots have been loaded.
 	OnlyOnce bool `yaml:"only_once"`
@@ -174,9 +532,42 @@ type LMDB struct {
 	Path    string          `yaml:"path"` // Path to directory holding data.mdb, or mdb file if NoSubdir
 	Options lmdbenv.Options `yaml:"options"`
 
+	// StoragePrefix is prepended to the names of all snapshots of this LMDB
+	// in the storage backend, e.g. "dnssec/". This allows LMDBs synced by
+	// the same process to use separate locations in a shared bucket. The fs
+	// backend stores names with a "/" in subdirectories.
+	StoragePrefix string `yaml:"storage_prefix"`
+
+	// ReceiveOnly makes this LMDB a read replica: remote snapshots are loaded,
+	// but local changes are never written to the storage backend, and the
+	// cleaner is disabled. This is the same as running the 'receive' command,
+	// but for a single LMDB.
+	ReceiveOnly bool `yaml:"receive_only"`
+
+	// SendOnly makes this LMDB a one-way export: snapshots of local changes
+	// are written, but remote snapshots are never loaded into it. This is
+	// the same as running the 'send' command, but for a single LMDB.
+	SendOnly bool `yaml:"send_only"`
+
+	// PostApplyCommand is a command and arguments to run after a remote
+	// snapshot with changes was merged into this LMDB, e.g. to tell the
+	// application to reload. The changed DBIs are passed in environment
+	// variables. PostApplyTimeout limits the time the command can take.
+	PostApplyCommand []string      `yaml:"post_apply_command"`
+	PostApplyTimeout time.Duration `yaml:"post_apply_timeout"`
+
 	// Per-DBI options
 	DBIOptions map[string]DBIOptions `yaml:"dbi_options"`
 
+	// IncludeDBIs are glob patterns of DBI names to sync, using the syntax of
+	// path.Match. When empty, all DBIs are synced.
+	IncludeDBIs []string `yaml:"include_dbis"`
+
+	// ExcludeDBIs are glob patterns of DBI names that must not be synced,
+	// even when they match IncludeDBIs. Excluded DBIs are not included in
+	// snapshots, ignored in remote snapshots and never get a shadow DBI.
+	ExcludeDBIs []string `yaml:"exclude_dbis"`
+
 	// Both important and dangerous: set to true if the LMDB schema already tracks
 	// changes in the exact way that this tool expects. This includes:
 	// - Every value is prefixed with an 24+ byte LS header.
@@ -186,17 +577,49 @@ type LMDB struct {
 	// that THIS MUST BE SUPPORTED IN THE LMDB SCHEMA THE APPLICATION USES!
 	SchemaTracksChanges bool `yaml:"schema_tracks_changes"`
 
+	// StartupCheckEntries is the number of entries per DBI that are checked
+	// for a plausible header when the LMDB is opened with SchemaTracksChanges
+	// enabled (default: 1000). The sync does not start if any are invalid,
+	// because it would produce garbage snapshots. Set to -1 to disable.
+	StartupCheckEntries int `yaml:"startup_check_entries"`
+
 	// Enables hacky support for DupSort DBs, with limitations.
 	// This will be applied to all dbs marked as DupSort.
 	// Not compatible with schema_tracks_changes=true
 	DupSortHack bool `yaml:"dupsort_hack"`
 
+	// DupSortNative enables support for DupSort DBIs without rewriting keys.
+	// Every value is synced separately with its own timestamp, and snapshots
+	// contain the original keys and values. Values are limited to 485 bytes.
+	// Not compatible with schema_tracks_changes=true or dupsort_hack=true.
+	DupSortNative bool `yaml:"dupsort_native"`
+
 	// HeaderExtraPaddingBlock adds an extra 8 all-zero bytes to the LS header
 	// to make it 32 bytes. This is useful to test an application's handling of
 	// the numExtra header field. This does not apply to shadow tables.
 	HeaderExtraPaddingBlock bool `yaml:"header_extra_padding_block"`
 }
 
+// IsDBIIncluded returns true if the DBI with given name must be synced
+// according to IncludeDBIs and ExcludeDBIs.
+// Invalid patterns never match, these are rejected by Config.Check.
+func (l LMDB) IsDBIIncluded(name string) bool {
+	for _, pattern := range l.ExcludeDBIs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(l.IncludeDBIs) == 0 {
+		return true
+	}
+	for _, pattern := range l.IncludeDBIs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 type DBIOptions struct {
 	// OverrideCreateFlags can override DBI create flags when loading a
 	// snapshot and the DBI does not create yet.
@@ -206,15 +629,137 @@ type DBIOptions struct {
 	//
 	// ONLY USE THIS WHEN YOU ARE SURE YOU NEED IT!
 	OverrideCreateFlags *dbiflags.Flags `yaml:"override_create_flags"`
+
+	// ConflictResolution configures how conflicting entries from remote
+	// snapshots are merged. By default, the newest entry wins.
+	ConflictResolution ConflictResolution `yaml:"conflict_resolution"`
+
+	// Encoding declares how the application encodes the values of the DBI:
+	// "raw" for plain values, "header" for values that start with the
+	// Lightning Stream header, or "pdns" for the header encoding as written
+	// by PowerDNS Auth 4.8+. By default, this follows schema_tracks_changes.
+	// All DBIs of an LMDB must use the same kind of encoding.
+	Encoding string `yaml:"encoding"`
+
+	// Hook is the name of a value transformation hook registered by the Go
+	// program, see the syncer/schema package. It is not supported for
+	// DupSort DBIs.
+	Hook string `yaml:"hook"`
+
+	// Redact replaces or drops the values of sensitive entries in generated
+	// snapshots and backups, so that they are never uploaded. The first
+	// matching rule applies. It is not supported for DupSort DBIs.
+	Redact []RedactRule `yaml:"redact"`
+}
+
+// RedactRule selects entries by key and replaces or drops their values, see
+// the syncer/redact package. An entry matches if its key starts with
+// KeyPrefix and matches KeyRegex, if these are set.
+type RedactRule struct {
+	KeyPrefix string `yaml:"key_prefix"`
+	KeyRegex  string `yaml:"key_regex"`
+
+	// Action is "replace" (default) to replace the value with Replacement,
+	// or "drop" to leave the entry out of the snapshot.
+	Action string `yaml:"action"`
+
+	// ValueRegex limits "replace" to the parts of the value that match,
+	// which can be referenced in the Replacement as $1 or ${name}
+	ValueRegex  string `yaml:"value_regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Check validates the rule
+func (r RedactRule) Check() error {
+	if r.KeyPrefix == "" && r.KeyRegex == "" {
+		return fmt.Errorf("key_prefix or key_regex is required")
+	}
+	switch r.Action {
+	case "", "replace":
+	case "drop":
+		if r.ValueRegex != "" || r.Replacement != "" {
+			return fmt.Errorf("value_regex and replacement cannot be used with the drop action")
+		}
+	default:
+		return fmt.Errorf("action: unknown action %q (available: replace, drop)", r.Action)
+	}
+	if _, err := regexp.Compile(r.KeyRegex); err != nil {
+		return fmt.Errorf("key_regex: %w", err)
+	}
+	if _, err := regexp.Compile(r.ValueRegex); err != nil {
+		return fmt.Errorf("value_regex: %w", err)
+	}
+	return nil
+}
+
+// ConflictResolution configures the conflict resolution strategy of a DBI.
+// This is not supported for DupSort DBIs.
+type ConflictResolution struct {
+	// Strategy is one of "last_writer_wins" (default), "prefer_instance",
+	// "highest_version" or "exec".
+	Strategy string `yaml:"strategy"`
+
+	// PreferInstances are the instances whose entries always win over local
+	// entries, for "prefer_instance".
+	PreferInstances []string `yaml:"prefer_instances"`
+
+	// VersionOffset and VersionSize locate a big endian unsigned version
+	// number in the value, for "highest_version".
+	VersionOffset int `yaml:"version_offset"`
+	VersionSize   int `yaml:"version_size"`
+
+	// Command is the command and arguments to run for every conflict, for
+	// "exec". Timeout limits the time a single call can take.
+	Command []string      `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
 }
 
 type Storage struct {
 	Type    string                 `yaml:"type"`    // "fs", "s3", "memory"
 	Options map[string]interface{} `yaml:"options"` // backend specific
 
+	// Layout is an optional template for the object keys of snapshots, see
+	// the layout package. Empty means the flat default layout.
+	Layout string `yaml:"layout"`
+
 	// FIXME: Configure per LMDB instead, since we run a cleaner per LMDB?
 	Cleanup Cleanup `yaml:"cleanup"`
 
+	Compaction Compaction `yaml:"compaction"`
+
+	LeaderElection LeaderElection `yaml:"leader_election"`
+
+	// InstanceLease configures a lease per LMDB on the instance name, which
+	// a process must hold to sync, so that two processes cannot run with the
+	// same instance name.
+	InstanceLease LeaderElection `yaml:"instance_lease"`
+
+	Heartbeat Heartbeat `yaml:"heartbeat"`
+
+	Convergence Convergence `yaml:"convergence"`
+
+	DeltaSnapshots DeltaSnapshots `yaml:"delta_snapshots"`
+
+	Compression Compression `yaml:"compression"`
+
+	Encryption Encryption `yaml:"encryption"`
+
+	Signing Signing `yaml:"signing"`
+
+	Throttle Throttle `yaml:"throttle"`
+
+	// Dedup stores the DBI blocks of framed snapshots in a shared
+	// content-addressed area of the bucket, see Dedup.
+	Dedup Dedup `yaml:"dedup"`
+
+	Failover Failover `yaml:"failover"`
+
+	Replication Replication `yaml:"replication"`
+
+	// Events configures storage change notifications, which pick up new
+	// snapshots right away instead of after the next storage poll.
+	Events storageevents.Config `yaml:"events"`
+
 	RootPath string `yaml:"root_path,omitempty"` // Deprecated: use options.root_path for fs
 }
 
@@ -242,11 +787,600 @@ type Cleanup struct {
 	// loaded and merged that snapshot, and written its own snapshot with this
 	// data, to ensure that this is also safe after extended downtime.
 	RemoveOldInstancesInterval time.Duration `yaml:"remove_old_instances_interval"`
+
+	// KeepLast is the number of most recent snapshots to keep for every
+	// instance, in addition to the ones protected by MustKeepInterval.
+	// The newest snapshot of an instance is always kept, so values below 1
+	// have the same effect as 1.
+	KeepLast int `yaml:"keep_last"`
+
+	// KeepInterval keeps all snapshots with a snapshot time within this
+	// interval, regardless of KeepLast. This allows restoring the data of
+	// any point in this interval. Zero disables this.
+	KeepInterval time.Duration `yaml:"keep_interval"`
+}
+
+// Compaction configures the merging of the snapshots of instances that have
+// disappeared. The last snapshot of such an instance would otherwise remain
+// in the storage forever, unless an instance with cleanup enabled has proven
+// that it merged it. The compaction merges the snapshots of all stale
+// instances into a single consolidated snapshot under its own instance name,
+// and then removes the stale snapshots.
+type Compaction struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Interval determines how often we check for stale instances.
+	Interval time.Duration `yaml:"interval"`
+
+	// StaleInterval is the time since the last snapshot of an instance after
+	// which the instance is considered gone and its snapshots are compacted.
+	// If an instance comes back after this, it simply loads the
+	// consolidated snapshot.
+	StaleInterval time.Duration `yaml:"stale_interval"`
+
+	// Instance is the instance name used for the consolidated snapshots.
+	// It must not be used by any real instance.
+	Instance string `yaml:"instance"`
+}
+
+// LeaderElection configures a lease in the storage backend that elects a
+// single instance per LMDB to run the cleanup and compaction. Without it,
+// every instance that has these enabled runs them.
+// The lease uses conditional writes with the aws and gcs storage backends.
+// With other backends, or with replication or failover enabled, it is
+// best-effort and relies on the SettleDelay.
+type LeaderElection struct {
+	Enabled bool `yaml:"enabled"`
+
+	// LeaseDuration is how long a lease stays valid without being renewed.
+	// The leader renews it after a third of this time. The clocks of all
+	// instances must be within a fraction of this of each other.
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+
+	// SettleDelay is the time between writing the lease and reading it back
+	// to check that no other instance took it at the same time, if the
+	// storage backend does not support conditional writes. It must be
+	// longer than the time it takes the storage backend to store it.
+	SettleDelay time.Duration `yaml:"settle_delay"`
+}
+
+// Heartbeat configures the heartbeat objects that every instance writes to
+// the storage backend, so that the status of all instances can be shown.
+type Heartbeat struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Interval determines how often the heartbeat is written and the
+	// heartbeats of the other instances are loaded.
+	// The actual interval is subject to intentional perturbation.
+	Interval time.Duration `yaml:"interval"`
+
+	// DeadAfter is the age of the last heartbeat of an instance after which
+	// it is no longer considered alive.
+	DeadAfter time.Duration `yaml:"dead_after"`
+
+	// RemoveAfter is the age of the last heartbeat of an instance after
+	// which its heartbeat is removed. Zero disables this.
+	RemoveAfter time.Duration `yaml:"remove_after"`
+}
+
+// Convergence configures the periodic check that all instances end up with
+// the same data. Every instance writes a digest object per LMDB with a
+// content hash of every synced DBI to the storage backend, and compares the
+// digests of all instances.
+type Convergence struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Interval determines how often the digest is written and the digests
+	// of the other instances are compared.
+	// The actual interval is subject to intentional perturbation.
+	Interval time.Duration `yaml:"interval"`
+
+	// Window is the time the instances may have different data for a DBI,
+	// for example while snapshots propagate, before the DBI is reported as
+	// not converged.
+	Window time.Duration `yaml:"window"`
+
+	// StaleAfter is the age of the last digest of an instance after which
+	// it is no longer compared.
+	StaleAfter time.Duration `yaml:"stale_after"`
+
+	// RemoveAfter is the age of the last digest of an instance after which
+	// its digest is removed. Zero disables this.
+	RemoveAfter time.Duration `yaml:"remove_after"`
+
+	// ExcludeDBIs are glob patterns of DBI names that are not compared,
+	// like DBIs that are intentionally different per instance.
+	ExcludeDBIs []string `yaml:"exclude_dbis"`
+}
+
+// IsDBIIncluded returns true if the DBI with the given name is compared
+func (c Convergence) IsDBIIncluded(name string) bool {
+	for _, pattern := range c.ExcludeDBIs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Failover configures a secondary storage backend, for example a MinIO
+// instance on another site, that is used while the primary one fails. The
+// primary is probed with a listing at a regular interval. After a number of
+// consecutive failed operations or probes, all operations go to the
+// secondary, until the primary is healthy again.
+//
+// Both backends must contain the same snapshots, for example through bucket
+// replication, otherwise instances only see the snapshots stored on the
+// backend they currently use.
+type Failover struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Type and Options configure the secondary backend, like the main
+	// storage type and options.
+	Type    string                 `yaml:"type"`
+	Options map[string]interface{} `yaml:"options"`
+
+	// FailureThreshold is the number of consecutive failed operations or
+	// probes of the primary after which we fail over. We only fail over if
+	// a probe of the secondary succeeds.
+	FailureThreshold int `yaml:"failure_threshold"`
+
+	// ProbeInterval is the time between health probes of the primary.
+	ProbeInterval time.Duration `yaml:"probe_interval"`
+
+	// FailbackAfter is the number of consecutive successful probes of the
+	// primary after which we fail back.
+	FailbackAfter int `yaml:"failback_after"`
+
+	// Encryption configures the encryption of the secondary backend, if it
+	// differs from storage.encryption.
+	Encryption Encryption `yaml:"encryption"`
+}
+
+// Replication configures additional storage backends that every blob is
+// stored in as well, for example buckets in other regions for disaster
+// recovery. Blobs are only listed and loaded from the main storage backend,
+// and deleted from all backends.
+type Replication struct {
+	Replicas []Replica `yaml:"replicas"`
+
+	// Quorum is the number of backends, including the main storage backend,
+	// that must store a blob for the store to succeed. The main backend must
+	// always succeed. Zero means all backends.
+	Quorum int `yaml:"quorum"`
+}
+
+// ReplicaName returns the name of the replica with index i
+func (r Replication) ReplicaName(i int) string {
+	if name := r.Replicas[i].Name; name != "" {
+		return name
+	}
+	return fmt.Sprintf("replica-%d", i+1)
+}
+
+// Replica configures a replica storage backend
+type Replica struct {
+	// Name identifies the replica in logs and metrics, "replica-N" if empty
+	Name    string                 `yaml:"name"`
+	Type    string                 `yaml:"type"`
+	Options map[string]interface{} `yaml:"options"`
+
+	// Encryption configures the encryption of this replica, if it differs
+	// from storage.encryption.
+	Encryption Encryption `yaml:"encryption"`
+}
+
+// AutoCompaction configures the online compaction of the LMDBs. LMDB never
+// returns free pages to the filesystem, so after large deletions the data
+// file can stay much larger than needed. When the free pages exceed both the
+// Threshold and MinFreeSize, the syncer replaces the data file with a
+// compacted copy and reopens the LMDB.
+//
+// This MUST only be enabled when no other process opens the LMDBs, because
+// these would keep using the old data file. The compaction is skipped if the
+// LMDB reader lock table has entries of other processes, but processes that
+// have not started a read transaction yet cannot be detected.
+type AutoCompaction struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Interval determines how often the fragmentation is checked.
+	Interval time.Duration `yaml:"interval"`
+
+	// Threshold is the fraction (0-1) of the pages in the data file that
+	// must be free.
+	Threshold float64 `yaml:"threshold"`
+
+	// MinFreeSize is the size the free pages must at least have, to avoid
+	// compacting small LMDBs.
+	MinFreeSize datasize.ByteSize `yaml:"min_free_size"`
+}
+
+// SnapshotTrigger configures when a snapshot of local changes is written.
+// By default, a snapshot is written as soon as a new LMDB transaction is
+// detected, which can mean one snapshot every lmdb_poll_interval on busy
+// instances. When enabled, local changes are collected until either Changes
+// write transactions happened or the oldest change waited for MaxDelay,
+// whichever comes first, but snapshots are never written more often than
+// MinInterval.
+type SnapshotTrigger struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Changes is the number of LMDB write transactions since the last
+	// snapshot that trigger a snapshot right away. 0 to only use MaxDelay.
+	Changes uint64 `yaml:"changes"`
+
+	// MaxDelay is the maximum time a local change waits for a snapshot.
+	MaxDelay time.Duration `yaml:"max_delay"`
+
+	// MinInterval is the minimum time between two snapshots.
+	MinInterval time.Duration `yaml:"min_interval"`
+}
+
+// BulkLoad configures the initial bulk load of an LMDB that is empty at
+// startup, for example a new instance bootstrapped from a bucket with the
+// snapshots of many instances. The full snapshots are loaded before any
+// delta snapshots, in larger write transactions that are not fsynced one by
+// one (see Durability), and the LMDB is synced once when all of them are
+// loaded. Only then the normal sync loop starts sending and receiving.
+type BulkLoad struct {
+	Enabled bool `yaml:"enabled"`
+
+	// MinInstances is the number of instances that must have snapshots to
+	// load for a bulk load.
+	MinInstances int `yaml:"min_instances"`
+
+	// BatchSize replaces the lmdb_load_batch_size during the bulk load, and
+	// the lmdb_load_batch_entries limit does not apply.
+	BatchSize datasize.ByteSize `yaml:"batch_size"`
+
+	// DownloadRate limits the download rate of the bulk load in bytes per
+	// second, in addition to storage.throttle.download_rate (default: 0,
+	// no limit).
+	DownloadRate datasize.ByteSize `yaml:"download_rate"`
+}
+
+// Durability levels of the LMDB write transactions
+const (
+	// DurabilityFull fsyncs every transaction (the LMDB default)
+	DurabilityFull = "full"
+	// DurabilityNoMetaSync does not fsync the meta page (MDB_NOMETASYNC).
+	// A system crash can undo the last transactions, but the LMDB remains
+	// consistent.
+	DurabilityNoMetaSync = "no_meta_sync"
+	// DurabilityNoSync does not fsync at all (MDB_NOSYNC). A system crash
+	// can corrupt the LMDB.
+	DurabilityNoSync = "no_sync"
+)
+
+// Durability configures the fsync of the write transactions of Lightning
+// Stream per phase of the sync. Once all snapshots that existed at startup
+// are loaded, the LMDB is synced and the flags set for these phases are
+// removed again. Flags the LMDB was opened with are kept.
+type Durability struct {
+	// BulkLoad applies during the bulk load of an empty LMDB (default:
+	// no_meta_sync). An LMDB corrupted by a system crash during the bulk
+	// load can be removed and bulk loaded again.
+	BulkLoad string `yaml:"bulk_load"`
+
+	// Startup applies while loading the snapshots that existed at startup
+	// into an LMDB that is not empty (default: full).
+	Startup string `yaml:"startup"`
+}
+
+// checkDurability checks a durability level
+func checkDurability(name, level string) error {
+	switch level {
+	case DurabilityFull, DurabilityNoMetaSync, DurabilityNoSync:
+		return nil
+	}
+	return fmt.Errorf("%s: must be %s, %s or %s", name,
+		DurabilityFull, DurabilityNoMetaSync, DurabilityNoSync)
+}
+
+// Split-brain actions, see Config.SplitBrainAction
+const (
+	SplitBrainWarn   = "warn"
+	SplitBrainRefuse = "refuse"
+)
+
+// TombstoneGC configures the removal of deleted entries (tombstones) from the
+// shadow DBIs, or from the main DBIs if the schema tracks changes. Deleted
+// entries are kept to propagate deletions to other instances, but without this
+// they are kept forever.
+type TombstoneGC struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Interval determines how often the GC runs.
+	Interval time.Duration `yaml:"interval"`
+
+	// Retention is the minimum age of a deleted entry before it is purged.
+	// Additionally, the last snapshot loaded from every other instance must
+	// show that it has merged a snapshot newer than the deleted entry from
+	// every instance. Snapshots of older versions do not record this, so the
+	// GC waits until every instance runs a version that does. This must be
+	// long enough for all instances to have loaded a snapshot with the
+	// deletion, including instances that are down for maintenance.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// Backup configures scheduled full backups. A backup is a full snapshot of
+// the local LMDB, which contains the merged data of all instances, stored
+// under a separate prefix. Backups are never loaded by the syncers and are
+// not removed by the storage cleanup, but only by their own retention rules.
+type Backup struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Schedule is a cron schedule in UTC with five fields (minute, hour,
+	// day of month, month, day of week), or one of @hourly, @daily, @weekly
+	// and @monthly.
+	Schedule string `yaml:"schedule"`
+
+	// Prefix is prepended to the snapshot names of backups. It is added after
+	// the storage_prefix of the LMDB.
+	Prefix string `yaml:"prefix"`
+
+	// KeepLast is the number of most recent backups of this instance to keep
+	// for every LMDB. KeepInterval additionally keeps all backups with a
+	// snapshot time within this interval. If both are zero, backups are never
+	// removed.
+	KeepLast     int           `yaml:"keep_last"`
+	KeepInterval time.Duration `yaml:"keep_interval"`
+}
+
+// StorageLoadRetry configures how a failed snapshot download is retried
+// before it is reported as a failure, and the circuit breaker that stops
+// downloads when the storage backend keeps failing. Once all attempts have
+// failed, the download is tried again after the storage_retry_interval.
+type StorageLoadRetry struct {
+	// Attempts is the number of download attempts, including the first one.
+	Attempts int `yaml:"attempts"`
+
+	// Backoff is the delay before the first retry, which doubles for every
+	// next retry up to MaxBackoff.
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	// Jitter is the random fraction added to or removed from every delay,
+	// including the storage_retry_interval, so that instances do not all
+	// retry at the same time (0 to 1).
+	Jitter float64 `yaml:"jitter"`
+
+	// BreakerThreshold is the number of consecutive failed download attempts
+	// for an LMDB after which the circuit breaker opens, and no downloads are
+	// attempted for BreakerCooldown. Zero disables the circuit breaker.
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+}
+
+// HybridClock configures hybrid logical clock timestamps. With plain wall
+// clock timestamps, changes made after the clock was stepped backwards lose
+// from older changes. When enabled, every timestamp written is at least one
+// nanosecond higher than the last timestamp seen, locally or in a remote
+// snapshot.
+type HybridClock struct {
+	Enabled bool `yaml:"enabled"`
+
+	// MaxSkew is the maximum time a remote snapshot timestamp can be ahead
+	// of the local clock. Snapshots further ahead are reported in the logs
+	// and metrics, and do not advance the hybrid clock. This detection is
+	// also active when the hybrid clock is disabled.
+	MaxSkew time.Duration `yaml:"max_skew"`
+}
+
+// DeltaSnapshots configures incremental snapshots. When enabled, we only
+// store the entries that changed since the last full snapshot, and
+// periodically write a new full snapshot to bound the size of the deltas
+// and allow the cleaner to remove older snapshots.
+type DeltaSnapshots struct {
+	Enabled bool `yaml:"enabled"`
+
+	// FullInterval is the maximum time between full snapshots.
+	FullInterval time.Duration `yaml:"full_interval"`
+
+	// MaxDeltas is the maximum number of delta snapshots written after a
+	// full snapshot, before a new full snapshot is written.
+	MaxDeltas int `yaml:"max_deltas"`
+
+	// MaxSizeRatio triggers a new full snapshot when the last delta snapshot
+	// was larger than this fraction of the last full snapshot. Since deltas
+	// are cumulative, they grow until the next full snapshot.
+	MaxSizeRatio float64 `yaml:"max_size_ratio"`
+}
+
+// Compression configures the compression of snapshots we write. Snapshots
+// from other instances are always loaded, regardless of their compression.
+type Compression struct {
+	// Type is the compression type: "gzip" (default), "zstd", "lz4" or
+	// "none". The lz4 compression uses the least CPU time, at the cost of
+	// larger snapshots. Only enable zstd, lz4 or none after all instances
+	// have been upgraded to a version that supports it, older versions will
+	// ignore these snapshots.
+	Type string `yaml:"type"`
+
+	// Level is the compression level. The default (0) is 1 for gzip, 3 for
+	// zstd and the fast mode for lz4. Higher levels compress better at a
+	// higher CPU cost. Valid levels are -2 to 9 for gzip, where -1 is its
+	// default level 6 and -2 is Huffman only, 1 to 22 for zstd and 1 to 9
+	// for lz4.
+	Level int `yaml:"level"`
+
+	// DictionaryFile is the path to a zstd dictionary, for example trained
+	// with 'zstd --train' on samples written by 'snapshots dict-samples'.
+	// All instances must be configured with the same dictionary.
+	DictionaryFile string `yaml:"dictionary_file"`
+
+	// Framed writes snapshots as independently compressed blocks per DBI
+	// chunk with an index at the end, so that readers can decode them in
+	// parallel. Only enable this after all instances have been upgraded to a
+	// version that can read framed snapshots.
+	Framed bool `yaml:"framed"`
+}
+
+// LoadDictionary returns the contents of the DictionaryFile, if set
+func (c Compression) LoadDictionary() ([]byte, error) {
+	if c.DictionaryFile == "" {
+		return nil, nil
+	}
+	dict, err := os.ReadFile(c.DictionaryFile)
+	if err != nil {
+		return nil, fmt.Errorf("storage.compression.dictionary_file: %w", err)
+	}
+	return dict, nil
+}
+
+// Encryption configures client-side encryption of everything stored in the
+// storage backend, so that snapshot contents are not exposed to anyone with
+// access to the bucket. The failover and replica backends can use their own
+// encryption, the main one applies to those that do not set a type.
+type Encryption struct {
+	// Type is the encryption type: "" (disabled), "aes-gcm" or "age"
+	Type string `yaml:"type"`
+
+	// KeyFile is the path to a file with a 256 bit AES key, either as
+	// 32 raw bytes or as 64 hex characters. Required for "aes-gcm".
+	KeyFile string `yaml:"key_file"`
+
+	// AgeIdentityFile is the path to a file with age identities (private
+	// keys) used to decrypt snapshots. Required for "age".
+	AgeIdentityFile string `yaml:"age_identity_file"`
+
+	// AgeRecipients are the age public keys ("age1...") to encrypt
+	// snapshots to. If not set, the recipients of the identities are used.
+	AgeRecipients []string `yaml:"age_recipients"`
+
+	// AllowUnencrypted allows loading unencrypted snapshots, which can be
+	// useful during a migration to encrypted snapshots.
+	AllowUnencrypted bool `yaml:"allow_unencrypted"`
+}
+
+// Or returns e if it sets a type, and def otherwise, so that a backend without
+// its own encryption uses the main one
+func (e Encryption) Or(def Encryption) Encryption {
+	if e.Type == "" {
+		return def
+	}
+	return e
+}
+
+// check validates the encryption options, which are at path in the config
+func (e Encryption) check(path string) error {
+	switch e.Type {
+	case "":
+	case "aes-gcm":
+		if e.KeyFile == "" {
+			return fmt.Errorf("%s.key_file: required for aes-gcm", path)
+		}
+	case "age":
+		if e.AgeIdentityFile == "" {
+			return fmt.Errorf("%s.age_identity_file: required for age", path)
+		}
+	default:
+		return fmt.Errorf("%s.type: unsupported type %q", path, e.Type)
+	}
+	return nil
+}
+
+// Signing configures Ed25519 signatures of snapshots, so that anyone who
+// obtains write access to the bucket cannot inject forged snapshots.
+type Signing struct {
+	// PrivateKeyFile is the path to a PEM encoded PKCS #8 Ed25519 private
+	// key used to sign the snapshots written by this instance.
+	PrivateKeyFile string `yaml:"private_key_file"`
+
+	// PublicKeyFiles are paths to PEM encoded Ed25519 public keys. If set,
+	// only snapshots signed by one of these keys are loaded.
+	PublicKeyFiles []string `yaml:"public_key_files"`
+
+	// AllowUnsigned allows loading unsigned snapshots, which can be
+	// useful during a migration to signed snapshots.
+	AllowUnsigned bool `yaml:"allow_unsigned"`
+}
+
+// LoadSigner loads the private key, if configured
+func (s Signing) LoadSigner() (*snapshot.Signer, error) {
+	if s.PrivateKeyFile == "" {
+		return nil, nil
+	}
+	return snapshot.LoadSigner(s.PrivateKeyFile)
+}
+
+// LoadVerifier loads the public keys, if configured
+func (s Signing) LoadVerifier() (*snapshot.Verifier, error) {
+	if len(s.PublicKeyFiles) == 0 {
+		return nil, nil
+	}
+	v, err := snapshot.LoadVerifier(s.PublicKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+	v.AllowUnsigned = s.AllowUnsigned
+	return v, nil
+}
+
+// Throttle configures rate limits for storage transfers, in bytes per second.
+// A zero rate means unlimited. Blobs are transferred as a whole, so these
+// limit the average rate over multiple transfers, not the peak rate.
+type Throttle struct {
+	UploadRate   datasize.ByteSize `yaml:"upload_rate"`
+	DownloadRate datasize.ByteSize `yaml:"download_rate"`
+}
+
+// Dedup configures the deduplication of the DBI blocks of framed snapshots.
+// Every DBI block is stored once under a key derived from its SHA-256 hash,
+// or its HMAC with encryption enabled, and the snapshot object only refers to
+// it, so that DBIs that did not change between snapshots, or that are the
+// same in the snapshots of multiple instances, are uploaded and stored only
+// once.
+type Dedup struct {
+	Enabled bool `yaml:"enabled"`
+
+	// MinBlockSize is the size below which blocks are kept in the snapshot
+	// object itself.
+	MinBlockSize datasize.ByteSize `yaml:"min_block_size"`
+
+	// PerDBI stores all blocks of a DBI as a single object, so that every
+	// DBI of a snapshot is its own object in the bucket. DBIs that did not
+	// change are not uploaded again, and with storage_partial_downloads
+	// receivers only download the objects of DBIs that changed.
+	PerDBI bool `yaml:"per_dbi"`
+
+	// GCInterval is the interval between scans for blocks that are no longer
+	// referenced by any snapshot. These are deleted once they were found
+	// unreferenced in two scans. The scans are done while deleting old
+	// snapshots, so these require storage.cleanup on at least one instance.
+	GCInterval time.Duration `yaml:"gc_interval"`
 }
 
 // HTTP configures the HTTP server with Prometheus metrics and status page
 type HTTP struct {
-	Address string `yaml:"address"` // Address like ":8000"
+	Address string    `yaml:"address"` // Address like ":8000"
+	Admin   HTTPAdmin `yaml:"admin"`
+}
+
+// HTTPAdmin configures the admin API under /admin/ for runtime control of
+// the syncers. Every request must pass the token as a bearer token in the
+// Authorization header.
+type HTTPAdmin struct {
+	Enabled bool   `yaml:"enabled"`
+	Token   string `yaml:"token"`
+}
+
+// Tracing configures the export of OpenTelemetry traces of the sync cycles
+// to an OTLP/HTTP collector.
+type Tracing struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the host:port of the collector
+	Endpoint string `yaml:"endpoint"`
+	// URLPath overrides the default "/v1/traces" path
+	URLPath string `yaml:"url_path"`
+	// Insecure disables TLS
+	Insecure bool `yaml:"insecure"`
+	// Headers are extra HTTP headers to send, e.g. for authentication
+	Headers map[string]string `yaml:"headers"`
+	// SampleRatio is the fraction of traces to sample (0 to 1)
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// ServiceName is the service.name resource attribute
+	ServiceName string `yaml:"service_name"`
 }
 
 // Health configures the healthz error & warn thresholds
@@ -255,6 +1389,19 @@ type Health struct {
 	StorageLoad  healthtracker.HealthConfig `yaml:"storage_load"`
 	StorageStore healthtracker.HealthConfig `yaml:"storage_store"`
 	Start        starttracker.StartConfig   `yaml:"start"`
+	SnapshotAge  HealthSnapshotAge          `yaml:"snapshot_age"`
+}
+
+// HealthSnapshotAge configures the check on the age of the newest remote
+// snapshot that was applied to an LMDB. Before any remote snapshot has been
+// applied, the check passes.
+type HealthSnapshotAge struct {
+	EvaluationInterval time.Duration `yaml:"interval"`
+	// WarnAge is the age after which healthz reports a warning (0 disables)
+	WarnAge time.Duration `yaml:"warn_age"`
+	// ErrorAge is the age after which healthz reports an error and /readyz
+	// reports the instance as not ready (0 disables)
+	ErrorAge time.Duration `yaml:"error_age"`
 }
 
 // Check validates a Config instance
@@ -270,6 +1417,9 @@ func (c Config) Check() error {
 		if l.Path == "" {
 			return fmt.Errorf("%s: no path configured", prefix)
 		}
+		if strings.HasPrefix(l.StoragePrefix, "/") {
+			return fmt.Errorf("%s: storage_prefix: must not start with a '/'", prefix)
+		}
 		if l.Options.FileMask > 0777 { // decimal 511
 			return fmt.Errorf("lmdb.options.file_mask: too large value, possible use of decimal (%d) instead of octal (%#o)",
 				l.Options.FileMask, l.Options.FileMask)
@@ -281,12 +1431,98 @@ func (c Config) Check() error {
 		if l.SchemaTracksChanges && l.DupSortHack {
 			return fmt.Errorf("lmdb.schema_tracks_changes: cannot be used together with the dupsort_hack option")
 		}
+		if l.SchemaTracksChanges && l.DupSortNative {
+			return fmt.Errorf("lmdb.schema_tracks_changes: cannot be used together with the dupsort_native option")
+		}
+		if l.StartupCheckEntries < -1 {
+			return fmt.Errorf("%s: startup_check_entries: must be -1 or larger", prefix)
+		}
+		if l.ReceiveOnly && l.SendOnly {
+			return fmt.Errorf("%s: receive_only: cannot be used together with the send_only option", prefix)
+		}
+		if l.DupSortHack && l.DupSortNative {
+			return fmt.Errorf("lmdb.dupsort_native: cannot be used together with the dupsort_hack option")
+		}
+		for dbiName, dbiOpt := range l.DBIOptions {
+			enc := dbiOpt.Encoding
+			if !schema.IsValidEncoding(enc) {
+				return fmt.Errorf("%s: dbi_options.%s.encoding: unknown encoding %q (available: %v)",
+					prefix, dbiName, enc, schema.Encodings)
+			}
+			if enc != "" && schema.RequiresHeaders(enc) != l.SchemaTracksChanges {
+				return fmt.Errorf("%s: dbi_options.%s.encoding: %s values require schema_tracks_changes to be %v",
+					prefix, dbiName, enc, !l.SchemaTracksChanges)
+			}
+			for i, r := range dbiOpt.Redact {
+				if err := r.Check(); err != nil {
+					return fmt.Errorf("%s: dbi_options.%s.redact[%d]: %w", prefix, dbiName, i, err)
+				}
+			}
+		}
+		for _, pattern := range l.IncludeDBIs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: include_dbis: invalid pattern %q: %w", prefix, pattern, err)
+			}
+		}
+		for _, pattern := range l.ExcludeDBIs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: exclude_dbis: invalid pattern %q: %w", prefix, pattern, err)
+			}
+		}
 	}
 	if c.HTTP.Address != "" {
 		if _, _, err := net.SplitHostPort(c.HTTP.Address); err != nil {
 			return fmt.Errorf("http.address: %v", err)
 		}
 	}
+	if c.HTTP.Admin.Enabled {
+		if c.HTTP.Address == "" {
+			return fmt.Errorf("http.admin: requires http.address")
+		}
+		if c.HTTP.Admin.Token == "" {
+			return fmt.Errorf("http.admin.token: required when enabled")
+		}
+	}
+	if err := c.Storage.Events.Check(); err != nil {
+		return fmt.Errorf("storage.events: %w", err)
+	}
+	if ev := c.Storage.Events; ev.Enabled && ev.Webhook && c.HTTP.Address == "" {
+		return fmt.Errorf("storage.events.webhook: requires http.address")
+	}
+	for i, wh := range c.Webhooks {
+		if err := wh.Check(); err != nil {
+			return fmt.Errorf("webhooks[%d]: %w", i, err)
+		}
+	}
+	if err := c.Sidecar.Check(); err != nil {
+		return fmt.Errorf("sidecar.%w", err)
+	}
+	if err := c.Peer.Check(); err != nil {
+		return fmt.Errorf("peer: %w", err)
+	}
+	if err := c.ChangeFeed.Check(); err != nil {
+		return fmt.Errorf("change_feed: %w", err)
+	}
+	if err := c.ChangeImport.Check(); err != nil {
+		return fmt.Errorf("change_import: %w", err)
+	}
+	if c.ChangeImport.Enabled && c.ChangeImport.HTTP && c.HTTP.Address == "" {
+		return fmt.Errorf("change_import.http: requires http.address")
+	}
+	if err := c.PDNS.Check(); err != nil {
+		return fmt.Errorf("pdns.%w", err)
+	}
+	if c.Sidecar.PreStop && c.HTTP.Address == "" {
+		return fmt.Errorf("sidecar.prestop: requires http.address")
+	}
+	if c.Tracing.Enabled {
+		if c.Tracing.Endpoint == "" {
+			return fmt.Errorf("tracing.endpoint: required when enabled")
+		}
+		if r := c.Tracing.SampleRatio; r < 0 || r > 1 {
+			return fmt.Errorf("tracing.sample_ratio: must be between 0 and 1")
+		}
+	}
 	if c.LMDBPollInterval < 100*time.Millisecond {
 		return fmt.Errorf("lmdb_poll_interval: too short interval")
 	}
@@ -302,12 +1538,264 @@ func (c Config) Check() error {
 	if c.StorageRetryCount < 1 {
 		return fmt.Errorf("storage_retry_count: positive number required")
 	}
+	lr := c.StorageLoadRetry
+	if lr.Attempts < 1 {
+		return fmt.Errorf("storage_load_retry.attempts: positive number required")
+	}
+	if lr.Backoff < 0 || lr.MaxBackoff < lr.Backoff {
+		return fmt.Errorf("storage_load_retry.max_backoff: must not be shorter than backoff")
+	}
+	if lr.Jitter < 0 || lr.Jitter > 1 {
+		return fmt.Errorf("storage_load_retry.jitter: must be between 0 and 1")
+	}
+	if lr.BreakerThreshold < 0 {
+		return fmt.Errorf("storage_load_retry.breaker_threshold: cannot be negative")
+	}
 	if c.MemoryDownloadedSnapshots < 1 {
 		return fmt.Errorf("memory_downloaded_snapshots: positive number required")
 	}
 	if c.MemoryDecompressedSnapshots < 1 {
 		return fmt.Errorf("memory_decompressed_snapshots: positive number required")
 	}
+	if c.MemorySpillDir != "" {
+		if fi, err := os.Stat(c.MemorySpillDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("memory_spill_dir: not an existing directory")
+		}
+	}
+	if c.StartupDownloadWorkers < 1 {
+		return fmt.Errorf("startup_download_workers: positive number required")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout: must not be negative")
+	}
+	if c.SnapshotReadWorkers < 1 {
+		return fmt.Errorf("snapshot_read_workers: positive number required")
+	}
+	if c.LMDBLoadBatchEntries < 0 {
+		return fmt.Errorf("lmdb_load_batch_entries: must not be negative")
+	}
+	if c.MemorySnapshotChunkSize < 64*datasize.KB {
+		return fmt.Errorf("memory_snapshot_chunk_size: too small (minimum 64KB)")
+	}
+	if c.StorageHashTree {
+		if !c.Storage.Compression.Framed {
+			return fmt.Errorf("storage_hash_tree: requires storage.compression.framed")
+		}
+		if c.StorageHashTreeChunkSize < 64*datasize.KB {
+			return fmt.Errorf("storage_hash_tree_chunk_size: too small (minimum 64KB)")
+		}
+	}
+	if comp := c.Storage.Compression; comp.Type != "" {
+		switch comp.Type {
+		case "gzip", "zstd", "lz4", "none":
+		default:
+			return fmt.Errorf("storage.compression.type: unsupported type %q", comp.Type)
+		}
+		if comp.DictionaryFile != "" && comp.Type != "zstd" {
+			return fmt.Errorf("storage.compression.dictionary_file: only supported for zstd")
+		}
+	}
+	// The valid levels depend on the compression type
+	levelCheck := snapshot.Compression{
+		Type:  c.Storage.Compression.Type,
+		Level: c.Storage.Compression.Level,
+	}
+	if err := levelCheck.Check(); err != nil {
+		return fmt.Errorf("storage.compression.level: %w", err)
+	}
+	if err := c.Storage.Encryption.check("storage.encryption"); err != nil {
+		return err
+	}
+	if sig := c.Storage.Signing; sig.AllowUnsigned && len(sig.PublicKeyFiles) == 0 {
+		return fmt.Errorf("storage.signing.allow_unsigned: requires public_key_files")
+	}
+	if bl := c.LMDBBulkLoad; bl.Enabled {
+		if bl.MinInstances < 1 {
+			return fmt.Errorf("lmdb_bulk_load.min_instances: positive number required")
+		}
+		if bl.BatchSize > 0 && bl.BatchSize < datasize.MB {
+			return fmt.Errorf("lmdb_bulk_load.batch_size: too small (minimum 1MB)")
+		}
+	}
+	if err := checkDurability("lmdb_durability.bulk_load", c.LMDBDurability.BulkLoad); err != nil {
+		return err
+	}
+	if err := checkDurability("lmdb_durability.startup", c.LMDBDurability.Startup); err != nil {
+		return err
+	}
+	if a := c.SplitBrainAction; a != SplitBrainWarn && a != SplitBrainRefuse {
+		return fmt.Errorf("split_brain_action: must be %s or %s", SplitBrainWarn, SplitBrainRefuse)
+	}
+	if st := c.SnapshotTrigger; st.Enabled {
+		if st.MaxDelay <= 0 {
+			return fmt.Errorf("snapshot_trigger.max_delay: must be positive")
+		}
+		if st.MinInterval < 0 || st.MinInterval > st.MaxDelay {
+			return fmt.Errorf("snapshot_trigger.min_interval: must be between 0 and max_delay")
+		}
+	}
+	if ac := c.LMDBAutoCompaction; ac.Enabled {
+		if ac.Interval < time.Minute {
+			return fmt.Errorf("lmdb_auto_compaction.interval: too short interval (minimum 1m)")
+		}
+		if ac.Threshold <= 0 || ac.Threshold >= 1 {
+			return fmt.Errorf("lmdb_auto_compaction.threshold: must be between 0 and 1")
+		}
+	}
+	if gc := c.TombstoneGC; gc.Enabled {
+		if gc.Interval < time.Minute {
+			return fmt.Errorf("tombstone_gc.interval: too short interval (minimum 1m)")
+		}
+		if gc.Retention < time.Hour {
+			return fmt.Errorf("tombstone_gc.retention: too short (minimum 1h)")
+		}
+	}
+	if b := c.Backup; b.Enabled {
+		if _, err := cron.Parse(b.Schedule); err != nil {
+			return fmt.Errorf("backup.schedule: %w", err)
+		}
+		if b.Prefix == "" {
+			return fmt.Errorf("backup.prefix: required, backups cannot be stored with the normal snapshots")
+		}
+		if b.KeepLast < 0 {
+			return fmt.Errorf("backup.keep_last: cannot be negative")
+		}
+		if b.KeepInterval < 0 {
+			return fmt.Errorf("backup.keep_interval: cannot be negative")
+		}
+	}
+	if c.HybridClock.MaxSkew < 0 {
+		return fmt.Errorf("hybrid_clock.max_skew: cannot be negative")
+	}
+	if cl := c.Storage.Cleanup; cl.Enabled {
+		if cl.KeepLast < 0 {
+			return fmt.Errorf("storage.cleanup.keep_last: cannot be negative")
+		}
+		if cl.KeepInterval < 0 {
+			return fmt.Errorf("storage.cleanup.keep_interval: cannot be negative")
+		}
+	}
+	if cp := c.Storage.Compaction; cp.Enabled {
+		if cp.Interval < time.Minute {
+			return fmt.Errorf("storage.compaction.interval: too short interval (minimum 1m)")
+		}
+		if cp.StaleInterval < time.Hour {
+			return fmt.Errorf("storage.compaction.stale_interval: too short interval (minimum 1h)")
+		}
+		if cp.Instance == "" {
+			return fmt.Errorf("storage.compaction.instance: required")
+		}
+		if cp.Instance == c.Instance {
+			return fmt.Errorf("storage.compaction.instance: must differ from the instance name")
+		}
+	}
+	if fo := c.Storage.Failover; fo.Enabled {
+		if fo.Type == "" {
+			return fmt.Errorf("storage.failover.type: required")
+		}
+		if fo.FailureThreshold < 1 {
+			return fmt.Errorf("storage.failover.failure_threshold: positive number required")
+		}
+		if fo.ProbeInterval < 100*time.Millisecond {
+			return fmt.Errorf("storage.failover.probe_interval: too short interval (minimum 100ms)")
+		}
+		if fo.FailbackAfter < 1 {
+			return fmt.Errorf("storage.failover.failback_after: positive number required")
+		}
+		if err := fo.Encryption.check("storage.failover.encryption"); err != nil {
+			return err
+		}
+	}
+	if rp := c.Storage.Replication; len(rp.Replicas) > 0 {
+		names := make(map[string]bool)
+		for i, r := range rp.Replicas {
+			if r.Type == "" {
+				return fmt.Errorf("storage.replication.replicas[%d].type: required", i)
+			}
+			name := rp.ReplicaName(i)
+			if names[name] {
+				return fmt.Errorf("storage.replication.replicas[%d].name: duplicate name %q", i, name)
+			}
+			names[name] = true
+			if err := r.Encryption.check(fmt.Sprintf("storage.replication.replicas[%d].encryption", i)); err != nil {
+				return err
+			}
+		}
+		if rp.Quorum < 0 || rp.Quorum > len(rp.Replicas)+1 {
+			return fmt.Errorf("storage.replication.quorum: must be between 0 and the number of backends")
+		}
+	}
+	if dd := c.Storage.Dedup; dd.Enabled {
+		if !c.Storage.Compression.Framed {
+			return fmt.Errorf("storage.dedup: requires storage.compression.framed")
+		}
+		if dd.GCInterval < time.Minute {
+			return fmt.Errorf("storage.dedup.gc_interval: too short interval (minimum 1m)")
+		}
+	}
+	if le := c.Storage.LeaderElection; le.Enabled {
+		if le.LeaseDuration < 10*time.Second {
+			return fmt.Errorf("storage.leader_election.lease_duration: too short duration (minimum 10s)")
+		}
+		if le.SettleDelay <= 0 || le.SettleDelay >= le.LeaseDuration/3 {
+			return fmt.Errorf("storage.leader_election.settle_delay: must be positive and less than a third of the lease_duration")
+		}
+	}
+	if le := c.Storage.InstanceLease; le.Enabled {
+		if le.LeaseDuration < 10*time.Second {
+			return fmt.Errorf("storage.instance_lease.lease_duration: too short duration (minimum 10s)")
+		}
+		if le.SettleDelay <= 0 || le.SettleDelay >= le.LeaseDuration/3 {
+			return fmt.Errorf("storage.instance_lease.settle_delay: must be positive and less than a third of the lease_duration")
+		}
+	}
+	if hb := c.Storage.Heartbeat; hb.Enabled {
+		if hb.Interval < time.Second {
+			return fmt.Errorf("storage.heartbeat.interval: too short interval (minimum 1s)")
+		}
+		if hb.DeadAfter <= hb.Interval {
+			return fmt.Errorf("storage.heartbeat.dead_after: must be longer than the interval")
+		}
+		if hb.RemoveAfter < 0 {
+			return fmt.Errorf("storage.heartbeat.remove_after: cannot be negative")
+		}
+		if hb.RemoveAfter > 0 && hb.RemoveAfter <= hb.DeadAfter {
+			return fmt.Errorf("storage.heartbeat.remove_after: must be longer than dead_after")
+		}
+	}
+	if cv := c.Storage.Convergence; cv.Enabled {
+		if cv.Interval < 10*time.Second {
+			return fmt.Errorf("storage.convergence.interval: too short interval (minimum 10s)")
+		}
+		if cv.Window <= cv.Interval {
+			return fmt.Errorf("storage.convergence.window: must be longer than the interval")
+		}
+		if cv.StaleAfter <= cv.Interval {
+			return fmt.Errorf("storage.convergence.stale_after: must be longer than the interval")
+		}
+		if cv.RemoveAfter < 0 {
+			return fmt.Errorf("storage.convergence.remove_after: cannot be negative")
+		}
+		if cv.RemoveAfter > 0 && cv.RemoveAfter <= cv.StaleAfter {
+			return fmt.Errorf("storage.convergence.remove_after: must be longer than stale_after")
+		}
+		for _, pattern := range cv.ExcludeDBIs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("storage.convergence.exclude_dbis: invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	if ds := c.Storage.DeltaSnapshots; ds.Enabled {
+		if ds.FullInterval < time.Minute {
+			return fmt.Errorf("storage.delta_snapshots.full_interval: too short interval (minimum 1m)")
+		}
+		if ds.MaxDeltas < 1 {
+			return fmt.Errorf("storage.delta_snapshots.max_deltas: positive number required")
+		}
+		if ds.MaxSizeRatio <= 0 || ds.MaxSizeRatio > 1 {
+			return fmt.Errorf("storage.delta_snapshots.max_size_ratio: must be between 0 and 1")
+		}
+	}
 	return nil
 }
 
@@ -327,8 +1815,11 @@ func (c Config) Clone() Config {
 // String returns the config as a YAML string with passwords masked.
 func (c Config) String() string {
 	cc := c.Clone()
-	if cc.Storage.Options != nil {
-		opt := cc.Storage.Options
+	opts := []map[string]interface{}{cc.Storage.Options, cc.Storage.Failover.Options}
+	for _, r := range cc.Storage.Replication.Replicas {
+		opts = append(opts, r.Options)
+	}
+	for _, opt := range opts {
 		for _, key := range []string{"secret_key", "secret", "password"} {
 			iv := opt[key]
 			if v, ok := iv.(string); ok && v != "" {
@@ -336,6 +1827,54 @@ func (c Config) String() string {
 			}
 		}
 	}
+	if cc.Storage.Events.SQS.SecretKey != "" {
+		cc.Storage.Events.SQS.SecretKey = "***"
+	}
+	if cc.HTTP.Admin.Token != "" {
+		cc.HTTP.Admin.Token = "***"
+	}
+	if cc.Peer.TLS.Key != "" {
+		cc.Peer.TLS.Key = "***"
+	}
+	if cc.ChangeFeed.NATS.Token != "" {
+		cc.ChangeFeed.NATS.Token = "***"
+	}
+	if cc.ChangeFeed.NATS.Password != "" {
+		cc.ChangeFeed.NATS.Password = "***"
+	}
+	if cc.ChangeFeed.NATS.TLS.Key != "" {
+		cc.ChangeFeed.NATS.TLS.Key = "***"
+	}
+	if cc.ChangeFeed.Kafka.SASL.Password != "" {
+		cc.ChangeFeed.Kafka.SASL.Password = "***"
+	}
+	if cc.ChangeFeed.Kafka.TLS.Key != "" {
+		cc.ChangeFeed.Kafka.TLS.Key = "***"
+	}
+	if cc.ChangeFeed.Kafka.SchemaRegistry.Password != "" {
+		cc.ChangeFeed.Kafka.SchemaRegistry.Password = "***"
+	}
+	if cc.ChangeImport.HTTPToken != "" {
+		cc.ChangeImport.HTTPToken = "***"
+	}
+	if cc.ChangeImport.NATS.Token != "" {
+		cc.ChangeImport.NATS.Token = "***"
+	}
+	if cc.ChangeImport.NATS.Password != "" {
+		cc.ChangeImport.NATS.Password = "***"
+	}
+	if cc.ChangeImport.NATS.TLS.Key != "" {
+		cc.ChangeImport.NATS.TLS.Key = "***"
+	}
+	if cc.ChangeImport.Kafka.SASL.Password != "" {
+		cc.ChangeImport.Kafka.SASL.Password = "***"
+	}
+	if cc.ChangeImport.Kafka.TLS.Key != "" {
+		cc.ChangeImport.Kafka.TLS.Key = "***"
+	}
+	if cc.PDNS.API.APIKey != "" {
+		cc.PDNS.API.APIKey = "***"
+	}
 	y, err := yaml.Marshal(cc)
 	if err != nil {
 		logrus.Panicf("YAML marshal of config failed: %v", err) // Should never happen
@@ -371,17 +1910,76 @@ func Default() Config {
 			StorageLoad:  DefaultHealthStorageLoad,
 			StorageStore: DefaultHealthStorageStore,
 			Start:        DefaultHealthStart,
+			SnapshotAge:  DefaultHealthSnapshotAge,
 		},
 
-		LMDBScrapeSmaps:              true,
-		LMDBPollInterval:             DefaultLMDBPollInterval,
-		LMDBLogStatsInterval:         DefaultLMDBLogStatsInterval,
-		StoragePollInterval:          DefaultStoragePollInterval,
-		StorageRetryInterval:         DefaultStorageRetryInterval,
-		StorageRetryCount:            DefaultStorageRetryCount,
-		StorageForceSnapshotInterval: DefaultStorageForceSnapshotInterval,
-		MemoryDownloadedSnapshots:    DefaultMemoryDownloadedSnapshots,
-		MemoryDecompressedSnapshots:  DefaultMemoryDecompressedSnapshots,
+		LMDBScrapeSmaps:               true,
+		LMDBPollInterval:              DefaultLMDBPollInterval,
+		LMDBLogStatsInterval:          DefaultLMDBLogStatsInterval,
+		StoragePollInterval:           DefaultStoragePollInterval,
+		StorageRetryInterval:          DefaultStorageRetryInterval,
+		StorageRetryCount:             DefaultStorageRetryCount,
+		StorageForceSnapshotInterval:  DefaultStorageForceSnapshotInterval,
+		StorageVerifyChecksums:        true,
+		StorageSkipUnchangedSnapshots: true,
+		MemoryDownloadedSnapshots:     DefaultMemoryDownloadedSnapshots,
+		MemoryDecompressedSnapshots:   DefaultMemoryDecompressedSnapshots,
+		StartupDownloadWorkers:        DefaultStartupDownloadWorkers,
+		MemorySnapshotChunkSize:       DefaultMemorySnapshotChunkSize,
+		StorageHashTreeChunkSize:      DefaultStorageHashTreeChunkSize,
+		SnapshotReadWorkers:           DefaultSnapshotReadWorkers,
+		ShutdownTimeout:               DefaultShutdownTimeout,
+		LMDBLoadBatchSize:             DefaultLMDBLoadBatchSize,
+		SplitBrainAction:              SplitBrainWarn,
+
+		StorageLoadRetry: StorageLoadRetry{
+			Attempts:         DefaultStorageLoadRetryAttempts,
+			Backoff:          DefaultStorageLoadRetryBackoff,
+			MaxBackoff:       DefaultStorageRetryInterval,
+			Jitter:           DefaultStorageLoadRetryJitter,
+			BreakerThreshold: DefaultStorageLoadRetryBreakerThreshold,
+			BreakerCooldown:  DefaultStorageLoadRetryBreakerCooldown,
+		},
+		LMDBBulkLoad: BulkLoad{
+			Enabled:      false,
+			MinInstances: DefaultBulkLoadMinInstances,
+			BatchSize:    DefaultBulkLoadBatchSize,
+		},
+		LMDBDurability: Durability{
+			BulkLoad: DurabilityNoMetaSync,
+			Startup:  DurabilityFull,
+		},
+		SnapshotTrigger: SnapshotTrigger{
+			Enabled:     false,
+			Changes:     DefaultSnapshotTriggerChanges,
+			MaxDelay:    DefaultSnapshotTriggerMaxDelay,
+			MinInterval: DefaultSnapshotTriggerMinInterval,
+		},
+		LMDBAutoCompaction: AutoCompaction{
+			Enabled:     false,
+			Interval:    DefaultAutoCompactionInterval,
+			Threshold:   DefaultAutoCompactionThreshold,
+			MinFreeSize: DefaultAutoCompactionMinFreeSize,
+		},
+		TombstoneGC: TombstoneGC{
+			Enabled:   false,
+			Interval:  DefaultTombstoneGCInterval,
+			Retention: DefaultTombstoneGCRetention,
+		},
+		HybridClock: HybridClock{
+			MaxSkew: DefaultHybridClockMaxSkew,
+		},
+		Backup: Backup{
+			Enabled:  false,
+			Schedule: DefaultBackupSchedule,
+			Prefix:   DefaultBackupPrefix,
+			KeepLast: DefaultBackupKeepLast,
+		},
+		Tracing: Tracing{
+			Endpoint:    DefaultTracingEndpoint,
+			SampleRatio: 1,
+			ServiceName: DefaultTracingServiceName,
+		},
 
 		Storage: Storage{
 			Cleanup: Cleanup{
@@ -389,6 +1987,54 @@ func Default() Config {
 				Interval:                   5 * time.Minute,
 				MustKeepInterval:           10 * time.Minute,
 				RemoveOldInstancesInterval: 7 * 24 * time.Hour,
+				KeepLast:                   1,
+				KeepInterval:               0,
+			},
+			Compaction: Compaction{
+				Enabled:       false,
+				Interval:      DefaultCompactionInterval,
+				StaleInterval: DefaultCompactionStaleInterval,
+				Instance:      DefaultCompactionInstance,
+			},
+			LeaderElection: LeaderElection{
+				Enabled:       false,
+				LeaseDuration: DefaultLeaderElectionLeaseDuration,
+				SettleDelay:   DefaultLeaderElectionSettleDelay,
+			},
+			InstanceLease: LeaderElection{
+				Enabled:       false,
+				LeaseDuration: DefaultLeaderElectionLeaseDuration,
+				SettleDelay:   DefaultLeaderElectionSettleDelay,
+			},
+			Heartbeat: Heartbeat{
+				Enabled:     false,
+				Interval:    DefaultHeartbeatInterval,
+				DeadAfter:   DefaultHeartbeatDeadAfter,
+				RemoveAfter: DefaultHeartbeatRemoveAfter,
+			},
+			Convergence: Convergence{
+				Enabled:     false,
+				Interval:    DefaultConvergenceInterval,
+				Window:      DefaultConvergenceWindow,
+				StaleAfter:  DefaultConvergenceStaleAfter,
+				RemoveAfter: DefaultHeartbeatRemoveAfter,
+			},
+			Failover: Failover{
+				Enabled:          false,
+				FailureThreshold: DefaultFailoverFailureThreshold,
+				ProbeInterval:    DefaultFailoverProbeInterval,
+				FailbackAfter:    DefaultFailoverFailbackAfter,
+			},
+			DeltaSnapshots: DeltaSnapshots{
+				Enabled:      false,
+				FullInterval: DefaultDeltaSnapshotsFullInterval,
+				MaxDeltas:    DefaultDeltaSnapshotsMaxDeltas,
+				MaxSizeRatio: DefaultDeltaSnapshotsMaxSizeRatio,
+			},
+			Dedup: Dedup{
+				Enabled:      false,
+				MinBlockSize: DefaultDedupMinBlockSize,
+				GCInterval:   DefaultDedupGCInterval,
 			},
 		},
 	}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -86,13 +87,38 @@ func (c Config) Merge(o Config) Config {
 
 // Configure configures logrus according to Config
 func Configure(c Config) {
+	logrus.SetFormatter(NewFormatter(c))
+
+	level, err := logrus.ParseLevel(c.Level)
+	if err != nil {
+		// Should have been validated before calling this
+		logrus.Warnf("Ignoring invalid log level: %s", c.Level)
+	} else {
+		logrus.SetLevel(level)
+	}
+}
+
+// NewFormatter returns the logrus formatter for Config.
+//
+// The JSON format is meant to be ingested by log aggregators. Its top level
+// keys are "time", "level" and "msg", followed by the fields of the entry,
+// see docs/logging.md for the field names that are kept stable.
+func NewFormatter(c Config) logrus.Formatter {
 	noTimestamp := c.Timestamp == "disable"
 	fullTimestamp := c.Timestamp == "full"
 
 	var formatter logrus.Formatter
 	switch c.Format {
 	case "json":
-		formatter = &logrus.JSONFormatter{DisableTimestamp: noTimestamp}
+		formatter = &logrus.JSONFormatter{
+			DisableTimestamp: noTimestamp,
+			TimestampFormat:  time.RFC3339Nano,
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime:  "time",
+				logrus.FieldKeyLevel: "level",
+				logrus.FieldKeyMsg:   "msg",
+			},
+		}
 	case "logfmt":
 		formatter = &logrus.TextFormatter{
 			DisableColors:    true, // this sets logfmt
@@ -108,15 +134,7 @@ func Configure(c Config) {
 			},
 		}
 	}
-	logrus.SetFormatter(formatter)
-
-	level, err := logrus.ParseLevel(c.Level)
-	if err != nil {
-		// Should have been validated before calling this
-		logrus.Warnf("Ignoring invalid log level: %s", c.Level)
-	} else {
-		logrus.SetLevel(level)
-	}
+	return formatter
 }
 
 func addDefaults(def string, options []string) string {
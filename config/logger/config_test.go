@@ -0,0 +1,43 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFormatter_json(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	l.Formatter = NewFormatter(Config{Level: "info", Format: "json", Timestamp: "full"})
+
+	l.WithFields(logrus.Fields{
+		"db":            "main",
+		"instance":      "a",
+		"snapshot_name": "main__a__20230101-000000.000000000__G-0000000000000000.pb.gz",
+	}).WithError(errors.New("oops")).Warn("Something happened")
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "warning", entry["level"])
+	assert.Equal(t, "Something happened", entry["msg"])
+	assert.Equal(t, "main", entry["db"])
+	assert.Equal(t, "a", entry["instance"])
+	assert.Equal(t, "oops", entry["error"])
+	assert.Contains(t, entry, "time")
+	assert.Contains(t, entry, "snapshot_name")
+}
+
+func TestConfig_Merge(t *testing.T) {
+	c := DefaultConfig.Merge(Config{Format: "json"})
+	assert.Equal(t, "json", c.Format)
+	assert.Equal(t, DefaultConfig.Level, c.Level)
+	assert.NoError(t, c.Check())
+	assert.Error(t, Config{Level: "info", Format: "xml"}.Check())
+}
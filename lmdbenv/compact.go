@@ -0,0 +1,159 @@
+package lmdbenv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+)
+
+// ErrEnvInUse is returned by Compact if another process has the LMDB open
+var ErrEnvInUse = errors.New("LMDB is in use by another process")
+
+// DataFile returns the path of the data file of the env
+func DataFile(env *lmdb.Env) (string, error) {
+	path, err := env.Path()
+	if err != nil {
+		return "", err
+	}
+	flags, err := env.Flags()
+	if err != nil {
+		return "", err
+	}
+	if flags&lmdb.NoSubdir == 0 {
+		path = filepath.Join(path, "data.mdb")
+	}
+	return filepath.Abs(path)
+}
+
+// Compact replaces the data file of the env with a compacted copy without
+// free pages, like 'mdb_copy -c'. The copy is written to a temporary file
+// next to the data file, which then atomically replaces it. Writers are
+// blocked during the copy, so that no transaction can be lost.
+//
+// Note that compaction resets the transaction ID of the LMDB to 1.
+//
+// The env MUST be closed and reopened afterwards to use the new data file.
+// Any other process that has the LMDB open would keep using the old data
+// file, so Compact returns ErrEnvInUse if the reader lock table has entries
+// of other processes, both before the copy and right before the rename.
+// Processes that opened the LMDB but never started a read transaction do
+// not show up there, so this must still only be used when no other process
+// is expected to have it open.
+func Compact(env *lmdb.Env) error {
+	dataFile, err := DataFile(env)
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	st, err := os.Stat(dataFile)
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := checkOtherReaders(env); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+
+	// The write transaction only holds the writer lock, and must stay on
+	// this thread.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	txn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		return fmt.Errorf("compact: begin txn: %w", err)
+	}
+	defer txn.Abort()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dataFile), ".compact-*.mdb")
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name()) // fails after the rename
+	}()
+
+	// The copy uses a read transaction, which cannot be started on the
+	// thread of the write transaction.
+	errc := make(chan error, 1)
+	go func() {
+		errc <- env.CopyFDFlag(tmp.Fd(), lmdb.CopyCompact)
+	}()
+	if err := <-errc; err != nil {
+		return fmt.Errorf("compact: copy: %w", err)
+	}
+	if err := tmp.Chmod(st.Mode().Perm()); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	// Another process may have opened the LMDB during the copy
+	if err := checkOtherReaders(env); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), dataFile); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	// The data file has been replaced, so the env must be reopened even if
+	// this fails.
+	syncDir(filepath.Dir(dataFile))
+	return nil
+}
+
+// checkOtherReaders returns ErrEnvInUse if the reader lock table of the env
+// has entries of other processes. Stale entries of processes that are gone
+// are cleared first.
+func checkOtherReaders(env *lmdb.Env) error {
+	if _, err := env.ReaderCheck(); err != nil {
+		return err
+	}
+	pids, err := readerPIDs(env)
+	if err != nil {
+		return err
+	}
+	own := os.Getpid()
+	for _, pid := range pids {
+		if pid != own {
+			return fmt.Errorf("%w: pid %d is in the reader lock table", ErrEnvInUse, pid)
+		}
+	}
+	return nil
+}
+
+// readerPIDs returns the PIDs of the entries in the reader lock table
+func readerPIDs(env *lmdb.Env) ([]int, error) {
+	var pids []int
+	err := env.ReaderList(func(line string) error {
+		// The header line and the no readers messages do not start with a
+		// number.
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil
+		}
+		pids = append(pids, pid)
+		return nil
+	})
+	return pids, err
+}
+
+// syncDir tries to make a rename in the directory durable
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	_ = d.Sync()
+}
@@ -0,0 +1,117 @@
+package lmdbenv
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	tmpdir := t.TempDir()
+	env, err := New(tmpdir, lmdb.Create)
+	require.NoError(t, err)
+	defer func() {
+		_ = env.Close()
+	}()
+
+	val := make([]byte, 1000)
+	err = env.Update(func(txn *lmdb.Txn) error {
+		dbi, err := txn.CreateDBI("foo")
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, txn.Put(dbi, []byte(fmt.Sprintf("key-%04d", i)), val, 0))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	err = env.Update(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenDBI("foo", 0)
+		require.NoError(t, err)
+		for i := 10; i < 1000; i++ {
+			require.NoError(t, txn.Del(dbi, []byte(fmt.Sprintf("key-%04d", i)), nil))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	dataFile, err := DataFile(env)
+	require.NoError(t, err)
+	before, err := os.Stat(dataFile)
+	require.NoError(t, err)
+
+	require.NoError(t, Compact(env))
+	require.NoError(t, env.Close())
+
+	after, err := os.Stat(dataFile)
+	require.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size()/10)
+	assert.Equal(t, before.Mode(), after.Mode())
+	entries, err := os.ReadDir(tmpdir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "only data.mdb and lock.mdb")
+
+	env, err = New(tmpdir, 0)
+	require.NoError(t, err)
+	err = env.View(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenDBI("foo", 0)
+		require.NoError(t, err)
+		kvs, err := ReadDBI(txn, dbi)
+		require.NoError(t, err)
+		assert.Len(t, kvs, 10)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCompact_otherReader(t *testing.T) {
+	if dir := os.Getenv("LMDBENV_TEST_READER"); dir != "" {
+		// Helper process that keeps a read transaction open until stdin is
+		// closed
+		env, err := New(dir, 0)
+		require.NoError(t, err)
+		txn, err := env.BeginTxn(nil, lmdb.Readonly)
+		require.NoError(t, err)
+		fmt.Println("ready")
+		_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+		txn.Abort()
+		_ = env.Close()
+		return
+	}
+
+	tmpdir := t.TempDir()
+	env, err := New(tmpdir, lmdb.Create)
+	require.NoError(t, err)
+	defer func() {
+		_ = env.Close()
+	}()
+	err = env.View(func(txn *lmdb.Txn) error { return nil })
+	require.NoError(t, err)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCompact_otherReader$")
+	cmd.Env = append(os.Environ(), "LMDBENV_TEST_READER="+tmpdir)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ready\n", line)
+
+	// Our own reader slot does not count, the one of the helper does
+	err = Compact(env)
+	assert.ErrorIs(t, err, ErrEnvInUse)
+	entries, err := os.ReadDir(tmpdir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "no temporary file left")
+
+	require.NoError(t, stdin.Close())
+	require.NoError(t, cmd.Wait())
+	assert.NoError(t, Compact(env))
+}
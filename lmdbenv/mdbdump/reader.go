@@ -0,0 +1,209 @@
+package mdbdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Handler receives the DBIs and entries read by Read. The Writer implements
+// it, to copy mdb_dump output.
+type Handler interface {
+	// StartDBI is called before the entries of every DBI, with the LMDB DBI
+	// flags from the header. The name is empty for the main DBI.
+	StartDBI(name string, flags uint) error
+
+	// Put is called for every entry of the current DBI. The key and value
+	// are only valid until it returns.
+	Put(key, val []byte) error
+}
+
+// Read reads all sections of mdb_dump output, as written by mdb_dump with or
+// without -a, in the 'bytevalue' or 'print' format, and passes their contents
+// to the Handler.
+func Read(r io.Reader, h Handler) error {
+	d := &reader{r: bufio.NewReader(r)}
+	for {
+		more, err := d.readSection(h)
+		if err != nil {
+			return fmt.Errorf("mdbdump: line %d: %w", d.lineNo, err)
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+type reader struct {
+	r      *bufio.Reader
+	lineNo int
+}
+
+// readLine returns the next line without the line ending, or io.EOF
+func (d *reader) readLine() ([]byte, error) {
+	line, err := d.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil // last line without line ending
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.lineNo++
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// readSection reads a header and the data that follows it. It returns false
+// if there are no more sections.
+func (d *reader) readSection(h Handler) (more bool, err error) {
+	var (
+		name      string
+		flags     uint
+		printable bool
+		started   bool
+	)
+	for {
+		line, err := d.readLine()
+		if err == io.EOF {
+			if started {
+				return false, io.ErrUnexpectedEOF
+			}
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !started && len(line) == 0 {
+			continue // blank lines between sections
+		}
+		started = true
+		if string(line) == "HEADER=END" {
+			break
+		}
+		k, v, ok := bytes.Cut(line, []byte("="))
+		if !ok {
+			return false, fmt.Errorf("invalid header line %q", line)
+		}
+		switch key, val := string(k), string(v); key {
+		case "VERSION":
+			if val != strconv.Itoa(Version) {
+				return false, fmt.Errorf("unsupported version %q", val)
+			}
+		case "format":
+			switch val {
+			case "bytevalue":
+				printable = false
+			case "print":
+				printable = true
+			default:
+				return false, fmt.Errorf("unsupported format %q", val)
+			}
+		case "type":
+			if val != "btree" {
+				return false, fmt.Errorf("unsupported type %q", val)
+			}
+		case "database":
+			name = val
+		case "mapsize", "maxreaders", "db_pagesize", "mapaddr":
+			// Environment options that are not needed
+		default:
+			flag, known := dbiFlag(key)
+			if !known {
+				return false, fmt.Errorf("unknown header %q", key)
+			}
+			if val == "1" {
+				flags |= flag
+			}
+		}
+	}
+
+	if err := h.StartDBI(name, flags); err != nil {
+		return false, err
+	}
+	for {
+		line, err := d.readLine()
+		if err == io.EOF {
+			return false, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return false, err
+		}
+		if string(line) == "DATA=END" {
+			return true, nil
+		}
+		key, err := decodeData(line, printable)
+		if err != nil {
+			return false, err
+		}
+		line, err = d.readLine()
+		if err == io.EOF {
+			return false, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return false, err
+		}
+		val, err := decodeData(line, printable)
+		if err != nil {
+			return false, err
+		}
+		if err := h.Put(key, val); err != nil {
+			return false, err
+		}
+	}
+}
+
+func dbiFlag(name string) (uint, bool) {
+	for _, f := range dbiFlagNames {
+		if f.name == name {
+			return f.flag, true
+		}
+	}
+	return 0, false
+}
+
+var errInvalidData = errors.New("invalid data line")
+
+// decodeData decodes a key or value line, which starts with a space
+func decodeData(line []byte, printable bool) ([]byte, error) {
+	if len(line) == 0 || line[0] != ' ' {
+		return nil, errInvalidData
+	}
+	line = line[1:]
+	if !printable {
+		b := make([]byte, hex.DecodedLen(len(line)))
+		if _, err := hex.Decode(b, line); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidData, err)
+		}
+		return b, nil
+	}
+
+	// Printable characters as is, a backslash as two backslashes, and other
+	// bytes as a backslash followed by two hex digits
+	b := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+		if i+1 < len(line) && line[i+1] == '\\' {
+			b = append(b, '\\')
+			i++
+			continue
+		}
+		if i+2 >= len(line) {
+			return nil, errInvalidData
+		}
+		var x [1]byte
+		if _, err := hex.Decode(x[:], line[i+1:i+3]); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidData, err)
+		}
+		b = append(b, x[0])
+		i += 2
+	}
+	return b, nil
+}
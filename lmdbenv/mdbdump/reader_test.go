@@ -0,0 +1,93 @@
+package mdbdump
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHandler records the DBIs and entries as strings
+type testHandler struct {
+	events []string
+}
+
+func (h *testHandler) StartDBI(name string, flags uint) error {
+	h.events = append(h.events, fmt.Sprintf("dbi %q %#x", name, flags))
+	return nil
+}
+
+func (h *testHandler) Put(key, val []byte) error {
+	h.events = append(h.events, fmt.Sprintf("%q=%q", key, val))
+	return nil
+}
+
+func TestRead(t *testing.T) {
+	// Output of mdb_dump -a, which includes environment options
+	dump := strings.Join([]string{
+		"VERSION=3",
+		"format=bytevalue",
+		"database=foo",
+		"type=btree",
+		"mapsize=1073741824",
+		"maxreaders=126",
+		"db_pagesize=4096",
+		"HEADER=END",
+		" 61",
+		" 00ff",
+		" 62",
+		" ",
+		"DATA=END",
+		"VERSION=3",
+		"format=print",
+		"database=dup",
+		"type=btree",
+		"dupsort=1",
+		"HEADER=END",
+		" k",
+		" a\\\\b\\00c",
+		"DATA=END",
+	}, "\n") + "\n"
+	h := &testHandler{}
+	require.NoError(t, Read(strings.NewReader(dump), h))
+	assert.Equal(t, []string{
+		`dbi "foo" 0x0`,
+		`"a"="\x00\xff"`,
+		`"b"=""`,
+		`dbi "dup" 0x4`,
+		`"k"="a\\b\x00c"`,
+	}, h.events)
+
+	// Round trip through the Writer
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, Read(strings.NewReader(dump), w))
+	require.NoError(t, w.Close())
+	h2 := &testHandler{}
+	require.NoError(t, Read(&buf, h2))
+	assert.Equal(t, h.events, h2.events)
+
+	// Main DBI without a trailing newline
+	h = &testHandler{}
+	require.NoError(t, Read(strings.NewReader("VERSION=3\nformat=bytevalue\ntype=btree\nHEADER=END\n 61\n 62\nDATA=END"), h))
+	assert.Equal(t, []string{`dbi "" 0x0`, `"a"="b"`}, h.events)
+
+	// Empty input
+	require.NoError(t, Read(strings.NewReader(""), &testHandler{}))
+
+	for _, invalid := range []string{
+		"VERSION=2\nHEADER=END\nDATA=END\n",
+		"VERSION=3\nformat=other\nHEADER=END\nDATA=END\n",
+		"VERSION=3\nfoo=1\nHEADER=END\nDATA=END\n",
+		"VERSION=3\nformat=bytevalue\n",
+		"VERSION=3\nHEADER=END\n 61\n",
+		"VERSION=3\nHEADER=END\n 61\n 6\nDATA=END\n",
+		"VERSION=3\nHEADER=END\n 61\n62\nDATA=END\n",
+		"VERSION=3\nformat=print\nHEADER=END\n a\n \\0\nDATA=END\n",
+	} {
+		assert.Error(t, Read(strings.NewReader(invalid), &testHandler{}), invalid)
+	}
+}
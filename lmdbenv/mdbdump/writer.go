@@ -0,0 +1,104 @@
+// Package mdbdump implements the text format of the mdb_dump and mdb_load
+// tools of LMDB, with keys and values in the hex 'bytevalue' format.
+package mdbdump
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Version is the version of the format that is written
+const Version = 3
+
+// dbiFlagNames are the names of the DBI flags in the header, in the order
+// used by mdb_dump
+var dbiFlagNames = []struct {
+	flag uint
+	name string
+}{
+	{0x02, "reversekey"},
+	{0x04, "dupsort"},
+	{0x08, "integerkey"},
+	{0x10, "dupfixed"},
+	{0x20, "integerdup"},
+	{0x40, "reversedup"},
+}
+
+// Writer writes DBIs in the mdb_dump format. Every DBI is written as a
+// separate section, like mdb_dump -a does.
+type Writer struct {
+	w     *bufio.Writer
+	inDBI bool
+	line  []byte
+}
+
+// NewWriter returns a new Writer. Close must be called to finish the output.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// StartDBI writes the header of a named DBI with the given LMDB DBI flags.
+// Any entries written afterwards belong to this DBI.
+func (w *Writer) StartDBI(name string, flags uint) error {
+	if err := w.endDBI(); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(w.w, "VERSION=%d\nformat=bytevalue\n", Version)
+	if name != "" {
+		_, _ = fmt.Fprintf(w.w, "database=%s\n", name)
+	}
+	_, _ = fmt.Fprintf(w.w, "type=btree\n")
+	for _, f := range dbiFlagNames {
+		if flags&f.flag > 0 {
+			_, _ = fmt.Fprintf(w.w, "%s=1\n", f.name)
+		}
+	}
+	_, err := fmt.Fprintf(w.w, "HEADER=END\n")
+	w.inDBI = true
+	return err
+}
+
+// Put writes an entry of the current DBI
+func (w *Writer) Put(key, val []byte) error {
+	if !w.inDBI {
+		return fmt.Errorf("mdbdump: put without a DBI")
+	}
+	if err := w.writeData(key); err != nil {
+		return err
+	}
+	return w.writeData(val)
+}
+
+// Close finishes the current DBI and flushes the output. It does not close
+// the underlying io.Writer.
+func (w *Writer) Close() error {
+	if err := w.endDBI(); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) endDBI() error {
+	if !w.inDBI {
+		return nil
+	}
+	w.inDBI = false
+	_, err := w.w.WriteString("DATA=END\n")
+	return err
+}
+
+// writeData writes a key or value as a line with a leading space
+func (w *Writer) writeData(b []byte) error {
+	n := 1 + hex.EncodedLen(len(b)) + 1
+	if cap(w.line) < n {
+		w.line = make([]byte, n)
+	}
+	line := w.line[:n]
+	line[0] = ' '
+	hex.Encode(line[1:], b)
+	line[n-1] = '\n'
+	_, err := w.w.Write(line)
+	return err
+}
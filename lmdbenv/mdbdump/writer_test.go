@@ -0,0 +1,55 @@
+package mdbdump
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.StartDBI("foo", 0))
+	require.NoError(t, w.Put([]byte("a"), []byte("\x00\xff")))
+	require.NoError(t, w.Put([]byte("b"), nil))
+	require.NoError(t, w.StartDBI("dup", 0x04|0x10))
+	require.NoError(t, w.Put([]byte("k"), []byte("v")))
+	require.NoError(t, w.StartDBI("empty", 0))
+	require.NoError(t, w.Close())
+
+	expected := []string{
+		"VERSION=3",
+		"format=bytevalue",
+		"database=foo",
+		"type=btree",
+		"HEADER=END",
+		" 61",
+		" 00ff",
+		" 62",
+		" ", // empty value
+		"DATA=END",
+		"VERSION=3",
+		"format=bytevalue",
+		"database=dup",
+		"type=btree",
+		"dupsort=1",
+		"dupfixed=1",
+		"HEADER=END",
+		" 6b",
+		" 76",
+		"DATA=END",
+		"VERSION=3",
+		"format=bytevalue",
+		"database=empty",
+		"type=btree",
+		"HEADER=END",
+		"DATA=END",
+	}
+	assert.Equal(t, strings.Join(expected, "\n")+"\n", buf.String())
+
+	w = NewWriter(&buf)
+	assert.Error(t, w.Put([]byte("a"), []byte("b")))
+}
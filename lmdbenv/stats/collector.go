@@ -49,6 +49,13 @@ func (c *Collector) AddTarget(name string, dbnames []string, env *lmdb.Env) {
 	}
 }
 
+// RemoveTarget removes the target with given name, if any
+func (c *Collector) RemoveTarget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.targets, name)
+}
+
 func (c *Collector) EnableSmaps(enabled bool) {
 	c.mu.Lock()
 	c.smaps = enabled
@@ -62,6 +69,9 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- envMaxReadersDesc
 	ch <- envLastTxnID
 	ch <- envFileSizeDesc
+	ch <- freelistPagesDesc
+	ch <- usedPagesDesc
+	ch <- fragmentationDesc
 	ch <- statUsageBytesDesc
 	ch <- statTotalUsageBytesDesc
 	ch <- statTotalUsageFractionDesc
@@ -69,6 +79,11 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- statPagesDesc
 	ch <- statDepthDesc
 	ch <- smapsDesc
+	ch <- pageSizeDesc
+	ch <- mapUsedBytesDesc
+	ch <- mapUsedFractionDesc
+	ch <- freelistBytesDesc
+	ch <- collectSuccessDesc
 }
 
 // Collect is part of the prometheus.Collect interface. It fetches statistics
@@ -117,6 +132,36 @@ func (c *Collector) doCollect(ch chan<- prometheus.Metric, t Target) {
 			t.Name,
 		)
 
+		// Collect map usage, which is the high-water mark of the pages in
+		// use, including free pages. The LMDB is full when this reaches
+		// the map size.
+		envStat, err := t.Env.Stat()
+		if err != nil {
+			return errors.Wrap(err, "env stat")
+		}
+		psize := envStat.PSize
+		mapUsed := uint64(info.LastPNO+1) * uint64(psize)
+		ch <- prometheus.MustNewConstMetric(
+			pageSizeDesc,
+			prometheus.GaugeValue,
+			float64(psize),
+			t.Name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			mapUsedBytesDesc,
+			prometheus.GaugeValue,
+			float64(mapUsed),
+			t.Name,
+		)
+		if info.MapSize > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				mapUsedFractionDesc,
+				prometheus.GaugeValue,
+				float64(mapUsed)/float64(info.MapSize),
+				t.Name,
+			)
+		}
+
 		// Collect file size
 		path, err := t.Env.Path()
 		if err != nil {
@@ -201,6 +246,37 @@ func (c *Collector) doCollect(ch chan<- prometheus.Metric, t Target) {
 					dbname, "overflow",
 				)
 			}
+
+			// Collect the freelist
+			freelist, err := ReadFreelist(t.Env, txn)
+			if err != nil {
+				return errors.Wrap(err, "freelist")
+			}
+			ch <- prometheus.MustNewConstMetric(
+				freelistPagesDesc,
+				prometheus.GaugeValue,
+				float64(freelist.FreePages),
+				t.Name,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				usedPagesDesc,
+				prometheus.GaugeValue,
+				float64(freelist.UsedPages),
+				t.Name,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				fragmentationDesc,
+				prometheus.GaugeValue,
+				freelist.Fragmentation(),
+				t.Name,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				freelistBytesDesc,
+				prometheus.GaugeValue,
+				float64(freelist.FreeBytes(psize)),
+				t.Name,
+			)
+
 			ch <- prometheus.MustNewConstMetric(
 				statTotalUsageBytesDesc,
 				prometheus.GaugeValue,
@@ -253,9 +329,17 @@ func (c *Collector) doCollect(ch chan<- prometheus.Metric, t Target) {
 
 		return nil
 	}
+	success := 1.0
 	if err := do(); err != nil {
 		logrus.Errorf("Collector: %v", err)
+		success = 0
 	}
+	ch <- prometheus.MustNewConstMetric(
+		collectSuccessDesc,
+		prometheus.GaugeValue,
+		success,
+		t.Name,
+	)
 }
 
 // Verify that Collector correctly implements the interface
@@ -294,6 +378,24 @@ var (
 		[]string{"lmdb"},
 		nil,
 	)
+	freelistPagesDesc = prometheus.NewDesc(
+		"lmdb_freelist_pages",
+		"Number of free pages in the freelist of LMDB database",
+		[]string{"lmdb"},
+		nil,
+	)
+	usedPagesDesc = prometheus.NewDesc(
+		"lmdb_used_pages",
+		"Number of pages in use by the data file of LMDB database, including free pages",
+		[]string{"lmdb"},
+		nil,
+	)
+	fragmentationDesc = prometheus.NewDesc(
+		"lmdb_fragmentation_fraction",
+		"Free pages as fraction (0-1) of the pages in use by the data file of LMDB database",
+		[]string{"lmdb"},
+		nil,
+	)
 	statUsageBytesDesc = prometheus.NewDesc(
 		"lmdb_db_usage_bytes",
 		"Bytes used in last version by data in databases",
@@ -336,6 +438,36 @@ var (
 		[]string{"lmdb", "database_path", "smap"},
 		nil,
 	)
+	pageSizeDesc = prometheus.NewDesc(
+		"lmdb_page_size_bytes",
+		"Page size of LMDB database",
+		[]string{"lmdb"},
+		nil,
+	)
+	mapUsedBytesDesc = prometheus.NewDesc(
+		"lmdb_map_used_bytes",
+		"Bytes of the map in use by LMDB database up to the last used page, including free pages",
+		[]string{"lmdb"},
+		nil,
+	)
+	mapUsedFractionDesc = prometheus.NewDesc(
+		"lmdb_map_used_fraction",
+		"Bytes of the map in use by LMDB database as fraction (0-1) of map size",
+		[]string{"lmdb"},
+		nil,
+	)
+	freelistBytesDesc = prometheus.NewDesc(
+		"lmdb_freelist_bytes",
+		"Bytes in free pages in the freelist of LMDB database",
+		[]string{"lmdb"},
+		nil,
+	)
+	collectSuccessDesc = prometheus.NewDesc(
+		"lmdb_collect_success",
+		"1 if the statistics of LMDB database were collected successfully, 0 otherwise",
+		[]string{"lmdb"},
+		nil,
+	)
 )
 
 func lmdbFullPath(path string) (string, error) {
@@ -45,3 +45,46 @@ func TestCollector(t *testing.T) {
 		t.Errorf("returned error: %v", err)
 	}
 }
+
+func TestCollector_mapUsage(t *testing.T) {
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		c := NewCollector(false)
+		c.AddTarget("test", nil, env)
+		for name, check := range map[string]func(v float64) bool{
+			"lmdb_collect_success":   func(v float64) bool { return v == 0 || v == 1 },
+			"lmdb_page_size_bytes":   func(v float64) bool { return v > 0 },
+			"lmdb_map_used_bytes":    func(v float64) bool { return v > 0 },
+			"lmdb_map_used_fraction": func(v float64) bool { return v > 0 && v < 1 },
+		} {
+			v, err := collectGauge(c, name)
+			if err != nil {
+				return err
+			}
+			if !check(v) {
+				return fmt.Errorf("%s: unexpected value %v", name, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("returned error: %v", err)
+	}
+}
+
+// collectGauge returns the value of the only gauge with the given name
+func collectGauge(c prometheus.Collector, name string) (float64, error) {
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		return 0, err
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range families {
+		if f.GetName() == name && len(f.Metric) == 1 {
+			return f.Metric[0].GetGauge().GetValue(), nil
+		}
+	}
+	return 0, fmt.Errorf("%s: not found", name)
+}
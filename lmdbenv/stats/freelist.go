@@ -0,0 +1,66 @@
+package stats
+
+import (
+	"strconv"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/pkg/errors"
+)
+
+// freeDBI is the internal LMDB DBI that holds the freelist
+const freeDBI = lmdb.DBI(0)
+
+// Freelist describes the free pages of an LMDB
+type Freelist struct {
+	FreePages uint64 // pages in the freelist, like 'mdb_stat -f'
+	UsedPages uint64 // pages in use by the data file, including free pages
+}
+
+// Fragmentation returns the fraction (0-1) of the pages in the data file that
+// are free. Free pages are reused by new transactions, but LMDB never returns
+// them to the filesystem.
+func (f Freelist) Fragmentation() float64 {
+	if f.UsedPages == 0 {
+		return 0
+	}
+	return float64(f.FreePages) / float64(f.UsedPages)
+}
+
+// FreeBytes returns the size of the free pages for the given page size
+func (f Freelist) FreeBytes(psize uint) uint64 {
+	return f.FreePages * uint64(psize)
+}
+
+// ReadFreelist reads the freelist of the LMDB env of the transaction.
+// Some of these pages may still be in use by older read transactions.
+func ReadFreelist(env *lmdb.Env, txn *lmdb.Txn) (Freelist, error) {
+	info, err := env.Info()
+	if err != nil {
+		return Freelist{}, errors.Wrap(err, "env info")
+	}
+	f := Freelist{
+		UsedPages: uint64(info.LastPNO) + 1,
+	}
+
+	c, err := txn.OpenCursor(freeDBI)
+	if err != nil {
+		return f, errors.Wrap(err, "open freelist cursor")
+	}
+	defer c.Close()
+
+	// Every value is a list of page numbers, prefixed with their count
+	pgnoSize := strconv.IntSize / 8
+	for {
+		_, val, err := c.Get(nil, nil, lmdb.Next)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				break
+			}
+			return f, errors.Wrap(err, "freelist next")
+		}
+		if n := len(val)/pgnoSize - 1; n > 0 {
+			f.FreePages += uint64(n)
+		}
+	}
+	return f, nil
+}
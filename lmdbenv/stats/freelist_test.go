@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+)
+
+func TestReadFreelist(t *testing.T) {
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		readFreelist := func() (f Freelist) {
+			err := env.View(func(txn *lmdb.Txn) (err error) {
+				f, err = ReadFreelist(env, txn)
+				return err
+			})
+			require.NoError(t, err)
+			return f
+		}
+
+		// Fill and empty a DBI in separate transactions, which leaves the
+		// pages in the freelist.
+		val := make([]byte, 1000)
+		err := env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.CreateDBI("foo")
+			require.NoError(t, err)
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, txn.Put(dbi, []byte(fmt.Sprintf("key-%04d", i)), val, 0))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		full := readFreelist()
+		assert.Greater(t, full.UsedPages, uint64(250))
+
+		for i := 0; i < 3; i++ {
+			err = env.Update(func(txn *lmdb.Txn) error {
+				dbi, err := txn.OpenDBI("foo", 0)
+				require.NoError(t, err)
+				return txn.Drop(dbi, false)
+			})
+			require.NoError(t, err)
+		}
+		empty := readFreelist()
+		assert.Greater(t, empty.FreePages, uint64(250))
+		assert.Greater(t, empty.Fragmentation(), 0.5)
+		assert.LessOrEqual(t, empty.Fragmentation(), 1.0)
+		assert.Equal(t, empty.FreePages*4096, empty.FreeBytes(4096))
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -2,6 +2,7 @@
 package stats
 
 import (
+	"math"
 	"os"
 
 	"github.com/PowerDNS/lmdb-go/lmdb"
@@ -53,6 +54,16 @@ func Log(env *lmdb.Env, dbnames []string, withSmaps bool, log logrus.FieldLogger
 				}
 			}
 
+			freelist, err := ReadFreelist(env, txn)
+			if err != nil {
+				return errors.Wrap(err, "freelist")
+			}
+			log.WithFields(logrus.Fields{
+				"free_pages":    freelist.FreePages,
+				"used_pages":    freelist.UsedPages,
+				"fragmentation": math.Round(100*freelist.Fragmentation()) / 100,
+			}).Info("LMDB freelist")
+
 			for _, dbname := range dbnames {
 				dbi, err := txn.OpenDBI(dbname, 0)
 				if err != nil {
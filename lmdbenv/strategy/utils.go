@@ -13,6 +13,8 @@ const LMDBMaxKeySize = 511
 
 const LMDBIntegerKeyFlag = 0x08 // not defined in Go bindings
 
+const LMDBReverseKeyFlag = 0x02 // not defined in Go bindings
+
 // iterBothFunc is the callback called by iterBoth.
 // Here 'db' refers to LMDB and 'it' to the Iterator with data we want to insert.
 // It is called with the key of the side that's behind, or both if they are equal.
@@ -21,15 +23,8 @@ type iterBothFunc func(itKey, dbKey, dbVal []byte, itEOF, dbEOF bool) error
 
 // iterBoth iterates over both LMDB and the Iterator and calls the callback
 // function with the values.
-// Set integerKey=true if the MDB_INTEGERKEY flag is set on the DBI.
-func iterBoth(it Iterator, c *lmdb.Cursor, integerKey bool, f iterBothFunc) error {
-	var cmpFunc func(a, b []byte) int
-	if integerKey && isLittleEndian {
-		cmpFunc = cmpIntegerLittleEndian
-	} else {
-		cmpFunc = bytes.Compare
-	}
-
+// The cmpFunc must match the key order of the DBI, see keyCompareFunc.
+func iterBoth(it Iterator, c *lmdb.Cursor, cmpFunc func(a, b []byte) int, f iterBothFunc) error {
 	itEOF := false
 	dbEOF := false
 	var itKey, dbKey, dbVal []byte
@@ -116,6 +111,41 @@ func iterBoth(it Iterator, c *lmdb.Cursor, integerKey bool, f iterBothFunc) erro
 	}
 }
 
+// keyCompareFunc returns the compare function that matches the key order of
+// a DBI with given flags.
+func keyCompareFunc(flags uint) func(a, b []byte) int {
+	switch {
+	case flags&LMDBIntegerKeyFlag > 0 && isLittleEndian:
+		return cmpIntegerLittleEndian
+	case flags&LMDBReverseKeyFlag > 0:
+		return cmpReverse
+	default:
+		return bytes.Compare
+	}
+}
+
+// cmpReverse compares the data starting at the last byte, like LMDB does for
+// MDB_REVERSEKEY DBIs.
+func cmpReverse(a, b []byte) int {
+	i, j := len(a)-1, len(b)-1
+	for ; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if a[i] != b[j] {
+			if a[i] < b[j] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
 // cmpIntegerLittleEndian is a compare function that interprets the data as a little endian
 func cmpIntegerLittleEndian(a, b []byte) int {
 	ai := bytesToInt(a)
@@ -22,3 +22,26 @@ func Test_cmpIntegerLittleEndian(t *testing.T) {
 		})
 	}
 }
+
+func Test_cmpReverse(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []byte
+		b    []byte
+		want int
+	}{
+		{"same", []byte("abc"), []byte("abc"), 0},
+		{"gt", []byte("ab"), []byte("ba"), 1},
+		{"lt", []byte("ba"), []byte("ab"), -1},
+		{"shorter", []byte("bc"), []byte("abc"), -1},
+		{"longer", []byte("abc"), []byte("bc"), 1},
+		{"empty", []byte{}, []byte("a"), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cmpReverse(tt.a, tt.b); got != tt.want {
+				t.Errorf("cmpReverse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+// Package sidecar integrates Lightning Stream with the pod lifecycle when it
+// runs as a sidecar container next to PowerDNS in Kubernetes:
+//
+//   - A ready file is created while the /readyz checks pass and removed when
+//     they fail or on shutdown, so that the readiness or startup probe of the
+//     PowerDNS container can check for it on a shared volume.
+//   - PowerDNS is notified when remote snapshots changed the data, with a
+//     signal to its process (this requires shareProcessNamespace in the pod)
+//     and/or an HTTP request to its API.
+//   - The /prestop endpoint, for a preStop hook, stores the local changes
+//     in a snapshot and waits for it, before Kubernetes sends the SIGTERM.
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/status/readiness"
+)
+
+const (
+	// DefaultReadyFileInterval is the default interval between readiness
+	// checks for the ready file
+	DefaultReadyFileInterval = time.Second
+
+	// DefaultPreStopTimeout is the default time the /prestop endpoint waits
+	// for the local changes to be stored
+	DefaultPreStopTimeout = 30 * time.Second
+
+	// DefaultNotifyDelay is the default time to wait for more changes before
+	// notifying PowerDNS
+	DefaultNotifyDelay = time.Second
+
+	// DefaultNotifyTimeout is the default timeout of a notification request
+	DefaultNotifyTimeout = 10 * time.Second
+
+	// PreStopPath is the path of the preStop endpoint
+	PreStopPath = "/prestop"
+)
+
+// Signals are the signals that can be sent to notify a process
+var Signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+var metricNotify = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "lightningstream_sidecar_notify_total",
+		Help: "Number of change notifications, by method (signal or http) and result",
+	},
+	[]string{"method", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(metricNotify)
+}
+
+// Config configures the sidecar mode
+type Config struct {
+	// ReadyFile is created while this instance is ready, and removed when
+	// not, e.g. '/run/lightningstream/ready' on an emptyDir volume.
+	ReadyFile         string        `yaml:"ready_file"`
+	ReadyFileInterval time.Duration `yaml:"ready_file_interval"`
+
+	// PreStop enables the /prestop endpoint on the HTTP server. It waits at
+	// most PreStopTimeout for the local changes to be stored.
+	PreStop        bool          `yaml:"prestop"`
+	PreStopTimeout time.Duration `yaml:"prestop_timeout"`
+
+	// Notify configures the notification of PowerDNS on data changes
+	Notify Notify `yaml:"notify"`
+}
+
+// Notify configures the notification of the main container when remote
+// snapshots changed the data. Changes within Delay are combined into one
+// notification.
+type Notify struct {
+	// Process is the name of the process to send Signal to (default
+	// SIGHUP), as shown in /proc/PID/comm, e.g. 'pdns_server'.
+	Process string `yaml:"process"`
+	Signal  string `yaml:"signal"`
+
+	// URL is requested with Method (default POST) and Headers, e.g. a
+	// PowerDNS API call with an X-API-Key header.
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+
+	Delay time.Duration `yaml:"delay"`
+}
+
+// Enabled returns true if any notification is configured
+func (n Notify) Enabled() bool {
+	return n.Process != "" || n.URL != ""
+}
+
+// Check validates the config
+func (c Config) Check() error {
+	if c.ReadyFileInterval < 0 {
+		return fmt.Errorf("ready_file_interval: must not be negative")
+	}
+	if c.PreStopTimeout < 0 {
+		return fmt.Errorf("prestop_timeout: must not be negative")
+	}
+	n := c.Notify
+	if n.Signal != "" {
+		if _, ok := Signals[n.Signal]; !ok {
+			return fmt.Errorf("notify.signal: must be SIGHUP, SIGUSR1 or SIGUSR2")
+		}
+		if n.Process == "" {
+			return fmt.Errorf("notify.signal: requires notify.process")
+		}
+	}
+	if n.URL != "" {
+		u, err := url.Parse(n.URL)
+		if err != nil {
+			return fmt.Errorf("notify.url: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("notify.url: unsupported scheme %q", u.Scheme)
+		}
+	}
+	if n.Timeout < 0 || n.Delay < 0 {
+		return fmt.Errorf("notify: timeout and delay must not be negative")
+	}
+	return nil
+}
+
+var (
+	mu      sync.Mutex
+	changed chan string // nil if notifications are disabled
+)
+
+// Start starts the ready file updates and the notifications until the
+// context is cancelled. The ready file is removed when the context is
+// cancelled.
+func Start(ctx context.Context, c Config) {
+	if c.ReadyFileInterval == 0 {
+		c.ReadyFileInterval = DefaultReadyFileInterval
+	}
+	n := c.Notify
+	if n.Signal == "" {
+		n.Signal = "SIGHUP"
+	}
+	if n.Method == "" {
+		n.Method = http.MethodPost
+	}
+	if n.Timeout == 0 {
+		n.Timeout = DefaultNotifyTimeout
+	}
+	if n.Delay == 0 {
+		n.Delay = DefaultNotifyDelay
+	}
+
+	l := logrus.WithField("component", "sidecar")
+	if c.ReadyFile != "" {
+		l.WithField("ready_file", c.ReadyFile).Info("Sidecar ready file enabled")
+		go runReadyFile(ctx, l, c.ReadyFile, c.ReadyFileInterval)
+	}
+	if n.Enabled() {
+		ch := make(chan string, 1)
+		mu.Lock()
+		changed = ch
+		mu.Unlock()
+		l.WithField("process", n.Process).WithField("url", n.URL).
+			Info("Sidecar change notifications enabled")
+		go runNotify(ctx, l, n, ch)
+	}
+}
+
+// Changed reports that a remote snapshot changed the data of an LMDB. It
+// never blocks.
+func Changed(lmdb string) {
+	mu.Lock()
+	ch := changed
+	mu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- lmdb:
+	default: // a notification is already pending
+	}
+}
+
+// runReadyFile creates or removes the ready file at every interval
+func runReadyFile(ctx context.Context, l logrus.FieldLogger, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	wasReady := false
+	for {
+		ready := len(readiness.Check()) == 0
+		if err := setReadyFile(path, ready); err != nil {
+			l.WithError(err).Error("Cannot update the ready file")
+		} else if ready != wasReady {
+			l.WithField("ready", ready).Info("Updated the ready file")
+			wasReady = ready
+		}
+		select {
+		case <-ctx.Done():
+			if err := setReadyFile(path, false); err != nil {
+				l.WithError(err).Error("Cannot remove the ready file")
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setReadyFile creates or removes the ready file
+func setReadyFile(path string, ready bool) error {
+	if !ready {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, []byte("ready\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runNotify sends a notification for every batch of changes
+func runNotify(ctx context.Context, l logrus.FieldLogger, n Notify, ch <-chan string) {
+	client := &http.Client{Timeout: n.Timeout}
+	for {
+		var lmdbs []string
+		select {
+		case <-ctx.Done():
+			return
+		case name := <-ch:
+			lmdbs = append(lmdbs, name)
+		}
+		// Combine the changes within the delay
+		t := time.NewTimer(n.Delay)
+	collect:
+		for {
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case name := <-ch:
+				lmdbs = append(lmdbs, name)
+			case <-t.C:
+				break collect
+			}
+		}
+		l := l.WithField("lmdbs", strings.Join(lmdbs, ","))
+		if n.Process != "" {
+			notifySignal(l, n.Process, Signals[n.Signal])
+		}
+		if n.URL != "" {
+			notifyHTTP(ctx, l, client, n)
+		}
+	}
+}
+
+// notifySignal sends a signal to all processes with the given name
+func notifySignal(l logrus.FieldLogger, process string, sig syscall.Signal) {
+	pids, err := findProcesses("/proc", process)
+	if err == nil && len(pids) == 0 {
+		err = fmt.Errorf("process %q not found", process)
+	}
+	for _, pid := range pids {
+		if err2 := syscall.Kill(pid, sig); err2 != nil {
+			err = err2
+		}
+	}
+	if err != nil {
+		metricNotify.WithLabelValues("signal", "error").Inc()
+		l.WithError(err).Warn("Cannot signal the process about changes")
+		return
+	}
+	metricNotify.WithLabelValues("signal", "ok").Inc()
+	l.WithField("pids", pids).WithField("signal", sig).Debug("Signalled process about changes")
+}
+
+// notifyHTTP sends the configured HTTP request
+func notifyHTTP(ctx context.Context, l logrus.FieldLogger, client *http.Client, n Notify) {
+	err := func() error {
+		req, err := http.NewRequestWithContext(ctx, n.Method, n.URL, nil)
+		if err != nil {
+			return err
+		}
+		for k, v := range n.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		metricNotify.WithLabelValues("http", "error").Inc()
+		l.WithError(err).Warn("Change notification request failed")
+		return
+	}
+	metricNotify.WithLabelValues("http", "ok").Inc()
+	l.Debug("Sent change notification request")
+}
+
+// findProcesses returns the PIDs of the processes with the given name,
+// other than our own
+func findProcesses(procDir, name string) ([]int, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, e := range entries {
+		var pid int
+		if _, err := fmt.Sscanf(e.Name(), "%d", &pid); err != nil || pid == self {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(procDir, e.Name(), "comm"))
+		if err != nil {
+			continue // process exited
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// PreStopHandler returns the handler of the /prestop endpoint. It calls flush
+// and responds once it returns, with a 500 status if it failed.
+func PreStopHandler(timeout time.Duration, flush func(ctx context.Context) error) http.Handler {
+	if timeout == 0 {
+		timeout = DefaultPreStopTimeout
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		l := logrus.WithField("component", "sidecar")
+		l.Info("PreStop hook called, storing local changes")
+		if err := flush(ctx); err != nil {
+			l.WithError(err).Error("PreStop flush failed")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l.Info("PreStop flush done")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
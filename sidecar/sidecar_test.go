@@ -0,0 +1,139 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"powerdns.com/platform/lightningstream/status/readiness"
+)
+
+func TestConfig_Check(t *testing.T) {
+	assert.NoError(t, Config{}.Check())
+	assert.NoError(t, Config{Notify: Notify{Process: "pdns_server", Signal: "SIGUSR1"}}.Check())
+	assert.NoError(t, Config{Notify: Notify{URL: "http://127.0.0.1:8081/api/v1/servers/localhost/cache/flush?domain=."}}.Check())
+	assert.Error(t, Config{Notify: Notify{Process: "pdns_server", Signal: "SIGKILL"}}.Check())
+	assert.Error(t, Config{Notify: Notify{Signal: "SIGHUP"}}.Check())
+	assert.Error(t, Config{Notify: Notify{URL: "ftp://localhost"}}.Check())
+	assert.Error(t, Config{ReadyFileInterval: -time.Second}.Check())
+}
+
+func TestReadyFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	path := filepath.Join(t.TempDir(), "ready")
+	var ready atomic.Bool
+	readiness.Register("sidecar_test", func() error {
+		if !ready.Load() {
+			return errors.New("not ready")
+		}
+		return nil
+	})
+	defer readiness.Deregister("sidecar_test")
+
+	done := make(chan struct{})
+	go func() {
+		runReadyFile(ctx, logrus.StandardLogger(), path, time.Millisecond)
+		close(done)
+	}()
+	exists := func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, exists())
+
+	ready.Store(true)
+	require.Eventually(t, exists, time.Second, time.Millisecond)
+	ready.Store(false)
+	require.Eventually(t, func() bool { return !exists() }, time.Second, time.Millisecond)
+
+	// Removed on shutdown
+	ready.Store(true)
+	require.Eventually(t, exists, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.False(t, exists())
+}
+
+func TestFindProcesses(t *testing.T) {
+	proc := t.TempDir()
+	for pid, comm := range map[string]string{
+		"1":    "tini",
+		"7":    "pdns_server",
+		"12":   "pdns_server",
+		"self": "lightningstream",
+	} {
+		require.NoError(t, os.Mkdir(filepath.Join(proc, pid), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(proc, pid, "comm"), []byte(comm+"\n"), 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(proc, "99"), 0755)) // exited
+
+	pids, err := findProcesses(proc, "pdns_server")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{7, 12}, pids)
+}
+
+func TestNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan *http.Request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer srv.Close()
+
+	Start(ctx, Config{Notify: Notify{
+		URL:     srv.URL + "/api/v1/servers/localhost/cache/flush?domain=.",
+		Method:  http.MethodPut,
+		Headers: map[string]string{"X-API-Key": "secret"},
+		Delay:   20 * time.Millisecond,
+	}})
+	defer func() {
+		mu.Lock()
+		changed = nil
+		mu.Unlock()
+	}()
+
+	// Changes within the delay are combined
+	Changed("main")
+	Changed("main")
+	Changed("other")
+	r := <-requests
+	assert.Equal(t, http.MethodPut, r.Method)
+	assert.Equal(t, "/api/v1/servers/localhost/cache/flush", r.URL.Path)
+	assert.Equal(t, "secret", r.Header.Get("X-API-Key"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, requests, 0)
+
+	Changed("main")
+	<-requests
+}
+
+func TestPreStopHandler(t *testing.T) {
+	var flushErr error
+	h := PreStopHandler(time.Second, func(ctx context.Context) error {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		return flushErr
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, PreStopPath, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	flushErr = errors.New("main: sending is paused")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, PreStopPath, nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "sending is paused")
+}
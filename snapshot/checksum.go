@@ -0,0 +1,247 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/CrowdStrike/csproto"
+)
+
+// Protobuf field numbers of a DBIChecksum
+const (
+	FieldDBIChecksumName   = 1
+	FieldDBIChecksumSHA256 = 2
+	FieldDBIChecksumChunks = 3
+)
+
+// DBIChecksum is the SHA-256 checksum of all DBI messages with the same name
+// in a snapshot, as stored in the Meta.
+//
+// With a hash tree (StreamWriter.HashTree), Chunks has the SHA-256 checksum
+// of every DBI message of the DBI in order. Every message holds a range of
+// keys, so a receiver can compare these with the chunks of a snapshot it
+// already loaded to find the key ranges that changed.
+type DBIChecksum struct {
+	Name   string
+	SHA256 []byte
+	Chunks [][]byte
+}
+
+func (c *DBIChecksum) Marshal() []byte {
+	b := make([]byte, 0, len(c.Name)+len(c.SHA256)+20)
+	var tmp [16]byte
+	n := csproto.EncodeTag(tmp[:], FieldDBIChecksumName, csproto.WireTypeLengthDelimited)
+	n += csproto.EncodeVarint(tmp[n:], uint64(len(c.Name)))
+	b = append(b, tmp[:n]...)
+	b = append(b, c.Name...)
+	n = csproto.EncodeTag(tmp[:], FieldDBIChecksumSHA256, csproto.WireTypeLengthDelimited)
+	n += csproto.EncodeVarint(tmp[n:], uint64(len(c.SHA256)))
+	b = append(b, tmp[:n]...)
+	b = append(b, c.SHA256...)
+	for _, sum := range c.Chunks {
+		n = csproto.EncodeTag(tmp[:], FieldDBIChecksumChunks, csproto.WireTypeLengthDelimited)
+		n += csproto.EncodeVarint(tmp[n:], uint64(len(sum)))
+		b = append(b, tmp[:n]...)
+		b = append(b, sum...)
+	}
+	return b
+}
+
+func (c *DBIChecksum) Unmarshal(data []byte) error {
+	d := csproto.NewDecoder(data)
+	d.SetMode(csproto.DecoderModeFast)
+	for d.More() {
+		tag, wireType, err := d.DecodeTag()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case FieldDBIChecksumName:
+			c.Name, err = getString(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+		case FieldDBIChecksumSHA256:
+			sum, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			c.SHA256 = append([]byte(nil), sum...)
+		case FieldDBIChecksumChunks:
+			sum, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			c.Chunks = append(c.Chunks, append([]byte(nil), sum...))
+		default:
+			if _, err := d.Skip(tag, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checksummer calculates the checksums of the DBI messages in a snapshot.
+// The whole data checksum covers the length and contents of every DBI
+// message in order. A DBI can be split over multiple consecutive messages,
+// which are all covered by the checksum for that DBI name.
+//
+// If chunks is set, the checksum of every message is recorded as well. The
+// messages of the DBIs in skipped are only partially present, and are only
+// checked against the chunk checksums.
+type checksummer struct {
+	data    hash.Hash
+	dbi     hash.Hash
+	name    string
+	dbis    []DBIChecksum
+	chunks  bool
+	skipped map[string][][]byte // chunk checksums by DBI name
+}
+
+func newChecksummer() *checksummer {
+	return &checksummer{
+		data: sha256.New(),
+		dbi:  sha256.New(),
+	}
+}
+
+// setSkipped sets the DBIs left out of a partial snapshot
+func (c *checksummer) setSkipped(skipped []string) {
+	c.skipped = make(map[string][][]byte, len(skipped))
+	for _, name := range skipped {
+		c.skipped[name] = nil
+	}
+}
+
+// add adds a marshalled DBI message
+func (c *checksummer) add(name string, msg []byte) {
+	if chunks, isSkipped := c.skipped[name]; isSkipped {
+		sum := sha256.Sum256(msg)
+		c.skipped[name] = append(chunks, sum[:])
+		return
+	}
+	if len(c.dbis) == 0 || name != c.name {
+		c.endDBI()
+		c.name = name
+		c.dbis = append(c.dbis, DBIChecksum{Name: name})
+	}
+	var b [16]byte
+	n := csproto.EncodeVarint(b[:], uint64(len(msg)))
+	for _, h := range []hash.Hash{c.data, c.dbi} {
+		_, _ = h.Write(b[:n])
+		_, _ = h.Write(msg)
+	}
+	if c.chunks {
+		sum := sha256.Sum256(msg)
+		last := &c.dbis[len(c.dbis)-1]
+		last.Chunks = append(last.Chunks, sum[:])
+	}
+}
+
+// endDBI sets the checksum of the last DBI
+func (c *checksummer) endDBI() {
+	if len(c.dbis) == 0 {
+		return
+	}
+	last := &c.dbis[len(c.dbis)-1]
+	if last.SHA256 == nil {
+		last.SHA256 = c.dbi.Sum(nil)
+	}
+	c.dbi.Reset()
+}
+
+// sums returns the whole data checksum and the checksum for every DBI
+func (c *checksummer) sums() ([]byte, []DBIChecksum) {
+	c.endDBI()
+	return c.data.Sum(nil), c.dbis
+}
+
+// verify compares the checksums calculated with the ones from the Meta.
+// Snapshots written before checksums were introduced do not have any, in
+// which case checked is false.
+// The skipped DBIs of a partial snapshot are not expected, and the whole data
+// checksum cannot be verified for these. Any messages of skipped DBIs must
+// match one of the chunk checksums of their DBI.
+func (c *checksummer) verify(m Meta, skipped []string) (checked bool, err error) {
+	if len(m.DataSHA256) == 0 {
+		return false, nil
+	}
+	data, dbis := c.sums()
+	expectedDBIs := m.DBIChecksums
+	if len(skipped) > 0 {
+		isSkipped := make(map[string]bool, len(skipped))
+		for _, name := range skipped {
+			isSkipped[name] = true
+		}
+		expectedDBIs = nil
+		for _, expected := range m.DBIChecksums {
+			if !isSkipped[expected.Name] {
+				expectedDBIs = append(expectedDBIs, expected)
+			}
+		}
+	}
+	if len(dbis) != len(expectedDBIs) {
+		return true, fmt.Errorf("checksum mismatch: %d DBIs, expected %d",
+			len(dbis), len(expectedDBIs))
+	}
+	for i, expected := range expectedDBIs {
+		if dbis[i].Name != expected.Name {
+			return true, fmt.Errorf("checksum mismatch: DBI %q, expected %q",
+				dbis[i].Name, expected.Name)
+		}
+		if !bytes.Equal(dbis[i].SHA256, expected.SHA256) {
+			return true, fmt.Errorf("checksum mismatch for DBI %q", expected.Name)
+		}
+	}
+	if len(skipped) == 0 && !bytes.Equal(data, m.DataSHA256) {
+		return true, fmt.Errorf("checksum mismatch for snapshot data")
+	}
+	for name, chunks := range c.skipped {
+		if len(chunks) == 0 {
+			continue
+		}
+		expected := make(map[string]bool)
+		for _, dbi := range m.DBIChecksums {
+			if dbi.Name == name {
+				for _, sum := range dbi.Chunks {
+					expected[string(sum)] = true
+				}
+			}
+		}
+		for _, sum := range chunks {
+			if !expected[string(sum)] {
+				return true, fmt.Errorf("checksum mismatch for a chunk of DBI %q", name)
+			}
+		}
+	}
+	return true, nil
+}
+
+// Verify reads the whole snapshot and checks the checksums stored in it.
+// It returns an ErrCorrupt error if the snapshot cannot be decoded, or if
+// the checksums do not match. For older snapshots without checksums, checked
+// is false, but the snapshot is still fully decoded.
+// If v is not nil, the signature is verified as well, and an ErrBadSignature
+// error is returned if it is missing or invalid.
+func Verify(data []byte, v *Verifier, dicts ...[]byte) (checked bool, err error) {
+	sr, err := NewStreamReader(data, dicts...)
+	if err != nil {
+		return false, err
+	}
+	sr.Verifier = v
+	defer func() {
+		_ = sr.Close()
+	}()
+	for {
+		if _, err := sr.Next(); err != nil {
+			if err == io.EOF {
+				return sr.Checked, nil
+			}
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Supported compression types
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+	CompressionNone = "none"
+)
+
+var (
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicLZ4  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// isProtobufStart returns true if the data starts with the tag of one of the
+// top level Snapshot fields, which means that it is not compressed.
+func isProtobufStart(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	switch data[0] {
+	case 0x08, 0x12, 0x1a, 0x20, 0x2a: // fields 1-5, see FieldSnapshotFormatVersion
+		return true
+	}
+	return false
+}
+
+// DetectCompression returns the compression type of snapshot data based on
+// its magic bytes, or an empty string if it is not recognized. For framed
+// snapshots this returns the compression of the first block.
+func DetectCompression(data []byte) string {
+	if IsFramed(data) {
+		data = firstFramedPayload(data)
+	}
+	switch {
+	case bytes.HasPrefix(data, magicGzip):
+		return CompressionGzip
+	case bytes.HasPrefix(data, magicZstd):
+		return CompressionZstd
+	case bytes.HasPrefix(data, magicLZ4):
+		return CompressionLZ4
+	case isProtobufStart(data):
+		return CompressionNone
+	}
+	return ""
+}
+
+// Compression describes how snapshots are compressed.
+// The zero value uses gzip at its fastest level, which was the only
+// supported compression before zstd support was added.
+type Compression struct {
+	// Type is the compression type, "gzip" (default), "zstd", "lz4" or
+	// "none".
+	Type string
+
+	// Level is the compression level, 0 for the default. For gzip this is
+	// -2-9 with a default of 1, where -1 is the gzip default level and -2 is
+	// Huffman only. For zstd this is 1-22 with a default of 3.
+	// For lz4 the default is its fast mode, and 1-9 select its slower high
+	// compression mode.
+	Level int
+
+	// Dictionary is an optional zstd dictionary to compress with. Any
+	// instance that loads these snapshots must have the same dictionary.
+	Dictionary []byte
+
+	// Framed writes framed snapshots, in which every DBI chunk is compressed
+	// independently and can be read on its own, see FramedReader.
+	Framed bool
+}
+
+// Check validates the compression settings
+func (c Compression) Check() error {
+	switch c.Type {
+	case "", CompressionGzip:
+		if c.Level < gzip.HuffmanOnly || c.Level > gzip.BestCompression {
+			return fmt.Errorf("gzip compression level must be between -2 and 9")
+		}
+		if len(c.Dictionary) > 0 {
+			return fmt.Errorf("dictionary is only supported for zstd compression")
+		}
+	case CompressionZstd:
+		if c.Level < 0 || c.Level > 22 {
+			return fmt.Errorf("zstd compression level must be between 1 and 22")
+		}
+	case CompressionLZ4:
+		if c.Level < 0 || c.Level > 9 {
+			return fmt.Errorf("lz4 compression level must be between 1 and 9")
+		}
+		if len(c.Dictionary) > 0 {
+			return fmt.Errorf("dictionary is only supported for zstd compression")
+		}
+	case CompressionNone:
+		if c.Level != 0 {
+			return fmt.Errorf("compression level is not supported without compression")
+		}
+		if len(c.Dictionary) > 0 {
+			return fmt.Errorf("dictionary is only supported for zstd compression")
+		}
+	default:
+		return fmt.Errorf("unsupported compression type: %q", c.Type)
+	}
+	return nil
+}
+
+// Extension returns the snapshot filename extension for this compression
+func (c Compression) Extension() string {
+	switch c.Type {
+	case CompressionZstd:
+		return ExtensionZstd
+	case CompressionLZ4:
+		return ExtensionLZ4
+	case CompressionNone:
+		return ExtensionNone
+	}
+	return ExtensionGzip
+}
+
+// newWriter returns a compressing writer
+func (c Compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Type {
+	case "", CompressionGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.BestSpeed
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if c.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		opts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+		if len(c.Dictionary) > 0 {
+			opts = append(opts, zstd.WithEncoderDict(c.Dictionary))
+		}
+		return zstd.NewWriter(w, opts...)
+	case CompressionLZ4:
+		level := lz4.Fast
+		if c.Level > 0 {
+			level = lz4.CompressionLevel(1 << (8 + c.Level)) // lz4.Level1 to lz4.Level9
+		}
+		zw := lz4.NewWriter(w)
+		if err := zw.Apply(lz4.CompressionLevelOption(level)); err != nil {
+			return nil, err
+		}
+		return zw, nil
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression type: %q", c.Type)
+	}
+}
+
+// newReader returns a reader for the protobuf data of a snapshot, based on
+// the magic bytes at the start of the data, which can be compressed or framed.
+// The dicts are zstd dictionaries that may have been used to compress the data.
+func newReader(data []byte, dicts [][]byte) (io.ReadCloser, error) {
+	if IsFramed(data) {
+		return newFramedStreamReader(data, dicts)
+	}
+	return newDecompressor(data, dicts)
+}
+
+// newDecompressor returns a decompressing reader for the compressed data,
+// based on the magic bytes at the start of the data.
+func newDecompressor(data []byte, dicts [][]byte) (io.ReadCloser, error) {
+	r := bytes.NewReader(data)
+	switch {
+	case bytes.HasPrefix(data, magicGzip):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(data, magicZstd):
+		var opts []zstd.DOption
+		for _, dict := range dicts {
+			if len(dict) > 0 {
+				opts = append(opts, zstd.WithDecoderDicts(dict))
+			}
+		}
+		zr, err := zstd.NewReader(r, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(data, magicLZ4):
+		return io.NopCloser(lz4.NewReader(r)), nil
+	case isProtobufStart(data):
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown snapshot compression")
+	}
+}
+
+// nopWriteCloser writes data uncompressed
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
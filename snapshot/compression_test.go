@@ -0,0 +1,127 @@
+package snapshot
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpDataCompression_roundtrip(t *testing.T) {
+	// Dictionary built from test snapshots with zstd.BuildDict
+	dict, err := os.ReadFile("testdata/zstd.dict")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		c     Compression
+		magic []byte
+	}{
+		{"default", Compression{}, magicGzip},
+		{"gzip-9", Compression{Type: CompressionGzip, Level: 9}, magicGzip},
+		{"gzip-huffman", Compression{Type: CompressionGzip, Level: -2}, magicGzip},
+		{"zstd", Compression{Type: CompressionZstd}, magicZstd},
+		{"zstd-19", Compression{Type: CompressionZstd, Level: 19}, magicZstd},
+		{"zstd-dict", Compression{Type: CompressionZstd, Dictionary: dict}, magicZstd},
+		{"lz4", Compression{Type: CompressionLZ4}, magicLZ4},
+		{"lz4-9", Compression{Type: CompressionLZ4, Level: 9}, magicLZ4},
+		{"none", Compression{Type: CompressionNone}, []byte{0x08}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.c.Check())
+			origSnap := makeTestSnapshot(1000)
+			data, st, err := DumpDataCompression(origSnap, tt.c)
+			require.NoError(t, err)
+			assert.Equal(t, tt.magic, data[:len(tt.magic)])
+			assert.Equal(t, len(data), int(st.CompressedSize))
+			if tt.c.Type != "" {
+				assert.Equal(t, tt.c.Type, DetectCompression(data))
+			}
+
+			snap, err := LoadData(data, dict)
+			require.NoError(t, err)
+			assert.Equal(t, origSnap.Meta, snap.Meta)
+			require.Equal(t, 1, len(snap.Databases))
+			assert.Equal(t, origSnap.Databases[0].Marshal(), snap.Databases[0].Marshal())
+		})
+	}
+
+	// Cannot load without the dictionary
+	data, _, err := DumpDataCompression(makeTestSnapshot(10), Compression{
+		Type:       CompressionZstd,
+		Dictionary: dict,
+	})
+	require.NoError(t, err)
+	_, err = LoadData(data)
+	assert.Error(t, err)
+
+	_, err = LoadData([]byte("invalid"))
+	assert.Error(t, err)
+}
+
+func TestCompression_Check(t *testing.T) {
+	assert.NoError(t, Compression{}.Check())
+	assert.Error(t, Compression{Type: "xz"}.Check())
+	assert.Error(t, Compression{Type: CompressionGzip, Level: 10}.Check())
+	assert.NoError(t, Compression{Type: CompressionGzip, Level: -2}.Check())
+	assert.Error(t, Compression{Type: CompressionGzip, Level: -3}.Check())
+	assert.Error(t, Compression{Type: CompressionZstd, Level: -1}.Check())
+	assert.Error(t, Compression{Type: CompressionGzip, Dictionary: []byte("x")}.Check())
+	assert.Error(t, Compression{Type: CompressionZstd, Level: 23}.Check())
+	assert.NoError(t, Compression{Type: CompressionNone}.Check())
+	assert.Error(t, Compression{Type: CompressionNone, Level: 1}.Check())
+	assert.NoError(t, Compression{Type: CompressionLZ4, Level: 9}.Check())
+	assert.Error(t, Compression{Type: CompressionLZ4, Level: 10}.Check())
+	assert.Error(t, Compression{Type: CompressionLZ4, Dictionary: []byte("x")}.Check())
+}
+
+func TestLoadData_lz4(t *testing.T) {
+	// Written by other tools, with the default lz4 options
+	origSnap := makeTestSnapshot(1000)
+	var buf bytes.Buffer
+	zw := lz4.NewWriter(&buf)
+	_, err := origSnap.WriteTo(zw)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	data := buf.Bytes()
+	assert.Equal(t, CompressionLZ4, DetectCompression(data))
+
+	snap, err := LoadData(data)
+	require.NoError(t, err)
+	assert.Equal(t, origSnap.Meta, snap.Meta)
+	require.Equal(t, 1, len(snap.Databases))
+	assert.Equal(t, origSnap.Databases[0].Marshal(), snap.Databases[0].Marshal())
+
+	assert.Equal(t, "", DetectCompression([]byte("invalid")))
+	assert.Equal(t, "", DetectCompression(nil))
+}
+
+func TestStreamWriter_compressionMeta(t *testing.T) {
+	for _, c := range []Compression{
+		{},
+		{Type: CompressionZstd},
+		{Type: CompressionLZ4},
+		{Type: CompressionLZ4, Framed: true},
+		{Type: CompressionNone},
+		{Type: CompressionNone, Framed: true},
+	} {
+		var buf bytes.Buffer
+		sw, err := NewStreamWriter(&buf, c, 1, 1)
+		require.NoError(t, err)
+		_, err = sw.Close(makeTestMeta())
+		require.NoError(t, err)
+
+		want := c.Type
+		if want == "" {
+			want = CompressionGzip
+		}
+		assert.Equal(t, want, DetectCompression(buf.Bytes()))
+		snap, err := LoadData(buf.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, want, snap.Meta.Compression)
+	}
+}
@@ -1,6 +1,7 @@
 package snapshot
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -136,6 +137,18 @@ func (d *DBI) doFlushFields() {
 	d.data = append(d.data, b[:offset]...)
 }
 
+// reset clears all data and sets new top-level fields, reusing the
+// allocated buffer.
+func (d *DBI) reset(name string, flags uint64, transform string) {
+	d.data = d.data[:0]
+	d.cur = 0
+	d.flushed = false
+	d.name = name
+	d.flags = flags
+	d.transform = transform
+	d.dirty = true
+}
+
 // ResetCursor resets the read cursor to the beginning of the buffer
 func (d *DBI) ResetCursor() {
 	d.cur = 0
@@ -400,6 +413,72 @@ func (d *DBI) Map(transform string, f KVMapFunc) (*DBI, error) {
 	return newDBI, nil
 }
 
+// Len returns the number of KV entries. This resets the read cursor.
+func (d *DBI) Len() (int, error) {
+	d.ResetCursor()
+	defer d.ResetCursor()
+	n := 0
+	for {
+		if _, err := d.Next(); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		n++
+	}
+}
+
+// Split splits the DBI after the first n entries, or after the first entry
+// with a different key after that, so that the entries of a key are never
+// split, like the StreamWriter does. The tail is nil if the DBI cannot be
+// split, in which case the DBI itself is returned as the head without
+// copying. Otherwise, both are copies with the same top-level fields.
+// This resets the read cursor.
+func (d *DBI) Split(n int) (head, tail *DBI, err error) {
+	// Find the index of the first entry of the tail
+	d.ResetCursor()
+	defer d.ResetCursor()
+	var lastKey []byte
+	splitAt := -1
+	for i := 0; splitAt < 0; i++ {
+		kv, err := d.Next()
+		if err == io.EOF {
+			return d, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if i > 0 && i >= n && !bytes.Equal(kv.Key, lastKey) {
+			splitAt = i
+		}
+		lastKey = kv.Key // points into the data
+	}
+
+	head = NewDBI()
+	tail = NewDBI()
+	for _, dbi := range []*DBI{head, tail} {
+		dbi.SetName(d.name)
+		dbi.SetFlags(d.flags)
+		dbi.SetTransform(d.transform)
+	}
+	d.ResetCursor()
+	for i := 0; ; i++ {
+		kv, err := d.Next()
+		if err == io.EOF {
+			return head, tail, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if i < splitAt {
+			head.Append(kv)
+		} else {
+			tail.Append(kv)
+		}
+	}
+}
+
 // AsInefficientKVList returns all KV entries as an inefficient []KV.
 // Only use this for tests.
 func (d *DBI) AsInefficientKVList() ([]KV, error) {
@@ -66,6 +66,60 @@ func TestDBI(t *testing.T) {
 	assert.Equal(t, io.EOF, err)
 }
 
+func TestDBI_Split(t *testing.T) {
+	d := makeTestDBI(10)
+	n, err := d.Len()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+
+	// No copy if it fits
+	head, tail, err := d.Split(10)
+	assert.NoError(t, err)
+	assert.Same(t, d, head)
+	assert.Nil(t, tail)
+
+	head, tail, err = d.Split(3)
+	assert.NoError(t, err)
+	for _, part := range []*DBI{head, tail} {
+		assert.Equal(t, "test-name", part.Name())
+		assert.Equal(t, "test-transform", part.Transform())
+		assert.Equal(t, uint64(42), part.Flags())
+	}
+	headKVs, err := head.AsInefficientKVList()
+	assert.NoError(t, err)
+	tailKVs, err := tail.AsInefficientKVList()
+	assert.NoError(t, err)
+	allKVs, err := d.AsInefficientKVList()
+	assert.NoError(t, err)
+	assert.Len(t, headKVs, 3)
+	assert.Len(t, tailKVs, 7)
+	assert.Equal(t, allKVs, append(headKVs, tailKVs...))
+
+	// The values of a key are not split
+	d = NewDBI()
+	for _, k := range []string{"a", "b", "b", "b", "c"} {
+		d.Append(KV{Key: []byte(k), Value: []byte("v")})
+	}
+	head, tail, err = d.Split(2)
+	assert.NoError(t, err)
+	headKVs, err = head.AsInefficientKVList()
+	assert.NoError(t, err)
+	assert.Len(t, headKVs, 4)
+	tailKVs, err = tail.AsInefficientKVList()
+	assert.NoError(t, err)
+	assert.Len(t, tailKVs, 1)
+
+	// No key boundary after n entries
+	d = NewDBI()
+	for i := 0; i < 3; i++ {
+		d.Append(KV{Key: []byte("b"), Value: []byte{byte(i)}})
+	}
+	head, tail, err = d.Split(1)
+	assert.NoError(t, err)
+	assert.Same(t, d, head)
+	assert.Nil(t, tail)
+}
+
 func BenchmarkDBI_Next(b *testing.B) {
 	d := makeTestDBI(1_000_000)
 	d.ResetCursor()
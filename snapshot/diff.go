@@ -0,0 +1,129 @@
+package snapshot
+
+import (
+	"bytes"
+	"io"
+	"sort"
+)
+
+// DiffKind describes how an entry differs between two snapshots
+type DiffKind string
+
+const (
+	DiffAdded     DiffKind = "added"     // only present in b
+	DiffRemoved   DiffKind = "removed"   // only present in a
+	DiffChanged   DiffKind = "changed"   // different value or flags
+	DiffTimestamp DiffKind = "timestamp" // only the timestamp differs
+)
+
+// DiffEntry is a single difference found by Diff. A and B are the entry as
+// found in each snapshot, and are zero if the entry was not present.
+type DiffEntry struct {
+	DBI  string
+	Kind DiffKind
+	A    KV
+	B    KV
+}
+
+// Diff compares the DBIs of two snapshots and calls f for every entry that
+// differs, ordered by DBI name and key. DBIs split over multiple messages are
+// compared as a whole. Entries of DBIs with the dupsort_native_v1 transform
+// are identified by both their key and value, all others by their key.
+func Diff(a, b []*DBI, f func(e DiffEntry) error) error {
+	entriesA, err := diffIndex(a)
+	if err != nil {
+		return err
+	}
+	entriesB, err := diffIndex(b)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range entriesA {
+		names = append(names, name)
+	}
+	for name := range entriesB {
+		if _, exists := entriesA[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ea, eb := entriesA[name], entriesB[name]
+		var ids []diffID
+		for id := range ea {
+			ids = append(ids, id)
+		}
+		for id := range eb {
+			if _, exists := ea[id]; !exists {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if c := bytes.Compare([]byte(ids[i].key), []byte(ids[j].key)); c != 0 {
+				return c < 0
+			}
+			return ids[i].value < ids[j].value
+		})
+
+		for _, id := range ids {
+			kvA, inA := ea[id]
+			kvB, inB := eb[id]
+			e := DiffEntry{DBI: name, A: kvA, B: kvB}
+			switch {
+			case !inA:
+				e.Kind = DiffAdded
+			case !inB:
+				e.Kind = DiffRemoved
+			case kvA.Flags != kvB.Flags || !bytes.Equal(kvA.Value, kvB.Value):
+				e.Kind = DiffChanged
+			case kvA.TimestampNano != kvB.TimestampNano:
+				e.Kind = DiffTimestamp
+			default:
+				continue // equal
+			}
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// diffID identifies an entry within a DBI
+type diffID struct {
+	key   string
+	value string // only set for dupsort_native_v1
+}
+
+// diffIndex indexes the entries of all DBIs by name and diffID.
+// The KVs refer to the DBI data, which is never modified after loading.
+func diffIndex(dbis []*DBI) (map[string]map[diffID]KV, error) {
+	index := make(map[string]map[diffID]KV)
+	for _, dbi := range dbis {
+		entries := index[dbi.Name()]
+		if entries == nil {
+			entries = make(map[diffID]KV)
+			index[dbi.Name()] = entries
+		}
+		native := dbi.Transform() == TransformDupSortNativeV1
+		dbi.ResetCursor()
+		for {
+			kv, err := dbi.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			id := diffID{key: string(kv.Key)}
+			if native {
+				id.value = string(kv.Value)
+			}
+			entries[id] = kv
+		}
+	}
+	return index, nil
+}
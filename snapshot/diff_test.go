@@ -0,0 +1,58 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	dbi := func(name, transform string, kvs ...KV) *DBI {
+		d := NewDBI()
+		d.SetName(name)
+		d.SetTransform(transform)
+		for _, kv := range kvs {
+			d.Append(kv)
+		}
+		return d
+	}
+	kv := func(k, v string, ts uint64, flags uint32) KV {
+		return KV{Key: []byte(k), Value: []byte(v), TimestampNano: ts, Flags: flags}
+	}
+
+	a := []*DBI{
+		dbi("foo", "", kv("a", "1", 1, 0), kv("b", "2", 1, 0)),
+		dbi("foo", "", kv("c", "3", 1, 0), kv("d", "4", 1, 0)), // second chunk
+		dbi("dup", TransformDupSortNativeV1, kv("k", "x", 1, 0), kv("k", "y", 1, 0)),
+		dbi("onlya", ""),
+	}
+	b := []*DBI{
+		dbi("dup", TransformDupSortNativeV1, kv("k", "y", 1, 0), kv("k", "z", 2, 0)),
+		dbi("foo", "", kv("a", "1", 1, 0), kv("b", "2", 2, 0), kv("c", "", 2, 1)),
+		dbi("foo", "", kv("e", "5", 2, 0)),
+	}
+
+	var res []string
+	err := Diff(a, b, func(e DiffEntry) error {
+		res = append(res, e.DBI+":"+string(e.Kind)+":"+string(e.A.Key)+string(e.B.Key)+
+			"="+string(e.A.Value)+string(e.B.Value))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"dup:removed:k=x",
+		"dup:added:k=z",
+		"foo:timestamp:bb=22",
+		"foo:changed:cc=3",
+		"foo:removed:d=4",
+		"foo:added:e=5",
+	}, res)
+
+	// Identical snapshots have no differences
+	err = Diff(a, a, func(e DiffEntry) error {
+		t.Errorf("unexpected difference: %+v", e)
+		return nil
+	})
+	require.NoError(t, err)
+}
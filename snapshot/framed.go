@@ -0,0 +1,774 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/CrowdStrike/csproto"
+)
+
+// A framed snapshot stores the same protobuf fields as a streamed snapshot,
+// but split into blocks that are compressed independently:
+//
+//	magic      "LSF2"
+//	blocks     block header followed by the compressed block payload
+//	index      FramedIndex protobuf, not compressed
+//	trailer    index size (uint32 LE) followed by "LSF2"
+//
+// A block header is the block kind (1 byte), the payload size (uint32 LE)
+// and the CRC-32C of the payload (uint32 LE). The first block holds the
+// format versions, every chunk of DBI entries written by the StreamWriter is
+// a block of its own, and the last block holds the Meta and Signature.
+//
+// The decompressed blocks concatenated are a regular snapshot protobuf, so a
+// StreamReader reads a framed snapshot like any other. The index allows
+// a FramedReader to fetch and decode only the blocks of a single DBI, for
+// example with range requests, and to decode blocks in parallel.
+//
+// A partial framed snapshot leaves out the blocks of some DBIs, which are
+// listed in the index. It is only created by FramedReader.Partial for a
+// reader that already has the data of these DBIs, and never stored.
+var magicFramed = []byte("LSF2")
+
+// ErrNotFramed is returned by NewFramedReader for snapshots that are not
+// framed snapshots
+var ErrNotFramed = errors.New("not a framed snapshot")
+
+const (
+	framedBlockHeaderSize = 9
+	framedTrailerSize     = 8
+)
+
+// BlockKind is the kind of data in a framed snapshot block
+type BlockKind uint8
+
+const (
+	BlockHeader BlockKind = 1 // format versions
+	BlockDBI    BlockKind = 2 // one DBI message
+	BlockMeta   BlockKind = 3 // Meta and Signature
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// IsFramed returns true if the snapshot file contents are a framed snapshot
+func IsFramed(data []byte) bool {
+	return bytes.HasPrefix(data, magicFramed)
+}
+
+// firstFramedPayload returns the (compressed) payload of the first block of
+// a framed snapshot, or nil if it is truncated
+func firstFramedPayload(data []byte) []byte {
+	data = data[len(magicFramed):]
+	if len(data) < framedBlockHeaderSize {
+		return nil
+	}
+	size := int64(binary.LittleEndian.Uint32(data[1:]))
+	if int64(len(data)-framedBlockHeaderSize) < size {
+		return nil
+	}
+	return data[framedBlockHeaderSize : framedBlockHeaderSize+size]
+}
+
+// Protobuf field numbers of the FramedIndex and FramedBlock
+const (
+	FieldFramedIndexBlock   = 1
+	FieldFramedIndexSkipped = 2
+
+	FieldFramedBlockKind             = 1
+	FieldFramedBlockName             = 2
+	FieldFramedBlockOffset           = 3
+	FieldFramedBlockSize             = 4
+	FieldFramedBlockCRC32C           = 5
+	FieldFramedBlockUncompressedSize = 6
+)
+
+// FramedBlock is the index entry of a block in a framed snapshot
+type FramedBlock struct {
+	Kind             BlockKind
+	Name             string // DBI name for BlockDBI
+	Offset           int64  // offset of the block header in the file
+	Size             int64  // size of the compressed payload
+	CRC32C           uint32 // checksum of the compressed payload
+	UncompressedSize int64
+}
+
+// FramedIndex is the index at the end of a framed snapshot
+type FramedIndex struct {
+	Blocks  []FramedBlock
+	Skipped []string // DBIs left out of a partial snapshot
+}
+
+func (idx *FramedIndex) Marshal() []byte {
+	var b []byte
+	var tmp [16]byte
+	for _, blk := range idx.Blocks {
+		pb := blk.Marshal()
+		n := csproto.EncodeTag(tmp[:], FieldFramedIndexBlock, csproto.WireTypeLengthDelimited)
+		n += csproto.EncodeVarint(tmp[n:], uint64(len(pb)))
+		b = append(b, tmp[:n]...)
+		b = append(b, pb...)
+	}
+	for _, name := range idx.Skipped {
+		n := csproto.EncodeTag(tmp[:], FieldFramedIndexSkipped, csproto.WireTypeLengthDelimited)
+		n += csproto.EncodeVarint(tmp[n:], uint64(len(name)))
+		b = append(b, tmp[:n]...)
+		b = append(b, name...)
+	}
+	return b
+}
+
+func (idx *FramedIndex) Unmarshal(data []byte) error {
+	d := csproto.NewDecoder(data)
+	d.SetMode(csproto.DecoderModeFast)
+	for d.More() {
+		tag, wireType, err := d.DecodeTag()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case FieldFramedIndexBlock:
+			msg, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			var blk FramedBlock
+			if err := blk.Unmarshal(msg); err != nil {
+				return err
+			}
+			idx.Blocks = append(idx.Blocks, blk)
+		case FieldFramedIndexSkipped:
+			name, err := getString(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			idx.Skipped = append(idx.Skipped, string([]byte(name)))
+		default:
+			if _, err := d.Skip(tag, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (blk *FramedBlock) Marshal() []byte {
+	b := make([]byte, 0, len(blk.Name)+64)
+	var tmp [16]byte
+	for _, f := range []struct {
+		tag int
+		val uint64
+	}{
+		{FieldFramedBlockKind, uint64(blk.Kind)},
+		{FieldFramedBlockOffset, uint64(blk.Offset)},
+		{FieldFramedBlockSize, uint64(blk.Size)},
+		{FieldFramedBlockCRC32C, uint64(blk.CRC32C)},
+		{FieldFramedBlockUncompressedSize, uint64(blk.UncompressedSize)},
+	} {
+		n := csproto.EncodeTag(tmp[:], f.tag, csproto.WireTypeVarint)
+		n += csproto.EncodeVarint(tmp[n:], f.val)
+		b = append(b, tmp[:n]...)
+	}
+	if blk.Name != "" {
+		n := csproto.EncodeTag(tmp[:], FieldFramedBlockName, csproto.WireTypeLengthDelimited)
+		n += csproto.EncodeVarint(tmp[n:], uint64(len(blk.Name)))
+		b = append(b, tmp[:n]...)
+		b = append(b, blk.Name...)
+	}
+	return b
+}
+
+func (blk *FramedBlock) Unmarshal(data []byte) error {
+	d := csproto.NewDecoder(data)
+	d.SetMode(csproto.DecoderModeFast)
+	for d.More() {
+		tag, wireType, err := d.DecodeTag()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case FieldFramedBlockName:
+			name, err := getString(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			blk.Name = string([]byte(name)) // do not refer to the index data
+		case FieldFramedBlockKind, FieldFramedBlockOffset, FieldFramedBlockSize,
+			FieldFramedBlockCRC32C, FieldFramedBlockUncompressedSize:
+			if err := expectWT(tag, wireType, csproto.WireTypeVarint); err != nil {
+				return err
+			}
+			val, err := d.DecodeUInt64()
+			if err != nil {
+				return err
+			}
+			switch tag {
+			case FieldFramedBlockKind:
+				blk.Kind = BlockKind(val)
+			case FieldFramedBlockOffset:
+				blk.Offset = int64(val)
+			case FieldFramedBlockSize:
+				blk.Size = int64(val)
+			case FieldFramedBlockCRC32C:
+				blk.CRC32C = uint32(val)
+			case FieldFramedBlockUncompressedSize:
+				blk.UncompressedSize = int64(val)
+			}
+		default:
+			if _, err := d.Skip(tag, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// framedWriter compresses the blocks of a framed snapshot. The compressor is
+// reused for all blocks.
+type framedWriter struct {
+	c     Compression
+	out   io.Writer
+	off   int64
+	block bytes.Buffer // uncompressed data of the current block
+	comp  bytes.Buffer // compressed data of the current block
+	zw    io.WriteCloser
+	index FramedIndex
+}
+
+func newFramedWriter(out io.Writer, c Compression) (*framedWriter, error) {
+	fw := &framedWriter{c: c, out: out}
+	n, err := out.Write(magicFramed)
+	fw.off += int64(n)
+	return fw, err
+}
+
+// endBlock compresses and writes the data written since the last block
+func (fw *framedWriter) endBlock(kind BlockKind, name string) error {
+	fw.comp.Reset()
+	if rw, ok := fw.zw.(interface{ Reset(io.Writer) }); ok {
+		rw.Reset(&fw.comp)
+	} else {
+		zw, err := fw.c.newWriter(&fw.comp)
+		if err != nil {
+			return err
+		}
+		fw.zw = zw
+	}
+	if _, err := fw.zw.Write(fw.block.Bytes()); err != nil {
+		return err
+	}
+	if err := fw.zw.Close(); err != nil {
+		return err
+	}
+	payload := fw.comp.Bytes()
+	if int64(len(payload)) > math.MaxUint32 {
+		return fmt.Errorf("snapshot block too large: %d bytes", len(payload))
+	}
+	blk := FramedBlock{
+		Kind:             kind,
+		Name:             name,
+		Offset:           fw.off,
+		Size:             int64(len(payload)),
+		CRC32C:           crc32.Checksum(payload, crc32c),
+		UncompressedSize: int64(fw.block.Len()),
+	}
+	var hdr [framedBlockHeaderSize]byte
+	hdr[0] = byte(kind)
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(blk.Size))
+	binary.LittleEndian.PutUint32(hdr[5:], blk.CRC32C)
+	if err := fw.write(hdr[:]); err != nil {
+		return err
+	}
+	if err := fw.write(payload); err != nil {
+		return err
+	}
+	fw.index.Blocks = append(fw.index.Blocks, blk)
+	fw.block.Reset()
+	return nil
+}
+
+// close writes the index and trailer
+func (fw *framedWriter) close() error {
+	indexPB := fw.index.Marshal()
+	var trailer [framedTrailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(indexPB)))
+	copy(trailer[4:], magicFramed)
+	if err := fw.write(indexPB); err != nil {
+		return err
+	}
+	return fw.write(trailer[:])
+}
+
+func (fw *framedWriter) write(b []byte) error {
+	n, err := fw.out.Write(b)
+	fw.off += int64(n)
+	return err
+}
+
+// framedStreamReader returns the concatenated decompressed blocks of a framed
+// snapshot, which together are a regular snapshot protobuf.
+type framedStreamReader struct {
+	data    []byte // blocks only
+	dicts   [][]byte
+	cur     io.ReadCloser
+	skipped []string // DBIs left out of a partial snapshot
+}
+
+func newFramedStreamReader(data []byte, dicts [][]byte) (*framedStreamReader, error) {
+	var trailer []byte
+	if len(data) >= framedTrailerSize {
+		trailer = data[len(data)-framedTrailerSize:]
+	}
+	indexStart, indexSize, err := framedIndexRange(int64(len(data)), trailer)
+	if err != nil {
+		return nil, err
+	}
+	var idx FramedIndex
+	if err := idx.Unmarshal(data[indexStart : indexStart+indexSize]); err != nil {
+		return nil, err
+	}
+	return &framedStreamReader{
+		data:    data[len(magicFramed):indexStart],
+		dicts:   dicts,
+		skipped: idx.Skipped,
+	}, nil
+}
+
+func (r *framedStreamReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if err == io.EOF {
+				err = r.cur.Close()
+				r.cur = nil
+				if n > 0 || err != nil {
+					return n, err
+				}
+				continue
+			}
+			return n, err
+		}
+		if len(r.data) == 0 {
+			return 0, io.EOF
+		}
+		if len(r.data) < framedBlockHeaderSize {
+			return 0, io.ErrUnexpectedEOF
+		}
+		size := int64(binary.LittleEndian.Uint32(r.data[1:]))
+		sum := binary.LittleEndian.Uint32(r.data[5:])
+		if int64(len(r.data)-framedBlockHeaderSize) < size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		payload := r.data[framedBlockHeaderSize : framedBlockHeaderSize+size]
+		r.data = r.data[framedBlockHeaderSize+size:]
+		if crc32.Checksum(payload, crc32c) != sum {
+			return 0, fmt.Errorf("block checksum mismatch")
+		}
+		zr, err := newDecompressor(payload, r.dicts)
+		if err != nil {
+			return 0, err
+		}
+		r.cur = zr
+	}
+}
+
+func (r *framedStreamReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// framedIndexRange returns the offset and size of the index of a framed
+// snapshot of the given size, based on the trailer at the end of the file.
+func framedIndexRange(size int64, trailer []byte) (offset, indexSize int64, err error) {
+	if size < int64(len(magicFramed)+framedTrailerSize) || len(trailer) != framedTrailerSize ||
+		!bytes.Equal(trailer[4:], magicFramed) {
+		return 0, 0, fmt.Errorf("invalid framed snapshot trailer")
+	}
+	indexSize = int64(binary.LittleEndian.Uint32(trailer))
+	offset = size - framedTrailerSize - indexSize
+	if offset < int64(len(magicFramed)) {
+		return 0, 0, fmt.Errorf("invalid framed snapshot index size: %d", indexSize)
+	}
+	return offset, indexSize, nil
+}
+
+// FramedReader reads the DBIs of a framed snapshot independently, instead of
+// reading the whole snapshot. It only reads the index and the header and
+// Meta blocks when created, and the blocks of a DBI when it is requested.
+// The reads can be served with range requests.
+type FramedReader struct {
+	FormatVersion uint32
+	CompatVersion uint32
+	Meta          Meta
+	Signature     *Signature
+	Index         FramedIndex
+
+	r      io.ReaderAt
+	dicts  [][]byte
+	metaPB []byte
+}
+
+// NewFramedReader reads the index, versions and Meta of a framed snapshot of
+// the given size. If v is not nil, the Signature is verified, which makes the
+// checksums in the Meta, and thereby all DBIs read, trusted.
+// Errors caused by corrupt data wrap ErrCorrupt, errors returned by r are
+// returned as is. For a snapshot that does not start with the framed
+// snapshot magic, ErrNotFramed is returned.
+func NewFramedReader(r io.ReaderAt, size int64, v *Verifier, dicts ...[]byte) (*FramedReader, error) {
+	fr := &FramedReader{r: r, dicts: dicts}
+	if err := fr.init(size); err != nil {
+		return nil, framedError(err)
+	}
+	if v != nil {
+		err := v.verifyMeta(fr.FormatVersion, fr.CompatVersion, fr.metaPB, fr.Signature, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fr, nil
+}
+
+func (fr *FramedReader) init(size int64) error {
+	magic := make([]byte, len(magicFramed))
+	if err := fr.readAt(magic, 0); err != nil {
+		return err
+	}
+	if !IsFramed(magic) {
+		return ErrNotFramed
+	}
+	trailer := make([]byte, framedTrailerSize)
+	if size >= framedTrailerSize {
+		if err := fr.readAt(trailer, size-framedTrailerSize); err != nil {
+			return err
+		}
+	}
+	offset, indexSize, err := framedIndexRange(size, trailer)
+	if err != nil {
+		return err
+	}
+	indexPB := make([]byte, indexSize)
+	if err := fr.readAt(indexPB, offset); err != nil {
+		return err
+	}
+	if err := fr.Index.Unmarshal(indexPB); err != nil {
+		return err
+	}
+	for _, blk := range fr.Index.Blocks {
+		if blk.Kind != BlockHeader && blk.Kind != BlockMeta {
+			continue
+		}
+		pb, err := fr.readBlock(blk)
+		if err != nil {
+			return err
+		}
+		if err := fr.unmarshalFields(pb); err != nil {
+			return err
+		}
+	}
+	if len(fr.Meta.DataSHA256) == 0 {
+		return fmt.Errorf("no checksums in framed snapshot")
+	}
+	return nil
+}
+
+// unmarshalFields reads the top-level fields of the header and Meta blocks
+func (fr *FramedReader) unmarshalFields(pb []byte) error {
+	d := csproto.NewDecoder(pb)
+	d.SetMode(csproto.DecoderModeFast)
+	for d.More() {
+		tag, wireType, err := d.DecodeTag()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case FieldSnapshotFormatVersion:
+			fr.FormatVersion, err = getUInt32(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+		case FieldSnapshotCompatVersion:
+			fr.CompatVersion, err = getUInt32(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+		case FieldSnapshotMeta:
+			msg, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			fr.metaPB = msg // refers to pb, which is not reused
+			if err := fr.Meta.Unmarshal(msg); err != nil {
+				return err
+			}
+		case FieldSnapshotSignature:
+			msg, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			fr.Signature = new(Signature)
+			if err := fr.Signature.Unmarshal(msg); err != nil {
+				return err
+			}
+		default:
+			if _, err := d.Skip(tag, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DBINames returns the names of the DBIs in the snapshot, in order
+func (fr *FramedReader) DBINames() []string {
+	var names []string
+	for _, blk := range fr.Index.Blocks {
+		if blk.Kind != BlockDBI {
+			continue
+		}
+		if len(names) == 0 || names[len(names)-1] != blk.Name {
+			names = append(names, blk.Name)
+		}
+	}
+	return names
+}
+
+// ReadDBI reads and decodes all DBI messages with the given name, decoding
+// the blocks in parallel. The data is verified against the DBI checksum in
+// the Meta. It returns nil if the DBI is not in the snapshot.
+// Errors caused by corrupt data wrap ErrCorrupt.
+func (fr *FramedReader) ReadDBI(name string) ([]*DBI, error) {
+	var blocks []FramedBlock
+	for _, blk := range fr.Index.Blocks {
+		if blk.Kind == BlockDBI && blk.Name == name {
+			blocks = append(blocks, blk)
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, nil
+	}
+
+	msgs := make([][]byte, len(blocks))
+	errs := make([]error, len(blocks))
+	var wg sync.WaitGroup
+	for i, blk := range blocks {
+		wg.Add(1)
+		go func(i int, blk FramedBlock) {
+			defer wg.Done()
+			msgs[i], errs[i] = fr.readDBIBlock(blk)
+		}(i, blk)
+	}
+	wg.Wait()
+
+	sums := newChecksummer()
+	var dbis []*DBI
+	for i := range blocks {
+		if errs[i] != nil {
+			return nil, framedError(fmt.Errorf("dbi %s: %w", name, errs[i]))
+		}
+		dbi, err := NewDBIFromData(msgs[i])
+		if err != nil {
+			return nil, fmt.Errorf("%w: dbi %s: %v", ErrCorrupt, name, err)
+		}
+		sums.add(name, msgs[i])
+		dbis = append(dbis, dbi)
+	}
+	_, got := sums.sums()
+	for _, expected := range fr.Meta.DBIChecksums {
+		if expected.Name == name {
+			if !bytes.Equal(got[0].SHA256, expected.SHA256) {
+				return nil, fmt.Errorf("%w: checksum mismatch for DBI %q", ErrCorrupt, name)
+			}
+			return dbis, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no checksum for DBI %q", ErrCorrupt, name)
+}
+
+// readDBIBlock returns the DBI message in a block
+func (fr *FramedReader) readDBIBlock(blk FramedBlock) ([]byte, error) {
+	pb, err := fr.readBlock(blk)
+	if err != nil {
+		return nil, err
+	}
+	d := csproto.NewDecoder(pb)
+	d.SetMode(csproto.DecoderModeFast)
+	tag, wireType, err := d.DecodeTag()
+	if err != nil {
+		return nil, err
+	}
+	if tag != FieldSnapshotDBI {
+		return nil, fmt.Errorf("unexpected field %d in DBI block", tag)
+	}
+	msg, err := getBytes(d, tag, wireType)
+	if err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("trailing data in DBI block")
+	}
+	return msg, nil
+}
+
+// Partial returns a partial framed snapshot that only contains the blocks of
+// the given DBIs, next to the header and Meta blocks. The other DBIs are
+// listed as skipped in its index. Consecutive blocks are fetched with a
+// single read. The blocks are checked, but not decompressed.
+// Errors caused by corrupt data wrap ErrCorrupt.
+func (fr *FramedReader) Partial(names []string) ([]byte, error) {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	return fr.PartialChunks(func(name string, chunk int) bool {
+		return keep[name]
+	})
+}
+
+// PartialChunks returns a partial framed snapshot like Partial, with only the
+// DBI blocks for which keep returns true. The chunk is the position of the
+// block among the blocks of its DBI. A DBI of which any block was left out is
+// listed as skipped, and its remaining blocks can only be verified against the
+// chunk checksums in the Meta, see DBIChecksum.
+func (fr *FramedReader) PartialChunks(keep func(name string, chunk int) bool) ([]byte, error) {
+	var blocks []FramedBlock
+	var idx FramedIndex
+	chunk := make(map[string]int)
+	for _, blk := range fr.Index.Blocks {
+		if blk.Kind == BlockDBI {
+			i := chunk[blk.Name]
+			chunk[blk.Name]++
+			if !keep(blk.Name, i) {
+				n := len(idx.Skipped)
+				if n == 0 || idx.Skipped[n-1] != blk.Name {
+					idx.Skipped = append(idx.Skipped, blk.Name)
+				}
+				continue
+			}
+		}
+		if blk.Size < 0 || blk.Size > maxStreamMessageSize {
+			return nil, fmt.Errorf("%w: invalid block size: %d", ErrCorrupt, blk.Size)
+		}
+		blocks = append(blocks, blk)
+	}
+
+	var out bytes.Buffer
+	out.Write(magicFramed)
+	for i := 0; i < len(blocks); {
+		// Find the run of blocks that are stored back to back
+		j := i + 1
+		end := blocks[i].Offset + framedBlockHeaderSize + blocks[i].Size
+		for j < len(blocks) && blocks[j].Offset == end {
+			end += framedBlockHeaderSize + blocks[j].Size
+			j++
+		}
+		b := make([]byte, end-blocks[i].Offset)
+		if err := fr.readAt(b, blocks[i].Offset); err != nil {
+			return nil, framedError(err)
+		}
+		for _, blk := range blocks[i:j] {
+			n := framedBlockHeaderSize + blk.Size
+			if _, err := checkBlock(blk, b[:n]); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+			}
+			blk.Offset = int64(out.Len())
+			idx.Blocks = append(idx.Blocks, blk)
+			out.Write(b[:n])
+			b = b[n:]
+		}
+		i = j
+	}
+
+	indexPB := idx.Marshal()
+	var trailer [framedTrailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(indexPB)))
+	copy(trailer[4:], magicFramed)
+	out.Write(indexPB)
+	out.Write(trailer[:])
+	return out.Bytes(), nil
+}
+
+// readError is an error returned by the io.ReaderAt of a FramedReader
+type readError struct {
+	err error
+}
+
+func (e readError) Error() string {
+	return e.err.Error()
+}
+
+// readAt reads len(p) bytes at off. Reading beyond the end of the snapshot
+// means that the index is corrupt, other read errors are returned as
+// a readError.
+func (fr *FramedReader) readAt(p []byte, off int64) error {
+	_, err := fr.r.ReadAt(p, off)
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return err
+	}
+	return readError{err: err}
+}
+
+// framedError returns the original error for read errors and ErrNotFramed,
+// and wraps ErrCorrupt around all other errors
+func framedError(err error) error {
+	var re readError
+	if errors.As(err, &re) {
+		return re.err
+	}
+	if err == ErrNotFramed {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
+
+// checkBlock checks a block read from the file against its index entry and
+// returns the payload
+func checkBlock(blk FramedBlock, b []byte) ([]byte, error) {
+	payload := b[framedBlockHeaderSize:]
+	if BlockKind(b[0]) != blk.Kind ||
+		int64(binary.LittleEndian.Uint32(b[1:])) != blk.Size ||
+		binary.LittleEndian.Uint32(b[5:]) != blk.CRC32C {
+		return nil, fmt.Errorf("block header does not match index")
+	}
+	if crc32.Checksum(payload, crc32c) != blk.CRC32C {
+		return nil, fmt.Errorf("block checksum mismatch")
+	}
+	return payload, nil
+}
+
+// readBlock reads, checks and decompresses a block
+func (fr *FramedReader) readBlock(blk FramedBlock) ([]byte, error) {
+	if blk.Size < 0 || blk.Size > maxStreamMessageSize {
+		return nil, fmt.Errorf("invalid block size: %d", blk.Size)
+	}
+	b := make([]byte, framedBlockHeaderSize+blk.Size)
+	if err := fr.readAt(b, blk.Offset); err != nil {
+		return nil, err
+	}
+	payload, err := checkBlock(blk, b)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := newDecompressor(payload, fr.dicts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+	size := blk.UncompressedSize
+	if size < 0 || size > maxStreamMessageSize {
+		size = 0
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := io.Copy(buf, zr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
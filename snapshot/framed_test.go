@@ -0,0 +1,233 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFramed(t *testing.T, c Compression, signer *Signer, srcKVs []KV) []byte {
+	var buf bytes.Buffer
+	c.Framed = true
+	sw, err := NewStreamWriter(&buf, c, 3, 2)
+	require.NoError(t, err)
+	sw.ChunkSize = 64 * 1024
+	sw.Signer = signer
+	require.NoError(t, sw.StartDBI("empty", 8, ""))
+	require.NoError(t, sw.EndDBI())
+	require.NoError(t, sw.StartDBI("test-name", 42, "test-transform"))
+	for _, kv := range srcKVs {
+		require.NoError(t, sw.Append(kv))
+	}
+	require.NoError(t, sw.EndDBI())
+	st, err := sw.Close(makeTestMeta())
+	require.NoError(t, err)
+	assert.Equal(t, buf.Len(), int(st.CompressedSize))
+	return buf.Bytes()
+}
+
+func TestStreamWriter_framed(t *testing.T) {
+	src := makeTestDBI(10_000)
+	srcKVs, err := src.AsInefficientKVList()
+	require.NoError(t, err)
+
+	for _, c := range []Compression{{}, {Type: CompressionZstd}} {
+		t.Run(c.Extension(), func(t *testing.T) {
+			data := writeFramed(t, c, nil, srcKVs)
+			assert.True(t, IsFramed(data))
+
+			checked, err := Verify(data, nil)
+			require.NoError(t, err)
+			assert.True(t, checked)
+
+			snap, err := LoadData(data)
+			require.NoError(t, err)
+			assert.Equal(t, uint32(3), snap.FormatVersion)
+			assert.Equal(t, uint32(2), snap.CompatVersion)
+			require.Greater(t, len(snap.Databases), 2)
+			assert.Equal(t, "empty", snap.Databases[0].Name())
+			var kvs []KV
+			for _, dbi := range snap.Databases[1:] {
+				l, err := dbi.AsInefficientKVList()
+				require.NoError(t, err)
+				kvs = append(kvs, l...)
+			}
+			assert.Equal(t, srcKVs, kvs)
+		})
+	}
+}
+
+func TestFramedReader(t *testing.T) {
+	src := makeTestDBI(10_000)
+	srcKVs, err := src.AsInefficientKVList()
+	require.NoError(t, err)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	data := writeFramed(t, Compression{Type: CompressionZstd}, NewSigner(priv), srcKVs)
+	fr, err := NewFramedReader(bytes.NewReader(data), int64(len(data)), NewVerifier(pub))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), fr.FormatVersion)
+	assert.Equal(t, uint32(2), fr.CompatVersion)
+	assert.Equal(t, makeTestMeta().InstanceID, fr.Meta.InstanceID)
+	assert.Equal(t, []string{"empty", "test-name"}, fr.DBINames())
+
+	dbis, err := fr.ReadDBI("test-name")
+	require.NoError(t, err)
+	require.Greater(t, len(dbis), 1)
+	var kvs []KV
+	for _, dbi := range dbis {
+		assert.Equal(t, uint64(42), dbi.Flags())
+		l, err := dbi.AsInefficientKVList()
+		require.NoError(t, err)
+		kvs = append(kvs, l...)
+	}
+	assert.Equal(t, srcKVs, kvs)
+
+	dbis, err = fr.ReadDBI("missing")
+	require.NoError(t, err)
+	assert.Nil(t, dbis)
+
+	_, err = NewFramedReader(bytes.NewReader(data), int64(len(data)), NewVerifier(otherPub))
+	assert.ErrorIs(t, err, ErrBadSignature)
+
+	// Corrupt a byte in the first DBI block of test-name
+	var blk FramedBlock
+	for _, b := range fr.Index.Blocks {
+		if b.Name == "test-name" {
+			blk = b
+			break
+		}
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[blk.Offset+framedBlockHeaderSize+blk.Size/2] ^= 0xff
+	fr, err = NewFramedReader(bytes.NewReader(corrupt), int64(len(corrupt)), nil)
+	require.NoError(t, err)
+	_, err = fr.ReadDBI("test-name")
+	assert.ErrorIs(t, err, ErrCorrupt)
+	_, err = Verify(corrupt, nil)
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	// Truncated snapshot
+	_, err = NewFramedReader(bytes.NewReader(data[:len(data)-1]), int64(len(data)-1), nil)
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestFramedReader_Partial(t *testing.T) {
+	src := makeTestDBI(10_000)
+	srcKVs, err := src.AsInefficientKVList()
+	require.NoError(t, err)
+	data := writeFramed(t, Compression{}, nil, srcKVs)
+	fr, err := NewFramedReader(bytes.NewReader(data), int64(len(data)), nil)
+	require.NoError(t, err)
+
+	partial, err := fr.Partial([]string{"empty"})
+	require.NoError(t, err)
+	assert.True(t, IsFramed(partial))
+	assert.Less(t, len(partial), len(data)/2)
+	checked, err := Verify(partial, nil)
+	require.NoError(t, err)
+	assert.True(t, checked)
+
+	sr, err := NewStreamReader(partial)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-name"}, sr.Skipped)
+	dbi, err := sr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "empty", dbi.Name())
+
+	// A partial snapshot with all DBIs is the same as the original
+	all, err := fr.Partial(fr.DBINames())
+	require.NoError(t, err)
+	assert.Equal(t, data, all)
+
+	// Only the DBIs that are present are verified
+	pfr, err := NewFramedReader(bytes.NewReader(partial), int64(len(partial)), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-name"}, pfr.Index.Skipped)
+	pfr.Meta.DBIChecksums[0].SHA256 = pfr.Meta.DBIChecksums[1].SHA256
+	_, err = pfr.ReadDBI("empty")
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	// Not framed
+	plain := mustDumpData(t, makeTestSnapshot(10))
+	_, err = NewFramedReader(bytes.NewReader(plain), int64(len(plain)), nil)
+	assert.Equal(t, ErrNotFramed, err)
+}
+
+func TestFramedReader_PartialChunks(t *testing.T) {
+	src := makeTestDBI(20_000)
+	srcKVs, err := src.AsInefficientKVList()
+	require.NoError(t, err)
+	write := func(kvs []KV) []byte {
+		var buf bytes.Buffer
+		sw, err := NewStreamWriter(&buf, Compression{Framed: true}, 3, 2)
+		require.NoError(t, err)
+		sw.ChunkSize = 16 * 1024
+		sw.HashTree = true
+		require.NoError(t, sw.StartDBI("test-name", 42, ""))
+		for _, kv := range kvs {
+			require.NoError(t, sw.Append(kv))
+		}
+		require.NoError(t, sw.EndDBI())
+		_, err = sw.Close(makeTestMeta())
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+	chunks := func(data []byte) (*FramedReader, [][]byte) {
+		fr, err := NewFramedReader(bytes.NewReader(data), int64(len(data)), nil)
+		require.NoError(t, err)
+		require.Len(t, fr.Meta.DBIChecksums, 1)
+		return fr, fr.Meta.DBIChecksums[0].Chunks
+	}
+
+	_, before := chunks(write(srcKVs))
+	require.Greater(t, len(before), 10)
+	known := make(map[string]bool)
+	for _, sum := range before {
+		known[string(sum)] = true
+	}
+
+	// Inserting a key only changes the chunk that holds it
+	changed := append([]KV(nil), srcKVs[:10_000]...)
+	changed = append(changed, KV{Key: append(append([]byte(nil), srcKVs[10_000].Key...), 0)})
+	changed = append(changed, srcKVs[10_000:]...)
+	data := write(changed)
+	fr, after := chunks(data)
+	var keep []int
+	for i, sum := range after {
+		if !known[string(sum)] {
+			keep = append(keep, i)
+		}
+	}
+	assert.Len(t, keep, 1)
+
+	partial, err := fr.PartialChunks(func(name string, chunk int) bool {
+		return chunk == keep[0]
+	})
+	require.NoError(t, err)
+	assert.Less(t, len(partial), len(data)/5)
+	checked, err := Verify(partial, nil)
+	require.NoError(t, err)
+	assert.True(t, checked)
+	sr, err := NewStreamReader(partial)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-name"}, sr.Skipped)
+
+	// Chunks of skipped DBIs must match a chunk checksum
+	c := newChecksummer()
+	c.setSkipped([]string{"test-name"})
+	c.add("test-name", []byte("forged"))
+	_, err = c.verify(fr.Meta, []string{"test-name"})
+	assert.Error(t, err)
+
+	// The chunk checksums are stored in the Meta
+	var m Meta
+	require.NoError(t, m.Unmarshal(fr.Meta.Marshal()))
+	assert.Equal(t, after, m.DBIChecksums[0].Chunks)
+}
@@ -6,14 +6,14 @@ import (
 	"time"
 
 	"github.com/c2h5oh/datasize"
-	"github.com/klauspost/compress/gzip"
 )
 
-// LoadData loads snapshot file contents that are gzipped protobufs
-func LoadData(data []byte) (*Snapshot, error) {
+// LoadData loads snapshot file contents that are gzip or zstd compressed
+// protobufs. The compression is detected automatically. The dicts are
+// any zstd dictionaries that may have been used to compress the snapshot.
+func LoadData(data []byte, dicts ...[]byte) (*Snapshot, error) {
 	// Uncompress
-	dataReader := bytes.NewReader(data)
-	g, err := gzip.NewReader(dataReader)
+	g, err := newReader(data, dicts)
 	if err != nil {
 		return nil, err
 	}
@@ -23,6 +23,7 @@ func LoadData(data []byte) (*Snapshot, error) {
 	//pbData, err := io.ReadAll(g)
 	_, err = io.Copy(pbBuf, g)
 	if err != nil {
+		_ = g.Close()
 		return nil, err
 	}
 	pbData := pbBuf.Bytes()
@@ -39,8 +40,13 @@ func LoadData(data []byte) (*Snapshot, error) {
 	return msg, nil
 }
 
-// DumpData returns a compressed Snapshot.
+// DumpData returns a gzip compressed Snapshot.
 func DumpData(msg *Snapshot) ([]byte, DumpDataStats, error) {
+	return DumpDataCompression(msg, Compression{})
+}
+
+// DumpDataCompression returns a Snapshot compressed with given compression.
+func DumpDataCompression(msg *Snapshot, c Compression) ([]byte, DumpDataStats, error) {
 	var stat DumpDataStats
 	t0 := time.Now()
 
@@ -52,12 +58,12 @@ func DumpData(msg *Snapshot) ([]byte, DumpDataStats, error) {
 		estimatedSize += d.Size()
 	}
 	out := bytes.NewBuffer(make([]byte, 0, estimatedSize/2))
-	gw, err := gzip.NewWriterLevel(out, gzip.BestSpeed)
+	gw, err := c.newWriter(out)
 	if err != nil {
 		return nil, stat, err
 	}
 
-	// Marshal and write to gzip writer
+	// Marshal and write to compressing writer
 	// The marshalling itself takes almost no time, since all the DBI data is
 	// already marshaled.
 	pbSize, err := msg.WriteTo(gw)
@@ -81,4 +87,5 @@ type DumpDataStats struct {
 	TCompressed    time.Duration     // time it took to marshal (near 0) and compress
 	ProtobufSize   datasize.ByteSize // uncompressed protobuf size
 	CompressedSize datasize.ByteSize // uncompressed protobuf size
+	DataSHA256     []byte            // checksum of all DBI data, only set by StreamWriter
 }
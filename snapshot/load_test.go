@@ -8,6 +8,14 @@ import (
 )
 
 func BenchmarkDumpData_1M_entries(b *testing.B) {
+	benchmarkDumpData(b, Compression{})
+}
+
+func BenchmarkDumpData_1M_entries_zstd(b *testing.B) {
+	benchmarkDumpData(b, Compression{Type: CompressionZstd})
+}
+
+func benchmarkDumpData(b *testing.B, c Compression) {
 	// Keep in mind that is basically just testing the compression speed,
 	// as that is by far the bottleneck here now.
 	const entries = 1_000_000
@@ -18,7 +26,7 @@ func BenchmarkDumpData_1M_entries(b *testing.B) {
 	b.ResetTimer()
 	t := time.Now()
 	for i := 0; i < b.N; i++ {
-		data, st, err := DumpData(snap)
+		data, st, err := DumpDataCompression(snap, c)
 		if len(data) < 1*MB {
 			b.Fatal("snapshot too small", len(data))
 		}
@@ -0,0 +1,87 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// lmdbKeyOrderFlags are the MDB_INTEGERKEY and MDB_REVERSEKEY DBI flags,
+// which are not defined in the Go bindings.
+const lmdbKeyOrderFlags = 0x08 | 0x02
+
+// Merge merges the DBIs of multiple snapshots and writes the result to sw,
+// ordered by DBI name and key. Of entries that occur in more than one
+// snapshot, the one with the newest timestamp is kept. Deleted entries are
+// kept as well, because these are needed to propagate the deletion. If the
+// timestamps are equal, the entry from the earliest snapshot in inputs wins.
+// Entries are identified like in Diff. All entries are held in memory.
+func Merge(sw *StreamWriter, inputs ...[]*DBI) error {
+	type dbiInfo struct {
+		flags     uint64
+		transform string
+		entries   map[diffID]KV
+	}
+	merged := make(map[string]*dbiInfo)
+	for _, dbis := range inputs {
+		index, err := diffIndex(dbis)
+		if err != nil {
+			return err
+		}
+		for _, dbi := range dbis {
+			name := dbi.Name()
+			info, exists := merged[name]
+			if !exists {
+				if dbi.Flags()&lmdbKeyOrderFlags > 0 {
+					return fmt.Errorf("dbi %s: cannot merge DBIs with MDB_INTEGERKEY or MDB_REVERSEKEY", name)
+				}
+				info = &dbiInfo{
+					flags:     dbi.Flags(),
+					transform: dbi.Transform(),
+					entries:   make(map[diffID]KV),
+				}
+				merged[name] = info
+			} else if dbi.Transform() != info.transform {
+				return fmt.Errorf("dbi %s: cannot merge transforms %q and %q",
+					name, info.transform, dbi.Transform())
+			}
+			for id, kv := range index[name] {
+				if cur, exists := info.entries[id]; !exists || kv.TimestampNano > cur.TimestampNano {
+					info.entries[id] = kv
+				}
+			}
+			delete(index, name) // all chunks of this DBI were indexed at once
+		}
+	}
+
+	var names []string
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := merged[name]
+		ids := make([]diffID, 0, len(info.entries))
+		for id := range info.entries {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if c := bytes.Compare([]byte(ids[i].key), []byte(ids[j].key)); c != 0 {
+				return c < 0
+			}
+			return ids[i].value < ids[j].value
+		})
+		if err := sw.StartDBI(name, info.flags, info.transform); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := sw.Append(info.entries[id]); err != nil {
+				return err
+			}
+		}
+		if err := sw.EndDBI(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
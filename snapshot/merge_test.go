@@ -0,0 +1,82 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	dbi := func(name, transform string, kvs ...KV) *DBI {
+		d := NewDBI()
+		d.SetName(name)
+		d.SetFlags(4)
+		d.SetTransform(transform)
+		for _, kv := range kvs {
+			d.Append(kv)
+		}
+		return d
+	}
+	kv := func(k, v string, ts uint64, flags uint32) KV {
+		return KV{Key: []byte(k), Value: []byte(v), TimestampNano: ts, Flags: flags}
+	}
+	merge := func(inputs ...[]*DBI) ([]string, error) {
+		var buf bytes.Buffer
+		sw, err := NewStreamWriter(&buf, Compression{}, 3, 2)
+		require.NoError(t, err)
+		if err := Merge(sw, inputs...); err != nil {
+			return nil, err
+		}
+		_, err = sw.Close(Meta{})
+		require.NoError(t, err)
+		snap, err := LoadData(buf.Bytes())
+		require.NoError(t, err)
+		var res []string
+		for _, d := range snap.Databases {
+			assert.Equal(t, uint64(4), d.Flags())
+			kvs, err := d.AsInefficientKVList()
+			require.NoError(t, err)
+			for _, e := range kvs {
+				res = append(res, fmt.Sprintf("%s:%s=%s@%d/%d",
+					d.Name(), e.Key, e.Value, e.TimestampNano, e.Flags))
+			}
+		}
+		return res, nil
+	}
+
+	a := []*DBI{
+		dbi("foo", "", kv("a", "1", 1, 0), kv("b", "2", 3, 0)),
+		dbi("foo", "", kv("c", "3", 1, 0), kv("d", "4", 2, 0)), // second chunk
+		dbi("dup", TransformDupSortNativeV1, kv("k", "x", 1, 0), kv("k", "y", 1, 0)),
+	}
+	b := []*DBI{
+		dbi("dup", TransformDupSortNativeV1, kv("k", "y", 2, 1), kv("k", "z", 2, 0)),
+		dbi("foo", "", kv("a", "new", 2, 0), kv("b", "old", 2, 0), kv("c", "", 2, 1)),
+		dbi("foo", "", kv("d", "same", 2, 0), kv("e", "5", 2, 0)),
+	}
+	res, err := merge(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"dup:k=x@1/0",
+		"dup:k=y@2/1", // deleted entries are kept
+		"dup:k=z@2/0",
+		"foo:a=new@2/0",
+		"foo:b=2@3/0",
+		"foo:c=@2/1",
+		"foo:d=4@2/0", // first input wins on equal timestamps
+		"foo:e=5@2/0",
+	}, res)
+
+	_, err = merge(a, []*DBI{dbi("dup", TransformDupSortHackV1)})
+	assert.Error(t, err)
+	for _, flags := range []uint64{0x08, 0x02} { // MDB_INTEGERKEY, MDB_REVERSEKEY
+		ordered := NewDBI()
+		ordered.SetName("ordered")
+		ordered.SetFlags(flags)
+		_, err = merge([]*DBI{ordered})
+		assert.Error(t, err)
+	}
+}
@@ -14,6 +14,16 @@ const (
 	FieldMetaLMDBTxnID     = 4
 	FieldMetaTimestampNano = 5
 	FieldMetaDatabaseName  = 7
+	FieldMetaDataSHA256    = 8
+	FieldMetaDBIChecksums  = 9
+	FieldMetaCompression   = 10
+	FieldMetaLoaded        = 11
+)
+
+// Protobuf field numbers of a LoadedSnapshot
+const (
+	FieldLoadedSnapshotInstanceID    = 1
+	FieldLoadedSnapshotTimestampNano = 2
 )
 
 type Meta struct {
@@ -23,6 +33,70 @@ type Meta struct {
 	LmdbTxnID     int64
 	TimestampNano uint64
 	DatabaseName  string
+
+	// DataSHA256 and DBIChecksums are the checksums of the DBI data, see
+	// StreamWriter. These are only set for snapshots that have the Meta
+	// after the DBIs.
+	DataSHA256   []byte        `json:",omitempty"`
+	DBIChecksums []DBIChecksum `json:",omitempty"`
+
+	// Compression is the compression type the snapshot was written with,
+	// like "zstd". This is informational, readers detect the compression
+	// from the data. It is empty for snapshots written by older versions.
+	Compression string `json:",omitempty"`
+
+	// Loaded has the newest snapshot of every other instance that was
+	// merged into the LMDB when the snapshot was taken. This allows other
+	// instances to tell which tombstones this instance has merged. It is
+	// empty for snapshots written by older versions.
+	Loaded []LoadedSnapshot `json:",omitempty"`
+}
+
+// LoadedSnapshot identifies a snapshot of another instance by its timestamp
+type LoadedSnapshot struct {
+	InstanceID    string
+	TimestampNano uint64
+}
+
+func (ls *LoadedSnapshot) Marshal() []byte {
+	b := make([]byte, 0, len(ls.InstanceID)+20)
+	var tmp [16]byte
+	n := csproto.EncodeTag(tmp[:], FieldLoadedSnapshotInstanceID, csproto.WireTypeLengthDelimited)
+	n += csproto.EncodeVarint(tmp[n:], uint64(len(ls.InstanceID)))
+	b = append(b, tmp[:n]...)
+	b = append(b, ls.InstanceID...)
+	n = csproto.EncodeTag(tmp[:], FieldLoadedSnapshotTimestampNano, csproto.WireTypeFixed64)
+	binary.LittleEndian.PutUint64(tmp[n:], ls.TimestampNano)
+	b = append(b, tmp[:n+8]...)
+	return b
+}
+
+func (ls *LoadedSnapshot) Unmarshal(data []byte) error {
+	d := csproto.NewDecoder(data)
+	d.SetMode(csproto.DecoderModeFast)
+	for d.More() {
+		tag, wireType, err := d.DecodeTag()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case FieldLoadedSnapshotInstanceID:
+			ls.InstanceID, err = getString(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+		case FieldLoadedSnapshotTimestampNano:
+			ls.TimestampNano, err = getFixed64(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+		default:
+			if _, err := d.Skip(tag, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (m *Meta) Marshal() []byte {
@@ -34,6 +108,7 @@ func (m *Meta) Marshal() []byte {
 		{FieldMetaInstanceID, m.InstanceID},
 		{FieldMetaHostname, m.Hostname},
 		{FieldMetaDatabaseName, m.DatabaseName},
+		{FieldMetaCompression, m.Compression},
 	}
 
 	// Make a safe estimate of the buffer size needed, not accurate.
@@ -42,6 +117,21 @@ func (m *Meta) Marshal() []byte {
 		bufSizeNeeded += len(sf.val) + 20
 	}
 	bufSizeNeeded += 1000 // generous enough for the numeric fields
+	var checksumsPB [][]byte
+	if len(m.DataSHA256) > 0 {
+		bufSizeNeeded += len(m.DataSHA256) + 20
+	}
+	for i := range m.DBIChecksums {
+		pb := m.DBIChecksums[i].Marshal()
+		checksumsPB = append(checksumsPB, pb)
+		bufSizeNeeded += len(pb) + 20
+	}
+	var loadedPB [][]byte
+	for i := range m.Loaded {
+		pb := m.Loaded[i].Marshal()
+		loadedPB = append(loadedPB, pb)
+		bufSizeNeeded += len(pb) + 20
+	}
 	b := make([]byte, bufSizeNeeded)
 	offset := 0
 
@@ -62,6 +152,21 @@ func (m *Meta) Marshal() []byte {
 		binary.LittleEndian.PutUint64(b[offset:offset+8], m.TimestampNano)
 		offset += 8
 	}
+	if len(m.DataSHA256) > 0 {
+		offset += csproto.EncodeTag(b[offset:], FieldMetaDataSHA256, csproto.WireTypeLengthDelimited)
+		offset += csproto.EncodeVarint(b[offset:], uint64(len(m.DataSHA256)))
+		offset += copy(b[offset:], m.DataSHA256)
+	}
+	for _, pb := range checksumsPB {
+		offset += csproto.EncodeTag(b[offset:], FieldMetaDBIChecksums, csproto.WireTypeLengthDelimited)
+		offset += csproto.EncodeVarint(b[offset:], uint64(len(pb)))
+		offset += copy(b[offset:], pb)
+	}
+	for _, pb := range loadedPB {
+		offset += csproto.EncodeTag(b[offset:], FieldMetaLoaded, csproto.WireTypeLengthDelimited)
+		offset += csproto.EncodeVarint(b[offset:], uint64(len(pb)))
+		offset += copy(b[offset:], pb)
+	}
 
 	return b[:offset]
 }
@@ -105,6 +210,37 @@ func (m *Meta) Unmarshal(data []byte) error {
 			if err != nil {
 				return err
 			}
+		case FieldMetaCompression:
+			m.Compression, err = getString(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+		case FieldMetaDataSHA256:
+			sum, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			m.DataSHA256 = append([]byte(nil), sum...)
+		case FieldMetaDBIChecksums:
+			msg, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			var c DBIChecksum
+			if err := c.Unmarshal(msg); err != nil {
+				return err
+			}
+			m.DBIChecksums = append(m.DBIChecksums, c)
+		case FieldMetaLoaded:
+			msg, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			var ls LoadedSnapshot
+			if err := ls.Unmarshal(msg); err != nil {
+				return err
+			}
+			m.Loaded = append(m.Loaded, ls)
 		default:
 			if _, err := d.Skip(tag, wireType); err != nil {
 				return err
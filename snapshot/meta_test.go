@@ -31,3 +31,29 @@ func TestMeta(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, orig, loaded)
 }
+
+func TestMeta_checksums(t *testing.T) {
+	orig := makeTestMeta()
+	orig.DataSHA256 = []byte("0123456789abcdef0123456789abcdef")
+	orig.DBIChecksums = []DBIChecksum{
+		{Name: "a", SHA256: []byte("sum-a")},
+		{Name: "b", SHA256: []byte("sum-b")},
+	}
+	orig.Compression = CompressionZstd
+
+	var loaded Meta
+	assert.NoError(t, loaded.Unmarshal(orig.Marshal()))
+	assert.Equal(t, orig, loaded)
+}
+
+func TestMeta_loaded(t *testing.T) {
+	orig := makeTestMeta()
+	orig.Loaded = []LoadedSnapshot{
+		{InstanceID: "a", TimestampNano: 1678946171_001_002_003},
+		{InstanceID: "b", TimestampNano: 1},
+	}
+
+	var loaded Meta
+	assert.NoError(t, loaded.Unmarshal(orig.Marshal()))
+	assert.Equal(t, orig, loaded)
+}
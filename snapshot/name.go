@@ -16,6 +16,23 @@ const (
 	dotIndex   = 15                          // position of the '.'
 )
 
+const (
+	// ExtensionGzip is the filename extension of gzip compressed snapshots
+	ExtensionGzip = "pb.gz"
+	// ExtensionZstd is the filename extension of zstd compressed snapshots.
+	// Older versions do not recognize this extension and will ignore these.
+	ExtensionZstd = "pb.zst"
+	// ExtensionLZ4 is the filename extension of lz4 compressed snapshots.
+	// Older versions do not recognize this extension and will ignore these.
+	ExtensionLZ4 = "pb.lz4"
+	// ExtensionNone is the filename extension of uncompressed snapshots.
+	// Older versions do not recognize this extension and will ignore these.
+	ExtensionNone = "pb"
+	// DeltaExtensionPrefix is prepended to the extension of delta snapshots.
+	// Older versions do not recognize these extensions and will ignore these.
+	DeltaExtensionPrefix = "delta."
+)
+
 func NameTimestamp(ts time.Time) string {
 	fileTimestamp := strings.Replace(
 		ts.UTC().Format(timeFormat),
@@ -28,12 +45,40 @@ func NameTimestampFromNano(tsNano header.Timestamp) string {
 }
 
 func Name(syncerName, instanceID, generationID string, ts time.Time) string {
+	return NameWithExtension(syncerName, instanceID, generationID, ts, ExtensionGzip)
+}
+
+// NameWithExtension is like Name, but for a snapshot with given compression
+// extension, like ExtensionZstd.
+func NameWithExtension(syncerName, instanceID, generationID string, ts time.Time, ext string) string {
 	fileTimestamp := NameTimestamp(ts)
-	name := fmt.Sprintf("%s__%s__%s__%s.pb.gz",
+	name := fmt.Sprintf("%s__%s__%s__%s.%s",
 		syncerName,
 		instanceID,
 		fileTimestamp,
 		generationID,
+		ext,
+	)
+	return name
+}
+
+// DeltaName returns the name of a delta snapshot that only contains the
+// changes since the full snapshot with timestamp baseTS.
+func DeltaName(syncerName, instanceID, generationID string, ts, baseTS time.Time) string {
+	return DeltaNameWithExtension(syncerName, instanceID, generationID, ts, baseTS, ExtensionGzip)
+}
+
+// DeltaNameWithExtension is like DeltaName, but for a snapshot with given
+// compression extension, like ExtensionZstd.
+func DeltaNameWithExtension(syncerName, instanceID, generationID string, ts, baseTS time.Time, ext string) string {
+	name := fmt.Sprintf("%s__%s__%s__%s__%s.%s%s",
+		syncerName,
+		instanceID,
+		NameTimestamp(ts),
+		generationID,
+		NameTimestamp(baseTS),
+		DeltaExtensionPrefix,
+		ext,
 	)
 	return name
 }
@@ -44,7 +89,9 @@ func ParseName(name string) (NameInfo, error) {
 	if !found {
 		return empty, fmt.Errorf("invalid name: no dot: %s", name)
 	}
-	if ext != "pb.gz" {
+	compressionExt := strings.TrimPrefix(ext, DeltaExtensionPrefix)
+	isDelta := compressionExt != ext
+	if extensionCompression(compressionExt) == "" {
 		return empty, fmt.Errorf("unexpected extension: %s", name)
 	}
 	ni.FullName = name
@@ -57,27 +104,80 @@ func ParseName(name string) (NameInfo, error) {
 	ni.InstanceID = p[1]
 	ni.TimestampString = p[2]
 	ni.GenerationID = p[3]
-	tss := ni.TimestampString
+	ts, err := parseNameTimestamp(ni.TimestampString)
+	if err != nil {
+		return empty, fmt.Errorf("%w in %s", err, name)
+	}
+	ni.Timestamp = ts
+	if isDelta {
+		if len(p) < 5 {
+			return empty, fmt.Errorf("delta snapshot without base timestamp: %s", name)
+		}
+		ni.BaseTimestampString = p[4]
+		ts, err := parseNameTimestamp(ni.BaseTimestampString)
+		if err != nil {
+			return empty, fmt.Errorf("base %w in %s", err, name)
+		}
+		ni.BaseTimestamp = ts
+	}
+	return ni, nil
+}
+
+// parseNameTimestamp parses a timestamp as used in snapshot names
+func parseNameTimestamp(tss string) (time.Time, error) {
 	if len(tss) != len(timeFormat) || tss[dotIndex] != '-' {
-		return empty, fmt.Errorf("invalid timestamp format: %s in %s", tss, name)
+		return time.Time{}, fmt.Errorf("invalid timestamp format: %s", tss)
 	}
 	tss = tss[:dotIndex] + "." + tss[dotIndex+1:] // replace second '-' with '.' for parsing
 	ts, err := time.Parse(timeFormat, tss)        // returns time in UTC
 	if err != nil {
-		return empty, fmt.Errorf("timestamp parse error: %s", err)
+		return time.Time{}, fmt.Errorf("timestamp parse error: %s", err)
 	}
-	ni.Timestamp = ts
-	return ni, nil
+	return ts, nil
 }
 
 type NameInfo struct {
 	FullName        string
-	Extension       string // "pb.gz"
+	Extension       string // like "pb.gz", "pb.zst" or "delta.pb.gz"
 	SyncerName      string
 	InstanceID      string
 	GenerationID    string
 	TimestampString string
 	Timestamp       time.Time
+
+	// Only set for delta snapshots: the timestamp of the full snapshot
+	// this delta snapshot is based on.
+	BaseTimestampString string
+	BaseTimestamp       time.Time
+}
+
+// IsDelta returns true if this is a delta snapshot that only contains the
+// changes since the base snapshot.
+func (ni NameInfo) IsDelta() bool {
+	return ni.BaseTimestampString != ""
+}
+
+// Compression returns the compression type indicated by the extension, like
+// CompressionZstd. Snapshot readers do not rely on this, they detect the
+// compression from the data.
+func (ni NameInfo) Compression() string {
+	return extensionCompression(strings.TrimPrefix(ni.Extension, DeltaExtensionPrefix))
+}
+
+// extensionCompression returns the compression type for a snapshot extension
+// without the delta prefix, or an empty string if it is not known.
+func extensionCompression(ext string) string {
+	switch ext {
+	case ExtensionGzip:
+		return CompressionGzip
+	case ExtensionZstd:
+		return CompressionZstd
+	case ExtensionLZ4:
+		return CompressionLZ4
+	case ExtensionNone:
+		return CompressionNone
+	}
+	return ""
 }
 
 // ShortHash returns a short hash of name info to visually distinguish snapshots in logs
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseName(t *testing.T) {
@@ -29,6 +30,20 @@ func TestParseName(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"zstd",
+			NameWithExtension("db1", "inst1", "gen1", ts, ExtensionZstd),
+			NameInfo{
+				FullName:        "db1__inst1__20220102-030405-012345678__gen1.pb.zst",
+				Extension:       "pb.zst",
+				SyncerName:      "db1",
+				InstanceID:      "inst1",
+				GenerationID:    "gen1",
+				TimestampString: "20220102-030405-012345678",
+				Timestamp:       ts,
+			},
+			false,
+		},
 		{
 			"extra-fields",
 			"db1__inst1__20220102-030405-012345678__gen1__extra__extra.pb.gz",
@@ -43,6 +58,70 @@ func TestParseName(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"delta-roundtrip",
+			DeltaName("db1", "inst1", "gen1", ts.Add(time.Hour), ts),
+			NameInfo{
+				FullName:            "db1__inst1__20220102-040405-012345678__gen1__20220102-030405-012345678.delta.pb.gz",
+				Extension:           "delta.pb.gz",
+				SyncerName:          "db1",
+				InstanceID:          "inst1",
+				GenerationID:        "gen1",
+				TimestampString:     "20220102-040405-012345678",
+				Timestamp:           ts.Add(time.Hour),
+				BaseTimestampString: "20220102-030405-012345678",
+				BaseTimestamp:       ts,
+			},
+			false,
+		},
+		{
+			"delta-zstd",
+			DeltaNameWithExtension("db1", "inst1", "gen1", ts.Add(time.Hour), ts, ExtensionZstd),
+			NameInfo{
+				FullName:            "db1__inst1__20220102-040405-012345678__gen1__20220102-030405-012345678.delta.pb.zst",
+				Extension:           "delta.pb.zst",
+				SyncerName:          "db1",
+				InstanceID:          "inst1",
+				GenerationID:        "gen1",
+				TimestampString:     "20220102-040405-012345678",
+				Timestamp:           ts.Add(time.Hour),
+				BaseTimestampString: "20220102-030405-012345678",
+				BaseTimestamp:       ts,
+			},
+			false,
+		},
+		{
+			"uncompressed",
+			NameWithExtension("db1", "inst1", "gen1", ts, ExtensionNone),
+			NameInfo{
+				FullName:        "db1__inst1__20220102-030405-012345678__gen1.pb",
+				Extension:       "pb",
+				SyncerName:      "db1",
+				InstanceID:      "inst1",
+				GenerationID:    "gen1",
+				TimestampString: "20220102-030405-012345678",
+				Timestamp:       ts,
+			},
+			false,
+		},
+		{
+			"unknown-compression",
+			"db1__inst1__20220102-030405-012345678__gen1.pb.xz",
+			NameInfo{},
+			true,
+		},
+		{
+			"delta-no-base",
+			"db1__inst1__20220102-030405-012345678__gen1.delta.pb.gz",
+			NameInfo{},
+			true,
+		},
+		{
+			"delta-invalid-base",
+			"db1__inst1__20220102-030405-012345678__gen1__foo.delta.pb.gz",
+			NameInfo{},
+			true,
+		},
 		{
 			"invalid",
 			"invalid",
@@ -79,3 +158,20 @@ func TestParseName(t *testing.T) {
 		})
 	}
 }
+
+func TestNameInfo_Compression(t *testing.T) {
+	ts := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	for ext, want := range map[string]string{
+		ExtensionGzip: CompressionGzip,
+		ExtensionZstd: CompressionZstd,
+		ExtensionLZ4:  CompressionLZ4,
+		ExtensionNone: CompressionNone,
+	} {
+		ni, err := ParseName(NameWithExtension("db1", "inst1", "gen1", ts, ext))
+		require.NoError(t, err)
+		assert.Equal(t, want, ni.Compression(), ext)
+		ni, err = ParseName(DeltaNameWithExtension("db1", "inst1", "gen1", ts, ts, ext))
+		require.NoError(t, err)
+		assert.Equal(t, want, ni.Compression(), ext)
+	}
+}
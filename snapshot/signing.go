@@ -0,0 +1,222 @@
+package snapshot
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/CrowdStrike/csproto"
+)
+
+// Protobuf field numbers of a Signature
+const (
+	FieldSignatureKeyID     = 1
+	FieldSignatureSignature = 2
+)
+
+// signaturePrefix separates snapshot signatures from any other use of the keys
+const signaturePrefix = "lightningstream snapshot signature v1\n"
+
+// ErrBadSignature is returned when a snapshot is not signed by a trusted key
+var ErrBadSignature = errors.New("bad snapshot signature")
+
+// Signature is an Ed25519 signature of a snapshot. It is written after the
+// Meta and signs the format versions and the Meta. The Meta contains the
+// checksums of all DBI data, so the signature covers the whole snapshot.
+type Signature struct {
+	KeyID     []byte // first 8 bytes of the SHA-256 of the public key
+	Signature []byte
+}
+
+func (s *Signature) Marshal() []byte {
+	var b []byte
+	var tmp [16]byte
+	for _, f := range []struct {
+		tag int
+		val []byte
+	}{
+		{FieldSignatureKeyID, s.KeyID},
+		{FieldSignatureSignature, s.Signature},
+	} {
+		n := csproto.EncodeTag(tmp[:], f.tag, csproto.WireTypeLengthDelimited)
+		n += csproto.EncodeVarint(tmp[n:], uint64(len(f.val)))
+		b = append(b, tmp[:n]...)
+		b = append(b, f.val...)
+	}
+	return b
+}
+
+func (s *Signature) Unmarshal(data []byte) error {
+	d := csproto.NewDecoder(data)
+	d.SetMode(csproto.DecoderModeFast)
+	for d.More() {
+		tag, wireType, err := d.DecodeTag()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case FieldSignatureKeyID, FieldSignatureSignature:
+			val, err := getBytes(d, tag, wireType)
+			if err != nil {
+				return err
+			}
+			val = append([]byte(nil), val...)
+			if tag == FieldSignatureKeyID {
+				s.KeyID = val
+			} else {
+				s.Signature = val
+			}
+		default:
+			if _, err := d.Skip(tag, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// KeyID returns the ID of a public key as used in signatures
+func KeyID(pub ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(pub)
+	return sum[:8]
+}
+
+// signedData returns the data that is signed for a snapshot
+func signedData(formatVersion, compatVersion uint32, metaPB []byte) []byte {
+	b := make([]byte, 0, len(signaturePrefix)+20+len(metaPB))
+	b = append(b, signaturePrefix...)
+	var tmp [20]byte
+	n := csproto.EncodeVarint(tmp[:], uint64(formatVersion))
+	n += csproto.EncodeVarint(tmp[n:], uint64(compatVersion))
+	b = append(b, tmp[:n]...)
+	return append(b, metaPB...)
+}
+
+// Signer signs the snapshots written by a StreamWriter
+type Signer struct {
+	key   ed25519.PrivateKey
+	keyID []byte
+}
+
+// NewSigner returns a Signer for an Ed25519 private key
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{
+		key:   key,
+		keyID: KeyID(key.Public().(ed25519.PublicKey)),
+	}
+}
+
+// LoadSigner loads a PEM encoded PKCS #8 Ed25519 private key, as generated
+// by 'openssl genpkey -algorithm ed25519'.
+func LoadSigner(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", path)
+	}
+	return NewSigner(edKey), nil
+}
+
+func (s *Signer) sign(formatVersion, compatVersion uint32, metaPB []byte) Signature {
+	return Signature{
+		KeyID:     s.keyID,
+		Signature: ed25519.Sign(s.key, signedData(formatVersion, compatVersion, metaPB)),
+	}
+}
+
+// Verifier checks that snapshots were signed by one of the trusted keys
+type Verifier struct {
+	keys map[string]ed25519.PublicKey // by hex key ID
+
+	// AllowUnsigned accepts snapshots without a signature, which can be
+	// useful during a migration to signed snapshots. A snapshot with an
+	// invalid signature is never accepted.
+	AllowUnsigned bool
+}
+
+// NewVerifier returns a Verifier that trusts the given public keys
+func NewVerifier(keys ...ed25519.PublicKey) *Verifier {
+	v := &Verifier{keys: make(map[string]ed25519.PublicKey)}
+	for _, key := range keys {
+		v.keys[hex.EncodeToString(KeyID(key))] = key
+	}
+	return v
+}
+
+// LoadVerifier loads PEM encoded PKIX Ed25519 public keys, as generated by
+// 'openssl pkey -pubout'. A file can contain multiple keys.
+func LoadVerifier(paths []string) (*Verifier, error) {
+	var keys []ed25519.PublicKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		n := 0
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			edKey, ok := key.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("%s: not an Ed25519 public key", path)
+			}
+			keys = append(keys, edKey)
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("%s: no PEM data found", path)
+		}
+	}
+	return NewVerifier(keys...), nil
+}
+
+// verify checks the signature read by a StreamReader
+func (v *Verifier) verify(sr *StreamReader) error {
+	return v.verifyMeta(sr.FormatVersion, sr.CompatVersion, sr.metaPB, sr.Signature, sr.Checked)
+}
+
+// verifyMeta checks the signature of the versions and marshalled Meta.
+// Checked indicates that the Meta had checksums, which were verified.
+func (v *Verifier) verifyMeta(formatVersion, compatVersion uint32, metaPB []byte, sig *Signature, checked bool) error {
+	if sig == nil {
+		if v.AllowUnsigned {
+			return nil
+		}
+		return fmt.Errorf("%w: snapshot is not signed", ErrBadSignature)
+	}
+	if !checked {
+		return fmt.Errorf("%w: signed snapshot has no checksums", ErrBadSignature)
+	}
+	key, exists := v.keys[hex.EncodeToString(sig.KeyID)]
+	if !exists {
+		return fmt.Errorf("%w: unknown key ID %x", ErrBadSignature, sig.KeyID)
+	}
+	data := signedData(formatVersion, compatVersion, metaPB)
+	if !ed25519.Verify(key, data, sig.Signature) {
+		return fmt.Errorf("%w: verification failed for key ID %x", ErrBadSignature, sig.KeyID)
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ const (
 	FieldSnapshotMeta          = 2
 	FieldSnapshotDBI           = 3
 	FieldSnapshotCompatVersion = 4
+	FieldSnapshotSignature     = 5
 )
 
 // Snapshot is the root object in a snapshot protobuf
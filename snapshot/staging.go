@@ -0,0 +1,112 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// NewStagedStreamReader returns a StreamReader like NewStreamReader, but it
+// first decompresses the whole snapshot to a temporary staging file in dir,
+// which is then mapped into memory. The DBI messages are read directly from
+// the mapping instead of being copied into a buffer, so that the kernel can
+// page the uncompressed data in and out as needed, instead of holding
+// gigabytes of DBI data on the heap.
+//
+// The staging file is removed right after it has been mapped, so that it
+// does not remain behind if the process is killed. Close removes the mapping.
+// The returned DBIs remain valid until Close.
+func NewStagedStreamReader(data []byte, dir string, dicts ...[]byte) (*StreamReader, error) {
+	gr, err := newReader(data, dicts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	defer func() {
+		_ = gr.Close()
+	}()
+
+	f, err := os.CreateTemp(dir, "lightningstream-staging-*")
+	if err != nil {
+		return nil, fmt.Errorf("stage snapshot: %w", err)
+	}
+	defer func() {
+		_ = f.Close() // the mapping remains valid
+	}()
+	if err := os.Remove(f.Name()); err != nil {
+		return nil, fmt.Errorf("stage snapshot: %w", err)
+	}
+	n, err := io.Copy(f, gr)
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return nil, fmt.Errorf("stage snapshot: %w", err) // write error
+		}
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+
+	mr := &mappedReader{}
+	if n > 0 {
+		mr.data, err = syscall.Mmap(int(f.Fd()), 0, int(n), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, fmt.Errorf("map staged snapshot: %w", err)
+		}
+	}
+	sr := &StreamReader{
+		gr:   mr,
+		r:    mr,
+		sums: newChecksummer(),
+	}
+	if fr, ok := gr.(*framedStreamReader); ok {
+		sr.Skipped = fr.skipped
+		sr.sums.setSkipped(fr.skipped)
+	}
+	return sr, nil
+}
+
+// mappedReader reads the decompressed data from a staging file mapped into
+// memory.
+type mappedReader struct {
+	data []byte
+	pos  int
+}
+
+func (m *mappedReader) Read(p []byte) (int, error) {
+	if m.pos >= len(m.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.pos:])
+	m.pos += n
+	return n, nil
+}
+
+func (m *mappedReader) ReadByte() (byte, error) {
+	if m.pos >= len(m.data) {
+		return 0, io.EOF
+	}
+	b := m.data[m.pos]
+	m.pos++
+	return b, nil
+}
+
+// next returns the next n bytes without copying them
+func (m *mappedReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(m.data)-m.pos) {
+		m.pos = len(m.data)
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := m.data[m.pos : m.pos+int(n)]
+	m.pos += int(n)
+	return b, nil
+}
+
+// Close removes the mapping
+func (m *mappedReader) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
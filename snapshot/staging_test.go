@@ -0,0 +1,44 @@
+package snapshot
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStagedStreamReader(t *testing.T) {
+	dir := t.TempDir()
+	orig := makeTestSnapshot(1000)
+	data, _, err := DumpData(orig)
+	require.NoError(t, err)
+
+	sr, err := NewStagedStreamReader(data, dir)
+	require.NoError(t, err)
+	dbi, err := sr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, orig.FormatVersion, sr.FormatVersion)
+	assert.Equal(t, orig.Meta, sr.Meta)
+	assert.Equal(t, orig.Databases[0].Marshal(), dbi.Marshal())
+	_, err = sr.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// The staging file is removed right away
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+	require.NoError(t, sr.Close())
+
+	// Truncated and invalid data
+	_, err = NewStagedStreamReader(data[:len(data)/2], dir)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	_, err = NewStagedStreamReader([]byte("invalid"), dir)
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	// Missing directory
+	_, err = NewStagedStreamReader(data, dir+"/missing")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrCorrupt)
+}
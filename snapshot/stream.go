@@ -0,0 +1,521 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"time"
+
+	"github.com/CrowdStrike/csproto"
+	"github.com/c2h5oh/datasize"
+)
+
+// DefaultStreamChunkSize is the default size at which a StreamWriter writes
+// out the DBI data it buffered.
+const DefaultStreamChunkSize = 16 * MB
+
+// StreamWriter writes a compressed snapshot without first constructing all
+// DBIs in memory.
+//
+// A protobuf message must be prefixed with its length, so the entries of a DBI
+// are buffered until about ChunkSize bytes have been collected. These are then
+// written out as a DBI message with the DBI name, flags and transform, and the
+// remaining entries will follow in one or more DBI messages with the same name.
+// This is safe, because snapshot loaders merge DBI messages one entry at a time.
+// The values of a single key are never split across chunks, so that the
+// values of a DupSort key are loaded together.
+//
+// The Meta is written last, because fields like the LMDB transaction ID
+// are not always known before all data has been read. It includes SHA-256
+// checksums of all DBI data and of every DBI, which the StreamReader verifies
+// once it has read the Meta. If a Signer is set, the Meta is followed by
+// a Signature.
+//
+// With Compression.Framed, every DBI message is written as an independently
+// compressed block of a framed snapshot instead, see framed.go.
+//
+// With HashTree, the checksum of every DBI message is included in the Meta,
+// see DBIChecksum. The DBI is then split at keys selected by their hash once
+// a chunk has reached a quarter of the ChunkSize, instead of at the first key
+// after the ChunkSize, so that a change only affects the chunk that holds the
+// key, and the chunks before and after it remain the same.
+type StreamWriter struct {
+	ChunkSize int
+	Signer    *Signer
+	HashTree  bool
+
+	cw      *countingWriter // counts the protobuf bytes written
+	gw      io.WriteCloser  // compressing writer, nil if framed
+	fw      *framedWriter   // framed snapshot writer, if framed
+	out     *countingWriter // counts the compressed bytes written
+	chunk   *DBI            // current chunk, reused for all chunks
+	inDBI   bool            // between StartDBI and EndDBI
+	written bool            // chunk of the current DBI written
+	empty   int             // size of the chunk without entries
+	lastKey []byte          // last key appended to the current chunk
+	sums    *checksummer    // checksums of the DBI messages written
+	version [2]uint32       // format and compat version, for the signature
+	comp    string          // compression type, recorded in the Meta
+	tWrite  time.Duration   // time spent compressing and writing
+	err     error           // sticky error
+}
+
+// NewStreamWriter creates a StreamWriter that writes a snapshot with the given
+// format versions to w using compression c.
+func NewStreamWriter(w io.Writer, c Compression, formatVersion, compatVersion uint32) (*StreamWriter, error) {
+	sw := &StreamWriter{
+		ChunkSize: DefaultStreamChunkSize,
+		out:       &countingWriter{w: w},
+		chunk:     NewDBI(),
+		sums:      newChecksummer(),
+		version:   [2]uint32{formatVersion, compatVersion},
+		comp:      c.Type,
+	}
+	if sw.comp == "" {
+		sw.comp = CompressionGzip
+	}
+	if c.Framed {
+		fw, err := newFramedWriter(sw.out, c)
+		if err != nil {
+			return nil, err
+		}
+		sw.fw = fw
+		sw.cw = &countingWriter{w: &fw.block}
+	} else {
+		gw, err := c.newWriter(sw.out)
+		if err != nil {
+			return nil, err
+		}
+		sw.gw = gw
+		sw.cw = &countingWriter{w: gw}
+	}
+	header := Snapshot{
+		FormatVersion: formatVersion,
+		CompatVersion: compatVersion,
+	}
+	if err := sw.write(func(w io.Writer) error {
+		if _, err := header.WriteTo(w); err != nil {
+			return err
+		}
+		return sw.endBlock(BlockHeader, "")
+	}); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// StartDBI starts a new DBI. All entries appended until EndDBI is called
+// will be part of this DBI.
+func (sw *StreamWriter) StartDBI(name string, flags uint64, transform string) error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if sw.inDBI {
+		return fmt.Errorf("StartDBI: previous DBI not ended")
+	}
+	if sw.chunk.data == nil {
+		// Only allocate once, the buffer is reused for every chunk
+		sw.chunk.data = make([]byte, 0, sw.ChunkSize+sw.ChunkSize/8)
+	}
+	sw.chunk.reset(name, flags, transform)
+	sw.empty = sw.chunk.Size()
+	sw.inDBI = true
+	sw.written = false
+	sw.lastKey = sw.lastKey[:0]
+	sw.sums.chunks = sw.HashTree
+	return nil
+}
+
+// Append appends a KV to the current DBI. The data KV.Key and KV.Value refer
+// to is copied, so it is safe when they point directly into LMDB pages.
+func (sw *StreamWriter) Append(kv KV) error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if !sw.inDBI {
+		return fmt.Errorf("Append: no DBI started")
+	}
+	if sw.isChunkEnd(kv.Key) {
+		if err := sw.flushChunk(); err != nil {
+			return err
+		}
+		sw.chunk.reset(sw.chunk.name, sw.chunk.flags, sw.chunk.transform)
+	}
+	sw.chunk.Append(kv)
+	sw.lastKey = append(sw.lastKey[:0], kv.Key...)
+	return nil
+}
+
+// hashTreeBoundary selects on average one in this many keys as a chunk
+// boundary for a HashTree
+const hashTreeBoundary = 64
+
+// isChunkEnd returns true if the current chunk must be written out before
+// appending an entry with this key. The values of a key are never split.
+func (sw *StreamWriter) isChunkEnd(key []byte) bool {
+	size := sw.chunk.Size()
+	if bytes.Equal(sw.lastKey, key) {
+		return false
+	}
+	if size >= sw.ChunkSize {
+		return true
+	}
+	if !sw.HashTree || size < sw.ChunkSize/4 {
+		return false
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return h.Sum32()%hashTreeBoundary == 0
+}
+
+// EndDBI writes out any remaining entries of the current DBI. A DBI without
+// any entries is still written, so that receivers can create it.
+func (sw *StreamWriter) EndDBI() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if !sw.inDBI {
+		return fmt.Errorf("EndDBI: no DBI started")
+	}
+	sw.inDBI = false
+	if sw.written && sw.chunk.Size() == sw.empty {
+		return nil // nothing left to write
+	}
+	return sw.flushChunk()
+}
+
+// Close writes the Meta, flushes the compressor and returns the stats for
+// the snapshot written. It does not close the underlying writer. The
+// compression type is recorded in the Meta, unless already set.
+func (sw *StreamWriter) Close(meta Meta) (DumpDataStats, error) {
+	var stat DumpDataStats
+	if sw.err != nil {
+		return stat, sw.err
+	}
+	if sw.inDBI {
+		return stat, fmt.Errorf("Close: DBI not ended")
+	}
+	meta.DataSHA256, meta.DBIChecksums = sw.sums.sums()
+	if meta.Compression == "" {
+		meta.Compression = sw.comp
+	}
+	err := sw.write(func(w io.Writer) error {
+		tail := Snapshot{Meta: meta}
+		if _, err := tail.WriteTo(w); err != nil {
+			return err
+		}
+		if sw.Signer != nil {
+			sig := sw.Signer.sign(sw.version[0], sw.version[1], meta.Marshal())
+			if err := writeField(w, FieldSnapshotSignature, sig.Marshal()); err != nil {
+				return err
+			}
+		}
+		if sw.fw != nil {
+			if err := sw.fw.endBlock(BlockMeta, ""); err != nil {
+				return err
+			}
+			return sw.fw.close()
+		}
+		return sw.gw.Close()
+	})
+	if err != nil {
+		return stat, err
+	}
+	sw.chunk = nil
+	sw.err = fmt.Errorf("StreamWriter closed")
+	stat.TCompressed = sw.tWrite
+	stat.ProtobufSize = datasize.ByteSize(sw.cw.n)
+	stat.CompressedSize = datasize.ByteSize(sw.out.n)
+	stat.DataSHA256 = meta.DataSHA256
+	return stat, nil
+}
+
+// flushChunk writes the current chunk as a DBI message
+func (sw *StreamWriter) flushChunk() error {
+	sw.written = true
+	return sw.write(func(w io.Writer) error {
+		dbiPB := sw.chunk.Marshal()
+		sw.sums.add(sw.chunk.name, dbiPB)
+		if err := writeField(w, FieldSnapshotDBI, dbiPB); err != nil {
+			return err
+		}
+		return sw.endBlock(BlockDBI, sw.chunk.name)
+	})
+}
+
+// endBlock ends a block of a framed snapshot
+func (sw *StreamWriter) endBlock(kind BlockKind, name string) error {
+	if sw.fw == nil {
+		return nil
+	}
+	return sw.fw.endBlock(kind, name)
+}
+
+// writeField writes a length delimited top-level field
+func writeField(w io.Writer, tag int, msg []byte) error {
+	// Header with tag and length
+	var b [16]byte
+	n := csproto.EncodeTag(b[:], tag, csproto.WireTypeLengthDelimited)
+	n += csproto.EncodeVarint(b[n:], uint64(len(msg)))
+	if _, err := w.Write(b[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// write calls f with the protobuf writer and records the time spent and
+// any error.
+func (sw *StreamWriter) write(f func(w io.Writer) error) error {
+	t := time.Now()
+	err := f(sw.cw)
+	sw.tWrite += time.Since(t)
+	if err != nil {
+		sw.err = err
+	}
+	return err
+}
+
+// ErrCorrupt is returned by a StreamReader when the snapshot data cannot be
+// decoded.
+var ErrCorrupt = errors.New("corrupt snapshot")
+
+// maxStreamMessageSize limits the size of a single DBI message a StreamReader
+// will allocate a buffer for, to not crash on corrupt data.
+const maxStreamMessageSize = 1 << 36
+
+// StreamReader decodes a compressed snapshot one DBI message at a time,
+// instead of loading the whole uncompressed snapshot into memory.
+//
+// The FormatVersion and CompatVersion are set once they have been read, which
+// is before the first DBI for all snapshots written by this program. The Meta
+// is only complete once Next has returned io.EOF, because the StreamWriter
+// writes it after the DBIs.
+//
+// Once all data has been read, the checksums in the Meta are verified, and
+// Next returns an ErrCorrupt error instead of io.EOF if these do not match.
+// Checked is then set if the snapshot had checksums. If a Verifier is set,
+// the Signature is verified as well.
+//
+// For a partial framed snapshot, Skipped lists the DBIs that were left out.
+// Only the checksums of the DBIs present are verified.
+type StreamReader struct {
+	FormatVersion uint32
+	CompatVersion uint32
+	Meta          Meta
+	Checked       bool
+	Signature     *Signature
+	Verifier      *Verifier
+	Skipped       []string
+
+	gr     io.ReadCloser // decompressing reader
+	r      byteReader
+	buf    []byte // reused for every DBI message
+	sums   *checksummer
+	metaPB []byte // the Meta as read, for the signature
+}
+
+// NewStreamReader returns a StreamReader for snapshot file contents that are
+// gzip or zstd compressed. The dicts are any zstd dictionaries that may have
+// been used to compress the snapshot.
+func NewStreamReader(data []byte, dicts ...[]byte) (*StreamReader, error) {
+	gr, err := newReader(data, dicts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	sr := &StreamReader{
+		gr:   gr,
+		r:    bufio.NewReaderSize(gr, 64*1024),
+		sums: newChecksummer(),
+	}
+	if fr, ok := gr.(*framedStreamReader); ok {
+		sr.Skipped = fr.skipped
+		sr.sums.setSkipped(fr.skipped)
+	}
+	return sr, nil
+}
+
+// Next returns the next DBI message in the snapshot, or io.EOF if there are
+// no more. A DBI can be split over multiple messages with the same name.
+// The returned DBI is only valid until the next call to Next, because its
+// data buffer is reused.
+func (sr *StreamReader) Next() (*DBI, error) {
+	dbi, err := sr.next()
+	if err == io.EOF {
+		sr.Checked, err = sr.sums.verify(sr.Meta, sr.Skipped)
+		if err == nil && sr.Verifier != nil {
+			if err = sr.Verifier.verify(sr); err != nil {
+				return nil, err
+			}
+		}
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return dbi, err
+}
+
+func (sr *StreamReader) next() (*DBI, error) {
+	for {
+		v, err := binary.ReadUvarint(sr.r)
+		if err != nil {
+			return nil, err // io.EOF at a field boundary is the normal end
+		}
+		tag := int(v >> 3)
+		wireType := csproto.WireType(v & 0x7)
+
+		switch tag {
+		case FieldSnapshotFormatVersion, FieldSnapshotCompatVersion:
+			if err := expectWT(tag, wireType, csproto.WireTypeVarint); err != nil {
+				return nil, err
+			}
+			val, err := sr.readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			if tag == FieldSnapshotFormatVersion {
+				sr.FormatVersion = uint32(val)
+			} else {
+				sr.CompatVersion = uint32(val)
+			}
+		case FieldSnapshotMeta:
+			if err := expectWT(tag, wireType, csproto.WireTypeLengthDelimited); err != nil {
+				return nil, err
+			}
+			msg, err := sr.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			// The Meta strings refer to the data, which must therefore not
+			// be the reused buffer.
+			sr.metaPB = append([]byte(nil), msg...)
+			if err := sr.Meta.Unmarshal(sr.metaPB); err != nil {
+				return nil, err
+			}
+		case FieldSnapshotSignature:
+			if err := expectWT(tag, wireType, csproto.WireTypeLengthDelimited); err != nil {
+				return nil, err
+			}
+			msg, err := sr.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			sr.Signature = new(Signature)
+			if err := sr.Signature.Unmarshal(msg); err != nil {
+				return nil, err
+			}
+		case FieldSnapshotDBI:
+			if err := expectWT(tag, wireType, csproto.WireTypeLengthDelimited); err != nil {
+				return nil, err
+			}
+			msg, err := sr.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			dbi, err := NewDBIFromData(msg)
+			if err != nil {
+				return nil, err
+			}
+			sr.sums.add(dbi.Name(), msg)
+			return dbi, nil
+		default:
+			if err := sr.skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Close closes the decompressing reader
+func (sr *StreamReader) Close() error {
+	sr.buf = nil
+	return sr.gr.Close()
+}
+
+// readUvarint reads a varint inside a message, where EOF is unexpected
+func (sr *StreamReader) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(sr.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+// byteReader is the buffered reader of the decompressed data
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readBytes reads length delimited data into the reused buffer
+func (sr *StreamReader) readBytes() ([]byte, error) {
+	size, err := sr.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if size > maxStreamMessageSize {
+		return nil, fmt.Errorf("message too large: %d bytes", size)
+	}
+	if mr, ok := sr.r.(*mappedReader); ok {
+		return mr.next(size) // no copy needed
+	}
+	if uint64(cap(sr.buf)) < size {
+		sr.buf = make([]byte, size)
+	}
+	b := sr.buf[:size]
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// skip skips the data of an unknown field
+func (sr *StreamReader) skip(wireType csproto.WireType) error {
+	var n uint64
+	switch wireType {
+	case csproto.WireTypeVarint:
+		_, err := sr.readUvarint()
+		return err
+	case csproto.WireTypeLengthDelimited:
+		size, err := sr.readUvarint()
+		if err != nil {
+			return err
+		}
+		n = size
+	case csproto.WireTypeFixed32:
+		n = 4
+	case csproto.WireTypeFixed64:
+		n = 8
+	default:
+		return fmt.Errorf("unsupported wire type: %v", wireType)
+	}
+	if _, err := io.CopyN(io.Discard, sr.r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,248 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamWriter(t *testing.T) {
+	src := makeTestDBI(10_000)
+	srcKVs, err := src.AsInefficientKVList()
+	require.NoError(t, err)
+
+	for _, c := range []Compression{{}, {Type: CompressionZstd}, {Type: CompressionLZ4}} {
+		t.Run(c.Extension(), func(t *testing.T) {
+			var buf bytes.Buffer
+			sw, err := NewStreamWriter(&buf, c, 3, 2)
+			require.NoError(t, err)
+			sw.ChunkSize = 64 * 1024
+
+			// Empty DBI
+			require.NoError(t, sw.StartDBI("empty", 8, ""))
+			require.NoError(t, sw.EndDBI())
+
+			// Large DBI that gets split into chunks
+			require.NoError(t, sw.StartDBI("test-name", 42, "test-transform"))
+			for _, kv := range srcKVs {
+				require.NoError(t, sw.Append(kv))
+			}
+			require.NoError(t, sw.EndDBI())
+
+			st, err := sw.Close(makeTestMeta())
+			require.NoError(t, err)
+			assert.Equal(t, buf.Len(), int(st.CompressedSize))
+			assert.Greater(t, int(st.ProtobufSize), src.Size())
+
+			snap, err := LoadData(buf.Bytes())
+			require.NoError(t, err)
+			assert.Equal(t, uint32(3), snap.FormatVersion)
+			assert.Equal(t, uint32(2), snap.CompatVersion)
+			assert.Len(t, snap.Meta.DataSHA256, 32)
+			assert.Len(t, snap.Meta.DBIChecksums, 2)
+			assert.NotEmpty(t, snap.Meta.Compression)
+			meta := snap.Meta
+			meta.DataSHA256, meta.DBIChecksums, meta.Compression = nil, nil, ""
+			assert.Equal(t, makeTestMeta(), meta)
+
+			require.Greater(t, len(snap.Databases), 2)
+			assert.Equal(t, "empty", snap.Databases[0].Name())
+			assert.Equal(t, uint64(8), snap.Databases[0].Flags())
+			empty, err := snap.Databases[0].AsInefficientKVList()
+			require.NoError(t, err)
+			assert.Len(t, empty, 0)
+
+			var kvs []KV
+			for _, dbi := range snap.Databases[1:] {
+				assert.Equal(t, "test-name", dbi.Name())
+				assert.Equal(t, uint64(42), dbi.Flags())
+				assert.Equal(t, "test-transform", dbi.Transform())
+				assert.LessOrEqual(t, dbi.Size(), sw.ChunkSize+1024)
+				l, err := dbi.AsInefficientKVList()
+				require.NoError(t, err)
+				kvs = append(kvs, l...)
+			}
+			assert.Equal(t, srcKVs, kvs)
+		})
+	}
+}
+
+func TestStreamWriter_sameKeyNotSplit(t *testing.T) {
+	var buf bytes.Buffer
+	sw, err := NewStreamWriter(&buf, Compression{}, 3, 2)
+	require.NoError(t, err)
+	sw.ChunkSize = 50
+
+	require.NoError(t, sw.StartDBI("dupsort", 0, TransformDupSortHackV1))
+	for _, k := range []string{"a", "b", "b", "b", "b", "b", "c"} {
+		require.NoError(t, sw.Append(KV{
+			Key:   []byte(k),
+			Value: bytes.Repeat([]byte("x"), 40),
+		}))
+	}
+	require.NoError(t, sw.EndDBI())
+	_, err = sw.Close(Meta{})
+	require.NoError(t, err)
+
+	snap, err := LoadData(buf.Bytes())
+	require.NoError(t, err)
+	var keys []string
+	for _, dbi := range snap.Databases {
+		l, err := dbi.AsInefficientKVList()
+		require.NoError(t, err)
+		var chunkKeys string
+		for _, kv := range l {
+			chunkKeys += string(kv.Key)
+		}
+		keys = append(keys, chunkKeys)
+	}
+	assert.Equal(t, []string{"a", "bbbbb", "c"}, keys)
+}
+
+func TestStreamWriter_errors(t *testing.T) {
+	sw, err := NewStreamWriter(&bytes.Buffer{}, Compression{}, 3, 2)
+	require.NoError(t, err)
+	assert.Error(t, sw.Append(KV{Key: []byte("a")}))
+	assert.Error(t, sw.EndDBI())
+	require.NoError(t, sw.StartDBI("a", 0, ""))
+	assert.Error(t, sw.StartDBI("b", 0, ""))
+	_, err = sw.Close(Meta{})
+	assert.Error(t, err)
+}
+
+func TestStreamReader(t *testing.T) {
+	// Snapshot written in one go, with the Meta before the DBIs
+	orig := makeTestSnapshot(1000)
+	data, _, err := DumpData(orig)
+	require.NoError(t, err)
+
+	sr, err := NewStreamReader(data)
+	require.NoError(t, err)
+	dbi, err := sr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, orig.FormatVersion, sr.FormatVersion)
+	assert.Equal(t, orig.CompatVersion, sr.CompatVersion)
+	assert.Equal(t, orig.Meta, sr.Meta)
+	assert.Equal(t, orig.Databases[0].Marshal(), dbi.Marshal())
+	_, err = sr.Next()
+	assert.Equal(t, io.EOF, err)
+	require.NoError(t, sr.Close())
+
+	// Truncated and invalid data
+	sr, err = NewStreamReader(data[:len(data)/2])
+	require.NoError(t, err)
+	_, err = sr.Next()
+	assert.ErrorIs(t, err, ErrCorrupt)
+	_, err = NewStreamReader([]byte("invalid"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestStreamReader_checksums(t *testing.T) {
+	write := func(values ...string) []byte {
+		var buf bytes.Buffer
+		sw, err := NewStreamWriter(&buf, Compression{}, 3, 2)
+		require.NoError(t, err)
+		sw.ChunkSize = 10
+		for _, name := range []string{"a", "b"} {
+			require.NoError(t, sw.StartDBI(name, 0, ""))
+			for _, v := range values {
+				require.NoError(t, sw.Append(KV{Key: []byte(v), Value: []byte(v)}))
+			}
+			require.NoError(t, sw.EndDBI())
+		}
+		_, err = sw.Close(makeTestMeta())
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	data := write("x", "y", "z")
+	checked, err := Verify(data, nil)
+	require.NoError(t, err)
+	assert.True(t, checked)
+
+	snap, err := LoadData(data)
+	require.NoError(t, err)
+	require.Len(t, snap.Meta.DBIChecksums, 2)
+	assert.Equal(t, "b", snap.Meta.DBIChecksums[1].Name)
+	assert.Len(t, snap.Meta.DataSHA256, 32)
+
+	// Snapshot with the checksums of different data
+	other, err := LoadData(write("x", "Y", "z"))
+	require.NoError(t, err)
+	snap.Meta.DataSHA256 = other.Meta.DataSHA256
+	snap.Meta.DBIChecksums[1] = other.Meta.DBIChecksums[1]
+	forged, _, err := DumpData(snap)
+	require.NoError(t, err)
+	sr, err := NewStreamReader(forged)
+	require.NoError(t, err)
+	for err == nil {
+		_, err = sr.Next()
+	}
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.Contains(t, err.Error(), `DBI "b"`)
+
+	// Snapshots without checksums are not checked
+	checked, err = Verify(mustDumpData(t, makeTestSnapshot(10)), nil)
+	require.NoError(t, err)
+	assert.False(t, checked)
+}
+
+func mustDumpData(t *testing.T, snap *Snapshot) []byte {
+	data, _, err := DumpData(snap)
+	require.NoError(t, err)
+	return data
+}
+
+func TestStreamWriter_signing(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	otherPub, otherPriv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	write := func(signer *Signer) []byte {
+		var buf bytes.Buffer
+		sw, err := NewStreamWriter(&buf, Compression{}, 3, 2)
+		require.NoError(t, err)
+		sw.Signer = signer
+		require.NoError(t, sw.StartDBI("a", 0, ""))
+		require.NoError(t, sw.Append(KV{Key: []byte("k"), Value: []byte("v")}))
+		require.NoError(t, sw.EndDBI())
+		_, err = sw.Close(makeTestMeta())
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+	signed := write(NewSigner(priv))
+	unsigned := write(nil)
+
+	v := NewVerifier(pub)
+	_, err = Verify(signed, v)
+	assert.NoError(t, err)
+	_, err = Verify(write(NewSigner(otherPriv)), v)
+	assert.ErrorIs(t, err, ErrBadSignature)
+	_, err = Verify(signed, NewVerifier(otherPub))
+	assert.ErrorIs(t, err, ErrBadSignature)
+	_, err = Verify(unsigned, v)
+	assert.ErrorIs(t, err, ErrBadSignature)
+
+	v.AllowUnsigned = true
+	_, err = Verify(unsigned, v)
+	assert.NoError(t, err)
+
+	// Changed metadata invalidates the signature
+	sr, err := NewStreamReader(signed)
+	require.NoError(t, err)
+	for err == nil {
+		_, err = sr.Next()
+	}
+	require.Equal(t, io.EOF, err)
+	require.NotNil(t, sr.Signature)
+	assert.Equal(t, KeyID(pub), sr.Signature.KeyID)
+	assert.NoError(t, v.verify(sr))
+	sr.Meta.InstanceID = "forged"
+	sr.metaPB = sr.Meta.Marshal()
+	assert.ErrorIs(t, v.verify(sr), ErrBadSignature)
+}
@@ -10,6 +10,10 @@ const (
 	// TransformDupSortHackV1 is the 'transform' field for the current
 	// dupsort_hack key-value transformation.
 	TransformDupSortHackV1 = "dupsort_hack_v1"
+	// TransformDupSortNativeV1 is the 'transform' field for DupSort DBIs
+	// synced with dupsort_native. The key is repeated for every value, and
+	// every value has its own timestamp and flags.
+	TransformDupSortNativeV1 = "dupsort_native_v1"
 	// TransformNone indicates no transformation
 	TransformNone = ""
 )
@@ -19,7 +23,7 @@ func TransformSupported(transform string) bool {
 	switch transform {
 	case TransformNone:
 		return true
-	case TransformDupSortHackV1:
+	case TransformDupSortHackV1, TransformDupSortNativeV1:
 		return true
 	default:
 		return false
@@ -43,11 +47,12 @@ func (d *DBI) ValidateTransform(formatVersion uint32, nativeSchema bool) error {
 	// First formatVersion that has the transform field
 	if formatVersion >= 3 {
 		flagsDupSort := flags&lmdb.DupSort > 0
-		transformDupSort := transform == TransformDupSortHackV1
+		transformDupSort := transform == TransformDupSortHackV1 ||
+			transform == TransformDupSortNativeV1
 		if flagsDupSort && !transformDupSort {
 			return fmt.Errorf("snapshot dbi %q: dupsort DBI flag without "+
-				"expected transform (got %q, expected %q)",
-				dbiName, transform, TransformDupSortHackV1)
+				"expected transform (got %q, expected %q or %q)",
+				dbiName, transform, TransformDupSortHackV1, TransformDupSortNativeV1)
 		}
 		if !flagsDupSort && transformDupSort {
 			return fmt.Errorf("snapshot dbi %q: non-dupsort DBI flags with "+
@@ -1,10 +1,117 @@
 package snapshot
 
-// Update wraps a Snapshot and NameInfo
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Update wraps the compressed data of a snapshot and its NameInfo.
+// The snapshot is only decompressed while it is being loaded, see NewReader.
 type Update struct {
-	Snapshot *Snapshot
+	Data     []byte   // compressed snapshot file contents
+	Dicts    [][]byte // zstd dictionaries the snapshot may have been compressed with
 	NameInfo NameInfo
 	OnClose  func(u *Update)
+
+	// OnLoaded is called by the syncer once the snapshot has been loaded
+	// into the LMDB successfully.
+	OnLoaded func(u *Update)
+
+	// IsBase indicates that this full snapshot was only loaded as the base
+	// for a newer delta snapshot of the same instance.
+	IsBase bool
+
+	// The temporary file with the data after Spill, and its size
+	spilled     string
+	spilledSize int
+
+	// mapped is the spilled file mapped into memory by NewReader
+	mapped []byte
+}
+
+// Spill writes the data to a temporary file in dir and removes it from
+// memory. NewReader maps the file into memory when the snapshot is loaded,
+// which allows the kernel to page it out again. Close removes the file.
+func (u *Update) Spill(dir string) error {
+	if u.spilled != "" || len(u.Data) == 0 {
+		return nil
+	}
+	f, err := os.CreateTemp(dir, "lightningstream-spill-*")
+	if err != nil {
+		return fmt.Errorf("spill snapshot: %w", err)
+	}
+	_, err = f.Write(u.Data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("spill snapshot: %w", err)
+	}
+	u.spilled = f.Name()
+	u.spilledSize = len(u.Data)
+	u.Data = nil
+	return nil
+}
+
+// Spilled returns the temporary file with the data, if it was spilled
+func (u *Update) Spilled() string {
+	return u.spilled
+}
+
+// Size returns the size of the compressed data
+func (u *Update) Size() int {
+	if u.spilled != "" {
+		return u.spilledSize
+	}
+	return len(u.Data)
+}
+
+// NewReader returns a StreamReader for the snapshot data
+func (u *Update) NewReader() (*StreamReader, error) {
+	if u.spilled != "" && u.mapped == nil {
+		if err := u.mapSpilled(); err != nil {
+			return nil, err
+		}
+	}
+	return NewStreamReader(u.Data, u.Dicts...)
+}
+
+// NewStagedReader returns a StreamReader that decompresses the snapshot to a
+// staging file in dir first, see NewStagedStreamReader.
+func (u *Update) NewStagedReader(dir string) (*StreamReader, error) {
+	if u.spilled != "" && u.mapped == nil {
+		if err := u.mapSpilled(); err != nil {
+			return nil, err
+		}
+	}
+	return NewStagedStreamReader(u.Data, dir, u.Dicts...)
+}
+
+// mapSpilled maps the spilled file into memory as the data
+func (u *Update) mapSpilled() error {
+	f, err := os.Open(u.spilled)
+	if err != nil {
+		return fmt.Errorf("open spilled snapshot: %w", err)
+	}
+	defer func() {
+		_ = f.Close() // the mapping remains valid
+	}()
+	data, err := syscall.Mmap(int(f.Fd()), 0, u.spilledSize, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("map spilled snapshot: %w", err)
+	}
+	u.mapped = data
+	u.Data = data
+	return nil
+}
+
+// Loaded signals that the snapshot has been loaded successfully
+func (u *Update) Loaded() {
+	if u.OnLoaded != nil {
+		u.OnLoaded(u)
+	}
 }
 
 func (u *Update) Close() {
@@ -12,5 +119,13 @@ func (u *Update) Close() {
 		u.OnClose(u)
 	}
 	u.OnClose = nil
-	u.Snapshot = nil
+	u.Data = nil
+	if u.mapped != nil {
+		_ = syscall.Munmap(u.mapped)
+		u.mapped = nil
+	}
+	if u.spilled != "" {
+		_ = os.Remove(u.spilled)
+		u.spilled = ""
+	}
 }
@@ -0,0 +1,58 @@
+package snapshot
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdate_Spill(t *testing.T) {
+	var buf bytes.Buffer
+	sw, err := NewStreamWriter(&buf, Compression{}, 3, 2)
+	require.NoError(t, err)
+	require.NoError(t, sw.StartDBI("test", 0, ""))
+	require.NoError(t, sw.EndDBI())
+	_, err = sw.Close(makeTestMeta())
+	require.NoError(t, err)
+
+	closed := false
+	u := Update{
+		Data: buf.Bytes(),
+		OnClose: func(u *Update) {
+			closed = true
+		},
+	}
+	dir := t.TempDir()
+	require.NoError(t, u.Spill(dir))
+	assert.Nil(t, u.Data)
+	assert.Equal(t, buf.Len(), u.Size())
+	path := u.Spilled()
+	require.FileExists(t, path)
+
+	// Mapped back into memory for loading
+	sr, err := u.NewReader()
+	require.NoError(t, err)
+	dbi, err := sr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "test", dbi.Name())
+	_, err = sr.Next()
+	assert.Equal(t, io.EOF, err)
+	require.NoError(t, sr.Close())
+
+	u.Close()
+	assert.True(t, closed)
+	assert.NoFileExists(t, path)
+	assert.Equal(t, "", u.Spilled())
+
+	// Spill errors leave the data in memory
+	u = Update{Data: buf.Bytes()}
+	assert.Error(t, u.Spill(dir+"/missing"))
+	assert.Equal(t, buf.Bytes(), u.Data)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
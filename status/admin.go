@@ -0,0 +1,283 @@
+package status
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AdminPathPrefix is the path under which the admin API is served
+const AdminPathPrefix = "/admin/"
+
+// Controller allows runtime control of a syncer through the admin API
+type Controller interface {
+	TriggerSync()
+	ForceSnapshot()
+	Flush(ctx context.Context) error
+	Pause(send, receive bool)
+	Resume(send, receive bool)
+	Paused() (send, receive bool)
+	MergeStats() []MergeStats
+}
+
+// AddController registers the Controller of an LMDB with the admin API
+func AddController(name string, c Controller) {
+	gi.mu.Lock()
+	defer gi.mu.Unlock()
+	if gi.controllers == nil {
+		gi.controllers = make(map[string]Controller)
+	}
+	gi.controllers[name] = c
+}
+
+func RemoveController(name string) {
+	gi.mu.Lock()
+	defer gi.mu.Unlock()
+	delete(gi.controllers, name)
+}
+
+// Controllers returns the registered controllers by LMDB name
+func Controllers() map[string]Controller {
+	return gi.selectControllers("")
+}
+
+// FlushAll flushes the local changes of all LMDBs at the same time, see
+// Controller.Flush, and returns the first error.
+func FlushAll(ctx context.Context) error {
+	controllers := Controllers()
+	errs := make(chan error, len(controllers))
+	for _, c := range controllers {
+		go func(c Controller) {
+			errs <- c.Flush(ctx)
+		}(c)
+	}
+	var firstErr error
+	for range controllers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// AdminLMDB is the admin API status of an LMDB
+type AdminLMDB struct {
+	Name           string       `json:"name"`
+	PausedUpload   bool         `json:"paused_upload"`
+	PausedDownload bool         `json:"paused_download"`
+	LastTxnID      int64        `json:"last_txn_id,omitempty"`
+	MapSize        int64        `json:"map_size,omitempty"`
+	Used           uint64       `json:"used,omitempty"`
+	DBIs           []AdminDBI   `json:"dbis,omitempty"`
+	Merges         []MergeStats `json:"merges,omitempty"`
+	Error          string       `json:"error,omitempty"`
+}
+
+// AdminDBI are the statistics of a DBI returned by the admin API
+type AdminDBI struct {
+	Name          string `json:"name"`
+	Entries       uint64 `json:"entries"`
+	Depth         uint   `json:"depth"`
+	BranchPages   uint64 `json:"branch_pages"`
+	LeafPages     uint64 `json:"leaf_pages"`
+	OverflowPages uint64 `json:"overflow_pages"`
+	Used          uint64 `json:"used"`
+	Flags         string `json:"flags"`
+}
+
+// MergeStats are the totals of the changes and conflicts in a DBI caused by
+// merging remote snapshots since the start. A conflict is a remote entry that
+// differed from the local entry, which was either kept (LocalWon), replaced
+// by the remote entry (RemoteWon), or replaced by a different value returned
+// by the conflict resolver (Resolved).
+type MergeStats struct {
+	DBI       string `json:"dbi"`
+	Added     int64  `json:"added"`
+	Updated   int64  `json:"updated"`
+	Deleted   int64  `json:"deleted"`
+	Conflicts int64  `json:"conflicts"`
+	LocalWon  int64  `json:"conflicts_local_won"`
+	RemoteWon int64  `json:"conflicts_remote_won"`
+	Resolved  int64  `json:"conflicts_resolved"`
+}
+
+// AdminHandler returns the handler for the admin API, which requires the
+// token as a bearer token. All actions apply to all LMDBs, unless the `lmdb`
+// query parameter selects one:
+//
+//	POST /admin/sync      check for local and remote changes right away
+//	POST /admin/snapshot  store a full snapshot
+//	POST /admin/pause     pause upload, download or both (`direction`)
+//	POST /admin/resume    resume upload, download or both (`direction`)
+//	GET  /admin/stats     pause state, per-DBI statistics and merge statistics
+func AdminHandler(token string) http.Handler {
+	return &adminAPI{token: []byte(token)}
+}
+
+type adminAPI struct {
+	token []byte
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, AdminPathPrefix)
+	var apply func(c Controller)
+	switch action {
+	case "stats":
+		if r.Method != http.MethodGet {
+			a.methodNotAllowed(w, http.MethodGet)
+			return
+		}
+	case "sync":
+		apply = Controller.TriggerSync
+	case "snapshot":
+		apply = Controller.ForceSnapshot
+	case "pause", "resume":
+		send, receive, err := parseDirection(r.URL.Query().Get("direction"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apply = func(c Controller) {
+			if action == "pause" {
+				c.Pause(send, receive)
+			} else {
+				c.Resume(send, receive)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if apply != nil && r.Method != http.MethodPost {
+		a.methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	controllers := gi.selectControllers(r.URL.Query().Get("lmdb"))
+	if len(controllers) == 0 {
+		http.Error(w, "lmdb not found", http.StatusNotFound)
+		return
+	}
+	names := make([]string, 0, len(controllers))
+	for name, c := range controllers {
+		if apply != nil {
+			apply(c)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if apply != nil {
+		logrus.WithField("lmdbs", names).WithField("action", action).
+			Info("Admin API action")
+	}
+
+	var res []AdminLMDB
+	for _, name := range names {
+		st := AdminLMDB{Name: name}
+		st.PausedUpload, st.PausedDownload = controllers[name].Paused()
+		if action == "stats" {
+			st.Merges = controllers[name].MergeStats()
+		}
+		res = append(res, st)
+	}
+	if action == "stats" {
+		addDBStats(res, gi.DBInfo())
+	}
+
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+func (a *adminAPI) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), a.token) == 1
+}
+
+func (a *adminAPI) methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// selectControllers returns the controller with the given name, or all
+// controllers if the name is empty
+func (i *info) selectControllers(name string) map[string]Controller {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	res := make(map[string]Controller)
+	for n, c := range i.controllers {
+		if name == "" || n == name {
+			res[n] = c
+		}
+	}
+	return res
+}
+
+// parseDirection parses the direction query parameter of pause and resume
+func parseDirection(direction string) (send, receive bool, err error) {
+	switch direction {
+	case "", "both":
+		return true, true, nil
+	case "upload":
+		return true, false, nil
+	case "download":
+		return false, true, nil
+	default:
+		return false, false, fmt.Errorf(
+			"invalid direction %q, must be one of: upload, download, both", direction)
+	}
+}
+
+// addDBStats adds the LMDB and DBI statistics to the admin status
+func addDBStats(res []AdminLMDB, infos []DBInfo) {
+	for i := range res {
+		st := &res[i]
+		for _, info := range infos {
+			if info.Name != st.Name {
+				continue
+			}
+			if info.Err != nil {
+				st.Error = info.Err.Error()
+			}
+			if info.Info != nil {
+				st.LastTxnID = info.Info.LastTxnID
+				st.MapSize = info.Info.MapSize
+			}
+			st.Used = uint64(info.Used)
+			for _, ds := range info.DBIStats {
+				st.DBIs = append(st.DBIs, AdminDBI{
+					Name:          ds.Name,
+					Entries:       ds.Stat.Entries,
+					Depth:         ds.Stat.Depth,
+					BranchPages:   ds.Stat.BranchPages,
+					LeafPages:     ds.Stat.LeafPages,
+					OverflowPages: ds.Stat.OverflowPages,
+					Used:          uint64(ds.Used),
+					Flags:         ds.FlagsDisplay,
+				})
+			}
+		}
+	}
+}
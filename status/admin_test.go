@@ -0,0 +1,123 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testController struct {
+	synced, snapshots int
+	send, receive     bool
+	flushErr          error
+	merges            []MergeStats
+}
+
+func (c *testController) TriggerSync()   { c.synced++ }
+func (c *testController) ForceSnapshot() { c.snapshots++ }
+
+func (c *testController) Flush(ctx context.Context) error { return c.flushErr }
+
+func (c *testController) Pause(send, receive bool) {
+	c.send = c.send || send
+	c.receive = c.receive || receive
+}
+
+func (c *testController) Resume(send, receive bool) {
+	c.send = c.send && !send
+	c.receive = c.receive && !receive
+}
+
+func (c *testController) Paused() (send, receive bool) {
+	return c.send, c.receive
+}
+
+func (c *testController) MergeStats() []MergeStats {
+	return c.merges
+}
+
+func TestAdminHandler(t *testing.T) {
+	a := &testController{}
+	b := &testController{}
+	AddController("a", a)
+	AddController("b", b)
+	defer RemoveController("a")
+	defer RemoveController("b")
+
+	h := AdminHandler("secret")
+	do := func(method, target, token string) (int, []AdminLMDB) {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var res []AdminLMDB
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		}
+		return rec.Code, res
+	}
+
+	code, _ := do("POST", "/admin/sync", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do("POST", "/admin/sync", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, 0, a.synced)
+
+	code, res := do("POST", "/admin/sync", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, res, 2)
+	assert.Equal(t, 1, a.synced)
+	assert.Equal(t, 1, b.synced)
+
+	code, _ = do("POST", "/admin/snapshot?lmdb=b", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, a.snapshots)
+	assert.Equal(t, 1, b.snapshots)
+
+	code, _ = do("POST", "/admin/snapshot?lmdb=c", "secret")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do("GET", "/admin/snapshot", "secret")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = do("POST", "/admin/unknown", "secret")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, res = do("POST", "/admin/pause?direction=upload&lmdb=a", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []AdminLMDB{{Name: "a", PausedUpload: true}}, res)
+	code, res = do("POST", "/admin/pause?lmdb=b", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []AdminLMDB{{Name: "b", PausedUpload: true, PausedDownload: true}}, res)
+	code, _ = do("POST", "/admin/pause?direction=sideways", "secret")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do("POST", "/admin/resume?direction=download", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	a.merges = []MergeStats{{DBI: "records", Added: 2, Conflicts: 1, LocalWon: 1}}
+	code, res = do("GET", "/admin/stats", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []AdminLMDB{
+		{Name: "a", PausedUpload: true, Merges: a.merges},
+		{Name: "b", PausedUpload: true},
+	}, res)
+}
+
+func TestFlushAll(t *testing.T) {
+	a := &testController{}
+	b := &testController{}
+	AddController("a", a)
+	AddController("b", b)
+	defer RemoveController("a")
+	defer RemoveController("b")
+
+	require.NoError(t, FlushAll(context.Background()))
+	b.flushErr = errors.New("b: sending is paused")
+	assert.Equal(t, b.flushErr, FlushAll(context.Background()))
+}
@@ -0,0 +1,295 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/c2h5oh/datasize"
+
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer/heartbeat"
+)
+
+// DashboardSnapshots is the number of recent snapshots shown on the dashboard
+const DashboardSnapshots = 30
+
+// InstanceLag is the heartbeat of an instance with its lag behind the other
+// instances of the same LMDB
+type InstanceLag struct {
+	heartbeat.Status
+
+	// Lag is how much older the newest snapshot loaded by the instance is
+	// than the newest snapshot stored by any other instance.
+	Lag time.Duration
+
+	// NeverLoaded is true if other instances stored snapshots, but the
+	// instance did not load any yet.
+	NeverLoaded bool
+}
+
+// SnapshotEntry is a snapshot in the dashboard timeline
+type SnapshotEntry struct {
+	LMDB     string
+	Instance string
+	Time     time.Time
+	Delta    bool
+	Size     int64
+}
+
+// clusterLag determines the lag of every instance in the cluster
+func clusterLag(cluster map[string][]heartbeat.Status) map[string][]InstanceLag {
+	res := make(map[string][]InstanceLag, len(cluster))
+	for name, instances := range cluster {
+		for i, st := range instances {
+			var newestOther time.Time
+			for j, other := range instances {
+				if i != j && other.LastSnapshot.After(newestOther) {
+					newestOther = other.LastSnapshot
+				}
+			}
+			il := InstanceLag{Status: st}
+			switch {
+			case newestOther.IsZero():
+			case st.LastLoaded.IsZero():
+				il.NeverLoaded = true
+			case newestOther.After(st.LastLoaded):
+				il.Lag = newestOther.Sub(st.LastLoaded)
+			}
+			res[name] = append(res[name], il)
+		}
+	}
+	return res
+}
+
+// recentSnapshots returns the n most recent snapshots in the storage listing,
+// newest first. Other objects are ignored.
+func recentSnapshots(list simpleblob.BlobList, n int) []SnapshotEntry {
+	var res []SnapshotEntry
+	for _, b := range list {
+		ni, err := snapshot.ParseName(b.Name)
+		if err != nil {
+			continue
+		}
+		res = append(res, SnapshotEntry{
+			LMDB:     ni.SyncerName,
+			Instance: ni.InstanceID,
+			Time:     ni.Timestamp,
+			Delta:    ni.IsDelta(),
+			Size:     b.Size,
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.After(res[j].Time)
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+const dashboardTemplateString = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<meta http-equiv="refresh" content="10">
+	<title>Lightning Stream Dashboard</title>
+	<style>
+		body          { font-family: sans-serif; }
+		table, td, th { border: 1px solid #ccc; border-collapse: collapse; }
+		td, th        { padding: 5px; text-align: left; }
+		td.num        { text-align: right; }
+		td.error      { background-color: #ffb8b8; }
+		td.warning    { background-color: #fff1a8; }
+		td.no-error   { background-color: #a6f3a6; }
+		a             { text-decoration: none; color: #3c6ac5; }
+	</style>
+</head>
+<body>
+	<h1>⚡ Lightning Stream Dashboard</h1>
+	<p>
+		<a href="/">Status</a>
+		|
+		<a href="/metrics">Prometheus metrics</a>
+		|
+		<a href="/healthz">healthz</a>
+		|
+		<a href="/readyz">readyz</a>
+	</p>
+	<p>Generated at {{formatTime .Generated}}, refreshes every 10 seconds.</p>
+
+	<h2>Cluster instances</h2>
+	{{range $name, $instances := .Instances}}
+		<h3>{{$name}}</h3>
+		<table>
+		<thead>
+			<tr>
+				<th>Instance</th>
+				<th>Hostname</th>
+				<th>Version</th>
+				<th>Heartbeat</th>
+				<th>Last snapshot</th>
+				<th>Last loaded</th>
+				<th>Lag</th>
+			</tr>
+		</thead>
+		<tbody>
+		{{range $instances}}
+			<tr>
+				<td class="{{if .Alive}}no-error{{else}}error{{end}}">{{.Instance}}</td>
+				<td>{{.Hostname}}</td>
+				<td>{{.Version}}</td>
+				<td>{{formatTime .Time}}</td>
+				<td>{{formatTime .LastSnapshot}}</td>
+				<td>{{formatTime .LastLoaded}}</td>
+				{{if .NeverLoaded}}
+				<td class="warning">never loaded</td>
+				{{else}}
+				<td class="num">{{formatDuration .Lag}}</td>
+				{{end}}
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+	{{else}}
+		<p>No heartbeats, enable storage.heartbeat to see the cluster instances.</p>
+	{{end}}
+
+	<h2>DBI entries</h2>
+	{{range .DBInfo}}
+		<h3>{{.Name}}{{if .Err}} (error: {{.Err}}){{end}}</h3>
+		<table>
+		<thead>
+			<tr>
+				<th>DBI</th>
+				<th>Entries</th>
+				<th>Used</th>
+			</tr>
+		</thead>
+		<tbody>
+		{{range .DBIStats}}
+			<tr>
+				<td>{{.Name}}</td>
+				<td class="num">{{.Stat.Entries}}</td>
+				<td class="num">{{.Used.HumanReadable}}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+	{{end}}
+
+	<h2>Snapshot timeline</h2>
+	{{if .SnapshotsErr}}
+		<p>Error listing storage: {{.SnapshotsErr}}</p>
+	{{else}}
+		<table>
+		<thead>
+			<tr>
+				<th>Time</th>
+				<th>LMDB</th>
+				<th>Instance</th>
+				<th>Type</th>
+				<th>Size</th>
+			</tr>
+		</thead>
+		<tbody>
+		{{range .Snapshots}}
+			<tr>
+				<td>{{formatTime .Time}}</td>
+				<td>{{.LMDB}}</td>
+				<td>{{.Instance}}</td>
+				<td>{{if .Delta}}delta{{else}}full{{end}}</td>
+				<td class="num">{{byteSize .Size}}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+	{{end}}
+
+	<h2>Recent errors</h2>
+	{{if .Errors}}
+		<table>
+		<thead>
+			<tr>
+				<th>Time</th>
+				<th>Level</th>
+				<th>LMDB</th>
+				<th>Message</th>
+				<th>Error</th>
+			</tr>
+		</thead>
+		<tbody>
+		{{range .Errors}}
+			<tr>
+				<td>{{formatTime .Time}}</td>
+				<td class="{{if eq .Level "warning"}}warning{{else}}error{{end}}">{{.Level}}</td>
+				<td>{{.LMDB}}</td>
+				<td>{{.Message}}</td>
+				<td>{{.Error}}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+	{{else}}
+		<p>No warnings or errors since the start.</p>
+	{{end}}
+</body>
+</html>`
+
+var dashboardTemplate *htmltemplate.Template
+
+func init() {
+	var err error
+	dashboardTemplate, err = htmltemplate.New("dashboard").Funcs(htmltemplate.FuncMap{
+		"byteSize": func(size int64) string {
+			return datasize.ByteSize(size).HumanReadable()
+		},
+		"formatTime": func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return t.UTC().Format(time.RFC3339)
+		},
+		"formatDuration": func(d time.Duration) string {
+			return d.Round(time.Second).String()
+		},
+	}).Parse(dashboardTemplateString)
+	if err != nil {
+		log.Fatalf("BUG: Error in dashboard HTML template: %v", err)
+	}
+}
+
+// DashboardPage shows the cluster instances, snapshot timeline, DBI entry
+// counts, lag between instances and recent errors.
+func (p *Page) DashboardPage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	list, err := gi.ListBlobs(ctx)
+
+	data := struct {
+		Generated    time.Time
+		Instances    map[string][]InstanceLag
+		DBInfo       []DBInfo
+		Snapshots    []SnapshotEntry
+		SnapshotsErr error
+		Errors       []LogEntry
+	}{
+		Generated:    time.Now(),
+		Instances:    clusterLag(heartbeat.Cluster()),
+		DBInfo:       gi.DBInfo(),
+		Snapshots:    recentSnapshots(list, DashboardSnapshots),
+		SnapshotsErr: err,
+		Errors:       errorLog.List(),
+	}
+
+	err = dashboardTemplate.Execute(w, data)
+	if err != nil {
+		w.WriteHeader(500)
+		_, _ = w.Write([]byte(fmt.Sprintf("Template execution error: %v", err)))
+	}
+}
@@ -0,0 +1,76 @@
+package status
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/syncer/heartbeat"
+)
+
+func TestClusterLag(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := func(instance string, lastSnapshot, lastLoaded time.Time) heartbeat.Status {
+		return heartbeat.Status{Heartbeat: heartbeat.Heartbeat{
+			Instance:     instance,
+			LastSnapshot: lastSnapshot,
+			LastLoaded:   lastLoaded,
+		}}
+	}
+	a := status("a", t0.Add(time.Minute), t0.Add(2*time.Minute))
+	b := status("b", t0.Add(2*time.Minute), t0)
+	c := status("c", time.Time{}, time.Time{})
+	res := clusterLag(map[string][]heartbeat.Status{"main": {a, b, c}})
+	assert.Equal(t, map[string][]InstanceLag{"main": {
+		{Status: a},
+		{Status: b, Lag: time.Minute},
+		{Status: c, NeverLoaded: true},
+	}}, res)
+
+	// A single instance has no lag
+	res = clusterLag(map[string][]heartbeat.Status{"main": {c}})
+	assert.Equal(t, []InstanceLag{{Status: c}}, res["main"])
+}
+
+func TestRecentSnapshots(t *testing.T) {
+	list := simpleblob.BlobList{
+		{Name: "main__a__20240101-000001-000000000__G-0000000000000000.pb.gz", Size: 10},
+		{Name: "main__b__20240101-000003-000000000__G-0000000000000000.pb.zst", Size: 20},
+		{Name: "main__a__20240101-000002-000000000__G-0000000000000000__20240101-000001-000000000.delta.pb.gz", Size: 5},
+		{Name: "main.heartbeat__a.json", Size: 100},
+	}
+	res := recentSnapshots(list, 2)
+	require.Len(t, res, 2)
+	assert.Equal(t, "b", res[0].Instance)
+	assert.Equal(t, int64(20), res[0].Size)
+	assert.False(t, res[0].Delta)
+	assert.Equal(t, "a", res[1].Instance)
+	assert.Equal(t, "main", res[1].LMDB)
+	assert.True(t, res[1].Delta)
+}
+
+func TestDashboardPage(t *testing.T) {
+	h := &recentErrors{}
+	l := logrus.New()
+	l.AddHook(h)
+	for i := 0; i < MaxRecentErrors+5; i++ {
+		l.WithField("db", "main").Warnf("warning %d", i)
+	}
+	l.Info("not kept")
+	errs := h.List()
+	require.Len(t, errs, MaxRecentErrors)
+	assert.Equal(t, fmt.Sprintf("warning %d", MaxRecentErrors+4), errs[0].Message)
+	assert.Equal(t, "main", errs[0].LMDB)
+	assert.Equal(t, "warning", errs[0].Level)
+
+	p := &Page{}
+	rec := httptest.NewRecorder()
+	p.DashboardPage(rec, httptest.NewRequest("GET", "/dashboard", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Lightning Stream Dashboard")
+}
@@ -83,3 +83,16 @@ func (ht *HealthTracker) AddSuccess() {
 
 	ht.logger.Debug("tracked successful attempt")
 }
+
+// Ready returns an error if the tracked activity has been failing for longer
+// than the error duration. It can be registered as a readiness check.
+func (ht *HealthTracker) Ready() error {
+	if ht.sequence.Load() == 0 {
+		return nil
+	}
+	failingFor := time.Since(ht.since.Load())
+	if failingFor < ht.Config.ErrorDuration {
+		return nil
+	}
+	return fmt.Errorf("failed to %s for %s - last error: '%s'", ht.activity, failingFor.Round(time.Second), ht.lastErr.Load())
+}
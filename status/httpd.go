@@ -2,6 +2,7 @@ package status
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	htmltemplate "html/template"
 	"log"
@@ -14,6 +15,11 @@ import (
 	"github.com/wojas/go-healthz"
 
 	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/sidecar"
+	"powerdns.com/platform/lightningstream/status/readiness"
+	"powerdns.com/platform/lightningstream/syncer/changefeed"
+	"powerdns.com/platform/lightningstream/syncer/heartbeat"
+	"powerdns.com/platform/lightningstream/syncer/storageevents"
 )
 
 func StartHTTPServer(c config.Config) {
@@ -27,7 +33,25 @@ func StartHTTPServer(c config.Config) {
 	logrus.WithField("address", c.HTTP.Address).Info("HTTP stats server enabled")
 	http.Handle("/metrics", promhttp.Handler())
 	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/readyz", readiness.Handler())
 	http.HandleFunc("/storage", page.BlobListPage)
+	http.HandleFunc("/instances", page.InstancesPage)
+	http.HandleFunc("/dashboard", page.DashboardPage)
+	logrus.AddHook(&errorLog) // recent errors for the dashboard
+	if ev := c.Storage.Events; ev.Enabled && ev.Webhook {
+		http.Handle(storageevents.WebhookPath, storageevents.Handler())
+	}
+	if ci := c.ChangeImport; ci.Enabled && ci.HTTP {
+		http.Handle(changefeed.ImportPath, changefeed.ImportHandler(ci.HTTPToken))
+	}
+	if c.Sidecar.PreStop {
+		logrus.Info("HTTP sidecar prestop endpoint enabled")
+		http.Handle(sidecar.PreStopPath, sidecar.PreStopHandler(c.Sidecar.PreStopTimeout, FlushAll))
+	}
+	if c.HTTP.Admin.Enabled {
+		logrus.Info("HTTP admin API enabled")
+		http.Handle(AdminPathPrefix, AdminHandler(c.HTTP.Admin.Token))
+	}
 	http.Handle("/", page)
 	go func() {
 		err := http.ListenAndServe(c.HTTP.Address, nil)
@@ -59,9 +83,13 @@ const statusTemplateString = `<!DOCTYPE html>
 <body>
 	<h1>⚡ Lightning Stream Status</h1>
 	<p>
+		<a href="/dashboard">Dashboard</a>
+		|
 		<a href="/metrics">Prometheus metrics</a>
 		|
 		<a href="/healthz">healthz</a>
+		|
+		<a href="/readyz">readyz</a>
 	</p>
 
 	<h2>LMDBs</h2>
@@ -123,6 +151,38 @@ const statusTemplateString = `<!DOCTYPE html>
 		</table>
 	{{end}}
 
+	{{range $name, $instances := .Instances}}
+		<h2>Instances of {{$name}}</h2>
+		<table>
+		<thead>
+			<tr>
+				<th>Instance</th>
+				<th>Hostname</th>
+				<th>Version</th>
+				<th>Generation</th>
+				<th>Started</th>
+				<th>Heartbeat</th>
+				<th>Last snapshot</th>
+				<th>Last loaded</th>
+			</tr>
+		</thead>
+		<tbody>
+		{{range $instances}}
+			<tr>
+				<td class="{{if .Alive}}no-error{{else}}error{{end}}">{{.Instance}}</td>
+				<td>{{.Hostname}}</td>
+				<td>{{.Version}}</td>
+				<td>{{.GenerationID}}</td>
+				<td>{{formatTime .StartTime}}</td>
+				<td>{{formatTime .Time}}</td>
+				<td>{{formatTime .LastSnapshot}}</td>
+				<td>{{formatTime .LastLoaded}}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+	{{end}}
+
 	<h2>Storage</h2>
 	<p><a href="storage">Storage snapshot listing (text)</a></p>
 
@@ -137,6 +197,12 @@ func init() {
 		"byteSize": func(size int64) string {
 			return datasize.ByteSize(size).HumanReadable()
 		},
+		"formatTime": func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return t.UTC().Format(time.RFC3339)
+		},
 	}).Parse(statusTemplateString)
 	if err != nil {
 		log.Fatalf("BUG: Error in status HTML template: %v", err)
@@ -160,6 +226,21 @@ func (p *Page) BlobListPage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// InstancesPage returns the last loaded heartbeats of all instances by LMDB
+// as JSON.
+func (p *Page) InstancesPage(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(heartbeat.Cluster(), "", "  ")
+	if err != nil {
+		w.WriteHeader(500)
+		_, _ = fmt.Fprintf(w, "ERROR: %v\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	_, _ = w.Write(data)
+}
+
 func (p *Page) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
@@ -167,11 +248,13 @@ func (p *Page) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := struct {
-		Config config.Config
-		DBInfo []DBInfo
+		Config    config.Config
+		DBInfo    []DBInfo
+		Instances map[string][]heartbeat.Status
 	}{
-		Config: p.c,
-		DBInfo: gi.DBInfo(),
+		Config:    p.c,
+		DBInfo:    gi.DBInfo(),
+		Instances: heartbeat.Cluster(),
 	}
 
 	err := statusTemplate.Execute(w, data)
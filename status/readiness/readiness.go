@@ -0,0 +1,75 @@
+// Package readiness implements the /readyz endpoint. Components register
+// checks that return an error as long as this instance is not ready to serve
+// traffic, for example before the initial sync has completed.
+//
+// Unlike healthz, there are no warnings: an instance is either ready or not.
+package readiness
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var (
+	mu     sync.Mutex
+	checks = make(map[string]func() error)
+)
+
+// Register adds or replaces a named readiness check
+func Register(name string, check func() error) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks[name] = check
+}
+
+// Deregister removes a named readiness check
+func Deregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(checks, name)
+}
+
+// Check runs all registered checks and returns the errors of the failing
+// ones by name.
+func Check() map[string]error {
+	mu.Lock()
+	funcs := make(map[string]func() error, len(checks))
+	for name, f := range checks {
+		funcs[name] = f
+	}
+	mu.Unlock()
+
+	failed := make(map[string]error)
+	for name, f := range funcs {
+		if err := f(); err != nil {
+			failed[name] = err
+		}
+	}
+	return failed
+}
+
+// Handler returns the /readyz HTTP handler. It responds with a 200 status
+// if all checks pass, and with a 503 status and the failing checks if not.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed := Check()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		if len(failed) == 0 {
+			_, _ = fmt.Fprintln(w, "ok")
+			return
+		}
+		names := make([]string, 0, len(failed))
+		for name := range failed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(w, "not ready")
+		for _, name := range names {
+			_, _ = fmt.Fprintf(w, "%s: %v\n", name, failed[name])
+		}
+	})
+}
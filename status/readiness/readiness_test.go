@@ -0,0 +1,38 @@
+package readiness
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	get := func() (int, string) {
+		rec := httptest.NewRecorder()
+		Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	ready := false
+	Register("a", func() error { return nil })
+	Register("b", func() error {
+		if !ready {
+			return errors.New("initial sync pending")
+		}
+		return nil
+	})
+	defer Deregister("a")
+	defer Deregister("b")
+
+	code, body := get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready\nb: initial sync pending\n", body)
+
+	ready = true
+	code, body = get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+}
@@ -0,0 +1,71 @@
+package status
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxRecentErrors is the number of recent warnings and errors kept for the
+// dashboard
+const MaxRecentErrors = 25
+
+// LogEntry is a warning or error logged recently
+type LogEntry struct {
+	Time    time.Time
+	Level   string
+	LMDB    string
+	Message string
+	Error   string
+}
+
+// recentErrors is a logrus hook that keeps the most recent warnings and errors
+type recentErrors struct {
+	mu      sync.Mutex
+	entries []LogEntry // oldest first
+}
+
+var errorLog recentErrors
+
+func (h *recentErrors) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+	}
+}
+
+func (h *recentErrors) Fire(e *logrus.Entry) error {
+	le := LogEntry{
+		Time:    e.Time,
+		Level:   e.Level.String(),
+		Message: e.Message,
+	}
+	if db, ok := e.Data["db"]; ok {
+		le.LMDB = fmt.Sprint(db)
+	}
+	if err, ok := e.Data[logrus.ErrorKey]; ok {
+		le.Error = fmt.Sprint(err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) >= MaxRecentErrors {
+		h.entries = append(h.entries[:0], h.entries[1:]...)
+	}
+	h.entries = append(h.entries, le)
+	return nil
+}
+
+// List returns the recent warnings and errors, newest first
+func (h *recentErrors) List() []LogEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := make([]LogEntry, len(h.entries))
+	for i, le := range h.entries {
+		res[len(res)-1-i] = le
+	}
+	return res
+}
@@ -21,6 +21,10 @@ type StartConfig struct {
 	WarnDuration       time.Duration `yaml:"warn_duration"`
 	ReportHealthz      bool          `yaml:"report_healthz"`
 	ReportMetadata     bool          `yaml:"report_metadata"`
+	// CatchUpBarrier makes healthz fail immediately, ignoring the warn and
+	// error durations, until all remote snapshots that existed at startup
+	// have been loaded.
+	CatchUpBarrier bool `yaml:"catch_up_barrier"`
 }
 
 func (sc StartConfig) Validated() StartConfig {
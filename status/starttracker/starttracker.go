@@ -2,11 +2,13 @@ package starttracker
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wojas/go-healthz"
 	"go.uber.org/atomic"
+	"powerdns.com/platform/lightningstream/status/readiness"
 )
 
 type StartTracker struct {
@@ -18,6 +20,8 @@ type StartTracker struct {
 	prefix                string
 	metaFieldStartup      string
 	logger                logrus.FieldLogger
+	done                  chan struct{}
+	doneOnce              sync.Once
 }
 
 func New(sc StartConfig, prefix string) *StartTracker {
@@ -26,6 +30,7 @@ func New(sc StartConfig, prefix string) *StartTracker {
 		prefix:           prefix,
 		metaFieldStartup: fmt.Sprintf("startup_%s", prefix),
 		logger:           logrus.WithField("starttracker", prefix),
+		done:             make(chan struct{}),
 	}
 
 	// Default startup state to false (not finished)
@@ -39,6 +44,9 @@ func New(sc StartConfig, prefix string) *StartTracker {
 	// Register tracker to healthz
 	st.RegisterTracker()
 
+	// Not ready to serve traffic before the startup phase has completed
+	readiness.Register(fmt.Sprintf("%s_startup", prefix), st.Ready)
+
 	return st
 }
 
@@ -55,7 +63,10 @@ func (st *StartTracker) RegisterTracker() {
 		failingFor := time.Since(st.since.Load())
 
 		// Tests for pending activities
-		if !st.initialListing.Load() || !st.initialStore.Load() || !st.initialReceiveAndLoad.Load() {
+		if !st.completed() {
+			if st.Config.CatchUpBarrier {
+				return fmt.Errorf("initial catch-up pending after %s", failingFor.Round(time.Second))
+			}
 			if st.Config.ReportHealthz {
 				if failingFor >= st.Config.ErrorDuration {
 					st.logger.Debugf("successful startup pending after %s is violating the error threshold (%s)", failingFor.Round(time.Second), st.Config.ErrorDuration)
@@ -87,11 +98,20 @@ func (st *StartTracker) RegisterTracker() {
 	st.logger.Info("registered tracker for startup phase")
 }
 
+// Ready returns an error as long as the startup phase has not completed
+func (st *StartTracker) Ready() error {
+	if !st.completed() {
+		return fmt.Errorf("startup pending after %s", time.Since(st.since.Load()).Round(time.Second))
+	}
+	return nil
+}
+
 // SetPassedInitialListing is called once initial storage snapshot listing has been obtained
 func (st *StartTracker) SetPassedInitialListing() {
 	st.initialListing.Store(true)
 
 	st.logger.Debug("tracked successful initial listing")
+	st.checkDone()
 }
 
 // SetPassedInitialStore is called once initial storage snapshot has been stored (or skipped)
@@ -99,6 +119,7 @@ func (st *StartTracker) SetPassedInitialStore() {
 	st.initialStore.Store(true)
 
 	st.logger.Debug("tracked successful initial snapshot store")
+	st.checkDone()
 }
 
 // SetPassCompleted is called repeatedly the main sync loop has completed a pass
@@ -108,5 +129,24 @@ func (st *StartTracker) SetPassCompleted() {
 		st.initialReceiveAndLoad.Store(true)
 
 		st.logger.Debug("tracked successful initial receive & load")
+		st.checkDone()
+	}
+}
+
+// Done returns a channel that is closed once the startup phase has completed,
+// which means that all remote snapshots known at startup have been loaded.
+func (st *StartTracker) Done() <-chan struct{} {
+	return st.done
+}
+
+func (st *StartTracker) completed() bool {
+	return st.initialListing.Load() && st.initialStore.Load() && st.initialReceiveAndLoad.Load()
+}
+
+func (st *StartTracker) checkDone() {
+	if st.completed() {
+		st.doneOnce.Do(func() {
+			close(st.done)
+		})
 	}
 }
@@ -0,0 +1,36 @@
+package starttracker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func isDone(st *StartTracker) bool {
+	select {
+	case <-st.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestStartTracker_Done(t *testing.T) {
+	st := New(StartConfig{CatchUpBarrier: true}, "test_done")
+	assert.Error(t, st.Ready())
+	assert.False(t, isDone(st))
+
+	st.SetPassedInitialListing()
+	st.SetPassedInitialStore()
+	assert.Error(t, st.Ready())
+	assert.False(t, isDone(st))
+
+	st.SetPassCompleted()
+	assert.NoError(t, st.Ready())
+	assert.True(t, isDone(st))
+
+	// Subsequent passes must not close the channel again
+	st.SetPassCompleted()
+	st.SetPassedInitialStore()
+	assert.True(t, isDone(st))
+}
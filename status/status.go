@@ -14,9 +14,10 @@ import (
 )
 
 type info struct {
-	mu  sync.Mutex
-	dbs []dbs
-	st  simpleblob.Interface
+	mu          sync.Mutex
+	dbs         []dbs
+	st          simpleblob.Interface
+	controllers map[string]Controller
 }
 
 type dbs struct {
@@ -0,0 +1,155 @@
+// Package systemd implements the systemd service notifications (sd_notify)
+// for a service with Type=notify:
+//
+//   - READY=1 is sent once all LMDBs have loaded the remote snapshots that
+//     existed at startup.
+//   - WATCHDOG=1 is sent at half the WatchdogSec interval of the service, as
+//     long as every syncer has completed a sync cycle within that interval,
+//     so that systemd restarts a wedged process.
+//   - STOPPING=1 is sent on shutdown.
+//
+// Nothing is sent when the process is not started by systemd.
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mu     sync.Mutex
+	cycles = make(map[string]func() time.Time)
+)
+
+// Register adds or replaces a named function that returns the time of the
+// last completed sync cycle
+func Register(name string, lastCycle func() time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	cycles[name] = lastCycle
+}
+
+// Deregister removes a named sync cycle function
+func Deregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(cycles, name)
+}
+
+// Stale returns the names of the syncers that have not completed a sync
+// cycle within maxAge, in sorted order.
+func Stale(maxAge time.Duration) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var stale []string
+	for name, lastCycle := range cycles {
+		if time.Since(lastCycle()) > maxAge {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// Notify sends a state to the service manager, like "READY=1". It does
+// nothing if NOTIFY_SOCKET is not set.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("systemd notify: %w", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("systemd notify: %w", err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns the watchdog timeout of the service, or zero if
+// the watchdog is not enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil // meant for another process
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("systemd: invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Run sends READY=1 once all caughtUp channels are closed, and then the
+// watchdog pings until the context is cancelled. It returns right away
+// if the process is not started by systemd.
+func Run(ctx context.Context, caughtUp []<-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	l := logrus.WithField("component", "systemd")
+	interval, err := WatchdogInterval()
+	if err != nil {
+		l.WithError(err).Warn("Watchdog disabled")
+	}
+
+	notify := func(state string) {
+		if err := Notify(state); err != nil {
+			l.WithError(err).Warn("Notification failed")
+		}
+	}
+	notify("STATUS=Waiting for the initial sync")
+	for _, ch := range caughtUp {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			notify("STOPPING=1")
+			return
+		}
+	}
+	notify("READY=1\nSTATUS=Syncing")
+	l.Info("Notified systemd that the service is ready")
+
+	if interval <= 0 {
+		<-ctx.Done()
+		notify("STOPPING=1")
+		return
+	}
+	l.WithField("watchdog", interval).Info("Sending systemd watchdog pings")
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			notify("STOPPING=1")
+			return
+		case <-ticker.C:
+		}
+		if stale := Stale(interval); len(stale) > 0 {
+			l.WithField("lmdbs", strings.Join(stale, ",")).
+				Warn("No sync cycle completed within the watchdog interval, not sending a watchdog ping")
+			continue
+		}
+		notify("WATCHDOG=1")
+	}
+}
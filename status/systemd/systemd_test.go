@@ -0,0 +1,111 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+// listen returns a connection that receives the notifications
+func listen(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// receive returns the next notification
+func receive(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.NoError(t, Notify("READY=1"))
+
+	conn := listen(t)
+	require.NoError(t, Notify("READY=1"))
+	assert.Equal(t, "READY=1", receive(t, conn))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	d, err := WatchdogInterval()
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d)
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "1")
+	d, err = WatchdogInterval()
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d, "other process")
+
+	t.Setenv("WATCHDOG_PID", "")
+	d, err = WatchdogInterval()
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, d)
+
+	t.Setenv("WATCHDOG_USEC", "foo")
+	_, err = WatchdogInterval()
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	conn := listen(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	var lastCycle atomic.Time
+	lastCycle.Store(time.Now())
+	Register("test", lastCycle.Load)
+	defer Deregister("test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	caughtUp := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Run(ctx, []<-chan struct{}{caughtUp})
+		close(done)
+	}()
+
+	assert.Equal(t, "STATUS=Waiting for the initial sync", receive(t, conn))
+	close(caughtUp)
+	assert.Equal(t, "READY=1\nSTATUS=Syncing", receive(t, conn))
+
+	// Pings while the sync cycles complete
+	for i := 0; i < 3; i++ {
+		lastCycle.Store(time.Now())
+		assert.Equal(t, "WATCHDOG=1", receive(t, conn))
+	}
+
+	// No pings for a wedged syncer
+	lastCycle.Store(time.Now().Add(-time.Minute))
+	assert.Equal(t, []string{"test"}, Stale(20*time.Millisecond))
+	for {
+		// Drain a ping that may have been sent before the update
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		if _, err := conn.Read(make([]byte, 1024)); err != nil {
+			break
+		}
+	}
+
+	cancel()
+	<-done
+	assert.Equal(t, "STOPPING=1", receive(t, conn))
+}
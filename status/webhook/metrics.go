@@ -0,0 +1,25 @@
+package webhook
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	metricSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_webhook_sent_total",
+			Help: "Number of webhook events sent, by event and result",
+		},
+		[]string{"event", "result"},
+	)
+	metricDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_webhook_dropped_total",
+			Help: "Number of webhook events dropped because the queue was full",
+		},
+		[]string{"event"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricSent)
+	prometheus.MustRegister(metricDropped)
+}
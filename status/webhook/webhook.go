@@ -0,0 +1,275 @@
+// Package webhook sends sync events to external HTTP endpoints.
+//
+// Events are sent as a JSON POST in the background. Every webhook has its own
+// queue, so that a slow endpoint does not delay the others, and events are
+// dropped when the queue is full, so that webhooks never slow down syncing.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// Event types
+const (
+	EventSnapshotStored = "snapshot_stored" // a snapshot was uploaded
+	EventSnapshotLoaded = "snapshot_loaded" // a remote snapshot was applied
+	EventConflict       = "conflict"        // a conflict resolver was used for a remote snapshot
+	EventStorageError   = "storage_error"   // a storage operation failed
+	EventFailover       = "failover"        // the storage failed over or back
+	EventZonesChanged   = "zones_changed"   // remote snapshots changed PowerDNS zones
+	EventDiverged       = "diverged"        // the instances did not converge within the window
+	EventConverged      = "converged"       // the instances converged again after EventDiverged
+)
+
+// Events lists all event types
+var Events = []string{
+	EventSnapshotStored,
+	EventSnapshotLoaded,
+	EventConflict,
+	EventStorageError,
+	EventFailover,
+	EventZonesChanged,
+	EventDiverged,
+	EventConverged,
+}
+
+const (
+	// DefaultTimeout is the default timeout for a single POST
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultRetryInterval is the time between retries of a failed POST
+	DefaultRetryInterval = time.Second
+
+	// QueueSize is the number of events queued per webhook
+	QueueSize = 100
+)
+
+// Config configures a single webhook
+type Config struct {
+	URL string `yaml:"url"`
+	// Events to send, all events if empty
+	Events []string `yaml:"events"`
+	// Headers are extra HTTP headers, e.g. for authentication
+	Headers map[string]string `yaml:"headers"`
+	// Timeout for a single POST (default: 10s)
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is the number of times a failed POST is retried
+	Retries int `yaml:"retries"`
+}
+
+// Check validates the Config
+func (c Config) Check() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url: must be an http or https URL")
+	}
+	for _, e := range c.Events {
+		if !inList(Events, e) {
+			return fmt.Errorf("events: unknown event %q, must be one of: %s",
+				e, strings.Join(Events, ", "))
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout: must not be negative")
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("retries: must not be negative")
+	}
+	return nil
+}
+
+// Event is the JSON payload of a webhook. Fields that do not apply to the
+// event type are omitted.
+type Event struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	LMDB     string    `json:"lmdb,omitempty"`
+
+	SnapshotName     string `json:"snapshot_name,omitempty"`
+	SnapshotInstance string `json:"snapshot_instance,omitempty"`
+
+	// Conflicts is the number of conflicts per DBI for EventConflict
+	Conflicts map[string]int `json:"conflicts,omitempty"`
+
+	// Operation is the storage operation ("list", "load" or "store") and
+	// Error the error message for EventStorageError.
+	Operation string `json:"operation,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	// Backend is the storage backend now in use ("primary" or "secondary")
+	// for EventFailover.
+	Backend string `json:"backend,omitempty"`
+
+	// Zones are the names of the changed zones for EventZonesChanged.
+	// ZonesUnknown is true if the names of some changed zones are unknown.
+	Zones        []string `json:"zones,omitempty"`
+	ZonesUnknown bool     `json:"zones_unknown,omitempty"`
+
+	// DBI is the DBI that diverged or converged for EventDiverged and
+	// EventConverged. Instances are the instances with different data for
+	// EventDiverged.
+	DBI       string   `json:"dbi,omitempty"`
+	Instances []string `json:"instances,omitempty"`
+}
+
+var (
+	mu       sync.Mutex
+	hooks    []*hook
+	instance string
+)
+
+// Start starts sending events to the configured webhooks until the context
+// is cancelled. The instance name is added to all events.
+func Start(ctx context.Context, conf []Config, instanceName string) {
+	mu.Lock()
+	defer mu.Unlock()
+	instance = instanceName
+	for _, c := range conf {
+		h := newHook(c)
+		hooks = append(hooks, h)
+		go h.run(ctx)
+		h.l.WithField("events", h.events()).Info("Webhook enabled")
+	}
+}
+
+// Notify queues an event for all webhooks that want it. It never blocks and
+// does nothing if no webhooks are configured.
+func Notify(e Event) {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Instance == "" {
+		e.Instance = instance
+	}
+	for _, h := range hooks {
+		if !h.wants(e.Event) {
+			continue
+		}
+		select {
+		case h.queue <- e:
+		default:
+			metricDropped.WithLabelValues(e.Event).Inc()
+			h.l.WithField("event", e.Event).Warn("Webhook queue full, dropping event")
+		}
+	}
+}
+
+type hook struct {
+	c      Config
+	l      logrus.FieldLogger
+	client *http.Client
+	queue  chan Event
+
+	retryInterval time.Duration // for tests
+}
+
+func newHook(c Config) *hook {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	u, _ := url.Parse(c.URL) // validated by Check
+	return &hook{
+		c:             c,
+		l:             logrus.WithField("component", "webhook").WithField("host", u.Host),
+		client:        &http.Client{Timeout: c.Timeout},
+		queue:         make(chan Event, QueueSize),
+		retryInterval: DefaultRetryInterval,
+	}
+}
+
+func (h *hook) wants(event string) bool {
+	return len(h.c.Events) == 0 || inList(h.c.Events, event)
+}
+
+func (h *hook) events() []string {
+	if len(h.c.Events) == 0 {
+		return Events
+	}
+	return h.c.Events
+}
+
+func (h *hook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-h.queue:
+			h.send(ctx, e)
+		}
+	}
+}
+
+// send POSTs an event with retries
+func (h *hook) send(ctx context.Context, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		h.l.WithError(err).Error("Could not encode webhook event")
+		return
+	}
+	for i := 0; i <= h.c.Retries; i++ {
+		if i > 0 {
+			if utils.SleepContext(ctx, h.retryInterval) != nil {
+				return
+			}
+		}
+		err = h.post(ctx, body)
+		if err == nil {
+			metricSent.WithLabelValues(e.Event, "success").Inc()
+			return
+		}
+		h.l.WithError(err).WithField("event", e.Event).WithField("attempt", i+1).
+			Debug("Webhook failed")
+	}
+	metricSent.WithLabelValues(e.Event, "failure").Inc()
+	h.l.WithError(err).WithField("event", e.Event).Warn("Webhook failed, giving up")
+}
+
+func (h *hook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.c.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func inList(list []string, item string) bool {
+	for _, v := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Check(t *testing.T) {
+	assert.NoError(t, Config{URL: "https://example.com/hook"}.Check())
+	assert.NoError(t, Config{URL: "http://localhost:8080", Events: []string{EventConflict}}.Check())
+	assert.Error(t, Config{URL: ""}.Check())
+	assert.Error(t, Config{URL: "ftp://example.com"}.Check())
+	assert.Error(t, Config{URL: "https://example.com", Events: []string{"foo"}}.Check())
+	assert.Error(t, Config{URL: "https://example.com", Retries: -1}.Check())
+}
+
+func TestNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer func() {
+		hooks = nil
+	}()
+
+	received := make(chan Event, 10)
+	fails := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		received <- e
+	}))
+	defer srv.Close()
+
+	// Not started yet, ignored
+	Notify(Event{Event: EventSnapshotStored})
+
+	Start(ctx, []Config{{
+		URL:     srv.URL,
+		Events:  []string{EventSnapshotLoaded, EventConflict},
+		Headers: map[string]string{"X-Token": "secret"},
+		Retries: 1,
+	}}, "self")
+	require.Len(t, hooks, 1)
+	hooks[0].retryInterval = time.Millisecond
+
+	Notify(Event{Event: EventSnapshotStored}) // not subscribed
+	Notify(Event{Event: EventSnapshotLoaded, LMDB: "main", SnapshotInstance: "other"})
+	Notify(Event{Event: EventConflict, LMDB: "main", Conflicts: map[string]int{"records": 2}})
+
+	select {
+	case e := <-received:
+		assert.Equal(t, EventSnapshotLoaded, e.Event)
+		assert.Equal(t, "self", e.Instance)
+		assert.Equal(t, "main", e.LMDB)
+		assert.Equal(t, "other", e.SnapshotInstance)
+		assert.False(t, e.Time.IsZero())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case e := <-received:
+		assert.Equal(t, EventConflict, e.Event)
+		assert.Equal(t, map[string]int{"records": 2}, e.Conflicts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	assert.Len(t, received, 0)
+}
@@ -0,0 +1,79 @@
+package syncer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/c2h5oh/datasize"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/stats"
+)
+
+// errEnvCompacted is returned by the sync loop after an auto compaction, to
+// make Sync reopen the env.
+var errEnvCompacted = errors.New("env compacted")
+
+// autoCompact compacts the LMDB if its free pages exceed the configured
+// thresholds, and returns true if it did. The env must be reopened after that.
+// The compaction is skipped if another process has the LMDB open.
+func (s *Syncer) autoCompact(env *lmdb.Env) (bool, error) {
+	ac := s.c.LMDBAutoCompaction
+	var freelist stats.Freelist
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		freelist, err = stats.ReadFreelist(env, txn)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	envStat, err := env.Stat()
+	if err != nil {
+		return false, err
+	}
+	freeBytes := freelist.FreeBytes(envStat.PSize)
+	l := s.l.WithFields(logrus.Fields{
+		"fragmentation": freelist.Fragmentation(),
+		"free_size":     datasize.ByteSize(freeBytes).HumanReadable(),
+	})
+	if freelist.Fragmentation() < ac.Threshold || freeBytes < uint64(ac.MinFreeSize) {
+		l.Debug("No auto compaction needed")
+		return false, nil
+	}
+
+	l.Info("Compacting LMDB")
+	t0 := time.Now()
+	if err := lmdbenv.Compact(env); err != nil {
+		if errors.Is(err, lmdbenv.ErrEnvInUse) {
+			metricAutoCompactions.WithLabelValues(s.name, "skipped").Inc()
+			l.WithError(err).Warn("Not compacting LMDB that is open in another process")
+			return false, nil
+		}
+		metricAutoCompactions.WithLabelValues(s.name, "failed").Inc()
+		return false, err
+	}
+	metricAutoCompactions.WithLabelValues(s.name, "success").Inc()
+	l.WithField("time_total", time.Since(t0).Round(time.Millisecond)).
+		Info("Compacted LMDB, reopening it")
+	return true, nil
+}
+
+// reopenEnv closes the env and opens it again after an auto compaction
+func (s *Syncer) reopenEnv() error {
+	if err := s.Env().Close(); err != nil {
+		return err
+	}
+	env, err := OpenEnv(s.l, s.lc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.env = env
+	s.mu.Unlock()
+
+	// The compaction reset the transaction ID, so the next snapshot must be
+	// a full one.
+	s.delta = deltaState{}
+	return nil
+}
@@ -0,0 +1,65 @@
+package syncer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+func TestSyncer_autoCompact(t *testing.T) {
+	s, env := createInstance(t, "a", memory.New(), false)
+	s.delta.nDeltas = 1
+
+	// Fill and mostly empty the DBI to leave free pages
+	val := make([]byte, 1000)
+	err := env.Update(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenDBI(testDBIName, lmdb.Create)
+		require.NoError(t, err)
+		for i := 0; i < 300; i++ {
+			require.NoError(t, txn.Put(dbi, []byte(fmt.Sprintf("key-%04d", i)), val, 0))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	err = env.Update(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenDBI(testDBIName, 0)
+		require.NoError(t, err)
+		for i := 1; i < 300; i++ {
+			require.NoError(t, txn.Del(dbi, []byte(fmt.Sprintf("key-%04d", i)), nil))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	s.c.LMDBAutoCompaction = config.AutoCompaction{
+		Enabled:     true,
+		Threshold:   0.5,
+		MinFreeSize: datasize.GB,
+	}
+	compacted, err := s.autoCompact(env)
+	require.NoError(t, err)
+	assert.False(t, compacted, "free pages below min_free_size")
+
+	s.c.LMDBAutoCompaction.MinFreeSize = 64 * datasize.KB
+	compacted, err = s.autoCompact(env)
+	require.NoError(t, err)
+	assert.True(t, compacted)
+
+	require.NoError(t, s.reopenEnv())
+	assert.NotSame(t, env, s.Env())
+	assert.Equal(t, deltaState{}, s.delta)
+	data, err := dumpData(s.Env(), false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key-0000": string(val)}, data)
+
+	compacted, err = s.autoCompact(s.Env())
+	require.NoError(t, err)
+	assert.False(t, compacted, "already compacted")
+	require.NoError(t, s.Env().Close())
+}
@@ -0,0 +1,193 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/c2h5oh/datasize"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/backends/prefix"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/utils"
+	"powerdns.com/platform/lightningstream/utils/cron"
+)
+
+// runBackups writes a full backup on the configured schedule until the
+// context is cancelled. The first backup is only written once all snapshots
+// that existed at startup have been loaded. Failed backups are logged and
+// retried at the next scheduled time.
+func (s *Syncer) runBackups(ctx context.Context, env *lmdb.Env) error {
+	schedule, err := cron.Parse(s.c.Backup.Schedule)
+	if err != nil {
+		return err // checked by config.Check
+	}
+	select {
+	case <-s.CaughtUp():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for {
+		now := time.Now().UTC()
+		next := schedule.Next(now)
+		if next.IsZero() {
+			return fmt.Errorf("backup schedule %q never matches", schedule)
+		}
+		s.l.WithField("next_backup", next).Debug("Waiting for next backup")
+		if err := utils.SleepContext(ctx, next.Sub(now)); err != nil {
+			return err
+		}
+		if _, err := s.BackupOnce(ctx, env); err != nil {
+			if utils.IsCanceled(ctx) {
+				return ctx.Err()
+			}
+			metricBackupsFailed.WithLabelValues(s.name).Inc()
+			s.l.WithError(err).Error("Backup failed")
+			continue
+		}
+		if err := s.pruneBackups(ctx); err != nil {
+			s.l.WithError(err).Warn("Removing old backups failed")
+		}
+	}
+}
+
+// BackupOnce writes a full snapshot of the LMDB to the backup prefix and
+// returns its name. Unlike SendOnce, it only needs a read transaction. In
+// shadow mode, the shadow DBIs are read as they are, so local changes that
+// were not included in a normal snapshot yet are not included.
+func (s *Syncer) BackupOnce(ctx context.Context, env *lmdb.Env) (name string, err error) {
+	t0 := time.Now()
+	var meta snapshot.Meta
+	meta.DatabaseName = s.name
+	meta.Hostname = hostname
+	meta.InstanceID = s.instanceID()
+	meta.GenerationID = s.generationID()
+
+	var buf bytes.Buffer
+	var sw *snapshot.StreamWriter
+	var ts time.Time
+	nDBIs := 0
+	err = env.View(func(txn *lmdb.Txn) error {
+		ts = time.Now()
+		meta.TimestampNano = uint64(header.TimestampFromTime(ts))
+		meta.LmdbTxnID = int64(txn.ID())
+
+		dbiNames, err := lmdbenv.ReadDBINames(txn)
+		if err != nil {
+			return err
+		}
+		exists := make(map[string]bool, len(dbiNames))
+		for _, dbiName := range dbiNames {
+			exists[dbiName] = true
+		}
+
+		sw, err = snapshot.NewStreamWriter(&buf, s.compression,
+			snapshot.CurrentFormatVersion, snapshot.WriteCompatFormatVersion)
+		if err != nil {
+			return err
+		}
+		if n := s.c.MemorySnapshotChunkSize; n > 0 {
+			sw.ChunkSize = int(n)
+		}
+		sw.Signer = s.signer
+
+		for _, dbiName := range dbiNames {
+			if strings.HasPrefix(dbiName, SyncDBIPrefix) {
+				continue // skip our own special dbs
+			}
+			if !s.lc.IsDBIIncluded(dbiName) {
+				continue // excluded from sync
+			}
+			readDBIName := dbiName
+			if !s.lc.SchemaTracksChanges {
+				readDBIName = SyncDBIShadowPrefix + dbiName
+				if !exists[readDBIName] {
+					// New DBI that was not included in a snapshot yet
+					s.l.WithField("dbi", dbiName).Debug(
+						"Skipping DBI without shadow DBI in backup")
+					continue
+				}
+			}
+			if _, err := s.streamDBI(txn, readDBIName, dbiName, nil, nil, nil, sw); err != nil {
+				return fmt.Errorf("dbi %s: %w", dbiName, err)
+			}
+			nDBIs++
+			if utils.IsCanceled(ctx) {
+				return context.Canceled
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := sw.Close(meta); err != nil {
+		return "", err
+	}
+	out := buf.Bytes()
+
+	name = snapshot.NameWithExtension(s.name, s.instanceID(), s.generationID(),
+		ts, s.compression.Extension())
+	st := prefix.New(s.st, s.c.Backup.Prefix)
+	if err := s.storeWithRetry(ctx, st, name, out); err != nil {
+		return "", fmt.Errorf("store backup %s: %w", name, err)
+	}
+	metricBackupsStored.WithLabelValues(s.name).Inc()
+	metricBackupsLastTimestamp.WithLabelValues(s.name).Set(float64(ts.UnixNano()) / 1e9)
+	metricBackupsLastSize.WithLabelValues(s.name).Set(float64(len(out)))
+	s.l.WithFields(logrus.Fields{
+		"backup_name": s.c.Backup.Prefix + name,
+		"backup_size": datasize.ByteSize(len(out)).HumanReadable(),
+		"dbis":        nDBIs,
+		"time_total":  time.Since(t0).Round(time.Millisecond),
+	}).Info("Stored backup")
+	return name, nil
+}
+
+// pruneBackups removes the backups of this instance that are neither one of
+// the newest Backup.KeepLast, nor within Backup.KeepInterval. Backups of other
+// instances are left to those instances.
+func (s *Syncer) pruneBackups(ctx context.Context) error {
+	conf := s.c.Backup
+	if conf.KeepLast <= 0 && conf.KeepInterval <= 0 {
+		return nil
+	}
+	st := prefix.New(s.st, conf.Prefix)
+	ls, err := st.List(ctx, s.name+"__")
+	if err != nil {
+		return err
+	}
+	var backups []snapshot.NameInfo
+	for _, name := range ls.Names() {
+		ni, err := snapshot.ParseName(name)
+		if err != nil || ni.InstanceID != s.instanceID() {
+			continue
+		}
+		backups = append(backups, ni)
+	}
+	// Newest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Timestamp.After(backups[j].Timestamp)
+	})
+	now := time.Now()
+	for i, ni := range backups {
+		if i < conf.KeepLast {
+			continue
+		}
+		if conf.KeepInterval > 0 && now.Sub(ni.Timestamp) < conf.KeepInterval {
+			continue
+		}
+		if err := st.Delete(ctx, ni.FullName); err != nil {
+			return fmt.Errorf("delete backup %s: %w", ni.FullName, err)
+		}
+		metricBackupsRemoved.WithLabelValues(s.name).Inc()
+		s.l.WithField("backup_name", conf.Prefix+ni.FullName).Info("Removed old backup")
+	}
+	return nil
+}
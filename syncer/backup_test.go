@@ -0,0 +1,98 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/fs"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func TestSyncer_BackupOnce(t *testing.T) {
+	// The fs backend stores the backup prefix as a subdirectory
+	newStorage := map[string]func(t *testing.T) simpleblob.Interface{
+		"memory": func(t *testing.T) simpleblob.Interface {
+			return memory.New()
+		},
+		"fs": func(t *testing.T) simpleblob.Interface {
+			st, err := fs.New(fs.Options{RootPath: t.TempDir()})
+			require.NoError(t, err)
+			return st
+		},
+	}
+	for _, backend := range []string{"memory", "fs"} {
+		for _, withHeader := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/withHeader=%v", backend, withHeader), func(t *testing.T) {
+				testBackupOnce(t, newStorage[backend](t), withHeader)
+			})
+		}
+	}
+}
+
+func testBackupOnce(t *testing.T, st simpleblob.Interface, withHeader bool) {
+	ctx := context.Background()
+	syncerA, envA := createInstance(t, "a", st, withHeader)
+	syncerB, envB := createInstance(t, "b", st, withHeader)
+	syncerA.c.Backup = config.Backup{Prefix: "backups/", KeepLast: 2}
+
+	exp := map[string]string{"foo": "bar", "abc": "def"}
+	for key, val := range exp {
+		setKey(t, envA, key, val, withHeader)
+	}
+	_, err := syncerA.SendOnce(ctx, envA)
+	require.NoError(t, err)
+
+	// Stored under the backup prefix, not with the normal snapshots
+	name, err := syncerA.BackupOnce(ctx, envA)
+	require.NoError(t, err)
+	assert.Len(t, listInstanceSnapshots(st, "a"), 1)
+	data, err := st.Load(ctx, "backups/"+name)
+	require.NoError(t, err)
+
+	// A backup contains the same data as a normal snapshot
+	ni, err := snapshot.ParseName(name)
+	require.NoError(t, err)
+	_, _, err = syncerB.LoadOnce(ctx, envB, "a", snapshot.Update{
+		Data:     data,
+		NameInfo: ni,
+	}, 0)
+	require.NoError(t, err)
+	kv, err := dumpData(envB, withHeader)
+	require.NoError(t, err)
+	assert.Equal(t, exp, kv)
+
+	// Only the newest backups of our own instance are kept
+	ts := ni.Timestamp
+	old := []string{
+		snapshot.Name(testLMDBName, "a", "G-0", ts.Add(-3*time.Hour)),
+		snapshot.Name(testLMDBName, "a", "G-0", ts.Add(-2*time.Hour)),
+		snapshot.Name(testLMDBName, "a", "G-0", ts.Add(-time.Hour)),
+		snapshot.Name(testLMDBName, "b", "G-0", ts.Add(-3*time.Hour)),
+	}
+	for _, n := range old {
+		require.NoError(t, st.Store(ctx, "backups/"+n, data))
+	}
+	require.NoError(t, syncerA.pruneBackups(ctx))
+	ls, err := st.List(ctx, "backups/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"backups/" + old[2], "backups/" + old[3], "backups/" + name,
+	}, ls.Names())
+
+	// Unless they are within the keep interval
+	syncerA.c.Backup.KeepLast = 0
+	syncerA.c.Backup.KeepInterval = time.Minute
+	require.NoError(t, syncerA.pruneBackups(ctx))
+	ls, err = st.List(ctx, "backups/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"backups/" + old[3], "backups/" + name,
+	}, ls.Names())
+}
@@ -0,0 +1,42 @@
+package syncer
+
+import (
+	"time"
+
+	"powerdns.com/platform/lightningstream/syncer/receiver"
+)
+
+// bulkLoad is the initial bulk load of an empty LMDB, see config.BulkLoad
+type bulkLoad struct {
+	r       *receiver.Receiver
+	started time.Time
+	loads   int
+}
+
+// startBulkLoad starts a bulk load if it is enabled and the LMDB is empty.
+// It returns nil if no bulk load is started. The durability is set by the
+// caller.
+func (s *Syncer) startBulkLoad(r *receiver.Receiver, hasDataAtStart bool) *bulkLoad {
+	conf := s.c.LMDBBulkLoad
+	if !conf.Enabled || hasDataAtStart || s.opt.SendOnly || s.opt.DryRun {
+		return nil
+	}
+	r.StartBulkLoad(conf.DownloadRate)
+	s.bulkLoading.Store(true)
+	metricBulkLoadActive.WithLabelValues(s.name).Set(1)
+	s.l.Info("LMDB is empty, starting bulk load")
+	return &bulkLoad{
+		r:       r,
+		started: time.Now(),
+	}
+}
+
+// end ends the bulk load. It is safe to call on a nil bulkLoad, or more than
+// once.
+func (b *bulkLoad) end(s *Syncer) {
+	if b == nil || !s.bulkLoading.Swap(false) {
+		return
+	}
+	b.r.BulkLoadDone()
+	metricBulkLoadActive.WithLabelValues(s.name).Set(0)
+}
@@ -0,0 +1,68 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/syncer/receiver"
+)
+
+func TestSyncer_bulkLoad(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		st := memory.New()
+		syncerA, envA := createInstance(t, "a", st, withHeader)
+		syncerB, envB := createInstance(t, "b", st, withHeader)
+		syncerC, envC := createInstance(t, "c", st, withHeader)
+		syncerC.c.LMDBBulkLoad.Enabled = true
+		syncerC.c.LMDBDurability.BulkLoad = config.DurabilityNoMetaSync
+		syncerC.c.OnlyOnce = true
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		setKey(t, envA, "foo", "a", withHeader)
+		_, err := syncerA.SendOnce(ctx, envA)
+		require.NoError(t, err)
+		setKey(t, envB, "bar", "b", withHeader)
+		_, err = syncerB.SendOnce(ctx, envB)
+		require.NoError(t, err)
+
+		require.NoError(t, syncerC.Sync(ctx))
+		assertKeyWait(t, envC, "foo", "a", withHeader)
+		assertKeyWait(t, envC, "bar", "b", withHeader)
+
+		// Full durability after the bulk load
+		assert.False(t, syncerC.bulkLoading.Load())
+		flags, err := envC.Flags()
+		require.NoError(t, err)
+		assert.Zero(t, flags&lmdb.NoMetaSync)
+	}
+}
+
+func TestSyncer_startBulkLoad(t *testing.T) {
+	st := memory.New()
+	s, _ := createInstance(t, "a", st, true)
+	r := receiver.New(st, s.c, s.name, s.l, "a")
+
+	// Disabled by default
+	b := s.startBulkLoad(r, false)
+	assert.Nil(t, b)
+	b.end(s)
+
+	// Only for an empty LMDB
+	s.c.LMDBBulkLoad.Enabled = true
+	assert.Nil(t, s.startBulkLoad(r, true))
+
+	b = s.startBulkLoad(r, false)
+	require.NotNil(t, b)
+	assert.True(t, s.bulkLoading.Load())
+	b.end(s)
+	b.end(s)
+	assert.False(t, s.bulkLoading.Load())
+}
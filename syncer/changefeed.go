@@ -0,0 +1,82 @@
+package syncer
+
+import (
+	"sync"
+	"time"
+
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/syncer/changefeed"
+)
+
+// changeSet collects the local changes found while writing a snapshot, for
+// the change feed. Entries written in a transaction after since are changes.
+// Entries merged from remote snapshots while local changes were waiting for
+// a snapshot are included as well, because these are written the same way.
+// It is safe for concurrent use by the parallel DBI readers.
+type changeSet struct {
+	since  header.TxnID
+	max    int
+	values bool
+
+	mu        sync.Mutex
+	changes   []changefeed.Change
+	truncated int
+}
+
+// newChangeSet returns a changeSet for the next snapshot, or nil if the
+// change feed is not active.
+func (s *Syncer) newChangeSet() *changeSet {
+	active, c := changefeed.Active()
+	if !active {
+		return nil
+	}
+	return &changeSet{
+		since:  s.changesSince,
+		max:    c.MaxChanges,
+		values: c.IncludeValues,
+	}
+}
+
+// add adds an entry read from the LMDB if it is a change. The key and value
+// are copied, because they may point into the LMDB pages.
+func (cs *changeSet) add(dbiName string, key, val []byte, h header.Header) {
+	if h.TxnID <= cs.since {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.changes) >= cs.max {
+		cs.truncated++
+		return
+	}
+	c := changefeed.Change{
+		DBI:       dbiName,
+		Key:       append([]byte(nil), key...),
+		Op:        changefeed.OpPut,
+		Timestamp: time.Unix(0, int64(h.Timestamp)).UTC(),
+	}
+	if h.Flags.IsDeleted() {
+		c.Op = changefeed.OpDelete
+	} else if cs.values {
+		c.Value = append([]byte(nil), val...)
+	}
+	cs.changes = append(cs.changes, c)
+}
+
+// publishChanges publishes the changes included in the stored snapshot
+func (s *Syncer) publishChanges(cs *changeSet, snapshotName string) {
+	if cs == nil {
+		return
+	}
+	if cs.truncated > 0 {
+		metricChangeFeedTruncated.WithLabelValues(s.name).Add(float64(cs.truncated))
+		s.l.WithField("truncated", cs.truncated).WithField("max_changes", cs.max).
+			Warn("Too many changes for the change feed, not all were published")
+	}
+	for i := range cs.changes {
+		cs.changes[i].LMDB = s.name
+		cs.changes[i].Instance = s.instanceID()
+		cs.changes[i].Snapshot = snapshotName
+	}
+	changefeed.Publish(cs.changes)
+}
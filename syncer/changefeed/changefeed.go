@@ -0,0 +1,254 @@
+// Package changefeed publishes the changes made to the local LMDBs to message
+// systems, so that other systems can consume a real-time feed of the data
+// changes, for example for provisioning or auditing.
+//
+// The changes are found while writing a snapshot: every entry written to the
+// LMDB since the previous snapshot is a change. They are published in the
+// background after the snapshot was stored, so a slow or unavailable message
+// system never blocks the sync. Batches that cannot be queued are dropped.
+package changefeed
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxChanges is the default maximum number of changes published
+	// for a single snapshot
+	DefaultMaxChanges = 100000
+
+	// DefaultQueueSize is the default number of batches queued per
+	// destination
+	DefaultQueueSize = 16
+
+	// RetryInterval is the time between attempts to publish a batch
+	RetryInterval = 5 * time.Second
+)
+
+// Config configures the change feed
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+
+	// IncludeValues adds the new values of changed entries to the events.
+	// By default, only the keys are published.
+	IncludeValues bool `yaml:"include_values"`
+
+	// MaxChanges is the maximum number of changes published for a single
+	// snapshot (default: 100000). Any further changes, like those of a bulk
+	// import, are not published, which is counted in a metric.
+	MaxChanges int `yaml:"max_changes"`
+
+	// QueueSize is the number of batches of changes queued per destination
+	// while it is slow or unavailable (default: 16).
+	QueueSize int `yaml:"queue_size"`
+
+	NATS  NATSConfig  `yaml:"nats"`
+	Kafka KafkaConfig `yaml:"kafka"`
+}
+
+// Check validates the configuration
+func (c Config) Check() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.NATS.URL == "" && len(c.Kafka.Brokers) == 0 {
+		return fmt.Errorf("nats.url or kafka.brokers is required when enabled")
+	}
+	if c.MaxChanges < 0 || c.QueueSize < 0 {
+		return fmt.Errorf("max_changes and queue_size must not be negative")
+	}
+	if c.NATS.URL != "" {
+		if err := c.NATS.Check(); err != nil {
+			return fmt.Errorf("nats.%w", err)
+		}
+	}
+	if len(c.Kafka.Brokers) > 0 {
+		if err := c.Kafka.Check(); err != nil {
+			return fmt.Errorf("kafka.%w", err)
+		}
+	}
+	return nil
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxChanges == 0 {
+		c.MaxChanges = DefaultMaxChanges
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = DefaultQueueSize
+	}
+	return c
+}
+
+// Op is the operation of a change
+type Op string
+
+const (
+	OpPut    Op = "put"
+	OpDelete Op = "delete"
+)
+
+// Change is a single changed LMDB entry. It is published as JSON, with the
+// key and value as base64.
+type Change struct {
+	LMDB      string    `json:"lmdb"`
+	DBI       string    `json:"dbi"`
+	Key       []byte    `json:"key"`
+	Value     []byte    `json:"value,omitempty"`
+	Op        Op        `json:"op"`
+	Timestamp time.Time `json:"timestamp"`
+	Instance  string    `json:"instance"`
+	// Snapshot is the name of the snapshot that includes the change
+	Snapshot string `json:"snapshot"`
+}
+
+// ID returns a unique ID for the change, which message systems can use to
+// detect duplicates when a batch is published again.
+func (c Change) ID() string {
+	h := sha256.New()
+	for _, s := range []string{c.Instance, c.LMDB, c.DBI} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(c.Key)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(c.Timestamp.UnixNano()))
+	h.Write(ts[:])
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// publisher publishes batches of changes to a single destination
+type publisher interface {
+	publish(ctx context.Context, changes []Change) error
+	close()
+}
+
+// destination is a running publisher with its queue
+type destination struct {
+	name  string
+	p     publisher
+	queue chan []Change
+}
+
+var (
+	mu           sync.Mutex
+	destinations []*destination
+	conf         Config
+)
+
+// Active returns true if changes are published, and the options to collect
+// them with.
+func Active() (bool, Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(destinations) > 0, conf
+}
+
+// Publish queues the changes of a snapshot for publishing. This never blocks.
+func Publish(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, d := range destinations {
+		select {
+		case d.queue <- changes:
+		default:
+			metricDropped.WithLabelValues(d.name).Add(float64(len(changes)))
+			logrus.WithField("component", "changefeed").WithField("destination", d.name).
+				WithField("changes", len(changes)).Warn("Change feed queue full, changes dropped")
+		}
+	}
+}
+
+// Start connects to the configured destinations and publishes the changes
+// passed to Publish until the context is cancelled.
+func Start(ctx context.Context, c Config) error {
+	if !c.Enabled {
+		return nil
+	}
+	c = c.withDefaults()
+	var ds []*destination
+	if c.NATS.URL != "" {
+		p, err := newNATSPublisher(ctx, c.NATS)
+		if err != nil {
+			return fmt.Errorf("change feed: nats: %w", err)
+		}
+		ds = append(ds, &destination{name: "nats", p: p})
+	}
+	if len(c.Kafka.Brokers) > 0 {
+		p, err := newKafkaPublisher(ctx, c.Kafka)
+		if err != nil {
+			for _, d := range ds {
+				d.p.close()
+			}
+			return fmt.Errorf("change feed: kafka: %w", err)
+		}
+		ds = append(ds, &destination{name: "kafka", p: p})
+	}
+	start(ctx, c, ds...)
+	return nil
+}
+
+// start runs the destinations
+func start(ctx context.Context, c Config, ds ...*destination) {
+	mu.Lock()
+	defer mu.Unlock()
+	conf = c
+	for _, d := range ds {
+		d.queue = make(chan []Change, c.QueueSize)
+		destinations = append(destinations, d)
+		go d.run(ctx)
+	}
+}
+
+// run publishes the queued batches, retrying every batch until it succeeds
+func (d *destination) run(ctx context.Context) {
+	l := logrus.WithField("component", "changefeed").WithField("destination", d.name)
+	l.Info("Change feed enabled")
+	defer func() {
+		mu.Lock()
+		for i, other := range destinations {
+			if other == d {
+				destinations = append(destinations[:i], destinations[i+1:]...)
+				break
+			}
+		}
+		mu.Unlock()
+		d.p.close()
+	}()
+	for {
+		var changes []Change
+		select {
+		case <-ctx.Done():
+			return
+		case changes = <-d.queue:
+		}
+		for {
+			err := d.p.publish(ctx, changes)
+			if err == nil {
+				metricPublished.WithLabelValues(d.name).Add(float64(len(changes)))
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			metricErrors.WithLabelValues(d.name).Inc()
+			l.WithError(err).Warn("Publishing changes failed, retrying")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(RetryInterval):
+			}
+		}
+	}
+}
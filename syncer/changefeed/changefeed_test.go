@@ -0,0 +1,112 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChange_ID(t *testing.T) {
+	ts := time.Unix(1700000000, 123)
+	c := Change{LMDB: "main", DBI: "records", Key: []byte("foo"), Op: OpPut,
+		Timestamp: ts, Instance: "a", Snapshot: "x"}
+	id := c.ID()
+	assert.Len(t, id, 32)
+
+	// Independent of the value and snapshot, so republished changes match
+	c2 := c
+	c2.Value = []byte("bar")
+	c2.Snapshot = "y"
+	assert.Equal(t, id, c2.ID())
+
+	c2 = c
+	c2.Timestamp = ts.Add(1)
+	assert.NotEqual(t, id, c2.ID())
+	c2 = c
+	c2.Instance = "b"
+	assert.NotEqual(t, id, c2.ID())
+
+	data, err := json.Marshal(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"key":"Zm9v"`)
+	assert.NotContains(t, string(data), `"value"`)
+}
+
+func TestNATSConfig_subject(t *testing.T) {
+	ch := Change{LMDB: "main", DBI: "records.v1 *"}
+	assert.Equal(t, "lightningstream.changes.main.records_v1__", NATSConfig{}.subject(ch))
+	assert.Equal(t, "dns.main", NATSConfig{Subject: "dns.{lmdb}"}.subject(ch))
+}
+
+func TestConfig_Check(t *testing.T) {
+	assert.NoError(t, Config{}.Check())
+	assert.Error(t, Config{Enabled: true}.Check())
+	assert.NoError(t, Config{Enabled: true, NATS: NATSConfig{NATSConnection: NATSConnection{URL: "nats://localhost"}}}.Check())
+	assert.Error(t, Config{Enabled: true, NATS: NATSConfig{NATSConnection: NATSConnection{URL: "nats://localhost"}, Subject: "a.>"}}.Check())
+	assert.Error(t, Config{Enabled: true, NATS: NATSConfig{NATSConnection: NATSConnection{URL: "nats://localhost", Token: "t", User: "u"}}}.Check())
+	assert.Error(t, Config{Enabled: true, MaxChanges: -1, NATS: NATSConfig{NATSConnection: NATSConnection{URL: "nats://localhost"}}}.Check())
+}
+
+type fakePublisher struct {
+	mu      sync.Mutex
+	fail    int
+	batches [][]Change
+	closed  bool
+}
+
+func (p *fakePublisher) publish(ctx context.Context, changes []Change) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail > 0 {
+		p.fail--
+		return fmt.Errorf("unavailable")
+	}
+	p.batches = append(p.batches, changes)
+	return nil
+}
+
+func (p *fakePublisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
+
+func TestPublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Not active yet
+	active, _ := Active()
+	assert.False(t, active)
+	Publish([]Change{{Key: []byte("ignored")}})
+
+	p := &fakePublisher{}
+	start(ctx, Config{Enabled: true, QueueSize: 1}.withDefaults(), &destination{name: "fake", p: p})
+	active, c := Active()
+	assert.True(t, active)
+	assert.Equal(t, DefaultMaxChanges, c.MaxChanges)
+
+	Publish([]Change{{Key: []byte("foo")}})
+	Publish(nil)
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.batches) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []byte("foo"), p.batches[0][0].Key)
+
+	// Stopped with the context
+	cancel()
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.closed
+	}, time.Second, 5*time.Millisecond)
+	active, _ = Active()
+	assert.False(t, active)
+}
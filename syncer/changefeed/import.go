@@ -0,0 +1,277 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ImportPath is the path of the import endpoint on the HTTP server
+	ImportPath = "/changes"
+
+	// DefaultImportBatchSize is the default maximum number of changes applied
+	// in a single LMDB transaction
+	DefaultImportBatchSize = 100
+
+	// DefaultImportGroup is the default NATS durable consumer name and Kafka
+	// consumer group
+	DefaultImportGroup = "lightningstream"
+)
+
+// ErrInvalidChange is returned for changes that can never be applied. These
+// are rejected instead of retried.
+var ErrInvalidChange = errors.New("invalid change")
+
+// errNoImporter is returned when the LMDB is not syncing at the moment, for
+// example while it is being reopened after a compaction
+var errNoImporter = errors.New("LMDB is not available")
+
+// ImportConfig configures the import of changes made by external systems
+// into the LMDBs. The changes use the same format as the change feed. They
+// are applied to the local LMDB like a local write, and are then replicated
+// to the other instances through snapshots.
+//
+// The NATS consumer and Kafka consumer group are shared by all instances by
+// default, so that every change is applied by a single instance.
+type ImportConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// HTTP accepts a JSON array of changes as a POST on /changes of the HTTP
+	// server. The changes are applied before the response is sent.
+	HTTP bool `yaml:"http"`
+
+	// HTTPToken is the bearer token that the requests to /changes must have.
+	// Strongly recommended when http is enabled.
+	HTTPToken string `yaml:"http_token"`
+
+	// BatchSize is the maximum number of changes fetched from NATS and
+	// applied in a single LMDB transaction (default: 100)
+	BatchSize int `yaml:"batch_size"`
+
+	NATS  NATSImportConfig  `yaml:"nats"`
+	Kafka KafkaImportConfig `yaml:"kafka"`
+}
+
+// Check validates the configuration
+func (c ImportConfig) Check() error {
+	if !c.Enabled {
+		return nil
+	}
+	if !c.HTTP && c.NATS.URL == "" && len(c.Kafka.Brokers) == 0 {
+		return fmt.Errorf("one of http, nats.url or kafka.brokers is required when enabled")
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch_size: must not be negative")
+	}
+	if c.NATS.URL != "" {
+		if err := c.NATS.Check(); err != nil {
+			return fmt.Errorf("nats.%w", err)
+		}
+	}
+	if len(c.Kafka.Brokers) > 0 {
+		if err := c.Kafka.Check(); err != nil {
+			return fmt.Errorf("kafka.%w", err)
+		}
+	}
+	return nil
+}
+
+func (c ImportConfig) withDefaults() ImportConfig {
+	if c.BatchSize == 0 {
+		c.BatchSize = DefaultImportBatchSize
+	}
+	return c
+}
+
+// Importer applies changes to an LMDB and returns the number of changes
+// applied. Changes that are older than the current entry are not applied.
+// It returns an error that wraps ErrInvalidChange if a change can never be
+// applied.
+type Importer func(ctx context.Context, changes []Change) (applied int, err error)
+
+var (
+	importMu    sync.Mutex
+	importers   = make(map[string]Importer) // by LMDB name
+	importLMDBs map[string]bool             // configured LMDB names
+)
+
+// RegisterImporter registers the Importer of an LMDB, until the returned
+// function is called.
+func RegisterImporter(lmdbName string, imp Importer) (unregister func()) {
+	importMu.Lock()
+	defer importMu.Unlock()
+	importers[lmdbName] = imp
+	return func() {
+		importMu.Lock()
+		defer importMu.Unlock()
+		delete(importers, lmdbName)
+	}
+}
+
+// Import applies the changes with the registered Importers. Changes for
+// different LMDBs are applied in separate transactions.
+func Import(ctx context.Context, source string, changes []Change) (applied int, err error) {
+	applied, err = doImport(ctx, changes)
+	countImport(source, len(changes), applied, err)
+	return applied, err
+}
+
+// countImport updates the metrics for an import
+func countImport(source string, received, applied int, err error) {
+	metricImportReceived.WithLabelValues(source).Add(float64(received))
+	metricImportApplied.WithLabelValues(source).Add(float64(applied))
+	if err != nil {
+		if errors.Is(err, ErrInvalidChange) {
+			metricImportRejected.WithLabelValues(source).Inc()
+		} else {
+			metricImportErrors.WithLabelValues(source).Inc()
+		}
+	}
+}
+
+func doImport(ctx context.Context, changes []Change) (applied int, err error) {
+	var order []string
+	byLMDB := make(map[string][]Change)
+	for _, ch := range changes {
+		if err := ch.check(); err != nil {
+			return 0, err
+		}
+		if _, exists := byLMDB[ch.LMDB]; !exists {
+			order = append(order, ch.LMDB)
+		}
+		byLMDB[ch.LMDB] = append(byLMDB[ch.LMDB], ch)
+	}
+
+	importMu.Lock()
+	imps := make([]Importer, len(order))
+	for i, name := range order {
+		if importLMDBs != nil && !importLMDBs[name] {
+			importMu.Unlock()
+			return 0, fmt.Errorf("%w: unknown lmdb %q", ErrInvalidChange, name)
+		}
+		imps[i] = importers[name]
+	}
+	importMu.Unlock()
+
+	for i, name := range order {
+		imp := imps[i]
+		if imp == nil {
+			return applied, fmt.Errorf("lmdb %s: %w", name, errNoImporter)
+		}
+		n, err := imp(ctx, byLMDB[name])
+		applied += n
+		if err != nil {
+			return applied, fmt.Errorf("lmdb %s: %w", name, err)
+		}
+	}
+	return applied, nil
+}
+
+// check validates the fields of an imported change
+func (c Change) check() error {
+	switch {
+	case c.LMDB == "":
+		return fmt.Errorf("%w: no lmdb", ErrInvalidChange)
+	case c.DBI == "":
+		return fmt.Errorf("%w: no dbi", ErrInvalidChange)
+	case len(c.Key) == 0:
+		return fmt.Errorf("%w: no key", ErrInvalidChange)
+	case c.Op != OpPut && c.Op != OpDelete:
+		return fmt.Errorf("%w: unknown op %q", ErrInvalidChange, c.Op)
+	}
+	return nil
+}
+
+// DecodeChange decodes a change message, which is a JSON object, optionally
+// in the wire format of a schema registry
+func DecodeChange(data []byte) (Change, error) {
+	if len(data) > 5 && data[0] == 0 {
+		data = data[5:] // skip the magic byte and schema ID
+	}
+	var c Change
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidChange, err)
+	}
+	return c, c.check()
+}
+
+// consumer receives changes from a message system and imports them
+type consumer interface {
+	// run imports changes until the context is cancelled or the connection
+	// fails
+	run(ctx context.Context) error
+	close()
+}
+
+// StartImport starts the configured consumers. The lmdbNames are the
+// configured LMDBs, changes for other LMDBs are rejected.
+func StartImport(ctx context.Context, c ImportConfig, lmdbNames []string) error {
+	if !c.Enabled {
+		return nil
+	}
+	c = c.withDefaults()
+	importMu.Lock()
+	importLMDBs = make(map[string]bool)
+	for _, name := range lmdbNames {
+		importLMDBs[name] = true
+	}
+	importMu.Unlock()
+
+	var consumers []consumer
+	var names []string
+	closeAll := func() {
+		for _, cons := range consumers {
+			cons.close()
+		}
+	}
+	if c.NATS.URL != "" {
+		cons, err := newNATSConsumer(ctx, c.NATS, c.BatchSize)
+		if err != nil {
+			return fmt.Errorf("change import: nats: %w", err)
+		}
+		consumers = append(consumers, cons)
+		names = append(names, "nats")
+	}
+	if len(c.Kafka.Brokers) > 0 {
+		cons, err := newKafkaConsumer(ctx, c.Kafka)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("change import: kafka: %w", err)
+		}
+		consumers = append(consumers, cons)
+		names = append(names, "kafka")
+	}
+	for i, cons := range consumers {
+		go runConsumer(ctx, names[i], cons)
+	}
+	if c.HTTP {
+		logrus.WithField("component", "changeimport").Info("Change import endpoint enabled")
+	}
+	return nil
+}
+
+// runConsumer runs a consumer until the context is cancelled
+func runConsumer(ctx context.Context, source string, cons consumer) {
+	l := logrus.WithField("component", "changeimport").WithField("source", source)
+	l.Info("Change import enabled")
+	defer cons.close()
+	for {
+		err := cons.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		metricImportErrors.WithLabelValues(source).Inc()
+		l.WithError(err).Warn("Change import failed, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(RetryInterval):
+		}
+	}
+}
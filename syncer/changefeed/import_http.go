@@ -0,0 +1,67 @@
+package changefeed
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxImportBodySize is the maximum size of a request to the import endpoint
+const maxImportBodySize = 16 << 20
+
+// ImportHandler returns the handler for the import endpoint. If token is not
+// empty, requests must have it as a bearer token. The response is a JSON
+// object with the number of changes received and applied. Invalid changes
+// return a 400 status. Other errors return a 503 status, and the client should
+// retry the request, which is safe because changes that were already applied
+// are skipped.
+func ImportHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare(
+				[]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxImportBodySize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxImportBodySize {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		var changes []Change
+		if err := json.Unmarshal(body, &changes); err != nil {
+			http.Error(w, fmt.Sprintf("invalid changes: %v", err), http.StatusBadRequest)
+			return
+		}
+		applied, err := Import(r.Context(), "http", changes)
+		if err != nil {
+			status := http.StatusServiceUnavailable
+			if errors.Is(err, ErrInvalidChange) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Received int `json:"received"`
+			Applied  int `json:"applied"`
+		}{len(changes), applied})
+	})
+}
@@ -0,0 +1,109 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// KafkaImportConfig configures the import from Kafka topics with a consumer
+// group. The message values are changes as JSON, optionally in the wire
+// format of a schema registry.
+type KafkaImportConfig struct {
+	KafkaConnection `yaml:",inline"`
+
+	// Topics to import changes from
+	Topics []string `yaml:"topics"`
+
+	// GroupID is the consumer group (default: "lightningstream")
+	GroupID string `yaml:"group_id"`
+}
+
+// Check validates the configuration
+func (c KafkaImportConfig) Check() error {
+	if err := c.KafkaConnection.Check(); err != nil {
+		return err
+	}
+	if len(c.Topics) == 0 {
+		return fmt.Errorf("topics: at least one topic is required")
+	}
+	return nil
+}
+
+type kafkaConsumer struct {
+	c KafkaImportConfig
+	r *kafka.Reader
+	l logrus.FieldLogger
+}
+
+func newKafkaConsumer(ctx context.Context, c KafkaImportConfig) (*kafkaConsumer, error) {
+	if c.GroupID == "" {
+		c.GroupID = DefaultImportGroup
+	}
+	tlsConfig, mechanism, err := c.security(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     c.Brokers,
+		GroupID:     c.GroupID,
+		GroupTopics: c.Topics,
+		Dialer: &kafka.Dialer{
+			ClientID:      "lightningstream",
+			Timeout:       10 * time.Second,
+			DualStack:     true,
+			TLS:           tlsConfig,
+			SASLMechanism: mechanism,
+		},
+	})
+	return &kafkaConsumer{
+		c: c,
+		r: r,
+		l: logrus.WithField("component", "changeimport").WithField("source", "kafka"),
+	}, nil
+}
+
+// run imports the messages one by one, and commits them once applied, so
+// that the changes to a key are applied in order. Invalid changes are
+// committed without applying them, and failed changes are retried.
+func (c *kafkaConsumer) run(ctx context.Context) error {
+	for {
+		m, err := c.r.FetchMessage(ctx)
+		if err != nil {
+			return err
+		}
+		for {
+			ch, err := DecodeChange(m.Value)
+			if err == nil {
+				_, err = Import(ctx, "kafka", []Change{ch})
+			} else {
+				countImport("kafka", 1, 0, err)
+			}
+			if err == nil {
+				break
+			}
+			if errors.Is(err, ErrInvalidChange) {
+				c.l.WithError(err).WithField("topic", m.Topic).WithField("offset", m.Offset).
+					Warn("Rejected change")
+				break
+			}
+			c.l.WithError(err).Warn("Importing change failed, retrying")
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(RetryInterval):
+			}
+		}
+		if err := c.r.CommitMessages(ctx, m); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *kafkaConsumer) close() {
+	_ = c.r.Close()
+}
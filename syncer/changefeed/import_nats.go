@@ -0,0 +1,173 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultNATSImportSubject is the default subject to import changes from
+	DefaultNATSImportSubject = "lightningstream.import.>"
+
+	// natsFetchWait is the maximum time to wait for changes in a fetch
+	natsFetchWait = 5 * time.Second
+)
+
+// NATSImportConfig configures the import from a NATS JetStream stream with a
+// durable pull consumer
+type NATSImportConfig struct {
+	NATSConnection `yaml:",inline"`
+
+	// Stream is the name of the stream. By default, it is looked up by the
+	// subject.
+	Stream string `yaml:"stream"`
+
+	// Subject is the subject filter of the consumer, which may contain
+	// wildcards (default: "lightningstream.import.>")
+	Subject string `yaml:"subject"`
+
+	// Durable is the name of the durable consumer (default: "lightningstream")
+	Durable string `yaml:"durable"`
+}
+
+// Check validates the configuration
+func (c NATSImportConfig) Check() error {
+	if err := c.NATSConnection.Check(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(c.Subject, " \t\r\n") {
+		return fmt.Errorf("subject: must not contain whitespace")
+	}
+	if strings.ContainsAny(c.Durable, " \t\r\n.*>") {
+		return fmt.Errorf("durable: must not contain whitespace, '.' or wildcards")
+	}
+	return nil
+}
+
+type natsConsumer struct {
+	c         NATSImportConfig
+	batchSize int
+	nc        *nats.Conn
+	js        nats.JetStreamContext
+	l         logrus.FieldLogger
+}
+
+func newNATSConsumer(ctx context.Context, c NATSImportConfig, batchSize int) (*natsConsumer, error) {
+	if c.Subject == "" {
+		c.Subject = DefaultNATSImportSubject
+	}
+	if c.Durable == "" {
+		c.Durable = DefaultImportGroup
+	}
+	nc, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &natsConsumer{
+		c:         c,
+		batchSize: batchSize,
+		nc:        nc,
+		js:        js,
+		l:         logrus.WithField("component", "changeimport").WithField("source", "nats"),
+	}, nil
+}
+
+// run fetches batches of changes and acknowledges them once applied. Invalid
+// changes are terminated, and batches that fail are redelivered after the
+// RetryInterval.
+func (c *natsConsumer) run(ctx context.Context) error {
+	var opts []nats.SubOpt
+	if c.c.Stream != "" {
+		opts = append(opts, nats.BindStream(c.c.Stream))
+	}
+	opts = append(opts, nats.AckExplicit())
+	sub, err := c.js.PullSubscribe(c.c.Subject, c.c.Durable, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sub.Unsubscribe() // keeps the durable consumer
+	}()
+
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, natsFetchWait)
+		msgs, err := sub.Fetch(c.batchSize, nats.Context(fetchCtx))
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+			continue // no changes
+		}
+		if err != nil {
+			return err
+		}
+		c.importBatch(ctx, msgs)
+	}
+}
+
+func (c *natsConsumer) importBatch(ctx context.Context, msgs []*nats.Msg) {
+	changes := make([]Change, 0, len(msgs))
+	valid := make([]*nats.Msg, 0, len(msgs))
+	for _, m := range msgs {
+		ch, err := DecodeChange(m.Data)
+		if err != nil {
+			countImport("nats", 1, 0, err)
+			c.l.WithError(err).WithField("subject", m.Subject).Warn("Rejected change")
+			_ = m.Term()
+			continue
+		}
+		changes = append(changes, ch)
+		valid = append(valid, m)
+	}
+	if len(changes) == 0 {
+		return
+	}
+	applied, err := doImport(ctx, changes)
+	if errors.Is(err, ErrInvalidChange) && len(changes) > 1 {
+		// Import them one by one to only reject the invalid ones. Changes
+		// that were applied already are skipped.
+		for i := range changes {
+			_, err := Import(ctx, "nats", changes[i:i+1])
+			c.ack(valid[i:i+1], err)
+		}
+		return
+	}
+	countImport("nats", len(changes), applied, err)
+	c.ack(valid, err)
+}
+
+// ack acknowledges the messages according to the result of their import
+func (c *natsConsumer) ack(msgs []*nats.Msg, err error) {
+	switch {
+	case err == nil:
+		for _, m := range msgs {
+			_ = m.Ack()
+		}
+	case errors.Is(err, ErrInvalidChange):
+		c.l.WithError(err).Warn("Rejected change")
+		for _, m := range msgs {
+			_ = m.Term()
+		}
+	default:
+		c.l.WithError(err).Warn("Importing changes failed, retrying")
+		for _, m := range msgs {
+			_ = m.NakWithDelay(RetryInterval)
+		}
+	}
+}
+
+func (c *natsConsumer) close() {
+	c.nc.Close()
+}
@@ -0,0 +1,131 @@
+package changefeed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeChange(t *testing.T) {
+	data := `{"lmdb":"main","dbi":"records","key":"Zm9v","value":"YmFy","op":"put","timestamp":"2023-01-02T03:04:05Z"}`
+	c, err := DecodeChange([]byte(data))
+	require.NoError(t, err)
+	assert.Equal(t, "main", c.LMDB)
+	assert.Equal(t, []byte("foo"), c.Key)
+	assert.Equal(t, []byte("bar"), c.Value)
+	assert.Equal(t, OpPut, c.Op)
+	assert.Equal(t, 2023, c.Timestamp.Year())
+
+	// Schema registry wire format
+	c2, err := DecodeChange(append([]byte{0, 0, 0, 0, 42}, data...))
+	require.NoError(t, err)
+	assert.Equal(t, c, c2)
+
+	for _, invalid := range []string{
+		`{`,
+		`{"lmdb":"main","dbi":"records","op":"put"}`,
+		`{"lmdb":"main","dbi":"records","key":"Zm9v","op":"update"}`,
+		`{"dbi":"records","key":"Zm9v","op":"delete"}`,
+	} {
+		_, err := DecodeChange([]byte(invalid))
+		assert.ErrorIs(t, err, ErrInvalidChange, invalid)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	var got []Change
+	defer RegisterImporter("main", func(ctx context.Context, changes []Change) (int, error) {
+		for _, c := range changes {
+			if c.DBI == "fail" {
+				return 0, fmt.Errorf("failed")
+			}
+		}
+		got = append(got, changes...)
+		return len(changes), nil
+	})()
+	put := func(lmdb, dbi string) Change {
+		return Change{LMDB: lmdb, DBI: dbi, Key: []byte("foo"), Op: OpPut}
+	}
+
+	applied, err := Import(ctx, "test", []Change{put("main", "a"), put("main", "b")})
+	require.NoError(t, err)
+	assert.Equal(t, 2, applied)
+	assert.Len(t, got, 2)
+
+	// Not registered, for example while reopening
+	_, err = Import(ctx, "test", []Change{put("other", "a")})
+	assert.ErrorIs(t, err, errNoImporter)
+
+	_, err = Import(ctx, "test", []Change{put("main", "fail")})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrInvalidChange)
+
+	// Unknown once started
+	importMu.Lock()
+	importLMDBs = map[string]bool{"main": true}
+	importMu.Unlock()
+	defer func() {
+		importMu.Lock()
+		importLMDBs = nil
+		importMu.Unlock()
+	}()
+	_, err = Import(ctx, "test", []Change{put("main", "a"), put("other", "a")})
+	assert.ErrorIs(t, err, ErrInvalidChange)
+	assert.Len(t, got, 2)
+}
+
+func TestImportHandler(t *testing.T) {
+	var got []Change
+	defer RegisterImporter("main", func(ctx context.Context, changes []Change) (int, error) {
+		got = append(got, changes...)
+		return 1, nil
+	})()
+	srv := httptest.NewServer(ImportHandler("secret"))
+	defer srv.Close()
+
+	post := func(token, data string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+ImportPath, strings.NewReader(data))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	changes := `[
+		{"lmdb":"main","dbi":"records","key":"Zm9v","op":"put"},
+		{"lmdb":"main","dbi":"records","key":"YmFy","op":"delete"}
+	]`
+	status, _ := post("", changes)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = post("wrong", changes)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Empty(t, got)
+
+	status, body := post("secret", changes)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"received":2,"applied":1}`, body)
+	assert.Len(t, got, 2)
+
+	status, _ = post("secret", `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = post("secret", `[{"lmdb":"main","dbi":"records","op":"put"}]`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = post("secret", `[{"lmdb":"other","dbi":"records","key":"Zm9v","op":"put"}]`)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
@@ -0,0 +1,244 @@
+package changefeed
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/go-tlsconfig"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	// DefaultKafkaTopic is the default topic template
+	DefaultKafkaTopic = "lightningstream.changes.{lmdb}.{dbi}"
+
+	// DefaultKafkaTimeout is the default time to wait for the acknowledgements
+	// of a batch
+	DefaultKafkaTimeout = 10 * time.Second
+)
+
+// KafkaConnection configures the connection to the Kafka brokers
+type KafkaConnection struct {
+	// Brokers are the addresses of the bootstrap brokers
+	Brokers []string `yaml:"brokers"`
+
+	// SASL authentication
+	SASL KafkaSASL `yaml:"sasl"`
+
+	// TLS enables TLS to the brokers when any option is set.
+	// See https://github.com/PowerDNS/go-tlsconfig for the available options
+	TLS tlsconfig.Config `yaml:"tls"`
+}
+
+// KafkaSASL configures SASL authentication
+type KafkaSASL struct {
+	// Mechanism is one of "plain", "scram-sha-256" or "scram-sha-512". SASL
+	// is disabled if empty.
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+// Check validates the configuration
+func (c KafkaConnection) Check() error {
+	for _, b := range c.Brokers {
+		if b == "" {
+			return fmt.Errorf("brokers: empty address")
+		}
+	}
+	if _, err := c.SASL.mechanism(); err != nil {
+		return fmt.Errorf("sasl.%w", err)
+	}
+	return nil
+}
+
+// security returns the TLS configuration and SASL mechanism, which are nil
+// if not enabled
+func (c KafkaConnection) security(ctx context.Context) (*tls.Config, sasl.Mechanism, error) {
+	mechanism, err := c.SASL.mechanism()
+	if err != nil {
+		return nil, nil, fmt.Errorf("sasl: %w", err)
+	}
+	if !c.TLS.HasCA() && !c.TLS.HasCertWithKey() && !c.TLS.InsecureSkipVerify {
+		return nil, mechanism, nil
+	}
+	mgr, err := tlsconfig.NewManager(ctx, c.TLS, tlsconfig.Options{
+		IsClient: true,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls: %w", err)
+	}
+	tlsConfig, err := mgr.TLSConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls: %w", err)
+	}
+	return tlsConfig, mechanism, nil
+}
+
+// KafkaConfig configures publishing to Kafka. Every change is a message with
+// the LMDB key as the message key, so that all changes to a key end up in the
+// same partition in order, and compacted topics keep the latest change.
+type KafkaConfig struct {
+	KafkaConnection `yaml:",inline"`
+
+	// Topic is the topic to publish to, where "{lmdb}" and "{dbi}" are
+	// replaced by the LMDB and DBI name (default:
+	// "lightningstream.changes.{lmdb}.{dbi}"). Topics are not created.
+	Topic string `yaml:"topic"`
+
+	// SchemaRegistry enables the serialization of the values in the wire
+	// format of a Confluent compatible schema registry
+	SchemaRegistry SchemaRegistryConfig `yaml:"schema_registry"`
+
+	// Timeout is the time to wait for the acknowledgements of a batch
+	// (default: 10s)
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Check validates the configuration
+func (c KafkaConfig) Check() error {
+	if err := c.KafkaConnection.Check(); err != nil {
+		return err
+	}
+	if c.Topic != "" && strings.ContainsAny(strings.NewReplacer(
+		"{lmdb}", "", "{dbi}", "").Replace(c.Topic), kafkaInvalidChars) {
+		return fmt.Errorf("topic: must only contain letters, digits, '.', '_' and '-'")
+	}
+	if err := c.SchemaRegistry.Check(); err != nil {
+		return fmt.Errorf("schema_registry.%w", err)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout: must not be negative")
+	}
+	return nil
+}
+
+func (c KafkaSASL) mechanism() (sasl.Mechanism, error) {
+	switch c.Mechanism {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	default:
+		return nil, fmt.Errorf("mechanism: unsupported: %q", c.Mechanism)
+	}
+}
+
+// kafkaInvalidChars is a sample of the characters that cannot be used in
+// topic names, used to validate the configuration
+const kafkaInvalidChars = " \t\r\n/\\:*?\"<>|{}"
+
+// topic returns the topic for a change
+func (c KafkaConfig) topic(ch Change) string {
+	topic := c.Topic
+	if topic == "" {
+		topic = DefaultKafkaTopic
+	}
+	return strings.NewReplacer(
+		"{lmdb}", topicToken(ch.LMDB),
+		"{dbi}", topicToken(ch.DBI),
+	).Replace(topic)
+}
+
+// topicToken replaces the characters that cannot be used in a topic name
+// by '_'
+func topicToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+type kafkaPublisher struct {
+	c        KafkaConfig
+	w        *kafka.Writer
+	registry *schemaRegistry
+}
+
+func newKafkaPublisher(ctx context.Context, c KafkaConfig) (*kafkaPublisher, error) {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultKafkaTimeout
+	}
+	tlsConfig, mechanism, err := c.security(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p := &kafkaPublisher{
+		c: c,
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(c.Brokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+			WriteTimeout: c.Timeout,
+			Transport: &kafka.Transport{
+				ClientID: "lightningstream",
+				TLS:      tlsConfig,
+				SASL:     mechanism,
+			},
+		},
+	}
+	if c.SchemaRegistry.URL != "" {
+		p.registry = newSchemaRegistry(c.SchemaRegistry)
+	}
+	return p, nil
+}
+
+// messages returns the messages for a batch. The change ID is added as the
+// "id" header, so that consumers can detect a batch that was published again.
+func (p *kafkaPublisher) messages(ctx context.Context, changes []Change) ([]kafka.Message, error) {
+	msgs := make([]kafka.Message, 0, len(changes))
+	for _, ch := range changes {
+		topic := p.c.topic(ch)
+		value, err := json.Marshal(ch)
+		if err != nil {
+			return nil, err
+		}
+		if p.registry != nil {
+			value, err = p.registry.encode(ctx, topic, value)
+			if err != nil {
+				return nil, fmt.Errorf("schema registry: %w", err)
+			}
+		}
+		msgs = append(msgs, kafka.Message{
+			Topic: topic,
+			Key:   ch.Key,
+			Value: value,
+			Headers: []kafka.Header{
+				{Key: "id", Value: []byte(ch.ID())},
+			},
+			Time: ch.Timestamp,
+		})
+	}
+	return msgs, nil
+}
+
+// publish publishes a batch and waits for all acknowledgements
+func (p *kafkaPublisher) publish(ctx context.Context, changes []Change) error {
+	msgs, err := p.messages(ctx, changes)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.c.Timeout)
+	defer cancel()
+	return p.w.WriteMessages(ctx, msgs...)
+}
+
+func (p *kafkaPublisher) close() {
+	_ = p.w.Close()
+}
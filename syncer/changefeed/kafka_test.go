@@ -0,0 +1,95 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaConfig_Check(t *testing.T) {
+	brokers := []string{"localhost:9092"}
+	assert.NoError(t, KafkaConfig{KafkaConnection: KafkaConnection{Brokers: brokers}}.Check())
+	assert.NoError(t, KafkaConfig{KafkaConnection: KafkaConnection{Brokers: brokers}, Topic: "dns-{lmdb}.{dbi}"}.Check())
+	assert.Error(t, KafkaConfig{KafkaConnection: KafkaConnection{Brokers: brokers}, Topic: "dns/{lmdb}"}.Check())
+	assert.NoError(t, KafkaConfig{KafkaConnection: KafkaConnection{Brokers: brokers, SASL: KafkaSASL{
+		Mechanism: "scram-sha-512", Username: "u", Password: "p"}}}.Check())
+	assert.Error(t, KafkaConfig{KafkaConnection: KafkaConnection{Brokers: brokers, SASL: KafkaSASL{Mechanism: "gssapi"}}}.Check())
+	assert.Error(t, KafkaConfig{KafkaConnection: KafkaConnection{Brokers: brokers}, SchemaRegistry: SchemaRegistryConfig{
+		URL: "localhost:8081"}}.Check())
+	assert.NoError(t, Config{Enabled: true, Kafka: KafkaConfig{KafkaConnection: KafkaConnection{Brokers: brokers}}}.Check())
+}
+
+func TestKafkaConfig_topic(t *testing.T) {
+	ch := Change{LMDB: "main", DBI: "records/v1"}
+	assert.Equal(t, "lightningstream.changes.main.records_v1", KafkaConfig{}.topic(ch))
+	assert.Equal(t, "dns-main", KafkaConfig{Topic: "dns-{lmdb}"}.topic(ch))
+}
+
+func TestKafkaPublisher_messages(t *testing.T) {
+	ctx := context.Background()
+	ch := Change{LMDB: "main", DBI: "records", Key: []byte("foo"), Op: OpPut,
+		Timestamp: time.Unix(1700000000, 0), Instance: "a", Snapshot: "x"}
+	plain, err := json.Marshal(ch)
+	require.NoError(t, err)
+
+	p, err := newKafkaPublisher(ctx, KafkaConfig{KafkaConnection: KafkaConnection{Brokers: []string{"localhost:9092"}}})
+	require.NoError(t, err)
+	defer p.close()
+	msgs, err := p.messages(ctx, []Change{ch})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "lightningstream.changes.main.records", msgs[0].Topic)
+	assert.Equal(t, []byte("foo"), msgs[0].Key)
+	assert.Equal(t, plain, msgs[0].Value)
+	assert.Equal(t, "id", msgs[0].Headers[0].Key)
+	assert.Equal(t, ch.ID(), string(msgs[0].Headers[0].Value))
+
+	// With a schema registry that does not have the schema yet
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		var req map[string]string
+		assert.NoError(t, json.Unmarshal(body, &req))
+		assert.Equal(t, "JSON", req["schemaType"])
+		assert.Equal(t, changeSchema, req["schema"])
+		user, _, _ := r.BasicAuth()
+		assert.Equal(t, "u", user)
+		if r.URL.Path == "/subjects/lightningstream.changes.main.records-value" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40403}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":42}`))
+	}))
+	defer srv.Close()
+
+	p, err = newKafkaPublisher(ctx, KafkaConfig{
+		KafkaConnection: KafkaConnection{Brokers: []string{"localhost:9092"}},
+		SchemaRegistry:  SchemaRegistryConfig{URL: srv.URL, Username: "u", Password: "p"},
+	})
+	require.NoError(t, err)
+	defer p.close()
+	for i := 0; i < 2; i++ {
+		msgs, err = p.messages(ctx, []Change{ch})
+		require.NoError(t, err)
+		v := msgs[0].Value
+		require.Greater(t, len(v), 5)
+		assert.Equal(t, byte(0), v[0])
+		assert.Equal(t, uint32(42), binary.BigEndian.Uint32(v[1:5]))
+		assert.Equal(t, plain, v[5:])
+	}
+	// Looked up and registered once
+	assert.Equal(t, []string{
+		"/subjects/lightningstream.changes.main.records-value",
+		"/subjects/lightningstream.changes.main.records-value/versions",
+	}, requests)
+}
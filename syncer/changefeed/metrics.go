@@ -0,0 +1,66 @@
+package changefeed
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	metricPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_changefeed_changes_published_total",
+			Help: "Number of changes published, by destination",
+		},
+		[]string{"destination"},
+	)
+	metricDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_changefeed_changes_dropped_total",
+			Help: "Number of changes not published because the queue was full, by destination",
+		},
+		[]string{"destination"},
+	)
+	metricErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_changefeed_errors_total",
+			Help: "Number of failed attempts to publish a batch of changes, by destination",
+		},
+		[]string{"destination"},
+	)
+
+	metricImportReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_changeimport_changes_received_total",
+			Help: "Number of changes received for import, by source",
+		},
+		[]string{"source"},
+	)
+	metricImportApplied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_changeimport_changes_applied_total",
+			Help: "Number of imported changes applied, excluding those older than the current entry, by source",
+		},
+		[]string{"source"},
+	)
+	metricImportRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_changeimport_rejected_total",
+			Help: "Number of imports rejected because of invalid changes, by source",
+		},
+		[]string{"source"},
+	)
+	metricImportErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_changeimport_errors_total",
+			Help: "Number of failed imports that are retried, by source",
+		},
+		[]string{"source"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricPublished)
+	prometheus.MustRegister(metricDropped)
+	prometheus.MustRegister(metricErrors)
+	prometheus.MustRegister(metricImportReceived)
+	prometheus.MustRegister(metricImportApplied)
+	prometheus.MustRegister(metricImportRejected)
+	prometheus.MustRegister(metricImportErrors)
+}
@@ -0,0 +1,193 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/go-tlsconfig"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// DefaultNATSSubject is the default subject template
+	DefaultNATSSubject = "lightningstream.changes.{lmdb}.{dbi}"
+
+	// DefaultNATSTimeout is the default time to wait for the acknowledgements
+	// of a batch
+	DefaultNATSTimeout = 10 * time.Second
+)
+
+// NATSConnection configures the connection to a NATS server
+type NATSConnection struct {
+	// URL of the NATS server, or a comma separated list of servers
+	URL string `yaml:"url"`
+
+	// Authentication with a credentials file, a token, or a user and password
+	CredsFile string `yaml:"creds_file"`
+	Token     string `yaml:"token"`
+	User      string `yaml:"user"`
+	Password  string `yaml:"password"`
+
+	// TLS configures a private CA or client certificate. TLS is also used
+	// for tls:// URLs without any options.
+	// See https://github.com/PowerDNS/go-tlsconfig for the available options
+	TLS tlsconfig.Config `yaml:"tls"`
+}
+
+// Check validates the configuration
+func (c NATSConnection) Check() error {
+	if c.Token != "" && c.User != "" {
+		return fmt.Errorf("token and user cannot be used together")
+	}
+	return nil
+}
+
+// connect connects to the server, and keeps reconnecting when the
+// connection is lost
+func (c NATSConnection) connect(ctx context.Context) (*nats.Conn, error) {
+	opts := []nats.Option{
+		nats.Name("lightningstream"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+	}
+	switch {
+	case c.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(c.CredsFile))
+	case c.Token != "":
+		opts = append(opts, nats.Token(c.Token))
+	case c.User != "":
+		opts = append(opts, nats.UserInfo(c.User, c.Password))
+	}
+	if c.TLS.HasCA() || c.TLS.HasCertWithKey() || c.TLS.InsecureSkipVerify {
+		mgr, err := tlsconfig.NewManager(ctx, c.TLS, tlsconfig.Options{
+			IsClient: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		tlsConfig, err := mgr.TLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+	return nats.Connect(c.URL, opts...)
+}
+
+// NATSConfig configures publishing to a NATS JetStream stream. The stream
+// must exist and capture the subjects.
+type NATSConfig struct {
+	NATSConnection `yaml:",inline"`
+
+	// Subject is the subject to publish to, where "{lmdb}" and "{dbi}" are
+	// replaced by the LMDB and DBI name (default:
+	// "lightningstream.changes.{lmdb}.{dbi}").
+	Subject string `yaml:"subject"`
+
+	// Timeout is the time to wait for the acknowledgements of a batch
+	// (default: 10s)
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Check validates the configuration
+func (c NATSConfig) Check() error {
+	if err := c.NATSConnection.Check(); err != nil {
+		return err
+	}
+	if c.Subject != "" && strings.ContainsAny(c.Subject, " \t\r\n*>") {
+		return fmt.Errorf("subject: must not contain whitespace or wildcards")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout: must not be negative")
+	}
+	return nil
+}
+
+// subject returns the subject for a change
+func (c NATSConfig) subject(ch Change) string {
+	subject := c.Subject
+	if subject == "" {
+		subject = DefaultNATSSubject
+	}
+	return strings.NewReplacer(
+		"{lmdb}", subjectToken(ch.LMDB),
+		"{dbi}", subjectToken(ch.DBI),
+	).Replace(subject)
+}
+
+// subjectToken replaces the characters that cannot be used in a subject
+// token by '_'
+func subjectToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+type natsPublisher struct {
+	c  NATSConfig
+	nc *nats.Conn
+	js nats.JetStreamContext
+}
+
+func newNATSPublisher(ctx context.Context, c NATSConfig) (*natsPublisher, error) {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultNATSTimeout
+	}
+	nc, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &natsPublisher{c: c, nc: nc, js: js}, nil
+}
+
+// publish publishes a batch and waits for all acknowledgements. The message
+// IDs make JetStream drop the duplicates when a batch is published again.
+func (p *natsPublisher) publish(ctx context.Context, changes []Change) error {
+	futures := make([]nats.PubAckFuture, 0, len(changes))
+	for _, ch := range changes {
+		data, err := json.Marshal(ch)
+		if err != nil {
+			return err
+		}
+		m := nats.NewMsg(p.c.subject(ch))
+		m.Data = data
+		f, err := p.js.PublishMsgAsync(m, nats.MsgId(ch.ID()))
+		if err != nil {
+			return err
+		}
+		futures = append(futures, f)
+	}
+	t := time.NewTimer(p.c.Timeout)
+	defer t.Stop()
+	select {
+	case <-p.js.PublishAsyncComplete():
+	case <-t.C:
+		return fmt.Errorf("timeout waiting for acknowledgements")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, f := range futures {
+		select {
+		case err := <-f.Err():
+			return err
+		default:
+		}
+	}
+	return nil
+}
+
+func (p *natsPublisher) close() {
+	p.nc.Close()
+}
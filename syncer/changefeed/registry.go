@@ -0,0 +1,170 @@
+package changefeed
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSchemaRegistryTimeout is the default timeout for requests to the
+// schema registry
+const DefaultSchemaRegistryTimeout = 10 * time.Second
+
+// changeSchema is the JSON Schema of a Change
+const changeSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "LightningStreamChange",
+  "type": "object",
+  "properties": {
+    "lmdb": {"type": "string"},
+    "dbi": {"type": "string"},
+    "key": {"type": "string", "contentEncoding": "base64"},
+    "value": {"type": "string", "contentEncoding": "base64"},
+    "op": {"type": "string", "enum": ["put", "delete"]},
+    "timestamp": {"type": "string", "format": "date-time"},
+    "instance": {"type": "string"},
+    "snapshot": {"type": "string"}
+  },
+  "required": ["lmdb", "dbi", "key", "op", "timestamp", "instance", "snapshot"]
+}`
+
+// SchemaRegistryConfig configures a Confluent compatible schema registry.
+// The JSON Schema of the changes is registered for the "<topic>-value"
+// subjects, unless it already exists.
+type SchemaRegistryConfig struct {
+	// URL of the schema registry. Disabled if empty.
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Timeout for requests to the registry (default: 10s)
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Check validates the configuration
+func (c SchemaRegistryConfig) Check() error {
+	if c.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url: must be a http or https URL")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout: must not be negative")
+	}
+	return nil
+}
+
+// schemaRegistry serializes values in the schema registry wire format, which
+// is a zero byte, the schema ID as a 32 bit big endian integer, and the data.
+type schemaRegistry struct {
+	c      SchemaRegistryConfig
+	client *http.Client
+
+	mu  sync.Mutex
+	ids map[string]int // by subject
+}
+
+func newSchemaRegistry(c SchemaRegistryConfig) *schemaRegistry {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultSchemaRegistryTimeout
+	}
+	return &schemaRegistry{
+		c:      c,
+		client: &http.Client{Timeout: c.Timeout},
+		ids:    make(map[string]int),
+	}
+}
+
+// encode returns the data in the wire format for the subject of the topic
+func (r *schemaRegistry) encode(ctx context.Context, topic string, data []byte) ([]byte, error) {
+	id, err := r.schemaID(ctx, topic+"-value")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(out[1:], uint32(id))
+	return append(out, data...), nil
+}
+
+// schemaID returns the ID of the change schema for a subject. It looks up the
+// schema first, so that it also works when the registry does not allow
+// clients to register schemas, and registers it if it does not exist.
+func (r *schemaRegistry) schemaID(ctx context.Context, subject string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.ids[subject]; ok {
+		return id, nil
+	}
+	base := strings.TrimSuffix(r.c.URL, "/") + "/subjects/" + url.PathEscape(subject)
+	id, err := r.post(ctx, base)
+	if err == errSchemaNotFound {
+		id, err = r.post(ctx, base+"/versions")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("subject %s: %w", subject, err)
+	}
+	r.ids[subject] = id
+	return id, nil
+}
+
+var errSchemaNotFound = fmt.Errorf("schema not found")
+
+// post posts the change schema to a lookup or register endpoint
+func (r *schemaRegistry) post(ctx context.Context, u string) (int, error) {
+	body, err := json.Marshal(map[string]string{
+		"schemaType": "JSON",
+		"schema":     changeSchema,
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if r.c.Username != "" {
+		req.SetBasicAuth(r.c.Username, r.c.Password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errSchemaNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("unexpected status: %s: %s", resp.Status,
+			strings.TrimSpace(string(respBody)))
+	}
+	var res struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(respBody, &res); err != nil {
+		return 0, err
+	}
+	if res.ID <= 0 {
+		return 0, fmt.Errorf("no schema ID in response")
+	}
+	return res.ID, nil
+}
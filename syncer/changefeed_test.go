@@ -0,0 +1,57 @@
+package syncer
+
+import (
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/syncer/changefeed"
+)
+
+func TestChangeSet(t *testing.T) {
+	s, env := createInstance(t, "a", memory.New(), true)
+
+	setKey(t, env, "old", "o", true)
+	info, err := env.Info()
+	require.NoError(t, err)
+	setKey(t, env, "bar", "b", true)
+	setKey(t, env, "foo", "f", true)
+
+	read := func(cs *changeSet) {
+		err := env.View(func(txn *lmdb.Txn) error {
+			_, err := s.readDBI(txn, testDBIName, testDBIName, false, nil, cs, nil)
+			return err
+		})
+		require.NoError(t, err)
+	}
+
+	// Only entries written after since are changes
+	cs := &changeSet{since: header.TxnID(info.LastTxnID), max: 10, values: true}
+	read(cs)
+	require.Len(t, cs.changes, 2)
+	assert.Equal(t, testDBIName, cs.changes[0].DBI)
+	assert.Equal(t, []byte("bar"), cs.changes[0].Key)
+	assert.Equal(t, []byte("b"), cs.changes[0].Value)
+	assert.Equal(t, changefeed.OpPut, cs.changes[0].Op)
+	assert.False(t, cs.changes[0].Timestamp.IsZero())
+	assert.Equal(t, []byte("foo"), cs.changes[1].Key)
+
+	// Values are optional, and the number of changes is limited
+	cs = &changeSet{since: header.TxnID(info.LastTxnID), max: 1}
+	read(cs)
+	require.Len(t, cs.changes, 1)
+	assert.Nil(t, cs.changes[0].Value)
+	assert.Equal(t, 1, cs.truncated)
+
+	// Nothing changed since the last transaction
+	cs = &changeSet{since: header.TxnID(info.LastTxnID) + 2, max: 10}
+	read(cs)
+	assert.Empty(t, cs.changes)
+
+	// Not collected when the change feed is not active
+	assert.Nil(t, s.newChangeSet())
+}
@@ -0,0 +1,192 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/syncer/changefeed"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// registerImporter registers the import of external changes into the env,
+// until the returned function is called. It waits for a running import.
+func (s *Syncer) registerImporter(env *lmdb.Env) (unregister func()) {
+	var mu sync.RWMutex
+	closed := false
+	unregisterImporter := changefeed.RegisterImporter(s.name,
+		func(ctx context.Context, changes []changefeed.Change) (int, error) {
+			mu.RLock()
+			defer mu.RUnlock()
+			if closed {
+				return 0, fmt.Errorf("LMDB was closed")
+			}
+			return s.importChanges(env, changes)
+		})
+	return func() {
+		unregisterImporter()
+		mu.Lock()
+		closed = true
+		mu.Unlock()
+	}
+}
+
+// importChanges applies external changes in a single transaction, like an
+// application would, and returns the number of changes applied.
+//
+// The headers get the timestamp of the change, and changes that are not
+// newer than the current entry are skipped, so importing a change again has
+// no effect. With the shadow schema, both the main and shadow DBI are
+// updated. A main entry that changed since the last snapshot counts as
+// changed now, because the shadow DBI does not have it yet.
+func (s *Syncer) importChanges(env *lmdb.Env, changes []changefeed.Change) (applied int, err error) {
+	for _, ch := range changes {
+		if strings.HasPrefix(ch.DBI, SyncDBIPrefix) || !s.lc.IsDBIIncluded(ch.DBI) {
+			return 0, fmt.Errorf("%w: dbi %q is not synced", changefeed.ErrInvalidChange, ch.DBI)
+		}
+	}
+	now := header.TimestampFromTime(time.Now())
+	err = env.Update(func(txn *lmdb.Txn) error {
+		txnID := header.TxnID(txn.ID())
+		for _, ch := range changes {
+			ok, err := s.importChange(txn, ch, txnID, now)
+			if err != nil {
+				if lmdb.IsErrno(err, lmdb.BadValSize) {
+					err = fmt.Errorf("%w: %v", changefeed.ErrInvalidChange, err)
+				}
+				return fmt.Errorf("dbi %s key %s: %w", ch.DBI, utils.DisplayASCII(ch.Key), err)
+			}
+			if ok {
+				applied++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if applied > 0 {
+		metricImportedChanges.WithLabelValues(s.name).Add(float64(applied))
+	}
+	return applied, nil
+}
+
+// importChange applies a single change, and returns false if it was not
+// newer than the current entry
+func (s *Syncer) importChange(txn *lmdb.Txn, ch changefeed.Change, txnID header.TxnID, now header.Timestamp) (bool, error) {
+	ts := now
+	if !ch.Timestamp.IsZero() {
+		ts = header.TimestampFromTime(ch.Timestamp)
+	}
+	flags := header.NoFlags
+	var val []byte
+	if ch.Op == changefeed.OpDelete {
+		flags = header.FlagDeleted
+	} else {
+		val = ch.Value
+	}
+	hval := make([]byte, header.MinHeaderSize, header.MinHeaderSize+len(val))
+	header.PutBasic(hval, ts, txnID, flags)
+	hval = append(hval, val...)
+
+	dbi, err := openOrCreateDBI(txn, ch.DBI, 0)
+	if err != nil {
+		return false, err
+	}
+	dbiFlags, err := txn.Flags(dbi)
+	if err != nil {
+		return false, err
+	}
+	if dbiFlags&lmdb.DupSort > 0 {
+		return false, fmt.Errorf("%w: dupsort DBIs are not supported", changefeed.ErrInvalidChange)
+	}
+
+	if s.lc.SchemaTracksChanges {
+		oldTS, err := entryTimestamp(txn, dbi, ch.Key)
+		if err != nil || ts <= oldTS {
+			return false, err
+		}
+		return true, txn.Put(dbi, ch.Key, hval, 0)
+	}
+
+	shadowName, err := s.shadowDBIName(ch.DBI)
+	if err != nil {
+		return false, err
+	}
+	shadow, err := openOrCreateDBI(txn, shadowName, dbiFlags&uint(AllowedShadowDBIFlagsMask))
+	if err != nil {
+		return false, err
+	}
+	oldTS, err := shadowEntryTimestamp(txn, dbi, shadow, ch.Key, now)
+	if err != nil || ts <= oldTS {
+		return false, err
+	}
+	if flags.IsDeleted() {
+		if err := txn.Del(dbi, ch.Key, nil); err != nil && !lmdb.IsNotFound(err) {
+			return false, err
+		}
+	} else if err := txn.Put(dbi, ch.Key, val, 0); err != nil {
+		return false, err
+	}
+	return true, txn.Put(shadow, ch.Key, hval, 0)
+}
+
+// shadowEntryTimestamp returns the timestamp of the entry in the shadow DBI,
+// or now if the main entry changed since the last snapshot
+func shadowEntryTimestamp(txn *lmdb.Txn, dbi, shadow lmdb.DBI, key []byte, now header.Timestamp) (header.Timestamp, error) {
+	mainVal, err := txn.Get(dbi, key)
+	mainExists := err == nil
+	if err != nil && !lmdb.IsNotFound(err) {
+		return 0, err
+	}
+	shadowVal, err := txn.Get(shadow, key)
+	if lmdb.IsNotFound(err) {
+		if mainExists {
+			return now, nil
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	h, appVal, err := header.Parse(shadowVal)
+	if err != nil {
+		return 0, err
+	}
+	if h.Flags.IsDeleted() == mainExists || (mainExists && !bytes.Equal(appVal, mainVal)) {
+		return now, nil
+	}
+	return h.Timestamp, nil
+}
+
+// entryTimestamp returns the timestamp in the header of an entry, or 0 if
+// the entry does not exist
+func entryTimestamp(txn *lmdb.Txn, dbi lmdb.DBI, key []byte) (header.Timestamp, error) {
+	val, err := txn.Get(dbi, key)
+	if lmdb.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	h, _, err := header.Parse(val)
+	if err != nil {
+		return 0, err
+	}
+	return h.Timestamp, nil
+}
+
+// openOrCreateDBI opens a DBI, and creates it with the flags if it does not
+// exist yet
+func openOrCreateDBI(txn *lmdb.Txn, name string, flags uint) (lmdb.DBI, error) {
+	dbi, err := txn.OpenDBI(name, 0)
+	if lmdb.IsNotFound(err) {
+		return txn.OpenDBI(name, lmdb.Create|flags)
+	}
+	return dbi, err
+}
@@ -0,0 +1,101 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/syncer/changefeed"
+)
+
+func TestSyncer_importChanges(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		t.Run(fmt.Sprintf("withHeader=%v", withHeader), func(t *testing.T) {
+			ctx := context.Background()
+			s, env := createInstance(t, "a", memory.New(), withHeader)
+			ts := time.Now().Add(-time.Hour)
+			// Without deleted entries, which the native schema keeps
+			liveData := func() map[string]string {
+				data, err := dumpData(env, withHeader)
+				require.NoError(t, err)
+				for k, v := range data {
+					if v == "" {
+						delete(data, k)
+					}
+				}
+				return data
+			}
+			change := func(key, val string, op changefeed.Op, ts time.Time) changefeed.Change {
+				return changefeed.Change{LMDB: "default", DBI: testDBIName, Key: []byte(key),
+					Value: []byte(val), Op: op, Timestamp: ts}
+			}
+
+			applied, err := s.importChanges(env, []changefeed.Change{
+				change("foo", "1", changefeed.OpPut, ts),
+				change("bar", "2", changefeed.OpPut, ts),
+				change("gone", "", changefeed.OpDelete, ts),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, 3, applied)
+			assert.Equal(t, map[string]string{"foo": "1", "bar": "2"}, liveData())
+
+			// Older changes and the same changes again are skipped
+			applied, err = s.importChanges(env, []changefeed.Change{
+				change("foo", "old", changefeed.OpPut, ts.Add(-time.Second)),
+				change("bar", "2", changefeed.OpPut, ts),
+				change("bar", "", changefeed.OpDelete, ts.Add(time.Second)),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, 1, applied)
+			assert.Equal(t, map[string]string{"foo": "1"}, liveData())
+
+			// A local change wins over older imported changes, also when it
+			// is not in the shadow DBI yet
+			setKey(t, env, "foo", "local", withHeader)
+			applied, err = s.importChanges(env, []changefeed.Change{
+				change("foo", "old", changefeed.OpPut, ts.Add(time.Minute)),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, 0, applied)
+			applied, err = s.importChanges(env, []changefeed.Change{
+				change("foo", "new", changefeed.OpPut, time.Now().Add(time.Hour)),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, 1, applied)
+			assert.Equal(t, map[string]string{"foo": "new"}, liveData())
+
+			// The snapshot has the timestamps of the changes
+			_, err = s.SendOnce(ctx, env)
+			require.NoError(t, err)
+			err = env.View(func(txn *lmdb.Txn) error {
+				dbiName := testDBIName
+				if !withHeader {
+					dbiName, err = s.shadowDBIName(testDBIName)
+					require.NoError(t, err)
+				}
+				dbi, err := txn.OpenDBI(dbiName, 0)
+				require.NoError(t, err)
+				val, err := txn.Get(dbi, []byte("bar"))
+				require.NoError(t, err)
+				h, _, err := header.Parse(val)
+				require.NoError(t, err)
+				assert.True(t, h.Flags.IsDeleted())
+				assert.Equal(t, header.TimestampFromTime(ts.Add(time.Second)), h.Timestamp)
+				return nil
+			})
+			require.NoError(t, err)
+
+			// Changes to DBIs that are not synced are rejected
+			_, err = s.importChanges(env, []changefeed.Change{{LMDB: "default",
+				DBI: SyncDBIPrefix + "x", Key: []byte("foo"), Op: changefeed.OpPut}})
+			assert.ErrorIs(t, err, changefeed.ErrInvalidChange)
+		})
+	}
+}
@@ -25,6 +25,7 @@ func New(name string, st simpleblob.Interface, cc config.Cleanup, logger logrus.
 		snapFirstSeen:    map[string]time.Time{},
 		mu:               sync.Mutex{},
 		lastByInstance:   map[string]time.Time{},
+		changed:          make(chan struct{}, 1),
 	}
 }
 
@@ -39,12 +40,24 @@ type Worker struct {
 	snapFirstSeen    map[string]time.Time
 	conf             config.Cleanup
 
-	// mu protects lastByInstance
+	// mu protects lastByInstance and conf
 	mu sync.Mutex
 	// lastByInstance tracks the last snapshot loaded by instance and
 	// successfully committed to a snapshot, so that the cleaner can make safe
 	// decisions about when to remove stale snapshots.
 	lastByInstance map[string]time.Time
+
+	// isLeader is checked before every cleaning session, if set
+	isLeader func() bool
+
+	// changed is signalled by SetConfig
+	changed chan struct{}
+}
+
+// SetLeader sets a function that reports if this instance is the elected
+// leader. If it returns false, cleaning sessions are skipped.
+func (w *Worker) SetLeader(isLeader func() bool) {
+	w.isLeader = isLeader
 }
 
 // SetCommitted records the snapshot time of the last snapshots loaded
@@ -66,25 +79,51 @@ func (w *Worker) GetCommitted(instance string) time.Time {
 	return w.lastByInstance[instance]
 }
 
-func (w *Worker) Run(ctx context.Context) error {
-	if !w.conf.Enabled {
-		// If disabled, simply wait for the context to close
-		<-ctx.Done()
-		return context.Canceled
+// SetConfig replaces the cleanup configuration. It is safe to call while
+// running, and takes effect at the next cleaning session.
+func (w *Worker) SetConfig(cc config.Cleanup) {
+	w.mu.Lock()
+	w.conf = cc
+	w.mu.Unlock()
+	select {
+	case w.changed <- struct{}{}:
+	default:
 	}
+}
+
+func (w *Worker) config() config.Cleanup {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conf
+}
+
+func (w *Worker) Run(ctx context.Context) error {
 	for {
-		err := w.RunOnce(ctx, time.Now())
-		if err != nil {
+		conf := w.config()
+		if !conf.Enabled {
+			// If disabled, wait for the context to close or the config to
+			// change
+			select {
+			case <-ctx.Done():
+				return context.Canceled
+			case <-w.changed:
+				continue
+			}
+		}
+		if w.isLeader != nil && !w.isLeader() {
+			w.l.Debug("Not the leader, skipping clean run")
+		} else if err := w.RunOnce(ctx, time.Now()); err != nil {
 			w.l.WithError(err).Warn("Clean run failed")
 		}
-		if err = utils.SleepContextPerturb(ctx, w.conf.Interval); err != nil {
+		if err := utils.SleepContextPerturb(ctx, conf.Interval); err != nil {
 			return err
 		}
 	}
 }
 
 func (w *Worker) RunOnce(ctx context.Context, now time.Time) error {
-	if !w.conf.Enabled {
+	conf := w.config()
+	if !conf.Enabled {
 		return nil
 	}
 
@@ -101,12 +140,12 @@ func (w *Worker) RunOnce(ctx context.Context, now time.Time) error {
 	seen := make(map[string]bool)
 	for _, name := range names {
 		if w.ignoredFilenames[name] {
-			//r.l.WithField("filename", name).Debug("Ignored")
+			//r.l.WithField("snapshot_name", name).Debug("Ignored")
 			continue
 		}
 		ni, err := snapshot.ParseName(name)
 		if err != nil {
-			w.l.WithError(err).WithField("filename", name).
+			w.l.WithError(err).WithField("snapshot_name", name).
 				Debug("Skipping invalid filename")
 			w.ignoredFilenames[name] = true
 			continue
@@ -139,52 +178,92 @@ func (w *Worker) RunOnce(ctx context.Context, now time.Time) error {
 	slices.SortFunc(removalCandidates, func(a, b snapshot.NameInfo) bool {
 		return a.Timestamp.After(b.Timestamp) // 'less' in sort order if newer
 	})
+	all := removalCandidates
 
 	// Protect the newest snapshots, in case an instance is still downloading it.
 	// We do not use the snapshot time, because the appearance of a snapshot can be
 	// delayed due to multi-site syncing. Instead, we keep track when we have
 	// first seen a snapshot in the listing, and only consider it for deletion
 	// after that interval exceeds the threshold.
-	seenInstances := make(map[string]bool)
+	keptByInstance := make(map[string]int)
 	removalCandidates = lo.Filter(removalCandidates, func(ni snapshot.NameInfo, index int) bool {
 		firstSeenTime, exists := w.snapFirstSeen[ni.FullName]
 		if !exists {
 			w.snapFirstSeen[ni.FullName] = now
-			// Not setting seenInstances so that the previous newest snapshot
-			// remains for at least one config Cleanup.Interval when a new one
-			// just arrived.
+			// Not counting it in keptByInstance so that the previous newest
+			// snapshot remains for at least one config Cleanup.Interval when
+			// a new one just arrived.
 			return doNotDelete
 		}
-		if now.Sub(firstSeenTime) <= w.conf.MustKeepInterval {
-			seenInstances[ni.InstanceID] = true
+		if now.Sub(firstSeenTime) <= conf.MustKeepInterval {
+			keptByInstance[ni.InstanceID]++
 			return doNotDelete
 		}
 		return continueEvaluation
 	})
 
-	// Remove older snapshots if we have seen very recent snapshots for that instance
+	// Remove older snapshots if we have seen very recent snapshots for that
+	// instance, but keep the configured number of newest snapshots.
+	keepLast := conf.KeepLast
+	if keepLast < 1 {
+		keepLast = 1
+	}
 	var tooOld []snapshot.NameInfo
 	removalCandidates = lo.Filter(removalCandidates, func(ni snapshot.NameInfo, index int) bool {
-		if !seenInstances[ni.InstanceID] {
+		kept := keptByInstance[ni.InstanceID]
+		if kept == 0 {
 			// Do not delete newest (first in list) snapshot for this instance
-			seenInstances[ni.InstanceID] = true
-			if now.Sub(ni.Timestamp) > w.conf.RemoveOldInstancesInterval {
+			keptByInstance[ni.InstanceID]++
+			if now.Sub(ni.Timestamp) > conf.RemoveOldInstancesInterval {
 				// Move to tooOld list to consider for stale instance cleanup below
 				tooOld = append(tooOld, ni)
 			}
 			return doNotDelete
 		}
+		if kept < keepLast {
+			keptByInstance[ni.InstanceID]++
+			return doNotDelete
+		}
 		// This instance has newer snapshots that we keep.
 		return continueEvaluation
 	})
 
+	// Keep all snapshots that are younger than the retention interval,
+	// based on the snapshot time.
+	if conf.KeepInterval > 0 {
+		removalCandidates = lo.Filter(removalCandidates, func(ni snapshot.NameInfo, index int) bool {
+			if now.Sub(ni.Timestamp) <= conf.KeepInterval {
+				return doNotDelete
+			}
+			return continueEvaluation
+		})
+	}
+
+	// Keep the full snapshots that the remaining delta snapshots are based on.
+	removing := make(map[string]bool)
+	for _, ni := range removalCandidates {
+		removing[ni.FullName] = true
+	}
+	neededBases := make(map[string]bool) // by instance and timestamp
+	for _, ni := range all {
+		if ni.IsDelta() && !removing[ni.FullName] {
+			neededBases[ni.InstanceID+"__"+ni.BaseTimestampString] = true
+		}
+	}
+	removalCandidates = lo.Filter(removalCandidates, func(ni snapshot.NameInfo, index int) bool {
+		if !ni.IsDelta() && neededBases[ni.InstanceID+"__"+ni.TimestampString] {
+			return doNotDelete
+		}
+		return continueEvaluation
+	})
+
 	// Everything that is still in the removalCandidates can now be deleted,
 	// because we have determined there are newer snapshots for those instances,
 	// and we are skipping all the very recent ones.
 	nCleaned := 0
 	nError := 0
 	for _, ni := range removalCandidates {
-		l := w.l.WithField("snapshot", ni.FullName)
+		l := w.l.WithField("snapshot_name", ni.FullName)
 		l.Debug("Cleaning old snapshot")
 		metricDeleteCalls.WithLabelValues(w.name, "newer snapshot").Inc()
 		if err := w.st.Delete(ctx, ni.FullName); err != nil {
@@ -202,7 +281,7 @@ func (w *Worker) RunOnce(ctx context.Context, now time.Time) error {
 	// is to check if _this_ instance has both loaded and merged the snapshot,
 	// and subsequently successfully committed a snapshot of its own.
 	for _, ni := range tooOld {
-		l := w.l.WithField("snapshot", ni.FullName)
+		l := w.l.WithField("snapshot_name", ni.FullName)
 		lastCommitted := w.GetCommitted(ni.InstanceID)
 		if ni.Timestamp.After(lastCommitted) {
 			// Newer than any snapshots we have merged and committed that
@@ -217,7 +296,7 @@ func (w *Worker) RunOnce(ctx context.Context, now time.Time) error {
 			nError++
 			continue
 		}
-		l.WithField("instance", ni.InstanceID).Info(
+		l.WithField("snapshot_instance", ni.InstanceID).Info(
 			"Cleaning stale instance snapshot, merge proven")
 		nCleaned++
 	}
@@ -151,3 +151,156 @@ func TestWorker(t *testing.T) {
 	})
 
 }
+
+func TestWorker_deltaBase(t *testing.T) {
+	st := memory.New()
+	logger := logrus.New()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	w := New("test", st, config.Cleanup{
+		Enabled:                    true,
+		Interval:                   time.Minute, // not used in test
+		MustKeepInterval:           10 * time.Minute,
+		RemoveOldInstancesInterval: 7 * 24 * time.Hour,
+	}, logger)
+
+	delta := func(timeString, baseTimeString string) string {
+		return snapshot.DeltaName("test", "a", "G", mt(timeString), mt(baseTimeString))
+	}
+	snapshots := []string{
+		snap("test", "a", "2020-01-30 08:00:00"),
+		snap("test", "a", "2020-01-30 08:01:00"),
+		delta("2020-01-30 08:02:00", "2020-01-30 08:01:00"),
+		delta("2020-01-30 08:03:00", "2020-01-30 08:01:00"),
+	}
+	for _, name := range snapshots {
+		assert.NoError(t, st.Store(ctx, name, []byte{'x'}))
+	}
+
+	doRun := func(timeString string, expectedSnapshots []string) {
+		assert.NoError(t, w.RunOnce(ctx, mt(timeString)), timeString)
+		list, err := st.List(ctx, "")
+		assert.NoError(t, err, timeString)
+		names := list.Names()
+		sort.Strings(names)
+		sort.Strings(expectedSnapshots)
+		assert.Equal(t, expectedSnapshots, names, timeString)
+	}
+
+	doRun("2020-01-30 10:00:00", snapshots)
+
+	// The base of the latest delta is kept, older ones are removed
+	doRun("2020-01-30 10:10:01", []string{
+		snap("test", "a", "2020-01-30 08:01:00"),
+		delta("2020-01-30 08:03:00", "2020-01-30 08:01:00"),
+	})
+
+	// Once a new full snapshot arrives, the old base can be removed
+	assert.NoError(t, st.Store(ctx, snap("test", "a", "2020-01-30 10:11:00"), []byte{'x'}))
+	doRun("2020-01-30 10:12:00", []string{
+		snap("test", "a", "2020-01-30 08:01:00"),
+		snap("test", "a", "2020-01-30 10:11:00"),
+		delta("2020-01-30 08:03:00", "2020-01-30 08:01:00"),
+	})
+	doRun("2020-01-30 10:13:00", []string{
+		snap("test", "a", "2020-01-30 10:11:00"),
+	})
+}
+
+func TestWorker_retention(t *testing.T) {
+	st := memory.New()
+	logger := logrus.New()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	w := New("test", st, config.Cleanup{
+		Enabled:                    true,
+		Interval:                   time.Minute, // not used in test
+		MustKeepInterval:           10 * time.Minute,
+		RemoveOldInstancesInterval: 7 * 24 * time.Hour,
+		KeepLast:                   2,
+		KeepInterval:               time.Hour,
+	}, logger)
+
+	snapshots := []string{
+		snap("test", "a", "2020-01-30 06:00:00"),
+		snap("test", "a", "2020-01-30 07:00:00"),
+		snap("test", "a", "2020-01-30 08:00:00"),
+		snap("test", "a", "2020-01-30 09:30:00"),
+		snap("test", "a", "2020-01-30 09:40:00"),
+		snap("test", "a", "2020-01-30 09:50:00"),
+		snap("test", "b", "2020-01-30 06:00:00"),
+		snap("test", "b", "2020-01-30 07:00:00"),
+		snap("test", "b", "2020-01-30 08:00:00"),
+	}
+	for _, name := range snapshots {
+		assert.NoError(t, st.Store(ctx, name, []byte{'x'}))
+	}
+
+	doRun := func(timeString string, expectedSnapshots []string) {
+		assert.NoError(t, w.RunOnce(ctx, mt(timeString)), timeString)
+		list, err := st.List(ctx, "")
+		assert.NoError(t, err, timeString)
+		names := list.Names()
+		sort.Strings(names)
+		sort.Strings(expectedSnapshots)
+		assert.Equal(t, expectedSnapshots, names, timeString)
+	}
+
+	doRun("2020-01-30 10:00:00", snapshots)
+
+	// Instance 'a' keeps everything within the last hour, 'b' the newest two
+	doRun("2020-01-30 10:10:01", []string{
+		snap("test", "a", "2020-01-30 09:30:00"),
+		snap("test", "a", "2020-01-30 09:40:00"),
+		snap("test", "a", "2020-01-30 09:50:00"),
+		snap("test", "b", "2020-01-30 07:00:00"),
+		snap("test", "b", "2020-01-30 08:00:00"),
+	})
+
+	// Once they are older than the interval, only the newest two remain
+	doRun("2020-01-30 10:45:00", []string{
+		snap("test", "a", "2020-01-30 09:40:00"),
+		snap("test", "a", "2020-01-30 09:50:00"),
+		snap("test", "b", "2020-01-30 07:00:00"),
+		snap("test", "b", "2020-01-30 08:00:00"),
+	})
+}
+
+func TestWorker_SetConfig(t *testing.T) {
+	st := memory.New()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	old := snap("test", "a", "2020-01-30 08:00:00")
+	newest := snap("test", "a", "2020-01-30 08:01:00")
+	for _, name := range []string{old, newest} {
+		assert.NoError(t, st.Store(ctx, name, []byte{'x'}))
+	}
+
+	// Disabled, Run waits for a config change
+	w := New("test", st, config.Cleanup{}, logrus.New())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	w.SetConfig(config.Cleanup{
+		Enabled:                    true,
+		Interval:                   10 * time.Millisecond,
+		RemoveOldInstancesInterval: 7 * 24 * time.Hour,
+	})
+	assert.Eventually(t, func() bool {
+		ls, err := st.List(ctx, "test__")
+		return err == nil && len(ls) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	ls, err := st.List(ctx, "test__")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{newest}, ls.Names())
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
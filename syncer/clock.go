@@ -0,0 +1,75 @@
+package syncer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+// hybridClock generates the timestamps for local changes.
+//
+// Wall clock timestamps break the merge ordering when the clock is stepped
+// backwards, because newer changes then get older timestamps. When enabled,
+// this works like a hybrid logical clock: every timestamp is the maximum of
+// the wall clock and the last timestamp seen plus one, where the timestamps
+// seen include those of remote snapshots that are not too far in the future.
+type hybridClock struct {
+	conf config.HybridClock
+	name string // LMDB name, for metrics
+	l    logrus.FieldLogger
+
+	mu   sync.Mutex
+	last header.Timestamp
+}
+
+// Now returns the timestamp to use for local changes at wall clock time wall
+func (c *hybridClock) Now(wall time.Time) header.Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts := header.TimestampFromTime(wall)
+	if ts < c.last {
+		metricClockBackwards.WithLabelValues(c.name).Inc()
+		c.l.WithField("behind", time.Duration(c.last-ts)).
+			Warn("Clock went backwards")
+	}
+	if c.conf.Enabled && ts <= c.last {
+		ts = c.last + 1
+	}
+	if ts > c.last {
+		c.last = ts
+	}
+	return ts
+}
+
+// Observe records the timestamp of a remote snapshot loaded at wall clock
+// time wall. It tracks how far ahead the clock of the remote instance is,
+// and advances the clock to the remote timestamp if enabled. Timestamps more
+// than MaxSkew in the future are ignored, to not let a single instance with
+// a broken clock drag all other instances along.
+func (c *hybridClock) Observe(instance string, remote, wall time.Time) {
+	ahead := remote.Sub(wall)
+	if ahead < 0 {
+		ahead = 0 // we cannot distinguish skew from propagation delay
+	}
+	metricClockSkew.WithLabelValues(c.name, instance).Set(ahead.Seconds())
+	if c.conf.MaxSkew > 0 && ahead > c.conf.MaxSkew {
+		metricClockSkewExceeded.WithLabelValues(c.name, instance).Inc()
+		c.l.WithFields(logrus.Fields{
+			"snapshot_instance": instance,
+			"ahead":             ahead.Round(time.Millisecond),
+			"max_skew":          c.conf.MaxSkew,
+		}).Warn("Remote snapshot timestamp too far in the future, check clocks")
+		return
+	}
+	if !c.conf.Enabled {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ts := header.TimestampFromTime(remote); ts > c.last {
+		c.last = ts
+	}
+}
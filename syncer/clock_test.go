@@ -0,0 +1,62 @@
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+func TestHybridClock(t *testing.T) {
+	t0 := testTS(1).Time()
+	newClock := func(enabled bool) *hybridClock {
+		return &hybridClock{
+			conf: config.HybridClock{Enabled: enabled, MaxSkew: time.Minute},
+			name: t.Name(),
+			l:    logrus.StandardLogger(),
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newClock(false)
+		assert.Equal(t, header.TimestampFromTime(t0), c.Now(t0))
+		// Wall clock stepped backwards is used as is, but detected
+		assert.Equal(t, header.TimestampFromTime(t0.Add(-time.Second)), c.Now(t0.Add(-time.Second)))
+		assert.Equal(t, 1.0, testutil.ToFloat64(metricClockBackwards.WithLabelValues(c.name)))
+		// Remote timestamps do not affect the clock
+		c.Observe("other", t0.Add(10*time.Second), t0)
+		assert.Equal(t, header.TimestampFromTime(t0.Add(time.Second)), c.Now(t0.Add(time.Second)))
+		assert.Equal(t, 10.0, testutil.ToFloat64(metricClockSkew.WithLabelValues(c.name, "other")))
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		c := newClock(true)
+		ts := c.Now(t0)
+		assert.Equal(t, header.TimestampFromTime(t0), ts)
+		// Same or earlier wall clock time still increases
+		assert.Equal(t, ts+1, c.Now(t0))
+		assert.Equal(t, ts+2, c.Now(t0.Add(-time.Hour)))
+		// Wall clock ahead again
+		ts = c.Now(t0.Add(time.Second))
+		assert.Equal(t, header.TimestampFromTime(t0.Add(time.Second)), ts)
+
+		// Remote timestamp within max skew advances the clock
+		remote := t0.Add(30 * time.Second)
+		c.Observe("other", remote, t0.Add(2*time.Second))
+		assert.Equal(t, header.TimestampFromTime(remote)+1, c.Now(t0.Add(3*time.Second)))
+
+		// Remote timestamp beyond max skew is ignored
+		c.Observe("broken", t0.Add(time.Hour), t0.Add(4*time.Second))
+		assert.Equal(t, 1.0, testutil.ToFloat64(metricClockSkewExceeded.WithLabelValues(c.name, "broken")))
+		assert.Equal(t, header.TimestampFromTime(remote)+2, c.Now(t0.Add(5*time.Second)))
+
+		// Remote timestamp in the past has no effect
+		c.Observe("old", t0, t0.Add(6*time.Second))
+		assert.Equal(t, 0.0, testutil.ToFloat64(metricClockSkew.WithLabelValues(c.name, "old")))
+		assert.Equal(t, header.TimestampFromTime(t0.Add(time.Minute)), c.Now(t0.Add(time.Minute)))
+	})
+}
@@ -0,0 +1,195 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// runCompaction periodically compacts the snapshots of stale instances until
+// the context is cancelled, if this instance is the leader.
+func (s *Syncer) runCompaction(ctx context.Context) error {
+	for {
+		if err := utils.SleepContextPerturb(ctx, s.c.Storage.Compaction.Interval); err != nil {
+			return err
+		}
+		if !s.isLeader() {
+			s.l.Debug("Not the leader, skipping compaction")
+			continue
+		}
+		if _, err := s.CompactOnce(ctx, time.Now()); err != nil {
+			if utils.IsCanceled(ctx) {
+				return ctx.Err()
+			}
+			metricCompactionFailed.WithLabelValues(s.name).Inc()
+			s.l.WithError(err).Warn("Compaction failed")
+		}
+	}
+}
+
+// CompactOnce merges the latest snapshots of all instances that have not
+// written a snapshot for Compaction.StaleInterval into a consolidated snapshot
+// of the compaction instance, together with its previous consolidated
+// snapshot. Once that has been stored, all snapshots of the stale instances
+// and the previous consolidated snapshots are removed. It returns the names
+// of the compacted instances.
+func (s *Syncer) CompactOnce(ctx context.Context, now time.Time) (compacted []string, err error) {
+	conf := s.c.Storage.Compaction
+	ls, err := s.st.List(ctx, s.name+"__")
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the receiver, find the latest usable snapshot of every instance
+	// and the full snapshot it is based on, if it is a delta.
+	byInstance := make(map[string][]snapshot.NameInfo) // all snapshots
+	latest := make(map[string]snapshot.NameInfo)
+	bases := make(map[string]snapshot.NameInfo)
+	fulls := make(map[string]snapshot.NameInfo) // by instance and timestamp
+	for _, name := range ls.Names() {
+		ni, err := snapshot.ParseName(name)
+		if err != nil {
+			continue
+		}
+		byInstance[ni.InstanceID] = append(byInstance[ni.InstanceID], ni)
+		if ni.IsDelta() {
+			base, exists := fulls[ni.InstanceID+"__"+ni.BaseTimestampString]
+			if !exists {
+				continue
+			}
+			bases[ni.InstanceID] = base
+		} else {
+			fulls[ni.InstanceID+"__"+ni.TimestampString] = ni
+			delete(bases, ni.InstanceID)
+		}
+		latest[ni.InstanceID] = ni
+	}
+
+	for inst, ni := range latest {
+		if inst == s.instanceID() || inst == conf.Instance {
+			continue
+		}
+		if now.Sub(ni.Timestamp) > conf.StaleInterval {
+			compacted = append(compacted, inst)
+		}
+	}
+	if len(compacted) == 0 {
+		return nil, nil
+	}
+	sort.Strings(compacted)
+	l := s.l.WithField("compacted_instances", compacted)
+	l.Info("Compacting snapshots of stale instances")
+
+	// The previous consolidated snapshot is the first input, the snapshots
+	// of the stale instances follow with their bases before their deltas.
+	var toLoad []snapshot.NameInfo
+	if prev, exists := latest[conf.Instance]; exists {
+		if base, exists := bases[conf.Instance]; exists {
+			toLoad = append(toLoad, base)
+		}
+		toLoad = append(toLoad, prev)
+	}
+	for _, inst := range compacted {
+		if base, exists := bases[inst]; exists {
+			toLoad = append(toLoad, base)
+		}
+		toLoad = append(toLoad, latest[inst])
+	}
+	var inputs [][]*snapshot.DBI
+	for _, ni := range toLoad {
+		dbis, err := s.loadForCompaction(ctx, ni.FullName)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %w", ni.FullName, err)
+		}
+		inputs = append(inputs, dbis)
+	}
+
+	var buf bytes.Buffer
+	sw, err := snapshot.NewStreamWriter(&buf, s.compression,
+		snapshot.CurrentFormatVersion, snapshot.WriteCompatFormatVersion)
+	if err != nil {
+		return nil, err
+	}
+	if n := s.c.MemorySnapshotChunkSize; n > 0 {
+		sw.ChunkSize = int(n)
+	}
+	sw.Signer = s.signer
+	if err := snapshot.Merge(sw, inputs...); err != nil {
+		return nil, err
+	}
+	inputs = nil // allow GC
+
+	ts := time.Now()
+	_, err = sw.Close(snapshot.Meta{
+		DatabaseName:  s.name,
+		Hostname:      hostname,
+		InstanceID:    conf.Instance,
+		GenerationID:  s.generationID(),
+		TimestampNano: uint64(header.TimestampFromTime(ts)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := buf.Bytes()
+	name := snapshot.NameWithExtension(s.name, conf.Instance, s.generationID(),
+		ts, s.compression.Extension())
+	if err := s.storeWithRetry(ctx, s.st, name, out); err != nil {
+		return nil, fmt.Errorf("store %s: %w", name, err)
+	}
+	l.WithFields(logrus.Fields{
+		"snapshot_name": name,
+		"snapshot_size": datasize.ByteSize(len(out)).HumanReadable(),
+		"merged":        len(toLoad),
+	}).Info("Stored consolidated snapshot")
+
+	// Only remove what we listed, so that a stale instance that comes back
+	// in the meantime does not lose its new snapshot.
+	var remove []snapshot.NameInfo
+	remove = append(remove, byInstance[conf.Instance]...)
+	for _, inst := range compacted {
+		remove = append(remove, byInstance[inst]...)
+	}
+	for _, ni := range remove {
+		if err := s.st.Delete(ctx, ni.FullName); err != nil {
+			return compacted, fmt.Errorf("delete %s: %w", ni.FullName, err)
+		}
+		s.l.WithField("snapshot_name", ni.FullName).Debug("Removed compacted snapshot")
+	}
+	metricCompactedInstances.WithLabelValues(s.name).Add(float64(len(compacted)))
+	return compacted, nil
+}
+
+// loadForCompaction loads and verifies a snapshot
+func (s *Syncer) loadForCompaction(ctx context.Context, name string) ([]*snapshot.DBI, error) {
+	data, err := s.st.Load(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var dicts [][]byte
+	if dict := s.compression.Dictionary; len(dict) > 0 {
+		dicts = append(dicts, dict)
+	}
+	// Never merge a corrupt snapshot into the consolidated one, since the
+	// stale snapshots are removed afterwards.
+	if _, err := snapshot.Verify(data, s.verifier, dicts...); err != nil {
+		return nil, err
+	}
+	snap, err := snapshot.LoadData(data, dicts...)
+	if err != nil {
+		return nil, err
+	}
+	for i, dbi := range snap.Databases {
+		if snap.Databases[i], err = s.dupSortConvert(dbi); err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbi.Name(), err)
+		}
+	}
+	return snap.Databases, nil
+}
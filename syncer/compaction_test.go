@@ -0,0 +1,77 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func TestSyncer_CompactOnce(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		t.Run(fmt.Sprintf("withHeader=%v", withHeader), func(t *testing.T) {
+			ctx := context.Background()
+			st := memory.New()
+			syncerA, envA := createInstance(t, "a", st, withHeader)
+			syncerB, envB := createInstance(t, "b", st, withHeader)
+			syncerC, envC := createInstance(t, "c", st, withHeader)
+			syncerC.c.Storage.Compaction = config.Compaction{
+				StaleInterval: time.Hour,
+				Instance:      "compacted",
+			}
+
+			setKey(t, envA, "a", "1", withHeader)
+			setKey(t, envA, "both", "from-a", withHeader)
+			_, err := syncerA.SendOnce(ctx, envA)
+			require.NoError(t, err)
+			setKey(t, envB, "b", "2", withHeader)
+			setKey(t, envB, "both", "from-b", withHeader) // newer
+			_, err = syncerB.SendOnce(ctx, envB)
+			require.NoError(t, err)
+			_, err = syncerC.SendOnce(ctx, envC) // own snapshot is never compacted
+			require.NoError(t, err)
+
+			// Nothing is stale yet
+			compacted, err := syncerC.CompactOnce(ctx, time.Now())
+			require.NoError(t, err)
+			assert.Empty(t, compacted)
+
+			compacted, err = syncerC.CompactOnce(ctx, time.Now().Add(2*time.Hour))
+			require.NoError(t, err)
+			assert.Equal(t, []string{"a", "b"}, compacted)
+			assert.Len(t, listInstanceSnapshots(st, "a"), 0)
+			assert.Len(t, listInstanceSnapshots(st, "b"), 0)
+			assert.Len(t, listInstanceSnapshots(st, "c"), 1)
+			list := listInstanceSnapshots(st, "compacted")
+			require.Len(t, list, 1)
+
+			// The consolidated snapshot has the merged data
+			data, err := st.Load(ctx, list[0].Name)
+			require.NoError(t, err)
+			ni, err := snapshot.ParseName(list[0].Name)
+			require.NoError(t, err)
+			syncerD, envD := createInstance(t, "d", memory.New(), withHeader)
+			_, _, err = syncerD.LoadOnce(ctx, envD, "compacted", snapshot.Update{
+				Data:     data,
+				NameInfo: ni,
+			}, 0)
+			require.NoError(t, err)
+			kv, err := dumpData(envD, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{
+				"a": "1", "b": "2", "both": "from-b",
+			}, kv)
+
+			// The consolidated snapshot itself is never considered stale
+			compacted, err = syncerC.CompactOnce(ctx, time.Now().Add(24*time.Hour))
+			require.NoError(t, err)
+			assert.Empty(t, compacted)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package conflict
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The side that won a conflict, as recorded in the AuditLog
+const (
+	WinnerLocal    = "local"
+	WinnerRemote   = "remote"
+	WinnerResolved = "resolved" // the Resolver returned a different value
+)
+
+// AuditRecord is a line in the AuditLog
+type AuditRecord struct {
+	Time           time.Time  `json:"time"`
+	LMDB           string     `json:"lmdb"`
+	DBI            string     `json:"dbi"`
+	Key            []byte     `json:"key"`
+	RemoteInstance string     `json:"remote_instance"`
+	Strategy       string     `json:"strategy"`
+	Winner         string     `json:"winner"`
+	Local          AuditEntry `json:"local"`
+	Remote         AuditEntry `json:"remote"`
+}
+
+// AuditEntry describes one side of a conflict without its value
+type AuditEntry struct {
+	Timestamp uint64 `json:"timestamp"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	SHA256    string `json:"sha256,omitempty"` // of the value, if not deleted
+}
+
+// NewAuditEntry returns the AuditEntry for an Entry
+func NewAuditEntry(e Entry) AuditEntry {
+	ae := AuditEntry{
+		Timestamp: uint64(e.Timestamp),
+		Deleted:   e.Deleted,
+	}
+	if !e.Deleted {
+		sum := sha256.Sum256(e.Value)
+		ae.SHA256 = hex.EncodeToString(sum[:])
+	}
+	return ae
+}
+
+// AuditLog is an append-only file with a JSON line for every conflict, which
+// allows operators to audit which entries were overwritten by remote ones.
+// Values are only recorded as a hash.
+type AuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenAuditLog opens or creates the AuditLog file at path for appending
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open conflict log: %w", err)
+	}
+	return &AuditLog{f: f}, nil
+}
+
+// Write appends a record to the log. Every record is appended with a single
+// write, so that multiple processes can share the log.
+func (a *AuditLog) Write(r AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return os.ErrClosed
+	}
+	_, err = a.f.Write(data)
+	return err
+}
+
+// Close closes the log file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
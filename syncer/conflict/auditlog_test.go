@@ -0,0 +1,46 @@
+package conflict
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conflicts.jsonl")
+	a, err := OpenAuditLog(path)
+	require.NoError(t, err)
+	rec := AuditRecord{
+		LMDB:   "main",
+		DBI:    "records",
+		Key:    []byte("key"),
+		Winner: WinnerRemote,
+		Local:  NewAuditEntry(Entry{Value: []byte("abc"), Timestamp: 1}),
+		Remote: NewAuditEntry(Entry{Timestamp: 2, Deleted: true}),
+	}
+	require.NoError(t, a.Write(rec))
+	require.NoError(t, a.Close())
+	require.NoError(t, a.Close())
+	assert.ErrorIs(t, a.Write(rec), os.ErrClosed)
+
+	// Appended to the existing file
+	a, err = OpenAuditLog(path)
+	require.NoError(t, err)
+	require.NoError(t, a.Write(rec))
+	require.NoError(t, a.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	var got AuditRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &got))
+	assert.Equal(t, rec, got)
+	assert.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", got.Local.SHA256)
+	assert.Empty(t, got.Remote.SHA256)
+}
@@ -0,0 +1,118 @@
+// Package conflict implements pluggable conflict resolution for entries
+// merged from remote snapshots.
+//
+// By default, the entry with the highest timestamp wins (last-writer-wins).
+// For schemas where this silently loses data, a Resolver can be configured
+// per DBI with the conflict_resolution DBI option.
+//
+// Resolvers MUST be deterministic and give the same result regardless of
+// which of the two entries is local, otherwise instances can diverge.
+package conflict
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+// Entry is one version of an LMDB entry
+type Entry struct {
+	Value     []byte // application value, nil if deleted
+	Timestamp header.Timestamp
+	Deleted   bool
+}
+
+// Equal returns true if both entries are identical
+func (e Entry) Equal(o Entry) bool {
+	return e.Timestamp == o.Timestamp &&
+		e.Deleted == o.Deleted &&
+		bytes.Equal(e.Value, o.Value)
+}
+
+// Conflict describes a local entry and a remote snapshot entry for the same
+// key with a different value.
+type Conflict struct {
+	DBI            string
+	Key            []byte
+	Local          Entry
+	Remote         Entry
+	RemoteInstance string // instance that wrote the remote snapshot
+}
+
+// Resolver decides which entry to keep for a conflict.
+type Resolver interface {
+	// Resolve returns the entry the LMDB should contain. This is either
+	// the Local or Remote entry, or a new entry that merges both.
+	// The data of the Conflict is only valid during the call.
+	Resolve(c Conflict) (Entry, error)
+}
+
+// Factory creates a Resolver from its configuration
+type Factory func(cr config.ConflictResolution) (Resolver, error)
+
+var (
+	mu        sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register registers a Resolver Factory for a strategy name, so that it can
+// be configured for a DBI. This allows Go programs that embed the syncer to
+// add their own strategies. It panics if the name is already registered.
+func Register(strategy string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exists := factories[strategy]; exists {
+		panic("conflict: strategy registered twice: " + strategy)
+	}
+	factories[strategy] = f
+}
+
+// Strategies returns the sorted names of all registered strategies
+func Strategies() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the Resolver configured by cr. It returns nil without an error
+// for the default last-writer-wins strategy, which the syncer implements
+// directly for speed.
+func New(cr config.ConflictResolution) (Resolver, error) {
+	if cr.Strategy == "" || cr.Strategy == StrategyLastWriterWins {
+		return nil, nil
+	}
+	mu.Lock()
+	f, exists := factories[cr.Strategy]
+	mu.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown conflict resolution strategy %q (available: %v)",
+			cr.Strategy, Strategies())
+	}
+	return f(cr)
+}
+
+// LastWriterWins resolves a conflict the same way the syncer does without
+// a Resolver: the newest entry wins, and for equal timestamps the entry with
+// the lexicographically highest value wins. Other Resolvers use this to
+// break ties.
+func LastWriterWins(c Conflict) Entry {
+	if c.Remote.Timestamp != c.Local.Timestamp {
+		if c.Remote.Timestamp > c.Local.Timestamp {
+			return c.Remote
+		}
+		return c.Local
+	}
+	if bytes.Compare(c.Remote.Value, c.Local.Value) > 0 {
+		return c.Remote
+	}
+	return c.Local
+}
@@ -0,0 +1,118 @@
+package conflict
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+func testConflict(local, remote string, localTS, remoteTS int) Conflict {
+	return Conflict{
+		DBI:            "foo",
+		Key:            []byte("key"),
+		Local:          Entry{Value: []byte(local), Timestamp: header.Timestamp(1000 + localTS)},
+		Remote:         Entry{Value: []byte(remote), Timestamp: header.Timestamp(1000 + remoteTS)},
+		RemoteInstance: "remote",
+	}
+}
+
+func TestNew(t *testing.T) {
+	r, err := New(config.ConflictResolution{})
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	r, err = New(config.ConflictResolution{Strategy: StrategyLastWriterWins})
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	_, err = New(config.ConflictResolution{Strategy: "unknown"})
+	assert.Error(t, err)
+	_, err = New(config.ConflictResolution{Strategy: StrategyPreferInstance})
+	assert.Error(t, err)
+	_, err = New(config.ConflictResolution{Strategy: StrategyHighestVersion, VersionSize: 3})
+	assert.Error(t, err)
+	_, err = New(config.ConflictResolution{Strategy: StrategyExec})
+	assert.Error(t, err)
+}
+
+func TestLastWriterWins(t *testing.T) {
+	c := testConflict("a", "b", 1, 2)
+	assert.Equal(t, c.Remote, LastWriterWins(c))
+	c = testConflict("a", "b", 2, 1)
+	assert.Equal(t, c.Local, LastWriterWins(c))
+	c = testConflict("b", "a", 1, 1)
+	assert.Equal(t, c.Local, LastWriterWins(c))
+}
+
+func TestPreferInstance(t *testing.T) {
+	r, err := New(config.ConflictResolution{
+		Strategy:        StrategyPreferInstance,
+		PreferInstances: []string{"primary"},
+	})
+	require.NoError(t, err)
+
+	c := testConflict("local", "remote", 2, 1)
+	res, err := r.Resolve(c)
+	require.NoError(t, err)
+	assert.Equal(t, c.Local, res)
+
+	c.RemoteInstance = "primary"
+	res, err = r.Resolve(c)
+	require.NoError(t, err)
+	assert.Equal(t, c.Remote, res)
+}
+
+func TestHighestVersion(t *testing.T) {
+	r, err := New(config.ConflictResolution{
+		Strategy:      StrategyHighestVersion,
+		VersionOffset: 1,
+		VersionSize:   2,
+	})
+	require.NoError(t, err)
+
+	// Higher version wins, even if older
+	c := testConflict("x\x00\x02a", "y\x00\x01b", 1, 2)
+	res, err := r.Resolve(c)
+	require.NoError(t, err)
+	assert.Equal(t, c.Local, res)
+
+	// Same version falls back to the timestamp
+	c = testConflict("x\x00\x02a", "y\x00\x02b", 1, 2)
+	res, err = r.Resolve(c)
+	require.NoError(t, err)
+	assert.Equal(t, c.Remote, res)
+
+	// Too short and deleted values fall back to the timestamp
+	c = testConflict("x\x00\x02a", "y", 1, 2)
+	res, err = r.Resolve(c)
+	require.NoError(t, err)
+	assert.Equal(t, c.Remote, res)
+	c = testConflict("x\x00\x02a", "", 1, 2)
+	c.Remote.Deleted = true
+	res, err = r.Resolve(c)
+	require.NoError(t, err)
+	assert.Equal(t, c.Remote, res)
+}
+
+func TestExec(t *testing.T) {
+	// Merged value "bWVyZ2Vk" is base64 for "merged"
+	r, err := New(config.ConflictResolution{
+		Strategy: StrategyExec,
+		Command:  []string{"sh", "-c", `cat > /dev/null; echo '{"value": "bWVyZ2Vk"}'`},
+	})
+	require.NoError(t, err)
+	c := testConflict("a", "b", 1, 2)
+	res, err := r.Resolve(c)
+	require.NoError(t, err)
+	assert.Equal(t, Entry{Value: []byte("merged"), Timestamp: c.Remote.Timestamp}, res)
+
+	r, err = New(config.ConflictResolution{
+		Strategy: StrategyExec,
+		Command:  []string{"sh", "-c", "echo failed >&2; exit 1"},
+	})
+	require.NoError(t, err)
+	_, err = r.Resolve(c)
+	assert.ErrorContains(t, err, "failed")
+}
@@ -0,0 +1,185 @@
+package conflict
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"powerdns.com/platform/lightningstream/config"
+)
+
+// Built-in strategy names
+const (
+	StrategyLastWriterWins = "last_writer_wins"
+	StrategyPreferInstance = "prefer_instance"
+	StrategyHighestVersion = "highest_version"
+	StrategyExec           = "exec"
+)
+
+// DefaultExecTimeout is the default timeout for a single exec resolver call
+const DefaultExecTimeout = 5 * time.Second
+
+func init() {
+	Register(StrategyPreferInstance, newPreferInstance)
+	Register(StrategyHighestVersion, newHighestVersion)
+	Register(StrategyExec, newExec)
+}
+
+// preferInstance lets entries from snapshots of the preferred instances win
+// over local entries, regardless of their timestamp.
+type preferInstance struct {
+	instances map[string]bool
+}
+
+func newPreferInstance(cr config.ConflictResolution) (Resolver, error) {
+	if len(cr.PreferInstances) == 0 {
+		return nil, fmt.Errorf("%s: prefer_instances required", cr.Strategy)
+	}
+	r := &preferInstance{instances: make(map[string]bool)}
+	for _, instance := range cr.PreferInstances {
+		r.instances[instance] = true
+	}
+	return r, nil
+}
+
+func (r *preferInstance) Resolve(c Conflict) (Entry, error) {
+	if r.instances[c.RemoteInstance] {
+		return c.Remote, nil
+	}
+	return LastWriterWins(c), nil
+}
+
+// highestVersion compares a big endian unsigned version number stored at a
+// fixed offset in the value. The entry with the highest version wins.
+// Deleted entries and values too short to contain a version fall back to
+// last-writer-wins.
+type highestVersion struct {
+	offset int
+	size   int
+}
+
+func newHighestVersion(cr config.ConflictResolution) (Resolver, error) {
+	switch cr.VersionSize {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("%s: version_size must be 1, 2, 4 or 8", cr.Strategy)
+	}
+	if cr.VersionOffset < 0 {
+		return nil, fmt.Errorf("%s: version_offset cannot be negative", cr.Strategy)
+	}
+	return &highestVersion{offset: cr.VersionOffset, size: cr.VersionSize}, nil
+}
+
+func (r *highestVersion) version(e Entry) ([]byte, bool) {
+	if e.Deleted || len(e.Value) < r.offset+r.size {
+		return nil, false
+	}
+	return e.Value[r.offset : r.offset+r.size], true
+}
+
+func (r *highestVersion) Resolve(c Conflict) (Entry, error) {
+	lv, lok := r.version(c.Local)
+	rv, rok := r.version(c.Remote)
+	if !lok || !rok {
+		return LastWriterWins(c), nil
+	}
+	// Big endian numbers of equal size compare like bytes
+	switch bytes.Compare(rv, lv) {
+	case 1:
+		return c.Remote, nil
+	case -1:
+		return c.Local, nil
+	default:
+		return LastWriterWins(c), nil
+	}
+}
+
+// execResolver runs an external command for every conflict. The command
+// receives the conflict as a JSON object on stdin and must write the
+// resulting entry as a JSON object to stdout. Values are base64 encoded.
+//
+// Input, on a single line:
+//
+//	{"dbi": "...", "key": "...", "remote_instance": "...",
+//	 "local": {"value": "...", "timestamp": 123, "deleted": false},
+//	 "remote": {"value": "...", "timestamp": 456, "deleted": false}}
+//
+// Output:
+//
+//	{"value": "...", "deleted": false}
+//
+// The timestamp of the result is the highest timestamp of both entries.
+type execResolver struct {
+	command []string
+	timeout time.Duration
+}
+
+func newExec(cr config.ConflictResolution) (Resolver, error) {
+	if len(cr.Command) == 0 {
+		return nil, fmt.Errorf("%s: command required", cr.Strategy)
+	}
+	timeout := cr.Timeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+	return &execResolver{command: cr.Command, timeout: timeout}, nil
+}
+
+type execEntry struct {
+	Value     []byte `json:"value"`
+	Timestamp uint64 `json:"timestamp"`
+	Deleted   bool   `json:"deleted"`
+}
+
+type execInput struct {
+	DBI            string    `json:"dbi"`
+	Key            []byte    `json:"key"`
+	RemoteInstance string    `json:"remote_instance"`
+	Local          execEntry `json:"local"`
+	Remote         execEntry `json:"remote"`
+}
+
+func (r *execResolver) Resolve(c Conflict) (Entry, error) {
+	in, err := json.Marshal(execInput{
+		DBI:            c.DBI,
+		Key:            c.Key,
+		RemoteInstance: c.RemoteInstance,
+		Local:          execEntry{Value: c.Local.Value, Timestamp: uint64(c.Local.Timestamp), Deleted: c.Local.Deleted},
+		Remote:         execEntry{Value: c.Remote.Value, Timestamp: uint64(c.Remote.Timestamp), Deleted: c.Remote.Deleted},
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, r.command[0], r.command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Entry{}, fmt.Errorf("conflict command: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var res execEntry
+	if err := json.Unmarshal(out, &res); err != nil {
+		return Entry{}, fmt.Errorf("conflict command: invalid output: %w", err)
+	}
+	ts := c.Local.Timestamp
+	if c.Remote.Timestamp > ts {
+		ts = c.Remote.Timestamp
+	}
+	e := Entry{
+		Value:     res.Value,
+		Timestamp: ts,
+		Deleted:   res.Deleted,
+	}
+	if e.Deleted {
+		e.Value = nil
+	}
+	return e, nil
+}
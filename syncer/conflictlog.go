@@ -0,0 +1,32 @@
+package syncer
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/syncer/conflict"
+)
+
+// conflictLogger returns an OnConflict function for a NativeIterator that
+// writes the conflicts to the conflict log. Only the first write error is
+// logged, because the same error is likely for every conflict.
+func (s *Syncer) conflictLogger(l logrus.FieldLogger, strategy string) func(c conflict.Conflict, winner string) {
+	failed := false
+	return func(c conflict.Conflict, winner string) {
+		err := s.opt.ConflictLog.Write(conflict.AuditRecord{
+			Time:           time.Now().UTC(),
+			LMDB:           s.name,
+			DBI:            c.DBI,
+			Key:            c.Key,
+			RemoteInstance: c.RemoteInstance,
+			Strategy:       strategy,
+			Winner:         winner,
+			Local:          conflict.NewAuditEntry(c.Local),
+			Remote:         conflict.NewAuditEntry(c.Remote),
+		})
+		if err != nil && !failed {
+			failed = true
+			l.WithError(err).Error("Failed to write the conflict log")
+		}
+	}
+}
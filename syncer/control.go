@@ -0,0 +1,112 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// flushPollInterval is the interval at which Flush checks if the changes
+// were stored
+const flushPollInterval = 50 * time.Millisecond
+
+// TriggerSync makes the sync loop check for local changes and ready remote
+// snapshots right away, instead of after the lmdb_poll_interval, and starts
+// a new storage listing.
+func (s *Syncer) TriggerSync() {
+	s.mu.Lock()
+	r := s.receiver
+	s.mu.Unlock()
+	if r != nil {
+		r.Trigger()
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ForceSnapshot makes the sync loop store a full snapshot as soon as possible,
+// even if there were no local changes and delta snapshots are enabled.
+// If sending is paused, the snapshot is stored once it is resumed.
+func (s *Syncer) ForceSnapshot() {
+	s.forceFull.Store(true)
+	s.TriggerSync()
+}
+
+// Flush stores a snapshot of the local changes made before the call, if any,
+// and waits until it is stored or the context is done. This returns an error
+// if sending is paused, because the changes would not be stored.
+func (s *Syncer) Flush(ctx context.Context) error {
+	if s.opt.ReceiveOnly {
+		return nil
+	}
+	if s.pausedSend.Load() {
+		return fmt.Errorf("%s: sending is paused", s.name)
+	}
+	info, err := s.Env().Info()
+	if err != nil {
+		return err
+	}
+	target := uint64(info.LastTxnID)
+	for {
+		cur := s.flushTxnID.Load()
+		if cur >= target || s.flushTxnID.CompareAndSwap(cur, target) {
+			break
+		}
+	}
+	s.TriggerSync()
+	for s.syncedTxnID.Load() < target {
+		if err := utils.SleepContext(ctx, flushPollInterval); err != nil {
+			return fmt.Errorf("%s: local changes not stored: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+// Pause stops storing new snapshots if send is true, and stops loading remote
+// snapshots if receive is true, until Resume is called. Local changes are
+// not lost while sending is paused, they are included in the first snapshot
+// after Resume.
+func (s *Syncer) Pause(send, receive bool) {
+	if send {
+		s.pausedSend.Store(true)
+	}
+	if receive {
+		s.pausedReceive.Store(true)
+	}
+	s.l.WithField("send", send).WithField("receive", receive).Info("Paused syncing")
+}
+
+// Resume reverts a Pause for the selected directions
+func (s *Syncer) Resume(send, receive bool) {
+	if send {
+		s.pausedSend.Store(false)
+	}
+	if receive {
+		s.pausedReceive.Store(false)
+	}
+	s.l.WithField("send", send).WithField("receive", receive).Info("Resumed syncing")
+	s.TriggerSync()
+}
+
+// Paused returns which sync directions are currently paused
+func (s *Syncer) Paused() (send, receive bool) {
+	return s.pausedSend.Load(), s.pausedReceive.Load()
+}
+
+// sleep waits for the duration, or until TriggerSync is called
+func (s *Syncer) sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	case <-s.wake:
+		return nil
+	}
+}
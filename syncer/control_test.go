@@ -0,0 +1,95 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_control(t *testing.T) {
+	st := memory.New()
+	envA, tmpA, err := createLMDB(t)
+	require.NoError(t, err)
+	c := createConfig("a", tmpA, false)
+	c.LMDBPollInterval = time.Hour // only TriggerSync wakes the sync loop
+	syncerA, err := New(testLMDBName, envA, st, c, c.LMDBs[testLMDBName], Options{})
+	require.NoError(t, err)
+	syncerB, envB := createInstance(t, "b", st, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	setKey(t, envA, "foo", "v1", false)
+	goRunSync(ctx, syncerA)
+	requireSnapshotsLenWait(t, st, 1, "a")
+
+	setKey(t, envA, "foo", "v2", false)
+	syncerA.TriggerSync()
+	requireSnapshotsLenWait(t, st, 2, "a")
+
+	// No snapshots while sending is paused, not even forced ones
+	syncerA.Pause(true, false)
+	send, receive := syncerA.Paused()
+	assert.True(t, send)
+	assert.False(t, receive)
+	assert.EqualError(t, syncerA.checkPaused(), "sync paused: upload")
+	setKey(t, envA, "foo", "v3", false)
+	syncerA.ForceSnapshot()
+	time.Sleep(10 * tick)
+	requireSnapshotsLenWait(t, st, 2, "a")
+
+	// The changes are sent after resuming
+	syncerA.Resume(true, false)
+	requireSnapshotsLenWait(t, st, 3, "a")
+	assert.NoError(t, syncerA.checkPaused())
+
+	// Forced snapshot without local changes
+	syncerA.ForceSnapshot()
+	requireSnapshotsLenWait(t, st, 4, "a")
+
+	// Nothing is loaded while receiving is paused
+	syncerB.Pause(false, true)
+	goRunSync(ctx, syncerB)
+	time.Sleep(10 * tick)
+	_, err = dumpData(envB, false)
+	assert.True(t, lmdb.IsNotFound(err), "DBI should not exist yet")
+
+	syncerB.Resume(true, true)
+	assertKeyWait(t, envB, "foo", "v3", false)
+}
+
+func TestSyncer_Flush(t *testing.T) {
+	st := memory.New()
+	envA, tmpA, err := createLMDB(t)
+	require.NoError(t, err)
+	c := createConfig("a", tmpA, false)
+	c.LMDBPollInterval = time.Hour // only TriggerSync wakes the sync loop
+	syncerA, err := New(testLMDBName, envA, st, c, c.LMDBs[testLMDBName], Options{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	setKey(t, envA, "foo", "v1", false)
+	goRunSync(ctx, syncerA)
+	requireSnapshotsLenWait(t, st, 1, "a")
+
+	// Flush stores the changes right away and waits for it
+	setKey(t, envA, "foo", "v2", false)
+	require.NoError(t, syncerA.Flush(ctx))
+	require.Len(t, listInstanceSnapshots(st, "a"), 2)
+
+	// Nothing to store
+	require.NoError(t, syncerA.Flush(ctx))
+	require.Len(t, listInstanceSnapshots(st, "a"), 2)
+
+	// Changes cannot be stored while sending is paused
+	syncerA.Pause(true, false)
+	setKey(t, envA, "foo", "v3", false)
+	assert.Error(t, syncerA.Flush(ctx))
+}
@@ -0,0 +1,188 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/status/webhook"
+	"powerdns.com/platform/lightningstream/syncer/digest"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// convergenceState tracks the DBIs for which the instances have different
+// data. Only used by the convergence check.
+type convergenceState struct {
+	// since is the first check that found different data per DBI
+	since map[string]time.Time
+
+	// reported are the DBIs that were reported as not converged
+	reported map[string]bool
+}
+
+// runConvergenceChecks periodically writes our digest and compares it with
+// those of the other instances until the context is cancelled.
+func (s *Syncer) runConvergenceChecks(ctx context.Context, env *lmdb.Env) error {
+	// Differences are expected until we have loaded the remote snapshots
+	select {
+	case <-s.CaughtUp():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for {
+		if err := s.ConvergenceCheckOnce(ctx, env, time.Now()); err != nil {
+			if utils.IsCanceled(ctx) {
+				return ctx.Err()
+			}
+			metricConvergenceChecksFailed.WithLabelValues(s.name).Inc()
+			s.l.WithError(err).Warn("Convergence check failed")
+		}
+		if err := utils.SleepContextPerturb(ctx, s.c.Storage.Convergence.Interval); err != nil {
+			return err
+		}
+	}
+}
+
+// ConvergenceCheckOnce hashes the contents of the synced DBIs and writes
+// them as our digest, unless in receive-only mode. It then compares them
+// with the recent digests of the other instances, and reports the DBIs that
+// have had different data for longer than the window. The digests of
+// instances that have been gone for RemoveAfter are removed if we are the
+// leader.
+func (s *Syncer) ConvergenceCheckOnce(ctx context.Context, env *lmdb.Env, now time.Time) error {
+	conf := s.c.Storage.Convergence
+	h := digest.NewHasher()
+	err := env.View(func(txn *lmdb.Txn) error {
+		_, err := Export(txn, s.lc, true, h)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("hash dbis: %w", err)
+	}
+	own := digest.Digest{
+		Instance: s.instanceID(),
+		Time:     now,
+		DBIs:     make(map[string]string),
+	}
+	for dbiName, sum := range h.Sums() {
+		if conf.IsDBIIncluded(dbiName) {
+			own.DBIs[dbiName] = sum
+		}
+	}
+	if !s.opt.ReceiveOnly {
+		if err := digest.Store(ctx, s.st, s.name, own); err != nil {
+			return fmt.Errorf("store digest: %w", err)
+		}
+	}
+
+	statuses, err := digest.List(ctx, s.st, s.name)
+	if err != nil {
+		return fmt.Errorf("list digests: %w", err)
+	}
+	digests := []digest.Digest{own}
+	for _, ds := range statuses {
+		if ds.Instance == own.Instance {
+			continue
+		}
+		age := now.Sub(ds.Time)
+		if conf.RemoveAfter > 0 && age > conf.RemoveAfter && s.isLeader() {
+			if err := s.st.Delete(ctx, ds.Name); err != nil {
+				return fmt.Errorf("delete digest %s: %w", ds.Name, err)
+			}
+			s.l.WithField("digest_instance", ds.Instance).Info("Removed digest of gone instance")
+			continue
+		}
+		if age > conf.StaleAfter {
+			continue
+		}
+		d := ds.Digest
+		d.DBIs = make(map[string]string)
+		for dbiName, sum := range ds.DBIs {
+			if conf.IsDBIIncluded(dbiName) {
+				d.DBIs[dbiName] = sum
+			}
+		}
+		digests = append(digests, d)
+	}
+	metricClusterDigests.WithLabelValues(s.name).Set(float64(len(digests)))
+	s.updateConvergence(digest.Compare(digests), now)
+	return nil
+}
+
+// updateConvergence updates the convergence state, metrics and webhooks
+// with the results of a comparison
+func (s *Syncer) updateConvergence(results map[string]digest.Result, now time.Time) {
+	cs := &s.convergence
+	if cs.since == nil {
+		cs.since = make(map[string]time.Time)
+		cs.reported = make(map[string]bool)
+	}
+	window := s.c.Storage.Convergence.Window
+
+	var dbiNames []string
+	for dbiName := range results {
+		dbiNames = append(dbiNames, dbiName)
+	}
+	sort.Strings(dbiNames)
+
+	metricClusterDBIConverged.DeletePartialMatch(prometheus.Labels{"lmdb": s.name})
+	metricClusterDBIDivergence.DeletePartialMatch(prometheus.Labels{"lmdb": s.name})
+	for _, dbiName := range dbiNames {
+		res := results[dbiName]
+		l := s.l.WithField("dbi", dbiName)
+		if res.Converged {
+			if cs.reported[dbiName] {
+				l.WithField("diverged_for", now.Sub(cs.since[dbiName]).Round(time.Second)).
+					Info("Instances converged again")
+				webhook.Notify(webhook.Event{
+					Event: webhook.EventConverged,
+					LMDB:  s.name,
+					DBI:   dbiName,
+				})
+			}
+			delete(cs.since, dbiName)
+			delete(cs.reported, dbiName)
+			metricClusterDBIConverged.WithLabelValues(s.name, dbiName).Set(1)
+			metricClusterDBIDivergence.WithLabelValues(s.name, dbiName).Set(0)
+			continue
+		}
+
+		since, exists := cs.since[dbiName]
+		if !exists {
+			since = now
+			cs.since[dbiName] = now
+		}
+		d := now.Sub(since)
+		metricClusterDBIDivergence.WithLabelValues(s.name, dbiName).Set(d.Seconds())
+		if d < window {
+			metricClusterDBIConverged.WithLabelValues(s.name, dbiName).Set(1)
+			continue
+		}
+		metricClusterDBIConverged.WithLabelValues(s.name, dbiName).Set(0)
+		if !cs.reported[dbiName] {
+			cs.reported[dbiName] = true
+			l.WithFields(logrus.Fields{
+				"diverged_for": d.Round(time.Second),
+				"instances":    res.Differing,
+			}).Warn("Instances did not converge within the window")
+			webhook.Notify(webhook.Event{
+				Event:     webhook.EventDiverged,
+				LMDB:      s.name,
+				DBI:       dbiName,
+				Instances: res.Differing,
+			})
+		}
+	}
+
+	// DBIs that no longer exist
+	for dbiName := range cs.since {
+		if _, exists := results[dbiName]; !exists {
+			delete(cs.since, dbiName)
+			delete(cs.reported, dbiName)
+		}
+	}
+}
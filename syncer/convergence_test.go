@@ -0,0 +1,75 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/syncer/digest"
+)
+
+func TestSyncer_ConvergenceCheckOnce(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	syncerA, envA := createInstance(t, "a", st, true)
+	syncerB, envB := createInstance(t, "b", st, true)
+	conf := config.Convergence{
+		Enabled:     true,
+		Interval:    time.Minute,
+		Window:      10 * time.Minute,
+		StaleAfter:  5 * time.Minute,
+		RemoveAfter: time.Hour,
+	}
+	syncerA.c.Storage.Convergence = conf
+	syncerB.c.Storage.Convergence = conf
+	converged := func() float64 {
+		return testutil.ToFloat64(metricClusterDBIConverged.WithLabelValues(syncerA.name, testDBIName))
+	}
+
+	// Same data with different timestamps
+	setKey(t, envA, "foo", "v1", true)
+	setKey(t, envB, "foo", "v1", true)
+	now := time.Now()
+	require.NoError(t, syncerB.ConvergenceCheckOnce(ctx, envB, now))
+	require.NoError(t, syncerA.ConvergenceCheckOnce(ctx, envA, now))
+	assert.Equal(t, 1.0, converged())
+	assert.Equal(t, 2.0, testutil.ToFloat64(metricClusterDigests.WithLabelValues(syncerA.name)))
+	assert.Empty(t, syncerA.convergence.since)
+
+	// Different data within the window
+	setKey(t, envB, "bar", "v1", true)
+	require.NoError(t, syncerB.ConvergenceCheckOnce(ctx, envB, now))
+	require.NoError(t, syncerA.ConvergenceCheckOnce(ctx, envA, now))
+	assert.Equal(t, 1.0, converged())
+	assert.Equal(t, now, syncerA.convergence.since[testDBIName])
+
+	// Not converged within the window
+	later := now.Add(11 * time.Minute)
+	require.NoError(t, syncerB.ConvergenceCheckOnce(ctx, envB, later))
+	require.NoError(t, syncerA.ConvergenceCheckOnce(ctx, envA, later))
+	assert.Equal(t, 0.0, converged())
+	assert.Equal(t, (11 * time.Minute).Seconds(),
+		testutil.ToFloat64(metricClusterDBIDivergence.WithLabelValues(syncerA.name, testDBIName)))
+	assert.True(t, syncerA.convergence.reported[testDBIName])
+
+	// Converged again
+	setKey(t, envA, "bar", "v1", true)
+	require.NoError(t, syncerA.ConvergenceCheckOnce(ctx, envA, later))
+	assert.Equal(t, 1.0, converged())
+	assert.Empty(t, syncerA.convergence.reported)
+
+	// The digest of b is stale and ignored, and then removed
+	setKey(t, envA, "bar", "v2", true)
+	require.NoError(t, syncerA.ConvergenceCheckOnce(ctx, envA, later.Add(6*time.Minute)))
+	assert.Equal(t, 1.0, converged())
+	assert.Equal(t, 1.0, testutil.ToFloat64(metricClusterDigests.WithLabelValues(syncerA.name)))
+	require.NoError(t, syncerA.ConvergenceCheckOnce(ctx, envA, later.Add(2*time.Hour)))
+	ls, err := st.List(ctx, digest.Prefix(testLMDBName))
+	require.NoError(t, err)
+	assert.Equal(t, []string{digest.Name(testLMDBName, "a")}, ls.Names())
+}
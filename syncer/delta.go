@@ -0,0 +1,70 @@
+package syncer
+
+import (
+	"time"
+
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+// deltaBase describes the full snapshot a delta snapshot is based on
+type deltaBase struct {
+	Time      time.Time        // snapshot time, used in the delta name
+	Timestamp header.Timestamp // snapshot timestamp
+	TxnID     header.TxnID     // last LMDB transaction included in the snapshot
+}
+
+// includes returns true if an entry with this header has changed since
+// the base snapshot and must be included in a delta snapshot.
+// Entries merged from remote snapshots can have an older timestamp, but
+// these are always written with a new local TxnID.
+func (b *deltaBase) includes(h header.Header) bool {
+	return h.TxnID > b.TxnID || h.Timestamp > b.Timestamp
+}
+
+// deltaState tracks the delta snapshots written since the last full snapshot
+type deltaState struct {
+	base          *deltaBase // nil if no full snapshot written yet
+	fullSize      int        // size of the last full snapshot
+	nDeltas       int        // number of deltas written since
+	lastDeltaSize int        // size of the last delta
+	forceFull     bool       // full snapshot requested with ForceSnapshot
+}
+
+// nextDeltaBase returns the base to use for the next snapshot, or nil if the
+// next snapshot must be a full one.
+func (s *Syncer) nextDeltaBase(now time.Time) *deltaBase {
+	conf := s.c.Storage.DeltaSnapshots
+	ds := &s.delta
+	switch {
+	case !conf.Enabled || ds.base == nil:
+		return nil
+	case ds.forceFull:
+		return nil
+	case s.lc.DupSortHack:
+		// The dupsort hack stores all values of a key as a single entry in
+		// the snapshot, which does not combine with partial updates.
+		return nil
+	case now.Sub(ds.base.Time) >= conf.FullInterval:
+		return nil
+	case ds.nDeltas >= conf.MaxDeltas:
+		return nil
+	case float64(ds.lastDeltaSize) > conf.MaxSizeRatio*float64(ds.fullSize):
+		return nil
+	}
+	return ds.base
+}
+
+// updateDeltaState records a successfully stored snapshot. For a full
+// snapshot, base is the new base for future deltas.
+func (s *Syncer) updateDeltaState(isDelta bool, base *deltaBase, size int) {
+	ds := &s.delta
+	if isDelta {
+		ds.nDeltas++
+		ds.lastDeltaSize = size
+		return
+	}
+	*ds = deltaState{
+		base:     base,
+		fullSize: size,
+	}
+}
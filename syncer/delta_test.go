@@ -0,0 +1,51 @@
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+func TestDeltaBase_includes(t *testing.T) {
+	b := &deltaBase{Timestamp: 100, TxnID: 10}
+	assert.False(t, b.includes(header.Header{Timestamp: 100, TxnID: 10}))
+	assert.False(t, b.includes(header.Header{Timestamp: 50, TxnID: 5}))
+	assert.True(t, b.includes(header.Header{Timestamp: 101, TxnID: 10}))
+	// Merged from an older remote snapshot after the base was written
+	assert.True(t, b.includes(header.Header{Timestamp: 50, TxnID: 11}))
+}
+
+func TestSyncer_nextDeltaBase(t *testing.T) {
+	c := config.Default()
+	c.Storage.DeltaSnapshots.Enabled = true
+	c.Storage.DeltaSnapshots.MaxDeltas = 2
+	s := &Syncer{c: c}
+
+	now := time.Now()
+	assert.Nil(t, s.nextDeltaBase(now), "no full snapshot yet")
+
+	base := &deltaBase{Time: now, Timestamp: header.TimestampFromTime(now), TxnID: 1}
+	s.updateDeltaState(false, base, 1000)
+	assert.Equal(t, base, s.nextDeltaBase(now))
+	assert.Nil(t, s.nextDeltaBase(now.Add(time.Hour)), "full_interval passed")
+
+	s.updateDeltaState(true, nil, 600)
+	assert.Nil(t, s.nextDeltaBase(now), "max_size_ratio exceeded")
+
+	s.updateDeltaState(false, base, 1000)
+	s.updateDeltaState(true, nil, 100)
+	assert.Equal(t, base, s.nextDeltaBase(now))
+	s.updateDeltaState(true, nil, 100)
+	assert.Nil(t, s.nextDeltaBase(now), "max_deltas reached")
+
+	s.lc.DupSortHack = true
+	s.updateDeltaState(false, base, 1000)
+	assert.Nil(t, s.nextDeltaBase(now), "not supported with dupsort_hack")
+
+	s.c.Storage.DeltaSnapshots.Enabled = false
+	s.lc.DupSortHack = false
+	assert.Nil(t, s.nextDeltaBase(now), "disabled")
+}
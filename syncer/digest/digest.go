@@ -0,0 +1,197 @@
+// Package digest implements the convergence check between instances. Every
+// instance periodically writes a small digest object per LMDB with a content
+// hash of every synced DBI, which allows any instance to check that all
+// instances ended up with the same data.
+package digest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+)
+
+// Digest is the content of a digest object
+type Digest struct {
+	Instance string    `json:"instance"`
+	Time     time.Time `json:"time"` // time the hashes were computed
+
+	// DBIs has the hex encoded content hash by DBI name
+	DBIs map[string]string `json:"dbis"`
+}
+
+// Status is a Digest as listed from the storage backend
+type Status struct {
+	Digest
+
+	// Name is the name of the digest object
+	Name string `json:"name"`
+}
+
+// Prefix returns the name prefix of the digest objects of an LMDB. It does
+// not match the snapshot name prefix of the LMDB.
+func Prefix(lmdbName string) string {
+	return lmdbName + ".digest__"
+}
+
+// Name returns the name of the digest object of an instance
+func Name(lmdbName, instance string) string {
+	return Prefix(lmdbName) + instance + ".json"
+}
+
+// Store writes the digest of an instance
+func Store(ctx context.Context, st simpleblob.Interface, lmdbName string, d Digest) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return st.Store(ctx, Name(lmdbName, d.Instance), data)
+}
+
+// List loads the digests of all instances, ordered by instance. Invalid
+// digest objects are skipped.
+func List(ctx context.Context, st simpleblob.Interface, lmdbName string) ([]Status, error) {
+	prefix := Prefix(lmdbName)
+	ls, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var res []Status
+	for _, name := range ls.Names() {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := st.Load(ctx, name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // removed since the listing
+			}
+			return nil, err
+		}
+		var d Digest
+		if err := json.Unmarshal(data, &d); err != nil || d.Instance == "" {
+			continue
+		}
+		res = append(res, Status{Digest: d, Name: name})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Instance < res[j].Instance
+	})
+	return res, nil
+}
+
+// Hasher computes the content hashes of DBIs from their entries in key
+// order. It implements the syncer.Exporter interface, so that the hashes
+// only depend on the keys and values of the application, and not on the
+// timestamps or the shadow DBIs.
+type Hasher struct {
+	sums map[string]string
+	cur  string
+	h    hash.Hash
+	buf  [4]byte
+}
+
+// NewHasher returns a new Hasher
+func NewHasher() *Hasher {
+	return &Hasher{sums: make(map[string]string)}
+}
+
+// StartDBI starts hashing the entries of a DBI
+func (h *Hasher) StartDBI(name string, flags uint) error {
+	h.finish()
+	h.cur = name
+	h.h = sha256.New()
+	return nil
+}
+
+// Put adds an entry to the hash of the current DBI
+func (h *Hasher) Put(key, val []byte) error {
+	h.write(key)
+	h.write(val)
+	return nil
+}
+
+// Sums returns the hex encoded hashes by DBI name
+func (h *Hasher) Sums() map[string]string {
+	h.finish()
+	return h.sums
+}
+
+// write adds a length prefixed key or value to the hash
+func (h *Hasher) write(b []byte) {
+	binary.BigEndian.PutUint32(h.buf[:], uint32(len(b)))
+	h.h.Write(h.buf[:])
+	h.h.Write(b)
+}
+
+func (h *Hasher) finish() {
+	if h.h == nil {
+		return
+	}
+	h.sums[h.cur] = hex.EncodeToString(h.h.Sum(nil))
+	h.h = nil
+}
+
+// Result is the result of comparing the digests of a single DBI
+type Result struct {
+	// Converged is true if all instances have the same hash
+	Converged bool
+
+	// Differing are the instances that do not have the hash of the
+	// largest group of instances with the same hash. Instances without the
+	// DBI are included.
+	Differing []string
+}
+
+// Compare compares the digests of the instances per DBI. The DBIs of all
+// digests are included.
+func Compare(digests []Digest) map[string]Result {
+	dbis := make(map[string]bool)
+	for _, d := range digests {
+		for name := range d.DBIs {
+			dbis[name] = true
+		}
+	}
+	res := make(map[string]Result, len(dbis))
+	for name := range dbis {
+		byHash := make(map[string][]string)
+		for _, d := range digests {
+			sum := d.DBIs[name] // empty if missing
+			byHash[sum] = append(byHash[sum], d.Instance)
+		}
+		if len(byHash) == 1 {
+			res[name] = Result{Converged: true}
+			continue
+		}
+		// The largest group is considered correct, with ties broken by
+		// the hash for a stable result
+		best := ""
+		for sum, instances := range byHash {
+			if sum == "" {
+				continue
+			}
+			n, bestN := len(instances), len(byHash[best])
+			if best == "" || n > bestN || (n == bestN && sum < best) {
+				best = sum
+			}
+		}
+		var differing []string
+		for sum, instances := range byHash {
+			if sum != best {
+				differing = append(differing, instances...)
+			}
+		}
+		sort.Strings(differing)
+		res[name] = Result{Differing: differing}
+	}
+	return res
+}
@@ -0,0 +1,66 @@
+package digest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreList(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, Store(ctx, st, "main", Digest{Instance: "b", Time: now, DBIs: map[string]string{"foo": "01"}}))
+	require.NoError(t, Store(ctx, st, "main", Digest{Instance: "a", Time: now}))
+	require.NoError(t, Store(ctx, st, "other", Digest{Instance: "c", Time: now}))
+	require.NoError(t, st.Store(ctx, Prefix("main")+"invalid.json", []byte("{")))
+
+	res, err := List(ctx, st, "main")
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	assert.Equal(t, "a", res[0].Instance)
+	assert.Equal(t, Name("main", "a"), res[0].Name)
+	assert.Equal(t, "b", res[1].Instance)
+	assert.Equal(t, map[string]string{"foo": "01"}, res[1].DBIs)
+	assert.True(t, now.Equal(res[1].Time))
+}
+
+func TestHasher(t *testing.T) {
+	sums := func(entries ...string) map[string]string {
+		h := NewHasher()
+		require.NoError(t, h.StartDBI("foo", 0))
+		for i := 0; i+1 < len(entries); i += 2 {
+			require.NoError(t, h.Put([]byte(entries[i]), []byte(entries[i+1])))
+		}
+		require.NoError(t, h.StartDBI("empty", 0))
+		return h.Sums()
+	}
+	a := sums("a", "1", "b", "2")
+	require.Len(t, a, 2)
+	assert.Len(t, a["foo"], 64)
+	assert.Equal(t, a, sums("a", "1", "b", "2"))
+	assert.NotEqual(t, a["foo"], sums("a", "1", "b", "3")["foo"])
+	assert.NotEqual(t, a["foo"], sums("a1", "", "b", "2")["foo"]) // length prefixed
+	assert.NotEqual(t, a["foo"], sums()["foo"])
+	assert.Equal(t, a["empty"], sums()["empty"])
+}
+
+func TestCompare(t *testing.T) {
+	res := Compare([]Digest{
+		{Instance: "a", DBIs: map[string]string{"foo": "1", "bar": "1", "baz": "1"}},
+		{Instance: "b", DBIs: map[string]string{"foo": "1", "bar": "2", "baz": "2"}},
+		{Instance: "c", DBIs: map[string]string{"foo": "1", "bar": "1"}},
+	})
+	assert.Equal(t, map[string]Result{
+		"foo": {Converged: true},
+		"bar": {Differing: []string{"b"}},
+		// Ties are broken by the hash, missing DBIs always differ
+		"baz": {Differing: []string{"b", "c"}},
+	}, res)
+
+	assert.Empty(t, Compare(nil))
+}
@@ -0,0 +1,120 @@
+package syncer
+
+import (
+	"bytes"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/lmdbenv/strategy"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// DryRunMaxKeys is the maximum number of changed keys that are logged per DBI
+// for a remote snapshot in dry-run mode.
+const DryRunMaxKeys = 100
+
+// update runs a write transaction. In dry-run mode, the transaction is
+// aborted after fn returned, so that the LMDB is never modified.
+func (s *Syncer) update(env *lmdb.Env, fn lmdb.TxnOp) error {
+	if !s.opt.DryRun {
+		return env.Update(fn)
+	}
+	err := env.Update(func(txn *lmdb.Txn) error {
+		if err := fn(txn); err != nil {
+			return err
+		}
+		return errAbortTxn
+	})
+	if err == errAbortTxn {
+		return nil
+	}
+	return err
+}
+
+// changeRecorder wraps an Iterator to record the keys for which the merged
+// value differs from the current value in the LMDB.
+type changeRecorder struct {
+	strategy.Iterator
+	key     []byte
+	changed int
+	keys    []string // first DryRunMaxKeys changed keys
+
+	// verify has the merged values of the keys changed by earlier remote
+	// snapshots in verify-only mode. These are merged with instead of the
+	// LMDB values, because the transactions of the earlier merges were
+	// aborted.
+	verify map[string]*verifyEntry
+}
+
+func (r *changeRecorder) Next() ([]byte, error) {
+	key, err := r.Iterator.Next()
+	r.key = key
+	return key, err
+}
+
+func (r *changeRecorder) Merge(oldval []byte) ([]byte, error) {
+	var prev *verifyEntry
+	if r.verify != nil {
+		if prev = r.verify[string(r.key)]; prev != nil {
+			oldval = prev.merged
+		}
+	}
+	val, err := r.Iterator.Merge(oldval)
+	if err == nil && !bytes.Equal(val, oldval) {
+		r.changed++
+		if len(r.keys) < DryRunMaxKeys {
+			r.keys = append(r.keys, utils.DisplayASCII(r.key))
+		}
+		if r.verify != nil {
+			if prev == nil {
+				prev = &verifyEntry{local: copyBytes(oldval)}
+				r.verify[string(r.key)] = prev
+			}
+			prev.merged = copyBytes(val)
+		}
+	}
+	return val, err
+}
+
+// verifyEntry is the local and the merged value of a key in verify-only mode
+type verifyEntry struct {
+	local  []byte
+	merged []byte
+}
+
+// differs returns true if the merged data differs from the local data
+func (e *verifyEntry) differs() bool {
+	return !sameData(e.local, e.merged)
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// sameData returns true if two values with headers have the same application
+// value regardless of their timestamps, or are both deleted or absent. This
+// is used by verify-only mode, which compares the data.
+func sameData(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	appValue := func(val []byte) (app []byte, deleted bool, ok bool) {
+		if val == nil {
+			return nil, true, true
+		}
+		h, app, err := header.Parse(val)
+		if err != nil {
+			return nil, false, false
+		}
+		return app, h.Flags.IsDeleted(), true
+	}
+	appA, deletedA, okA := appValue(a)
+	appB, deletedB, okB := appValue(b)
+	if !okA || !okB || deletedA != deletedB {
+		return false
+	}
+	return deletedA || bytes.Equal(appA, appB)
+}
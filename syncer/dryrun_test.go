@@ -0,0 +1,118 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+func TestSyncer_dryRun(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		t.Run(fmt.Sprintf("withHeader=%v", withHeader), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			st := memory.New()
+			syncerA, envA := createInstance(t, "a", st, withHeader)
+			syncerB, envB := createInstance(t, "b", st, withHeader)
+			syncerB.opt.DryRun = true
+			syncerB.c.OnlyOnce = true
+			l, hook := test.NewNullLogger()
+			syncerB.l = l
+
+			setKey(t, envA, "foo", "a", withHeader)
+			_, err := syncerA.SendOnce(ctx, envA)
+			require.NoError(t, err)
+			setKey(t, envB, "bar", "b", withHeader)
+			before, err := envB.Info()
+			require.NoError(t, err)
+
+			require.NoError(t, syncerB.Sync(ctx))
+
+			// Nothing changed or stored
+			data, err := dumpData(envB, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"bar": "b"}, data)
+			after, err := envB.Info()
+			require.NoError(t, err)
+			assert.Equal(t, before.LastTxnID, after.LastTxnID)
+			assert.Empty(t, listInstanceSnapshots(st, "b"))
+
+			// But logged
+			var messages []string
+			var changed []string
+			for _, e := range hook.AllEntries() {
+				messages = append(messages, e.Message)
+				if e.Message == "Dry run: keys would change" && e.Level == logrus.InfoLevel {
+					changed = append(changed, e.Data["keys"].([]string)...)
+				}
+			}
+			assert.Contains(t, messages, "Dry run: remote snapshot would be loaded")
+			assert.Contains(t, messages, "Dry run: snapshot would be stored")
+			assert.Equal(t, []string{utils.DisplayASCII([]byte("foo"))}, changed)
+		})
+	}
+}
+
+func TestSyncer_verifyOnly(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		t.Run(fmt.Sprintf("withHeader=%v", withHeader), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			st := memory.New()
+			syncerA, envA := createInstance(t, "a", st, withHeader)
+			syncerB, envB := createInstance(t, "b", st, withHeader)
+			syncerC, envC := createInstance(t, "c", st, withHeader)
+			syncerB.opt.VerifyOnly = true
+			syncerB.opt.DryRun = true
+			syncerB.opt.ReceiveOnly = true
+			syncerB.c.OnlyOnce = true
+			l, hook := test.NewNullLogger()
+			syncerB.l = l
+
+			setKey(t, envA, "foo", "a", withHeader)
+			_, err := syncerA.SendOnce(ctx, envA)
+			require.NoError(t, err)
+			setKey(t, envC, "foo", "c", withHeader)
+			_, err = syncerC.SendOnce(ctx, envC)
+			require.NoError(t, err)
+			setKey(t, envB, "bar", "b", withHeader)
+			before, err := envB.Info()
+			require.NoError(t, err)
+
+			// Both snapshots change the same key, which is reported once
+			assert.ErrorIs(t, syncerB.Sync(ctx), ErrVerifyDifferences)
+			var changed []string
+			for _, e := range hook.AllEntries() {
+				if e.Message == "Verify: keys differ from the merged remote snapshots" {
+					assert.Equal(t, 1, e.Data["changed"])
+					changed = append(changed, e.Data["keys"].([]string)...)
+				}
+			}
+			assert.Equal(t, []string{utils.DisplayASCII([]byte("foo"))}, changed)
+
+			// Nothing changed or stored
+			data, err := dumpData(envB, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"bar": "b"}, data)
+			after, err := envB.Info()
+			require.NoError(t, err)
+			assert.Equal(t, before.LastTxnID, after.LastTxnID)
+			assert.Empty(t, listInstanceSnapshots(st, "b"))
+
+			// Only the data is compared, not the timestamps, and local keys
+			// that are not in the snapshots are not a difference
+			setKey(t, envB, "foo", "c", withHeader)
+			hook.Reset()
+			require.NoError(t, syncerB.Sync(ctx))
+			assert.Equal(t, "Verify: the LMDB matches the merged remote snapshots", hook.LastEntry().Message)
+		})
+	}
+}
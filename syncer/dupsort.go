@@ -0,0 +1,456 @@
+package syncer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/dbiflags"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// Native dupsort support (dupsort_native option)
+//
+// The shadow DBI of a DupSort DBI is itself a DupSort DBI with the same keys.
+// Every value in the main DBI has a corresponding value in the shadow DBI that
+// holds the original value and the LS header for that specific value:
+//
+//	uint16be(len(value)) + value + header
+//
+// The length prefix allows us to find the original value without parsing the
+// header first. Values that were removed from the main DBI remain present in
+// the shadow DBI with the Deleted flag set, so that their deletion can be
+// synced with a timestamp like any other change.
+//
+// Snapshots contain the original keys and values without any mangling, with
+// one entry per value and the same key repeated for all its values. These
+// DBIs have the TransformDupSortNativeV1 transform set.
+
+const (
+	// dupSortShadowOverhead is the number of bytes a shadow value adds to
+	// the original value.
+	dupSortShadowOverhead = 2 + header.MinHeaderSize
+	// DupSortNativeMaxValueSize is the maximum size of a value in a DupSort
+	// DBI with dupsort_native. LMDB limits the size of DupSort values to the
+	// maximum key size.
+	DupSortNativeMaxValueSize = LMDBMaxKeySize - dupSortShadowOverhead
+)
+
+// dupSortShadowValue creates a value for a DupSort shadow DBI
+func dupSortShadowValue(val []byte, ts header.Timestamp, txnID header.TxnID, flags header.Flags) ([]byte, error) {
+	if len(val) > DupSortNativeMaxValueSize {
+		return nil, fmt.Errorf(
+			"value size %d exceeds dupsort_native max size of %d: value %s",
+			len(val), DupSortNativeMaxValueSize, utils.DisplayASCII(val))
+	}
+	b := make([]byte, 2+len(val)+header.MinHeaderSize)
+	binary.BigEndian.PutUint16(b, uint16(len(val)))
+	copy(b[2:], val)
+	header.PutBasic(b[2+len(val):], ts, txnID, flags)
+	return b, nil
+}
+
+// parseDupSortShadowValue does the opposite of dupSortShadowValue
+func parseDupSortShadowValue(b []byte) (val []byte, h header.Header, err error) {
+	if len(b) < dupSortShadowOverhead {
+		return nil, h, header.ErrTooShort
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n+header.MinHeaderSize {
+		return nil, h, fmt.Errorf("dupsort shadow value too short for length %d", n)
+	}
+	h, extra, err := header.Parse(b[2+n:])
+	if err != nil {
+		return nil, h, err
+	}
+	if len(extra) > 0 {
+		return nil, h, fmt.Errorf("dupsort shadow value has trailing data")
+	}
+	return b[2 : 2+n], h, nil
+}
+
+// dupSortShadowEntry is a parsed value in a DupSort shadow DBI
+type dupSortShadowEntry struct {
+	raw []byte // value as stored in the shadow DBI
+	h   header.Header
+}
+
+// readDupSortShadow reads all the values of a key in a DupSort shadow DBI,
+// indexed by their original value.
+func readDupSortShadow(txn *lmdb.Txn, dbi lmdb.DBI, dbiName string, key []byte) (map[string]dupSortShadowEntry, error) {
+	c, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	entries := make(map[string]dupSortShadowEntry)
+	_, v, err := c.Get(key, nil, lmdb.Set)
+	for err == nil {
+		val, h, perr := parseDupSortShadowValue(v)
+		if perr != nil {
+			return nil, ErrEntry{
+				DBIName: dbiName,
+				Key:     key,
+				Err:     perr,
+			}
+		}
+		entries[string(val)] = dupSortShadowEntry{
+			raw: append([]byte(nil), v...),
+			h:   h,
+		}
+		_, v, err = c.Get(nil, nil, lmdb.NextDup)
+	}
+	if !lmdb.IsNotFound(err) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// putDupSortShadow replaces the old shadow value, if any, with a new value
+func putDupSortShadow(
+	txn *lmdb.Txn, dbi lmdb.DBI, key []byte, old *dupSortShadowEntry,
+	val []byte, ts header.Timestamp, txnID header.TxnID, flags header.Flags,
+) (dupSortShadowEntry, error) {
+	raw, err := dupSortShadowValue(val, ts, txnID, flags)
+	if err != nil {
+		return dupSortShadowEntry{}, err
+	}
+	if old != nil {
+		if err := txn.Del(dbi, key, old.raw); err != nil {
+			return dupSortShadowEntry{}, err
+		}
+	}
+	if err := txn.Put(dbi, key, raw, 0); err != nil {
+		return dupSortShadowEntry{}, err
+	}
+	return dupSortShadowEntry{
+		raw: raw,
+		h: header.Header{
+			Timestamp: ts,
+			TxnID:     txnID,
+			Flags:     flags,
+		},
+	}, nil
+}
+
+// dupSortGroups calls f for every run of entries with the same key in dbiMsg.
+// The KVs point into the dbiMsg data.
+func dupSortGroups(dbiMsg *snapshot.DBI, f func(key []byte, kvs []snapshot.KV) error) error {
+	dbiMsg.ResetCursor()
+	var group []snapshot.KV
+	for {
+		kv, err := dbiMsg.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(group) > 0 && !bytes.Equal(group[0].Key, kv.Key) {
+			if err := f(group[0].Key, group); err != nil {
+				return err
+			}
+			group = group[:0]
+		}
+		group = append(group, kv)
+	}
+	if len(group) > 0 {
+		return f(group[0].Key, group)
+	}
+	return nil
+}
+
+// mainToShadowDupSort syncs a DupSort DBI to its DupSort shadow DBI for
+// dupsort_native. The mainMsg must be a raw dump of the main DBI.
+// Values added to the main DBI get the tsNano timestamp, and values that
+// disappeared from it are marked as deleted with that timestamp.
+func mainToShadowDupSort(
+	txn *lmdb.Txn, dbiName, shadowDBIName string, mainMsg *snapshot.DBI, tsNano header.Timestamp,
+) error {
+	mainDBI, err := txn.OpenDBI(dbiName, 0)
+	if err != nil {
+		return err
+	}
+	shadowDBI, err := txn.OpenDBI(shadowDBIName, 0)
+	if err != nil {
+		return err
+	}
+	txnID := header.TxnID(txn.ID())
+
+	// sync sets the shadow values of key to the main values
+	sync := func(key []byte, kvs []snapshot.KV) error {
+		entries, err := readDupSortShadow(txn, shadowDBI, shadowDBIName, key)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			e, exists := entries[string(kv.Value)]
+			delete(entries, string(kv.Value))
+			if exists && !e.h.Flags.IsDeleted() {
+				continue // unchanged, keep the original timestamp
+			}
+			var old *dupSortShadowEntry
+			if exists {
+				old = &e
+			}
+			_, err := putDupSortShadow(txn, shadowDBI, key, old, kv.Value, tsNano, txnID, 0)
+			if err != nil {
+				return fmt.Errorf("key %s: %w", utils.DisplayASCII(key), err)
+			}
+		}
+		// Remaining values were removed from the main DBI
+		for val, e := range entries {
+			if e.h.Flags.IsDeleted() {
+				continue
+			}
+			e := e
+			_, err := putDupSortShadow(txn, shadowDBI, key, &e, []byte(val), tsNano, txnID, header.FlagDeleted)
+			if err != nil {
+				return fmt.Errorf("key %s: %w", utils.DisplayASCII(key), err)
+			}
+		}
+		return nil
+	}
+
+	if err := dupSortGroups(mainMsg, sync); err != nil {
+		return err
+	}
+
+	// Keys that only remain in the shadow DBI had all their values removed
+	var removed [][]byte
+	c, err := txn.OpenCursor(shadowDBI)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var flag uint = lmdb.First
+	for {
+		key, _, err := c.Get(nil, nil, flag)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				break
+			}
+			return err
+		}
+		flag = lmdb.NextNoDup
+		_, err = txn.Get(mainDBI, key)
+		if err == nil {
+			continue
+		}
+		if !lmdb.IsNotFound(err) {
+			return err
+		}
+		removed = append(removed, append([]byte(nil), key...))
+	}
+	for _, key := range removed {
+		if err := sync(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDupSort merges a remote snapshot DBI with the TransformDupSortNativeV1
+// transform into a DupSort shadow DBI. Every value is merged separately:
+// the entry with the latest timestamp wins, and on equal timestamps a
+// deletion wins. It returns the number of entries merged.
+func loadDupSort(txn *lmdb.Txn, shadowDBI lmdb.DBI, shadowDBIName string, dbiMsg *snapshot.DBI) (int, error) {
+	txnID := header.TxnID(txn.ID())
+	var n int
+	err := dupSortGroups(dbiMsg, func(key []byte, kvs []snapshot.KV) error {
+		entries, err := readDupSortShadow(txn, shadowDBI, shadowDBIName, key)
+		if err != nil {
+			return err
+		}
+		n += len(kvs)
+		for _, kv := range kvs {
+			ts := header.Timestamp(kv.TimestampNano)
+			flags := header.Flags(kv.Flags).Masked()
+			e, exists := entries[string(kv.Value)]
+			var old *dupSortShadowEntry
+			if exists {
+				if ts < e.h.Timestamp {
+					continue
+				}
+				if ts == e.h.Timestamp && (e.h.Flags.IsDeleted() || !flags.IsDeleted()) {
+					continue
+				}
+				old = &e
+			}
+			e, err = putDupSortShadow(txn, shadowDBI, key, old, kv.Value, ts, txnID, flags)
+			if err != nil {
+				return fmt.Errorf("key %s: %w", utils.DisplayASCII(key), err)
+			}
+			entries[string(kv.Value)] = e
+		}
+		return nil
+	})
+	return n, err
+}
+
+// dupSortShadowToPlain prepares a dump of a DupSort shadow DBI for insertion
+// into the main DBI by removing the values of deleted entries, which makes
+// the PlainIterator skip them.
+func dupSortShadowToPlain(dbiMsg *snapshot.DBI) (*snapshot.DBI, error) {
+	return dbiMsg.Map("", func(kv snapshot.KV) (snapshot.KV, error) {
+		if header.Flags(kv.Flags).IsDeleted() {
+			kv.Value = nil
+		}
+		return kv, nil
+	})
+}
+
+// dupSortConvert converts a remote DupSort snapshot DBI to the transform
+// used by the local dupsort mode, so that instances can be migrated from
+// the dupsort_hack to dupsort_native one at a time.
+func (s *Syncer) dupSortConvert(dbiMsg *snapshot.DBI) (*snapshot.DBI, error) {
+	transform := dbiMsg.Transform()
+	switch {
+	case s.lc.DupSortNative && transform == snapshot.TransformDupSortHackV1:
+		return dbiMsg.Map(snapshot.TransformDupSortNativeV1, dupSortHackToNativeOne)
+	case s.lc.DupSortHack && transform == snapshot.TransformDupSortNativeV1:
+		return dbiMsg.Map(snapshot.TransformDupSortHackV1, dupSortHackEncodeOne)
+	default:
+		return dbiMsg, nil
+	}
+}
+
+// dupSortHackToNativeOne decodes a dupsort_hack entry for dupsort_native.
+// Deleted entries do not have a value in a dupsort_hack snapshot, so the value
+// is recovered from the key. For long values this can only be a prefix of the
+// original value, in which case the deletion does not match any value.
+func dupSortHackToNativeOne(kv snapshot.KV) (snapshot.KV, error) {
+	result, err := dupSortHackDecodeOne(kv)
+	if err != nil {
+		return result, err
+	}
+	if header.Flags(kv.Flags).IsDeleted() && len(kv.Value) == 0 {
+		result.Value = kv.Key[len(result.Key)+4 : len(kv.Key)-1]
+	}
+	return result, nil
+}
+
+// rebuildMismatchedShadow recreates a shadow DBI if its flags do not match
+// the flags it must be created with. This happens when switching between
+// dupsort_hack and dupsort_native, or for shadow DBIs created by versions
+// that did not transfer MDB_REVERSEKEY.
+// LMDB cannot change the flags of a DBI, so the entries are copied with their
+// headers into a new DBI with the right flags, converted between the
+// dupsort_hack and dupsort_native formats if needed. This keeps the original
+// timestamps and the deleted entries. Only if the entries cannot be converted
+// is the shadow DBI dropped, and the next mainToShadow recreates it from the
+// main DBI with new timestamps.
+func (s *Syncer) rebuildMismatchedShadow(txn *lmdb.Txn, shadowDBIName string, mainDupSort bool, targetFlags uint) error {
+	exists, err := lmdbenv.DBIExists(txn, shadowDBIName)
+	if err != nil || !exists {
+		return err
+	}
+	dbi, err := txn.OpenDBI(shadowDBIName, 0)
+	if err != nil {
+		return err
+	}
+	flags, err := txn.Flags(dbi)
+	if err != nil {
+		return err
+	}
+	const mask = lmdb.DupSort | uint(AllowedShadowDBIFlagsMask)
+	if flags&mask == targetFlags&mask {
+		return nil
+	}
+	l := s.l.WithField("dbi", shadowDBIName).
+		WithField("flags", dbiflags.Flags(flags)).
+		WithField("expected_flags", dbiflags.Flags(targetFlags))
+
+	kvs, err := lmdbenv.ReadDBI(txn, dbi)
+	if err != nil {
+		return err
+	}
+	kvs, convErr := convertShadowEntries(kvs, mainDupSort, flags&lmdb.DupSort > 0, targetFlags&lmdb.DupSort > 0)
+	if err := txn.Drop(dbi, true); err != nil {
+		return err
+	}
+	if convErr != nil {
+		l.WithError(convErr).Warn("Recreating shadow DBI for changed flags from the main DBI")
+		return nil
+	}
+	l.WithField("entries", len(kvs)).Warn("Rebuilding shadow DBI for changed flags")
+	dbi, err = txn.OpenDBI(shadowDBIName, lmdb.Create|targetFlags)
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if err := txn.Put(dbi, kv.Key, kv.Val, 0); err != nil {
+			return fmt.Errorf("rebuild shadow dbi %s: key %s: %w",
+				shadowDBIName, utils.DisplayASCII(kv.Key), err)
+		}
+	}
+	return nil
+}
+
+// convertShadowEntries converts the entries of a shadow DBI of a DupSort DBI
+// between the dupsort_hack and dupsort_native formats. Entries are returned
+// unchanged if the format stays the same.
+func convertShadowEntries(kvs []lmdbenv.KV, mainDupSort, fromNative, toNative bool) ([]lmdbenv.KV, error) {
+	if fromNative == toNative {
+		return kvs, nil
+	}
+	if !mainDupSort {
+		return nil, fmt.Errorf("main DBI is no longer a DupSort DBI")
+	}
+	res := make([]lmdbenv.KV, 0, len(kvs))
+	seen := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		var h header.Header
+		var val []byte
+		var err error
+		if fromNative {
+			val, h, err = parseDupSortShadowValue(kv.Val)
+		} else {
+			h, val, err = header.Parse(kv.Val)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", utils.DisplayASCII(kv.Key), err)
+		}
+		e := snapshot.KV{
+			Key:           kv.Key,
+			Value:         val,
+			TimestampNano: uint64(h.Timestamp),
+			Flags:         uint32(h.Flags),
+		}
+		if toNative {
+			e, err = dupSortHackToNativeOne(e)
+			if err != nil {
+				return nil, err
+			}
+			raw, err := dupSortShadowValue(e.Value, h.Timestamp, h.TxnID, h.Flags)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, lmdbenv.KV{Key: e.Key, Val: raw})
+			continue
+		}
+		e, err = dupSortHackEncodeOne(e)
+		if err != nil {
+			return nil, err
+		}
+		if seen[string(e.Key)] {
+			return nil, fmt.Errorf(
+				"dupsort_hack does not result in unique keys for key %s",
+				utils.DisplayASCII(kv.Key))
+		}
+		seen[string(e.Key)] = true
+		if h.Flags.IsDeleted() {
+			e.Value = nil // deleted values are kept in the key only
+		}
+		raw := make([]byte, header.MinHeaderSize, header.MinHeaderSize+len(e.Value))
+		header.PutBasic(raw, h.Timestamp, h.TxnID, h.Flags)
+		res = append(res, lmdbenv.KV{Key: e.Key, Val: append(raw, e.Value...)})
+	}
+	return res, nil
+}
@@ -0,0 +1,200 @@
+package syncer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func Test_dupSortShadowValue(t *testing.T) {
+	ts := testTS(1)
+	raw, err := dupSortShadowValue(b("val"), ts, 42, header.FlagDeleted)
+	require.NoError(t, err)
+	assert.Equal(t, "\x00\x03val"+h(ts, 42, header.FlagDeleted), string(raw))
+
+	val, hdr, err := parseDupSortShadowValue(raw)
+	require.NoError(t, err)
+	assert.Equal(t, "val", string(val))
+	assert.Equal(t, ts, hdr.Timestamp)
+	assert.Equal(t, header.TxnID(42), hdr.TxnID)
+	assert.True(t, hdr.Flags.IsDeleted())
+
+	_, _, err = parseDupSortShadowValue(raw[:len(raw)-1])
+	assert.Error(t, err)
+	_, err = dupSortShadowValue(make([]byte, DupSortNativeMaxValueSize+1), ts, 42, 0)
+	assert.Error(t, err)
+}
+
+// dumpDupSort returns the key-values of a DBI as "key=value" strings,
+// with the timestamps and flags for shadow DBIs.
+func dumpDupSort(t *testing.T, s *Syncer, txn *lmdb.Txn, dbiName string, shadow bool) ([]string, string) {
+	readName := dbiName
+	if shadow {
+		readName = SyncDBIShadowPrefix + dbiName
+	}
+	dbiMsg, err := s.readDBI(txn, readName, dbiName, !shadow, nil, nil, nil)
+	require.NoError(t, err)
+	kvs, err := dbiMsg.AsInefficientKVList()
+	require.NoError(t, err)
+	var res []string
+	for _, kv := range kvs {
+		if shadow && dbiMsg.Transform() == snapshot.TransformDupSortHackV1 {
+			kv, err = dupSortHackToNativeOne(kv)
+			require.NoError(t, err)
+		}
+		e := string(kv.Key) + "=" + string(kv.Value)
+		if shadow {
+			e += "@" + header.Timestamp(kv.TimestampNano).Time().Format("2")
+			if header.Flags(kv.Flags).IsDeleted() {
+				e += "-deleted"
+			}
+		}
+		res = append(res, e)
+	}
+	return res, dbiMsg.Transform()
+}
+
+func TestSyncer_dupSortNative(t *testing.T) {
+	ts1 := testTS(1)
+	ts2 := testTS(2)
+	ts3 := testTS(3)
+
+	lc := config.LMDB{DupSortNative: true}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		s, err := New("test", env, nil, config.Config{}, lc, Options{})
+		require.NoError(t, err)
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			ctx := context.Background()
+			dbi, err := txn.OpenDBI("foo", lmdb.Create|lmdb.DupSort)
+			require.NoError(t, err)
+			for _, kv := range []string{"a=1", "a=2", "a=3", "b=x"} {
+				p := strings.Split(kv, "=")
+				require.NoError(t, txn.Put(dbi, b(p[0]), b(p[1]), 0))
+			}
+
+			// Initial copy to shadow, which is itself a DupSort DBI
+			require.NoError(t, s.mainToShadow(ctx, txn, ts1))
+			shadow, transform := dumpDupSort(t, s, txn, "foo", true)
+			assert.Equal(t, snapshot.TransformDupSortNativeV1, transform)
+			assert.Equal(t, []string{"a=1@1", "a=2@1", "a=3@1", "b=x@1"}, shadow)
+
+			// Local changes only change the timestamps of changed values
+			require.NoError(t, txn.Del(dbi, b("a"), b("2")))
+			require.NoError(t, txn.Del(dbi, b("b"), b("x")))
+			require.NoError(t, txn.Put(dbi, b("a"), b("4"), 0))
+			require.NoError(t, s.mainToShadow(ctx, txn, ts2))
+			shadow, _ = dumpDupSort(t, s, txn, "foo", true)
+			assert.ElementsMatch(t, []string{
+				"a=1@1", "a=2@2-deleted", "a=3@1", "a=4@2", "b=x@2-deleted",
+			}, shadow)
+
+			// Merge a remote snapshot, every value separately
+			remote := snapshot.NewDBI()
+			remote.SetName("foo")
+			remote.SetFlags(uint64(lmdb.DupSort))
+			remote.SetTransform(snapshot.TransformDupSortNativeV1)
+			for _, kv := range []snapshot.KV{
+				{Key: b("a"), Value: b("1"), TimestampNano: uint64(ts1), Flags: uint32(header.FlagDeleted)}, // deletion wins
+				{Key: b("a"), Value: b("2"), TimestampNano: uint64(ts3)},                                    // newer
+				{Key: b("a"), Value: b("4"), TimestampNano: uint64(ts1), Flags: uint32(header.FlagDeleted)}, // older
+				{Key: b("c"), Value: b("y"), TimestampNano: uint64(ts3)},                                    // new key
+			} {
+				remote.Append(kv)
+			}
+			sr := &snapshot.StreamReader{FormatVersion: snapshot.CurrentFormatVersion}
+			require.NoError(t, s.loadDBI(txn, s.l, sr, remote, "remote"))
+			require.NoError(t, s.shadowToMain(ctx, txn))
+
+			main, _ := dumpDupSort(t, s, txn, "foo", false)
+			assert.Equal(t, []string{"a=2", "a=3", "a=4", "c=y"}, main)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
+
+func TestSyncer_dupSortUpgrade(t *testing.T) {
+	ts1 := testTS(1)
+	ts2 := testTS(2)
+	ts3 := testTS(3)
+
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		s, err := New("test", env, nil, config.Config{}, config.LMDB{DupSortHack: true}, Options{})
+		require.NoError(t, err)
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			ctx := context.Background()
+			dbi, err := txn.OpenDBI("foo", lmdb.Create|lmdb.DupSort)
+			require.NoError(t, err)
+			for _, kv := range []string{"a=1", "a=2", "a=3", "b=x"} {
+				p := strings.Split(kv, "=")
+				require.NoError(t, txn.Put(dbi, b(p[0]), b(p[1]), 0))
+			}
+			require.NoError(t, s.mainToShadow(ctx, txn, ts1))
+			require.NoError(t, txn.Del(dbi, b("a"), b("2")))
+			require.NoError(t, s.mainToShadow(ctx, txn, ts2))
+			expected := []string{"a=1@1", "a=2@2-deleted", "a=3@1", "b=x@1"}
+			shadow, transform := dumpDupSort(t, s, txn, "foo", true)
+			assert.Equal(t, snapshot.TransformDupSortHackV1, transform)
+			assert.Equal(t, expected, shadow)
+
+			// Switching to dupsort_native keeps the timestamps and deletions
+			s.lc = config.LMDB{DupSortNative: true}
+			require.NoError(t, s.mainToShadow(ctx, txn, ts3))
+			shadow, transform = dumpDupSort(t, s, txn, "foo", true)
+			assert.Equal(t, snapshot.TransformDupSortNativeV1, transform)
+			assert.Equal(t, expected, shadow)
+
+			// And back
+			s.lc = config.LMDB{DupSortHack: true}
+			require.NoError(t, s.mainToShadow(ctx, txn, ts3))
+			shadow, transform = dumpDupSort(t, s, txn, "foo", true)
+			assert.Equal(t, snapshot.TransformDupSortHackV1, transform)
+			assert.Equal(t, expected, shadow)
+
+			main, _ := dumpDupSort(t, s, txn, "foo", false)
+			assert.Equal(t, []string{"a=1", "a=3", "b=x"}, main)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
+
+func TestSyncer_dupSortConvert(t *testing.T) {
+	hack := snapshot.NewDBI()
+	hack.SetName("foo")
+	hack.SetFlags(uint64(lmdb.DupSort))
+	hack.SetTransform(snapshot.TransformDupSortHackV1)
+	hack.Append(snapshot.KV{Key: b("a\x00\x00\x00\x001\x01"), Value: b("1"), TimestampNano: 1})
+	hack.Append(snapshot.KV{Key: b("a\x00\x00\x00\x002\x01"), TimestampNano: 2, Flags: uint32(header.FlagDeleted)})
+
+	s := &Syncer{lc: config.LMDB{DupSortNative: true}}
+	native, err := s.dupSortConvert(hack)
+	require.NoError(t, err)
+	assert.Equal(t, snapshot.TransformDupSortNativeV1, native.Transform())
+	kvs, err := native.AsInefficientKVList()
+	require.NoError(t, err)
+	assert.Equal(t, []snapshot.KV{
+		{Key: b("a"), Value: b("1"), TimestampNano: 1},
+		{Key: b("a"), Value: b("2"), TimestampNano: 2, Flags: uint32(header.FlagDeleted)},
+	}, kvs)
+
+	// And back
+	s = &Syncer{lc: config.LMDB{DupSortHack: true}}
+	back, err := s.dupSortConvert(native)
+	require.NoError(t, err)
+	assert.Equal(t, snapshot.TransformDupSortHackV1, back.Transform())
+	kvs, err = back.AsInefficientKVList()
+	require.NoError(t, err)
+	assert.Equal(t, b("a\x00\x00\x00\x002\x01"), kvs[1].Key)
+	assert.Equal(t, uint64(2), kvs[1].TimestampNano)
+}
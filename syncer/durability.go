@@ -0,0 +1,56 @@
+package syncer
+
+import (
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+// durabilityEnvFlags returns the env flags for a durability level. An empty
+// level means full durability.
+func durabilityEnvFlags(level string) uint {
+	switch level {
+	case config.DurabilityNoMetaSync:
+		return lmdb.NoMetaSync
+	case config.DurabilityNoSync:
+		return lmdb.NoSync
+	}
+	return 0
+}
+
+// setDurability changes the env flags to the durability level for a phase
+// of the sync. When the durability is raised, the env is synced first, so
+// that the transactions of the previous phase are on disk as well.
+// Only the flags set by an earlier call are removed, the flags the LMDB was
+// opened with are kept.
+func (s *Syncer) setDurability(env *lmdb.Env, level string) error {
+	current, err := env.Flags()
+	if err != nil {
+		return err
+	}
+	want := durabilityEnvFlags(level)
+	unset := s.durabilitySet &^ want
+	set := want &^ current
+	if unset == 0 && set == 0 {
+		return nil
+	}
+	if unset != 0 {
+		if err := env.Sync(true); err != nil {
+			return err
+		}
+		if err := env.UnsetFlags(unset); err != nil {
+			return err
+		}
+		s.durabilitySet &^= unset
+	}
+	if set != 0 {
+		if err := env.SetFlags(set); err != nil {
+			return err
+		}
+		s.durabilitySet |= set
+	}
+	if level == "" {
+		level = config.DurabilityFull
+	}
+	s.l.WithField("durability", level).Info("Changed LMDB durability")
+	return nil
+}
@@ -0,0 +1,38 @@
+package syncer
+
+import (
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+func TestSyncer_setDurability(t *testing.T) {
+	s, env := createInstance(t, "a", memory.New(), true)
+	flags := func() uint {
+		f, err := env.Flags()
+		require.NoError(t, err)
+		return f & (lmdb.NoSync | lmdb.NoMetaSync | lmdb.MapAsync)
+	}
+	assert.Zero(t, flags())
+
+	require.NoError(t, s.setDurability(env, config.DurabilityNoSync))
+	assert.Equal(t, uint(lmdb.NoSync), flags())
+	require.NoError(t, s.setDurability(env, config.DurabilityNoMetaSync))
+	assert.Equal(t, uint(lmdb.NoMetaSync), flags())
+	require.NoError(t, s.setDurability(env, config.DurabilityFull))
+	assert.Zero(t, flags())
+
+	// The flags the LMDB was opened with are kept
+	require.NoError(t, env.SetFlags(lmdb.NoMetaSync))
+	require.NoError(t, s.setDurability(env, config.DurabilityNoSync))
+	assert.Equal(t, uint(lmdb.NoSync|lmdb.NoMetaSync), flags())
+	require.NoError(t, s.setDurability(env, ""))
+	assert.Equal(t, uint(lmdb.NoMetaSync), flags())
+	require.NoError(t, s.setDurability(env, config.DurabilityNoMetaSync))
+	require.NoError(t, s.setDurability(env, config.DurabilityFull))
+	assert.Equal(t, uint(lmdb.NoMetaSync), flags())
+}
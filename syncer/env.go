@@ -1,13 +1,33 @@
 package syncer
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/PowerDNS/lmdb-go/lmdb"
 	"github.com/c2h5oh/datasize"
 	"github.com/sirupsen/logrus"
 	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+const (
+	// DefaultStartupCheckEntries is the default number of entries per DBI
+	// checked for a plausible header on startup.
+	DefaultStartupCheckEntries = 1000
+
+	// maxReportedInvalidEntries limits the entries listed in the error
+	maxReportedInvalidEntries = 10
 )
 
+// maxPlausibleTimestamp is the latest timestamp accepted by the startup
+// check. Random application data interpreted as a timestamp is almost always
+// later than this.
+var maxPlausibleTimestamp = header.TimestampFromTime(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC))
+
 // OpenEnv opens the LMDB env with the right options
 func OpenEnv(l logrus.FieldLogger, lc config.LMDB) (env *lmdb.Env, err error) {
 	l.WithField("lmdbpath", lc.Path).Info("Opening LMDB")
@@ -19,6 +39,7 @@ func OpenEnv(l logrus.FieldLogger, lc config.LMDB) (env *lmdb.Env, err error) {
 	// Print some env info
 	info, err := env.Info()
 	if err != nil {
+		_ = env.Close()
 		return nil, err
 	}
 	l.WithFields(logrus.Fields{
@@ -26,8 +47,96 @@ func OpenEnv(l logrus.FieldLogger, lc config.LMDB) (env *lmdb.Env, err error) {
 		"LastTxnID": info.LastTxnID,
 	}).Info("Env info")
 
-	// TODO: Perhaps check data if SchemaTracksChanges is set. Check if
-	//       the timestamp is in a reasonable range or 0.
+	if lc.SchemaTracksChanges {
+		if err := checkHeaders(env, lc); err != nil {
+			_ = env.Close()
+			return nil, err
+		}
+	}
 
 	return env, nil
 }
+
+// checkHeaders checks if the first startup_check_entries entries of every
+// synced DBI have a header with a timestamp that is zero or plausible, to
+// detect applications that do not write headers before we send their values
+// in snapshots.
+func checkHeaders(env *lmdb.Env, lc config.LMDB) error {
+	limit := lc.StartupCheckEntries
+	if limit < 0 {
+		return nil
+	}
+	if limit == 0 {
+		limit = DefaultStartupCheckEntries
+	}
+	var invalid []string
+	nInvalid := 0
+	err := env.View(func(txn *lmdb.Txn) error {
+		txn.RawRead = true // keys are copied for the error
+		dbiNames, err := lmdbenv.ReadDBINames(txn)
+		if err != nil {
+			return err
+		}
+		for _, dbiName := range dbiNames {
+			if strings.HasPrefix(dbiName, SyncDBIPrefix) || !lc.IsDBIIncluded(dbiName) {
+				continue
+			}
+			err := checkDBIHeaders(txn, dbiName, limit, func(key []byte, problem string) {
+				nInvalid++
+				if len(invalid) < maxReportedInvalidEntries {
+					invalid = append(invalid, fmt.Sprintf("dbi %s key %s: %s",
+						dbiName, utils.DisplayASCII(key), problem))
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("dbi %s: %w", dbiName, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if nInvalid == 0 {
+		return nil
+	}
+	msg := strings.Join(invalid, "; ")
+	if nInvalid > len(invalid) {
+		msg += fmt.Sprintf("; and %d more", nInvalid-len(invalid))
+	}
+	return fmt.Errorf("schema_tracks_changes is enabled, but entries without a "+
+		"valid header were found, check if the application supports Lightning "+
+		"Stream headers: %s", msg)
+}
+
+// checkDBIHeaders calls f for every entry among the first limit entries of
+// the DBI without a plausible header
+func checkDBIHeaders(txn *lmdb.Txn, dbiName string, limit int, f func(key []byte, problem string)) error {
+	dbi, err := txn.OpenDBI(dbiName, 0)
+	if err != nil {
+		return err
+	}
+	c, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var flag uint = lmdb.First
+	for i := 0; i < limit; i++ {
+		key, val, err := c.Get(nil, nil, flag)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		flag = lmdb.Next
+		h, _, err := header.Parse(val)
+		if err != nil {
+			f(key, err.Error())
+		} else if h.Timestamp > maxPlausibleTimestamp {
+			f(key, fmt.Sprintf("implausible timestamp %d", h.Timestamp))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package syncer
+
+import (
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+func TestOpenEnv_checkHeaders(t *testing.T) {
+	lc := config.LMDB{
+		Path:                t.TempDir(),
+		Options:             lmdbenv.Options{Create: true},
+		SchemaTracksChanges: true,
+		ExcludeDBIs:         []string{"excluded"},
+	}
+	l := logrus.StandardLogger()
+	env, err := OpenEnv(l, lc)
+	require.NoError(t, err)
+	put := func(dbiName, key string, val []byte) {
+		err := env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.OpenDBI(dbiName, lmdb.Create)
+			if err != nil {
+				return err
+			}
+			return txn.Put(dbi, b(key), val, 0)
+		})
+		require.NoError(t, err)
+	}
+	val := make([]byte, header.MinHeaderSize)
+	header.PutBasic(val, testTS(1), 1, header.NoFlags)
+	put("data", "valid", val)
+	header.PutBasic(val, 0, 1, header.NoFlags)
+	put("data", "zero", val)
+	put("excluded", "plain", b("no header"))
+	put(SyncDBIState, "x", b("{}"))
+	require.NoError(t, env.Close())
+
+	env, err = OpenEnv(l, lc)
+	require.NoError(t, err)
+	put("data", "zz-plain", b("no header"))
+	put("other", "far-future", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, env.Close())
+
+	_, err = OpenEnv(l, lc)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dbi data key zz-plain")
+	assert.Contains(t, err.Error(), "dbi other key far-future")
+	assert.NotContains(t, err.Error(), "excluded")
+
+	// Only the first entries are checked
+	lc.StartupCheckEntries = 1
+	_, err = OpenEnv(l, lc)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "dbi data key zz-plain")
+
+	lc.StartupCheckEntries = -1
+	env, err = OpenEnv(l, lc)
+	require.NoError(t, err)
+	require.NoError(t, env.Close())
+}
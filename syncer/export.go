@@ -0,0 +1,96 @@
+package syncer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// Exporter receives the DBIs and entries passed by Export
+type Exporter interface {
+	// StartDBI is called before the entries of every DBI, with its LMDB
+	// DBI flags
+	StartDBI(name string, flags uint) error
+
+	// Put is called for every entry of the current DBI in key order. The
+	// key and value are only valid until it returns.
+	Put(key, val []byte) error
+}
+
+// Export passes the synced DBIs of an LMDB to an Exporter. With stripHeaders,
+// the headers are removed from the values of an LMDB with
+// schema_tracks_changes and deleted entries are skipped, which results in the
+// native schema of the application. The values of other LMDBs have no
+// headers, their shadow DBIs are never exported.
+// It returns the number of entries exported per DBI.
+func Export(txn *lmdb.Txn, lc config.LMDB, stripHeaders bool, e Exporter) (map[string]int, error) {
+	dbiNames, err := lmdbenv.ReadDBINames(txn)
+	if err != nil {
+		return nil, err
+	}
+	strip := stripHeaders && lc.SchemaTracksChanges
+
+	counts := make(map[string]int)
+	for _, dbiName := range dbiNames {
+		if strings.HasPrefix(dbiName, SyncDBIPrefix) || !lc.IsDBIIncluded(dbiName) {
+			continue
+		}
+		dbi, err := txn.OpenDBI(dbiName, 0)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		flags, err := txn.Flags(dbi)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		if err := e.StartDBI(dbiName, flags); err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		n, err := exportDBI(txn, dbi, strip, e)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		counts[dbiName] = n
+	}
+	return counts, nil
+}
+
+// exportDBI passes all entries of a DBI to the Exporter
+func exportDBI(txn *lmdb.Txn, dbi lmdb.DBI, strip bool, e Exporter) (int, error) {
+	c, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	n := 0
+	var flag uint = lmdb.First
+	for {
+		key, val, err := c.Get(nil, nil, flag)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return n, nil
+			}
+			return 0, err
+		}
+		flag = lmdb.Next
+		if strip {
+			h, appVal, err := header.Parse(val)
+			if err != nil {
+				return 0, fmt.Errorf("key %s: %w", utils.DisplayASCII(key), err)
+			}
+			if h.Flags.IsDeleted() {
+				continue
+			}
+			val = appVal
+		}
+		if err := e.Put(key, val); err != nil {
+			return 0, err
+		}
+		n++
+	}
+}
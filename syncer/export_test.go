@@ -0,0 +1,88 @@
+package syncer
+
+import (
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+// testExporter records the exported entries as strings by DBI
+type testExporter struct {
+	dbis  map[string]map[string]string
+	flags map[string]uint
+	cur   string
+}
+
+func (e *testExporter) StartDBI(name string, flags uint) error {
+	if e.dbis == nil {
+		e.dbis = make(map[string]map[string]string)
+		e.flags = make(map[string]uint)
+	}
+	e.dbis[name] = make(map[string]string)
+	e.flags[name] = flags
+	e.cur = name
+	return nil
+}
+
+func (e *testExporter) Put(key, val []byte) error {
+	e.dbis[e.cur][string(key)] = string(val)
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	withHeader := func(val string, flags header.Flags) []byte {
+		b := make([]byte, header.MinHeaderSize, header.MinHeaderSize+len(val))
+		header.PutBasic(b, testTS(1), 1, flags)
+		return append(b, val...)
+	}
+	lc := config.LMDB{SchemaTracksChanges: true}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		return env.Update(func(txn *lmdb.Txn) error {
+			foo, err := txn.OpenDBI("foo", lmdb.Create)
+			require.NoError(t, err)
+			state, err := txn.OpenDBI(SyncDBIState, lmdb.Create)
+			require.NoError(t, err)
+			_, err = txn.OpenDBI("empty", lmdb.Create|lmdb.ReverseKey)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(foo, b("a"), withHeader("va", header.NoFlags), 0))
+			require.NoError(t, txn.Put(foo, b("b"), withHeader("", header.FlagDeleted), 0))
+			require.NoError(t, txn.Put(state, b("x"), b("{}"), 0))
+
+			// Stripped
+			e := &testExporter{}
+			counts, err := Export(txn, lc, true, e)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]int{"foo": 1, "empty": 0}, counts)
+			assert.Equal(t, map[string]map[string]string{
+				"foo":   {"a": "va"},
+				"empty": {},
+			}, e.dbis)
+			assert.Equal(t, uint(lmdb.ReverseKey), e.flags["empty"])
+
+			// With headers
+			e = &testExporter{}
+			counts, err = Export(txn, lc, false, e)
+			require.NoError(t, err)
+			assert.Equal(t, 2, counts["foo"])
+			assert.Equal(t, string(withHeader("va", header.NoFlags)), e.dbis["foo"]["a"])
+
+			// Without schema_tracks_changes the values are never parsed
+			e = &testExporter{}
+			counts, err = Export(txn, config.LMDB{}, true, e)
+			require.NoError(t, err)
+			assert.Equal(t, 2, counts["foo"])
+
+			// Invalid header
+			require.NoError(t, txn.Put(foo, b("c"), b("short"), 0))
+			_, err = Export(txn, lc, true, &testExporter{})
+			assert.Error(t, err)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
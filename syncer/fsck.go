@@ -0,0 +1,220 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+// FsckIssue is a violation of an invariant found by Fsck
+type FsckIssue struct {
+	DBIName  string // DBI with the issue
+	Problem  string
+	Entries  int  // number of entries affected, if applicable
+	Fixable  bool // can be repaired by Fsck
+	Repaired bool
+}
+
+func (i FsckIssue) String() string {
+	if i.Entries > 0 {
+		return fmt.Sprintf("dbi %s: %s (%d entries)", i.DBIName, i.Problem, i.Entries)
+	}
+	return fmt.Sprintf("dbi %s: %s", i.DBIName, i.Problem)
+}
+
+// Fsck checks an LMDB against the invariants Lightning Stream relies on:
+//
+//   - With schema_tracks_changes, every entry of a synced DBI has a valid
+//     header with a timestamp.
+//   - Without, every shadow DBI belongs to a synced main DBI, every shadow
+//     entry has a valid header with a timestamp, and the shadow DBIs contain
+//     all the changes of the main DBIs.
+//   - There are no other DBIs with the _sync prefix.
+//
+// Changes that have not been synced to the shadow DBIs are expected while
+// the application writes and Lightning Stream is running.
+//
+// If repair is set, the txn must be a write transaction. The shadow DBIs are
+// then updated with the pending changes, and stray _sync DBIs are dropped.
+// Entries with invalid headers cannot be repaired.
+func Fsck(ctx context.Context, txn *lmdb.Txn, name string, lc config.LMDB, repair bool) ([]FsckIssue, error) {
+	hooks, err := loadHooks(lc)
+	if err != nil {
+		return nil, err
+	}
+	s := &Syncer{
+		name:  name,
+		lc:    lc,
+		l:     logrus.WithField("db", name),
+		hooks: hooks,
+	}
+
+	dbiNames, err := lmdbenv.ReadDBINames(txn)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool)
+	for _, dbiName := range dbiNames {
+		exists[dbiName] = true
+	}
+
+	var issues []FsckIssue
+	var stray []string
+	invalidShadow := make(map[string]bool) // by main DBI name
+	for _, dbiName := range dbiNames {
+		switch {
+		case dbiName == SyncDBIState, dbiName == SyncDBITombstones, dbiName == SyncDBIStaging:
+			// Valid in both modes
+		case strings.HasPrefix(dbiName, SyncDBIShadowPrefix):
+			mainName := strings.TrimPrefix(dbiName, SyncDBIShadowPrefix)
+			if lc.SchemaTracksChanges || !exists[mainName] || !lc.IsDBIIncluded(mainName) {
+				stray = append(stray, dbiName)
+				continue
+			}
+			n, err := countInvalidHeaders(txn, dbiName, true)
+			if err != nil {
+				return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+			}
+			if n > 0 {
+				invalidShadow[mainName] = true
+				issues = append(issues, FsckIssue{
+					DBIName: dbiName,
+					Problem: "entries without a valid header",
+					Entries: n,
+				})
+			}
+		case strings.HasPrefix(dbiName, SyncDBIPrefix):
+			stray = append(stray, dbiName)
+		case !lc.IsDBIIncluded(dbiName):
+			// Not synced, anything goes
+		case lc.SchemaTracksChanges:
+			n, err := countInvalidHeaders(txn, dbiName, false)
+			if err != nil {
+				return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+			}
+			if n > 0 {
+				issues = append(issues, FsckIssue{
+					DBIName: dbiName,
+					Problem: "entries without a valid header",
+					Entries: n,
+				})
+			}
+		}
+	}
+
+	// Pending changes cannot be counted for shadow DBIs that cannot be parsed
+	pendingShadow := false
+	if !lc.SchemaTracksChanges {
+		for _, dbiName := range dbiNames {
+			if strings.HasPrefix(dbiName, SyncDBIPrefix) || !lc.IsDBIIncluded(dbiName) ||
+				invalidShadow[dbiName] {
+				continue
+			}
+			n, err := s.pendingShadowChanges(txn, dbiName)
+			if err != nil {
+				return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+			}
+			if n > 0 {
+				pendingShadow = true
+				issues = append(issues, FsckIssue{
+					DBIName: dbiName,
+					Problem: "changes not synced to the shadow DBI",
+					Entries: n,
+					Fixable: len(invalidShadow) == 0,
+				})
+			}
+		}
+	}
+
+	for _, dbiName := range stray {
+		issues = append(issues, FsckIssue{
+			DBIName: dbiName,
+			Problem: "stray sync DBI",
+			Fixable: true,
+		})
+	}
+
+	if !repair {
+		return issues, nil
+	}
+	for i, issue := range issues {
+		if !issue.Fixable || !strings.HasPrefix(issue.DBIName, SyncDBIPrefix) {
+			continue
+		}
+		dbi, err := txn.OpenDBI(issue.DBIName, 0)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", issue.DBIName, err)
+		}
+		if err := txn.Drop(dbi, true); err != nil {
+			return nil, fmt.Errorf("dbi %s: drop: %w", issue.DBIName, err)
+		}
+		issues[i].Repaired = true
+	}
+	// The shadow DBIs are only updated if all of them can be parsed, because
+	// mainToShadow processes all DBIs.
+	if pendingShadow && len(invalidShadow) == 0 {
+		tsNano := header.TimestampFromTime(time.Now())
+		if err := s.mainToShadow(ctx, txn, tsNano); err != nil {
+			return nil, fmt.Errorf("update shadow DBIs: %w", err)
+		}
+		for i, issue := range issues {
+			if issue.Fixable && !strings.HasPrefix(issue.DBIName, SyncDBIPrefix) {
+				issues[i].Repaired = true
+			}
+		}
+	}
+	return issues, nil
+}
+
+// countInvalidHeaders returns the number of entries in a DBI that do not
+// start with a valid header with a timestamp. For DupSort DBIs, all values
+// are checked. The values of DupSort shadow DBIs have their own format.
+func countInvalidHeaders(txn *lmdb.Txn, dbiName string, isShadow bool) (int, error) {
+	dbi, err := txn.OpenDBI(dbiName, 0)
+	if err != nil {
+		return 0, err
+	}
+	flags, err := txn.Flags(dbi)
+	if err != nil {
+		return 0, err
+	}
+	parse := func(v []byte) (header.Header, error) {
+		h, _, err := header.Parse(v)
+		return h, err
+	}
+	if isShadow && flags&lmdb.DupSort > 0 {
+		parse = func(v []byte) (header.Header, error) {
+			_, h, err := parseDupSortShadowValue(v)
+			return h, err
+		}
+	}
+
+	c, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	n := 0
+	var flag uint = lmdb.First
+	for {
+		_, v, err := c.Get(nil, nil, flag)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return n, nil
+			}
+			return 0, err
+		}
+		flag = lmdb.Next
+		h, err := parse(v)
+		if err != nil || h.Timestamp == 0 {
+			n++
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+func TestFsck_shadow(t *testing.T) {
+	ctx := context.Background()
+	lc := config.LMDB{DupSortHack: true}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		return env.Update(func(txn *lmdb.Txn) error {
+			plain, err := txn.OpenDBI("plain", lmdb.Create)
+			require.NoError(t, err)
+			for _, k := range []string{"a", "b"} {
+				require.NoError(t, txn.Put(plain, b(k), b("v"), 0))
+			}
+			// Shadow DBI without main DBI and unknown sync DBI
+			_, err = txn.OpenDBI(SyncDBIShadowPrefix+"gone", lmdb.Create)
+			require.NoError(t, err)
+			_, err = txn.OpenDBI("_sync_foo", lmdb.Create)
+			require.NoError(t, err)
+
+			issues, err := Fsck(ctx, txn, "test", lc, false)
+			require.NoError(t, err)
+			assert.Equal(t, []FsckIssue{
+				{DBIName: "plain", Problem: "changes not synced to the shadow DBI", Entries: 2, Fixable: true},
+				{DBIName: "_sync_foo", Problem: "stray sync DBI", Fixable: true},
+				{DBIName: "_sync_shadow_gone", Problem: "stray sync DBI", Fixable: true},
+			}, issues)
+
+			issues, err = Fsck(ctx, txn, "test", lc, true)
+			require.NoError(t, err)
+			require.Len(t, issues, 3)
+			for _, issue := range issues {
+				assert.True(t, issue.Repaired, issue.String())
+			}
+			issues, err = Fsck(ctx, txn, "test", lc, false)
+			require.NoError(t, err)
+			assert.Empty(t, issues)
+
+			// Invalid shadow entries cannot be repaired
+			shadow, err := txn.OpenDBI(SyncDBIShadowPrefix+"plain", 0)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(shadow, b("a"), b("short"), 0))
+			require.NoError(t, txn.Put(plain, b("c"), b("v"), 0))
+			issues, err = Fsck(ctx, txn, "test", lc, true)
+			require.NoError(t, err)
+			assert.Equal(t, []FsckIssue{
+				{DBIName: "_sync_shadow_plain", Problem: "entries without a valid header", Entries: 1},
+			}, issues)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
+
+func TestFsck_native(t *testing.T) {
+	ctx := context.Background()
+	lc := config.LMDB{SchemaTracksChanges: true}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		return env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.OpenDBI("data", lmdb.Create)
+			require.NoError(t, err)
+			val := make([]byte, header.MinHeaderSize, header.MinHeaderSize+1)
+			header.PutBasic(val, testTS(1), 1, header.NoFlags)
+			require.NoError(t, txn.Put(dbi, b("valid"), append(val, 'v'), 0))
+			require.NoError(t, txn.Put(dbi, b("short"), b("v"), 0))
+			header.PutBasic(val, 0, 1, header.NoFlags)
+			require.NoError(t, txn.Put(dbi, b("zero"), val, 0))
+			// Left over from shadow mode
+			_, err = txn.OpenDBI(SyncDBIShadowPrefix+"data", lmdb.Create)
+			require.NoError(t, err)
+			_, err = txn.OpenDBI(SyncDBIState, lmdb.Create)
+			require.NoError(t, err)
+
+			issues, err := Fsck(ctx, txn, "test", lc, true)
+			require.NoError(t, err)
+			assert.Equal(t, []FsckIssue{
+				{DBIName: "data", Problem: "entries without a valid header", Entries: 2},
+				{DBIName: "_sync_shadow_data", Problem: "stray sync DBI", Fixable: true, Repaired: true},
+			}, issues)
+			exists, err := lmdbenv.DBIExists(txn, SyncDBIShadowPrefix+"data")
+			require.NoError(t, err)
+			assert.False(t, exists)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,79 @@
+package syncer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wojas/go-healthz"
+	"powerdns.com/platform/lightningstream/status/healthtracker"
+	"powerdns.com/platform/lightningstream/status/readiness"
+)
+
+// registerSnapshotAgeCheck registers the healthz and readiness checks for the
+// age of the newest remote snapshot applied, if enabled.
+func (s *Syncer) registerSnapshotAgeCheck() {
+	conf := s.c.Health.SnapshotAge
+	if conf.WarnAge <= 0 && conf.ErrorAge <= 0 {
+		return
+	}
+	interval := conf.EvaluationInterval
+	if interval < healthtracker.MinEvaluationInterval {
+		interval = healthtracker.MinEvaluationInterval
+	}
+
+	name := fmt.Sprintf("%s_snapshot_age", s.name)
+	healthz.Register(name, interval, func() error {
+		if err := s.checkSnapshotAge(conf.ErrorAge); err != nil {
+			return err
+		}
+		if err := s.checkSnapshotAge(conf.WarnAge); err != nil {
+			return healthz.Warnf("%v", err)
+		}
+		return nil
+	})
+	if conf.ErrorAge > 0 {
+		readiness.Register(name, func() error {
+			return s.checkSnapshotAge(conf.ErrorAge)
+		})
+	}
+	s.l.WithField("interval", interval).Info("registered tracker for snapshot age")
+}
+
+// checkSnapshotAge returns an error if the newest remote snapshot applied is
+// older than maxAge. A zero maxAge disables the check, and it always passes
+// as long as no remote snapshot has been applied.
+func (s *Syncer) checkSnapshotAge(maxAge time.Duration) error {
+	newest := s.newestApplied.Load()
+	if maxAge <= 0 || newest.IsZero() {
+		return nil
+	}
+	age := time.Since(newest)
+	if age < maxAge {
+		return nil
+	}
+	return fmt.Errorf("newest applied remote snapshot is %s old", age.Round(time.Second))
+}
+
+// registerPauseCheck registers a healthz check that warns while syncing is
+// paused, so that a forgotten pause does not go unnoticed.
+func (s *Syncer) registerPauseCheck() {
+	name := fmt.Sprintf("%s_paused", s.name)
+	healthz.Register(name, healthtracker.MinEvaluationInterval, s.checkPaused)
+}
+
+// checkPaused returns a healthz warning with the paused directions
+func (s *Syncer) checkPaused() error {
+	var paused []string
+	send, receive := s.Paused()
+	if send {
+		paused = append(paused, "upload")
+	}
+	if receive {
+		paused = append(paused, "download")
+	}
+	if len(paused) == 0 {
+		return nil
+	}
+	return healthz.Warnf("sync paused: %s", strings.Join(paused, ", "))
+}
@@ -0,0 +1,86 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"powerdns.com/platform/lightningstream/syncer/heartbeat"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// runHeartbeats periodically writes our heartbeat and loads those of the
+// other instances until the context is cancelled.
+func (s *Syncer) runHeartbeats(ctx context.Context) error {
+	for {
+		if err := s.HeartbeatOnce(ctx, time.Now()); err != nil {
+			if utils.IsCanceled(ctx) {
+				return ctx.Err()
+			}
+			metricHeartbeatsFailed.WithLabelValues(s.name).Inc()
+			s.l.WithError(err).Warn("Heartbeat failed")
+		}
+		if err := utils.SleepContextPerturb(ctx, s.c.Storage.Heartbeat.Interval); err != nil {
+			return err
+		}
+	}
+}
+
+// HeartbeatOnce writes our heartbeat, unless in receive-only mode, and loads
+// the heartbeats of all instances to update the cluster view and metrics.
+// The heartbeats of instances that have been gone for RemoveAfter are removed
+// if we are the leader.
+func (s *Syncer) HeartbeatOnce(ctx context.Context, now time.Time) error {
+	conf := s.c.Storage.Heartbeat
+	if !s.opt.ReceiveOnly {
+		hb := heartbeat.Heartbeat{
+			Instance:     s.instanceID(),
+			Hostname:     hostname,
+			Version:      s.c.Version,
+			GenerationID: s.generationID(),
+			StartTime:    s.started,
+			Time:         now,
+			LastSnapshot: s.lastStored.Load(),
+			LastLoaded:   s.newestApplied.Load(),
+		}
+		if err := heartbeat.Store(ctx, s.st, s.name, hb); err != nil {
+			return fmt.Errorf("store heartbeat: %w", err)
+		}
+	}
+
+	statuses, err := heartbeat.List(ctx, s.st, s.name, now, conf.DeadAfter)
+	if err != nil {
+		return fmt.Errorf("list heartbeats: %w", err)
+	}
+	var current []heartbeat.Status
+	for _, hs := range statuses {
+		if conf.RemoveAfter > 0 && now.Sub(hs.Time) > conf.RemoveAfter && s.isLeader() {
+			if err := s.st.Delete(ctx, hs.Name); err != nil {
+				return fmt.Errorf("delete heartbeat %s: %w", hs.Name, err)
+			}
+			s.l.WithField("heartbeat_instance", hs.Instance).Info("Removed heartbeat of gone instance")
+			continue
+		}
+		current = append(current, hs)
+	}
+	heartbeat.SetCluster(s.name, current)
+
+	metricClusterHeartbeatAge.DeletePartialMatch(prometheus.Labels{"lmdb": s.name})
+	metricClusterSnapshotAge.DeletePartialMatch(prometheus.Labels{"lmdb": s.name})
+	alive, dead := 0, 0
+	for _, hs := range current {
+		if hs.Alive {
+			alive++
+		} else {
+			dead++
+		}
+		metricClusterHeartbeatAge.WithLabelValues(s.name, hs.Instance).Set(now.Sub(hs.Time).Seconds())
+		if !hs.LastSnapshot.IsZero() {
+			metricClusterSnapshotAge.WithLabelValues(s.name, hs.Instance).Set(now.Sub(hs.LastSnapshot).Seconds())
+		}
+	}
+	metricClusterInstances.WithLabelValues(s.name, "alive").Set(float64(alive))
+	metricClusterInstances.WithLabelValues(s.name, "dead").Set(float64(dead))
+	return nil
+}
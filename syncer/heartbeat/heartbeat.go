@@ -0,0 +1,127 @@
+// Package heartbeat implements the instance registry in the storage backend.
+// Every instance periodically writes a small heartbeat object for every LMDB
+// it syncs, which allows any instance to show which instances are alive and
+// how far they are behind.
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+)
+
+// Heartbeat is the content of a heartbeat object
+type Heartbeat struct {
+	Instance     string    `json:"instance"`
+	Hostname     string    `json:"hostname"`
+	Version      string    `json:"version"`
+	GenerationID string    `json:"generation_id"`
+	StartTime    time.Time `json:"start_time"`
+	Time         time.Time `json:"time"` // time the heartbeat was written
+
+	// LastSnapshot is the time of the last snapshot stored by the instance
+	LastSnapshot time.Time `json:"last_snapshot,omitempty"`
+
+	// LastLoaded is the time of the newest snapshot of another instance
+	// that was loaded by the instance.
+	LastLoaded time.Time `json:"last_loaded,omitempty"`
+}
+
+// Status is a Heartbeat with the state of the instance at the time of the
+// listing.
+type Status struct {
+	Heartbeat
+
+	// Name is the name of the heartbeat object
+	Name string `json:"name"`
+
+	// Alive is true if the heartbeat was written recently enough
+	Alive bool `json:"alive"`
+}
+
+// Prefix returns the name prefix of the heartbeat objects of an LMDB. It
+// does not match the snapshot name prefix of the LMDB.
+func Prefix(lmdbName string) string {
+	return lmdbName + ".heartbeat__"
+}
+
+// Name returns the name of the heartbeat object of an instance
+func Name(lmdbName, instance string) string {
+	return Prefix(lmdbName) + instance + ".json"
+}
+
+// Store writes the heartbeat of an instance
+func Store(ctx context.Context, st simpleblob.Interface, lmdbName string, hb Heartbeat) error {
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	return st.Store(ctx, Name(lmdbName, hb.Instance), data)
+}
+
+// List loads the heartbeats of all instances, ordered by instance. Instances
+// are considered alive if their heartbeat is no older than deadAfter at now.
+// Invalid heartbeat objects are skipped.
+func List(ctx context.Context, st simpleblob.Interface, lmdbName string, now time.Time, deadAfter time.Duration) ([]Status, error) {
+	prefix := Prefix(lmdbName)
+	ls, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var res []Status
+	for _, name := range ls.Names() {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := st.Load(ctx, name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // removed since the listing
+			}
+			return nil, err
+		}
+		var hb Heartbeat
+		if err := json.Unmarshal(data, &hb); err != nil || hb.Instance == "" {
+			continue
+		}
+		res = append(res, Status{
+			Heartbeat: hb,
+			Name:      name,
+			Alive:     now.Sub(hb.Time) <= deadAfter,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Instance < res[j].Instance
+	})
+	return res, nil
+}
+
+var (
+	mu       sync.Mutex
+	clusters = make(map[string][]Status)
+)
+
+// SetCluster records the last listed heartbeats of an LMDB for Cluster
+func SetCluster(lmdbName string, statuses []Status) {
+	mu.Lock()
+	defer mu.Unlock()
+	clusters[lmdbName] = statuses
+}
+
+// Cluster returns the last listed heartbeats by LMDB name
+func Cluster() map[string][]Status {
+	mu.Lock()
+	defer mu.Unlock()
+	res := make(map[string][]Status, len(clusters))
+	for name, statuses := range clusters {
+		res[name] = statuses
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/syncer/heartbeat"
+)
+
+func TestSyncer_HeartbeatOnce(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	syncerA, envA := createInstance(t, "a", st, true)
+	syncerB, _ := createInstance(t, "b", st, true)
+	conf := config.Heartbeat{
+		Enabled:     true,
+		Interval:    time.Minute,
+		DeadAfter:   5 * time.Minute,
+		RemoveAfter: time.Hour,
+	}
+	syncerA.c.Storage.Heartbeat = conf
+	syncerB.c.Storage.Heartbeat = conf
+
+	setKey(t, envA, "foo", "v1", true)
+	_, err := syncerA.SendOnce(ctx, envA)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, syncerB.HeartbeatOnce(ctx, now))
+	require.NoError(t, syncerA.HeartbeatOnce(ctx, now))
+	statuses := heartbeat.Cluster()[testLMDBName]
+	require.Len(t, statuses, 2)
+	assert.Equal(t, "a", statuses[0].Instance)
+	assert.True(t, statuses[0].Alive)
+	assert.Equal(t, syncerA.generationID(), statuses[0].GenerationID)
+	assert.False(t, statuses[0].LastSnapshot.IsZero())
+	assert.Equal(t, "b", statuses[1].Instance)
+	assert.True(t, statuses[1].LastSnapshot.IsZero())
+
+	// b is gone
+	require.NoError(t, syncerA.HeartbeatOnce(ctx, now.Add(10*time.Minute)))
+	statuses = heartbeat.Cluster()[testLMDBName]
+	require.Len(t, statuses, 2)
+	assert.True(t, statuses[0].Alive)
+	assert.False(t, statuses[1].Alive)
+
+	// b is removed
+	require.NoError(t, syncerA.HeartbeatOnce(ctx, now.Add(2*time.Hour)))
+	statuses = heartbeat.Cluster()[testLMDBName]
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "a", statuses[0].Instance)
+	ls, err := st.List(ctx, heartbeat.Prefix(testLMDBName))
+	require.NoError(t, err)
+	assert.Equal(t, []string{heartbeat.Name(testLMDBName, "a")}, ls.Names())
+}
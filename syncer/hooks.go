@@ -0,0 +1,148 @@
+package syncer
+
+import (
+	"fmt"
+	"io"
+
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer/redact"
+	"powerdns.com/platform/lightningstream/syncer/schema"
+)
+
+// loadHooks returns the value hooks configured in the DBI options by DBI name
+func loadHooks(lc config.LMDB) (map[string]schema.Hook, error) {
+	hooks := make(map[string]schema.Hook)
+	for dbiName, dbiOpt := range lc.DBIOptions {
+		h, err := schema.Get(dbiOpt.Hook)
+		if err != nil {
+			return nil, fmt.Errorf("dbi_options.%s.hook: %w", dbiName, err)
+		}
+		if h != nil {
+			hooks[dbiName] = h
+		}
+	}
+	return hooks, nil
+}
+
+// dbiHook returns the value hook of a DBI, or nil if it has none. Hooks are
+// not supported for DupSort DBIs, recognised by their snapshot transform,
+// because their values are part of the sort order.
+func (s *Syncer) dbiHook(dbiName, transform string) (schema.Hook, error) {
+	h := s.hooks[dbiName]
+	if h != nil && transform != "" {
+		return nil, fmt.Errorf("dbi_options.%s.hook: not supported for DupSort DBIs", dbiName)
+	}
+	return h, nil
+}
+
+// loadRedactors returns the redactors for the redact rules configured in the
+// DBI options by DBI name
+func loadRedactors(lc config.LMDB) (map[string]*redact.Redactor, error) {
+	redactors := make(map[string]*redact.Redactor)
+	for dbiName, dbiOpt := range lc.DBIOptions {
+		r, err := redact.New(dbiOpt.Redact)
+		if err != nil {
+			return nil, fmt.Errorf("dbi_options.%s.redact: %w", dbiName, err)
+		}
+		if r != nil {
+			redactors[dbiName] = r
+		}
+	}
+	return redactors, nil
+}
+
+// dbiRedactor returns the redactor of a DBI, or nil if it has none. Like
+// hooks, redaction is not supported for DupSort DBIs.
+func (s *Syncer) dbiRedactor(dbiName, transform string) (*redact.Redactor, error) {
+	r := s.redactors[dbiName]
+	if r != nil && transform != "" {
+		return nil, fmt.Errorf("dbi_options.%s.redact: not supported for DupSort DBIs", dbiName)
+	}
+	return r, nil
+}
+
+// encodeKV redacts an entry read from the LMDB for a snapshot and applies
+// the Encode method of the hook. It returns false if the entry must be left
+// out. The values of deleted entries are returned as is.
+func encodeKV(r *redact.Redactor, h schema.Hook, dbiName string, kv snapshot.KV) (snapshot.KV, bool, error) {
+	if r != nil {
+		val, ok := r.Apply(kv.Key, kv.Value)
+		if !ok {
+			return kv, false, nil
+		}
+		if !header.Flags(kv.Flags).IsDeleted() {
+			kv.Value = val
+		}
+	}
+	if h == nil || header.Flags(kv.Flags).IsDeleted() {
+		return kv, true, nil
+	}
+	val, err := h.Encode(dbiName, kv.Key, kv.Value)
+	if err != nil {
+		return kv, false, ErrEntry{DBIName: dbiName, Key: kv.Key, Err: fmt.Errorf("hook encode: %w", err)}
+	}
+	kv.Value = val
+	return kv, true, nil
+}
+
+// decodeDBI applies the Decode method of the hook of a DBI to all entries
+// of a snapshot DBI, before they are merged into the LMDB.
+func (s *Syncer) decodeDBI(dbiMsg *snapshot.DBI) (*snapshot.DBI, error) {
+	dbiName := dbiMsg.Name()
+	h, err := s.dbiHook(dbiName, dbiMsg.Transform())
+	if err != nil || h == nil {
+		return dbiMsg, err
+	}
+	return dbiMsg.Map(dbiMsg.Transform(), func(kv snapshot.KV) (snapshot.KV, error) {
+		if header.Flags(kv.Flags).IsDeleted() {
+			return kv, nil
+		}
+		val, err := h.Decode(dbiName, kv.Key, kv.Value)
+		if err != nil {
+			return kv, ErrEntry{DBIName: dbiName, Key: kv.Key, Err: fmt.Errorf("hook decode: %w", err)}
+		}
+		kv.Value = val
+		return kv, nil
+	})
+}
+
+// encodeDBI redacts the entries of a snapshot DBI that was read from the
+// LMDB and applies the Encode method of the hook of the DBI to them.
+func (s *Syncer) encodeDBI(dbiMsg *snapshot.DBI) (*snapshot.DBI, error) {
+	dbiName := dbiMsg.Name()
+	h, err := s.dbiHook(dbiName, dbiMsg.Transform())
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.dbiRedactor(dbiName, dbiMsg.Transform())
+	if err != nil {
+		return nil, err
+	}
+	if h == nil && r == nil {
+		return dbiMsg, nil
+	}
+	newDBI := snapshot.NewDBISize(dbiMsg.Size())
+	newDBI.SetName(dbiName)
+	newDBI.SetFlags(dbiMsg.Flags())
+	newDBI.SetTransform(dbiMsg.Transform())
+	dbiMsg.ResetCursor()
+	for {
+		kv, err := dbiMsg.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		kv, ok, err := encodeKV(r, h, dbiName, kv)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			newDBI.Append(kv)
+		}
+	}
+	return newDBI, nil
+}
@@ -0,0 +1,150 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer/schema"
+)
+
+// reverseHook stores the values reversed in snapshots
+type reverseHook struct{}
+
+func (reverseHook) Encode(dbiName string, key, value []byte) ([]byte, error) {
+	return reverse(value), nil
+}
+
+func (reverseHook) Decode(dbiName string, key, value []byte) ([]byte, error) {
+	return reverse(value), nil
+}
+
+func reverse(value []byte) []byte {
+	res := make([]byte, len(value))
+	for i, c := range value {
+		res[len(value)-1-i] = c
+	}
+	return res
+}
+
+func init() {
+	schema.Register("test-reverse", reverseHook{})
+}
+
+func TestSyncer_hooks(t *testing.T) {
+	ts1 := testTS(1)
+	ts2 := testTS(2)
+
+	lc := config.LMDB{
+		DBIOptions: map[string]config.DBIOptions{
+			"foo": {Hook: "test-reverse"},
+		},
+	}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		s, err := New("test", env, nil, config.Config{}, lc, Options{})
+		require.NoError(t, err)
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			ctx := context.Background()
+			dbi, err := txn.OpenDBI("foo", lmdb.Create)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(dbi, b("a"), b("abc"), 0))
+			require.NoError(t, s.mainToShadow(ctx, txn, ts1))
+
+			// Values are encoded in snapshots
+			shadowDBIName, err := s.shadowDBIName("foo")
+			require.NoError(t, err)
+			dbiMsg, err := s.readDBI(txn, shadowDBIName, "foo", false, nil, nil, nil)
+			require.NoError(t, err)
+			dbiMsg, err = s.encodeDBI(dbiMsg)
+			require.NoError(t, err)
+			kvs, err := dbiMsg.AsInefficientKVList()
+			require.NoError(t, err)
+			require.Len(t, kvs, 1)
+			assert.Equal(t, "cba", string(kvs[0].Value))
+
+			// Values are decoded from snapshots
+			remote := snapshot.NewDBI()
+			remote.SetName("foo")
+			remote.Append(snapshot.KV{Key: b("a"), Value: b("zyx"), TimestampNano: uint64(ts2)})
+			sr := &snapshot.StreamReader{FormatVersion: snapshot.CurrentFormatVersion}
+			require.NoError(t, s.loadDBI(txn, s.l, sr, remote, "other"))
+			require.NoError(t, s.shadowToMain(ctx, txn))
+			val, err := txn.Get(dbi, b("a"))
+			require.NoError(t, err)
+			assert.Equal(t, "xyz", string(val))
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+
+	// Unknown hooks are rejected
+	lc.DBIOptions["foo"] = config.DBIOptions{Hook: "unknown"}
+	err = lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		_, err := New("test", env, nil, config.Config{}, lc, Options{})
+		return err
+	})
+	assert.ErrorContains(t, err, "dbi_options.foo.hook")
+}
+
+func TestSyncer_redact(t *testing.T) {
+	ts1 := testTS(1)
+
+	lc := config.LMDB{
+		DBIOptions: map[string]config.DBIOptions{
+			"foo": {
+				Hook: "test-reverse",
+				Redact: []config.RedactRule{
+					{KeyPrefix: "secret", Action: "drop"},
+					{KeyPrefix: "token", Replacement: "xxx"},
+				},
+			},
+		},
+	}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		s, err := New("test", env, nil, config.Config{}, lc, Options{})
+		require.NoError(t, err)
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			ctx := context.Background()
+			dbi, err := txn.OpenDBI("foo", lmdb.Create)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(dbi, b("name"), b("abc"), 0))
+			require.NoError(t, txn.Put(dbi, b("secret"), b("s3cret"), 0))
+			require.NoError(t, txn.Put(dbi, b("token"), b("t0ken"), 0))
+			require.NoError(t, s.mainToShadow(ctx, txn, ts1))
+
+			// Values are redacted before the hook encodes them
+			shadowDBIName, err := s.shadowDBIName("foo")
+			require.NoError(t, err)
+			dbiMsg, err := s.readDBI(txn, shadowDBIName, "foo", false, nil, nil, nil)
+			require.NoError(t, err)
+			dbiMsg, err = s.encodeDBI(dbiMsg)
+			require.NoError(t, err)
+			kvs, err := dbiMsg.AsInefficientKVList()
+			require.NoError(t, err)
+			require.Len(t, kvs, 2)
+			assert.Equal(t, "name", string(kvs[0].Key))
+			assert.Equal(t, "cba", string(kvs[0].Value))
+			assert.Equal(t, "token", string(kvs[1].Key))
+			assert.Equal(t, "xxx", string(kvs[1].Value))
+
+			// The same when streamed
+			var buf bytes.Buffer
+			sw, err := snapshot.NewStreamWriter(&buf, snapshot.Compression{},
+				snapshot.CurrentFormatVersion, snapshot.CurrentFormatVersion)
+			require.NoError(t, err)
+			n, err := s.streamDBI(txn, shadowDBIName, "foo", nil, nil, nil, sw)
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
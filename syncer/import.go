@@ -0,0 +1,103 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv/dbiflags"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// Importer writes entries from an LMDB without headers, like an mdb_dump of a
+// legacy database, into the synced DBIs of an LMDB. With
+// schema_tracks_changes, the values get a header with the import timestamp.
+// Otherwise they are written as is, and Finish updates the shadow DBIs with
+// the import timestamp. Existing entries with the same key are overwritten.
+// It implements the Exporter interface, so that Export can copy from another
+// LMDB.
+type Importer struct {
+	txn        *lmdb.Txn
+	lc         config.LMDB
+	ts         header.Timestamp
+	withHeader func([]byte) []byte
+
+	dbi     lmdb.DBI
+	dbiName string
+	skip    bool
+
+	// Counts is the number of entries written per DBI
+	Counts map[string]int
+
+	// Skipped are the DBIs that were skipped, because they are not synced
+	Skipped []string
+}
+
+// NewImporter returns an Importer that writes to the LMDB of the transaction
+// with the given timestamp
+func NewImporter(txn *lmdb.Txn, lc config.LMDB, ts header.Timestamp) *Importer {
+	return &Importer{
+		txn:        txn,
+		lc:         lc,
+		ts:         ts,
+		withHeader: headerPrefixer(lc, ts, header.TxnID(txn.ID())),
+		Counts:     make(map[string]int),
+	}
+}
+
+// StartDBI opens or creates a DBI with the given flags. Entries of the main
+// DBI, the Lightning Stream DBIs and the DBIs that are excluded from sync are
+// skipped.
+func (im *Importer) StartDBI(name string, flags uint) error {
+	im.skip = name == "" || strings.HasPrefix(name, SyncDBIPrefix) || !im.lc.IsDBIIncluded(name)
+	if im.skip {
+		im.Skipped = append(im.Skipped, name)
+		return nil
+	}
+	if im.lc.SchemaTracksChanges && flags&lmdb.DupSort > 0 {
+		return fmt.Errorf("dbi %s: flags %q are not supported with schema_tracks_changes",
+			name, dbiflags.Flags(flags))
+	}
+	dbi, err := im.txn.OpenDBI(name, flags|lmdb.Create)
+	if err != nil {
+		return fmt.Errorf("dbi %s: %w", name, err)
+	}
+	im.dbi, im.dbiName = dbi, name
+	if _, exists := im.Counts[name]; !exists {
+		im.Counts[name] = 0
+	}
+	return nil
+}
+
+// Put writes an entry to the current DBI
+func (im *Importer) Put(key, val []byte) error {
+	if im.skip {
+		return nil
+	}
+	if im.lc.SchemaTracksChanges {
+		val = im.withHeader(val)
+	}
+	if err := im.txn.Put(im.dbi, key, val, 0); err != nil {
+		return fmt.Errorf("key %s: %w", utils.DisplayASCII(key), err)
+	}
+	im.Counts[im.dbiName]++
+	return nil
+}
+
+// Finish updates the shadow DBIs of an LMDB without schema_tracks_changes,
+// so that the imported entries get the import timestamp instead of the time
+// of the next sync. It must be called before the transaction is committed.
+func (im *Importer) Finish(ctx context.Context) error {
+	if im.lc.SchemaTracksChanges {
+		return nil
+	}
+	s := &Syncer{
+		lc: im.lc,
+		l:  logrus.StandardLogger(),
+	}
+	return s.mainToShadow(ctx, im.txn, im.ts)
+}
@@ -0,0 +1,112 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+func TestImporter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("schema_tracks_changes", func(t *testing.T) {
+		lc := config.LMDB{SchemaTracksChanges: true, ExcludeDBIs: []string{"excluded"}}
+		err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+			return env.Update(func(txn *lmdb.Txn) error {
+				im := NewImporter(txn, lc, testTS(5))
+				for _, name := range []string{"foo", "excluded", SyncDBIState, ""} {
+					require.NoError(t, im.StartDBI(name, 0))
+					require.NoError(t, im.Put(b("a"), b("va")))
+				}
+				require.NoError(t, im.StartDBI("empty", lmdb.ReverseKey))
+				require.NoError(t, im.Finish(ctx))
+				assert.Equal(t, map[string]int{"foo": 1, "empty": 0}, im.Counts)
+				assert.Equal(t, []string{"excluded", SyncDBIState, ""}, im.Skipped)
+
+				dbi, err := txn.OpenDBI("foo", 0)
+				require.NoError(t, err)
+				val, err := txn.Get(dbi, b("a"))
+				require.NoError(t, err)
+				h, appVal, err := header.Parse(val)
+				require.NoError(t, err)
+				assert.Equal(t, testTS(5), h.Timestamp)
+				assert.Equal(t, "va", string(appVal))
+
+				exists, err := lmdbenv.DBIExists(txn, "excluded")
+				require.NoError(t, err)
+				assert.False(t, exists)
+
+				// Not supported in native mode
+				assert.Error(t, im.StartDBI("dup", lmdb.DupSort))
+				return nil
+			})
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("shadow", func(t *testing.T) {
+		lc := config.LMDB{}
+		err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+			return env.Update(func(txn *lmdb.Txn) error {
+				im := NewImporter(txn, lc, testTS(5))
+				require.NoError(t, im.StartDBI("foo", 0))
+				require.NoError(t, im.Put(b("a"), b("va")))
+				require.NoError(t, im.Finish(ctx))
+
+				dbi, err := txn.OpenDBI("foo", 0)
+				require.NoError(t, err)
+				val, err := txn.Get(dbi, b("a"))
+				require.NoError(t, err)
+				assert.Equal(t, "va", string(val))
+
+				shadow, err := txn.OpenDBI(SyncDBIShadowPrefix+"foo", 0)
+				require.NoError(t, err)
+				val, err = txn.Get(shadow, b("a"))
+				require.NoError(t, err)
+				h, appVal, err := header.Parse(val)
+				require.NoError(t, err)
+				assert.Equal(t, testTS(5), h.Timestamp)
+				assert.Equal(t, "va", string(appVal))
+				return nil
+			})
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("from LMDB", func(t *testing.T) {
+		lc := config.LMDB{SchemaTracksChanges: true}
+		err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+			return env.Update(func(txn *lmdb.Txn) error {
+				src, err := txn.OpenDBI("src", lmdb.Create)
+				require.NoError(t, err)
+				require.NoError(t, txn.Put(src, b("k"), b("v"), 0))
+
+				// Export from a plain LMDB, which is the same LMDB here
+				im := NewImporter(txn, lc, testTS(5))
+				counts, err := Export(txn, config.LMDB{IncludeDBIs: []string{"src"}}, false,
+					&renamingExporter{Exporter: im, prefix: "dst"})
+				require.NoError(t, err)
+				assert.Equal(t, map[string]int{"src": 1}, counts)
+				assert.Equal(t, map[string]int{"dstsrc": 1}, im.Counts)
+				return nil
+			})
+		})
+		assert.NoError(t, err)
+	})
+}
+
+// renamingExporter adds a prefix to the DBI names
+type renamingExporter struct {
+	Exporter
+	prefix string
+}
+
+func (e *renamingExporter) StartDBI(name string, flags uint) error {
+	return e.Exporter.StartDBI(e.prefix+name, flags)
+}
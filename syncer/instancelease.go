@@ -0,0 +1,76 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/atomic"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// ErrInstanceLeaseLost is returned by Sync when the lease on the instance
+// name expired or was taken by another process.
+var ErrInstanceLeaseLost = errors.New("lease on the instance name lost")
+
+// holdInstanceLease waits until this process holds the lease on the instance
+// name, and keeps renewing it in the background until stop is called, which
+// releases it. The returned context is cancelled when the lease is lost, in
+// which case stop returns ErrInstanceLeaseLost. The lease is held until stop
+// is called, even after ctx is cancelled, to cover the final snapshot on
+// shutdown.
+func (s *Syncer) holdInstanceLease(ctx context.Context) (leaseCtx context.Context, stop func() error, err error) {
+	ls := s.instanceLease
+	interval := s.c.Storage.InstanceLease.LeaseDuration / 3
+	for {
+		held, err := ls.TryAcquire(ctx, time.Now())
+		if held {
+			break
+		}
+		if err != nil {
+			if utils.IsCanceled(ctx) {
+				return nil, nil, ctx.Err()
+			}
+			s.l.WithError(err).Warn("Acquiring the lease on the instance name failed")
+		} else {
+			s.l.WithField("owner", ls.Owner()).
+				Error("Another process is using this instance name, waiting for its lease to expire")
+		}
+		if err := utils.SleepContext(ctx, interval); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var lost atomic.Bool
+	go func() {
+		defer close(done)
+		_ = ls.Run(runCtx) // releases the lease when cancelled
+	}()
+	go func() {
+		for {
+			if err := utils.SleepContext(runCtx, interval); err != nil {
+				return
+			}
+			if !ls.Held() {
+				s.l.WithField("owner", ls.Owner()).
+					Error("Stopping sync, the lease on the instance name was lost")
+				lost.Store(true)
+				cancel()
+				return
+			}
+		}
+	}()
+	stop = func() error {
+		cancel()
+		cancelRun()
+		<-done
+		if lost.Load() {
+			return ErrInstanceLeaseLost
+		}
+		return nil
+	}
+	return leaseCtx, stop, nil
+}
@@ -0,0 +1,72 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/syncer/lease"
+)
+
+func TestSyncer_holdInstanceLease(t *testing.T) {
+	st := memory.New()
+	conf := config.LeaderElection{
+		Enabled:       true,
+		LeaseDuration: 300 * time.Millisecond,
+		SettleDelay:   10 * time.Millisecond,
+	}
+	newSyncer := func(owner string) *Syncer {
+		env, tmp, err := createLMDB(t)
+		require.NoError(t, err)
+		c := createConfig("same", tmp, true)
+		c.Storage.InstanceLease = conf
+		s, err := New("default", env, st, c, c.LMDBs[testLMDBName], Options{})
+		require.NoError(t, err)
+		require.NotNil(t, s.instanceLease)
+		// The owner is the generation, which is the same within a process
+		s.instanceLease = lease.NewInstance(st, "default", "same", owner, conf, s.l)
+		return s
+	}
+	a := newSyncer("a")
+	b := newSyncer("b")
+
+	ctx := context.Background()
+	ctxA, stopA, err := a.holdInstanceLease(ctx)
+	require.NoError(t, err)
+
+	// b waits while a holds the lease
+	ctxTimeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, _, err = b.holdInstanceLease(ctxTimeout)
+	assert.Error(t, err)
+	assert.NoError(t, ctxA.Err())
+
+	// Released by a, b takes over
+	require.NoError(t, stopA())
+	_, stopB, err := b.holdInstanceLease(ctx)
+	require.NoError(t, err)
+
+	// a loses the lease when it is taken by another process
+	require.NoError(t, stopB())
+	ctxA, stopA, err = a.holdInstanceLease(ctx)
+	require.NoError(t, err)
+	other := lease.NewInstance(st, "default", "same", "other", conf, a.l)
+	// The renewal by a can recreate the lease between the two calls
+	require.Eventually(t, func() bool {
+		if err := st.Delete(ctx, lease.InstanceName("default", "same")); err != nil {
+			return false
+		}
+		ok, err := other.TryAcquire(ctx, time.Now())
+		return err == nil && ok
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-ctxA.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("sync not stopped after losing the lease")
+	}
+	assert.ErrorIs(t, stopA(), ErrInstanceLeaseLost)
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"powerdns.com/platform/lightningstream/lmdbenv/header"
 	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer/conflict"
+	"powerdns.com/platform/lightningstream/utils"
 )
 
 func NewNativeIterator(
@@ -58,8 +60,30 @@ type NativeIterator struct {
 	FormatVersion        uint32           // Snapshot FormatVersion
 	HeaderPaddingBlock   bool             // Extra padding block for testing
 
+	// PurgedBefore is the cutoff of the last tombstone GC run. Missing deleted
+	// entries older than this are not added again, because they were purged.
+	PurgedBefore header.Timestamp
+
+	// Resolver is an optional conflict resolver for remote snapshot entries.
+	// DBIName and RemoteInstance are passed to it.
+	Resolver       conflict.Resolver
+	DBIName        string
+	RemoteInstance string
+
+	// Conflicts counts the entries passed to the Resolver
+	Conflicts int
+
+	// Stats counts the changes made by merging a remote snapshot
+	Stats MergeCounts
+
+	// OnConflict is called for every remote entry that differs from the
+	// local entry, with the side that won, see conflict.WinnerLocal.
+	// The data of the Conflict is only valid during the call.
+	OnConflict func(c conflict.Conflict, winner string)
+
 	current int
 	started bool
+	count   int
 	buf     []byte
 	curKV   snapshot.KV
 }
@@ -76,9 +100,15 @@ func (it *NativeIterator) Next() (key []byte, err error) {
 		return nil, err // can be io.EOF
 	}
 	it.curKV = kv
+	it.count++
 	return kv.Key, nil
 }
 
+// Count returns the number of entries returned by Next so far
+func (it *NativeIterator) Count() int {
+	return it.count
+}
+
 // Merge compares the old LMDB value currently stored and the current iterator
 // value from the dump, and decides which value the LMDB should take.
 // The LMDB entries are always prefixed with a header.
@@ -87,7 +117,12 @@ func (it *NativeIterator) Merge(oldval []byte) (val []byte, err error) {
 	entryVal := entry.Value
 	//logrus.Debug("key = %s | old = %s | new = %s",
 	//	string(entry.Key), string(oldval), string(entryVal))
+	newDeleted := entry.MaskedFlags().IsDeleted() || (len(entryVal) == 0 && it.FormatVersion < 2)
 	if len(oldval) == 0 {
+		if entry.MaskedFlags().IsDeleted() && header.Timestamp(entry.TimestampNano) < it.PurgedBefore {
+			return nil, nil // purged tombstone, do not recreate
+		}
+		it.Stats.add(true, nil, newDeleted, entryVal)
 		// Not in destination db, add with header
 		return it.addHeader(
 			entryVal,
@@ -105,6 +140,13 @@ func (it *NativeIterator) Merge(oldval []byte) (val []byte, err error) {
 	oldTS := h.Timestamp
 	newTS := header.Timestamp(entry.TimestampNano)
 	actualOldVal := appVal
+	if it.Resolver != nil && newTS != 0 {
+		return it.resolve(oldval, h, appVal)
+	}
+	// A remote entry that differs from the local one, which is not the case
+	// for a main to shadow copy
+	oldDeleted := h.Flags.IsDeleted()
+	diverged := newTS != 0 && (oldDeleted != newDeleted || !bytes.Equal(actualOldVal, entryVal))
 	if newTS == 0 {
 		// Special handling for main to shadow copy that uses a default timestamp
 		if bytes.Equal(actualOldVal, entryVal) {
@@ -112,19 +154,122 @@ func (it *NativeIterator) Merge(oldval []byte) (val []byte, err error) {
 		}
 		newTS = it.DefaultTimestampNano
 	}
-	if newTS < oldTS {
-		// Current LMDB value has a higher timestamp, so keep that one
-		return oldval, nil
-	}
-	if newTS == oldTS && bytes.Compare(actualOldVal, entryVal) <= 0 {
-		// Same timestamp, lexicographic lower app value wins for deterministic values,
-		// so return the old value if the plain value was lower or equal.
+	if newTS < oldTS || (newTS == oldTS && bytes.Compare(actualOldVal, entryVal) <= 0) {
+		// Current LMDB value has a higher timestamp, so keep that one.
+		// With the same timestamp, lexicographic lower app value wins for
+		// deterministic values, so return the old value if the plain value
+		// was lower or equal.
+		if diverged {
+			it.Stats.LocalWon++
+			it.reportConflict(h, appVal, conflict.WinnerLocal)
+		}
 		return oldval, nil
 	}
 	// Update LMDB value
+	if diverged {
+		it.Stats.RemoteWon++
+		it.reportConflict(h, appVal, conflict.WinnerRemote)
+	}
+	it.Stats.add(oldDeleted, actualOldVal, newDeleted, entryVal)
 	return it.addHeader(entryVal, newTS, entry.MaskedFlags(), false)
 }
 
+// resolve merges a remote entry with the existing LMDB value using the
+// Resolver. Entries that only differ in their timestamp are not a conflict,
+// the newest timestamp is kept as usual.
+func (it *NativeIterator) resolve(oldval []byte, h header.Header, appVal []byte) ([]byte, error) {
+	entry := it.curKV
+	remoteFlags := entry.MaskedFlags()
+	local, remote := it.conflictEntries(h, appVal)
+	if local.Deleted == remote.Deleted && bytes.Equal(local.Value, remote.Value) {
+		if remote.Timestamp > local.Timestamp {
+			return it.addHeader(remote.Value, remote.Timestamp, remoteFlags, false)
+		}
+		return oldval, nil
+	}
+
+	it.Conflicts++
+	c := it.newConflict(local, remote)
+	res, err := it.Resolver.Resolve(c)
+	if err != nil {
+		return nil, fmt.Errorf("conflict resolution for key %s: %w",
+			utils.DisplayASCII(entry.Key), err)
+	}
+	if res.Equal(local) {
+		it.Stats.LocalWon++
+		if it.OnConflict != nil {
+			it.OnConflict(c, conflict.WinnerLocal)
+		}
+		return oldval, nil
+	}
+	var flags header.Flags
+	winner := conflict.WinnerRemote
+	if res.Equal(remote) {
+		flags = remoteFlags
+		it.Stats.RemoteWon++
+	} else {
+		if res.Deleted {
+			flags = header.FlagDeleted
+		}
+		it.Stats.Resolved++
+		winner = conflict.WinnerResolved
+	}
+	if res.Timestamp == 0 {
+		return nil, fmt.Errorf("conflict resolution for key %s: no timestamp",
+			utils.DisplayASCII(entry.Key))
+	}
+	if it.OnConflict != nil {
+		it.OnConflict(c, winner)
+	}
+	it.Stats.add(local.Deleted, local.Value, res.Deleted, res.Value)
+	return it.addHeader(res.Value, res.Timestamp, flags, false)
+}
+
+// conflictEntries returns the local entry with header h and the current
+// remote entry
+func (it *NativeIterator) conflictEntries(h header.Header, appVal []byte) (local, remote conflict.Entry) {
+	entry := it.curKV
+	remoteFlags := entry.MaskedFlags()
+	local = conflict.Entry{
+		Value:     appVal,
+		Timestamp: h.Timestamp,
+		Deleted:   h.Flags.IsDeleted(),
+	}
+	remote = conflict.Entry{
+		Value:     entry.Value,
+		Timestamp: header.Timestamp(entry.TimestampNano),
+		Deleted:   remoteFlags.IsDeleted() || (len(entry.Value) == 0 && it.FormatVersion < 2),
+	}
+	if local.Deleted {
+		local.Value = nil
+	}
+	if remote.Deleted {
+		remote.Value = nil
+	}
+	return local, remote
+}
+
+// newConflict returns the Conflict for the current remote entry
+func (it *NativeIterator) newConflict(local, remote conflict.Entry) conflict.Conflict {
+	return conflict.Conflict{
+		DBI:            it.DBIName,
+		Key:            it.curKV.Key,
+		Local:          local,
+		Remote:         remote,
+		RemoteInstance: it.RemoteInstance,
+	}
+}
+
+// reportConflict calls OnConflict, if set, for the current remote entry that
+// differs from the local entry with header h
+func (it *NativeIterator) reportConflict(h header.Header, appVal []byte, winner string) {
+	if it.OnConflict == nil {
+		return
+	}
+	local, remote := it.conflictEntries(h, appVal)
+	it.OnConflict(it.newConflict(local, remote), winner)
+}
+
 func (it *NativeIterator) Clean(oldval []byte) (val []byte, err error) {
 	// Clean effectively instructs us to delete the entry
 	h, _, err := header.Parse(oldval)
@@ -0,0 +1,271 @@
+// Package lease implements a lease stored in the storage backend, which is
+// used to elect a single instance to run cluster-wide tasks.
+package lease
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// Name returns the name of the lease blob for an LMDB. It does not match
+// the snapshot name prefix of the LMDB.
+func Name(lmdbName string) string {
+	return lmdbName + ".lease"
+}
+
+// record is the content of the lease blob
+type record struct {
+	Owner   string    `json:"owner"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// InstanceName returns the name of the lease blob on an instance name for an
+// LMDB, see NewInstance.
+func InstanceName(lmdbName, instance string) string {
+	return lmdbName + ".instance-lease__" + instance
+}
+
+// New creates a Lease with given blob name for the owner, which is typically
+// the instance name.
+func New(st simpleblob.Interface, name, owner string, conf config.LeaderElection, logger logrus.FieldLogger) *Lease {
+	return &Lease{
+		st:          st,
+		name:        name,
+		owner:       owner,
+		conf:        conf,
+		l:           logger.WithField("component", "lease"),
+		acquiredMsg: "Acquired lease, this instance is now the leader",
+		lostMsg:     "Lost lease, this instance is no longer the leader",
+	}
+}
+
+// NewInstance creates a Lease on the instance name for an LMDB, which
+// ensures that only one process uses the instance name. The owner must be
+// unique per process.
+func NewInstance(st simpleblob.Interface, lmdbName, instance, owner string, conf config.LeaderElection, logger logrus.FieldLogger) *Lease {
+	ls := New(st, InstanceName(lmdbName, instance), owner, conf, logger)
+	ls.acquiredMsg = "Acquired lease on the instance name"
+	ls.lostMsg = "Lost lease on the instance name, another process may be using it"
+	return ls
+}
+
+// Lease is a lease on a blob in the storage backend. If the backend supports
+// conditional writes, like S3 and GCS, the lease is only written if nobody
+// else wrote it since we loaded it. Otherwise, the lease is best-effort: it
+// is taken by writing it and reading it back after the SettleDelay, which
+// relies on read-after-write consistency of the storage backend and cannot
+// rule out two holders if the writes are slower than that.
+//
+// Held is safe for concurrent use, the other methods are not.
+type Lease struct {
+	st    simpleblob.Interface
+	name  string
+	owner string
+	conf  config.LeaderElection
+	l     logrus.FieldLogger
+
+	// Logged when the lease is acquired or lost
+	acquiredMsg string
+	lostMsg     string
+
+	// token is the token of our last successful write
+	token string
+
+	// bestEffort is set once the storage backend turned out not to support
+	// conditional writes
+	bestEffort bool
+
+	// expires is the expiry time of the lease we hold, zero if not held
+	expires atomic.Time
+
+	// lastOwner is the owner of the lease as last seen
+	lastOwner atomic.String
+}
+
+// Held returns true if we hold the lease and it has not expired.
+func (ls *Lease) Held() bool {
+	return time.Now().Before(ls.expires.Load())
+}
+
+// Owner returns the owner of the lease as last seen by TryAcquire, which is
+// empty if nobody held it.
+func (ls *Lease) Owner() string {
+	return ls.lastOwner.Load()
+}
+
+// Run keeps trying to acquire or renew the lease until the context is
+// cancelled, after which the lease is released if we hold it.
+func (ls *Lease) Run(ctx context.Context) error {
+	defer func() {
+		// The ctx is already cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := ls.Release(ctx); err != nil {
+			ls.l.WithError(err).Warn("Releasing lease failed")
+		}
+	}()
+	for {
+		if _, err := ls.TryAcquire(ctx, time.Now()); err != nil {
+			if utils.IsCanceled(ctx) {
+				return ctx.Err()
+			}
+			ls.l.WithError(err).Warn("Lease acquisition failed")
+		}
+		if err := utils.SleepContext(ctx, ls.conf.LeaseDuration/3); err != nil {
+			return err
+		}
+	}
+}
+
+// TryAcquire acquires or renews the lease and returns true if we hold it.
+// It fails if another owner holds a lease that has not expired at now.
+func (ls *Lease) TryAcquire(ctx context.Context, now time.Time) (bool, error) {
+	cur, version, err := ls.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	if cur != nil && cur.Owner != ls.owner && now.Before(cur.Expires) {
+		ls.setHeld(time.Time{}, cur.Owner)
+		return false, nil
+	}
+	// A renewal of an unexpired lease does not need to settle, because
+	// other instances do not write it until it has expired.
+	renew := cur != nil && cur.Token == ls.token && now.Before(cur.Expires)
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return false, err
+	}
+	rec := record{
+		Owner:   ls.owner,
+		Token:   hex.EncodeToString(token),
+		Expires: now.Add(ls.conf.LeaseDuration),
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return false, err
+	}
+	if !ls.bestEffort {
+		err := conditional.StoreIf(ctx, ls.st, ls.name, data, version)
+		if errors.Is(err, conditional.ErrPreconditionFailed) {
+			// Another instance wrote it since we loaded it
+			ls.setHeld(time.Time{}, "")
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	} else if err := ls.st.Store(ctx, ls.name, data); err != nil {
+		return false, err
+	}
+	if !renew && ls.bestEffort {
+		// Another instance may have written it at the same time, in which
+		// case the last write wins for both of us.
+		if err := utils.SleepContext(ctx, ls.conf.SettleDelay); err != nil {
+			return false, err
+		}
+		cur, _, err = ls.load(ctx)
+		if err != nil {
+			return false, err
+		}
+		if cur == nil || cur.Token != rec.Token {
+			owner := ""
+			if cur != nil {
+				owner = cur.Owner
+			}
+			ls.setHeld(time.Time{}, owner)
+			return false, nil
+		}
+	}
+	ls.token = rec.Token
+	ls.setHeld(rec.Expires, ls.owner)
+	return true, nil
+}
+
+// Release removes the lease if we hold it, so that another instance can
+// take over without waiting for it to expire.
+func (ls *Lease) Release(ctx context.Context) error {
+	token := ls.token
+	if token == "" {
+		return nil
+	}
+	ls.token = ""
+	ls.expires.Store(time.Time{})
+	metricHeld.WithLabelValues(ls.name).Set(0)
+	cur, _, err := ls.load(ctx)
+	if err != nil {
+		return err
+	}
+	if cur == nil || cur.Token != token {
+		return nil // already taken over
+	}
+	ls.l.Info("Releasing lease")
+	return ls.st.Delete(ctx, ls.name)
+}
+
+// setHeld updates the expiry time of the lease we hold, and logs a change
+// of owner.
+func (ls *Lease) setHeld(expires time.Time, owner string) {
+	wasHeld := !ls.expires.Load().IsZero()
+	ls.expires.Store(expires)
+	ls.lastOwner.Store(owner)
+	isHeld := !expires.IsZero()
+	if isHeld {
+		metricHeld.WithLabelValues(ls.name).Set(1)
+	} else {
+		metricHeld.WithLabelValues(ls.name).Set(0)
+	}
+	switch {
+	case isHeld && !wasHeld:
+		metricAcquired.WithLabelValues(ls.name).Inc()
+		ls.l.Info(ls.acquiredMsg)
+	case !isHeld && wasHeld:
+		ls.token = ""
+		ls.l.WithField("owner", owner).Warn(ls.lostMsg)
+	}
+}
+
+// load loads the current lease record, or nil if there is none, and the
+// version of the blob for a conditional write. The version is empty if
+// there is no blob, or if the backend does not support conditional writes.
+func (ls *Lease) load(ctx context.Context) (*record, string, error) {
+	var data []byte
+	var version string
+	var err error
+	if !ls.bestEffort {
+		data, version, err = conditional.LoadVersion(ctx, ls.st, ls.name)
+		if errors.Is(err, conditional.ErrUnsupported) {
+			ls.bestEffort = true
+			ls.l.Warn("Storage backend does not support conditional writes, the lease is best-effort")
+		}
+	}
+	if ls.bestEffort {
+		data, err = ls.st.Load(ctx, ls.name)
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	rec := new(record)
+	if err := json.Unmarshal(data, rec); err != nil {
+		// Treat like an expired lease, so that it gets overwritten
+		ls.l.WithError(err).Warn("Ignoring invalid lease")
+		return nil, version, nil
+	}
+	return rec, version, nil
+}
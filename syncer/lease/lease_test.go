@@ -0,0 +1,159 @@
+package lease
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/backends/conditional"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+var testConf = config.LeaderElection{
+	Enabled:       true,
+	LeaseDuration: time.Minute,
+	SettleDelay:   10 * time.Millisecond,
+}
+
+// versioned adds conditional writes to a memory backend, with a counter per
+// blob as the version
+type versioned struct {
+	*memory.Backend
+	mu       sync.Mutex
+	versions map[string]int
+}
+
+func newVersioned() *versioned {
+	return &versioned{Backend: memory.New(), versions: make(map[string]int)}
+}
+
+func (b *versioned) LoadVersion(ctx context.Context, name string) ([]byte, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := b.Load(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, strconv.Itoa(b.versions[name]), nil
+}
+
+func (b *versioned) StoreIf(ctx context.Context, name string, data []byte, version string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cur := ""
+	if _, err := b.Load(ctx, name); err == nil {
+		cur = strconv.Itoa(b.versions[name])
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if cur != version {
+		return conditional.ErrPreconditionFailed
+	}
+	b.versions[name]++
+	return b.Store(ctx, name, data)
+}
+
+func TestLease(t *testing.T) {
+	t.Run("best-effort", func(t *testing.T) {
+		testLease(t, memory.New(), true)
+	})
+	t.Run("conditional", func(t *testing.T) {
+		testLease(t, newVersioned(), false)
+	})
+}
+
+func testLease(t *testing.T, st simpleblob.Interface, bestEffort bool) {
+	ctx := context.Background()
+	a := New(st, Name("test"), "a", testConf, logrus.New())
+	b := New(st, Name("test"), "b", testConf, logrus.New())
+	now := time.Now()
+
+	ok, err := a.TryAcquire(ctx, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, a.Held())
+	assert.Equal(t, bestEffort, a.bestEffort)
+
+	ok, err = b.TryAcquire(ctx, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, b.Held())
+
+	// Renewal
+	ok, err = a.TryAcquire(ctx, now.Add(30*time.Second))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = b.TryAcquire(ctx, now.Add(time.Minute+time.Second))
+	require.NoError(t, err)
+	assert.False(t, ok, "renewed lease not expired yet")
+
+	// Expired, b takes over
+	ok, err = b.TryAcquire(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = a.TryAcquire(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, a.Held())
+
+	// Released, a takes over immediately
+	require.NoError(t, b.Release(ctx))
+	assert.False(t, b.Held())
+	ok, err = a.TryAcquire(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// Release is a no-op for b now
+	require.NoError(t, b.Release(ctx))
+	ok, err = b.TryAcquire(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestLease_concurrent(t *testing.T) {
+	conf := testConf
+	conf.SettleDelay = 100 * time.Millisecond
+	t.Run("best-effort", func(t *testing.T) {
+		testLeaseConcurrent(t, memory.New(), conf)
+	})
+	// The settle delay is not used with conditional writes
+	conf.SettleDelay = time.Hour
+	t.Run("conditional", func(t *testing.T) {
+		testLeaseConcurrent(t, newVersioned(), conf)
+	})
+}
+
+func testLeaseConcurrent(t *testing.T, st simpleblob.Interface, conf config.LeaderElection) {
+	ctx := context.Background()
+
+	owners := []string{"a", "b", "c", "d"}
+	results := make([]bool, len(owners))
+	var wg sync.WaitGroup
+	for i, owner := range owners {
+		wg.Add(1)
+		go func(i int, owner string) {
+			defer wg.Done()
+			ls := New(st, Name("test"), owner, conf, logrus.New())
+			ok, err := ls.TryAcquire(ctx, time.Now())
+			assert.NoError(t, err)
+			results[i] = ok
+		}(i, owner)
+	}
+	wg.Wait()
+
+	n := 0
+	for _, ok := range results {
+		if ok {
+			n++
+		}
+	}
+	assert.Equal(t, 1, n, "exactly one owner must get the lease")
+}
@@ -0,0 +1,27 @@
+package lease
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricHeld = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_lease_held",
+			Help: "1 if this instance holds the lease, 0 if not",
+		},
+		[]string{"lease"},
+	)
+	metricAcquired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_lease_acquired_total",
+			Help: "Number of times this instance acquired the lease",
+		},
+		[]string{"lease"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricHeld)
+	prometheus.MustRegister(metricAcquired)
+}
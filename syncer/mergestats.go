@@ -0,0 +1,90 @@
+package syncer
+
+import (
+	"bytes"
+	"sort"
+
+	"powerdns.com/platform/lightningstream/status"
+)
+
+// MergeCounts counts the changes made by merging a remote snapshot into a
+// DBI, and the conflicts with local entries that had a different value.
+type MergeCounts struct {
+	Added   int // new or undeleted entries
+	Updated int // entries with a changed value
+	Deleted int // entries deleted
+
+	// Conflicts by the side that won: the local entry, the remote entry,
+	// or a different value returned by the conflict resolver
+	LocalWon  int
+	RemoteWon int
+	Resolved  int
+}
+
+// add counts the change of an entry from the old to the new state
+func (c *MergeCounts) add(oldDeleted bool, oldVal []byte, newDeleted bool, newVal []byte) {
+	switch {
+	case oldDeleted && !newDeleted:
+		c.Added++
+	case !oldDeleted && newDeleted:
+		c.Deleted++
+	case !oldDeleted && !bytes.Equal(oldVal, newVal):
+		c.Updated++
+	}
+}
+
+// Conflicts returns the total number of conflicts
+func (c MergeCounts) Conflicts() int {
+	return c.LocalWon + c.RemoteWon + c.Resolved
+}
+
+// changes returns the total number of changed entries
+func (c MergeCounts) changes() int {
+	return c.Added + c.Updated + c.Deleted
+}
+
+// recordMergeStats adds the counts of a merged DBI to the metrics and the
+// totals returned by MergeStats
+func (s *Syncer) recordMergeStats(dbiName string, c MergeCounts) {
+	changes := metricDBIMergeChanges.MustCurryWith(map[string]string{"lmdb": s.name, "dbi": dbiName})
+	changes.WithLabelValues("added").Add(float64(c.Added))
+	changes.WithLabelValues("updated").Add(float64(c.Updated))
+	changes.WithLabelValues("deleted").Add(float64(c.Deleted))
+	conflicts := metricDBIMergeConflicts.MustCurryWith(map[string]string{"lmdb": s.name, "dbi": dbiName})
+	conflicts.WithLabelValues("local").Add(float64(c.LocalWon))
+	conflicts.WithLabelValues("remote").Add(float64(c.RemoteWon))
+	conflicts.WithLabelValues("resolved").Add(float64(c.Resolved))
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if s.mergeStats == nil {
+		s.mergeStats = make(map[string]*status.MergeStats)
+	}
+	st := s.mergeStats[dbiName]
+	if st == nil {
+		st = &status.MergeStats{DBI: dbiName}
+		s.mergeStats[dbiName] = st
+	}
+	st.Added += int64(c.Added)
+	st.Updated += int64(c.Updated)
+	st.Deleted += int64(c.Deleted)
+	st.Conflicts += int64(c.Conflicts())
+	st.LocalWon += int64(c.LocalWon)
+	st.RemoteWon += int64(c.RemoteWon)
+	st.Resolved += int64(c.Resolved)
+}
+
+// MergeStats returns the totals of the changes and conflicts per DBI caused
+// by merging remote snapshots since the start, sorted by DBI name
+func (s *Syncer) MergeStats() []status.MergeStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	res := make([]status.MergeStats, 0, len(s.mergeStats))
+	for _, st := range s.mergeStats {
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].DBI < res[j].DBI
+	})
+	return res
+}
@@ -0,0 +1,90 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/status"
+	"powerdns.com/platform/lightningstream/syncer/conflict"
+)
+
+func TestSyncer_mergeStats(t *testing.T) {
+	ts1 := testTS(1)
+	ts2 := testTS(2)
+	ts3 := testTS(3)
+
+	logPath := filepath.Join(t.TempDir(), "conflicts.jsonl")
+	conflictLog, err := conflict.OpenAuditLog(logPath)
+	require.NoError(t, err)
+	defer func() {
+		_ = conflictLog.Close()
+	}()
+
+	var s *Syncer
+	err = lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		var err error
+		s, err = New("test", env, nil, config.Config{}, config.LMDB{}, Options{ConflictLog: conflictLog})
+		require.NoError(t, err)
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			ctx := context.Background()
+			dbi, err := txn.OpenDBI("foo", lmdb.Create)
+			require.NoError(t, err)
+			for _, k := range []string{"a", "b", "d", "e"} {
+				require.NoError(t, txn.Put(dbi, b(k), b("local"), 0))
+			}
+			require.NoError(t, s.mainToShadow(ctx, txn, ts2))
+
+			d := snapshot.NewDBI()
+			d.SetName("foo")
+			d.Append(snapshot.KV{Key: b("a"), Value: b("new"), TimestampNano: uint64(ts3)})
+			d.Append(snapshot.KV{Key: b("b"), TimestampNano: uint64(ts3), Flags: uint32(header.FlagDeleted)})
+			d.Append(snapshot.KV{Key: b("c"), Value: b("new"), TimestampNano: uint64(ts1)})
+			d.Append(snapshot.KV{Key: b("d"), Value: b("old"), TimestampNano: uint64(ts1)})
+			d.Append(snapshot.KV{Key: b("e"), Value: b("local"), TimestampNano: uint64(ts3)})
+			sr := &snapshot.StreamReader{FormatVersion: snapshot.CurrentFormatVersion}
+			require.NoError(t, s.loadDBI(txn, s.l, sr, d, "other"))
+			return nil
+		})
+	})
+	require.NoError(t, err)
+
+	// The same value with a newer timestamp is neither a change nor a conflict
+	assert.Equal(t, []status.MergeStats{{
+		DBI:       "foo",
+		Added:     1,
+		Updated:   1,
+		Deleted:   1,
+		Conflicts: 3,
+		LocalWon:  1,
+		RemoteWon: 2,
+	}}, s.MergeStats())
+
+	// Conflicts are written to the conflict log
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	var winners []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec conflict.AuditRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		assert.Equal(t, "test", rec.LMDB)
+		assert.Equal(t, "foo", rec.DBI)
+		assert.Equal(t, "other", rec.RemoteInstance)
+		assert.Equal(t, conflict.StrategyLastWriterWins, rec.Strategy)
+		assert.Equal(t, uint64(ts2), rec.Local.Timestamp)
+		assert.NotEmpty(t, rec.Local.SHA256)
+		winners = append(winners, string(rec.Key)+"="+rec.Winner)
+	}
+	assert.Equal(t, []string{"a=remote", "b=remote", "d=local"}, winners)
+}
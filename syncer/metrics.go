@@ -29,6 +29,48 @@ var (
 		},
 		[]string{"lmdb"},
 	)
+	metricSnapshotsDelta = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_snapshots_generated_delta_total",
+			Help: "Number of generated snapshots that were delta snapshots",
+		},
+		[]string{"lmdb"},
+	)
+	metricSnapshotsTriggered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_snapshots_triggered_total",
+			Help: "Number of snapshots of local changes written by the snapshot_trigger, by reason",
+		},
+		[]string{"lmdb", "reason"},
+	)
+	metricChangeFeedTruncated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_changefeed_truncated_total",
+			Help: "Number of local changes not published to the change feed, because a snapshot had more than max_changes",
+		},
+		[]string{"lmdb"},
+	)
+	metricImportedChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_imported_changes_total",
+			Help: "Number of external changes imported into the LMDB",
+		},
+		[]string{"lmdb"},
+	)
+	metricSnapshotsSkippedUnchanged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_snapshots_skipped_unchanged_total",
+			Help: "Number of generated snapshots not stored, because the data was the same as in the last snapshot",
+		},
+		[]string{"lmdb"},
+	)
+	metricZoneFilterSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_zone_filter_skipped_total",
+			Help: "Number of entries of PowerDNS zones skipped by the zone filter, by stage (send or load) and reason (excluded or unknown zone)",
+		},
+		[]string{"lmdb", "stage", "reason"},
+	)
 	metricSnapshotsStoreFailed = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "lightningstream_syncer_snapshots_store_failed_attempts_total",
@@ -55,6 +97,239 @@ var (
 			Help: "Number of bytes stored successfully",
 		},
 	)
+	metricSnapshotsGeneratedDBIEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_syncer_snapshots_generated_last_dbi_entries",
+			Help: "Number of entries per DBI in last generated snapshot",
+		},
+		[]string{"lmdb", "dbi"},
+	)
+	metricSnapshotsMerged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_snapshots_merged_total",
+			Help: "Number of remote snapshots merged successfully by instance",
+		},
+		[]string{"lmdb", "syncer_instance"},
+	)
+	metricSnapshotsMergedLastTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_syncer_snapshots_merged_last_unix_seconds",
+			Help: "UNIX timestamp of last successful merge of a snapshot by instance",
+		},
+		[]string{"lmdb", "syncer_instance"},
+	)
+	metricSnapshotsMergedLastSnapshotTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_syncer_snapshots_merged_last_snapshot_unix_seconds",
+			Help: "UNIX timestamp of last merged snapshot by instance, as recorded in the snapshot name",
+		},
+		[]string{"lmdb", "syncer_instance"},
+	)
+	metricSnapshotsMergeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lightningstream_syncer_snapshots_merge_duration_seconds",
+			Help:    "Time it took to merge a remote snapshot, including shadow DBI updates",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+		},
+		[]string{"lmdb"},
+	)
+	metricShadowSyncDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lightningstream_syncer_shadow_sync_duration_seconds",
+			Help:    "Time it took to sync between main and shadow DBIs by direction",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+		},
+		[]string{"lmdb", "direction"},
+	)
+	metricDBIEntriesMerged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_dbi_entries_merged_total",
+			Help: "Number of entries from remote snapshots merged per DBI",
+		},
+		[]string{"lmdb", "dbi"},
+	)
+	metricClockBackwards = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_clock_backwards_total",
+			Help: "Number of times the local clock was found to have gone backwards",
+		},
+		[]string{"lmdb"},
+	)
+	metricClockSkew = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_syncer_clock_skew_seconds",
+			Help: "How far the timestamp of the last snapshot loaded from an instance was in the future",
+		},
+		[]string{"lmdb", "syncer_instance"},
+	)
+	metricClockSkewExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_clock_skew_exceeded_total",
+			Help: "Number of snapshots loaded from an instance with a timestamp more than max_skew in the future",
+		},
+		[]string{"lmdb", "syncer_instance"},
+	)
+	metricPostApplyCommandFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_post_apply_command_failed_total",
+			Help: "Number of times the post_apply_command failed or timed out",
+		},
+		[]string{"lmdb"},
+	)
+	metricTombstonesPurged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_tombstones_purged_total",
+			Help: "Number of deleted entries purged by the tombstone GC per DBI",
+		},
+		[]string{"lmdb", "dbi"},
+	)
+	metricBackupsStored = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_backups_stored_total",
+			Help: "Number of scheduled backups stored",
+		},
+		[]string{"lmdb"},
+	)
+	metricBackupsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_backups_failed_total",
+			Help: "Number of scheduled backups that failed",
+		},
+		[]string{"lmdb"},
+	)
+	metricBackupsRemoved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_backups_removed_total",
+			Help: "Number of old backups removed by the backup retention",
+		},
+		[]string{"lmdb"},
+	)
+	metricBackupsLastTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_syncer_backups_last_unix_seconds",
+			Help: "UNIX timestamp of the last stored backup",
+		},
+		[]string{"lmdb"},
+	)
+	metricBackupsLastSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_syncer_backups_last_size_bytes",
+			Help: "Size of the last stored backup in bytes",
+		},
+		[]string{"lmdb"},
+	)
+	metricCompactedInstances = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_compacted_instances_total",
+			Help: "Number of stale instances whose snapshots were compacted",
+		},
+		[]string{"lmdb"},
+	)
+	metricCompactionFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_compaction_failed_total",
+			Help: "Number of compaction runs that failed",
+		},
+		[]string{"lmdb"},
+	)
+	metricHeartbeatsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_heartbeats_failed_total",
+			Help: "Number of failed heartbeat writes or listings",
+		},
+		[]string{"lmdb"},
+	)
+	metricClusterInstances = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_cluster_instances",
+			Help: "Number of instances with a heartbeat by state (alive or dead)",
+		},
+		[]string{"lmdb", "state"},
+	)
+	metricClusterHeartbeatAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_cluster_instance_heartbeat_age_seconds",
+			Help: "Age of the last heartbeat of an instance",
+		},
+		[]string{"lmdb", "instance"},
+	)
+	metricClusterSnapshotAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_cluster_instance_snapshot_age_seconds",
+			Help: "Age of the last snapshot stored by an instance, according to its last heartbeat",
+		},
+		[]string{"lmdb", "instance"},
+	)
+	metricConvergenceChecksFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_convergence_checks_failed_total",
+			Help: "Number of failed convergence checks",
+		},
+		[]string{"lmdb"},
+	)
+	metricClusterDigests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_cluster_digests",
+			Help: "Number of instances with a recent digest that were compared in the last convergence check, including this one",
+		},
+		[]string{"lmdb"},
+	)
+	metricClusterDBIConverged = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_cluster_dbi_converged",
+			Help: "1 if all instances had the same data for the DBI within the convergence window, 0 if not",
+		},
+		[]string{"lmdb", "dbi"},
+	)
+	metricClusterDBIDivergence = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_cluster_dbi_divergence_seconds",
+			Help: "Time the instances have had different data for the DBI, 0 if they have the same data",
+		},
+		[]string{"lmdb", "dbi"},
+	)
+	metricAutoCompactions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_lmdb_auto_compactions_total",
+			Help: "Number of auto compactions of the LMDB by result (success, failed or skipped)",
+		},
+		[]string{"lmdb", "result"},
+	)
+	metricBulkLoadActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_syncer_bulk_load_active",
+			Help: "1 while the initial bulk load of an empty LMDB is in progress",
+		},
+		[]string{"lmdb"},
+	)
+	metricDBIMergeChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_dbi_merge_changes_total",
+			Help: "Entries added, updated or deleted per DBI by merging remote snapshots",
+		},
+		[]string{"lmdb", "dbi", "change"},
+	)
+	metricDBIMergeConflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_dbi_merge_conflicts_total",
+			Help: "Remote entries that differed from the local entry per DBI, by the side that won",
+		},
+		[]string{"lmdb", "dbi", "winner"},
+	)
+	metricSnapshotsMergedByCompression = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_snapshots_merged_by_compression_total",
+			Help: "Number of remote snapshots merged, by the compression they were written with",
+		},
+		[]string{"lmdb", "compression"},
+	)
+	metricSnapshotsStaged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_syncer_snapshots_staged_total",
+			Help: "Number of large snapshots decompressed to a staging file before merging",
+		},
+		[]string{"lmdb"},
+	)
 )
 
 func init() {
@@ -64,8 +339,47 @@ func init() {
 	prometheus.MustRegister(metricSnapshotsLoaded)
 	prometheus.MustRegister(metricSnapshotsLastTimestamp)
 	prometheus.MustRegister(metricSnapshotsLastSize)
+	prometheus.MustRegister(metricSnapshotsDelta)
 	prometheus.MustRegister(metricSnapshotsStoreFailed)
 	prometheus.MustRegister(metricSnapshotsStoreFailedPermanently)
 	prometheus.MustRegister(metricSnapshotsStoreCalls)
 	prometheus.MustRegister(metricSnapshotsStoreBytes)
+	prometheus.MustRegister(metricSnapshotsGeneratedDBIEntries)
+	prometheus.MustRegister(metricSnapshotsMerged)
+	prometheus.MustRegister(metricSnapshotsMergedLastTimestamp)
+	prometheus.MustRegister(metricSnapshotsMergedLastSnapshotTimestamp)
+	prometheus.MustRegister(metricSnapshotsMergeDuration)
+	prometheus.MustRegister(metricShadowSyncDuration)
+	prometheus.MustRegister(metricDBIEntriesMerged)
+	prometheus.MustRegister(metricAutoCompactions)
+	prometheus.MustRegister(metricTombstonesPurged)
+	prometheus.MustRegister(metricClockBackwards)
+	prometheus.MustRegister(metricClockSkew)
+	prometheus.MustRegister(metricClockSkewExceeded)
+	prometheus.MustRegister(metricPostApplyCommandFailed)
+	prometheus.MustRegister(metricBackupsStored)
+	prometheus.MustRegister(metricBackupsFailed)
+	prometheus.MustRegister(metricBackupsRemoved)
+	prometheus.MustRegister(metricBackupsLastTimestamp)
+	prometheus.MustRegister(metricBackupsLastSize)
+	prometheus.MustRegister(metricCompactedInstances)
+	prometheus.MustRegister(metricCompactionFailed)
+	prometheus.MustRegister(metricHeartbeatsFailed)
+	prometheus.MustRegister(metricClusterInstances)
+	prometheus.MustRegister(metricClusterHeartbeatAge)
+	prometheus.MustRegister(metricConvergenceChecksFailed)
+	prometheus.MustRegister(metricClusterDigests)
+	prometheus.MustRegister(metricClusterDBIConverged)
+	prometheus.MustRegister(metricClusterDBIDivergence)
+	prometheus.MustRegister(metricClusterSnapshotAge)
+	prometheus.MustRegister(metricBulkLoadActive)
+	prometheus.MustRegister(metricSnapshotsStaged)
+	prometheus.MustRegister(metricSnapshotsMergedByCompression)
+	prometheus.MustRegister(metricSnapshotsTriggered)
+	prometheus.MustRegister(metricSnapshotsSkippedUnchanged)
+	prometheus.MustRegister(metricChangeFeedTruncated)
+	prometheus.MustRegister(metricImportedChanges)
+	prometheus.MustRegister(metricZoneFilterSkipped)
+	prometheus.MustRegister(metricDBIMergeChanges)
+	prometheus.MustRegister(metricDBIMergeConflicts)
 }
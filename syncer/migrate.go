@@ -0,0 +1,95 @@
+package syncer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/dbiflags"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// AddHeaders prefixes every value in the synced DBIs of an LMDB with a header
+// with the given timestamp, to migrate an LMDB that was written without
+// headers to schema_tracks_changes. The values are not checked for an
+// existing header, so this must only be done once.
+// It returns the number of values updated per DBI. DupSort DBIs are not
+// supported with headers.
+func AddHeaders(txn *lmdb.Txn, lc config.LMDB, ts header.Timestamp) (map[string]int, error) {
+	dbiNames, err := lmdbenv.ReadDBINames(txn)
+	if err != nil {
+		return nil, err
+	}
+	withHeader := headerPrefixer(lc, ts, header.TxnID(txn.ID()))
+
+	counts := make(map[string]int)
+	for _, dbiName := range dbiNames {
+		if strings.HasPrefix(dbiName, SyncDBIPrefix) || !lc.IsDBIIncluded(dbiName) {
+			continue
+		}
+		dbi, err := txn.OpenDBI(dbiName, 0)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		flags, err := txn.Flags(dbi)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		if flags&lmdb.DupSort > 0 {
+			// Not supported in native mode
+			return nil, fmt.Errorf("dbi %s: flags %q are not supported with schema_tracks_changes",
+				dbiName, dbiflags.Flags(flags))
+		}
+		n, err := addHeadersPlain(txn, dbi, withHeader)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		counts[dbiName] = n
+	}
+	return counts, nil
+}
+
+// headerPrefixer returns a function that prefixes a value with a header with
+// the given timestamp and transaction ID, in the format the LMDB uses
+func headerPrefixer(lc config.LMDB, ts header.Timestamp, txnID header.TxnID) func(val []byte) []byte {
+	return func(val []byte) []byte {
+		size := header.MinHeaderSize
+		if lc.HeaderExtraPaddingBlock {
+			size += header.BlockSize
+		}
+		b := make([]byte, size, size+len(val))
+		header.PutBasic(b, ts, txnID, header.NoFlags)
+		if lc.HeaderExtraPaddingBlock {
+			b[header.NumExtraOffsetLow] = 1
+		}
+		return append(b, val...)
+	}
+}
+
+// addHeadersPlain replaces the values of a DBI without duplicates in place
+func addHeadersPlain(txn *lmdb.Txn, dbi lmdb.DBI, withHeader func([]byte) []byte) (int, error) {
+	c, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	n := 0
+	var flag uint = lmdb.First
+	for {
+		key, val, err := c.Get(nil, nil, flag)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return n, nil
+			}
+			return 0, err
+		}
+		flag = lmdb.Next
+		if err := c.Put(key, withHeader(val), lmdb.Current); err != nil {
+			return 0, fmt.Errorf("key %s: %w", utils.DisplayASCII(key), err)
+		}
+		n++
+	}
+}
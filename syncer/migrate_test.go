@@ -0,0 +1,59 @@
+package syncer
+
+import (
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+func TestAddHeaders(t *testing.T) {
+	lc := config.LMDB{SchemaTracksChanges: true}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		return env.Update(func(txn *lmdb.Txn) error {
+			plain, err := txn.OpenDBI("plain", lmdb.Create)
+			require.NoError(t, err)
+			other, err := txn.OpenDBI("other", lmdb.Create)
+			require.NoError(t, err)
+			state, err := txn.OpenDBI(SyncDBIState, lmdb.Create)
+			require.NoError(t, err)
+			for _, k := range []string{"a", "b", "c"} {
+				require.NoError(t, txn.Put(plain, b(k), b("v"+k), 0))
+				require.NoError(t, txn.Put(other, b("k"+k), b(k), 0))
+			}
+			require.NoError(t, txn.Put(state, b("x"), b("{}"), 0))
+
+			counts, err := AddHeaders(txn, lc, testTS(1))
+			require.NoError(t, err)
+			assert.Equal(t, map[string]int{"plain": 3, "other": 3}, counts)
+
+			for _, dbi := range []lmdb.DBI{plain, other} {
+				kvs, err := lmdbenv.ReadDBI(txn, dbi)
+				require.NoError(t, err)
+				require.Len(t, kvs, 3)
+				for _, kv := range kvs {
+					h, appVal, err := header.Parse(kv.Val)
+					require.NoError(t, err)
+					assert.Equal(t, testTS(1), h.Timestamp)
+					assert.Equal(t, header.TxnID(txn.ID()), h.TxnID)
+					assert.NotEmpty(t, appVal)
+				}
+			}
+			val, err := txn.Get(state, b("x"))
+			require.NoError(t, err)
+			assert.Equal(t, "{}", string(val))
+
+			// Not supported in native mode
+			_, err = txn.OpenDBI("dup", lmdb.Create|lmdb.DupSort)
+			require.NoError(t, err)
+			_, err = AddHeaders(txn, lc, testTS(2))
+			assert.Error(t, err)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
@@ -1,6 +1,38 @@
 package syncer
 
+import (
+	"time"
+
+	"powerdns.com/platform/lightningstream/syncer/conflict"
+)
+
 type Options struct {
 	// ReceiveOnly prevents writing snapshots, we will only receive them
 	ReceiveOnly bool
+
+	// SendOnly prevents loading remote snapshots, we will only write them
+	SendOnly bool
+
+	// Until ignores all remote snapshots newer than this time, to restore
+	// the state of the LMDB at that point in time. Zero means no limit.
+	Until time.Time
+
+	// DryRun does a single pass that lists and merges the remote snapshots
+	// and prepares a local snapshot, but aborts all LMDB write transactions
+	// and does not store anything. The snapshots that would be stored and
+	// the keys that would change are logged instead. Every remote snapshot
+	// is compared to the local data separately, and changes to native
+	// DupSort DBIs are only counted.
+	DryRun bool
+
+	// VerifyOnly does a dry run that only loads the remote snapshots, and
+	// compares the state the merge would result in against the LMDB. The
+	// keys that would change are collected over all remote snapshots, and
+	// reported once at the end, and Sync returns ErrVerifyDifferences if
+	// there are any. This implies DryRun and ReceiveOnly.
+	VerifyOnly bool
+
+	// ConflictLog records every remote entry that differed from the local
+	// entry, if set
+	ConflictLog *conflict.AuditLog
 }
@@ -0,0 +1,146 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// beginReadTxns starts n read-only transactions that all see the LMDB as of
+// transaction txnID. If the LMDB changed in the meantime, they would see
+// different data, and nil is returned without error.
+// The env is always opened with MDB_NOTLS, so these can be used by other
+// goroutines than the one that started them.
+func beginReadTxns(env *lmdb.Env, txnID header.TxnID, n int) ([]*lmdb.Txn, error) {
+	var txns []*lmdb.Txn
+	for i := 0; i < n; i++ {
+		txn, err := env.BeginTxn(nil, lmdb.Readonly)
+		if err != nil {
+			abortTxns(txns)
+			return nil, err
+		}
+		txns = append(txns, txn)
+		if header.TxnID(txn.ID()) != txnID {
+			abortTxns(txns)
+			return nil, nil
+		}
+	}
+	return txns, nil
+}
+
+func abortTxns(txns []*lmdb.Txn) {
+	for _, txn := range txns {
+		txn.Abort()
+	}
+}
+
+// streamDBIsParallel reads the DBIs with one worker per read transaction, and
+// writes them to the snapshot in the original order. The transactions are
+// aborted when done.
+// At most len(txns) DBIs are held in memory at a time: a worker must acquire
+// a slot before taking the next DBI, and slots are released once a DBI has
+// been written. Because DBIs are taken in order, the next DBI to write is
+// always being read or done.
+func (s *Syncer) streamDBIsParallel(
+	ctx context.Context, txns []*lmdb.Txn, dbiNames []string,
+	base *deltaBase, changes *changeSet, filter *zoneFilter, sw *snapshot.StreamWriter, dbiEntries map[string]int,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	type result struct {
+		dbiMsg *snapshot.DBI
+		err    error
+	}
+	results := make([]chan result, len(dbiNames))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	slots := make(chan struct{}, len(txns))
+
+	var mu sync.Mutex
+	next := 0 // index of the next DBI to read
+
+	var wg sync.WaitGroup
+	for _, txn := range txns {
+		wg.Add(1)
+		go func(txn *lmdb.Txn) {
+			defer wg.Done()
+			defer txn.Abort()
+			for {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				mu.Lock()
+				i := next
+				next++
+				mu.Unlock()
+				if i >= len(dbiNames) {
+					return
+				}
+				dbiName := dbiNames[i]
+				dbiMsg, err := s.readDBI(txn, dbiName, dbiName, false, base, changes, filter)
+				if err == nil {
+					dbiMsg, err = s.encodeDBI(dbiMsg)
+				}
+				results[i] <- result{dbiMsg: dbiMsg, err: err}
+				if err != nil {
+					return
+				}
+			}
+		}(txn)
+	}
+	defer func() {
+		cancel() // stop workers waiting for a slot after an error
+		wg.Wait()
+	}()
+
+	for i, dbiName := range dbiNames {
+		var res result
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return context.Canceled
+		}
+		if res.err != nil {
+			return fmt.Errorf("dbi %s: %w", dbiName, res.err)
+		}
+		n, err := writeDBI(sw, res.dbiMsg)
+		if err != nil {
+			return fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		dbiEntries[dbiName] = n
+		<-slots
+	}
+	return nil
+}
+
+// writeDBI writes a DBI that was read into memory to the snapshot, and
+// returns the number of entries.
+func writeDBI(sw *snapshot.StreamWriter, dbiMsg *snapshot.DBI) (int, error) {
+	if err := sw.StartDBI(dbiMsg.Name(), dbiMsg.Flags(), dbiMsg.Transform()); err != nil {
+		return 0, err
+	}
+	var n int
+	dbiMsg.ResetCursor()
+	for {
+		kv, err := dbiMsg.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := sw.Append(kv); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, sw.EndDBI()
+}
@@ -0,0 +1,143 @@
+package syncer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"go.uber.org/atomic"
+
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer/pdns"
+)
+
+// zoneRecorder wraps a NativeIterator to record the PowerDNS zones of the
+// entries changed by a merge
+type zoneRecorder struct {
+	*NativeIterator
+	dbiName string
+	zones   *pdns.Zones
+}
+
+func (r *zoneRecorder) Merge(oldval []byte) ([]byte, error) {
+	before := r.Stats.changes()
+	val, err := r.NativeIterator.Merge(oldval)
+	if err == nil && r.Stats.changes() != before {
+		r.zones.AddKey(r.dbiName, r.curKV.Key)
+	}
+	return val, err
+}
+
+// registerDomainLookup registers the lookup of PowerDNS domain names in the
+// env, until the returned function is called.
+func (s *Syncer) registerDomainLookup(env *lmdb.Env) (unregister func()) {
+	var mu sync.RWMutex
+	closed := false
+	unregisterLookup := pdns.RegisterLookup(s.name, func(ids map[uint32]bool) (names map[uint32]string, err error) {
+		mu.RLock()
+		defer mu.RUnlock()
+		if closed {
+			return nil, fmt.Errorf("LMDB was closed")
+		}
+		err = env.View(func(txn *lmdb.Txn) error {
+			names, err = pdns.FindDomains(txn, ids, s.lc.SchemaTracksChanges)
+			return err
+		})
+		return names, err
+	})
+	return func() {
+		unregisterLookup()
+		mu.Lock()
+		closed = true
+		mu.Unlock()
+	}
+}
+
+// zoneFilter applies the PowerDNS zone filter to the entries of a snapshot
+// and counts the entries it skips. A nil zoneFilter includes all entries.
+type zoneFilter struct {
+	*pdns.ZoneFilter
+	stage       string // "send" or "load", for the metrics
+	skipUnknown bool   // skip entries of unknown zones
+	excluded    atomic.Int64
+	unknown     atomic.Int64
+}
+
+// newZoneFilter returns the zone filter for the LMDB of the transaction, or
+// nil if all zones are replicated. Entries of unknown zones are never sent,
+// but are merged, because their zone may be created by a later snapshot.
+func (s *Syncer) newZoneFilter(txn *lmdb.Txn, stage string) (*zoneFilter, error) {
+	if !s.c.PDNS.Zones.Enabled() {
+		return nil, nil
+	}
+	f, err := pdns.NewZoneFilter(s.c.PDNS.Zones, txn, s.lc.SchemaTracksChanges, s.name)
+	if err != nil {
+		return nil, fmt.Errorf("zone filter: %w", err)
+	}
+	return &zoneFilter{ZoneFilter: f, stage: stage, skipUnknown: stage == "send"}, nil
+}
+
+// include returns true if the entry with the key in the DBI passes the
+// filter. This is safe for concurrent use.
+func (f *zoneFilter) include(dbiName string, key []byte) bool {
+	if f == nil || !pdns.IsSchemaDBI(dbiName) {
+		return true
+	}
+	allowed, known := f.Allowed(dbiName, key)
+	if !known {
+		if f.skipUnknown {
+			f.unknown.Inc()
+			return false
+		}
+		return true
+	}
+	if !allowed {
+		f.excluded.Inc()
+	}
+	return allowed
+}
+
+// filterDBI returns a snapshot DBI with only the entries that pass the
+// filter
+func (f *zoneFilter) filterDBI(dbiMsg *snapshot.DBI) (*snapshot.DBI, error) {
+	dbiName := dbiMsg.Name()
+	if f == nil || !pdns.IsSchemaDBI(dbiName) {
+		return dbiMsg, nil
+	}
+	newDBI := snapshot.NewDBISize(dbiMsg.Size())
+	newDBI.SetName(dbiName)
+	newDBI.SetFlags(dbiMsg.Flags())
+	newDBI.SetTransform(dbiMsg.Transform())
+	dbiMsg.ResetCursor()
+	for {
+		kv, err := dbiMsg.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if f.include(dbiName, kv.Key) {
+			newDBI.Append(kv)
+		}
+	}
+	return newDBI, nil
+}
+
+// done updates the metrics with the skipped entries
+func (f *zoneFilter) done(s *Syncer) {
+	if f == nil {
+		return
+	}
+	if n := f.excluded.Load(); n > 0 {
+		metricZoneFilterSkipped.WithLabelValues(s.name, f.stage, "excluded").Add(float64(n))
+	}
+	if n := f.unknown.Load(); n > 0 {
+		metricZoneFilterSkipped.WithLabelValues(s.name, f.stage, "unknown").Add(float64(n))
+		s.l.WithField("entries", n).Warn(
+			"Zone filter: not sending entries of unknown zones, they are included in a later full snapshot once the domains are available")
+	}
+	f.excluded.Store(0)
+	f.unknown.Store(0)
+}
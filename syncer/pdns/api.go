@@ -0,0 +1,174 @@
+package pdns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultServerID is the default server_id in the API URLs
+	DefaultServerID = "localhost"
+
+	// DefaultMaxZones is the default maximum number of zones flushed one by
+	// one, before the whole cache is flushed instead
+	DefaultMaxZones = 100
+
+	// DefaultTimeout is the default timeout for a single API request
+	DefaultTimeout = 10 * time.Second
+)
+
+// APIConfig configures the calls to the PowerDNS API after remote snapshots
+// that change zones were merged.
+type APIConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// URL is the base URL of the webserver of PowerDNS, like
+	// "http://127.0.0.1:8081"
+	URL string `yaml:"url"`
+
+	// APIKey is sent in the X-API-Key header
+	APIKey string `yaml:"api_key"`
+
+	// ServerID is the server in the API URLs (default: "localhost")
+	ServerID string `yaml:"server_id"`
+
+	// Rectify rectifies the changed zones before their caches are flushed.
+	// Only needed for DNSSEC zones that are not rectified by the application
+	// that changes them. The rectify is written to the local LMDB and synced
+	// to the other instances like any other change.
+	Rectify bool `yaml:"rectify"`
+
+	// MaxZones is the maximum number of changed zones that are flushed one
+	// by one (default: 100). If more zones changed, or if the zones of
+	// changed records cannot be determined, the whole cache is flushed.
+	MaxZones int `yaml:"max_zones"`
+
+	// Timeout for a single API request (default: 10s)
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Check validates the configuration
+func (c APIConfig) Check() error {
+	if !c.Enabled {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url: must be an http or https URL")
+	}
+	if c.APIKey == "" {
+		return fmt.Errorf("api_key: required when enabled")
+	}
+	if strings.Contains(c.ServerID, "/") {
+		return fmt.Errorf("server_id: must not contain '/'")
+	}
+	if c.MaxZones < 0 {
+		return fmt.Errorf("max_zones: must not be negative")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout: must not be negative")
+	}
+	return nil
+}
+
+func (c APIConfig) withDefaults() APIConfig {
+	if c.ServerID == "" {
+		c.ServerID = DefaultServerID
+	}
+	if c.MaxZones == 0 {
+		c.MaxZones = DefaultMaxZones
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	return c
+}
+
+type apiClient struct {
+	c      APIConfig
+	l      logrus.FieldLogger
+	client *http.Client
+}
+
+func newAPIClient(c APIConfig) *apiClient {
+	return &apiClient{
+		c:      c,
+		l:      logrus.WithField("component", "pdns-api"),
+		client: &http.Client{Timeout: c.Timeout},
+	}
+}
+
+// handle rectifies and flushes the changed zones, or flushes the whole cache
+// if there are too many or not all names are known.
+func (a *apiClient) handle(ctx context.Context, names []string, unknown bool) error {
+	if unknown || len(names) > a.c.MaxZones {
+		if err := a.flush(ctx, "."); err != nil {
+			return err
+		}
+		metricFlushedAll.Inc()
+		a.l.WithField("zones", len(names)).Debug("Flushed whole PowerDNS cache")
+		return nil
+	}
+	for _, name := range names {
+		if a.c.Rectify {
+			if err := a.rectify(ctx, name); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				// Not retried, the zone may not be signed or may be gone
+				a.l.WithError(err).WithField("zone", name).Warn("PowerDNS zone rectify failed")
+			}
+		}
+		if err := a.flush(ctx, name); err != nil {
+			return err
+		}
+		metricZonesFlushed.Inc()
+	}
+	a.l.WithField("zones", names).Debug("Flushed PowerDNS cache for changed zones")
+	return nil
+}
+
+// flush flushes the cache entries of a zone and all names below it
+func (a *apiClient) flush(ctx context.Context, name string) error {
+	q := url.Values{"domain": []string{name}}
+	return a.put(ctx, "flush", "/cache/flush?"+q.Encode())
+}
+
+// rectify rectifies a zone
+func (a *apiClient) rectify(ctx context.Context, name string) error {
+	return a.put(ctx, "rectify", "/zones/"+url.PathEscape(name)+"/rectify")
+}
+
+func (a *apiClient) put(ctx context.Context, endpoint, path string) error {
+	u := strings.TrimRight(a.c.URL, "/") + "/api/v1/servers/" + url.PathEscape(a.c.ServerID) + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", a.c.APIKey)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		metricRequests.WithLabelValues(endpoint, "failure").Inc()
+		return err
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		metricRequests.WithLabelValues(endpoint, "failure").Inc()
+		return fmt.Errorf("%s: unexpected status: %s: %s",
+			endpoint, resp.Status, strings.TrimSpace(string(body)))
+	}
+	metricRequests.WithLabelValues(endpoint, "success").Inc()
+	return nil
+}
@@ -0,0 +1,85 @@
+package pdns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIConfig_Check(t *testing.T) {
+	assert.NoError(t, APIConfig{}.Check())
+	assert.NoError(t, APIConfig{Enabled: true, URL: "http://127.0.0.1:8081", APIKey: "secret"}.Check())
+	assert.Error(t, APIConfig{Enabled: true, URL: "127.0.0.1:8081", APIKey: "secret"}.Check())
+	assert.Error(t, APIConfig{Enabled: true, URL: "http://127.0.0.1:8081"}.Check())
+	assert.Error(t, APIConfig{Enabled: true, URL: "http://127.0.0.1:8081", APIKey: "secret", ServerID: "a/b"}.Check())
+	assert.Error(t, APIConfig{Enabled: true, URL: "http://127.0.0.1:8081", APIKey: "secret", MaxZones: -1}.Check())
+	assert.Error(t, Config{API: APIConfig{Enabled: true}}.Check())
+}
+
+// testServer records the API requests as "METHOD path?query"
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+	fail     map[string]int // number of times to fail by path
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ts := &testServer{fail: make(map[string]int)}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-API-Key"))
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.requests = append(ts.requests, r.Method+" "+r.URL.RequestURI())
+		if ts.fail[r.URL.Path] > 0 {
+			ts.fail[r.URL.Path]--
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"error": "failed"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"count": 1, "result": "Flushed cache."}`))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *testServer) Requests() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]string(nil), ts.requests...)
+}
+
+func TestAPIClient_handle(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t)
+	a := newAPIClient(APIConfig{URL: ts.URL + "/", APIKey: "secret", Rectify: true, MaxZones: 2}.withDefaults())
+
+	// A failed rectify does not stop the flush
+	ts.fail["/api/v1/servers/localhost/zones/example.com./rectify"] = 1
+	require.NoError(t, a.handle(ctx, []string{"example.com.", "example.org."}, false))
+	assert.Equal(t, []string{
+		"PUT /api/v1/servers/localhost/zones/example.com./rectify",
+		"PUT /api/v1/servers/localhost/cache/flush?domain=example.com.",
+		"PUT /api/v1/servers/localhost/zones/example.org./rectify",
+		"PUT /api/v1/servers/localhost/cache/flush?domain=example.org.",
+	}, ts.Requests())
+
+	// Too many zones
+	require.NoError(t, a.handle(ctx, []string{"a.example.", "b.example.", "c.example."}, false))
+	assert.Equal(t, "PUT /api/v1/servers/localhost/cache/flush?domain=.", ts.Requests()[4])
+
+	// Names of the zones unknown
+	require.NoError(t, a.handle(ctx, nil, true))
+	assert.Equal(t, "PUT /api/v1/servers/localhost/cache/flush?domain=.", ts.Requests()[5])
+	assert.Len(t, ts.Requests(), 6)
+
+	// A failed flush is an error
+	ts.fail["/api/v1/servers/localhost/cache/flush"] = 1
+	a.c.Rectify = false
+	assert.Error(t, a.handle(ctx, []string{"example.com."}, false))
+}
@@ -0,0 +1,32 @@
+package pdns
+
+import (
+	"context"
+
+	"powerdns.com/platform/lightningstream/status/webhook"
+)
+
+// eventHandler sends the changed zones to the webhooks
+type eventHandler struct{}
+
+func (eventHandler) handle(ctx context.Context, names []string, unknown bool) error {
+	webhook.Notify(webhook.Event{
+		Event:        webhook.EventZonesChanged,
+		Zones:        names,
+		ZonesUnknown: unknown,
+	})
+	return nil
+}
+
+// metricsHandler updates the per-zone metrics
+type metricsHandler struct{}
+
+func (metricsHandler) handle(ctx context.Context, names []string, unknown bool) error {
+	for _, name := range names {
+		metricZoneLastChanged.WithLabelValues(name).SetToCurrentTime()
+	}
+	if unknown {
+		metricZoneLastChanged.WithLabelValues("").SetToCurrentTime()
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package pdns
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	metricRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_pdns_api_requests_total",
+			Help: "Number of PowerDNS API requests, by endpoint (flush or rectify) and result",
+		},
+		[]string{"endpoint", "result"},
+	)
+	metricZonesFlushed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "lightningstream_pdns_api_zones_flushed_total",
+			Help: "Number of changed zones flushed from the PowerDNS cache",
+		},
+	)
+	metricFlushedAll = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "lightningstream_pdns_api_flushed_all_total",
+			Help: "Number of times the whole PowerDNS cache was flushed, because too many zones changed or their names were unknown",
+		},
+	)
+	metricErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "lightningstream_pdns_api_errors_total",
+			Help: "Number of failed attempts to flush the PowerDNS cache that are retried",
+		},
+	)
+
+	metricNotifySent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_pdns_notify_sent_total",
+			Help: "Number of DNS NOTIFY messages sent for changed zones, by result",
+		},
+		[]string{"result"},
+	)
+
+	metricZoneLastChanged = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_pdns_zone_last_changed_timestamp_seconds",
+			Help: "Time a remote snapshot last changed the zone, by zone, with an empty zone for changes to unknown zones",
+		},
+		[]string{"zone"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricRequests)
+	prometheus.MustRegister(metricZonesFlushed)
+	prometheus.MustRegister(metricFlushedAll)
+	prometheus.MustRegister(metricErrors)
+	prometheus.MustRegister(metricNotifySent)
+	prometheus.MustRegister(metricZoneLastChanged)
+}
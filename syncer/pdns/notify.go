@@ -0,0 +1,229 @@
+package pdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultNotifyTimeout is the default time to wait for the response to a
+// NOTIFY before it is sent again
+const DefaultNotifyTimeout = 2 * time.Second
+
+// DNS message constants for NOTIFY (RFC 1996)
+const (
+	dnsHeaderSize   = 12
+	dnsOpcodeNotify = 4
+	dnsFlagQR       = 1 << 15
+	dnsFlagAA       = 1 << 10
+	dnsTypeSOA      = 6
+	dnsClassIN      = 1
+)
+
+// NotifyConfig configures sending DNS NOTIFY messages to secondary name
+// servers for the zones changed by remote snapshots, so that secondaries that
+// transfer the zones with AXFR or IXFR learn about the changes immediately.
+type NotifyConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Targets are the addresses of the secondary name servers, as "host" or
+	// "host:port" (default port 53). A NOTIFY for every changed zone is sent
+	// to all of them.
+	Targets []string `yaml:"targets"`
+
+	// Source is the local IP address to send from, for secondaries that only
+	// accept a NOTIFY from the addresses of their primaries
+	Source string `yaml:"source"`
+
+	// Timeout is the time to wait for a response (default: 2s)
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retries is the number of times a NOTIFY without a response is sent
+	// again
+	Retries int `yaml:"retries"`
+}
+
+// Check validates the configuration
+func (c NotifyConfig) Check() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("targets: at least one target is required when enabled")
+	}
+	for _, t := range c.Targets {
+		if _, err := notifyTarget(t); err != nil {
+			return fmt.Errorf("targets: %w", err)
+		}
+	}
+	if c.Source != "" && net.ParseIP(c.Source) == nil {
+		return fmt.Errorf("source: not an IP address: %q", c.Source)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout: must not be negative")
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("retries: must not be negative")
+	}
+	return nil
+}
+
+func (c NotifyConfig) withDefaults() NotifyConfig {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultNotifyTimeout
+	}
+	return c
+}
+
+// notifyTarget returns the target address with the default port added
+func notifyTarget(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = strings.Trim(target, "[]"), "53"
+	}
+	if host == "" || strings.ContainsAny(host, "[]/ ") {
+		return "", fmt.Errorf("invalid target %q", target)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+type notifier struct {
+	c NotifyConfig
+	l logrus.FieldLogger
+}
+
+func newNotifier(c NotifyConfig) *notifier {
+	return &notifier{
+		c: c,
+		l: logrus.WithField("component", "pdns-notify"),
+	}
+}
+
+// handle sends a NOTIFY for every changed zone to all targets in parallel.
+// Failures are logged and counted, but not retried after the configured
+// retries, because the secondaries still find the changes when they refresh.
+func (n *notifier) handle(ctx context.Context, names []string, unknown bool) error {
+	if unknown {
+		n.l.Warn("Names of changed zones unknown, NOTIFY not sent for these")
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	var wg sync.WaitGroup
+	for _, target := range n.c.Targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			n.notifyTarget(ctx, target, names)
+		}(target)
+	}
+	wg.Wait()
+	return nil
+}
+
+// notifyTarget sends a NOTIFY for the zones to a single target
+func (n *notifier) notifyTarget(ctx context.Context, target string, names []string) {
+	addr, _ := notifyTarget(target) // validated by Check
+	l := n.l.WithField("target", addr)
+	d := net.Dialer{}
+	if n.c.Source != "" {
+		d.LocalAddr = &net.UDPAddr{IP: net.ParseIP(n.c.Source)}
+	}
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		metricNotifySent.WithLabelValues("failure").Add(float64(len(names)))
+		l.WithError(err).Warn("NOTIFY failed")
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := n.notify(conn, name); err != nil {
+			metricNotifySent.WithLabelValues("failure").Inc()
+			l.WithError(err).WithField("zone", name).Warn("NOTIFY failed")
+			continue
+		}
+		metricNotifySent.WithLabelValues("success").Inc()
+		l.WithField("zone", name).Debug("NOTIFY sent")
+	}
+}
+
+// notify sends a NOTIFY for a zone and waits for the response
+func (n *notifier) notify(conn net.Conn, name string) error {
+	id := uint16(rand.Intn(1 << 16))
+	msg, err := notifyMessage(id, name)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 512)
+	for attempt := 0; attempt <= n.c.Retries; attempt++ {
+		if _, err = conn.Write(msg); err != nil {
+			return err
+		}
+		err = readNotifyResponse(conn, id, buf, time.Now().Add(n.c.Timeout))
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return err
+		}
+	}
+	return err
+}
+
+// readNotifyResponse reads the response to the NOTIFY with the id until the
+// deadline. Other messages are ignored.
+func readNotifyResponse(conn net.Conn, id uint16, buf []byte, deadline time.Time) error {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	for {
+		size, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if size < dnsHeaderSize || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		flags := binary.BigEndian.Uint16(buf[2:])
+		if flags&dnsFlagQR == 0 || (flags>>11)&0xf != dnsOpcodeNotify {
+			continue
+		}
+		if rcode := flags & 0xf; rcode != 0 {
+			return fmt.Errorf("NOTIFY refused with rcode %d", rcode)
+		}
+		return nil
+	}
+}
+
+// notifyMessage returns a NOTIFY message for the SOA of a zone
+func notifyMessage(id uint16, name string) ([]byte, error) {
+	msg := make([]byte, dnsHeaderSize, dnsHeaderSize+len(name)+6)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], dnsOpcodeNotify<<11|dnsFlagAA)
+	binary.BigEndian.PutUint16(msg[4:], 1) // QDCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue // root zone
+		}
+		if len(label) > 63 {
+			return nil, fmt.Errorf("label too long in %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, nil
+}
@@ -0,0 +1,144 @@
+package pdns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyConfig_Check(t *testing.T) {
+	assert.NoError(t, NotifyConfig{}.Check())
+	assert.NoError(t, NotifyConfig{Enabled: true, Targets: []string{"192.0.2.1", "[2001:db8::1]:5300", "ns2.example.com:53"}}.Check())
+	assert.NoError(t, NotifyConfig{Enabled: true, Targets: []string{"2001:db8::1"}, Source: "2001:db8::2"}.Check())
+	assert.Error(t, NotifyConfig{Enabled: true}.Check())
+	assert.Error(t, NotifyConfig{Enabled: true, Targets: []string{""}}.Check())
+	assert.Error(t, NotifyConfig{Enabled: true, Targets: []string{"192.0.2.1"}, Source: "nope"}.Check())
+	assert.Error(t, NotifyConfig{Enabled: true, Targets: []string{"192.0.2.1"}, Retries: -1}.Check())
+	assert.Error(t, Config{Notify: NotifyConfig{Enabled: true}}.Check())
+}
+
+func TestNotifyTarget(t *testing.T) {
+	for target, expected := range map[string]string{
+		"192.0.2.1":          "192.0.2.1:53",
+		"192.0.2.1:5300":     "192.0.2.1:5300",
+		"2001:db8::1":        "[2001:db8::1]:53",
+		"[2001:db8::1]":      "[2001:db8::1]:53",
+		"[2001:db8::1]:5300": "[2001:db8::1]:5300",
+		"ns.example.com":     "ns.example.com:53",
+	} {
+		addr, err := notifyTarget(target)
+		assert.NoError(t, err, target)
+		assert.Equal(t, expected, addr, target)
+	}
+}
+
+func TestNotifyMessage(t *testing.T) {
+	msg, err := notifyMessage(0x1234, "example.com.")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x12, 0x34, 0x24, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, // header
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, // qname
+		0, 6, 0, 1, // SOA IN
+	}, msg)
+
+	msg, err = notifyMessage(1, ".")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 6, 0, 1}, msg[dnsHeaderSize:])
+
+	_, err = notifyMessage(1, string(make([]byte, 64))+".example.")
+	assert.Error(t, err)
+}
+
+// notifyServer is a secondary that records the zones of NOTIFY messages. The
+// first message is not answered, to test the retries.
+type notifyServer struct {
+	conn  net.PacketConn
+	mu    sync.Mutex
+	zones []string
+	rcode uint16
+}
+
+func newNotifyServer(t *testing.T) *notifyServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	ns := &notifyServer{conn: conn}
+	go func() {
+		buf := make([]byte, 512)
+		first := true
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if first {
+				first = false
+				continue
+			}
+			msg := buf[:n]
+			var labels []string
+			for i := dnsHeaderSize; i < len(msg) && msg[i] != 0; i += int(msg[i]) + 1 {
+				labels = append(labels, string(msg[i+1:i+1+int(msg[i])]))
+			}
+			ns.mu.Lock()
+			ns.zones = append(ns.zones, labels[0])
+			rcode := ns.rcode
+			ns.mu.Unlock()
+
+			// Reply with another ID first, which is ignored
+			resp := append([]byte(nil), msg...)
+			binary.BigEndian.PutUint16(resp[2:], dnsFlagQR|dnsOpcodeNotify<<11|dnsFlagAA|rcode)
+			other := append([]byte(nil), resp...)
+			other[0]++
+			_, _ = conn.WriteTo(other, addr)
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return ns
+}
+
+func (ns *notifyServer) Zones() []string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return append([]string(nil), ns.zones...)
+}
+
+func TestNotifier_handle(t *testing.T) {
+	ctx := context.Background()
+	ns1 := newNotifyServer(t)
+	ns2 := newNotifyServer(t)
+	n := newNotifier(NotifyConfig{
+		Targets: []string{ns1.conn.LocalAddr().String(), ns2.conn.LocalAddr().String()},
+		Timeout: 50 * time.Millisecond,
+		Retries: 1,
+	}.withDefaults())
+
+	require.NoError(t, n.handle(ctx, []string{"a.example.", "b.example."}, false))
+	assert.Equal(t, []string{"a", "b"}, ns1.Zones())
+	assert.Equal(t, []string{"a", "b"}, ns2.Zones())
+
+	// Refused, which is not retried
+	ns1.mu.Lock()
+	ns1.rcode = 5
+	ns1.mu.Unlock()
+	require.NoError(t, n.handle(ctx, []string{"c.example."}, false))
+	assert.Equal(t, []string{"a", "b", "c"}, ns1.Zones())
+
+	// Without any response
+	n.c.Retries = 0
+	conn, err := net.Dial("udp", ns1.conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = ns1.conn.Close()
+	assert.Error(t, n.notify(conn, "d.example."))
+}
@@ -0,0 +1,165 @@
+// Package pdns integrates with the PowerDNS Authoritative server that serves
+// the synced LMDBs with its LMDB backend.
+//
+// The zones affected by a merged remote snapshot are derived from the keys
+// of the changed entries. Their cached answers are then flushed through the
+// PowerDNS API, so that the server does not serve stale answers until its
+// caches expire, and secondary name servers can be sent a DNS NOTIFY.
+//
+// The keys are parsed according to the schema of the LMDB backend, see
+// ParseKey.
+package pdns
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+// Config configures the integration with the PowerDNS Authoritative server
+type Config struct {
+	// API flushes the caches of the zones changed by remote snapshots
+	API APIConfig `yaml:"api"`
+
+	// Notify sends a DNS NOTIFY for the zones changed by remote snapshots
+	Notify NotifyConfig `yaml:"notify"`
+
+	// Webhook sends a "zones_changed" event with the names of the zones
+	// changed by remote snapshots to the webhooks
+	Webhook bool `yaml:"webhook"`
+
+	// ZoneMetrics exports the time of the last change by a remote snapshot
+	// per zone. This adds a metric per zone, so it is only suitable for a
+	// limited number of zones.
+	ZoneMetrics bool `yaml:"zone_metrics"`
+
+	// Zones selects the zones that are replicated. Entries of other zones are
+	// not included in generated snapshots, and skipped when merging remote
+	// snapshots.
+	Zones ZoneFilterConfig `yaml:"zones"`
+}
+
+// Check validates the configuration
+func (c Config) Check() error {
+	if err := c.API.Check(); err != nil {
+		return fmt.Errorf("api.%w", err)
+	}
+	if err := c.Notify.Check(); err != nil {
+		return fmt.Errorf("notify.%w", err)
+	}
+	if err := c.Zones.Check(); err != nil {
+		return fmt.Errorf("zones.%w", err)
+	}
+	return nil
+}
+
+// Enabled returns true if the changed zones need to be tracked
+func (c Config) Enabled() bool {
+	return c.API.Enabled || c.Notify.Enabled || c.Webhook || c.ZoneMetrics
+}
+
+// Zones collects the zones affected by changed entries, by domain ID or by
+// name, depending on the DBI of the entry.
+type Zones struct {
+	IDs   map[uint32]bool
+	Names map[string]bool
+}
+
+// NewZones returns an empty Zones
+func NewZones() *Zones {
+	return &Zones{
+		IDs:   make(map[uint32]bool),
+		Names: make(map[string]bool),
+	}
+}
+
+// AddKey adds the zone of a changed entry. Keys that do not identify a zone
+// are ignored.
+func (z *Zones) AddKey(dbiName string, key []byte) {
+	k, ok := ParseKey(dbiName, key)
+	switch {
+	case !ok:
+	case k.Zone != "":
+		z.Names[k.Zone] = true
+	case k.HasDomainID:
+		z.IDs[k.DomainID] = true
+	}
+}
+
+// Merge adds the zones of other
+func (z *Zones) Merge(other *Zones) {
+	for id := range other.IDs {
+		z.IDs[id] = true
+	}
+	for name := range other.Names {
+		z.Names[name] = true
+	}
+}
+
+// Empty returns true if no zones were added
+func (z *Zones) Empty() bool {
+	return len(z.IDs) == 0 && len(z.Names) == 0
+}
+
+// FindDomains looks up the names of the domain IDs in the DomainsIndexDBI,
+// or of all domains if ids is nil. IDs that are not found are not included.
+// If the values have headers, deleted entries are skipped. It returns nil if
+// the LMDB has no domains, like a shard LMDB.
+func FindDomains(txn *lmdb.Txn, ids map[uint32]bool, headers bool) (map[uint32]string, error) {
+	return readIndex(txn, DomainsIndexDBI, ids, headers)
+}
+
+// readIndex returns the names in an index DBI by the IDs of the entries, see
+// FindDomains.
+func readIndex(txn *lmdb.Txn, dbiName string, ids map[uint32]bool, headers bool) (map[uint32]string, error) {
+	dbi, err := txn.OpenDBI(dbiName, 0)
+	if lmdb.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cur, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+	names := make(map[uint32]string)
+	for flag := uint(lmdb.First); ids == nil || len(names) < len(ids); flag = lmdb.Next {
+		key, val, err := cur.Get(nil, nil, flag)
+		if lmdb.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, id, ok := parseIndexKey(key)
+		if !ok || (ids != nil && !ids[id]) {
+			continue
+		}
+		if headers {
+			h, _, err := header.Parse(val)
+			if err != nil {
+				return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+			}
+			if h.Flags.IsDeleted() {
+				continue
+			}
+		}
+		names[id] = name
+	}
+	return names, nil
+}
+
+// sortedNames returns the names of the map in order
+func sortedNames(m map[string]bool) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
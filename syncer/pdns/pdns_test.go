@@ -0,0 +1,83 @@
+package pdns
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+// indexKey returns a key of an index DBI
+func indexKey(stored string, id uint32) []byte {
+	key := make([]byte, 2, 2+len(stored)+4)
+	binary.BigEndian.PutUint16(key, uint16(len(stored)))
+	key = append(key, stored...)
+	return binary.BigEndian.AppendUint32(key, id)
+}
+
+func TestZones_AddKey(t *testing.T) {
+	z := NewZones()
+	assert.True(t, z.Empty())
+	z.AddKey(RecordsDBI, []byte("\x00\x00\x01\x02www\x00\x00\x01"))
+	z.AddKey(DomainsDBI, []byte("\x00\x00\x00\x07"))
+	z.AddKey(DomainsIndexDBI, indexKey("org\x00example\x00", 7))
+	z.AddKey(KeydataIndexDBI, indexKey("net\x00example\x00", 12))
+	z.AddKey(DomainsIndexDBI, []byte("\x00\x10short")) // invalid
+	z.AddKey(RecordsDBI, []byte("\x00\x01"))           // invalid
+	z.AddKey(MetadataDBI, []byte("\x00\x00\x00\x09"))  // no zone
+	z.AddKey("other", []byte("\x00\x00\x00\x09"))      // ignored
+	assert.False(t, z.Empty())
+	assert.Equal(t, map[uint32]bool{0x102: true, 7: true}, z.IDs)
+	assert.Equal(t, map[string]bool{"example.org.": true, "example.net.": true}, z.Names)
+
+	other := NewZones()
+	other.AddKey(DomainsDBI, []byte("\x00\x00\x00\x08"))
+	z.Merge(other)
+	assert.Equal(t, map[uint32]bool{0x102: true, 7: true, 8: true}, z.IDs)
+}
+
+func TestFindDomains(t *testing.T) {
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		return env.Update(func(txn *lmdb.Txn) error {
+			ids := map[uint32]bool{1: true, 2: true, 3: true}
+
+			// No domains in this LMDB
+			names, err := FindDomains(txn, ids, true)
+			require.NoError(t, err)
+			assert.Nil(t, names)
+
+			dbi, err := txn.OpenDBI(DomainsIndexDBI, lmdb.Create)
+			require.NoError(t, err)
+			put := func(stored string, id uint32, flags header.Flags) {
+				val := make([]byte, header.MinHeaderSize)
+				header.PutBasic(val, header.TimestampFromTime(time.Now()), header.TxnID(txn.ID()), flags)
+				require.NoError(t, txn.Put(dbi, indexKey(stored, id), val, 0))
+			}
+			put("com\x00example\x00", 1, header.NoFlags)
+			put("org\x00example\x00", 2, header.FlagDeleted)
+			put("org\x00other\x00", 4, header.NoFlags)
+
+			names, err = FindDomains(txn, ids, true)
+			require.NoError(t, err)
+			assert.Equal(t, map[uint32]string{1: "example.com."}, names)
+
+			// Without headers, all entries exist
+			names, err = FindDomains(txn, ids, false)
+			require.NoError(t, err)
+			assert.Equal(t, map[uint32]string{1: "example.com.", 2: "example.org."}, names)
+
+			// All domains
+			names, err = FindDomains(txn, nil, true)
+			require.NoError(t, err)
+			assert.Equal(t, map[uint32]string{1: "example.com.", 4: "other.org."}, names)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
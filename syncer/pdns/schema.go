@@ -0,0 +1,198 @@
+package pdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// DBI names of the PowerDNS LMDB backend schema version 5. The DBIs with a
+// "_0" suffix are indexes, with keys that are the length of the indexed name,
+// the name and the ID of the entry in the main DBI.
+const (
+	// RecordsDBI has the records, with keys that are the domain ID, the name
+	// relative to the zone and the record type. With sharding, this DBI is
+	// in the shard LMDBs.
+	RecordsDBI = "records_v5"
+
+	// DomainsDBI has the domains by domain ID, DomainsIndexDBI indexes them
+	// by name
+	DomainsDBI      = "domains_v5"
+	DomainsIndexDBI = "domains_v5_0"
+
+	// MetadataDBI has the domain metadata by an ID of its own,
+	// MetadataIndexDBI indexes them by domain name
+	MetadataDBI      = "metadata_v5"
+	MetadataIndexDBI = "metadata_v5_0"
+
+	// KeydataDBI has the DNSSEC keys by an ID of their own, KeydataIndexDBI
+	// indexes them by domain name
+	KeydataDBI      = "keydata_v5"
+	KeydataIndexDBI = "keydata_v5_0"
+
+	// TSIGDBI has the TSIG keys, TSIGIndexDBI indexes them by key name
+	TSIGDBI      = "tsig_v5"
+	TSIGIndexDBI = "tsig_v5_0"
+)
+
+// Key is a key of the PowerDNS LMDB backend schema, parsed by ParseKey.
+// Fields that the key does not contain are empty.
+type Key struct {
+	DBI string
+
+	// DomainID is the ID of the zone, if HasDomainID
+	DomainID    uint32
+	HasDomainID bool
+
+	// Zone is the fully qualified name of the zone
+	Zone string
+
+	// QName and QType of a record. The QName is relative to the zone, and
+	// empty for the apex.
+	QName string
+	QType uint16
+
+	// ID is the ID of a metadata, DNSSEC key or TSIG key entry
+	ID uint32
+
+	// Name is the name of a TSIG key
+	Name string
+}
+
+// String returns a description of the key for display
+func (k Key) String() string {
+	var p []string
+	if k.Zone != "" {
+		p = append(p, "zone="+k.Zone)
+	}
+	if k.HasDomainID {
+		p = append(p, fmt.Sprintf("domain_id=%d", k.DomainID))
+	}
+	if k.DBI == RecordsDBI {
+		qname := k.QName
+		if qname == "" {
+			qname = "@"
+		}
+		p = append(p, "qname="+qname, "qtype="+QTypeString(k.QType))
+	}
+	if k.Name != "" {
+		p = append(p, "name="+k.Name)
+	}
+	if k.ID != 0 {
+		p = append(p, fmt.Sprintf("id=%d", k.ID))
+	}
+	return strings.Join(p, " ")
+}
+
+// IsSchemaDBI returns true if the DBI is part of the PowerDNS LMDB backend
+// schema and its keys can be parsed by ParseKey
+func IsSchemaDBI(dbiName string) bool {
+	switch dbiName {
+	case RecordsDBI, DomainsDBI, DomainsIndexDBI, MetadataDBI, MetadataIndexDBI,
+		KeydataDBI, KeydataIndexDBI, TSIGDBI, TSIGIndexDBI:
+		return true
+	}
+	return false
+}
+
+// IsZoneDBI returns true if the zone of the entries in the DBI can be derived
+// from their keys
+func IsZoneDBI(dbiName string) bool {
+	switch dbiName {
+	case RecordsDBI, DomainsDBI, DomainsIndexDBI, MetadataIndexDBI, KeydataIndexDBI:
+		return true
+	}
+	return false
+}
+
+// ParseKey parses a key of a DBI of the PowerDNS LMDB backend schema. It
+// returns false for other DBIs and invalid keys.
+func ParseKey(dbiName string, key []byte) (Key, bool) {
+	k := Key{DBI: dbiName}
+	switch dbiName {
+	case RecordsDBI:
+		if len(key) < 4+2 {
+			return k, false
+		}
+		k.DomainID, k.HasDomainID = binary.BigEndian.Uint32(key), true
+		k.QName = strings.TrimSuffix(DisplayName(key[4:len(key)-2]), ".")
+		k.QType = binary.BigEndian.Uint16(key[len(key)-2:])
+	case DomainsDBI:
+		if len(key) != 4 {
+			return k, false
+		}
+		k.DomainID, k.HasDomainID = binary.BigEndian.Uint32(key), true
+	case MetadataDBI, KeydataDBI, TSIGDBI:
+		if len(key) != 4 {
+			return k, false
+		}
+		k.ID = binary.BigEndian.Uint32(key)
+	case DomainsIndexDBI, MetadataIndexDBI, KeydataIndexDBI:
+		name, id, ok := parseIndexKey(key)
+		if !ok {
+			return k, false
+		}
+		k.Zone = name
+		if dbiName == DomainsIndexDBI {
+			k.DomainID, k.HasDomainID = id, true
+		} else {
+			k.ID = id
+		}
+	case TSIGIndexDBI:
+		name, id, ok := parseIndexKey(key)
+		if !ok {
+			return k, false
+		}
+		k.Name, k.ID = name, id
+	default:
+		return k, false
+	}
+	return k, true
+}
+
+// parseIndexKey parses a key of an index DBI
+func parseIndexKey(key []byte) (name string, id uint32, ok bool) {
+	if len(key) < 2 {
+		return "", 0, false
+	}
+	n := int(binary.BigEndian.Uint16(key))
+	if len(key) != 2+n+4 {
+		return "", 0, false
+	}
+	return DisplayName(key[2 : 2+n]), binary.BigEndian.Uint32(key[2+n:]), true
+}
+
+// DisplayName converts a domain name as stored in the LMDB backend, which are
+// the labels in reverse order separated by null bytes, to a fully qualified
+// name with a trailing dot.
+func DisplayName(stored []byte) string {
+	p := bytes.Split(stored, []byte{0})
+	var labels []string
+	for i := len(p) - 1; i >= 0; i-- {
+		if len(p[i]) == 0 {
+			continue
+		}
+		labels = append(labels, string(p[i]))
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// qtypes has the names of the common record types
+var qtypes = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 13: "HINFO", 15: "MX",
+	16: "TXT", 17: "RP", 18: "AFSDB", 28: "AAAA", 29: "LOC", 33: "SRV",
+	35: "NAPTR", 37: "CERT", 39: "DNAME", 43: "DS", 44: "SSHFP", 46: "RRSIG",
+	47: "NSEC", 48: "DNSKEY", 50: "NSEC3", 51: "NSEC3PARAM", 52: "TLSA",
+	59: "CDS", 60: "CDNSKEY", 61: "OPENPGPKEY", 64: "SVCB", 65: "HTTPS",
+	99: "SPF", 257: "CAA", 65401: "ALIAS", 65402: "LUA",
+}
+
+// QTypeString returns the name of a record type, or "TYPE" and the number
+// for unknown types (RFC 3597)
+func QTypeString(qtype uint16) string {
+	if name, ok := qtypes[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
@@ -0,0 +1,72 @@
+package pdns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisplayName(t *testing.T) {
+	assert.Equal(t, "www.example.org.", DisplayName([]byte("org\x00example\x00www\x00")))
+	assert.Equal(t, "example.org.", DisplayName([]byte("org\x00example")))
+	assert.Equal(t, ".", DisplayName([]byte("\x00")))
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		dbi      string
+		key      string
+		expected Key
+		str      string
+	}{
+		{RecordsDBI, "\x00\x00\x01\x02mail\x00www\x00\x00\x00\x01",
+			Key{DBI: RecordsDBI, DomainID: 0x102, HasDomainID: true, QName: "www.mail", QType: 1},
+			"domain_id=258 qname=www.mail qtype=A"},
+		{RecordsDBI, "\x00\x00\x00\x07\x00\x00\x06",
+			Key{DBI: RecordsDBI, DomainID: 7, HasDomainID: true, QType: 6},
+			"domain_id=7 qname=@ qtype=SOA"},
+		{DomainsDBI, "\x00\x00\x00\x07",
+			Key{DBI: DomainsDBI, DomainID: 7, HasDomainID: true},
+			"domain_id=7"},
+		{DomainsIndexDBI, string(indexKey("org\x00example\x00", 7)),
+			Key{DBI: DomainsIndexDBI, DomainID: 7, HasDomainID: true, Zone: "example.org."},
+			"zone=example.org. domain_id=7"},
+		{MetadataDBI, "\x00\x00\x00\x09",
+			Key{DBI: MetadataDBI, ID: 9},
+			"id=9"},
+		{MetadataIndexDBI, string(indexKey("org\x00example\x00", 9)),
+			Key{DBI: MetadataIndexDBI, Zone: "example.org.", ID: 9},
+			"zone=example.org. id=9"},
+		{KeydataIndexDBI, string(indexKey("org\x00example\x00", 3)),
+			Key{DBI: KeydataIndexDBI, Zone: "example.org.", ID: 3},
+			"zone=example.org. id=3"},
+		{TSIGIndexDBI, string(indexKey("transfer\x00", 4)),
+			Key{DBI: TSIGIndexDBI, Name: "transfer.", ID: 4},
+			"name=transfer. id=4"},
+	}
+	for _, tt := range tests {
+		k, ok := ParseKey(tt.dbi, []byte(tt.key))
+		assert.True(t, ok, tt.dbi)
+		assert.Equal(t, tt.expected, k, tt.dbi)
+		assert.Equal(t, tt.str, k.String(), tt.dbi)
+		assert.True(t, IsSchemaDBI(tt.dbi), tt.dbi)
+	}
+
+	for dbi, key := range map[string]string{
+		RecordsDBI:      "\x00\x00\x01",
+		DomainsDBI:      "\x00\x00\x00\x07\x00",
+		DomainsIndexDBI: "\x00\x10short",
+		TSIGDBI:         "",
+		"other":         "\x00\x00\x00\x07",
+	} {
+		_, ok := ParseKey(dbi, []byte(key))
+		assert.False(t, ok, dbi)
+	}
+	assert.False(t, IsSchemaDBI("other"))
+}
+
+func TestQTypeString(t *testing.T) {
+	assert.Equal(t, "AAAA", QTypeString(28))
+	assert.Equal(t, "ALIAS", QTypeString(65401))
+	assert.Equal(t, "TYPE1234", QTypeString(1234))
+}
@@ -0,0 +1,227 @@
+package pdns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// RetryInterval is the time between attempts to handle changed zones
+const RetryInterval = 5 * time.Second
+
+// DomainLookup returns the names of domain IDs, or of all domains if ids is
+// nil. It returns nil if the LMDB does not have the domains, see FindDomains.
+type DomainLookup func(ids map[uint32]bool) (map[uint32]string, error)
+
+// handler acts on changed zones, like the API cache flush
+type handler interface {
+	// handle handles the sorted names of the changed zones. If unknown is
+	// true, the names of some changed zones could not be determined.
+	handle(ctx context.Context, names []string, unknown bool) error
+}
+
+// worker runs a handler in the background for the zones passed to Changed.
+// The errors counter is optional.
+type worker struct {
+	name    string
+	h       handler
+	errors  prometheus.Counter
+	l       logrus.FieldLogger
+	pending *Zones
+	wake    chan struct{}
+
+	retryInterval time.Duration // for tests
+}
+
+func newWorker(name string, h handler, errors prometheus.Counter) *worker {
+	return &worker{
+		name:          name,
+		h:             h,
+		errors:        errors,
+		l:             logrus.WithField("component", "pdns-"+name),
+		wake:          make(chan struct{}, 1),
+		retryInterval: RetryInterval,
+	}
+}
+
+var (
+	mu      sync.Mutex
+	workers []*worker
+	lookups = make(map[string]DomainLookup) // by LMDB name
+)
+
+// Active returns true if changed zones are tracked
+func Active() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(workers) > 0
+}
+
+// RegisterLookup registers the DomainLookup of an LMDB that may contain the
+// domains, until the returned function is called.
+func RegisterLookup(lmdbName string, lookup DomainLookup) (unregister func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	lookups[lmdbName] = lookup
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(lookups, lmdbName)
+	}
+}
+
+// Changed queues the changed zones for all handlers. This never blocks.
+func Changed(z *Zones) {
+	if z == nil || z.Empty() {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, w := range workers {
+		w.queue(z)
+	}
+}
+
+// Start runs the configured handlers for the zones passed to Changed until
+// the context is cancelled.
+func Start(ctx context.Context, c Config) {
+	var ws []*worker
+	if c.API.Enabled {
+		ws = append(ws, newWorker("api", newAPIClient(c.API.withDefaults()), metricErrors))
+	}
+	if c.Notify.Enabled {
+		ws = append(ws, newWorker("notify", newNotifier(c.Notify.withDefaults()),
+			metricNotifySent.WithLabelValues("failure")))
+	}
+	if c.Webhook {
+		ws = append(ws, newWorker("webhook", eventHandler{}, nil))
+	}
+	if c.ZoneMetrics {
+		ws = append(ws, newWorker("metrics", metricsHandler{}, nil))
+	}
+	start(ctx, ws...)
+}
+
+// start runs the workers
+func start(ctx context.Context, ws ...*worker) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, w := range ws {
+		workers = append(workers, w)
+		go w.run(ctx)
+	}
+}
+
+// queue adds the zones to the pending zones. Must be called with mu held.
+func (w *worker) queue(z *Zones) {
+	if w.pending == nil {
+		w.pending = NewZones()
+	}
+	w.pending.Merge(z)
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending zones and the registered lookups
+func (w *worker) take() (*Zones, []DomainLookup) {
+	mu.Lock()
+	defer mu.Unlock()
+	z := w.pending
+	w.pending = nil
+	ls := make([]DomainLookup, 0, len(lookups))
+	for _, l := range lookups {
+		ls = append(ls, l)
+	}
+	return z, ls
+}
+
+// run handles the pending zones whenever zones changed. The changes of
+// snapshots merged while the handler runs are combined.
+func (w *worker) run(ctx context.Context) {
+	w.l.Info("PowerDNS zone change handler enabled")
+	defer func() {
+		mu.Lock()
+		for i, other := range workers {
+			if other == w {
+				workers = append(workers[:i], workers[i+1:]...)
+				break
+			}
+		}
+		mu.Unlock()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		}
+		z, ls := w.take()
+		if z == nil {
+			continue
+		}
+		names, unknown := w.resolve(z, ls)
+		if err := w.h.handle(ctx, names, unknown); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if w.errors != nil {
+				w.errors.Inc()
+			}
+			w.l.WithError(err).Warn("Handling changed zones failed, retrying")
+			mu.Lock()
+			w.queue(z)
+			mu.Unlock()
+			if utils.SleepContext(ctx, w.retryInterval) != nil {
+				return
+			}
+		}
+	}
+}
+
+// resolve returns the sorted names of the zones. It returns true if the names
+// of the changed domain IDs are unknown, because no LMDB with the domains is
+// available.
+func (w *worker) resolve(z *Zones, lookups []DomainLookup) (names []string, unknown bool) {
+	m := make(map[string]bool, len(z.Names)+len(z.IDs))
+	for name := range z.Names {
+		m[name] = true
+	}
+	if len(z.IDs) == 0 {
+		return sortedNames(m), false
+	}
+	found := make(map[uint32]string)
+	succeeded := 0
+	for _, lookup := range lookups {
+		res, err := lookup(z.IDs)
+		if err != nil {
+			w.l.WithError(err).Warn("Domain lookup failed")
+			continue
+		}
+		if res == nil {
+			continue
+		}
+		succeeded++
+		for id, name := range res {
+			found[id] = name
+		}
+	}
+	if succeeded == 0 {
+		return sortedNames(m), true
+	}
+	for id := range z.IDs {
+		if name, ok := found[id]; ok {
+			m[name] = true
+		} else {
+			// Deleted zones are handled by the change of their index entry
+			w.l.WithField("domain_id", id).Debug("Changed domain ID not found")
+		}
+	}
+	return sortedNames(m), false
+}
@@ -0,0 +1,94 @@
+package pdns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorker_resolve(t *testing.T) {
+	w := newWorker("test", nil, metricErrors)
+	lookup := func(ids map[uint32]bool) (map[uint32]string, error) {
+		return map[uint32]string{1: "example.com.", 2: "example.org."}, nil
+	}
+	noDomains := func(ids map[uint32]bool) (map[uint32]string, error) {
+		return nil, nil
+	}
+	failing := func(ids map[uint32]bool) (map[uint32]string, error) {
+		return nil, errors.New("closed")
+	}
+
+	// Zones by ID and name, unknown IDs are skipped
+	z := NewZones()
+	z.IDs[1] = true
+	z.IDs[3] = true
+	z.Names["example.net."] = true
+	names, unknown := w.resolve(z, []DomainLookup{noDomains, failing, lookup})
+	assert.Equal(t, []string{"example.com.", "example.net."}, names)
+	assert.False(t, unknown)
+
+	// No LMDB with the domains
+	names, unknown = w.resolve(z, []DomainLookup{noDomains, failing})
+	assert.Equal(t, []string{"example.net."}, names)
+	assert.True(t, unknown)
+
+	// No lookup needed
+	z = NewZones()
+	z.Names["example.net."] = true
+	names, unknown = w.resolve(z, nil)
+	assert.Equal(t, []string{"example.net."}, names)
+	assert.False(t, unknown)
+}
+
+func TestStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := newTestServer(t)
+	ts.fail["/api/v1/servers/ns1/cache/flush"] = 1
+
+	// Not started yet, ignored
+	z := NewZones()
+	z.Names["ignored.example."] = true
+	Changed(z)
+	assert.False(t, Active())
+
+	w := newWorker("api", newAPIClient(APIConfig{URL: ts.URL, APIKey: "secret", ServerID: "ns1"}.withDefaults()), metricErrors)
+	w.retryInterval = time.Millisecond
+	start(ctx, w)
+	assert.True(t, Active())
+
+	unregister := RegisterLookup("main", func(ids map[uint32]bool) (map[uint32]string, error) {
+		return map[uint32]string{1: "example.com."}, nil
+	})
+	defer unregister()
+
+	z = NewZones()
+	z.IDs[1] = true
+	Changed(z)
+
+	// Retried after the failure
+	assert.Eventually(t, func() bool {
+		return len(ts.Requests()) == 2
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{
+		"PUT /api/v1/servers/ns1/cache/flush?domain=example.com.",
+		"PUT /api/v1/servers/ns1/cache/flush?domain=example.com.",
+	}, ts.Requests())
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		return !Active()
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	require.NoError(t, metricsHandler{}.handle(context.Background(), []string{"example.com."}, true))
+	assert.Greater(t, testutil.ToFloat64(metricZoneLastChanged.WithLabelValues("example.com.")), 0.0)
+	assert.Greater(t, testutil.ToFloat64(metricZoneLastChanged.WithLabelValues("")), 0.0)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metricZoneLastChanged.WithLabelValues("example.org.")))
+}
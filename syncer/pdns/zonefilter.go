@@ -0,0 +1,186 @@
+package pdns
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+)
+
+// ZoneFilterConfig selects the zones that are replicated, for split-horizon
+// deployments where some zones must not leave an instance. Patterns are zone
+// names, or "*." and a zone name to match all zones below it.
+type ZoneFilterConfig struct {
+	// Include replicates only the zones that match, if not empty
+	Include []string `yaml:"include"`
+
+	// Exclude never replicates the zones that match, even if included
+	Exclude []string `yaml:"exclude"`
+}
+
+// Check validates the configuration
+func (c ZoneFilterConfig) Check() error {
+	for _, p := range c.Include {
+		if err := checkZonePattern(p); err != nil {
+			return fmt.Errorf("include: %w", err)
+		}
+	}
+	for _, p := range c.Exclude {
+		if err := checkZonePattern(p); err != nil {
+			return fmt.Errorf("exclude: %w", err)
+		}
+	}
+	return nil
+}
+
+// Enabled returns true if not all zones are replicated
+func (c ZoneFilterConfig) Enabled() bool {
+	return len(c.Include) > 0 || len(c.Exclude) > 0
+}
+
+// Allowed returns true if the zone with the fully qualified name is
+// replicated
+func (c ZoneFilterConfig) Allowed(zone string) bool {
+	zone = normalizeZone(zone)
+	if len(c.Include) > 0 && !matchZone(c.Include, zone) {
+		return false
+	}
+	return !matchZone(c.Exclude, zone)
+}
+
+func checkZonePattern(p string) error {
+	name := strings.TrimSuffix(strings.TrimPrefix(p, "*."), ".")
+	if name == "" || strings.Contains(name, "*") {
+		return fmt.Errorf("invalid zone pattern %q", p)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return fmt.Errorf("invalid zone pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// normalizeZone returns the lowercase name with a trailing dot
+func normalizeZone(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+func matchZone(patterns []string, zone string) bool {
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(zone, "."+normalizeZone(p[2:])) {
+				return true
+			}
+		} else if zone == normalizeZone(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ZoneFilter applies a ZoneFilterConfig to the entries of the PowerDNS LMDB
+// backend schema. The zone of entries that are keyed by an ID is found in
+// the index DBIs of the LMDB it was created for. The domain IDs of records
+// in a shard LMDB are resolved with the registered DomainLookup functions
+// of the other LMDBs.
+type ZoneFilter struct {
+	c ZoneFilterConfig
+
+	// Zones by the ID in the key, by DBI. A nil map means that the DBI that
+	// indexes them was not available.
+	zones map[string]map[uint32]string
+}
+
+// zoneIndexes has the index DBIs with the zone names of the entries of the
+// DBIs that are keyed by an ID
+var zoneIndexes = map[string]string{
+	DomainsDBI:  DomainsIndexDBI,
+	MetadataDBI: MetadataIndexDBI,
+	KeydataDBI:  KeydataIndexDBI,
+}
+
+// NewZoneFilter returns a ZoneFilter for the entries of the LMDB of the
+// transaction. The registered lookup of the LMDB with the name lmdbName is
+// not used, because it would need another transaction.
+func NewZoneFilter(c ZoneFilterConfig, txn *lmdb.Txn, headers bool, lmdbName string) (*ZoneFilter, error) {
+	f := &ZoneFilter{c: c, zones: make(map[string]map[uint32]string)}
+	for dbiName, indexDBIName := range zoneIndexes {
+		zones, err := readIndex(txn, indexDBIName, nil, headers)
+		if err != nil {
+			return nil, err
+		}
+		f.zones[dbiName] = zones
+	}
+	if f.zones[DomainsDBI] == nil {
+		zones, err := lookupAll(lmdbName)
+		if err != nil {
+			return nil, err
+		}
+		f.zones[DomainsDBI] = zones
+	}
+	return f, nil
+}
+
+// lookupAll returns all domains of the registered lookups, except the one of
+// the named LMDB, or nil if none has domains
+func lookupAll(except string) (map[uint32]string, error) {
+	mu.Lock()
+	var ls []DomainLookup
+	for name, l := range lookups {
+		if name != except {
+			ls = append(ls, l)
+		}
+	}
+	mu.Unlock()
+
+	var all map[uint32]string
+	for _, lookup := range ls {
+		res, err := lookup(nil)
+		if err != nil {
+			return nil, fmt.Errorf("domain lookup: %w", err)
+		}
+		if res == nil {
+			continue
+		}
+		if all == nil {
+			all = make(map[uint32]string, len(res))
+		}
+		for id, name := range res {
+			all[id] = name
+		}
+	}
+	return all, nil
+}
+
+// Allowed returns true if the entry with the key is replicated. Entries that
+// do not belong to a zone, like the TSIG keys and the entries of other DBIs,
+// are always allowed. If the zone of the entry is unknown, it returns false
+// for known, and the caller decides.
+func (f *ZoneFilter) Allowed(dbiName string, key []byte) (allowed, known bool) {
+	k, ok := ParseKey(dbiName, key)
+	if !ok {
+		return true, true
+	}
+	zone := k.Zone
+	if zone == "" {
+		var zones map[uint32]string
+		var id uint32
+		switch dbiName {
+		case RecordsDBI, DomainsDBI:
+			zones, id = f.zones[DomainsDBI], k.DomainID
+		case MetadataDBI, KeydataDBI:
+			zones, id = f.zones[dbiName], k.ID
+		default:
+			return true, true
+		}
+		if zone, ok = zones[id]; !ok {
+			return true, false
+		}
+	}
+	return f.c.Allowed(zone), true
+}
@@ -0,0 +1,96 @@
+package pdns
+
+import (
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"powerdns.com/platform/lightningstream/lmdbenv"
+)
+
+func TestZoneFilterConfig(t *testing.T) {
+	assert.NoError(t, ZoneFilterConfig{Include: []string{"example.com", "*.example.org."}}.Check())
+	assert.Error(t, ZoneFilterConfig{Include: []string{""}}.Check())
+	assert.Error(t, ZoneFilterConfig{Exclude: []string{"."}}.Check())
+	assert.Error(t, ZoneFilterConfig{Exclude: []string{"a..example"}}.Check())
+	assert.Error(t, ZoneFilterConfig{Exclude: []string{"*.*.example"}}.Check())
+	assert.Error(t, Config{Zones: ZoneFilterConfig{Exclude: []string{""}}}.Check())
+
+	c := ZoneFilterConfig{}
+	assert.False(t, c.Enabled())
+	assert.True(t, c.Allowed("example.com."))
+
+	c = ZoneFilterConfig{
+		Include: []string{"example.com", "*.example.org."},
+		Exclude: []string{"internal.example.org"},
+	}
+	assert.True(t, c.Enabled())
+	assert.True(t, c.Allowed("example.com."))
+	assert.True(t, c.Allowed("Example.COM"))
+	assert.False(t, c.Allowed("sub.example.com."))
+	assert.False(t, c.Allowed("example.org."))
+	assert.True(t, c.Allowed("a.example.org."))
+	assert.True(t, c.Allowed("a.b.example.org."))
+	assert.False(t, c.Allowed("internal.example.org."))
+	assert.False(t, c.Allowed("otherexample.org."))
+}
+
+func TestZoneFilter_Allowed(t *testing.T) {
+	c := ZoneFilterConfig{Exclude: []string{"internal.example"}}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		return env.Update(func(txn *lmdb.Txn) error {
+			// A shard LMDB without any other LMDB with the domains
+			f, err := NewZoneFilter(c, txn, false, "shard")
+			require.NoError(t, err)
+			allowed, known := f.Allowed(RecordsDBI, []byte("\x00\x00\x00\x01www\x00\x00\x01"))
+			assert.True(t, allowed)
+			assert.False(t, known)
+
+			// The domains of the main LMDB
+			defer RegisterLookup("main", func(ids map[uint32]bool) (map[uint32]string, error) {
+				assert.Nil(t, ids)
+				return map[uint32]string{1: "example.com.", 2: "internal.example."}, nil
+			})()
+			defer RegisterLookup("shard", func(ids map[uint32]bool) (map[uint32]string, error) {
+				t.Error("own lookup called")
+				return nil, nil
+			})()
+			f, err = NewZoneFilter(c, txn, false, "shard")
+			require.NoError(t, err)
+			for _, tc := range []struct {
+				dbiName string
+				key     string
+				allowed bool
+				known   bool
+			}{
+				{RecordsDBI, "\x00\x00\x00\x01www\x00\x00\x01", true, true},
+				{RecordsDBI, "\x00\x00\x00\x02www\x00\x00\x01", false, true},
+				{RecordsDBI, "\x00\x00\x00\x03www\x00\x00\x01", true, false},
+				{DomainsDBI, "\x00\x00\x00\x02", false, true},
+				{DomainsIndexDBI, string(indexKey("example\x00internal\x00", 2)), false, true},
+				{KeydataIndexDBI, string(indexKey("example\x00internal\x00", 5)), false, true},
+				{KeydataDBI, "\x00\x00\x00\x05", true, false},
+				{TSIGDBI, "\x00\x00\x00\x05", true, true},
+				{"other", "\x00\x00\x00\x02", true, true},
+			} {
+				allowed, known := f.Allowed(tc.dbiName, []byte(tc.key))
+				assert.Equal(t, tc.allowed, allowed, "%q %q", tc.dbiName, tc.key)
+				assert.Equal(t, tc.known, known, "%q %q", tc.dbiName, tc.key)
+			}
+
+			// The indexes of the LMDB itself
+			dbi, err := txn.OpenDBI(KeydataIndexDBI, lmdb.Create)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(dbi, indexKey("example\x00internal\x00", 5), nil, 0))
+			f, err = NewZoneFilter(c, txn, false, "shard")
+			require.NoError(t, err)
+			allowed, known = f.Allowed(KeydataDBI, []byte("\x00\x00\x00\x05"))
+			assert.False(t, allowed)
+			assert.True(t, known)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,140 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer/pdns"
+)
+
+func TestSyncer_loadZones(t *testing.T) {
+	ts1 := testTS(1)
+	ts2 := testTS(2)
+	recordKey := func(id byte, name string) []byte {
+		return append([]byte{0, 0, 0, id}, name...)
+	}
+
+	var s *Syncer
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		var err error
+		s, err = New("test", env, nil, config.Config{}, config.LMDB{}, Options{})
+		require.NoError(t, err)
+		s.loadZones = pdns.NewZones()
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			ctx := context.Background()
+			dbi, err := txn.OpenDBI(pdns.RecordsDBI, lmdb.Create)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(dbi, recordKey(1, "www"), b("same"), 0))
+			require.NoError(t, txn.Put(dbi, recordKey(2, "www"), b("old"), 0))
+			require.NoError(t, s.mainToShadow(ctx, txn, ts1))
+
+			sr := &snapshot.StreamReader{FormatVersion: snapshot.CurrentFormatVersion}
+			d := snapshot.NewDBI()
+			d.SetName(pdns.RecordsDBI)
+			d.Append(snapshot.KV{Key: recordKey(1, "www"), Value: b("same"), TimestampNano: uint64(ts2)})
+			d.Append(snapshot.KV{Key: recordKey(2, "www"), Value: b("new"), TimestampNano: uint64(ts2)})
+			d.Append(snapshot.KV{Key: recordKey(3, "mail"), Value: b("new"), TimestampNano: uint64(ts2)})
+			require.NoError(t, s.loadDBI(txn, s.l, sr, d, "other"))
+
+			d = snapshot.NewDBI()
+			d.SetName(pdns.DomainsIndexDBI)
+			d.Append(snapshot.KV{Key: b("\x00\x0corg\x00example\x00\x00\x00\x00\x04"), TimestampNano: uint64(ts2)})
+			require.NoError(t, s.loadDBI(txn, s.l, sr, d, "other"))
+
+			// Not a zone DBI
+			d = snapshot.NewDBI()
+			d.SetName("metadata_v5")
+			d.Append(snapshot.KV{Key: b("\x00\x00\x00\x05"), Value: b("new"), TimestampNano: uint64(ts2)})
+			return s.loadDBI(txn, s.l, sr, d, "other")
+		})
+	})
+	require.NoError(t, err)
+
+	// Unchanged entries do not change their zone
+	assert.Equal(t, &pdns.Zones{
+		IDs:   map[uint32]bool{2: true, 3: true},
+		Names: map[string]bool{"example.org.": true},
+	}, s.loadZones)
+}
+
+func TestSyncer_zoneFilter(t *testing.T) {
+	ts1 := testTS(1)
+	ts2 := testTS(2)
+	recordKey := func(id byte, name string) []byte {
+		return append([]byte{0, 0, 0, id}, name...)
+	}
+	c := config.Config{PDNS: pdns.Config{Zones: pdns.ZoneFilterConfig{
+		Exclude: []string{"internal.example"},
+	}}}
+
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		s, err := New("test", env, nil, c, config.LMDB{}, Options{})
+		require.NoError(t, err)
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			ctx := context.Background()
+			index, err := txn.OpenDBI(pdns.DomainsIndexDBI, lmdb.Create)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(index, b("\x00\x0corg\x00example\x00\x00\x00\x00\x01"), nil, 0))
+			require.NoError(t, txn.Put(index, b("\x00\x11example\x00internal\x00\x00\x00\x00\x02"), nil, 0))
+			dbi, err := txn.OpenDBI(pdns.RecordsDBI, lmdb.Create)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(dbi, recordKey(1, "www"), b("public"), 0))
+			require.NoError(t, txn.Put(dbi, recordKey(2, "www"), b("internal"), 0))
+			require.NoError(t, txn.Put(dbi, recordKey(9, "www"), b("unknown"), 0))
+			require.NoError(t, s.mainToShadow(ctx, txn, ts1))
+
+			// Entries of excluded and unknown zones are not sent
+			filter, err := s.newZoneFilter(txn, "send")
+			require.NoError(t, err)
+			dbiMsg, err := s.readDBI(txn, SyncDBIShadowPrefix+pdns.RecordsDBI, pdns.RecordsDBI, false, nil, nil, filter)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"\x00\x00\x00\x01www"}, dbiKeys(t, dbiMsg))
+			dbiMsg, err = s.readDBI(txn, SyncDBIShadowPrefix+pdns.DomainsIndexDBI, pdns.DomainsIndexDBI, false, nil, nil, filter)
+			require.NoError(t, err)
+			assert.Len(t, dbiKeys(t, dbiMsg), 1)
+			assert.EqualValues(t, 2, filter.excluded.Load())
+			assert.EqualValues(t, 1, filter.unknown.Load())
+
+			// Entries of excluded zones are not merged, unknown ones are
+			sr := &snapshot.StreamReader{FormatVersion: snapshot.CurrentFormatVersion}
+			d := snapshot.NewDBI()
+			d.SetName(pdns.RecordsDBI)
+			d.Append(snapshot.KV{Key: recordKey(1, "mail"), Value: b("new"), TimestampNano: uint64(ts2)})
+			d.Append(snapshot.KV{Key: recordKey(2, "mail"), Value: b("new"), TimestampNano: uint64(ts2)})
+			d.Append(snapshot.KV{Key: recordKey(3, "mail"), Value: b("new"), TimestampNano: uint64(ts2)})
+			require.NoError(t, s.loadDBI(txn, s.l, sr, d, "other"))
+			assert.EqualValues(t, 1, s.loadFilter.excluded.Load())
+
+			dbiMsg, err = s.readDBI(txn, SyncDBIShadowPrefix+pdns.RecordsDBI, pdns.RecordsDBI, false, nil, nil, nil)
+			require.NoError(t, err)
+			assert.Equal(t, []string{
+				"\x00\x00\x00\x01mail",
+				"\x00\x00\x00\x01www",
+				"\x00\x00\x00\x02www",
+				"\x00\x00\x00\x03mail",
+				"\x00\x00\x00\x09www",
+			}, dbiKeys(t, dbiMsg))
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+// dbiKeys returns the keys of the entries of a snapshot DBI
+func dbiKeys(t *testing.T, dbiMsg *snapshot.DBI) []string {
+	kvs, err := dbiMsg.AsInefficientKVList()
+	require.NoError(t, err)
+	var keys []string
+	for _, kv := range kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys
+}
@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/PowerDNS/go-tlsconfig"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// client streams our snapshots to a single peer
+type client struct {
+	addr  string
+	c     Config
+	creds credentials.TransportCredentials
+	queue chan *pushMessage
+	l     logrus.FieldLogger
+}
+
+func newClient(ctx context.Context, addr string, c Config) (*client, error) {
+	mgr, err := tlsconfig.NewManager(ctx, c.TLS, tlsconfig.Options{
+		IsClient: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	tlsConfig, err := mgr.TLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return &client{
+		addr:  addr,
+		c:     c,
+		creds: credentials.NewTLS(tlsConfig),
+		queue: make(chan *pushMessage, c.QueueSize),
+		l:     logrus.WithField("component", "peer").WithField("peer", addr),
+	}, nil
+}
+
+// enqueue queues a snapshot for sending. This never blocks.
+func (cl *client) enqueue(m *pushMessage) {
+	if m.size() > int(cl.c.MaxMessageSize) {
+		metricDropped.WithLabelValues(cl.addr, "too_large").Inc()
+		return
+	}
+	select {
+	case cl.queue <- m:
+	default:
+		metricDropped.WithLabelValues(cl.addr, "queue_full").Inc()
+		cl.l.WithField("snapshot_name", m.Name).Debug("Queue full, snapshot dropped")
+	}
+}
+
+// run keeps streaming snapshots to the peer until the context is cancelled.
+// Snapshots are queued for Publish while running, including while
+// reconnecting.
+func (cl *client) run(ctx context.Context) {
+	mu.Lock()
+	clients[cl] = struct{}{}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		delete(clients, cl)
+		mu.Unlock()
+	}()
+
+	cl.l.Info("Streaming snapshots to peer")
+	for ctx.Err() == nil {
+		err := cl.stream(ctx)
+		metricConnected.WithLabelValues(cl.addr).Set(0)
+		if ctx.Err() != nil {
+			break
+		}
+		metricErrors.WithLabelValues(cl.addr).Inc()
+		cl.l.WithError(err).Debug("Peer stream failed, reconnecting")
+		select {
+		case <-ctx.Done():
+		case <-time.After(RetryInterval):
+		}
+	}
+}
+
+// stream connects to the peer and sends queued snapshots until an error
+// occurs
+func (cl *client) stream(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, cl.addr,
+		grpc.WithTransportCredentials(cl.creds),
+		grpc.WithDefaultCallOptions(
+			grpc.ForceCodec(codec{}),
+			grpc.MaxCallSendMsgSize(int(cl.c.MaxMessageSize)),
+		),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                KeepaliveInterval,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &serviceDesc.Streams[0], pushMethod)
+	if err != nil {
+		return err
+	}
+	metricConnected.WithLabelValues(cl.addr).Set(1)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-cl.queue:
+			if err := stream.SendMsg(m); err != nil {
+				return err
+			}
+			metricSent.WithLabelValues(cl.addr).Inc()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/CrowdStrike/csproto"
+	"google.golang.org/grpc"
+)
+
+// Protobuf field numbers of a pushMessage
+const (
+	fieldPushLMDB = 1
+	fieldPushName = 2
+	fieldPushData = 3
+)
+
+const (
+	serviceName = "lightningstream.peer.v1.Peer"
+	pushMethod  = "/" + serviceName + "/Push"
+)
+
+// serviceDesc describes the gRPC service. It has a single client streaming
+// method, that streams snapshots to the server and returns an empty response
+// when the client closes the stream:
+//
+//	service Peer {
+//	  rpc Push(stream PushMessage) returns (PushResponse);
+//	}
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Push",
+			Handler:       handlePush,
+			ClientStreams: true,
+		},
+	},
+}
+
+// pushMessage is a snapshot pushed to a peer
+type pushMessage struct {
+	LMDB string
+	Name string
+	Data []byte
+}
+
+// size returns an upper bound of the encoded size
+func (m *pushMessage) size() int {
+	return len(m.LMDB) + len(m.Name) + len(m.Data) + 3*11 // tags and lengths
+}
+
+func (m *pushMessage) Marshal() []byte {
+	b := make([]byte, 0, m.size())
+	var tmp [16]byte
+	for _, f := range []struct {
+		num   int
+		value []byte
+	}{
+		{fieldPushLMDB, []byte(m.LMDB)},
+		{fieldPushName, []byte(m.Name)},
+		{fieldPushData, m.Data},
+	} {
+		n := csproto.EncodeTag(tmp[:], f.num, csproto.WireTypeLengthDelimited)
+		n += csproto.EncodeVarint(tmp[n:], uint64(len(f.value)))
+		b = append(b, tmp[:n]...)
+		b = append(b, f.value...)
+	}
+	return b
+}
+
+func (m *pushMessage) Unmarshal(data []byte) error {
+	d := csproto.NewDecoder(data)
+	d.SetMode(csproto.DecoderModeFast)
+	for d.More() {
+		tag, wireType, err := d.DecodeTag()
+		if err != nil {
+			return err
+		}
+		if wireType != csproto.WireTypeLengthDelimited {
+			if _, err := d.Skip(tag, wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		switch tag {
+		case fieldPushLMDB:
+			m.LMDB, err = d.DecodeString()
+		case fieldPushName:
+			m.Name, err = d.DecodeString()
+		case fieldPushData:
+			var v []byte
+			v, err = d.DecodeBytes()
+			// The buffer is owned by gRPC
+			m.Data = append([]byte(nil), v...)
+		default:
+			_, err = d.Skip(tag, wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushResponse is the empty response of the Push method
+type pushResponse struct{}
+
+// codec encodes the messages as protobuf without generated code. Both sides
+// force its use, so its name must match the content-subtype.
+type codec struct{}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case *pushMessage:
+		return m.Marshal(), nil
+	case *pushResponse:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("peer codec: unsupported type %T", v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case *pushMessage:
+		return m.Unmarshal(data)
+	case *pushResponse:
+		return nil
+	}
+	return fmt.Errorf("peer codec: unsupported type %T", v)
+}
@@ -0,0 +1,49 @@
+package peer
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	metricSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_peer_snapshots_sent_total",
+			Help: "Number of snapshots sent to a peer",
+		},
+		[]string{"peer"},
+	)
+	metricDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_peer_snapshots_dropped_total",
+			Help: "Number of snapshots not sent to a peer, by reason",
+		},
+		[]string{"peer", "reason"},
+	)
+	metricReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_peer_snapshots_received_total",
+			Help: "Number of snapshots received from peers",
+		},
+		[]string{"lmdb"},
+	)
+	metricConnected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_peer_connected",
+			Help: "1 if the stream to a peer is connected",
+		},
+		[]string{"peer"},
+	)
+	metricErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_peer_errors_total",
+			Help: "Number of failed peer streams, by peer, or 'server' for incoming streams",
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricSent)
+	prometheus.MustRegister(metricDropped)
+	prometheus.MustRegister(metricReceived)
+	prometheus.MustRegister(metricConnected)
+	prometheus.MustRegister(metricErrors)
+}
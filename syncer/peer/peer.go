@@ -0,0 +1,187 @@
+// Package peer implements a direct replication transport, where instances
+// stream the snapshots they stored to each other over gRPC with mutual TLS.
+//
+// This is meant for deployments that need replication latencies well below
+// the storage poll interval, like two instances in different datacenters.
+// The storage remains the source of truth: snapshots are only pushed after
+// they were stored, and instances that were not connected, or snapshots that
+// were dropped, are picked up from the storage as before.
+package peer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PowerDNS/go-tlsconfig"
+	"github.com/c2h5oh/datasize"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxMessageSize is the default maximum size of a pushed snapshot
+	DefaultMaxMessageSize = 64 * datasize.MB
+
+	// DefaultQueueSize is the default number of snapshots queued per peer
+	DefaultQueueSize = 16
+
+	// RetryInterval is the time between connection attempts to a peer
+	RetryInterval = 2 * time.Second
+
+	// KeepaliveInterval is the time after which an idle connection is
+	// checked, so that dead connections are detected quickly.
+	KeepaliveInterval = 30 * time.Second
+)
+
+// Config configures the peer-to-peer streaming of snapshots
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Listen is the address to accept snapshots from peers on, like ":7890".
+	// If empty, snapshots are only sent.
+	Listen string `yaml:"listen"`
+
+	// Peers are the addresses of the instances to send our snapshots to,
+	// like "lightningstream.dc2.example.com:7890".
+	Peers []string `yaml:"peers"`
+
+	// TLS configures the certificates for both the server and the client
+	// connections. A CA and a certificate and key are required, and the
+	// certificate must be valid for both server and client authentication.
+	// See https://github.com/PowerDNS/go-tlsconfig for the available options
+	TLS tlsconfig.Config `yaml:"tls"`
+
+	// MaxMessageSize is the maximum size of a snapshot to push and accept
+	// (default: 64 MB). Larger snapshots are only replicated through the
+	// storage.
+	MaxMessageSize datasize.ByteSize `yaml:"max_message_size"`
+
+	// QueueSize is the number of snapshots queued per peer while sending is
+	// slower than storing (default: 16). Snapshots that do not fit are
+	// dropped, and picked up from the storage by the peer.
+	QueueSize int `yaml:"queue_size"`
+}
+
+// Check validates the configuration
+func (c Config) Check() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Listen == "" && len(c.Peers) == 0 {
+		return fmt.Errorf("one of listen or peers is required when enabled")
+	}
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+	}
+	for _, addr := range c.Peers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("peers: %w", err)
+		}
+	}
+	if c.TLS.CA == "" && c.TLS.CAFile == "" {
+		return fmt.Errorf("tls: a ca or ca_file is required for mutual TLS")
+	}
+	if c.TLS.Cert == "" && c.TLS.CertFile == "" {
+		return fmt.Errorf("tls: a cert or cert_file is required for mutual TLS")
+	}
+	if c.TLS.Key == "" && c.TLS.KeyFile == "" {
+		return fmt.Errorf("tls: a key or key_file is required for mutual TLS")
+	}
+	if c.MaxMessageSize < 0 || c.QueueSize < 0 {
+		return fmt.Errorf("max_message_size and queue_size must not be negative")
+	}
+	return nil
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = DefaultQueueSize
+	}
+	return c
+}
+
+// registration is a receiver that accepts pushed snapshots
+type registration struct {
+	lmdbName string
+	push     func(name string, data []byte)
+}
+
+var (
+	mu            sync.Mutex
+	registrations = make(map[*registration]struct{})
+	clients       = make(map[*client]struct{})
+)
+
+// Register registers the push function of the receiver of an LMDB, which is
+// called for every snapshot of the LMDB that a peer pushed to us. The
+// returned function removes the registration.
+func Register(lmdbName string, push func(name string, data []byte)) (unregister func()) {
+	reg := &registration{lmdbName: lmdbName, push: push}
+	mu.Lock()
+	registrations[reg] = struct{}{}
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		delete(registrations, reg)
+		mu.Unlock()
+	}
+}
+
+// Publish sends a snapshot that was just stored to all peers. This never
+// blocks: if the queue of a peer is full, the snapshot is dropped for that
+// peer.
+func Publish(lmdbName, name string, data []byte) {
+	m := &pushMessage{LMDB: lmdbName, Name: name, Data: data}
+	mu.Lock()
+	defer mu.Unlock()
+	for cl := range clients {
+		cl.enqueue(m)
+	}
+}
+
+// deliver hands a pushed snapshot to the receivers of its LMDB
+func deliver(m *pushMessage) {
+	mu.Lock()
+	var pushes []func(name string, data []byte)
+	for reg := range registrations {
+		if reg.lmdbName == m.LMDB {
+			pushes = append(pushes, reg.push)
+		}
+	}
+	mu.Unlock()
+	for _, push := range pushes {
+		push(m.Name, m.Data)
+	}
+}
+
+// Start starts the server and the connections to the peers, until the
+// context is cancelled.
+func Start(ctx context.Context, c Config) error {
+	if !c.Enabled {
+		return nil
+	}
+	c = c.withDefaults()
+	if c.Listen != "" {
+		addr, err := listen(ctx, c)
+		if err != nil {
+			return fmt.Errorf("peer: %w", err)
+		}
+		logrus.WithField("component", "peer").WithField("address", addr.String()).
+			Info("Accepting snapshots from peers")
+	}
+	for _, addr := range c.Peers {
+		cl, err := newClient(ctx, addr, c)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", addr, err)
+		}
+		go cl.run(ctx)
+	}
+	return nil
+}
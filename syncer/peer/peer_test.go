@@ -0,0 +1,99 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/go-tlsconfig/testca"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const snapMain = "main__a__20230102-150405-000000001__G-0000000000000001.pb.gz"
+
+type pushed struct {
+	name string
+	data []byte
+}
+
+func TestPushMessage(t *testing.T) {
+	m := &pushMessage{LMDB: "main", Name: snapMain, Data: bytes.Repeat([]byte("x"), 1000)}
+	data, err := codec{}.Marshal(m)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(data), m.size())
+
+	var m2 pushMessage
+	require.NoError(t, codec{}.Unmarshal(data, &m2))
+	assert.Equal(t, *m, m2)
+
+	_, err = codec{}.Marshal("foo")
+	assert.Error(t, err)
+}
+
+func TestConfig_Check(t *testing.T) {
+	ca, err := testca.New(testca.Options{})
+	require.NoError(t, err)
+	tlsConf, err := ca.ServerConfig("localhost")
+	require.NoError(t, err)
+
+	assert.NoError(t, Config{}.Check())
+	assert.NoError(t, Config{Enabled: true, Listen: ":7890", TLS: tlsConf}.Check())
+	assert.NoError(t, Config{Enabled: true, Peers: []string{"dc2:7890"}, TLS: tlsConf}.Check())
+	assert.Error(t, Config{Enabled: true, TLS: tlsConf}.Check())
+	assert.Error(t, Config{Enabled: true, Peers: []string{"dc2"}, TLS: tlsConf}.Check())
+	assert.Error(t, Config{Enabled: true, Listen: ":7890"}.Check(), "tls required")
+}
+
+func TestPublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := testca.New(testca.Options{})
+	require.NoError(t, err)
+	serverTLS, err := ca.ServerConfig("localhost")
+	require.NoError(t, err)
+	clientTLS, err := ca.ClientConfig("client")
+	require.NoError(t, err)
+
+	received := make(chan pushed, 10)
+	defer Register("main", func(name string, data []byte) {
+		received <- pushed{name: name, data: data}
+	})()
+
+	addr, err := listen(ctx, Config{Listen: "127.0.0.1:0", TLS: serverTLS}.withDefaults())
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr.String())
+	require.NoError(t, err)
+	peerAddr := net.JoinHostPort("localhost", port)
+
+	// A client without a certificate is refused
+	noCert := clientTLS
+	noCert.Cert, noCert.Key = "", ""
+	bad, err := newClient(ctx, peerAddr, Config{TLS: noCert}.withDefaults())
+	require.NoError(t, err)
+	bad.enqueue(&pushMessage{LMDB: "main", Name: snapMain, Data: []byte("bad")})
+	assert.Error(t, bad.stream(ctx))
+
+	cl, err := newClient(ctx, peerAddr, Config{TLS: clientTLS, MaxMessageSize: 1024}.withDefaults())
+	require.NoError(t, err)
+	go cl.run(ctx)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metricConnected.WithLabelValues(peerAddr)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	Publish("other", "other__a__20230102-150405-000000001__G-0000000000000001.pb.gz", []byte("other"))
+	Publish("main", snapMain, bytes.Repeat([]byte("x"), 2048)) // too large
+	Publish("main", snapMain, []byte("data"))
+	select {
+	case p := <-received:
+		assert.Equal(t, pushed{name: snapMain, data: []byte("data")}, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("snapshot not received")
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricDropped.WithLabelValues(peerAddr, "too_large")))
+	assert.Empty(t, received)
+}
@@ -0,0 +1,84 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/PowerDNS/go-tlsconfig"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	grpcpeer "google.golang.org/grpc/peer"
+)
+
+// listen starts the gRPC server that accepts snapshots from peers, until the
+// context is cancelled, and returns its address.
+func listen(ctx context.Context, c Config) (net.Addr, error) {
+	tlsConf := c.TLS
+	tlsConf.RequireClientCert = true
+	mgr, err := tlsconfig.NewManager(ctx, tlsConf, tlsconfig.Options{
+		IsServer:          true,
+		RequireClientCert: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	tlsConfig, err := mgr.TLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	srv := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+		grpc.ForceServerCodec(codec{}),
+		grpc.MaxRecvMsgSize(int(c.MaxMessageSize)),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             KeepaliveInterval / 2,
+			PermitWithoutStream: true,
+		}),
+	)
+	srv.RegisterService(&serviceDesc, struct{}{})
+
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Stop()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			logrus.WithField("component", "peer").WithError(err).Error("Server failed")
+		}
+	}()
+	return ln.Addr(), nil
+}
+
+// handlePush receives the snapshots streamed by a peer
+func handlePush(_ interface{}, stream grpc.ServerStream) error {
+	l := logrus.WithField("component", "peer")
+	if p, ok := grpcpeer.FromContext(stream.Context()); ok {
+		l = l.WithField("peer", p.Addr.String())
+	}
+	l.Debug("Peer connected")
+	for {
+		m := &pushMessage{}
+		if err := stream.RecvMsg(m); err != nil {
+			if errors.Is(err, io.EOF) {
+				l.Debug("Peer disconnected")
+				return stream.SendMsg(&pushResponse{})
+			}
+			metricErrors.WithLabelValues("server").Inc()
+			l.WithError(err).Debug("Peer stream failed")
+			return err
+		}
+		metricReceived.WithLabelValues(m.LMDB).Inc()
+		l.WithField("snapshot_name", m.Name).Debug("Snapshot pushed by peer")
+		deliver(m)
+	}
+}
@@ -0,0 +1,94 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// DefaultPostApplyTimeout is the default timeout for the post_apply_command
+const DefaultPostApplyTimeout = 30 * time.Second
+
+// runPostApplyCommand runs the post_apply_command of the LMDB after a remote
+// snapshot was merged. The command is not run for snapshots without entries.
+// A failing command is logged, but does not stop the sync.
+//
+// The command gets the following environment variables in addition to the
+// environment of this process:
+//
+//	LIGHTNINGSTREAM_LMDB               name of the LMDB in the config
+//	LIGHTNINGSTREAM_LMDB_PATH          path of the LMDB
+//	LIGHTNINGSTREAM_SNAPSHOT_NAME      name of the snapshot that was merged
+//	LIGHTNINGSTREAM_SNAPSHOT_INSTANCE  instance that wrote the snapshot
+//	LIGHTNINGSTREAM_CHANGED_DBIS       comma separated names of the DBIs with entries
+//	LIGHTNINGSTREAM_DBI_ENTRIES        comma separated "dbi=count" entries merged per DBI
+//	LIGHTNINGSTREAM_TOTAL_ENTRIES      total number of entries merged
+func (s *Syncer) runPostApplyCommand(ctx context.Context, instance string, ni snapshot.NameInfo) {
+	command := s.lc.PostApplyCommand
+	if len(command) == 0 {
+		return
+	}
+
+	dbis, total := s.mergedDBIs()
+	if total == 0 {
+		return
+	}
+	counts := make([]string, len(dbis))
+	for i, dbiName := range dbis {
+		counts[i] = fmt.Sprintf("%s=%d", dbiName, s.loadEntries[dbiName])
+	}
+
+	timeout := s.lc.PostApplyTimeout
+	if timeout <= 0 {
+		timeout = DefaultPostApplyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"LIGHTNINGSTREAM_LMDB="+s.name,
+		"LIGHTNINGSTREAM_LMDB_PATH="+s.lc.Path,
+		"LIGHTNINGSTREAM_SNAPSHOT_NAME="+ni.FullName,
+		"LIGHTNINGSTREAM_SNAPSHOT_INSTANCE="+instance,
+		"LIGHTNINGSTREAM_CHANGED_DBIS="+strings.Join(dbis, ","),
+		"LIGHTNINGSTREAM_DBI_ENTRIES="+strings.Join(counts, ","),
+		fmt.Sprintf("LIGHTNINGSTREAM_TOTAL_ENTRIES=%d", total),
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	t0 := time.Now()
+	err := cmd.Run()
+	l := s.l.WithField("command", command[0]).
+		WithField("time", time.Since(t0).Round(time.Millisecond))
+	if err != nil {
+		metricPostApplyCommandFailed.WithLabelValues(s.name).Inc()
+		l.WithError(err).WithField("output", strings.TrimSpace(out.String())).
+			Warn("Post apply command failed")
+		return
+	}
+	l.Debug("Post apply command succeeded")
+}
+
+// mergedDBIs returns the sorted names of the DBIs with entries merged by the
+// last load, and the total number of entries merged
+func (s *Syncer) mergedDBIs() (dbis []string, total int) {
+	for dbiName, n := range s.loadEntries {
+		if n == 0 {
+			continue
+		}
+		dbis = append(dbis, dbiName)
+		total += n
+	}
+	sort.Strings(dbis)
+	return dbis, total
+}
@@ -2,22 +2,37 @@ package receiver
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/status/webhook"
 	"powerdns.com/platform/lightningstream/utils"
 )
 
+// tracer creates the spans for snapshot downloads
+var tracer = otel.Tracer("powerdns.com/platform/lightningstream/syncer/receiver")
+
 type Downloader struct {
 	r        *Receiver
 	l        logrus.FieldLogger
 	instance string
 	lmdbname string
 	last     snapshot.NameInfo
+	lastFull snapshot.NameInfo // last full snapshot, used as base for deltas
 	c        config.Config
 
+	// loaded are the DBI checksums of the last full framed snapshot of this
+	// instance that the syncer loaded, for partial downloads. Protected by r.mu.
+	loaded []snapshot.DBIChecksum
+
 	// for signaling new work
 	newSnapshotSignal chan struct{}
 }
@@ -32,7 +47,7 @@ func (d *Downloader) NotifyNewSnapshot() {
 	}
 }
 
-// Run keeps downloading and unpacking new snapshots, and offering them to
+// Run keeps downloading new snapshots, and offering them to
 // the update loop.
 // It checks the Receiver for the latest version that it has seen, and downloads
 // that snapshot if it has not been loaded yet.
@@ -55,6 +70,9 @@ func (d *Downloader) Run(ctx context.Context) error {
 			// Get last one seen by Receiver
 			d.r.mu.Lock()
 			ni, exists := d.r.lastSeenByInstance[d.instance]
+			base := d.r.lastBaseByInstance[d.instance]
+			_, pending := d.r.snapshotsByInstance[d.instance]
+			pendingIsFull := pending && !d.r.snapshotsByInstance[d.instance].NameInfo.IsDelta()
 			d.r.mu.Unlock()
 
 			if !exists {
@@ -67,15 +85,40 @@ func (d *Downloader) Run(ctx context.Context) error {
 				break // already processed the most recent one
 			}
 
+			isBase := false
+			if ni.IsDelta() {
+				if base.FullName != d.lastFull.FullName {
+					// We first need to load the full snapshot this delta
+					// is based on.
+					ni = base
+					isBase = true
+				} else if pendingIsFull {
+					// The base snapshot has not been loaded by the syncer
+					// yet, and must not be replaced by the delta.
+					if err := utils.SleepContext(ctx, d.r.pollInterval.Load()); err != nil {
+						return err // cancelled
+					}
+					continue
+				}
+			}
+
 			// Do one load attempt
-			if err := d.LoadOnce(ctx, ni); err != nil {
-				d.l.WithError(err).WithField("filename", ni.FullName).Warn("Load error")
-				if err := utils.SleepContext(ctx, d.c.StorageRetryInterval); err != nil {
+			if err := d.LoadOnce(ctx, ni, isBase); err != nil {
+				d.l.WithError(err).WithField("snapshot_name", ni.FullName).Warn("Load error")
+				delay := jitter(d.c.StorageRetryInterval, d.c.StorageLoadRetry.Jitter)
+				if err := utils.SleepContext(ctx, delay); err != nil {
 					return err // cancelled
 				}
 				continue // retry
 			}
 
+			if !ni.IsDelta() {
+				d.lastFull = ni
+			}
+			if isBase {
+				continue // now load the delta
+			}
+
 			// Mark this as the last processed one
 			d.last = ni
 			break // success
@@ -83,20 +126,55 @@ func (d *Downloader) Run(ctx context.Context) error {
 	}
 }
 
-func (d *Downloader) LoadOnce(ctx context.Context, ni snapshot.NameInfo) error {
+// LoadOnce downloads a snapshot and offers it to the syncer.
+// If isBase is set, the snapshot is only loaded as the base for a delta
+// snapshot.
+func (d *Downloader) LoadOnce(ctx context.Context, ni snapshot.NameInfo, isBase bool) (err error) {
 	// Limit number of downloaded compressed snapshots in memory
-	downloadToken := d.r.downloadSnapshotLimit.Acquire()
+	downloadToken := d.r.downloadLimit().Acquire()
 	defer downloadToken.Release()
 
+	// Wait for the memory budget. The size is known from the listing.
+	d.r.mu.Lock()
+	size := d.r.sizeByName[ni.FullName]
+	d.r.mu.Unlock()
+	reservation, err := d.r.budget.Reserve(ctx, size)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			reservation.Release() // not offered to the syncer
+		}
+	}()
+
 	// Fetch the blob from the storage
 	t0 := time.Now()
 	metricSnapshotsLoadCalls.Inc()
-	data, err := d.r.st.Load(ctx, ni.FullName)
+	ctx, span := tracer.Start(ctx, "download", trace.WithAttributes(
+		attribute.String("lmdb", d.lmdbname),
+		attribute.String("syncer_instance", d.instance),
+		attribute.String("snapshot_name", ni.FullName)))
+	data, sums, err := d.download(ctx, ni)
+	span.SetAttributes(attribute.Int("bytes", len(data)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
 	if err != nil {
 		metricSnapshotsLoadFailed.WithLabelValues(d.lmdbname, d.instance).Inc()
 
 		// Signal failure to health tracker
 		d.r.storageLoadHealth.AddFailure(err)
+		webhook.Notify(webhook.Event{
+			Event:            webhook.EventStorageError,
+			LMDB:             d.lmdbname,
+			SnapshotName:     ni.FullName,
+			SnapshotInstance: d.instance,
+			Operation:        "load",
+			Error:            err.Error(),
+		})
 
 		return err
 	}
@@ -106,55 +184,96 @@ func (d *Downloader) LoadOnce(ctx context.Context, ni snapshot.NameInfo) error {
 
 	metricSnapshotsLoadBytes.Add(float64(len(data)))
 
-	// Limit number of decompressed snapshots in memory
-	// CAUTION: we cannot defer the Release, check all error paths!
-	token := d.r.decompressedSnapshotLimit.Acquire()
-
-	t1 := time.Now()
-
-	msg, err := snapshot.LoadData(data)
-	if err != nil {
-		d.l.Debug("Returning DecompressedSnapshotToken")
-		token.Release()
+	if len(data) == 0 {
 		// This snapshot is considered corrupt, we will ignore it from now on
+		err := fmt.Errorf("%w: empty file", snapshot.ErrCorrupt)
 		d.r.MarkCorrupt(ni.FullName, err)
 		d.last = ni
 		return err
 	}
 
-	// Release the download token once we have released the downloaded snapshot
-	data = nil // allow it to be freed
-	_ = data   // silence linter
-	downloadToken.Release()
+	// Detect corruption and forged snapshots before any of the data is merged
+	if d.r.c.StorageVerifyChecksums || d.r.verifier != nil {
+		if _, err := snapshot.Verify(data, d.r.verifier, d.r.dicts...); err != nil {
+			if errors.Is(err, snapshot.ErrBadSignature) {
+				metricSnapshotsSignatureFailed.WithLabelValues(d.lmdbname, d.instance).Inc()
+			} else {
+				metricSnapshotsChecksumFailed.WithLabelValues(d.lmdbname, d.instance).Inc()
+			}
+			d.r.MarkCorrupt(ni.FullName, err)
+			d.last = ni
+			return err
+		}
+	}
+
+	// Release the memory of a snapshot that may have to wait for the syncer
+	// while other downloads wait for the memory budget
+	reservation.Resize(int64(len(data)))
+	update := snapshot.Update{
+		Data:     data,
+		Dicts:    d.r.dicts,
+		NameInfo: ni,
+		IsBase:   isBase,
+	}
+	if d.r.budget.Waiting() > 0 {
+		if err := update.Spill(d.c.MemorySpillDir); err != nil {
+			d.l.WithError(err).Warn("Cannot spill snapshot to disk, keeping it in memory")
+		} else {
+			reservation.Release()
+			metricSnapshotsSpilled.WithLabelValues(d.lmdbname).Inc()
+			d.l.WithField("snapshot_name", ni.FullName).Debug("Spilled snapshot to disk")
+		}
+		data = nil
+	}
+
+	// Limit number of snapshots waiting to be loaded by the syncer.
+	// The syncer only decompresses a snapshot while it is loading it.
+	// CAUTION: we cannot defer the Release, check all error paths!
+	token := d.r.decompressedSnapshotLimit.Acquire()
+
+	t1 := time.Now()
 
 	// Make snapshot available to the syncer, replacing any previous one
 	// that has not been loaded yet.
 	d.r.mu.Lock()
 	// FIXME: use *snapshot.Update pointer in APIs with new tokens
-	d.r.snapshotsByInstance[d.instance] = snapshot.Update{
-		Snapshot: msg,
-		NameInfo: ni,
-		OnClose: func(u *snapshot.Update) {
-			if u.Snapshot == nil {
-				return // already called?
-			}
-			d.l.Debug("Returning DecompressedSnapshotToken")
-			// Clear it before returning the token
-			u.Snapshot = nil
-			utils.GC()
-			// Return token
-			token.Release()
-		},
+	replaced, hasReplaced := d.r.snapshotsByInstance[d.instance]
+	update.OnLoaded = func(u *snapshot.Update) {
+		if ni.IsDelta() {
+			return // the checksums of the base snapshot still apply
+		}
+		d.r.mu.Lock()
+		d.loaded = sums
+		d.r.mu.Unlock()
 	}
+	update.OnClose = func(u *snapshot.Update) {
+		d.l.Debug("Returning DecompressedSnapshotToken")
+		// Clear it before returning the token
+		u.Data = nil
+		utils.GC()
+		// Return token
+		token.Release()
+		reservation.Release()
+	}
+	d.r.snapshotsByInstance[d.instance] = update
 	d.r.mu.Unlock()
+	if hasReplaced {
+		replaced.Close() // never taken by the syncer
+	}
+
+	// The data is now owned by the pending update
+	downloadToken.Release()
 
 	t2 := time.Now()
 	d.l.WithFields(logrus.Fields{
-		"timestamp": ni.TimestampString,
-		//"generation":        ni.GenerationID,
-		"shorthash":         ni.ShortHash(),
-		"time_load_storage": utils.TimeDiff(t1, t0),
-		"time_load_total":   utils.TimeDiff(t2, t0),
+		"timestamp":           ni.TimestampString,
+		"snapshot_name":       ni.FullName,
+		"snapshot_generation": ni.GenerationID,
+		"shorthash":           ni.ShortHash(),
+		"delta":               ni.IsDelta(),
+		"base":                isBase,
+		"time_load_storage":   utils.TimeDiff(t1, t0),
+		"time_load_total":     utils.TimeDiff(t2, t0),
 	}).Info("Snapshot downloaded")
 
 	return nil
@@ -63,6 +63,76 @@ var (
 			Help: "Number of bytes downloaded successfully",
 		},
 	)
+	metricSnapshotsChecksumFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_receiver_snapshots_checksum_failed_total",
+			Help: "Number of downloaded snapshots that failed checksum verification",
+		},
+		[]string{"lmdb", "syncer_instance"},
+	)
+	metricSnapshotsSignatureFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_receiver_snapshots_signature_failed_total",
+			Help: "Number of downloaded snapshots rejected because of a missing or invalid signature",
+		},
+		[]string{"lmdb", "syncer_instance"},
+	)
+	metricSplitBrain = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_receiver_split_brain",
+			Help: "1 if multiple processes are writing snapshots with the same instance name",
+		},
+		[]string{"lmdb", "instance"},
+	)
+	metricSnapshotsSpilled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_receiver_snapshots_spilled_total",
+			Help: "Number of downloaded snapshots spilled to disk to stay within the memory budget",
+		},
+		[]string{"lmdb"},
+	)
+	metricSnapshotsLoadRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_receiver_snapshots_load_retries_total",
+			Help: "Number of retried snapshot load attempts",
+		},
+		[]string{"lmdb"},
+	)
+	metricStorageBreakerOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_receiver_storage_breaker_open",
+			Help: "1 if the storage circuit breaker is open because of too many failed loads",
+		},
+		[]string{"lmdb"},
+	)
+	metricStorageBreakerRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_receiver_storage_breaker_rejected_total",
+			Help: "Number of snapshot loads rejected by the open storage circuit breaker",
+		},
+		[]string{"lmdb"},
+	)
+	metricSnapshotsPartialLoads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_receiver_snapshots_partial_loads_total",
+			Help: "Number of snapshots downloaded partially, skipping unchanged DBIs",
+		},
+		[]string{"lmdb"},
+	)
+	metricSnapshotsPartialSkippedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_receiver_snapshots_partial_skipped_bytes_total",
+			Help: "Number of snapshot bytes not downloaded because their DBIs were unchanged",
+		},
+		[]string{"lmdb"},
+	)
+	metricSnapshotsPushLoads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_receiver_snapshots_pushed_loads_total",
+			Help: "Number of snapshot loads served by a snapshot pushed by a peer instead of the storage",
+		},
+		[]string{"lmdb"},
+	)
 	// TODO: add total space used by all snapshots
 )
 
@@ -74,4 +144,14 @@ func init() {
 	prometheus.MustRegister(metricSnapshotsLoadFailed)
 	prometheus.MustRegister(metricSnapshotsListFailed)
 	prometheus.MustRegister(metricSnapshotsLoadBytes)
+	prometheus.MustRegister(metricSnapshotsChecksumFailed)
+	prometheus.MustRegister(metricSnapshotsSignatureFailed)
+	prometheus.MustRegister(metricSnapshotsSpilled)
+	prometheus.MustRegister(metricSplitBrain)
+	prometheus.MustRegister(metricSnapshotsLoadRetries)
+	prometheus.MustRegister(metricStorageBreakerOpen)
+	prometheus.MustRegister(metricStorageBreakerRejected)
+	prometheus.MustRegister(metricSnapshotsPartialLoads)
+	prometheus.MustRegister(metricSnapshotsPartialSkippedBytes)
+	prometheus.MustRegister(metricSnapshotsPushLoads)
 }
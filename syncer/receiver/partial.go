@@ -0,0 +1,163 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// download loads a snapshot from the storage. With storage_partial_downloads
+// enabled, only the DBIs of a framed snapshot that changed since the last
+// snapshot of this instance that was loaded are downloaded, if possible, or
+// only their changed chunks with a hash tree.
+// A snapshot that a peer pushed to us is used instead of downloading it.
+// It also returns the DBI checksums of full framed snapshots, for the next
+// partial download.
+func (d *Downloader) download(ctx context.Context, ni snapshot.NameInfo) ([]byte, []snapshot.DBIChecksum, error) {
+	if data := d.r.pushedData(ni.FullName); data != nil {
+		metricSnapshotsPushLoads.WithLabelValues(d.lmdbname).Inc()
+		if !d.c.StoragePartialDownloads || ni.IsDelta() {
+			return data, nil, nil
+		}
+		return data, d.checksums(data), nil
+	}
+	if !d.c.StoragePartialDownloads || ni.IsDelta() {
+		data, err := d.r.load(ctx, ni.FullName)
+		return data, nil, err
+	}
+
+	data, sums, err := d.loadPartial(ctx, ni)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+		if !errors.Is(err, ranged.ErrUnsupported) && !errors.Is(err, snapshot.ErrNotFramed) {
+			d.l.WithError(err).WithField("snapshot_name", ni.FullName).
+				Warn("Partial download failed, downloading the whole snapshot")
+		}
+	}
+	if data != nil {
+		return data, sums, nil
+	}
+
+	data, err = d.r.load(ctx, ni.FullName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, d.checksums(data), nil
+}
+
+// checksums returns the DBI checksums of a whole framed snapshot
+func (d *Downloader) checksums(data []byte) []snapshot.DBIChecksum {
+	if !snapshot.IsFramed(data) {
+		return nil
+	}
+	fr, err := snapshot.NewFramedReader(bytes.NewReader(data), int64(len(data)), nil, d.r.dicts...)
+	if err != nil {
+		// Any corruption is reported by the verification or the load
+		return nil
+	}
+	return fr.Meta.DBIChecksums
+}
+
+// loadPartial downloads the changed DBIs of a framed snapshot with ranged
+// loads, and returns a partial snapshot with only these DBIs. If both
+// snapshots have a hash tree, only the changed chunks of these DBIs are
+// downloaded. It returns nil data if no snapshot of this instance was loaded
+// yet, or if all DBIs changed.
+func (d *Downloader) loadPartial(ctx context.Context, ni snapshot.NameInfo) ([]byte, []snapshot.DBIChecksum, error) {
+	d.r.mu.Lock()
+	loaded := d.loaded
+	size := d.r.sizeByName[ni.FullName]
+	d.r.mu.Unlock()
+	if len(loaded) == 0 || size == 0 {
+		return nil, nil, nil
+	}
+
+	// The Meta is verified here, so that a forged Meta cannot be used to make
+	// us skip DBIs.
+	rr := &rangeReader{ctx: ctx, r: d.r, name: ni.FullName}
+	fr, err := snapshot.NewFramedReader(rr, size, d.r.verifier, d.r.dicts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prev := make(map[string]snapshot.DBIChecksum, len(loaded))
+	for _, sum := range loaded {
+		prev[sum.Name] = sum
+	}
+	nBlocks := make(map[string]int)
+	for _, blk := range fr.Index.Blocks {
+		if blk.Kind == snapshot.BlockDBI {
+			nBlocks[blk.Name]++
+		}
+	}
+	var changed []string
+	unchangedChunks := make(map[string]map[int]bool) // by DBI name
+	nChunks, nSkippedChunks := 0, 0
+	for _, sum := range fr.Meta.DBIChecksums {
+		p := prev[sum.Name]
+		if bytes.Equal(p.SHA256, sum.SHA256) {
+			continue
+		}
+		changed = append(changed, sum.Name)
+		if len(sum.Chunks) == 0 || len(p.Chunks) == 0 || len(sum.Chunks) != nBlocks[sum.Name] {
+			continue // no hash tree, download the whole DBI
+		}
+		prevChunks := make(map[string]bool, len(p.Chunks))
+		for _, c := range p.Chunks {
+			prevChunks[string(c)] = true
+		}
+		unchanged := make(map[int]bool)
+		for i, c := range sum.Chunks {
+			if prevChunks[string(c)] {
+				unchanged[i] = true
+			}
+		}
+		unchangedChunks[sum.Name] = unchanged
+		nChunks += len(sum.Chunks)
+		nSkippedChunks += len(unchanged)
+	}
+	if len(changed) == len(fr.Meta.DBIChecksums) && nSkippedChunks == 0 {
+		return nil, nil, nil // nothing to skip
+	}
+
+	isChanged := make(map[string]bool, len(changed))
+	for _, name := range changed {
+		isChanged[name] = true
+	}
+	data, err := fr.PartialChunks(func(name string, chunk int) bool {
+		return isChanged[name] && !unchangedChunks[name][chunk]
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	metricSnapshotsPartialLoads.WithLabelValues(d.lmdbname).Inc()
+	metricSnapshotsPartialSkippedBytes.WithLabelValues(d.lmdbname).Add(float64(size - int64(len(data))))
+	d.l.WithFields(logrus.Fields{
+		"snapshot_name":  ni.FullName,
+		"changed_dbis":   len(changed),
+		"skipped_dbis":   len(fr.Meta.DBIChecksums) - len(changed),
+		"changed_chunks": nChunks - nSkippedChunks,
+		"skipped_chunks": nSkippedChunks,
+		"size":           size,
+		"partial_size":   len(data),
+	}).Debug("Downloaded changed DBIs only")
+	return data, fr.Meta.DBIChecksums, nil
+}
+
+// rangeReader reads a snapshot in the storage with ranged loads
+type rangeReader struct {
+	ctx  context.Context
+	r    *Receiver
+	name string
+}
+
+func (rr *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	data, err := rr.r.loadRange(rr.ctx, rr.name, off, int64(len(p)))
+	return copy(p, data), err
+}
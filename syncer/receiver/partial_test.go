@@ -0,0 +1,154 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"powerdns.com/platform/lightningstream/backends/fs"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func framedSnapshot(t *testing.T, values map[string]string) []byte {
+	var buf bytes.Buffer
+	sw, err := snapshot.NewStreamWriter(&buf, snapshot.Compression{Framed: true}, 3, 2)
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, sw.StartDBI(name, 0, ""))
+		require.NoError(t, sw.Append(snapshot.KV{Key: []byte("k"), Value: []byte(values[name])}))
+		require.NoError(t, sw.EndDBI())
+	}
+	_, err = sw.Close(snapshot.Meta{})
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+func storeSnapshot(t *testing.T, r *Receiver, st simpleblob.Interface, ts time.Time, data []byte) snapshot.NameInfo {
+	name := snapshot.Name("test", "other", "G-0", ts)
+	require.NoError(t, st.Store(context.Background(), name, data))
+	ni, err := snapshot.ParseName(name)
+	require.NoError(t, err)
+	r.mu.Lock()
+	r.sizeByName = map[string]int64{name: int64(len(data))}
+	r.mu.Unlock()
+	return ni
+}
+
+func TestDownloader_download(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Now()
+	fsb, err := fs.New(fs.Options{RootPath: t.TempDir()})
+	require.NoError(t, err)
+	c := config.Config{StoragePartialDownloads: true}
+
+	for _, st := range []simpleblob.Interface{fsb, memory.New()} {
+		r := New(st, c, "test", logrus.New(), "self")
+		d := &Downloader{r: r, l: r.l, c: c, instance: "other", lmdbname: "test"}
+
+		// Nothing loaded yet
+		full := framedSnapshot(t, map[string]string{"a": "1", "b": "1"})
+		ni := storeSnapshot(t, r, st, ts, full)
+		data, sums, err := d.download(ctx, ni)
+		require.NoError(t, err)
+		assert.Equal(t, full, data)
+		require.Len(t, sums, 2)
+		d.loaded = sums
+
+		// Only DBI "a" changed
+		full = framedSnapshot(t, map[string]string{"a": "2", "b": "1"})
+		ni = storeSnapshot(t, r, st, ts.Add(time.Second), full)
+		data, sums, err = d.download(ctx, ni)
+		require.NoError(t, err)
+		require.Len(t, sums, 2)
+		if st != fsb {
+			assert.Equal(t, full, data, "no ranged loads")
+			continue
+		}
+		assert.Less(t, len(data), len(full))
+		checked, err := snapshot.Verify(data, nil)
+		require.NoError(t, err)
+		assert.True(t, checked)
+		sr, err := snapshot.NewStreamReader(data)
+		require.NoError(t, err)
+		dbi, err := sr.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "a", dbi.Name())
+		_, err = sr.Next()
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, []string{"b"}, sr.Skipped)
+
+		// All DBIs changed
+		full = framedSnapshot(t, map[string]string{"a": "3", "b": "3"})
+		ni = storeSnapshot(t, r, st, ts.Add(2*time.Second), full)
+		data, _, err = d.download(ctx, ni)
+		require.NoError(t, err)
+		assert.Equal(t, full, data)
+	}
+}
+
+func TestDownloader_download_hashTree(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Now()
+	st, err := fs.New(fs.Options{RootPath: t.TempDir()})
+	require.NoError(t, err)
+	c := config.Config{StoragePartialDownloads: true}
+	r := New(st, c, "test", logrus.New(), "self")
+	d := &Downloader{r: r, l: r.l, c: c, instance: "other", lmdbname: "test"}
+
+	write := func(changed int) []byte {
+		var buf bytes.Buffer
+		sw, err := snapshot.NewStreamWriter(&buf, snapshot.Compression{Framed: true}, 3, 2)
+		require.NoError(t, err)
+		sw.ChunkSize = 16 * 1024
+		sw.HashTree = true
+		require.NoError(t, sw.StartDBI("a", 0, ""))
+		for i := 0; i < 10_000; i++ {
+			v := "1"
+			if i == changed {
+				v = "2"
+			}
+			require.NoError(t, sw.Append(snapshot.KV{
+				Key:   []byte(fmt.Sprintf("key-%06d", i)),
+				Value: []byte(v),
+			}))
+		}
+		require.NoError(t, sw.EndDBI())
+		_, err = sw.Close(snapshot.Meta{})
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	full := write(-1)
+	ni := storeSnapshot(t, r, st, ts, full)
+	_, sums, err := d.download(ctx, ni)
+	require.NoError(t, err)
+	d.loaded = sums
+
+	// Only the chunk with the changed key is downloaded
+	full = write(5000)
+	ni = storeSnapshot(t, r, st, ts.Add(time.Second), full)
+	data, sums, err := d.download(ctx, ni)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	assert.Less(t, len(data), len(full)/5)
+	checked, err := snapshot.Verify(data, nil)
+	require.NoError(t, err)
+	assert.True(t, checked)
+	snap, err := snapshot.LoadData(data)
+	require.NoError(t, err)
+	require.Len(t, snap.Databases, 1)
+	kvs, err := snap.Databases[0].AsInefficientKVList()
+	require.NoError(t, err)
+	assert.Less(t, len(kvs), 10_000)
+	assert.Contains(t, kvs, snapshot.KV{Key: []byte("key-005000"), Value: []byte("2")})
+}
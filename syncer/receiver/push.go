@@ -0,0 +1,150 @@
+package receiver
+
+import (
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// pushedSnapshot is a snapshot received directly from a peer. The pushed
+// snapshots of an instance are kept in timestamp order until they are listed.
+type pushedSnapshot struct {
+	ni   snapshot.NameInfo
+	data []byte
+}
+
+// Push offers a snapshot that another instance streamed to us directly (see
+// the peer package), so that it is loaded without waiting for the next
+// listing and without downloading it from the storage.
+// The storage remains the source of truth: the snapshot was stored before it
+// was pushed, and later listings will find it as well. Snapshots that cannot
+// be applied to what we know of the instance, like a delta snapshot with an
+// unknown base, trigger a listing instead.
+func (r *Receiver) Push(name string, data []byte) {
+	ni, err := snapshot.ParseName(name)
+	if err != nil || ni.SyncerName != r.lmdbname || ni.InstanceID == r.ownInstance {
+		return
+	}
+	if !r.until.IsZero() && ni.Timestamp.After(r.until) {
+		return
+	}
+
+	r.mu.Lock()
+	if r.c.SplitBrainAction == config.SplitBrainRefuse && len(r.splitBrain[ni.InstanceID]) > 0 {
+		r.mu.Unlock()
+		return
+	}
+	if _, corrupt := r.corruptSnapshots[name]; corrupt {
+		r.mu.Unlock()
+		return
+	}
+	if last, exists := r.lastSeenByInstance[ni.InstanceID]; exists && !ni.Timestamp.After(last.Timestamp) {
+		r.mu.Unlock()
+		return // already known
+	}
+	p := pushedSnapshot{ni: ni, data: data}
+	r.pushed[ni.InstanceID] = prunePushed(append(r.pushed[ni.InstanceID], p))
+
+	// The maps are replaced instead of updated, because RunOnce and the
+	// Downloaders use them without holding the lock.
+	lastSeen := copyNameInfos(r.lastSeenByInstance)
+	lastBase := copyNameInfos(r.lastBaseByInstance)
+	sizes := make(map[string]int64, len(r.sizeByName)+1)
+	for name, size := range r.sizeByName {
+		sizes[name] = size
+	}
+	applied := applyPushed(p, lastSeen, lastBase, sizes)
+	if applied {
+		r.lastSeenByInstance = lastSeen
+		r.lastBaseByInstance = lastBase
+		r.sizeByName = sizes
+		r.hasSnapshots = true
+	}
+	d := r.downloadersByInstance[ni.InstanceID]
+	r.mu.Unlock()
+
+	if !applied || d == nil {
+		// The listing starts a Downloader or finds the base snapshot
+		r.Trigger()
+		return
+	}
+	d.NotifyNewSnapshot()
+}
+
+// mergePushed adds the pushed snapshots that are newer than the listed ones
+// to the maps built by RunOnce, and forgets the ones that were listed, so that
+// a listing that is not consistent yet does not make us go back in time.
+// It must be called with r.mu held.
+func (r *Receiver) mergePushed(lastSeen, lastBase map[string]snapshot.NameInfo, sizes map[string]int64) {
+	for inst, pushed := range r.pushed {
+		last, listed := lastSeen[inst]
+		var keep []pushedSnapshot
+		for _, p := range pushed {
+			if listed && !p.ni.Timestamp.After(last.Timestamp) {
+				continue
+			}
+			applyPushed(p, lastSeen, lastBase, sizes)
+			keep = append(keep, p)
+		}
+		if len(keep) == 0 {
+			delete(r.pushed, inst)
+		} else {
+			r.pushed[inst] = keep
+		}
+	}
+}
+
+// prunePushed returns the pushed snapshots of an instance that are still
+// needed: the latest one, and its base if it is a delta snapshot.
+func prunePushed(pushed []pushedSnapshot) []pushedSnapshot {
+	latest := pushed[len(pushed)-1]
+	var keep []pushedSnapshot
+	for _, p := range pushed[:len(pushed)-1] {
+		if latest.ni.IsDelta() && !p.ni.IsDelta() && p.ni.TimestampString == latest.ni.BaseTimestampString {
+			keep = append(keep, p)
+		}
+	}
+	return append(keep, latest)
+}
+
+// applyPushed makes a pushed snapshot the latest one of its instance in the
+// maps, if it is a full snapshot or a delta snapshot of a known base.
+func applyPushed(p pushedSnapshot, lastSeen, lastBase map[string]snapshot.NameInfo, sizes map[string]int64) bool {
+	inst := p.ni.InstanceID
+	if p.ni.IsDelta() {
+		base, exists := lastSeen[inst]
+		if !exists || base.IsDelta() {
+			base, exists = lastBase[inst]
+		}
+		if !exists || base.TimestampString != p.ni.BaseTimestampString {
+			return false
+		}
+		lastBase[inst] = base
+	} else {
+		delete(lastBase, inst)
+	}
+	lastSeen[inst] = p.ni
+	sizes[p.ni.FullName] = int64(len(p.data))
+	return true
+}
+
+// pushedData returns the data of a snapshot if it was pushed to us
+func (r *Receiver) pushedData(name string) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, pushed := range r.pushed {
+		for _, p := range pushed {
+			if p.ni.FullName == name {
+				return p.data
+			}
+		}
+	}
+	return nil
+}
+
+func copyNameInfos(m map[string]snapshot.NameInfo) map[string]snapshot.NameInfo {
+	c := make(map[string]snapshot.NameInfo, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
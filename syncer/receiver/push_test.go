@@ -0,0 +1,86 @@
+package receiver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func TestReceiver_Push(t *testing.T) {
+	ts := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.New()
+	r := New(st, config.Config{
+		// Only list once, pushed snapshots are offered without listing
+		StoragePollInterval:         time.Hour,
+		MemoryDownloadedSnapshots:   2,
+		MemoryDecompressedSnapshots: 2,
+	}, "test", logrus.New(), "self")
+
+	next := func() (inst string, update snapshot.Update) {
+		for i := 0; i < 100; i++ {
+			inst, update = r.Next()
+			if inst != "" {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return inst, update
+	}
+
+	err := st.Store(ctx, snapshot.Name("test", "other", "G-0", ts), emptySnapshot())
+	require.NoError(t, err)
+	go func() {
+		err := r.Run(ctx)
+		if err != nil && err != context.Canceled {
+			assert.NoError(t, err)
+		}
+	}()
+	inst, _ := next()
+	require.Equal(t, "other", inst)
+	loads := testutil.ToFloat64(metricSnapshotsPushLoads.WithLabelValues("test"))
+
+	// Snapshots of our own instance, other LMDBs and older snapshots are ignored
+	r.Push(snapshot.Name("test", "self", "G-0", ts.Add(time.Second)), emptySnapshot())
+	r.Push(snapshot.Name("other", "other", "G-0", ts.Add(time.Second)), emptySnapshot())
+	r.Push(snapshot.Name("test", "other", "G-0", ts.Add(-time.Second)), emptySnapshot())
+	assert.ElementsMatch(t, []string{"other"}, r.SeenInstances())
+
+	// A pushed snapshot is offered without being stored or listed
+	pushed := append(emptySnapshot(), 0) // unique
+	name := snapshot.Name("test", "other", "G-0", ts.Add(time.Second))
+	r.Push(name, pushed)
+	inst, update := next()
+	require.Equal(t, "other", inst)
+	assert.Equal(t, name, update.NameInfo.FullName)
+	assert.Equal(t, pushed, update.Data)
+	update.Close()
+
+	// A delta on a pushed full snapshot
+	delta := snapshot.DeltaName("test", "other", "G-0", ts.Add(2*time.Second), ts.Add(time.Second))
+	r.Push(delta, emptySnapshot())
+	inst, update = next()
+	require.Equal(t, "other", inst)
+	assert.Equal(t, delta, update.NameInfo.FullName)
+	update.Close()
+	assert.Equal(t, loads+2, testutil.ToFloat64(metricSnapshotsPushLoads.WithLabelValues("test")))
+
+	// A listing that does not have the pushed snapshots yet does not make
+	// us go back to the stored one
+	require.NoError(t, r.RunOnce(ctx, false))
+	r.mu.Lock()
+	assert.Equal(t, delta, r.lastSeenByInstance["other"].FullName)
+	r.mu.Unlock()
+}
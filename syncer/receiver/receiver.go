@@ -7,13 +7,20 @@ import (
 	"time"
 
 	"github.com/PowerDNS/simpleblob"
+	"github.com/c2h5oh/datasize"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 	"powerdns.com/platform/lightningstream/utils/climit"
+	"powerdns.com/platform/lightningstream/utils/membudget"
 
+	"powerdns.com/platform/lightningstream/backends/throttle"
 	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/snapshot"
 	"powerdns.com/platform/lightningstream/status/healthtracker"
-	"powerdns.com/platform/lightningstream/utils"
+	"powerdns.com/platform/lightningstream/status/readiness"
+	"powerdns.com/platform/lightningstream/status/webhook"
+	"powerdns.com/platform/lightningstream/syncer/peer"
+	"powerdns.com/platform/lightningstream/syncer/storageevents"
 )
 
 func New(st simpleblob.Interface, c config.Config, dbname string, l logrus.FieldLogger, inst string) *Receiver {
@@ -28,8 +35,13 @@ func New(st simpleblob.Interface, c config.Config, dbname string, l logrus.Field
 		ignoredFilenames:       make(map[string]bool),
 		snapshotsByInstance:    make(map[string]snapshot.Update),
 		lastSeenByInstance:     make(map[string]snapshot.NameInfo),
+		lastBaseByInstance:     make(map[string]snapshot.NameInfo),
 		downloadersByInstance:  make(map[string]*Downloader),
 		corruptSnapshots:       make(map[string]error),
+		pushed:                 make(map[string][]pushedSnapshot),
+		trigger:                make(chan struct{}, 1),
+		budget:                 membudget.Shared(),
+		breaker:                newBreaker(c.StorageLoadRetry.BreakerThreshold, c.StorageLoadRetry.BreakerCooldown),
 		storageListHealth:      healthtracker.New(c.Health.StorageList, fmt.Sprintf("%s_storage_list", dbname), "list snapshots on storage backend"),
 		storageLoadHealth:      healthtracker.New(c.Health.StorageLoad, fmt.Sprintf("%s_storage_load", dbname), "load a snapshot from storage backend"),
 
@@ -44,6 +56,19 @@ func New(st simpleblob.Interface, c config.Config, dbname string, l logrus.Field
 			c.MemoryDownloadedSnapshots,
 			l.WithField("token", "Download")),
 	}
+	if c.StartupDownloadWorkers > c.MemoryDownloadedSnapshots {
+		r.startupSnapshotLimit = climit.New(
+			dbname,
+			"startup_download",
+			c.StartupDownloadWorkers,
+			l.WithField("token", "StartupDownload"))
+		r.startup.Store(true)
+	}
+
+	r.pollInterval.Store(c.StoragePollInterval)
+
+	// Not ready to serve traffic if the storage backend cannot be reached
+	readiness.Register(fmt.Sprintf("%s_storage_list", dbname), r.storageListHealth.Ready)
 
 	return r
 }
@@ -62,6 +87,26 @@ type Receiver struct {
 	l           logrus.FieldLogger
 	ownInstance string
 
+	// zstd dictionaries for loading snapshots, set before Run
+	dicts [][]byte
+
+	// verifier checks snapshot signatures, if configured, set before Run
+	verifier *snapshot.Verifier
+
+	// until makes us ignore snapshots newer than this time, if set before Run
+	until time.Time
+
+	// applied are the last snapshots by instance that were already applied
+	// to the LMDB before the start, if set before Run.
+	applied map[string]snapshot.NameInfo
+
+	// pollInterval is the storage_poll_interval, which can be changed with
+	// SetPollInterval while running.
+	pollInterval atomic.Duration
+
+	// trigger signals Run to list the storage right away
+	trigger chan struct{}
+
 	// Only accessed by Run goroutine
 	lastNotifiedByInstance map[string]snapshot.NameInfo
 	ignoredFilenames       map[string]bool
@@ -71,27 +116,63 @@ type Receiver struct {
 	mu                    sync.Mutex
 	snapshotsByInstance   map[string]snapshot.Update
 	lastSeenByInstance    map[string]snapshot.NameInfo
+	lastBaseByInstance    map[string]snapshot.NameInfo // only for delta snapshots
+	sizeByName            map[string]int64             // of the above snapshots
 	downloadersByInstance map[string]*Downloader
 	hasSnapshots          bool
 	corruptSnapshots      map[string]error
+	splitBrain            map[string][]string         // generations by instance
+	pushed                map[string][]pushedSnapshot // by instance, see Push
 
 	// Limit number of concurrent decompressed snapshots in memory
 	decompressedSnapshotLimit *climit.ConcurrencyLimit
 	downloadSnapshotLimit     *climit.ConcurrencyLimit
 
+	// Larger download limit while catching up at startup, if configured.
+	// It is used until StartupDone is called.
+	startupSnapshotLimit *climit.ConcurrencyLimit
+	startup              atomic.Bool
+
+	// Prioritized and rate limited downloads during a bulk load, see
+	// StartBulkLoad
+	bulk   atomic.Bool
+	bulkSt simpleblob.Interface
+
+	// Memory budget of the downloaded snapshots, shared by all receivers
+	budget *membudget.Budget
+
+	// Circuit breaker for snapshot loads
+	breaker *breaker
+
 	// Health trackers
 	storageListHealth *healthtracker.HealthTracker
 	storageLoadHealth *healthtracker.HealthTracker
 }
 
 // Next returns the next remote snapshot.Update to process if there is one
-// It is to be called by the Syncer.
+// It is to be called by the Syncer. If multiple snapshots are ready, the one
+// with the oldest timestamp is returned first.
+// During a bulk load, full snapshots are returned before delta snapshots.
 func (r *Receiver) Next() (instance string, update snapshot.Update) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	for instance, update = range r.snapshotsByInstance {
-		break // first is assigned to return values now
+	bulk := r.bulk.Load()
+	for inst, u := range r.snapshotsByInstance {
+		if instance == "" {
+			instance, update = inst, u
+			continue
+		}
+		if delta := u.NameInfo.IsDelta(); bulk && delta != update.NameInfo.IsDelta() {
+			if !delta {
+				instance, update = inst, u
+			}
+			continue
+		}
+		if u.NameInfo.Timestamp.Before(update.NameInfo.Timestamp) ||
+			(u.NameInfo.Timestamp.Equal(update.NameInfo.Timestamp) && inst < instance) {
+			instance, update = inst, u
+		}
 	}
 	if instance != "" {
 		// Consider handled
@@ -100,6 +181,86 @@ func (r *Receiver) Next() (instance string, update snapshot.Update) {
 	return instance, update
 }
 
+// StartupDone signals that all snapshots that existed at startup have been
+// loaded, after which the regular download limit applies.
+func (r *Receiver) StartupDone() {
+	r.startup.Store(false)
+}
+
+// StartBulkLoad starts a bulk load, during which Next returns full snapshots
+// before delta snapshots, and downloads are limited to downloadRate bytes
+// per second, if not zero. This must be called before the first RunOnce.
+func (r *Receiver) StartBulkLoad(downloadRate datasize.ByteSize) {
+	r.bulkSt = throttle.New(r.st, config.Throttle{DownloadRate: downloadRate})
+	r.bulk.Store(true)
+}
+
+// BulkLoadDone ends the bulk load
+func (r *Receiver) BulkLoadDone() {
+	r.bulk.Store(false)
+}
+
+// storage returns the storage backend for snapshot downloads
+func (r *Receiver) storage() simpleblob.Interface {
+	if r.bulk.Load() {
+		return r.bulkSt
+	}
+	return r.st
+}
+
+// downloadLimit returns the limit for the number of concurrent downloads
+func (r *Receiver) downloadLimit() *climit.ConcurrencyLimit {
+	if r.startup.Load() {
+		return r.startupSnapshotLimit
+	}
+	return r.downloadSnapshotLimit
+}
+
+// SetDictionaries sets the zstd dictionaries that snapshots may have been
+// compressed with. This must be called before Run.
+func (r *Receiver) SetDictionaries(dicts ...[]byte) {
+	r.dicts = dicts
+}
+
+// SetVerifier sets the Verifier used to check the signatures of all
+// downloaded snapshots. This must be called before Run.
+func (r *Receiver) SetVerifier(v *snapshot.Verifier) {
+	r.verifier = v
+}
+
+// SetUntil makes the Receiver ignore all snapshots with a timestamp after t,
+// which is used to restore the state of an LMDB at a point in time.
+// This must be called before Run.
+func (r *Receiver) SetUntil(t time.Time) {
+	r.until = t
+}
+
+// SetApplied sets the last snapshots by instance that were already applied to
+// the LMDB before the start, so that these are not downloaded again. A delta
+// snapshot is only considered applied together with its base snapshot.
+// This must be called before Run.
+func (r *Receiver) SetApplied(applied map[string]snapshot.NameInfo) {
+	r.applied = applied
+	for inst, ni := range applied {
+		r.lastNotifiedByInstance[inst] = ni
+	}
+}
+
+// IsApplied returns true if the latest snapshot seen for the instance was
+// already applied before the start.
+func (r *Receiver) IsApplied(instance string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ni, exists := r.lastSeenByInstance[instance]
+	return exists && ni.FullName == r.applied[instance].FullName
+}
+
+// SetPollInterval changes the interval between listings of the storage
+// backend. It is safe to call while running.
+func (r *Receiver) SetPollInterval(d time.Duration) {
+	r.pollInterval.Store(d)
+}
+
 // HasSnapshots indicates if there are any snapshots in the storage backend
 // for our prefix.
 func (r *Receiver) HasSnapshots() bool {
@@ -131,18 +292,40 @@ func (r *Receiver) MarkCorrupt(filename string, err error) {
 		return // already marked
 	}
 	r.corruptSnapshots[filename] = err
-	r.l.WithField("filename", filename).WithError(err).Warn(
+	r.l.WithField("snapshot_name", filename).WithError(err).Warn(
 		"Snapshot marked as corrupt and will be ignored")
 }
 
+// Trigger makes Run list the storage right away, instead of after the poll
+// interval. This never blocks.
+func (r *Receiver) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
 func (r *Receiver) Run(ctx context.Context) error {
+	defer storageevents.Register(r.lmdbname, r.Trigger)()
+	defer peer.Register(r.lmdbname, r.Push)()
 	for {
 		if err := r.RunOnce(ctx, false); err != nil {
 			r.l.WithError(err).Error("Fetch error")
 		}
 
-		if err := utils.SleepContext(ctx, r.c.StoragePollInterval); err != nil {
-			return err
+		// Poll less often while storage change notifications arrive
+		interval := r.pollInterval.Load()
+		if d, ok := storageevents.PollInterval(); ok && d > interval {
+			interval = d
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return context.Canceled
+		case <-r.trigger:
+			t.Stop()
+		case <-t.C:
 		}
 	}
 }
@@ -160,6 +343,12 @@ func (r *Receiver) RunOnce(ctx context.Context, includingOwn bool) error {
 
 		// Signal failure to health tracker
 		r.storageListHealth.AddFailure(err)
+		webhook.Notify(webhook.Event{
+			Event:     webhook.EventStorageError,
+			LMDB:      r.lmdbname,
+			Operation: "list",
+			Error:     err.Error(),
+		})
 
 		return fmt.Errorf("list snapshots: %w", err)
 	}
@@ -181,38 +370,85 @@ func (r *Receiver) RunOnce(ctx context.Context, includingOwn bool) error {
 	// Note that this always includes our own instance, even if includingOwn is false,
 	// which is important during startup in the sync loop.
 	lastSeenByInstance := make(map[string]snapshot.NameInfo)
+	lastBaseByInstance := make(map[string]snapshot.NameInfo)
+	fulls := make(map[string]snapshot.NameInfo) // by instance and timestamp
+	generations := newGenerationTracker()
 	for _, name := range names {
 		if r.ignoredFilenames[name] {
-			//r.l.WithField("filename", name).Debug("Ignored")
+			//r.l.WithField("snapshot_name", name).Debug("Ignored")
 			continue
 		}
 		ni, err := snapshot.ParseName(name)
 		if err != nil {
-			r.l.WithError(err).WithField("filename", name).
+			r.l.WithError(err).WithField("snapshot_name", name).
 				Debug("Skipping invalid filename")
 			r.ignoredFilenames[name] = true
 			continue
 		}
+		if !r.until.IsZero() && ni.Timestamp.After(r.until) {
+			continue
+		}
+		generations.add(ni)
 		// Since the names are sorted alphabetically, this newer ones will
 		// always overwrite older ones.
+		// A delta snapshot can only be used if its base snapshot exists.
+		if ni.IsDelta() {
+			base, exists := fulls[ni.InstanceID+"__"+ni.BaseTimestampString]
+			if !exists {
+				r.l.WithField("snapshot_name", name).
+					Debug("Skipping delta snapshot without base snapshot")
+				continue
+			}
+			lastBaseByInstance[ni.InstanceID] = base
+		} else {
+			fulls[ni.InstanceID+"__"+ni.TimestampString] = ni
+			delete(lastBaseByInstance, ni.InstanceID)
+		}
 		lastSeenByInstance[ni.InstanceID] = ni
 	}
 
+	// Instances that are used by multiple processes are ignored until only
+	// one generation remains, if configured
+	if r.c.SplitBrainAction == config.SplitBrainRefuse {
+		for inst := range generations.split {
+			delete(lastSeenByInstance, inst)
+			delete(lastBaseByInstance, inst)
+		}
+	}
+
+	// The sizes of the latest snapshots are needed for partial downloads
+	sizeByName := make(map[string]int64)
+	for _, ni := range lastSeenByInstance {
+		sizeByName[ni.FullName] = 0
+	}
+	for _, ni := range lastBaseByInstance {
+		sizeByName[ni.FullName] = 0
+	}
+	for _, blob := range ls {
+		if _, exists := sizeByName[blob.Name]; exists {
+			sizeByName[blob.Name] = blob.Size
+		}
+	}
+
 	now := time.Now()
 
 	// It is safe to continue using the map after this, because the map is not
 	// mutated from this point on.
 	// This map is read by the Downloader.
 	r.mu.Lock()
+	r.mergePushed(lastSeenByInstance, lastBaseByInstance, sizeByName)
 	r.lastSeenByInstance = lastSeenByInstance
+	r.lastBaseByInstance = lastBaseByInstance
+	r.sizeByName = sizeByName
 	r.hasSnapshots = len(lastSeenByInstance) > 0
 	r.mu.Unlock()
+	r.updateSplitBrain(generations.split)
 
 	for inst, ni := range lastSeenByInstance {
-		//r.l.WithField("filename", ni.FullName).Debug("Considering")
+		//r.l.WithField("snapshot_name", ni.FullName).Debug("Considering")
 		lastNotified := r.lastNotifiedByInstance[inst]
 		if ni.FullName == lastNotified.FullName {
-			//r.l.WithField("filename", ni.FullName).Debug("Already handled")
+			//r.l.WithField("snapshot_name", ni.FullName).Debug("Already handled")
 			continue // no change
 		}
 
@@ -223,10 +459,10 @@ func (r *Receiver) RunOnce(ctx context.Context, includingOwn bool) error {
 
 		age := now.Sub(ni.Timestamp)
 		r.l.WithFields(logrus.Fields{
-			"snapshot_instance": inst,
-			"timestamp":         ni.TimestampString,
-			"generation":        ni.GenerationID,
-			"age":               age.Round(10 * time.Millisecond),
+			"snapshot_instance":   inst,
+			"timestamp":           ni.TimestampString,
+			"snapshot_generation": ni.GenerationID,
+			"age":                 age.Round(10 * time.Millisecond),
 		}).Debug("New snapshot detected")
 
 		metricSnapshotsLastReceivedTimestamp.WithLabelValues(r.lmdbname, inst).
@@ -262,9 +498,17 @@ func (r *Receiver) getDownloader(ctx context.Context, instance string) *Download
 		c:                 r.c,
 		instance:          instance,
 		lmdbname:          r.lmdbname,
-		last:              snapshot.NameInfo{},
 		newSnapshotSignal: make(chan struct{}, 1),
 	}
+	if ni, exists := r.applied[instance]; exists {
+		// Do not download the applied snapshot or its base again
+		d.last = ni
+		if !ni.IsDelta() {
+			d.lastFull = ni
+		} else if base := r.lastBaseByInstance[instance]; base.TimestampString == ni.BaseTimestampString {
+			d.lastFull = base
+		}
+	}
 
 	go func() {
 		err := d.Run(ctx)
@@ -8,11 +8,15 @@ import (
 	"time"
 
 	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer/storageevents"
+	"powerdns.com/platform/lightningstream/utils/membudget"
 )
 
 func emptySnapshot() []byte {
@@ -83,3 +87,354 @@ func TestReceiver(t *testing.T) {
 	inst, _ = r.Next()
 	assert.Equal(t, "", inst)
 }
+
+func TestReceiver_delta(t *testing.T) {
+	ts := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.New()
+	r := New(st, config.Config{
+		StoragePollInterval:         10 * time.Millisecond,
+		MemoryDownloadedSnapshots:   2,
+		MemoryDecompressedSnapshots: 2,
+	}, "test", logrus.New(), "self")
+
+	// A delta without its base snapshot is ignored
+	err := st.Store(ctx, snapshot.DeltaName("test", "other", "G-0", ts.Add(time.Second), ts), emptySnapshot())
+	assert.NoError(t, err)
+	assert.NoError(t, r.RunOnce(ctx, false))
+	assert.Empty(t, r.SeenInstances())
+
+	// Once the base exists, the base is offered first, followed by the delta
+	err = st.Store(ctx, snapshot.Name("test", "other", "G-0", ts), emptySnapshot())
+	assert.NoError(t, err)
+	go func() {
+		err := r.Run(ctx)
+		if err != nil && err != context.Canceled {
+			assert.NoError(t, err)
+		}
+	}()
+
+	next := func() (inst string, update snapshot.Update) {
+		for i := 0; i < 50; i++ {
+			time.Sleep(20 * time.Millisecond)
+			inst, update = r.Next()
+			if inst != "" {
+				break
+			}
+		}
+		update.Close()
+		return inst, update
+	}
+
+	inst, update := next()
+	assert.Equal(t, "other", inst)
+	assert.True(t, update.IsBase)
+	assert.False(t, update.NameInfo.IsDelta())
+
+	inst, update = next()
+	assert.Equal(t, "other", inst)
+	assert.False(t, update.IsBase)
+	assert.True(t, update.NameInfo.IsDelta())
+
+	// A newer delta on the same base does not load the base again
+	err = st.Store(ctx, snapshot.DeltaName("test", "other", "G-0", ts.Add(2*time.Second), ts), emptySnapshot())
+	assert.NoError(t, err)
+	inst, update = next()
+	assert.Equal(t, "other", inst)
+	assert.False(t, update.IsBase)
+	assert.Equal(t, ts.Add(2*time.Second).UTC(), update.NameInfo.Timestamp)
+}
+
+func TestReceiver_until(t *testing.T) {
+	ts := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.New()
+	r := New(st, config.Config{}, "test", logrus.New(), "self")
+	r.SetUntil(ts.Add(1500 * time.Millisecond))
+
+	for _, name := range []string{
+		snapshot.Name("test", "other", "G-0", ts),
+		snapshot.DeltaName("test", "other", "G-0", ts.Add(time.Second), ts),
+		snapshot.DeltaName("test", "other", "G-0", ts.Add(2*time.Second), ts),
+		snapshot.Name("test", "self", "G-0", ts.Add(time.Second)),
+		snapshot.Name("test", "self", "G-0", ts.Add(3*time.Second)),
+		snapshot.Name("test", "new", "G-0", ts.Add(2*time.Second)),
+	} {
+		assert.NoError(t, st.Store(ctx, name, emptySnapshot()))
+	}
+	assert.NoError(t, r.RunOnce(ctx, false))
+	assert.ElementsMatch(t, []string{"other", "self"}, r.SeenInstances())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Equal(t, ts.Add(time.Second).UTC(), r.lastSeenByInstance["other"].Timestamp)
+	assert.Equal(t, ts.UTC(), r.lastBaseByInstance["other"].Timestamp)
+	assert.Equal(t, ts.Add(time.Second).UTC(), r.lastSeenByInstance["self"].Timestamp)
+}
+
+func TestReceiver_splitBrain(t *testing.T) {
+	ts := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.New()
+	r := New(st, config.Config{SplitBrainAction: config.SplitBrainWarn}, "test", logrus.New(), "self")
+
+	// A restart of "other" and of "self" is not a split-brain
+	for _, name := range []string{
+		snapshot.Name("test", "other", "G-0", ts),
+		snapshot.Name("test", "other", "G-1", ts.Add(time.Second)),
+		snapshot.Name("test", "self", "G-0", ts),
+		snapshot.Name("test", "self", "G-1", ts.Add(time.Second)),
+	} {
+		assert.NoError(t, st.Store(ctx, name, emptySnapshot()))
+	}
+	assert.NoError(t, r.RunOnce(ctx, false))
+	assert.Empty(t, r.SplitBrain())
+
+	// Interleaved generations of "other" are a split-brain
+	err := st.Store(ctx, snapshot.Name("test", "other", "G-0", ts.Add(2*time.Second)), emptySnapshot())
+	assert.NoError(t, err)
+	assert.NoError(t, r.RunOnce(ctx, false))
+	assert.Equal(t, map[string][]string{"other": {"G-0", "G-1"}}, r.SplitBrain())
+	assert.Equal(t, 1.0, testutil.ToFloat64(metricSplitBrain.WithLabelValues("test", "other")))
+	assert.ElementsMatch(t, []string{"other", "self"}, r.SeenInstances())
+
+	// Refused until resolved
+	r.c.SplitBrainAction = config.SplitBrainRefuse
+	assert.NoError(t, r.RunOnce(ctx, false))
+	assert.ElementsMatch(t, []string{"self"}, r.SeenInstances())
+
+	assert.NoError(t, st.Delete(ctx, snapshot.Name("test", "other", "G-0", ts)))
+	assert.NoError(t, r.RunOnce(ctx, false))
+	assert.Empty(t, r.SplitBrain())
+	assert.Equal(t, 0.0, testutil.ToFloat64(metricSplitBrain.WithLabelValues("test", "other")))
+	assert.ElementsMatch(t, []string{"other", "self"}, r.SeenInstances())
+}
+
+func TestReceiver_applied(t *testing.T) {
+	ts := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.New()
+	r := New(st, config.Config{
+		StoragePollInterval:         10 * time.Millisecond,
+		MemoryDownloadedSnapshots:   2,
+		MemoryDecompressedSnapshots: 2,
+	}, "test", logrus.New(), "self")
+
+	base := snapshot.Name("test", "other", "G-0", ts)
+	delta := snapshot.DeltaName("test", "other", "G-0", ts.Add(time.Second), ts)
+	for _, name := range []string{base, delta} {
+		assert.NoError(t, st.Store(ctx, name, emptySnapshot()))
+	}
+	ni, err := snapshot.ParseName(delta)
+	assert.NoError(t, err)
+	r.SetApplied(map[string]snapshot.NameInfo{"other": ni})
+	assert.NoError(t, r.RunOnce(ctx, true))
+	assert.True(t, r.IsApplied("other"))
+	assert.False(t, r.IsApplied("unknown"))
+
+	go func() {
+		err := r.Run(ctx)
+		if err != nil && err != context.Canceled {
+			assert.NoError(t, err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	inst, _ := r.Next()
+	assert.Equal(t, "", inst, "applied snapshot offered again")
+
+	// A newer delta on the same base does not load the base again
+	err = st.Store(ctx, snapshot.DeltaName("test", "other", "G-0", ts.Add(2*time.Second), ts), emptySnapshot())
+	assert.NoError(t, err)
+	var update snapshot.Update
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		inst, update = r.Next()
+		if inst != "" {
+			break
+		}
+	}
+	update.Close()
+	assert.Equal(t, "other", inst)
+	assert.False(t, update.IsBase)
+	assert.Equal(t, ts.Add(2*time.Second).UTC(), update.NameInfo.Timestamp)
+	assert.False(t, r.IsApplied("other"))
+}
+
+func TestReceiver_trigger(t *testing.T) {
+	ts := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.New()
+	r := New(st, config.Config{
+		StoragePollInterval:         time.Hour,
+		MemoryDownloadedSnapshots:   2,
+		MemoryDecompressedSnapshots: 2,
+	}, "test", logrus.New(), "self")
+	go func() {
+		err := r.Run(ctx)
+		if err != nil && err != context.Canceled {
+			assert.NoError(t, err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// A storage change notification makes it list the storage right away
+	name := snapshot.Name("test", "other", "G-0", ts)
+	assert.NoError(t, st.Store(ctx, name, emptySnapshot()))
+	storageevents.Notify(name)
+	var inst string
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		inst, _ = r.Next()
+		if inst != "" {
+			break
+		}
+	}
+	assert.Equal(t, "other", inst)
+}
+
+func TestReceiver_startup(t *testing.T) {
+	ts := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.New()
+	r := New(st, config.Config{
+		StoragePollInterval:         time.Hour,
+		MemoryDownloadedSnapshots:   1,
+		MemoryDecompressedSnapshots: 5,
+		StartupDownloadWorkers:      4,
+	}, "test", logrus.New(), "self")
+	assert.Equal(t, r.startupSnapshotLimit, r.downloadLimit())
+
+	// Snapshots of all instances are downloaded, and offered oldest first
+	instances := []string{"d", "b", "a", "c"}
+	for i, inst := range instances {
+		err := st.Store(ctx, snapshot.Name("test", inst, "G-0", ts.Add(time.Duration(i)*time.Second)), emptySnapshot())
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, r.RunOnce(ctx, false))
+	for i := 0; i < 50; i++ {
+		r.mu.Lock()
+		n := len(r.snapshotsByInstance)
+		r.mu.Unlock()
+		if n == len(instances) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, expected := range instances {
+		inst, update := r.Next()
+		update.Close()
+		assert.Equal(t, expected, inst)
+	}
+
+	r.StartupDone()
+	assert.Equal(t, r.downloadSnapshotLimit, r.downloadLimit())
+}
+
+func TestReceiver_bulkLoad(t *testing.T) {
+	ts := time.Now()
+	r := New(memory.New(), config.Config{
+		MemoryDownloadedSnapshots:   1,
+		MemoryDecompressedSnapshots: 1,
+	}, "test", logrus.New(), "self")
+
+	pending := func() {
+		for inst, name := range map[string]string{
+			"a": snapshot.DeltaName("test", "a", "G-0", ts, ts.Add(-time.Hour)),
+			"b": snapshot.Name("test", "b", "G-0", ts.Add(time.Second)),
+			"c": snapshot.Name("test", "c", "G-0", ts.Add(2*time.Second)),
+		} {
+			ni, err := snapshot.ParseName(name)
+			assert.NoError(t, err)
+			r.snapshotsByInstance[inst] = snapshot.Update{NameInfo: ni}
+		}
+	}
+	next := func() (names []string) {
+		for {
+			inst, _ := r.Next()
+			if inst == "" {
+				return names
+			}
+			names = append(names, inst)
+		}
+	}
+
+	// Oldest first
+	pending()
+	assert.Equal(t, []string{"a", "b", "c"}, next())
+
+	// Full snapshots before delta snapshots during a bulk load
+	r.StartBulkLoad(0)
+	assert.Equal(t, r.st, r.storage())
+	pending()
+	assert.Equal(t, []string{"b", "c", "a"}, next())
+
+	r.BulkLoadDone()
+	pending()
+	assert.Equal(t, []string{"a", "b", "c"}, next())
+}
+
+func TestReceiver_memoryBudget(t *testing.T) {
+	ts := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.New()
+	r := New(st, config.Config{
+		StoragePollInterval:         time.Hour,
+		MemoryDownloadedSnapshots:   1,
+		MemoryDecompressedSnapshots: 1,
+		MemorySpillDir:              t.TempDir(),
+	}, "test", logrus.New(), "self")
+	r.budget = membudget.New(1000)
+
+	// Another download is waiting for the budget
+	held, err := r.budget.Reserve(ctx, 900)
+	require.NoError(t, err)
+	waiter := make(chan *membudget.Reservation)
+	go func() {
+		res, err := r.budget.Reserve(ctx, 500)
+		assert.NoError(t, err)
+		waiter <- res
+	}()
+	require.Eventually(t, func() bool { return r.budget.Waiting() == 1 }, time.Second, time.Millisecond)
+
+	// The downloaded snapshot is spilled to disk, which frees the budget
+	require.NoError(t, st.Store(ctx, snapshot.Name("test", "a", "G-0", ts), emptySnapshot()))
+	require.NoError(t, r.RunOnce(ctx, false))
+	var update snapshot.Update
+	require.Eventually(t, func() bool {
+		var inst string
+		inst, update = r.Next()
+		return inst == "a"
+	}, time.Second, time.Millisecond)
+	path := update.Spilled()
+	require.NotEmpty(t, path)
+	assert.Equal(t, int64(900), r.budget.Used())
+
+	_, err = update.NewReader()
+	require.NoError(t, err)
+	update.Close()
+	assert.NoFileExists(t, path)
+
+	held.Release()
+	(<-waiter).Release()
+	assert.Equal(t, int64(0), r.budget.Used())
+}
@@ -0,0 +1,173 @@
+package receiver
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"powerdns.com/platform/lightningstream/backends/ranged"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// ErrBreakerOpen is returned by a load when the circuit breaker is open
+// because too many loads from the storage backend failed.
+var ErrBreakerOpen = errors.New("storage circuit breaker open, too many failed loads")
+
+// jitter randomly adds or removes up to fraction j of d
+func jitter(d time.Duration, j float64) time.Duration {
+	if j <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + j*(2*rand.Float64()-1)))
+}
+
+// backoff returns the delay before retry attempt n (starting at 1)
+func backoff(conf config.StorageLoadRetry, n int) time.Duration {
+	d := conf.Backoff
+	for i := 1; i < n && d < conf.MaxBackoff; i++ {
+		d *= 2
+	}
+	if conf.MaxBackoff > 0 && d > conf.MaxBackoff {
+		d = conf.MaxBackoff
+	}
+	return jitter(d, conf.Jitter)
+}
+
+// breaker is a circuit breaker for the loads from a storage backend. It
+// opens after a number of consecutive failures, and then rejects all loads
+// until the cooldown has passed. After that, a single load is allowed to
+// test the backend, which closes the breaker on success.
+type breaker struct {
+	threshold int // 0 disables
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool // load allowed after cooldown in progress
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow returns true if a load may be attempted
+func (b *breaker) allow() bool {
+	if b.threshold == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true // closed
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the result of a load that was allowed. It returns true if
+// this opened the breaker.
+func (b *breaker) done(err error) (opened bool) {
+	if b.threshold == 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+// isOpen returns true if loads are currently rejected
+func (b *breaker) isOpen() bool {
+	if b.threshold == 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
+
+// load loads a snapshot from the storage backend with retries. Every attempt
+// goes through the circuit breaker.
+func (r *Receiver) load(ctx context.Context, name string) ([]byte, error) {
+	return r.retry(ctx, name, func() ([]byte, error) {
+		return r.storage().Load(ctx, name)
+	})
+}
+
+// loadRange loads part of a snapshot like load. Backends that do not support
+// ranged loads return ranged.ErrUnsupported right away.
+func (r *Receiver) loadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	return r.retry(ctx, name, func() ([]byte, error) {
+		return ranged.Load(ctx, r.storage(), name, offset, length)
+	})
+}
+
+// retry calls load until it succeeds or the attempts are exhausted
+func (r *Receiver) retry(ctx context.Context, name string, load func() ([]byte, error)) ([]byte, error) {
+	conf := r.c.StorageLoadRetry
+	var err error
+	for attempt := 0; attempt < conf.Attempts || attempt == 0; attempt++ {
+		if attempt > 0 {
+			metricSnapshotsLoadRetries.WithLabelValues(r.lmdbname).Inc()
+			trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+				attribute.Int("attempt", attempt+1),
+				attribute.String("error", err.Error())))
+			if err := utils.SleepContext(ctx, backoff(conf, attempt)); err != nil {
+				return nil, err
+			}
+		}
+		if !r.breaker.allow() {
+			metricStorageBreakerRejected.WithLabelValues(r.lmdbname).Inc()
+			return nil, ErrBreakerOpen
+		}
+		var data []byte
+		data, err = load()
+		if errors.Is(err, ranged.ErrUnsupported) {
+			return nil, err
+		}
+		if r.breaker.done(err) {
+			r.l.WithError(err).WithField("cooldown", conf.BreakerCooldown).
+				Warn("Too many failed loads, opening storage circuit breaker")
+		}
+		metricStorageBreakerOpen.WithLabelValues(r.lmdbname).Set(b2f(r.breaker.isOpen()))
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		r.l.WithError(err).WithField("snapshot_name", name).WithField("attempt", attempt+1).
+			Debug("Load attempt failed")
+	}
+	return nil, err
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,121 @@
+package receiver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"powerdns.com/platform/lightningstream/config"
+)
+
+// flakyStorage fails the first n loads
+type flakyStorage struct {
+	simpleblob.Interface
+	fail  int
+	loads int
+}
+
+func (f *flakyStorage) Load(ctx context.Context, name string) ([]byte, error) {
+	f.loads++
+	if f.loads <= f.fail {
+		return nil, errors.New("503 Service Unavailable")
+	}
+	return f.Interface.Load(ctx, name)
+}
+
+func Test_backoff(t *testing.T) {
+	conf := config.StorageLoadRetry{
+		Backoff:    time.Second,
+		MaxBackoff: 5 * time.Second,
+	}
+	assert.Equal(t, time.Second, backoff(conf, 1))
+	assert.Equal(t, 2*time.Second, backoff(conf, 2))
+	assert.Equal(t, 4*time.Second, backoff(conf, 3))
+	assert.Equal(t, 5*time.Second, backoff(conf, 4))
+	assert.Equal(t, 5*time.Second, backoff(conf, 100))
+
+	conf.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		d := backoff(conf, 1)
+		assert.GreaterOrEqual(t, d, 800*time.Millisecond)
+		assert.LessOrEqual(t, d, 1200*time.Millisecond)
+	}
+}
+
+func Test_breaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	fail := errors.New("fail")
+
+	assert.True(t, b.allow())
+	assert.False(t, b.done(fail))
+	assert.True(t, b.allow())
+	assert.True(t, b.done(fail)) // opens
+	assert.True(t, b.isOpen())
+	assert.False(t, b.allow())
+
+	// Half-open after the cooldown, only one load allowed
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	assert.True(t, b.done(fail)) // reopens
+	assert.False(t, b.allow())
+
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow())
+	assert.False(t, b.done(nil)) // closes
+	assert.False(t, b.isOpen())
+	assert.True(t, b.allow())
+
+	// Disabled
+	b = newBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		assert.True(t, b.allow())
+		assert.False(t, b.done(fail))
+	}
+}
+
+func TestReceiver_load(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.New()
+	require.NoError(t, mem.Store(ctx, "foo", []byte("bar")))
+	st := &flakyStorage{Interface: mem, fail: 2}
+
+	r := New(st, config.Config{
+		StorageLoadRetry: config.StorageLoadRetry{
+			Attempts:         3,
+			Backoff:          time.Millisecond,
+			MaxBackoff:       time.Millisecond,
+			BreakerThreshold: 4,
+			BreakerCooldown:  time.Hour,
+		},
+	}, "test", logrus.New(), "self")
+
+	// Succeeds on the third attempt
+	data, err := r.load(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(data))
+	assert.Equal(t, 3, st.loads)
+
+	// All attempts fail
+	st.loads = 0
+	st.fail = 100
+	_, err = r.load(ctx, "foo")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrBreakerOpen)
+	assert.Equal(t, 3, st.loads)
+
+	// The fourth consecutive failure opens the breaker
+	_, err = r.load(ctx, "foo")
+	assert.ErrorIs(t, err, ErrBreakerOpen)
+	assert.Equal(t, 4, st.loads)
+	assert.True(t, r.breaker.isOpen())
+}
@@ -0,0 +1,106 @@
+package receiver
+
+import (
+	"sort"
+
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// generationTracker detects instance names that are used by multiple
+// processes at the same time (split-brain). Every process writes its
+// snapshots with a unique generation ID. After a restart, the snapshots of
+// the new generation follow those of the old one. When two processes use the
+// same instance name, the snapshots of their generations are interleaved.
+type generationTracker struct {
+	last  map[string]string          // last generation by instance
+	seen  map[string]map[string]bool // generations seen before the last one
+	split map[string][]string        // the interleaved generations by instance
+}
+
+func newGenerationTracker() *generationTracker {
+	return &generationTracker{
+		last:  make(map[string]string),
+		seen:  make(map[string]map[string]bool),
+		split: make(map[string][]string),
+	}
+}
+
+// add adds a snapshot. The snapshots of an instance must be added in
+// timestamp order.
+func (g *generationTracker) add(ni snapshot.NameInfo) {
+	inst := ni.InstanceID
+	last, exists := g.last[inst]
+	if !exists {
+		g.last[inst] = ni.GenerationID
+		return
+	}
+	if last == ni.GenerationID {
+		return
+	}
+	seen := g.seen[inst]
+	if seen == nil {
+		seen = make(map[string]bool)
+		g.seen[inst] = seen
+	}
+	if seen[ni.GenerationID] {
+		// A generation that was superseded before writes again
+		g.addSplit(inst, last, ni.GenerationID)
+	}
+	seen[last] = true
+	g.last[inst] = ni.GenerationID
+}
+
+func (g *generationTracker) addSplit(inst string, gens ...string) {
+	for _, gen := range gens {
+		found := false
+		for _, s := range g.split[inst] {
+			if s == gen {
+				found = true
+				break
+			}
+		}
+		if !found {
+			g.split[inst] = append(g.split[inst], gen)
+		}
+	}
+	sort.Strings(g.split[inst])
+}
+
+// SplitBrain returns the instances for which a split-brain was detected in the
+// last storage listing, with the generations involved.
+func (r *Receiver) SplitBrain() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make(map[string][]string, len(r.splitBrain))
+	for inst, gens := range r.splitBrain {
+		res[inst] = gens
+	}
+	return res
+}
+
+// updateSplitBrain reports the changes in the split-brain instances detected
+// in a storage listing
+func (r *Receiver) updateSplitBrain(split map[string][]string) {
+	r.mu.Lock()
+	prev := r.splitBrain
+	r.splitBrain = split
+	r.mu.Unlock()
+
+	for inst, gens := range split {
+		if _, exists := prev[inst]; exists {
+			continue
+		}
+		r.l.WithField("snapshot_instance", inst).
+			WithField("generations", gens).
+			WithField("action", r.c.SplitBrainAction).
+			Error("Split-brain: multiple processes are writing snapshots with the same instance name, " +
+				"which loses changes. Every process must have a unique instance name.")
+		metricSplitBrain.WithLabelValues(r.lmdbname, inst).Set(1)
+	}
+	for inst := range prev {
+		if _, exists := split[inst]; !exists {
+			r.l.WithField("snapshot_instance", inst).Info("Split-brain resolved")
+			metricSplitBrain.WithLabelValues(r.lmdbname, inst).Set(0)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package redact replaces or drops the values of sensitive entries before
+// they are written to snapshots, so that DBIs with secrets can be synced
+// without exporting the secrets to the storage bucket.
+//
+// Rules are configured per DBI with the redact DBI option. Other instances
+// merge a replaced value like any other value, so "drop" should be used for
+// entries that every instance has its own value for.
+package redact
+
+import (
+	"bytes"
+	"regexp"
+
+	"powerdns.com/platform/lightningstream/config"
+)
+
+// Redactor applies the redaction rules of a DBI
+type Redactor struct {
+	rules []rule
+}
+
+type rule struct {
+	prefix      []byte
+	key         *regexp.Regexp // nil matches all keys
+	drop        bool
+	value       *regexp.Regexp // nil replaces the whole value
+	replacement []byte
+}
+
+// New returns a Redactor for the rules, or nil if there are none
+func New(rules []config.RedactRule) (*Redactor, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &Redactor{}
+	for _, cr := range rules {
+		if err := cr.Check(); err != nil {
+			return nil, err
+		}
+		ru := rule{
+			prefix:      []byte(cr.KeyPrefix),
+			drop:        cr.Action == "drop",
+			replacement: []byte(cr.Replacement),
+		}
+		if cr.KeyRegex != "" {
+			ru.key = regexp.MustCompile(cr.KeyRegex) // validated by Check
+		}
+		if cr.ValueRegex != "" {
+			ru.value = regexp.MustCompile(cr.ValueRegex)
+		}
+		r.rules = append(r.rules, ru)
+	}
+	return r, nil
+}
+
+// Apply returns the value to write for an entry, and false if the entry
+// must be left out. Values of entries that no rule matches are returned as
+// is. The returned value must not be modified.
+func (r *Redactor) Apply(key, value []byte) ([]byte, bool) {
+	if r == nil {
+		return value, true
+	}
+	for _, ru := range r.rules {
+		if !bytes.HasPrefix(key, ru.prefix) || (ru.key != nil && !ru.key.Match(key)) {
+			continue
+		}
+		switch {
+		case ru.drop:
+			return nil, false
+		case ru.value != nil:
+			return ru.value.ReplaceAll(value, ru.replacement), true
+		default:
+			return ru.replacement, true
+		}
+	}
+	return value, true
+}
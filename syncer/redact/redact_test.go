@@ -0,0 +1,58 @@
+package redact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"powerdns.com/platform/lightningstream/config"
+)
+
+func TestRedactor_Apply(t *testing.T) {
+	r, err := New(nil)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	val, ok := r.Apply([]byte("key"), []byte("value"))
+	assert.True(t, ok)
+	assert.Equal(t, "value", string(val))
+
+	r, err = New([]config.RedactRule{
+		{KeyPrefix: "secret/", Action: "drop"},
+		{KeyRegex: `^user/\d+$`, ValueRegex: `"password":"[^"]*"`, Replacement: `"password":""`},
+		{KeyPrefix: "token/", KeyRegex: `/api$`, Replacement: "REDACTED"},
+	})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		key, value string
+		expected   string
+		keep       bool
+	}{
+		{"secret/a", "x", "", false},
+		{"user/12", `{"name":"a","password":"b"}`, `{"name":"a","password":""}`, true},
+		{"user/12/x", `{"password":"b"}`, `{"password":"b"}`, true},
+		{"token/api", "t0ken", "REDACTED", true},
+		{"token/web", "t0ken", "t0ken", true},
+		{"other", "x", "x", true},
+	} {
+		val, ok := r.Apply([]byte(tc.key), []byte(tc.value))
+		assert.Equal(t, tc.keep, ok, tc.key)
+		if ok {
+			assert.Equal(t, tc.expected, string(val), tc.key)
+		}
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	for _, rule := range []config.RedactRule{
+		{},
+		{KeyPrefix: "a", Action: "mask"},
+		{KeyPrefix: "a", Action: "drop", Replacement: "x"},
+		{KeyRegex: "("},
+		{KeyPrefix: "a", ValueRegex: "("},
+	} {
+		_, err := New([]config.RedactRule{rule})
+		assert.Error(t, err, "%+v", rule)
+	}
+}
@@ -0,0 +1,111 @@
+// Package schema implements the per-DBI schema descriptors, which declare the
+// value encoding of a DBI and optional value transformation hooks.
+//
+// Hooks allow applications that do not store their values in a form that is
+// suitable for syncing to adapt them, without forking Lightning Stream. A Go
+// program that embeds the syncer registers its hooks by name, and the
+// configuration selects them per DBI with the hook DBI option.
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Value encodings of a DBI
+const (
+	// EncodingRaw means that the application stores plain values, which
+	// requires schema_tracks_changes to be disabled.
+	EncodingRaw = "raw"
+
+	// EncodingHeader means that every value starts with the Lightning Stream
+	// header, which requires schema_tracks_changes.
+	EncodingHeader = "header"
+
+	// EncodingPDNS is the header encoding as written by PowerDNS Auth 4.8+.
+	// It is the same as EncodingHeader on the wire.
+	EncodingPDNS = "pdns"
+)
+
+// Encodings are all supported encodings
+var Encodings = []string{EncodingRaw, EncodingHeader, EncodingPDNS}
+
+// IsValidEncoding returns true for a known encoding, or an empty one.
+func IsValidEncoding(enc string) bool {
+	if enc == "" {
+		return true
+	}
+	for _, e := range Encodings {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresHeaders returns true if the encoding requires the LMDB to be
+// configured with schema_tracks_changes. The empty encoding follows the LMDB.
+func RequiresHeaders(enc string) bool {
+	return enc == EncodingHeader || enc == EncodingPDNS
+}
+
+// Hook transforms the application values of a DBI. Encode is applied to
+// values read from the LMDB when creating a snapshot, and Decode to values
+// from a snapshot before they are merged into the LMDB. Decode MUST reverse
+// Encode, and both MUST be deterministic, because instances compare the
+// values they have.
+//
+// The headers are not part of the value passed to the hook, and deleted
+// entries are never passed. The key and value are only valid during the call,
+// the returned value must not point into them if it is modified.
+type Hook interface {
+	Encode(dbiName string, key, value []byte) ([]byte, error)
+	Decode(dbiName string, key, value []byte) ([]byte, error)
+}
+
+var (
+	mu    sync.Mutex
+	hooks = make(map[string]Hook)
+)
+
+// Register registers a Hook under a name, so that it can be configured for a
+// DBI. It panics if the name is already registered or the hook is nil.
+func Register(name string, h Hook) {
+	mu.Lock()
+	defer mu.Unlock()
+	if h == nil {
+		panic("schema: nil hook registered: " + name)
+	}
+	if _, exists := hooks[name]; exists {
+		panic("schema: hook registered twice: " + name)
+	}
+	hooks[name] = h
+}
+
+// Hooks returns the sorted names of all registered hooks
+func Hooks() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var names []string
+	for name := range hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the hook registered under name. An empty name returns nil
+// without an error.
+func Get(name string) (Hook, error) {
+	if name == "" {
+		return nil, nil
+	}
+	mu.Lock()
+	h, exists := hooks[name]
+	mu.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown hook %q (available: %v)", name, Hooks())
+	}
+	return h, nil
+}
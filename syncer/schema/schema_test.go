@@ -0,0 +1,38 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopHook struct{}
+
+func (nopHook) Encode(dbiName string, key, value []byte) ([]byte, error) { return value, nil }
+func (nopHook) Decode(dbiName string, key, value []byte) ([]byte, error) { return value, nil }
+
+func TestRegister(t *testing.T) {
+	Register("nop", nopHook{})
+	assert.Panics(t, func() { Register("nop", nopHook{}) })
+	assert.Panics(t, func() { Register("nil", nil) })
+	assert.Contains(t, Hooks(), "nop")
+
+	h, err := Get("nop")
+	require.NoError(t, err)
+	assert.Equal(t, nopHook{}, h)
+	h, err = Get("")
+	require.NoError(t, err)
+	assert.Nil(t, h)
+	_, err = Get("unknown")
+	assert.Error(t, err)
+}
+
+func TestEncodings(t *testing.T) {
+	assert.True(t, IsValidEncoding(""))
+	assert.True(t, IsValidEncoding(EncodingPDNS))
+	assert.False(t, IsValidEncoding("json"))
+	assert.True(t, RequiresHeaders(EncodingHeader))
+	assert.False(t, RequiresHeaders(EncodingRaw))
+	assert.False(t, RequiresHeaders(""))
+}
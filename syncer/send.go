@@ -1,6 +1,7 @@
 package syncer
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strings"
@@ -9,20 +10,35 @@ import (
 	"github.com/PowerDNS/lmdb-go/lmdb"
 	"github.com/c2h5oh/datasize"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"powerdns.com/platform/lightningstream/lmdbenv"
 	"powerdns.com/platform/lightningstream/lmdbenv/header"
 	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/status/webhook"
+	"powerdns.com/platform/lightningstream/syncer/peer"
 	"powerdns.com/platform/lightningstream/utils"
 )
 
 func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnID, err error) {
-	var msg = new(snapshot.Snapshot)
-	msg.FormatVersion = snapshot.CurrentFormatVersion
-	msg.CompatVersion = snapshot.WriteCompatFormatVersion
-	msg.Meta.DatabaseName = s.name
-	msg.Meta.Hostname = hostname
-	msg.Meta.InstanceID = s.instanceID()
-	msg.Meta.GenerationID = s.generationID()
+	ctx, span := tracer.Start(ctx, "SendOnce", trace.WithAttributes(
+		attribute.String("lmdb", s.name)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	var meta snapshot.Meta
+	meta.DatabaseName = s.name
+	meta.Hostname = hostname
+	meta.InstanceID = s.instanceID()
+	meta.GenerationID = s.generationID()
+	meta.Loaded = s.loadedSnapshots()
+
+	// The snapshot is compressed while the DBIs are read, so that we never
+	// need to hold the complete uncompressed snapshot in memory.
+	var buf bytes.Buffer
+	var sw *snapshot.StreamWriter
+	dbiEntries := make(map[string]int) // for metrics
 
 	t0 := time.Now() // for performance measurements
 
@@ -34,13 +50,22 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 
 	schemaTracksChanges := s.lc.SchemaTracksChanges
 
+	// Only include changes since the last full snapshot if we can write
+	// a delta snapshot.
+	base := s.nextDeltaBase(t0)
+
+	// Local changes for the change feed, if enabled
+	changes := s.newChangeSet()
+
 	txnRawRead := false
 	var inTxn func(lmdb.TxnOp) error
 	if schemaTracksChanges {
 		inTxn = env.View
 		txnRawRead = true // []byte will point directly into LMDB, potentially unsafe
 	} else {
-		inTxn = env.Update
+		inTxn = func(fn lmdb.TxnOp) error {
+			return s.update(env, fn)
+		}
 	}
 
 	err = inTxn(func(txn *lmdb.Txn) error {
@@ -48,15 +73,16 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 		// if this is env.View, but this is only safe if the returned []byte
 		// keys and values are not used outside the transaction, because
 		// they point into the LMDB pages.
-		// This is safe here, because s.readDBI() allocates an arena []byte and
-		// copies all keys and values in there when txn.RawRead is set.
+		// This is safe here, because s.streamDBI() copies all keys and values
+		// into its chunk buffer before they are compressed.
 		txn.RawRead = txnRawRead
 
 		// Determine snapshot timestamp after we opened the transaction
 		ts = time.Now()
 		tTxnAcquire = ts
-		tsNano := header.TimestampFromTime(ts)
-		msg.Meta.TimestampNano = uint64(tsNano)
+		tsNano := s.clock.Now(ts)
+		ts = tsNano.Time() // can be ahead of the wall clock with hybrid_clock
+		meta.TimestampNano = uint64(tsNano)
 
 		// Get the actual transaction ID we ended up opening, which could be
 		// higher than the one we received from env.Info() if a new one was
@@ -68,7 +94,9 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 
 		// First update the shadow dbs
 		if !schemaTracksChanges {
+			ctx, shadowSpan := tracer.Start(ctx, "copy_shadow")
 			err := s.mainToShadow(ctx, txn, tsNano)
+			endSpan(shadowSpan, err)
 			if err != nil {
 				return err
 			}
@@ -86,22 +114,67 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 			return err
 		}
 
-		// Dump all DBIs using their shadow db
+		sw, err = snapshot.NewStreamWriter(&buf, s.compression,
+			snapshot.CurrentFormatVersion, snapshot.WriteCompatFormatVersion)
+		if err != nil {
+			return err
+		}
+		if n := s.c.MemorySnapshotChunkSize; n > 0 {
+			sw.ChunkSize = int(n)
+		}
+		if s.c.StorageHashTree {
+			sw.HashTree = true
+			sw.ChunkSize = int(s.c.StorageHashTreeChunkSize)
+		}
+		sw.Signer = s.signer
+
+		var syncNames []string
 		for _, dbiName := range dbiNames {
 			if strings.HasPrefix(dbiName, SyncDBIPrefix) {
 				continue // skip our own special dbs
 			}
+			if !s.lc.IsDBIIncluded(dbiName) {
+				continue // excluded from sync
+			}
+			syncNames = append(syncNames, dbiName)
+		}
+
+		// Entries of PowerDNS zones that are not replicated are never sent
+		filter, err := s.newZoneFilter(txn, "send")
+		if err != nil {
+			return err
+		}
+		defer filter.done(s)
+
+		// Other transactions cannot see the changes to the shadow dbs we
+		// just made, so the DBIs can only be read in parallel when the
+		// schema tracks changes.
+		if schemaTracksChanges && s.c.SnapshotReadWorkers > 1 && len(syncNames) > 1 {
+			txns, err := beginReadTxns(env, txnID, s.c.SnapshotReadWorkers)
+			if err != nil {
+				return err
+			}
+			if txns != nil {
+				return s.streamDBIsParallel(ctx, txns, syncNames, base, changes, filter, sw, dbiEntries)
+			}
+			s.l.Debug("LMDB changed while starting read transactions, " +
+				"reading DBIs sequentially")
+		}
 
+		// Dump all DBIs using their shadow db
+		for _, dbiName := range syncNames {
 			readDBIName := dbiName
 			if !schemaTracksChanges {
-				readDBIName = SyncDBIShadowPrefix + dbiName
+				readDBIName, err = s.shadowDBIName(dbiName)
+				if err != nil {
+					return err
+				}
 			}
-			dbiMsg, err := s.readDBI(txn, readDBIName, dbiName, false)
+			n, err := s.streamDBI(txn, readDBIName, dbiName, base, changes, filter, sw)
 			if err != nil {
-				return fmt.Errorf("dbi %s: %w", dbiNames, err)
+				return fmt.Errorf("dbi %s: %w", dbiName, err)
 			}
-
-			msg.Databases = append(msg.Databases, dbiMsg)
+			dbiEntries[dbiName] = n
 
 			if utils.IsCanceled(ctx) {
 				return context.Canceled
@@ -127,7 +200,7 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 			Debug("Adjusting TxnID (no changes)")
 		txnID = header.TxnID(info.LastTxnID)
 	}
-	msg.Meta.LmdbTxnID = int64(txnID)
+	meta.LmdbTxnID = int64(txnID)
 
 	// Return before actually writing a snapshot, but after the txnID was adjusted
 	// when we are in receive-only mode.
@@ -136,32 +209,84 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 		return txnID, nil
 	}
 
-	out, dds, err := snapshot.DumpData(msg)
+	dds, err := sw.Close(meta)
 	if err != nil {
 		return 0, err
 	}
+	out := buf.Bytes()
 	tDumpedData := time.Now()
 
-	msg = nil // no longer needed
+	if s.isUnchanged(base, dds.DataSHA256, tDumpedData) {
+		s.l.WithField("txnID", txnID).Debug("Snapshot store skipped, because the data did not change")
+		metricSnapshotsSkippedUnchanged.WithLabelValues(s.name).Inc()
+		// The last snapshot stored has the same data, so it incorporates
+		// the snapshots of other instances loaded since as well.
+		s.cleaner.SetCommitted(s.lastByInstance)
+		s.changesSince = txnID
+		return txnID, nil
+	}
+
+	// Reading, serializing and compressing the DBIs happen at the same time,
+	// so these are a single span with the compression time as an attribute.
+	_, dumpSpan := tracer.Start(ctx, "dump", trace.WithTimestamp(tShadow))
+	dumpSpan.SetAttributes(
+		attribute.Int("dbis", len(dbiEntries)),
+		attribute.Bool("delta", base != nil),
+		attribute.Int64("uncompressed_bytes", int64(dds.ProtobufSize)),
+		attribute.Int("compressed_bytes", len(out)),
+		seconds("compress_seconds", dds.TCompressed),
+	)
+	dumpSpan.End(trace.WithTimestamp(tDumpedData))
+
 	timeGC := utils.GC()
 
 	metricSnapshotsLoaded.WithLabelValues(s.name).Inc()
 	metricSnapshotsLastTimestamp.WithLabelValues(s.name).Set(float64(ts.UnixNano()) / 1e9)
 	metricSnapshotsLastSize.WithLabelValues(s.name).Set(float64(len(out)))
+	for dbiName, n := range dbiEntries {
+		metricSnapshotsGeneratedDBIEntries.WithLabelValues(s.name, dbiName).Set(float64(n))
+	}
 
 	// Send it to storage
-	name := snapshot.Name(s.name, s.instanceID(), s.generationID(), ts)
+	ext := s.compression.Extension()
+	name := snapshot.NameWithExtension(s.name, s.instanceID(), s.generationID(), ts, ext)
+	if base != nil {
+		name = snapshot.DeltaNameWithExtension(s.name, s.instanceID(), s.generationID(), ts, base.Time, ext)
+		metricSnapshotsDelta.WithLabelValues(s.name).Inc()
+	}
+	if s.opt.DryRun {
+		s.l.WithFields(logrus.Fields{
+			"uncompressed_size": dds.ProtobufSize.HumanReadable(),
+			"snapshot_size":     datasize.ByteSize(len(out)).HumanReadable(),
+			"snapshot_name":     name,
+			"delta":             base != nil,
+			"dbi_entries":       dbiEntries,
+		}).Info("Dry run: snapshot would be stored")
+		return txnID, nil
+	}
+	storeCtx, storeSpan := tracer.Start(ctx, "store", trace.WithAttributes(
+		attribute.String("snapshot_name", name),
+		attribute.Int("bytes", len(out))))
 	for i := 0; i < s.c.StorageRetryCount || s.c.StorageRetryForever; i++ {
 		metricSnapshotsStoreCalls.Inc()
-		err = s.st.Store(ctx, name, out)
+		storeSpan.SetAttributes(attribute.Int("attempts", i+1))
+		err = s.st.Store(storeCtx, name, out)
 		if err != nil {
 			s.l.WithError(err).Warn("Store failed, retrying")
 			metricSnapshotsStoreFailed.WithLabelValues(s.name).Inc()
 
 			// Signal failure to health tracker
 			s.storageStoreHealth.AddFailure(err)
+			webhook.Notify(webhook.Event{
+				Event:        webhook.EventStorageError,
+				LMDB:         s.name,
+				SnapshotName: name,
+				Operation:    "store",
+				Error:        err.Error(),
+			})
 
 			if err := utils.SleepContext(ctx, s.c.StorageRetryInterval); err != nil {
+				endSpan(storeSpan, err)
 				return 0, err
 			}
 			continue
@@ -174,12 +299,27 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 
 		break
 	}
+	endSpan(storeSpan, err)
 	if err != nil {
 		s.l.WithError(err).Warn("Store failed too many times, giving up")
 		metricSnapshotsStoreFailedPermanently.WithLabelValues(s.name).Inc()
 		return 0, err
 	}
 	tStored := time.Now()
+	s.lastStored.Store(ts)
+	s.lastStoredSum = dds.DataSHA256
+	s.lastStoredBase = time.Time{}
+	if base != nil {
+		s.lastStoredBase = base.Time
+	}
+
+	// Deltas are relative to the last full snapshot. We use the adjusted
+	// txnID, because LMDB reuses the ID of an empty transaction.
+	s.updateDeltaState(base != nil, &deltaBase{
+		Time:      ts,
+		Timestamp: header.TimestampFromTime(ts),
+		TxnID:     txnID,
+	}, len(out))
 
 	var compressionRatio string
 	if dds.CompressedSize > 0 {
@@ -191,7 +331,7 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 		"time_acquire":      utils.TimeDiff(tTxnAcquire, t0),
 		"time_copy_shadow":  tShadow.Sub(tTxnAcquire).Round(time.Millisecond),
 		"time_dump":         tDumped.Sub(tShadow).Round(time.Millisecond),
-		"time_compress":     dds.TCompressed.Round(time.Millisecond),
+		"time_compress":     dds.TCompressed.Round(time.Millisecond), // part of time_dump
 		"time_store":        tStored.Sub(tDumpedData).Round(time.Millisecond),
 		"time_gc":           timeGC,
 		"time_total":        tStored.Sub(t0).Round(time.Millisecond),
@@ -199,12 +339,46 @@ func (s *Syncer) SendOnce(ctx context.Context, env *lmdb.Env) (txnID header.TxnI
 		"compression_ratio": compressionRatio,
 		"snapshot_size":     datasize.ByteSize(len(out)).HumanReadable(),
 		"snapshot_name":     name,
+		"delta":             base != nil,
 		"txnID":             txnID,
 	}).Info("Stored snapshot")
 
+	webhook.Notify(webhook.Event{
+		Event:        webhook.EventSnapshotStored,
+		LMDB:         s.name,
+		SnapshotName: name,
+	})
+	peer.Publish(s.name, name, out)
+	s.publishChanges(changes, name)
+	s.changesSince = txnID
+
 	// Tell the cleaner which snapshots made by other instances have been
 	// incorporated in the last snapshot that we sent.
 	s.cleaner.SetCommitted(s.lastByInstance)
 
 	return txnID, nil
 }
+
+// isUnchanged returns true if a snapshot with this data checksum and delta
+// base would have the same data as the last snapshot stored, and does not
+// need to be stored. Deltas contain all changes since their base, so a delta
+// is compared with the last delta on the same base.
+// Snapshots are always stored once storage_force_snapshot_interval passed,
+// or when a full snapshot was requested.
+func (s *Syncer) isUnchanged(base *deltaBase, sum []byte, now time.Time) bool {
+	if !s.c.StorageSkipUnchangedSnapshots || s.delta.forceFull {
+		return false
+	}
+	if len(s.lastStoredSum) == 0 || !bytes.Equal(sum, s.lastStoredSum) {
+		return false
+	}
+	var baseTime time.Time
+	if base != nil {
+		baseTime = base.Time
+	}
+	if !baseTime.Equal(s.lastStoredBase) {
+		return false
+	}
+	dt := s.forceSnapshotInterval.Load()
+	return dt <= 0 || now.Sub(s.lastStored.Load()) < dt
+}
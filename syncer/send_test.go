@@ -9,10 +9,12 @@ import (
 	"github.com/PowerDNS/lmdb-go/lmdb"
 	"github.com/PowerDNS/simpleblob/backends/memory"
 	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/lmdbenv"
 	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
 )
 
 func BenchmarkSyncer_SendOnce_native_100k(b *testing.B) {
@@ -93,3 +95,110 @@ func doBenchmarkSyncerSendOnce(b *testing.B, native, dupsort bool) {
 	})
 	require.NoError(b, err)
 }
+
+func TestSyncer_SendOnce_parallel(t *testing.T) {
+	ctx := context.Background()
+	lc := config.LMDB{SchemaTracksChanges: true}
+	val := h(testTS(1), 42, header.NoFlags) + "value"
+
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		err := env.Update(func(txn *lmdb.Txn) error {
+			for i := 0; i < 5; i++ {
+				dbi, err := txn.OpenDBI(fmt.Sprintf("dbi-%d", i), lmdb.Create)
+				require.NoError(t, err)
+				for j := 0; j < 1000*i; j++ {
+					key := []byte(fmt.Sprintf("key-%d", j))
+					require.NoError(t, txn.Put(dbi, key, b(val), 0))
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		// Dump with the given number of workers and return the DBIs
+		dump := func(workers int) []*snapshot.DBI {
+			st := memory.New()
+			c := config.Config{SnapshotReadWorkers: workers, StorageRetryCount: 1}
+			s, err := New("test", env, st, c, lc, Options{})
+			require.NoError(t, err)
+			_, err = s.SendOnce(ctx, env)
+			require.NoError(t, err)
+			ls, err := st.List(ctx, "")
+			require.NoError(t, err)
+			require.Len(t, ls, 1)
+			data, err := st.Load(ctx, ls[0].Name)
+			require.NoError(t, err)
+			snap, err := snapshot.LoadData(data)
+			require.NoError(t, err)
+			return snap.Databases
+		}
+
+		sequential := dump(1)
+		parallel := dump(3)
+		require.Len(t, parallel, len(sequential))
+		for i, dbi := range sequential {
+			assert.Equal(t, dbi.Name(), parallel[i].Name())
+			assert.Equal(t, dbi.Marshal(), parallel[i].Marshal())
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestSyncer_SendOnce_unchanged(t *testing.T) {
+	ctx := context.Background()
+	lc := config.LMDB{
+		SchemaTracksChanges: true,
+		ExcludeDBIs:         []string{"excluded"},
+	}
+	put := func(env *lmdb.Env, dbiName, val string) {
+		err := env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.OpenDBI(dbiName, lmdb.Create)
+			require.NoError(t, err)
+			return txn.Put(dbi, []byte("key"), b(h(testTS(1), 42, header.NoFlags)+val), 0)
+		})
+		require.NoError(t, err)
+	}
+
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		st := memory.New()
+		c := config.Config{StorageRetryCount: 1, StorageSkipUnchangedSnapshots: true}
+		s, err := New("test", env, st, c, lc, Options{})
+		require.NoError(t, err)
+		count := func() int {
+			ls, err := st.List(ctx, "")
+			require.NoError(t, err)
+			return len(ls)
+		}
+
+		put(env, "foo", "v1")
+		_, err = s.SendOnce(ctx, env)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count())
+
+		// A transaction that only changed an excluded DBI
+		put(env, "excluded", "v1")
+		_, err = s.SendOnce(ctx, env)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count())
+
+		put(env, "foo", "v2")
+		_, err = s.SendOnce(ctx, env)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count())
+
+		// Requested full snapshots are always stored
+		s.delta.forceFull = true
+		_, err = s.SendOnce(ctx, env)
+		require.NoError(t, err)
+		assert.Equal(t, 3, count())
+
+		// Unless disabled
+		s.c.StorageSkipUnchangedSnapshots = false
+		_, err = s.SendOnce(ctx, env)
+		require.NoError(t, err)
+		assert.Equal(t, 4, count())
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -31,8 +31,16 @@ func (s *Syncer) mainToShadow(ctx context.Context, txn *lmdb.Txn, tsNano header.
 		if strings.HasPrefix(dbiName, SyncDBIPrefix) {
 			continue // skip shadow and other special databases
 		}
+		if !s.lc.IsDBIIncluded(dbiName) {
+			continue // excluded from sync
+		}
+		targetDBIName, err := s.shadowDBIName(dbiName)
+		if err != nil {
+			return err
+		}
+
 		// raw dump, because main does not have timestamps
-		dbiMsg, err := s.readDBI(txn, dbiName, dbiName, true)
+		dbiMsg, err := s.readDBI(txn, dbiName, dbiName, true, nil, nil, nil)
 		if err != nil {
 			return err
 		}
@@ -48,12 +56,20 @@ func (s *Syncer) mainToShadow(ctx context.Context, txn *lmdb.Txn, tsNano header.
 		}
 
 		isDupSort := dbiFlags&lmdb.DupSort > 0
-		if isDupSort && !s.lc.DupSortHack {
-			return fmt.Errorf("mainToShadow: dupsort db %q found and dupsort_hack disabled", dbiName)
+		if isDupSort && !s.lc.DupSortHack && !s.lc.DupSortNative {
+			return fmt.Errorf("mainToShadow: dupsort db %q found and neither dupsort_hack nor dupsort_native enabled", dbiName)
 		}
+		isDupSortNative := isDupSort && s.lc.DupSortNative
 
-		// If the DBI has MDB_INTEGERKEY set, our shadow db will use the same
+		// If the DBI has MDB_INTEGERKEY or MDB_REVERSEKEY set, our shadow db
+		// will use the same, so that the keys are ordered the same.
 		var targetFlags = dbiFlags & uint(AllowedShadowDBIFlagsMask)
+		if isDupSortNative {
+			targetFlags |= lmdb.DupSort
+		}
+		if err := s.rebuildMismatchedShadow(txn, targetDBIName, isDupSort, targetFlags); err != nil {
+			return err
+		}
 
 		if s.lc.DupSortHack && isDupSort {
 			dbiMsg, err = dupSortHackEncode(dbiMsg)
@@ -66,12 +82,19 @@ func (s *Syncer) mainToShadow(ctx context.Context, txn *lmdb.Txn, tsNano header.
 			return context.Canceled
 		}
 
-		targetDBIName := SyncDBIShadowPrefix + dbiName
 		targetDBI, err := txn.OpenDBI(targetDBIName, lmdb.Create|targetFlags)
 		if err != nil {
 			return err
 		}
 
+		if isDupSortNative {
+			err = mainToShadowDupSort(txn, dbiName, targetDBIName, dbiMsg, tsNano)
+			if err != nil {
+				return fmt.Errorf("dupsort_native error for DBI %s: %w", dbiName, err)
+			}
+			continue
+		}
+
 		it, err := NewNativeIterator(
 			snapshot.CurrentFormatVersion,
 			snapshot.CompatFormatVersion,
@@ -93,6 +116,7 @@ func (s *Syncer) mainToShadow(ctx context.Context, txn *lmdb.Txn, tsNano header.
 	}
 
 	tStored := time.Now()
+	metricShadowSyncDuration.WithLabelValues(s.name, "main_to_shadow").Observe(tStored.Sub(t0).Seconds())
 
 	s.l.WithFields(logrus.Fields{
 		"time_total": tStored.Sub(t0).Round(time.Millisecond),
@@ -105,18 +129,28 @@ func (s *Syncer) mainToShadow(ctx context.Context, txn *lmdb.Txn, tsNano header.
 // The sync is unidirectional. After the sync the main database will contain
 // all the non-deleted key-values present in the shadow database.
 func (s *Syncer) shadowToMain(ctx context.Context, txn *lmdb.Txn) error {
-	t0 := time.Now()
-
 	// List of DBIs to dump
 	dbiNames, err := lmdbenv.ReadDBINames(txn)
 	if err != nil {
 		return err
 	}
+	return s.shadowToMainDBIs(ctx, txn, dbiNames)
+}
 
+// shadowToMainDBIs is shadowToMain for the given DBIs only
+func (s *Syncer) shadowToMainDBIs(ctx context.Context, txn *lmdb.Txn, dbiNames []string) error {
+	t0 := time.Now()
 	for _, dbiName := range dbiNames {
 		if strings.HasPrefix(dbiName, SyncDBIPrefix) {
 			continue // skip shadow and other special databases
 		}
+		if !s.lc.IsDBIIncluded(dbiName) {
+			continue // excluded from sync
+		}
+		shadowDBIName, err := s.shadowDBIName(dbiName)
+		if err != nil {
+			return err
+		}
 
 		// The target is the current DBI
 		targetDBI, err := txn.OpenDBI(dbiName, 0)
@@ -129,19 +163,24 @@ func (s *Syncer) shadowToMain(ctx context.Context, txn *lmdb.Txn) error {
 		}
 
 		isDupSort := dbiFlags&lmdb.DupSort > 0
-		if isDupSort && !s.lc.DupSortHack {
-			return fmt.Errorf("shadowToMain: dupsort db %q found and dupsort_hack disabled", dbiName)
+		if isDupSort && !s.lc.DupSortHack && !s.lc.DupSortNative {
+			return fmt.Errorf("shadowToMain: dupsort db %q found and neither dupsort_hack nor dupsort_native enabled", dbiName)
 		}
 
 		// Dump associated shadow database. We will ignore the timestamps.
 		// At this point the shadow database must exist, as this function call
 		// will always be preceded by a mainToShadow call.
-		dbiMsg, err := s.readDBI(txn, SyncDBIShadowPrefix+dbiName, dbiName, false)
+		dbiMsg, err := s.readDBI(txn, shadowDBIName, dbiName, false, nil, nil, nil)
 		if err != nil {
 			return err
 		}
 
-		if isDupSort {
+		if isDupSort && s.lc.DupSortNative {
+			dbiMsg, err = dupSortShadowToPlain(dbiMsg)
+			if err != nil {
+				return fmt.Errorf("dupsort_native error for DBI %s: %w", dbiName, err)
+			}
+		} else if isDupSort {
 			dbiMsg, err = dupSortHackDecode(dbiMsg)
 			if err != nil {
 				return fmt.Errorf("dupsort_hack error for DBI %s: %w", dbiName, err)
@@ -174,6 +213,7 @@ func (s *Syncer) shadowToMain(ctx context.Context, txn *lmdb.Txn) error {
 	}
 
 	tStored := time.Now()
+	metricShadowSyncDuration.WithLabelValues(s.name, "shadow_to_main").Observe(tStored.Sub(t0).Seconds())
 
 	s.l.WithFields(logrus.Fields{
 		"time_total": tStored.Sub(t0).Round(time.Millisecond),
@@ -181,3 +221,13 @@ func (s *Syncer) shadowToMain(ctx context.Context, txn *lmdb.Txn) error {
 	}).Info("Synced data from shadow")
 	return nil
 }
+
+// shadowDBIName returns the name of the shadow DBI for a DBI. DBIs that are
+// excluded from sync must never be written to a shadow DBI, so this returns
+// an error for those.
+func (s *Syncer) shadowDBIName(dbiName string) (string, error) {
+	if !s.lc.IsDBIIncluded(dbiName) {
+		return "", fmt.Errorf("DBI %q is excluded from sync and cannot have a shadow DBI", dbiName)
+	}
+	return SyncDBIShadowPrefix + dbiName, nil
+}
@@ -73,7 +73,7 @@ func TestSyncer_shadow(t *testing.T) {
 			// Reverse sync should not change the original data
 			err = s.shadowToMain(context.Background(), txn)
 			assert.NoError(t, err)
-			dbiMsg, err := s.readDBI(txn, "foo", "foo", true)
+			dbiMsg, err := s.readDBI(txn, "foo", "foo", true, nil, nil, nil)
 			assert.NoError(t, err)
 			entries, err := dbiMsg.AsInefficientKVList()
 			assert.NoError(t, err)
@@ -185,3 +185,44 @@ func TestSyncer_shadow(t *testing.T) {
 	assert.NoError(t, err)
 
 }
+
+func TestSyncer_shadow_excludeDBIs(t *testing.T) {
+	lc := config.LMDB{
+		IncludeDBIs: []string{"foo*", "cache*"},
+		ExcludeDBIs: []string{"cache_*"},
+	}
+	assert.True(t, lc.IsDBIIncluded("foo"))
+	assert.True(t, lc.IsDBIIncluded("cache"))
+	assert.False(t, lc.IsDBIIncluded("cache_1"))
+	assert.False(t, lc.IsDBIIncluded("bar"))
+
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		s, err := New("test", env, nil, config.Config{}, lc, Options{})
+		assert.NoError(t, err)
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			for _, name := range []string{"foo", "cache_1", "bar"} {
+				dbi, err := txn.OpenDBI(name, lmdb.Create)
+				assert.NoError(t, err)
+				assert.NoError(t, txn.Put(dbi, b("a"), b("abc"), 0))
+			}
+
+			// Excluded DBIs do not get a shadow DBI
+			err = s.mainToShadow(context.Background(), txn, testTS(1))
+			assert.NoError(t, err)
+			names, err := lmdbenv.ReadDBINames(txn)
+			assert.NoError(t, err)
+			assert.Contains(t, names, SyncDBIShadowPrefix+"foo")
+			assert.NotContains(t, names, SyncDBIShadowPrefix+"cache_1")
+			assert.NotContains(t, names, SyncDBIShadowPrefix+"bar")
+
+			_, err = s.shadowDBIName("cache_1")
+			assert.Error(t, err)
+
+			err = s.shadowToMain(context.Background(), txn)
+			assert.NoError(t, err)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,68 @@
+package syncer
+
+import (
+	"context"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+)
+
+// workContext returns a context that is cancelled shutdown_timeout after ctx
+// is cancelled, or when the returned CancelFunc is called.
+func (s *Syncer) workContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	workCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-workCtx.Done():
+			return
+		}
+		if timeout := s.c.ShutdownTimeout; timeout > 0 {
+			s.l.WithField("timeout", timeout).Info("Shutting down, finishing work in progress")
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			select {
+			case <-t.C:
+				s.l.Warn("Shutdown timeout reached, aborting work in progress")
+			case <-workCtx.Done():
+			}
+		}
+		cancel()
+	}()
+	return workCtx, cancel
+}
+
+// flushOnShutdown writes a final snapshot when the LMDB has changed since the
+// last snapshot, so that these changes are not only written after a restart.
+// Errors are only logged, because we are exiting anyway.
+// If canSend is false, we have not loaded our own old snapshot yet, and must
+// not write a snapshot.
+func (s *Syncer) flushOnShutdown(ctx context.Context, env *lmdb.Env, lastSyncedTxnID header.TxnID, canSend bool) {
+	if s.opt.ReceiveOnly || s.c.ShutdownTimeout <= 0 || ctx.Err() != nil {
+		return
+	}
+	info, err := env.Info()
+	if err != nil {
+		s.l.WithError(err).Error("Final snapshot on shutdown failed")
+		return
+	}
+	if header.TxnID(info.LastTxnID) <= lastSyncedTxnID {
+		s.l.Debug("No local changes to write on shutdown")
+		return
+	}
+	if !canSend {
+		s.l.Warn("Not writing a final snapshot on shutdown, because our own old snapshot was not loaded yet")
+		return
+	}
+	if s.pausedSend.Load() {
+		s.l.Warn("Not writing a final snapshot on shutdown, because sending is paused")
+		return
+	}
+	s.l.Info("Writing final snapshot of local changes before shutdown")
+	if _, err := s.SendOnce(ctx, env); err != nil {
+		s.l.WithError(err).Error("Final snapshot on shutdown failed")
+		return
+	}
+	s.l.Info("Final snapshot written")
+}
@@ -0,0 +1,254 @@
+package syncer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// LMDB cannot rename DBIs, so a staged load cannot swap a staging DBI with
+// a main DBI. Instead, the write transactions that decode a large snapshot
+// only write the entries that differ from the local ones to the private
+// SyncDBIStaging DBI. The last transaction merges these into the shadow or
+// native DBIs and updates the main DBIs, so its duration depends on the
+// number of changed entries instead of the size of the snapshot. The
+// application sees the whole snapshot applied at once.
+//
+// The staged entries are merged with the normal rules in the last
+// transaction, so local changes made between the transactions are not lost.
+
+// stagedDBI is a run of consecutive entries of a DBI in the staging DBI
+type stagedDBI struct {
+	name      string
+	flags     uint64
+	transform string
+	n         int
+}
+
+// stageKey returns the staging DBI key of the entry with the given sequence
+// number, which keeps the entries in snapshot order.
+func stageKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+// stageValue encodes a snapshot entry for the staging DBI
+func stageValue(kv snapshot.KV) []byte {
+	b := make([]byte, 14, 14+len(kv.Key)+len(kv.Value))
+	binary.BigEndian.PutUint16(b, uint16(len(kv.Key)))
+	binary.BigEndian.PutUint64(b[2:], kv.TimestampNano)
+	binary.BigEndian.PutUint32(b[10:], kv.Flags)
+	b = append(b, kv.Key...)
+	return append(b, kv.Value...)
+}
+
+// parseStageValue does the opposite of stageValue
+func parseStageValue(b []byte) (kv snapshot.KV, err error) {
+	if len(b) < 14 {
+		return kv, fmt.Errorf("staged entry too short")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 14+n {
+		return kv, fmt.Errorf("staged entry too short for key length %d", n)
+	}
+	kv.TimestampNano = binary.BigEndian.Uint64(b[2:])
+	kv.Flags = binary.BigEndian.Uint32(b[10:])
+	kv.Key = b[14 : 14+n]
+	kv.Value = b[14+n:]
+	return kv, nil
+}
+
+// resetStaging empties the staging DBI, which can have entries left by a
+// load that was interrupted.
+func (s *Syncer) resetStaging(txn *lmdb.Txn) error {
+	s.staged = nil
+	s.stagedSeq = 0
+	dbi, err := txn.OpenDBI(SyncDBIStaging, lmdb.Create)
+	if err != nil {
+		return err
+	}
+	return txn.Drop(dbi, false)
+}
+
+// stageDBI writes the entries of a snapshot DBI message that differ from the
+// local entries to the staging DBI
+func (s *Syncer) stageDBI(txn *lmdb.Txn, l logrus.FieldLogger, sr *snapshot.StreamReader, dbiMsg *snapshot.DBI) error {
+	dbiMsg, err := s.prepareDBI(txn, l, sr, dbiMsg)
+	if err != nil || dbiMsg == nil {
+		return err
+	}
+	dbiName := dbiMsg.Name()
+	unchanged, err := s.unchangedFunc(txn, dbiMsg)
+	if err != nil {
+		return err
+	}
+	stagingDBI, err := txn.OpenDBI(SyncDBIStaging, lmdb.Create)
+	if err != nil {
+		return err
+	}
+
+	cur := stagedDBI{
+		name:      dbiName,
+		flags:     dbiMsg.Flags(),
+		transform: dbiMsg.Transform(),
+	}
+	if n := len(s.staged); n > 0 {
+		last := s.staged[n-1]
+		if last.name == cur.name && last.flags == cur.flags && last.transform == cur.transform {
+			cur = last
+			s.staged = s.staged[:n-1]
+		}
+	}
+	var skipped int
+	for {
+		kv, err := dbiMsg.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		same, err := unchanged(kv)
+		if err != nil {
+			return fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		if same {
+			skipped++
+			continue
+		}
+		s.stagedSeq++
+		if err := txn.Put(stagingDBI, stageKey(s.stagedSeq), stageValue(kv), lmdb.Append); err != nil {
+			return fmt.Errorf("dbi %s: stage entry: %w", dbiName, err)
+		}
+		cur.n++
+	}
+	// Runs without entries still create the DBIs when merged
+	s.staged = append(s.staged, cur)
+	// Unchanged entries count as merged, like in a load without staging
+	s.countMerged(dbiName, skipped)
+	l.WithField("dbi", dbiName).WithField("skipped", skipped).
+		Debug("Staged snapshot DBI")
+	return nil
+}
+
+// unchangedFunc returns a function that reports if a snapshot entry is
+// identical to the local entry in the DBI it would be merged into. Such an
+// entry carries no new information, so it does not need to be staged. It
+// would lose against a local change made before the staged entries are
+// merged, because that change has a newer timestamp.
+func (s *Syncer) unchangedFunc(txn *lmdb.Txn, dbiMsg *snapshot.DBI) (func(kv snapshot.KV) (bool, error), error) {
+	never := func(kv snapshot.KV) (bool, error) { return false, nil }
+	targetDBIName := dbiMsg.Name()
+	if !s.lc.SchemaTracksChanges {
+		var err error
+		targetDBIName, err = s.shadowDBIName(targetDBIName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	exists, err := lmdbenv.DBIExists(txn, targetDBIName)
+	if err != nil || !exists {
+		return never, err
+	}
+	targetDBI, err := txn.OpenDBI(targetDBIName, 0)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := txn.Flags(targetDBI)
+	if err != nil {
+		return nil, err
+	}
+	isDupSortNative := dbiMsg.Transform() == snapshot.TransformDupSortNativeV1
+	if (flags&lmdb.DupSort > 0) != isDupSortNative {
+		return never, nil // mergeDBI reports the mismatch
+	}
+
+	if isDupSortNative {
+		var lastKey []byte
+		var entries map[string]dupSortShadowEntry
+		return func(kv snapshot.KV) (bool, error) {
+			if entries == nil || !bytes.Equal(kv.Key, lastKey) {
+				var err error
+				entries, err = readDupSortShadow(txn, targetDBI, targetDBIName, kv.Key)
+				if err != nil {
+					return false, err
+				}
+				lastKey = append(lastKey[:0], kv.Key...)
+			}
+			e, exists := entries[string(kv.Value)]
+			return exists && sameHeader(e.h, kv), nil
+		}, nil
+	}
+	return func(kv snapshot.KV) (bool, error) {
+		val, err := txn.Get(targetDBI, kv.Key)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		h, appVal, err := header.Parse(val)
+		if err != nil {
+			return false, nil // mergeDBI reports invalid headers
+		}
+		return sameHeader(h, kv) && bytes.Equal(appVal, kv.Value), nil
+	}, nil
+}
+
+// sameHeader returns true if the header of a local entry has the timestamp
+// and deleted flag of a snapshot entry
+func sameHeader(h header.Header, kv snapshot.KV) bool {
+	return h.Timestamp == header.Timestamp(kv.TimestampNano) &&
+		h.Flags.IsDeleted() == header.Flags(kv.Flags).IsDeleted()
+}
+
+// applyStaged merges the staged entries into the LMDB and removes the
+// staging DBI
+func (s *Syncer) applyStaged(txn *lmdb.Txn, l logrus.FieldLogger, sr *snapshot.StreamReader, instance string) error {
+	stagingDBI, err := txn.OpenDBI(SyncDBIStaging, lmdb.Create)
+	if err != nil {
+		return err
+	}
+	c, err := txn.OpenCursor(stagingDBI)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var seq uint64
+	for _, sd := range s.staged {
+		dbiMsg := snapshot.NewDBI()
+		dbiMsg.SetName(sd.name)
+		dbiMsg.SetFlags(sd.flags)
+		dbiMsg.SetTransform(sd.transform)
+		for i := 0; i < sd.n; i++ {
+			seq++
+			key, val, err := c.Get(nil, nil, lmdb.Next)
+			if err != nil {
+				return fmt.Errorf("read staged entry %d: %w", seq, err)
+			}
+			if !bytes.Equal(key, stageKey(seq)) {
+				return fmt.Errorf("staged entry %d is missing", seq)
+			}
+			kv, err := parseStageValue(val)
+			if err != nil {
+				return fmt.Errorf("staged entry %d: %w", seq, err)
+			}
+			dbiMsg.Append(kv)
+		}
+		if err := s.mergeDBI(txn, l, sr, dbiMsg, instance); err != nil {
+			return err
+		}
+	}
+	s.staged = nil
+	s.stagedSeq = 0
+	return txn.Drop(stagingDBI, true)
+}
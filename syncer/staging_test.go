@@ -0,0 +1,141 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func TestStageValue(t *testing.T) {
+	kv := snapshot.KV{Key: b("key"), Value: b("val"), TimestampNano: 42, Flags: uint32(header.FlagDeleted)}
+	res, err := parseStageValue(stageValue(kv))
+	require.NoError(t, err)
+	assert.Equal(t, kv, res)
+
+	_, err = parseStageValue(stageValue(kv)[:16])
+	assert.Error(t, err)
+}
+
+func TestSyncer_LoadOnce_staging(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		t.Run(fmt.Sprintf("withHeader=%v", withHeader), func(t *testing.T) {
+			ctx := context.Background()
+			st := memory.New()
+			syncerA, envA := createInstance(t, "a", st, withHeader)
+			syncerB, envB := createInstance(t, "b", st, withHeader)
+			syncerB.c.LMDBLoadBatchSize = 0
+			syncerB.c.LMDBLoadBatchEntries = 7
+			syncerB.c.LMDBLoadStaging = true
+
+			// sendA writes a snapshot of a and returns it as an update
+			sendA := func() snapshot.Update {
+				_, err := syncerA.SendOnce(ctx, envA)
+				require.NoError(t, err)
+				list := listInstanceSnapshots(st, "a")
+				require.NotEmpty(t, list)
+				name := list[len(list)-1].Name
+				data, err := st.Load(ctx, name)
+				require.NoError(t, err)
+				ni, err := snapshot.ParseName(name)
+				require.NoError(t, err)
+				return snapshot.Update{Data: data, NameInfo: ni}
+			}
+			stagingExists := func(env *lmdb.Env) (exists bool) {
+				err := env.View(func(txn *lmdb.Txn) (err error) {
+					exists, err = lmdbenv.DBIExists(txn, SyncDBIStaging)
+					return err
+				})
+				require.NoError(t, err)
+				return exists
+			}
+
+			exp := make(map[string]string)
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key-%03d", i)
+				exp[key] = strings.Repeat("x", 100)
+				setKey(t, envA, key, exp[key], withHeader)
+			}
+
+			// Initial load, staging every entry
+			var nBatches int
+			syncerB.loadBatchDone = func() {
+				nBatches++
+			}
+			txnID, localChanged, err := syncerB.LoadOnce(ctx, envB, "a", sendA(), 0)
+			require.NoError(t, err)
+			assert.False(t, localChanged)
+			assert.Greater(t, nBatches, 100/7)
+			kv, err := dumpData(envB, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, exp, kv)
+			assert.False(t, stagingExists(envB))
+
+			// Only the changed entries are staged, and the application does
+			// not see any of them before the last transaction. Local changes
+			// between the transactions are kept.
+			for i := 1; i <= 3; i++ {
+				key := fmt.Sprintf("key-%03d", i)
+				exp[key] = "new"
+				setKey(t, envA, key, exp[key], withHeader)
+			}
+			before := kv
+			var staged, nCalls int
+			syncerB.loadBatchDone = func() {
+				nCalls++
+				if nCalls == 1 {
+					kv, err := dumpData(envB, withHeader)
+					require.NoError(t, err)
+					assert.Equal(t, before, kv)
+					setKey(t, envB, "key-050", "local", withHeader)
+					setKey(t, envB, "local", "local", withHeader)
+				}
+				staged = 0
+				for _, sd := range syncerB.staged {
+					staged += sd.n
+				}
+			}
+			_, localChanged, err = syncerB.LoadOnce(ctx, envB, "a", sendA(), txnID)
+			require.NoError(t, err)
+			assert.True(t, localChanged)
+			if withHeader {
+				// The local change of key-050 is already in the DBI the
+				// snapshot is merged into, and not only in the main DBI
+				assert.Equal(t, 4, staged)
+			} else {
+				assert.Equal(t, 3, staged)
+			}
+			exp["key-050"] = "local"
+			exp["local"] = "local"
+			kv, err = dumpData(envB, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, exp, kv)
+			assert.False(t, stagingExists(envB))
+
+			// A snapshot that fits in a single batch is merged in the same
+			// transaction
+			syncerC, envC := createInstance(t, "c", st, withHeader)
+			syncerC.c.LMDBLoadStaging = true
+			syncerC.loadBatchDone = func() {
+				t.Error("unexpected batch")
+			}
+			txnID, _, err = syncerC.LoadOnce(ctx, envC, "a", sendA(), 0)
+			require.NoError(t, err)
+			assert.Equal(t, header.TxnID(1), txnID)
+			delete(exp, "local")
+			exp["key-050"] = strings.Repeat("x", 100)
+			kv, err = dumpData(envC, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, exp, kv)
+			assert.False(t, stagingExists(envC))
+		})
+	}
+}
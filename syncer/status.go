@@ -0,0 +1,289 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// SafeInstanceID returns the instance name as used in snapshot names. If the
+// instance is empty, the hostname is used.
+func SafeInstanceID(instance string) string {
+	if instance == "" {
+		instance = hostname
+	}
+	return reUnsafe.ReplaceAllString(instance, "-")
+}
+
+// PendingShadowChanges counts the entries per DBI in which the main DBI
+// differs from its shadow DBI. These are local changes that have not been
+// synced to the shadow DBI yet, and thus have not been included in a snapshot.
+// This is only meaningful with schema_tracks_changes disabled. For DBIs
+// without a shadow DBI, all entries are counted.
+func PendingShadowChanges(txn *lmdb.Txn, lc config.LMDB) (map[string]int, error) {
+	hooks, err := loadHooks(lc)
+	if err != nil {
+		return nil, err
+	}
+	s := &Syncer{
+		lc:    lc,
+		l:     logrus.StandardLogger(),
+		hooks: hooks,
+	}
+	dbiNames, err := lmdbenv.ReadDBINames(txn)
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]int)
+	for _, dbiName := range dbiNames {
+		if strings.HasPrefix(dbiName, SyncDBIPrefix) || !lc.IsDBIIncluded(dbiName) {
+			continue
+		}
+		n, err := s.pendingShadowChanges(txn, dbiName)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+		pending[dbiName] = n
+	}
+	return pending, nil
+}
+
+// errAbortTxn is used to abort a write transaction without logging an error
+var errAbortTxn = errors.New("transaction aborted")
+
+// ReadSnapshotDBIs returns the DBIs of an LMDB as they would be included in a
+// full snapshot created now. With schema_tracks_changes disabled, the main
+// DBIs are first synced to their shadow DBIs in a write transaction that is
+// aborted afterwards, so the LMDB is never modified.
+func ReadSnapshotDBIs(env *lmdb.Env, lc config.LMDB) ([]*snapshot.DBI, error) {
+	s := &Syncer{
+		lc: lc,
+		l:  logrus.StandardLogger(),
+	}
+	var dbis []*snapshot.DBI
+	read := func(txn *lmdb.Txn) error {
+		if !lc.SchemaTracksChanges {
+			tsNano := header.TimestampFromTime(time.Now())
+			if err := s.mainToShadow(context.Background(), txn, tsNano); err != nil {
+				return err
+			}
+		}
+		dbiNames, err := lmdbenv.ReadDBINames(txn)
+		if err != nil {
+			return err
+		}
+		for _, dbiName := range dbiNames {
+			if strings.HasPrefix(dbiName, SyncDBIPrefix) || !lc.IsDBIIncluded(dbiName) {
+				continue
+			}
+			readDBIName := dbiName
+			if !lc.SchemaTracksChanges {
+				readDBIName, err = s.shadowDBIName(dbiName)
+				if err != nil {
+					return err
+				}
+			}
+			dbiMsg, err := s.readDBI(txn, readDBIName, dbiName, false, nil, nil, nil)
+			if err == nil {
+				dbiMsg, err = s.encodeDBI(dbiMsg)
+			}
+			if err != nil {
+				return fmt.Errorf("dbi %s: %w", dbiName, err)
+			}
+			dbis = append(dbis, dbiMsg)
+		}
+		return nil
+	}
+
+	if lc.SchemaTracksChanges {
+		err := env.View(read)
+		return dbis, err
+	}
+	err := env.Update(func(txn *lmdb.Txn) error {
+		if err := read(txn); err != nil {
+			return err
+		}
+		return errAbortTxn
+	})
+	if err != errAbortTxn {
+		return nil, err
+	}
+	return dbis, nil
+}
+
+// pendingShadowChanges compares a main DBI with its shadow DBI the same way
+// as mainToShadow, but only counts the differences.
+func (s *Syncer) pendingShadowChanges(txn *lmdb.Txn, dbiName string) (int, error) {
+	shadowDBIName, err := s.shadowDBIName(dbiName)
+	if err != nil {
+		return 0, err
+	}
+	mainMsg, err := s.readDBI(txn, dbiName, dbiName, true, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	exists, err := lmdbenv.DBIExists(txn, shadowDBIName)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		kvs, err := mainMsg.AsInefficientKVList()
+		return len(kvs), err
+	}
+
+	mainDBI, err := txn.OpenDBI(dbiName, 0)
+	if err != nil {
+		return 0, err
+	}
+	mainFlags, err := txn.Flags(mainDBI)
+	if err != nil {
+		return 0, err
+	}
+	shadowDBI, err := txn.OpenDBI(shadowDBIName, 0)
+	if err != nil {
+		return 0, err
+	}
+	isDupSort := mainFlags&lmdb.DupSort > 0
+
+	var n int
+	if isDupSort && s.lc.DupSortNative {
+		err := dupSortGroups(mainMsg, func(key []byte, kvs []snapshot.KV) error {
+			entries, err := readDupSortShadow(txn, shadowDBI, shadowDBIName, key)
+			if err != nil {
+				return err
+			}
+			for _, kv := range kvs {
+				e, ok := entries[string(kv.Value)]
+				if !ok || e.h.Flags.IsDeleted() {
+					n++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		// Values that were removed from the main DBI
+		err = forEachShadowEntry(txn, shadowDBI, parseDupSortShadowValue, func(key, val []byte) error {
+			return countIfMissing(txn, mainDBI, key, val, &n)
+		})
+		return n, err
+	}
+
+	if isDupSort {
+		mainMsg, err = dupSortHackEncode(mainMsg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	mainMsg.ResetCursor()
+	for {
+		kv, err := mainMsg.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		v, err := txn.Get(shadowDBI, kv.Key)
+		if lmdb.IsNotFound(err) {
+			n++
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		h, appVal, err := header.Parse(v)
+		if err != nil {
+			return 0, err
+		}
+		if h.Flags.IsDeleted() || !bytes.Equal(appVal, kv.Value) {
+			n++
+		}
+	}
+
+	// Keys that were removed from the main DBI
+	parse := func(v []byte) ([]byte, header.Header, error) {
+		h, appVal, err := header.Parse(v)
+		return appVal, h, err
+	}
+	err = forEachShadowEntry(txn, shadowDBI, parse, func(key, val []byte) error {
+		if !isDupSort {
+			return countIfMissing(txn, mainDBI, key, nil, &n)
+		}
+		kv, err := dupSortHackDecodeOne(snapshot.KV{Key: key, Value: val})
+		if err != nil {
+			return err
+		}
+		return countIfMissing(txn, mainDBI, kv.Key, kv.Value, &n)
+	})
+	return n, err
+}
+
+// forEachShadowEntry calls f for every entry in a shadow DBI that is not
+// marked as deleted.
+func forEachShadowEntry(
+	txn *lmdb.Txn, dbi lmdb.DBI,
+	parse func(v []byte) ([]byte, header.Header, error),
+	f func(key, val []byte) error,
+) error {
+	c, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var flag uint = lmdb.First
+	for {
+		key, v, err := c.Get(nil, nil, flag)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		flag = lmdb.Next
+		val, h, err := parse(v)
+		if err != nil {
+			return err
+		}
+		if h.Flags.IsDeleted() {
+			continue
+		}
+		if err := f(key, val); err != nil {
+			return err
+		}
+	}
+}
+
+// countIfMissing increments n if the key is not present in the DBI. If val is
+// not nil, the key must have that value, for DupSort DBIs.
+func countIfMissing(txn *lmdb.Txn, dbi lmdb.DBI, key, val []byte, n *int) error {
+	var err error
+	if val == nil {
+		_, err = txn.Get(dbi, key)
+	} else {
+		var c *lmdb.Cursor
+		c, err = txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		_, _, err = c.Get(key, val, lmdb.GetBoth)
+		c.Close()
+	}
+	if lmdb.IsNotFound(err) {
+		*n++
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+)
+
+func TestPendingShadowChanges(t *testing.T) {
+	// Both DupSort modes, because the DupSort DBI requires one of them
+	for _, lc := range []config.LMDB{{DupSortHack: true}, {DupSortNative: true}} {
+		lc := lc
+		err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+			s, err := New("test", env, nil, config.Config{}, lc, Options{})
+			require.NoError(t, err)
+
+			return env.Update(func(txn *lmdb.Txn) error {
+				plain, err := txn.OpenDBI("plain", lmdb.Create)
+				require.NoError(t, err)
+				dup, err := txn.OpenDBI("dup", lmdb.Create|lmdb.DupSort)
+				require.NoError(t, err)
+				for _, k := range []string{"a", "b", "c"} {
+					require.NoError(t, txn.Put(plain, b(k), b("v"), 0))
+					require.NoError(t, txn.Put(dup, b("k"), b(k), 0))
+				}
+
+				// Before the first sync all entries are pending
+				pending, err := PendingShadowChanges(txn, lc)
+				require.NoError(t, err)
+				assert.Equal(t, map[string]int{"plain": 3, "dup": 3}, pending)
+
+				require.NoError(t, s.mainToShadow(context.Background(), txn, testTS(1)))
+				pending, err = PendingShadowChanges(txn, lc)
+				require.NoError(t, err)
+				assert.Equal(t, map[string]int{"plain": 0, "dup": 0}, pending)
+
+				// One change, one addition and one deletion each
+				require.NoError(t, txn.Put(plain, b("a"), b("changed"), 0))
+				require.NoError(t, txn.Put(plain, b("d"), b("v"), 0))
+				require.NoError(t, txn.Del(plain, b("b"), nil))
+				require.NoError(t, txn.Put(dup, b("k"), b("d"), 0))
+				require.NoError(t, txn.Del(dup, b("k"), b("b")))
+				pending, err = PendingShadowChanges(txn, lc)
+				require.NoError(t, err)
+				assert.Equal(t, map[string]int{"plain": 3, "dup": 2}, pending)
+
+				require.NoError(t, s.mainToShadow(context.Background(), txn, testTS(2)))
+				pending, err = PendingShadowChanges(txn, lc)
+				require.NoError(t, err)
+				assert.Equal(t, map[string]int{"plain": 0, "dup": 0}, pending)
+				return nil
+			})
+		})
+		assert.NoError(t, err)
+	}
+}
+
+func TestReadSnapshotDBIs(t *testing.T) {
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		err := env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.OpenDBI("foo", lmdb.Create)
+			require.NoError(t, err)
+			return txn.Put(dbi, b("a"), b("1"), 0)
+		})
+		require.NoError(t, err)
+
+		dbis, err := ReadSnapshotDBIs(env, config.LMDB{})
+		require.NoError(t, err)
+		require.Len(t, dbis, 1)
+		assert.Equal(t, "foo", dbis[0].Name())
+		kvs, err := dbis[0].AsInefficientKVList()
+		require.NoError(t, err)
+		require.Len(t, kvs, 1)
+		assert.Equal(t, "a=1", string(kvs[0].Key)+"="+string(kvs[0].Value))
+		assert.NotZero(t, kvs[0].TimestampNano)
+
+		// The shadow DBI was only created in an aborted transaction
+		return env.View(func(txn *lmdb.Txn) error {
+			exists, err := lmdbenv.DBIExists(txn, SyncDBIShadowPrefix+"foo")
+			require.NoError(t, err)
+			assert.False(t, exists)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,53 @@
+package storageevents
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// longPoller polls an HTTP endpoint that only responds once there are changes
+type longPoller struct {
+	c      LongPollConfig
+	client *http.Client
+}
+
+func newLongPoller(c LongPollConfig) *longPoller {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultLongPollTimeout
+	}
+	return &longPoller{
+		c:      c,
+		client: &http.Client{Timeout: c.Timeout},
+	}
+}
+
+// poll does a single long poll request
+func (lp *longPoller) poll(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lp.c.URL, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range lp.c.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := lp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK && len(body) > 0 {
+		handleBody("long_poll", body)
+	}
+	return nil
+}
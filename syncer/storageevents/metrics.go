@@ -0,0 +1,33 @@
+package storageevents
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	metricReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_storage_events_received_total",
+			Help: "Number of storage change notifications received, by source",
+		},
+		[]string{"source"},
+	)
+	metricErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_storage_events_errors_total",
+			Help: "Number of failed attempts to receive storage change notifications, by source",
+		},
+		[]string{"source"},
+	)
+	metricTriggered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lightningstream_storage_events_triggered_total",
+			Help: "Number of storage listings triggered by notifications",
+		},
+		[]string{"lmdb"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricReceived)
+	prometheus.MustRegister(metricErrors)
+	prometheus.MustRegister(metricTriggered)
+}
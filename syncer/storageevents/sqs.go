@@ -0,0 +1,237 @@
+package storageevents
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// sqsAPIVersion is the version of the SQS query API
+const sqsAPIVersion = "2012-11-05"
+
+// sqsQueue receives messages from an SQS queue using the query API
+type sqsQueue struct {
+	c      SQSConfig
+	region string
+	creds  *credentials.Credentials
+	client *http.Client
+}
+
+func newSQSQueue(c SQSConfig) (*sqsQueue, error) {
+	if c.WaitTime == 0 {
+		c.WaitTime = DefaultSQSWaitTime
+	}
+	u, err := url.Parse(c.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	region := c.Region
+	if region == "" {
+		region = regionFromHost(u.Hostname())
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("region: cannot be determined from the queue URL, please configure it")
+	}
+	return &sqsQueue{
+		c:      c,
+		region: region,
+		creds:  credentials.NewChainCredentials(c.providers()),
+		client: &http.Client{Timeout: c.WaitTime + 30*time.Second},
+	}, nil
+}
+
+// regionFromHost returns the region from an SQS endpoint host like
+// 'sqs.eu-west-1.amazonaws.com', or an empty string.
+func regionFromHost(host string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) >= 4 && parts[0] == "sqs" && parts[2] == "amazonaws" {
+		return parts[1]
+	}
+	return ""
+}
+
+// providers returns the credential chain in order of precedence
+func (c SQSConfig) providers() []credentials.Provider {
+	var providers []credentials.Provider
+	if c.AccessKey != "" {
+		providers = append(providers, &credentials.Static{
+			Value: credentials.Value{
+				AccessKeyID:     c.AccessKey,
+				SecretAccessKey: c.SecretKey,
+				SessionToken:    c.SessionToken,
+				SignerType:      credentials.SignatureV4,
+			},
+		})
+	}
+	providers = append(providers,
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{Profile: c.Profile},
+	)
+	if !c.DisableIAM {
+		providers = append(providers, &credentials.IAM{})
+	}
+	return providers
+}
+
+type sqsMessage struct {
+	ReceiptHandle string `xml:"ReceiptHandle"`
+	Body          string `xml:"Body"`
+}
+
+type sqsReceiveResponse struct {
+	Messages []sqsMessage `xml:"ReceiveMessageResult>Message"`
+}
+
+type sqsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// receive receives and handles a batch of messages, and deletes them from
+// the queue.
+func (q *sqsQueue) receive(ctx context.Context) error {
+	var resp sqsReceiveResponse
+	err := q.call(ctx, url.Values{
+		"Action":              {"ReceiveMessage"},
+		"MaxNumberOfMessages": {"10"},
+		"WaitTimeSeconds":     {strconv.Itoa(int(q.c.WaitTime / time.Second))},
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("receive: %w", err)
+	}
+	if len(resp.Messages) == 0 {
+		return nil
+	}
+	del := url.Values{"Action": {"DeleteMessageBatch"}}
+	for i, msg := range resp.Messages {
+		handleBody("sqs", []byte(msg.Body))
+		prefix := fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.", i+1)
+		del.Set(prefix+"Id", strconv.Itoa(i+1))
+		del.Set(prefix+"ReceiptHandle", msg.ReceiptHandle)
+	}
+	// Messages that are not deleted are received again after the visibility
+	// timeout, which only triggers a superfluous listing.
+	if err := q.call(ctx, del, nil); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
+}
+
+// call does a signed query API call and decodes the XML response into res
+func (q *sqsQueue) call(ctx context.Context, params url.Values, res interface{}) error {
+	params.Set("Version", sqsAPIVersion)
+	body := params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, q.c.QueueURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	v, err := q.creds.Get()
+	if err != nil {
+		return fmt.Errorf("credentials: %w", err)
+	}
+	signV4(req, []byte(body), v, q.region, "sqs", time.Now())
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e sqsErrorResponse
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return fmt.Errorf("%s: %s", e.Code, e.Message)
+		}
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if res == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, res)
+}
+
+// signV4 signs a request with AWS Signature Version 4. Only the host, the
+// content type and the x-amz-* headers are signed.
+func signV4(req *http.Request, body []byte, v credentials.Value, region, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if v.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", v.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+v.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+v.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,359 @@
+// Package storageevents implements storage change notifications, which make
+// the receivers list the storage backend as soon as a new snapshot was
+// stored, instead of waiting for the next periodic listing.
+//
+// Notifications can be received from an AWS SQS queue that receives the S3
+// event notifications of the bucket, by long polling an HTTP endpoint, or
+// as a webhook on the HTTP server. While an SQS queue or long poll endpoint
+// is connected, the periodic listing falls back to a longer poll interval.
+package storageevents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+const (
+	// DefaultPollInterval is the default poll interval while a notification
+	// source is connected.
+	DefaultPollInterval = time.Minute
+
+	// DefaultSQSWaitTime is the default and maximum long poll time of an
+	// SQS ReceiveMessage call.
+	DefaultSQSWaitTime = 20 * time.Second
+
+	// DefaultLongPollTimeout is the default timeout of a long poll request
+	DefaultLongPollTimeout = time.Minute
+
+	// RetryInterval is the time between retries after a source failed
+	RetryInterval = 5 * time.Second
+
+	// WebhookPath is the path of the webhook on the HTTP server
+	WebhookPath = "/storage-events"
+)
+
+// Config configures the storage change notifications
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+
+	// PollInterval replaces the storage_poll_interval while an SQS queue or
+	// long poll endpoint is connected (default: 1m). It is never shorter
+	// than the storage_poll_interval.
+	PollInterval time.Duration `yaml:"poll_interval"`
+
+	// Webhook accepts notifications as a POST on /storage-events of the HTTP
+	// server. This does not change the poll interval, because it cannot tell
+	// if the notifications still arrive.
+	Webhook bool `yaml:"webhook"`
+
+	SQS      SQSConfig      `yaml:"sqs"`
+	LongPoll LongPollConfig `yaml:"long_poll"`
+}
+
+// SQSConfig configures an AWS SQS queue that receives the S3 event
+// notifications of the bucket, directly or through SNS. Every instance needs
+// its own queue, because received messages are deleted.
+type SQSConfig struct {
+	QueueURL string `yaml:"queue_url"`
+
+	// Region is the AWS region of the queue. By default, it is taken from
+	// the queue URL, or the AWS_REGION environment variable.
+	Region string `yaml:"region"`
+
+	// AccessKey, SecretKey and SessionToken are optional static credentials.
+	// Otherwise, the AWS_* environment variables, the shared credentials
+	// file and IAM roles are used, like the 'aws' storage backend does.
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    string `yaml:"secret_key"`
+	SessionToken string `yaml:"session_token"`
+	Profile      string `yaml:"profile"`
+	DisableIAM   bool   `yaml:"disable_iam"`
+
+	// WaitTime is the long poll time of a receive call (default and
+	// maximum: 20s)
+	WaitTime time.Duration `yaml:"wait_time"`
+}
+
+// LongPollConfig configures an HTTP endpoint that is polled with GET requests
+// that only return once there are changes. A 200 response with a body in one
+// of the supported formats signals changes, any other 2xx response none.
+type LongPollConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Timeout of a single request (default: 1m)
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Check validates the configuration
+func (c Config) Check() error {
+	if !c.Enabled {
+		return nil
+	}
+	if !c.Webhook && c.SQS.QueueURL == "" && c.LongPoll.URL == "" {
+		return fmt.Errorf("one of webhook, sqs.queue_url or long_poll.url is required when enabled")
+	}
+	if c.PollInterval < 0 {
+		return fmt.Errorf("poll_interval: must not be negative")
+	}
+	if c.SQS.QueueURL != "" {
+		if err := checkURL(c.SQS.QueueURL); err != nil {
+			return fmt.Errorf("sqs.queue_url: %w", err)
+		}
+		if (c.SQS.AccessKey == "") != (c.SQS.SecretKey == "") {
+			return fmt.Errorf("sqs: access_key and secret_key must be set together")
+		}
+		if c.SQS.WaitTime < 0 || c.SQS.WaitTime > DefaultSQSWaitTime {
+			return fmt.Errorf("sqs.wait_time: must be between 0 and 20s")
+		}
+	}
+	if c.LongPoll.URL != "" {
+		if err := checkURL(c.LongPoll.URL); err != nil {
+			return fmt.Errorf("long_poll.url: %w", err)
+		}
+		if c.LongPoll.Timeout < 0 {
+			return fmt.Errorf("long_poll.timeout: must not be negative")
+		}
+	}
+	return nil
+}
+
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+// registration is a receiver that wants to be triggered
+type registration struct {
+	lmdbName string
+	trigger  func()
+}
+
+var (
+	mu            sync.Mutex
+	registrations = make(map[*registration]struct{})
+	sources       []*atomic.Bool // connected state of the sources
+	pollInterval  time.Duration
+)
+
+// Register registers the trigger function of the receiver of an LMDB, which
+// is called when a snapshot of the LMDB may have been stored. The returned
+// function removes the registration.
+func Register(lmdbName string, trigger func()) (unregister func()) {
+	reg := &registration{lmdbName: lmdbName, trigger: trigger}
+	mu.Lock()
+	registrations[reg] = struct{}{}
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		delete(registrations, reg)
+		mu.Unlock()
+	}
+}
+
+// Notify triggers the receivers of the LMDBs of the snapshots with the
+// given storage keys. Keys that are not snapshots are ignored.
+func Notify(keys ...string) {
+	lmdbNames := make(map[string]bool)
+	for _, key := range keys {
+		base := key[strings.LastIndexByte(key, '/')+1:]
+		ni, err := snapshot.ParseName(base)
+		if err != nil {
+			continue
+		}
+		lmdbNames[ni.SyncerName] = true
+	}
+	trigger(func(lmdbName string) bool {
+		return lmdbNames[lmdbName]
+	})
+}
+
+// NotifyAll triggers all receivers
+func NotifyAll() {
+	trigger(func(string) bool { return true })
+}
+
+func trigger(match func(lmdbName string) bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for reg := range registrations {
+		if match(reg.lmdbName) {
+			metricTriggered.WithLabelValues(reg.lmdbName).Inc()
+			reg.trigger()
+		}
+	}
+}
+
+// PollInterval returns the configured poll interval and true if an SQS
+// queue or long poll endpoint is currently connected.
+func PollInterval() (time.Duration, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, connected := range sources {
+		if connected.Load() {
+			return pollInterval, true
+		}
+	}
+	return 0, false
+}
+
+// addSource registers a source for PollInterval
+func addSource() *atomic.Bool {
+	mu.Lock()
+	defer mu.Unlock()
+	connected := atomic.NewBool(false)
+	sources = append(sources, connected)
+	return connected
+}
+
+// Start starts receiving notifications from the configured sources until the
+// context is cancelled. The webhook is served by the HTTP server.
+func Start(ctx context.Context, c Config) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = DefaultPollInterval
+	}
+	mu.Lock()
+	pollInterval = c.PollInterval
+	mu.Unlock()
+
+	if c.SQS.QueueURL != "" {
+		q, err := newSQSQueue(c.SQS)
+		if err != nil {
+			return fmt.Errorf("storage events: sqs: %w", err)
+		}
+		go run(ctx, "sqs", q.receive)
+	}
+	if c.LongPoll.URL != "" {
+		lp := newLongPoller(c.LongPoll)
+		go run(ctx, "long_poll", lp.poll)
+	}
+	return nil
+}
+
+// run keeps calling a source until the context is cancelled
+func run(ctx context.Context, source string, f func(ctx context.Context) error) {
+	l := logrus.WithField("component", "storage_events").WithField("source", source)
+	l.Info("Storage event source enabled")
+	connected := addSource()
+	for ctx.Err() == nil {
+		err := f(ctx)
+		if err == nil {
+			if !connected.Swap(true) {
+				l.Info("Storage event source connected")
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		metricErrors.WithLabelValues(source).Inc()
+		if connected.Swap(false) {
+			l.WithError(err).Warn("Storage event source failed, falling back to polling")
+		} else {
+			l.WithError(err).Debug("Storage event source failed")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(RetryInterval):
+		}
+	}
+	connected.Store(false)
+}
+
+// handleBody triggers the receivers for a notification body
+func handleBody(source string, body []byte) {
+	metricReceived.WithLabelValues(source).Inc()
+	keys, err := ParseKeys(body)
+	if err != nil {
+		// Unknown format, but something has changed
+		NotifyAll()
+		return
+	}
+	Notify(keys...)
+}
+
+// ParseKeys returns the object keys from a notification body, which can be
+// an S3 event notification, an SNS message containing one, or a JSON object
+// with a "keys" list.
+func ParseKeys(body []byte) ([]string, error) {
+	var msg struct {
+		// S3 event notification
+		Records []struct {
+			S3 struct {
+				Object struct {
+					Key string `json:"key"`
+				} `json:"object"`
+			} `json:"s3"`
+		} `json:"Records"`
+		// S3 test event, sent when notifications are configured
+		Event string `json:"Event"`
+		// SNS notification
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+		// Generic
+		Keys []string `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	switch {
+	case msg.Type == "Notification" && msg.Message != "":
+		return ParseKeys([]byte(msg.Message))
+	case len(msg.Records) > 0:
+		var keys []string
+		for _, rec := range msg.Records {
+			// Keys in S3 event notifications are URL encoded
+			key, err := url.QueryUnescape(rec.S3.Object.Key)
+			if err != nil {
+				key = rec.S3.Object.Key
+			}
+			keys = append(keys, key)
+		}
+		return keys, nil
+	case msg.Event == "s3:TestEvent":
+		return nil, nil
+	case msg.Keys != nil:
+		return msg.Keys, nil
+	}
+	return nil, fmt.Errorf("unknown notification format")
+}
+
+// Handler is the webhook handler for notifications
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handleBody("webhook", body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
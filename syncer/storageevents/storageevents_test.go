@@ -0,0 +1,211 @@
+package storageevents
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	snapMain  = "main__a__20230102-150405-000000001__G-0000000000000001.pb.gz"
+	snapOther = "other__a__20230102-150405-000000001__G-0000000000000001.pb.gz"
+)
+
+// counter counts triggers
+type counter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *counter) trigger() {
+	c.mu.Lock()
+	c.n++
+	c.mu.Unlock()
+}
+
+func (c *counter) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestParseKeys(t *testing.T) {
+	s3Event := `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"prefix/main__a__x+y.pb.gz"}}}]}`
+	keys, err := ParseKeys([]byte(s3Event))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"prefix/main__a__x y.pb.gz"}, keys)
+
+	sns := fmt.Sprintf(`{"Type":"Notification","Message":%q}`, s3Event)
+	keys, err = ParseKeys([]byte(sns))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"prefix/main__a__x y.pb.gz"}, keys)
+
+	keys, err = ParseKeys([]byte(`{"keys":["a","b"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	keys, err = ParseKeys([]byte(`{"Service":"Amazon S3","Event":"s3:TestEvent"}`))
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = ParseKeys([]byte(`{"foo":1}`))
+	assert.Error(t, err)
+	_, err = ParseKeys([]byte(`garbage`))
+	assert.Error(t, err)
+}
+
+func TestNotify(t *testing.T) {
+	var main, other counter
+	defer Register("main", main.trigger)()
+	unregister := Register("other", other.trigger)
+
+	Notify("backups/"+snapMain, "main.lease", "main.heartbeat__a.json")
+	assert.Equal(t, 1, main.get())
+	assert.Equal(t, 0, other.get())
+
+	NotifyAll()
+	assert.Equal(t, 2, main.get())
+	assert.Equal(t, 1, other.get())
+
+	unregister()
+	Notify(snapOther)
+	assert.Equal(t, 1, other.get())
+}
+
+func TestHandler(t *testing.T) {
+	var main counter
+	defer Register("main", main.trigger)()
+
+	h := Handler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, WebhookPath,
+		strings.NewReader(`{"keys":["`+snapMain+`"]}`)))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 1, main.get())
+
+	// Unknown formats trigger all receivers
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, WebhookPath, strings.NewReader("changed")))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 2, main.get())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, WebhookPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestConfig_Check(t *testing.T) {
+	assert.NoError(t, Config{}.Check())
+	assert.Error(t, Config{Enabled: true}.Check())
+	assert.NoError(t, Config{Enabled: true, Webhook: true}.Check())
+	assert.NoError(t, Config{Enabled: true, SQS: SQSConfig{
+		QueueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/ls",
+	}}.Check())
+	assert.Error(t, Config{Enabled: true, SQS: SQSConfig{
+		QueueURL: "sqs.eu-west-1.amazonaws.com/123456789012/ls",
+	}}.Check())
+	assert.Error(t, Config{Enabled: true, SQS: SQSConfig{
+		QueueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/ls",
+		WaitTime: time.Minute,
+	}}.Check())
+	assert.Error(t, Config{Enabled: true, LongPoll: LongPollConfig{URL: "ftp://x"}}.Check())
+}
+
+func Test_signV4(t *testing.T) {
+	// The get-vanilla example of the AWS Signature Version 4 test suite
+	req := httptest.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	v := credentials.Value{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	signV4(req, nil, v, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func Test_regionFromHost(t *testing.T) {
+	assert.Equal(t, "eu-west-1", regionFromHost("sqs.eu-west-1.amazonaws.com"))
+	assert.Equal(t, "cn-north-1", regionFromHost("sqs.cn-north-1.amazonaws.com.cn"))
+	assert.Equal(t, "", regionFromHost("localhost"))
+}
+
+func TestSQS(t *testing.T) {
+	var main counter
+	defer Register("main", main.trigger)()
+
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/sqs/aws4_request")
+		require.NoError(t, r.ParseForm())
+		switch r.Form.Get("Action") {
+		case "ReceiveMessage":
+			assert.Equal(t, "1", r.Form.Get("WaitTimeSeconds"))
+			body := `{"Records":[{"s3":{"object":{"key":"` + snapMain + `"}}}]}`
+			_, _ = fmt.Fprintf(w, `<ReceiveMessageResponse><ReceiveMessageResult>`+
+				`<Message><ReceiptHandle>rh1</ReceiptHandle><Body>%s</Body></Message>`+
+				`</ReceiveMessageResult></ReceiveMessageResponse>`, body)
+		case "DeleteMessageBatch":
+			deleted = append(deleted, r.Form.Get("DeleteMessageBatchRequestEntry.1.ReceiptHandle"))
+			_, _ = fmt.Fprint(w, `<DeleteMessageBatchResponse/>`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidAction</Code>`+
+				`<Message>unknown</Message></Error></ErrorResponse>`)
+		}
+	}))
+	defer srv.Close()
+
+	q, err := newSQSQueue(SQSConfig{
+		QueueURL:   srv.URL + "/123456789012/ls",
+		Region:     "eu-west-1",
+		AccessKey:  "key",
+		SecretKey:  "secret",
+		DisableIAM: true,
+		WaitTime:   time.Second,
+	})
+	require.NoError(t, err)
+	require.NoError(t, q.receive(context.Background()))
+	assert.Equal(t, 1, main.get())
+	assert.Equal(t, []string{"rh1"}, deleted)
+
+	err = q.call(context.Background(), url.Values{"Action": {"Foo"}}, nil)
+	assert.EqualError(t, err, "InvalidAction: unknown")
+}
+
+func TestLongPoll(t *testing.T) {
+	var main counter
+	defer Register("main", main.trigger)()
+
+	changed := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+		if !changed {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"keys":["`+snapMain+`"]}`)
+	}))
+	defer srv.Close()
+
+	lp := newLongPoller(LongPollConfig{
+		URL:     srv.URL,
+		Headers: map[string]string{"X-Token": "secret"},
+	})
+	require.NoError(t, lp.poll(context.Background()))
+	assert.Equal(t, 1, main.get())
+	changed = false
+	require.NoError(t, lp.poll(context.Background()))
+	assert.Equal(t, 1, main.get())
+}
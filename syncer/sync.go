@@ -2,18 +2,28 @@ package syncer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PowerDNS/lmdb-go/lmdb"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/lmdbenv"
 	"powerdns.com/platform/lightningstream/lmdbenv/dbiflags"
 	"powerdns.com/platform/lightningstream/lmdbenv/header"
 	"powerdns.com/platform/lightningstream/lmdbenv/strategy"
+	"powerdns.com/platform/lightningstream/sidecar"
 	"powerdns.com/platform/lightningstream/snapshot"
 	"powerdns.com/platform/lightningstream/status"
+	"powerdns.com/platform/lightningstream/status/webhook"
+	"powerdns.com/platform/lightningstream/syncer/conflict"
+	"powerdns.com/platform/lightningstream/syncer/pdns"
 	"powerdns.com/platform/lightningstream/syncer/receiver"
 	"powerdns.com/platform/lightningstream/utils"
 )
@@ -25,14 +35,46 @@ const (
 	MaxConsecutiveSnapshotLoads = 10
 )
 
-// Sync opens the env and starts the two-way sync loop.
+// Sync opens the env and starts the two-way sync loop. After an auto
+// compaction, the env is reopened and the sync loop restarted.
 func (s *Syncer) Sync(ctx context.Context) error {
-	env := s.env
+	status.AddController(s.name, s)
+	defer status.RemoveController(s.name)
+	if s.instanceLease != nil {
+		leaseCtx, stop, err := s.holdInstanceLease(ctx)
+		if err != nil {
+			return err
+		}
+		err = s.syncEnvs(leaseCtx)
+		if lostErr := stop(); lostErr != nil {
+			return lostErr
+		}
+		return err
+	}
+	return s.syncEnvs(ctx)
+}
+
+// syncEnvs runs syncEnv, and runs it again with the reopened env after an
+// auto compaction
+func (s *Syncer) syncEnvs(ctx context.Context) error {
+	for {
+		err := s.syncEnv(ctx, s.Env())
+		if err != errEnvCompacted {
+			return err
+		}
+		if err := s.reopenEnv(); err != nil {
+			return err
+		}
+	}
+}
+
+// syncEnv starts the two-way sync loop for the env
+func (s *Syncer) syncEnv(ctx context.Context, env *lmdb.Env) error {
 	status.AddLMDBEnv(s.name, env)
 	defer status.RemoveLMDBEnv(s.name)
 
-	s.startStatsLogger(ctx, env)
 	s.registerCollector(env)
+	defer lmdbCollector.RemoveTarget(s.name)
 
 	r := receiver.New(
 		s.st,
@@ -41,6 +83,90 @@ func (s *Syncer) Sync(ctx context.Context) error {
 		s.l,
 		s.instanceID(),
 	)
+	if dict := s.compression.Dictionary; len(dict) > 0 {
+		r.SetDictionaries(dict)
+	}
+	r.SetVerifier(s.verifier)
+	r.SetUntil(s.opt.Until)
+	err := env.View(func(txn *lmdb.Txn) error {
+		var err error
+		s.purgedBefore, err = readPurgedBefore(txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if s.c.LMDBPersistSyncState && s.opt.Until.IsZero() {
+		applied, err := s.readSyncState(env)
+		if err != nil {
+			return err
+		}
+		r.SetApplied(applied)
+		for instance, ni := range applied {
+			if ni.Timestamp.After(s.lastByInstance[instance]) {
+				s.lastByInstance[instance] = ni.Timestamp
+			}
+			if ni.Timestamp.After(s.newestApplied.Load()) {
+				s.newestApplied.Store(ni.Timestamp)
+			}
+		}
+		if len(applied) > 0 {
+			s.l.WithField("instances", len(applied)).
+				Info("Loaded sync state, skipping snapshots that were already applied")
+		}
+	}
+	s.mu.Lock()
+	r.SetPollInterval(s.storagePollInterval) // in case of an earlier Reload
+	s.receiver = r
+	s.mu.Unlock()
+
+	// Background jobs, which must have finished before the env can be closed
+	var jobs sync.WaitGroup
+	jobsCtx, cancelJobs := context.WithCancel(ctx)
+	defer func() {
+		cancelJobs()
+		jobs.Wait()
+	}()
+	startJob := func(name string, f func(ctx context.Context) error) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			err := f(jobsCtx)
+			s.l.WithError(err).WithField("job", name).Info("Background job stopped")
+		}()
+	}
+	if s.c.LMDBLogStatsInterval > 0 {
+		startJob("stats_logger", func(ctx context.Context) error {
+			return s.runStatsLogger(ctx, env)
+		})
+	} else {
+		s.l.Info("LMDB stats logging disabled")
+	}
+	if s.leader != nil && !s.c.OnlyOnce {
+		startJob("leader_election", s.leader.Run)
+	}
+	if s.c.Storage.Heartbeat.Enabled && !s.c.OnlyOnce {
+		startJob("heartbeat", s.runHeartbeats)
+	}
+	if s.c.Storage.Convergence.Enabled && !s.c.OnlyOnce {
+		startJob("convergence", func(ctx context.Context) error {
+			return s.runConvergenceChecks(ctx, env)
+		})
+	}
+	if s.c.Backup.Enabled && !s.c.OnlyOnce {
+		startJob("backup", func(ctx context.Context) error {
+			return s.runBackups(ctx, env)
+		})
+	}
+	if s.c.Storage.Compaction.Enabled && !s.c.OnlyOnce && !s.opt.ReceiveOnly {
+		startJob("compaction", s.runCompaction)
+	}
+	if s.c.ChangeImport.Enabled && !s.c.OnlyOnce && !s.opt.ReceiveOnly && !s.opt.DryRun {
+		defer s.registerImporter(env)()
+	}
+	if (s.c.PDNS.Enabled() && !s.c.OnlyOnce && !s.opt.DryRun) || s.c.PDNS.Zones.Enabled() {
+		defer s.registerDomainLookup(env)()
+	}
 
 	return s.syncLoop(ctx, env, r)
 }
@@ -55,20 +181,53 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 
 	// The lastSyncedTxnID starts as 0 to force at least one snapshot on startup
 	var lastSyncedTxnID header.TxnID
+	s.syncedTxnID.Store(0)
+	s.changesSince = header.TxnID(info.LastTxnID)
 	hasDataAtStart := info.LastTxnID > 0
 	warnedEmpty := false
+	s.verifyKeys = nil
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Run cleaner in background to clean old snapshots
-	go func() {
-		err := s.cleaner.Run(ctx)
-		s.l.WithError(err).Info("Cleaner exited")
+	// Loads and stores in the loop below use workCtx, which is only cancelled
+	// shutdown_timeout after ctx, so that a load in progress can finish and
+	// a final snapshot can be written on shutdown.
+	workCtx, cancelWork := s.workContext(ctx)
+	defer cancelWork()
+
+	// Prioritized bulk load of an empty LMDB, until the snapshots that
+	// existed at startup are loaded
+	bulk := s.startBulkLoad(r, hasDataAtStart)
+	defer bulk.end(s)
+
+	// Relaxed durability until the snapshots that existed at startup are
+	// loaded, if configured. The LMDB is synced when it is raised again.
+	durability := s.c.LMDBDurability.Startup
+	if bulk != nil {
+		durability = s.c.LMDBDurability.BulkLoad
+	}
+	if err := s.setDurability(env, durability); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.setDurability(env, config.DurabilityFull); err != nil {
+			s.l.WithError(err).Error("Failed to restore full LMDB durability")
+		}
 	}()
 
-	// Wait for an initial snapshot listing
-	for {
+	// Run cleaner in background to clean old snapshots
+	if !s.opt.DryRun {
+		go func() {
+			err := s.cleaner.Run(ctx)
+			s.l.WithError(err).Info("Cleaner exited")
+		}()
+	}
+
+	// Wait for an initial snapshot listing. In send-only mode the receiver
+	// never runs, so there are no remote snapshots to wait for and the local
+	// data is written in an initial snapshot.
+	for !s.opt.SendOnly {
 		err := r.RunOnce(ctx, true) // including own snapshots, only during startup
 		if err == nil {
 			break
@@ -99,6 +258,10 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 	//
 	waitingForInstances := NewInstanceSet()
 	for _, instance := range r.SeenInstances() {
+		if r.IsApplied(instance) {
+			// Already applied before the restart, see lmdb_persist_sync_state
+			continue
+		}
 		if instance == ownInstanceID {
 			// This instance name has existing snapshots that we must load before
 			// attempting to write new snapshots, to not lose data.
@@ -108,12 +271,21 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 		waitingForInstances.Add(instance)
 	}
 
+	if bulk != nil && len(waitingForInstances.List()) < s.c.LMDBBulkLoad.MinInstances {
+		s.l.WithField("instances", len(waitingForInstances.List())).
+			Info("Too few instances with snapshots, not doing a bulk load")
+		bulk.end(s)
+		if err := s.setDurability(env, s.c.LMDBDurability.Startup); err != nil {
+			return err
+		}
+	}
+
 	if hasDataAtStart && !s.lc.SchemaTracksChanges {
 		// Sync to shadow using a time in the past to not overwrite newer data.
 		// At least is allows us to save newer entries that were added
 		// while the syncer was not running. It will not save updated entries.
 		s.l.Info("Syncing main to shadow, in case data was changed before start")
-		err := env.Update(func(txn *lmdb.Txn) error {
+		err := s.update(env, func(txn *lmdb.Txn) error {
 			// We would like to just use timestamp 0 here, but that
 			// would break older clients that explicitly guard against
 			// zero timestamps.
@@ -153,15 +325,24 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 
 	// To force periodic snapshots
 	lastSnapshotTime := time.Now()
-	forceSnapshotInterval := s.c.StorageForceSnapshotInterval
-	forceSnapshotEnabled := forceSnapshotInterval > 0
+
+	// To delay snapshots of local changes, if enabled
+	trigger := snapshotTrigger{c: s.c.SnapshotTrigger}
+
+	// To run the tombstone GC periodically, but not right after startup
+	lastTombstoneGC := time.Now()
+
+	// To check the fragmentation periodically, but not right after startup
+	lastCompactionCheck := time.Now()
 
 	// Run receiver in background to get newer snapshot after loading the
 	// initial batch of snapshots.
-	go func() {
-		err := r.Run(ctx)
-		s.l.WithError(err).Info("Receiver exited")
-	}()
+	if !s.opt.SendOnly {
+		go func() {
+			err := r.Run(ctx)
+			s.l.WithError(err).Info("Receiver exited")
+		}()
+	}
 
 	// There is no guarantee that the snapshots listed before have already been
 	// downloaded and are available for loading, but this is fine.
@@ -169,14 +350,14 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 
 	// Keep checking for new remote snapshots and uploading on local changes
 	for {
-		// Load all new snapshots that are ready (downloaded and unpacked).
+		// Load all new snapshots that are ready (downloaded).
 		// To not starve the syncer from sending local changes, we break for
 		// a local snapshot after MaxConsecutiveSnapshotLoads loads.
 		// Additionally, in shadow mode, every load will implicitly trigger a
 		// snapshot when local changes are detected.
 		nLoads := 0
 	loadReadySnapshotsLoop:
-		for {
+		for !utils.IsCanceled(ctx) && !s.pausedReceive.Load() {
 			instance, update := r.Next()
 			if instance == "" {
 				break loadReadySnapshotsLoop // no more ready remote snapshots
@@ -186,13 +367,28 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 			if instance == ownInstanceID {
 				s.l.Info("Loading snapshot for own instance")
 			}
-			waitingForInstances.Remove(instance)
+			if !update.IsBase {
+				// A base snapshot is always followed by a delta snapshot
+				waitingForInstances.Remove(instance)
+			}
 			actualTxnID, localChanged, err := s.LoadOnce(
-				ctx, env, instance, update, lastSyncedTxnID)
+				workCtx, env, instance, update, lastSyncedTxnID)
 			update.Close() // returns the DecompressedSnapshotToken
+			if errors.Is(err, snapshot.ErrCorrupt) {
+				// Any batches applied before the corruption was detected
+				// are kept, as these entries are valid on their own.
+				r.MarkCorrupt(update.NameInfo.FullName, err)
+				continue
+			}
 			if err != nil {
 				return err
 			}
+			if !s.opt.DryRun {
+				update.Loaded()
+			}
+			if s.bulkLoading.Load() {
+				bulk.loads++
+			}
 			utils.GC()
 			if !localChanged {
 				// Prevent triggering a local snapshot if there were no local
@@ -201,6 +397,7 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 				// If there were local changes, we leave it as is to trigger
 				// a snapshot below.
 				lastSyncedTxnID = actualTxnID
+				s.changesSince = actualTxnID
 			}
 			if localChanged && nLoads > MaxConsecutiveSnapshotLoads {
 				break loadReadySnapshotsLoop // allow a local snapshot before proceeding
@@ -222,14 +419,32 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 			}
 		}
 
+		// Purge old tombstones once all instances have been loaded
+		if gc := s.c.TombstoneGC; gc.Enabled && !s.opt.DryRun && waitingForInstances.Done() &&
+			time.Since(lastTombstoneGC) >= gc.Interval {
+			if err := s.runTombstoneGC(env, r.SeenInstances()); err != nil {
+				return err
+			}
+			lastTombstoneGC = time.Now()
+		}
+
 		// Check if we need to do a periodic snapshot
 		snapshotOverdue := false
-		if dt := time.Since(lastSnapshotTime); forceSnapshotEnabled && dt > forceSnapshotInterval {
+		forceSnapshotInterval := s.forceSnapshotInterval.Load()
+		if dt := time.Since(lastSnapshotTime); forceSnapshotInterval > 0 && dt > forceSnapshotInterval {
 			snapshotOverdue = true
 			logrus.WithField(
 				"last_snapshot_time_passed", dt.Round(time.Second).String(),
 			).Info("Snapshot overdue, forcing one")
 		}
+		if s.forceFull.Swap(false) {
+			s.l.Info("Full snapshot requested")
+			s.delta.forceFull = true
+		}
+		if s.delta.forceFull {
+			// Cleared once a full snapshot was stored
+			snapshotOverdue = true
+		}
 
 		// Check for change in local LMDB
 		info, err := env.Info()
@@ -240,10 +455,27 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 			"info.LastTxnID":  info.LastTxnID,
 			"lastSyncedTxnID": lastSyncedTxnID,
 		}).Trace("Checking if TxnID changed")
-		if header.TxnID(info.LastTxnID) > lastSyncedTxnID || snapshotOverdue {
+		changed := header.TxnID(info.LastTxnID) > lastSyncedTxnID
+		if changed && !snapshotOverdue && s.flushTxnID.Load() <= uint64(lastSyncedTxnID) {
+			changes := uint64(header.TxnID(info.LastTxnID) - lastSyncedTxnID)
+			due, reason := trigger.due(time.Now(), lastSnapshotTime, changes)
+			if !due {
+				s.l.WithField("changes", changes).Trace("Waiting for the snapshot trigger")
+				changed = false
+			} else if reason != "" {
+				s.l.WithField("changes", changes).WithField("reason", reason).
+					Debug("Snapshot triggered")
+				metricSnapshotsTriggered.WithLabelValues(s.name, reason).Inc()
+			}
+		}
+		if changed || snapshotOverdue {
 			// We have data to snapshot, or we have not performed a snapshot
 			// yet after startup.
-			if waitingForInstances.Contains(ownInstanceID) {
+			if s.pausedSend.Load() {
+				s.l.Debug("Sending paused, not writing a snapshot")
+			} else if s.bulkLoading.Load() {
+				s.l.Debug("Bulk load in progress, not writing a snapshot")
+			} else if waitingForInstances.Contains(ownInstanceID) {
 				// We must not store a snapshot before we have loaded our own
 				// snapshot, because if we started with an empty LMDB, we
 				// could write a snapshot that loses data that was only in our
@@ -261,12 +493,13 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 
 				// Store snapshot
 				if hasDataAtStart || lastSyncedTxnID > 0 {
-					actualTxnID, err := s.SendOnce(ctx, env)
+					actualTxnID, err := s.SendOnce(workCtx, env)
 					if err != nil {
 						return err
 					}
 					lastSyncedTxnID = actualTxnID
 					lastSnapshotTime = time.Now()
+					trigger.stored()
 					// Start tracker: Initial snapshot stored
 					s.startTracker.SetPassedInitialStore()
 				} else if !warnedEmpty {
@@ -276,236 +509,670 @@ func (s *Syncer) syncLoop(ctx context.Context, env *lmdb.Env, r *receiver.Receiv
 			}
 		}
 
+		// For Flush: all local changes up to here are in a snapshot
+		s.syncedTxnID.Store(uint64(lastSyncedTxnID))
+
 		// Update start tracker if pass has completed
 		if waitingForInstances.Done() {
+			if err := s.setDurability(env, config.DurabilityFull); err != nil {
+				return err
+			}
+			if s.bulkLoading.Load() {
+				bulk.end(s)
+				s.l.WithField("snapshots", bulk.loads).
+					WithField("duration", time.Since(bulk.started).Round(time.Millisecond)).
+					Info("Bulk load done")
+			}
 			s.startTracker.SetPassCompleted()
+			r.StartupDone()
+		}
+
+		// Compact the LMDB if it has too many free pages. This is done after
+		// the local snapshot, so that the sync can restart right away.
+		if ac := s.c.LMDBAutoCompaction; ac.Enabled && !s.c.OnlyOnce &&
+			time.Since(lastCompactionCheck) >= ac.Interval {
+			lastCompactionCheck = time.Now()
+			compacted, err := s.autoCompact(env)
+			if err != nil {
+				s.l.WithError(err).Warn("Auto compaction failed")
+			} else if compacted {
+				return errEnvCompacted
+			}
 		}
 
 		// If set, we are done now.
 		// This check is now intentionally after the local snapshot upload.
 		if s.c.OnlyOnce && waitingForInstances.Done() {
+			if s.opt.VerifyOnly {
+				return s.reportVerify()
+			}
 			s.l.Info("Stopping, because requested to only do a single pass")
 			return nil
 		}
 
+		// For the systemd watchdog
+		s.lastCycle.Store(time.Now())
+
 		// Sleep before next check for snapshots and local changes
 		s.l.Debug("Waiting for a new transaction")
-		if err := utils.SleepContext(ctx, s.c.LMDBPollInterval); err != nil {
+		if err := s.sleep(ctx, s.lmdbPollInterval.Load()); err != nil {
+			canSend := !waitingForInstances.Contains(ownInstanceID)
+			s.flushOnShutdown(workCtx, env, lastSyncedTxnID, canSend)
 			return err
 		}
 	}
 
 }
 
+// LoadOnce loads a remote snapshot into the LMDB.
+// The snapshot is decompressed and decoded while it is being applied, so that
+// at most a few DBI messages are held in memory at a time. Large snapshots are
+// applied in multiple write transactions of about lmdb_load_batch_size each,
+// with at most lmdb_load_batch_entries entries, if set.
+// In shadow mode, every transaction also copies the shadow DBIs it changed to
+// the main DBIs, so that a local change between two transactions cannot undo
+// the entries merged by the earlier ones. With lmdb_load_staging, the
+// transactions only stage the changed entries instead, and the last one
+// merges them all, see staging.go.
+// Errors caused by corrupt snapshot data wrap snapshot.ErrCorrupt.
 func (s *Syncer) LoadOnce(ctx context.Context, env *lmdb.Env, instance string, update snapshot.Update, lastTxnID header.TxnID) (txnID header.TxnID, localChanged bool, err error) {
 
 	t0 := time.Now() // for performance measurements
-	snap := update.Snapshot
+	ni := update.NameInfo
+
+	ctx, span := tracer.Start(ctx, "LoadOnce", trace.WithAttributes(
+		attribute.String("lmdb", s.name),
+		attribute.String("syncer_instance", instance),
+		attribute.String("snapshot_name", ni.FullName),
+		attribute.Int("compressed_bytes", len(update.Data)),
+		attribute.Bool("base", update.IsBase)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	s.loadEntries = nil
+	s.loadConflicts = nil
+	s.loadZones = nil
+	if pdns.Active() && !s.opt.DryRun {
+		s.loadZones = pdns.NewZones()
+	}
+	s.loadFilter = nil
+
+	var sr *snapshot.StreamReader
+	if th := s.c.MemoryStagingThreshold; th > 0 && uint64(update.Size()) >= th.Bytes() {
+		s.l.WithField("snapshot", ni.FullName).Debug("Staging large snapshot")
+		sr, err = update.NewStagedReader(s.c.MemorySpillDir)
+		metricSnapshotsStaged.WithLabelValues(s.name).Inc()
+	} else {
+		sr, err = update.NewReader()
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		_ = sr.Close()
+	}()
 
 	var tTxnAcquire time.Time
-	var tShadow1Start time.Time
-	var tShadow1End time.Time
-	var tShadow2Start time.Time
-	var tShadow2End time.Time
-	var tLoadStart time.Time
-	var tLoadEnd time.Time
+	var dtWriteLock time.Duration
+	var dtShadow1 time.Duration
+	var dtShadow2 time.Duration
+	var dtLoad time.Duration
 
 	schemaTracksChanges := s.lc.SchemaTracksChanges
+	batchSize := int(s.c.LMDBLoadBatchSize)
+	maxEntries := s.c.LMDBLoadBatchEntries
+	if s.bulkLoading.Load() {
+		batchSize = int(s.c.LMDBBulkLoad.BatchSize)
+		maxEntries = 0
+	}
+	if s.opt.DryRun {
+		// Every transaction is aborted, so later batches would not see the
+		// changes of earlier ones.
+		batchSize = 0
+		maxEntries = 0
+	}
 
-	err = env.Update(func(txn *lmdb.Txn) error {
-		ts := time.Now()
-		tTxnAcquire = ts
-		tsNano := header.TimestampFromTime(ts)
-		txnID = header.TxnID(txn.ID())
-
-		// There was a local change if the update transaction ID was more than 1
-		// higher than the last transaction ID we took a snapshot of.
-		// If nothing had changed since the last snapshot, we would get the next
-		// transaction ID in sequence.
-		localChanged = lastTxnID < (txnID - 1)
-
-		// TODO: Would be useful to have the NameInfo here
-		l := s.l.WithFields(logrus.Fields{
-			"txnID":             txnID,
-			"lastTxnID":         lastTxnID,
-			"snapshot_instance": instance,
-			"timestamp":         snapshot.NameTimestampFromNano(header.Timestamp(snap.Meta.TimestampNano)),
-			"localChanged":      localChanged,
-		})
-		l.Debug("Started load")
-
-		// First update the shadow dbs to reflect the latest local state
-		tShadow1Start = time.Now()
-		if !schemaTracksChanges && localChanged {
-			err := s.mainToShadow(ctx, txn, tsNano)
-			if err != nil {
-				return err
-			}
-		}
-		tShadow1End = time.Now()
+	l := s.l.WithFields(logrus.Fields{
+		"snapshot_instance": instance,
+		"snapshot_name":     ni.FullName,
+		"timestamp":         ni.TimestampString,
+	})
 
-		// Apply snapshot
-		tLoadStart = time.Now()
-		for _, dbiMsg := range snap.Databases {
-			dbiName := dbiMsg.Name()
-			dbiOpt := s.lc.DBIOptions[dbiName]
-			ld := l.WithField("dbi", dbiName)
+	// A staged load writes the changed entries to the staging DBI in batches
+	// and merges them in the last transaction, see staging.go
+	staging := s.c.LMDBLoadStaging && (batchSize > 0 || maxEntries > 0) && !s.bulkLoading.Load()
 
-			if strings.HasPrefix(dbiName, SyncDBIPrefix) {
-				ld.Warn("Remote snapshot contains private DBI, ignoring")
-				continue // skip our own special dbs
+	done := false
+	stagedAll := false // all snapshot entries were staged
+	shadowStale := false
+	nBatches := 0
+	var rest *snapshot.DBI // remainder of a DBI message split over batches
+	var batchDBIs []string // DBIs merged into the shadow DBIs by a batch
+	for !done {
+		nBatches++
+		err = s.update(env, func(txn *lmdb.Txn) (err error) {
+			ts := time.Now()
+			if nBatches == 1 {
+				tTxnAcquire = ts
 			}
+			// Decoding and merging the snapshot data are interleaved, so
+			// their times are attributes of the batch span.
+			var dtDecode, dtMerge time.Duration
+			ctx, batchSpan := tracer.Start(ctx, "load_batch", trace.WithAttributes(
+				attribute.Int("batch", nBatches)))
+			defer func() {
+				dtWriteLock += time.Since(ts)
+				batchSpan.SetAttributes(
+					seconds("decode_seconds", dtDecode),
+					seconds("merge_seconds", dtMerge))
+				endSpan(batchSpan, err)
+			}()
+			tsNano := s.clock.Now(ts)
+			txnID = header.TxnID(txn.ID())
 
-			err := dbiMsg.ValidateTransform(snap.FormatVersion, schemaTracksChanges)
-			if err != nil {
-				return err
-			}
+			// There was a local change if the update transaction ID was more than 1
+			// higher than the last transaction ID we took a snapshot of, or
+			// than the previous batch of this load.
+			// If nothing had changed since, we would get the next
+			// transaction ID in sequence.
+			changed := lastTxnID < (txnID - 1)
+			localChanged = localChanged || changed
 
-			ld.Debug("Starting merge of snapshot into DBI")
-			targetDBIName := dbiName
-			if !schemaTracksChanges {
-				targetDBIName = SyncDBIShadowPrefix + dbiName
+			l := l.WithFields(logrus.Fields{
+				"txnID":        txnID,
+				"lastTxnID":    lastTxnID,
+				"batch":        nBatches,
+				"localChanged": changed,
+			})
+			l.Debug("Started load")
 
-				// We need to create the actual data DBI too if it does not
-				// exist yet.
-				exists, err := lmdbenv.DBIExists(txn, dbiName)
+			// First update the shadow dbs to reflect the latest local state.
+			// A staged load only needs this in the transaction that merges
+			// the staged entries.
+			shadowStale = shadowStale || changed
+			copyShadow := func() error {
+				t := time.Now()
+				defer func() {
+					dtShadow1 += time.Since(t)
+				}()
+				if schemaTracksChanges || !(shadowStale || s.opt.DryRun) {
+					return nil
+				}
+				shadowTS := tsNano
+				if s.opt.DryRun {
+					// The copy of the startup pass was aborted, so it is
+					// repeated with the same timestamp, see syncLoop
+					shadowTS = header.Timestamp(1)
+				}
+				ctx, shadowSpan := tracer.Start(ctx, "copy_shadow")
+				err := s.mainToShadow(ctx, txn, shadowTS)
+				endSpan(shadowSpan, err)
 				if err != nil {
 					return err
 				}
-				if !exists {
-					if snap.FormatVersion < 3 && dbiOpt.OverrideCreateFlags == nil {
-						// Earlier versions stored the DBI flags from the shadow
-						// DBI instead of the flags from the original DBI.
-						return fmt.Errorf(
-							"DBI %s does not exist yet, and we cannot safely "+
-								"create it from a formatVersion=%d snapshot, "+
-								"only a formatVersion 3+ snapshot contains the "+
-								"information we need for this; you can explicitly "+
-								"override the flags through `override_create_flags` "+
-								"in `dbi_options`, but only attempt this if you "+
-								"are sure you need it",
-							dbiName, snap.FormatVersion)
-					}
+				shadowStale = false
+				return nil
+			}
+			if !staging {
+				if err := copyShadow(); err != nil {
+					return err
+				}
+			} else if nBatches == 1 {
+				if err := s.resetStaging(txn); err != nil {
+					return err
+				}
+			}
 
-					var flags = dbiflags.Flags(dbiMsg.Flags())
-					if dbiOpt.OverrideCreateFlags != nil {
-						flags = *dbiOpt.OverrideCreateFlags
+			// Apply snapshot
+			t := time.Now()
+			stagedBefore := stagedAll
+			batchBytes := 0
+			batchEntries := 0
+			batchDBIs = batchDBIs[:0]
+			for !stagedAll && (batchSize <= 0 || batchBytes < batchSize) &&
+				(maxEntries <= 0 || batchEntries < maxEntries) {
+				tDecode := time.Now()
+				var err error
+				dbiMsg := rest
+				rest = nil
+				if dbiMsg == nil {
+					dbiMsg, err = sr.Next()
+				}
+				if err == nil && maxEntries > 0 {
+					dbiMsg, rest, err = splitDBI(dbiMsg, maxEntries-batchEntries)
+					if err == nil {
+						var n int
+						n, err = dbiMsg.Len()
+						batchEntries += n
 					}
-					ld.WithField("flags", flags).Warn("Creating new DBI from snapshot")
-					_, err := txn.OpenDBI(dbiName, lmdb.Create|uint(flags))
-					if err != nil {
-						return err
+				}
+				dtDecode += time.Since(tDecode)
+				if err != nil {
+					if err == io.EOF {
+						stagedAll = staging
+						done = !staging
+						break
 					}
+					return err
+				}
+				tMerge := time.Now()
+				if staging {
+					err = s.stageDBI(txn, l, sr, dbiMsg)
+				} else {
+					err = s.loadDBI(txn, l, sr, dbiMsg, instance)
+				}
+				dtMerge += time.Since(tMerge)
+				if err != nil {
+					return err
+				}
+				batchBytes += dbiMsg.Size()
+				if n := len(batchDBIs); n == 0 || batchDBIs[n-1] != dbiMsg.Name() {
+					batchDBIs = append(batchDBIs, dbiMsg.Name())
 				}
-			}
 
-			// Create the target DBI if needed
-			exists, err := lmdbenv.DBIExists(txn, targetDBIName)
-			if err != nil {
-				return err
+				if utils.IsCanceled(ctx) {
+					return context.Canceled
+				}
 			}
-			if !exists {
-				// The formatVersion does not matter here, because the DBI flags
-				// stored in earlier versions will be the correct ones for the
-				// DBI that we are creating here (shadow or native).
-				var flags = dbiflags.Flags(dbiMsg.Flags())
-				if dbiOpt.OverrideCreateFlags != nil {
-					flags = *dbiOpt.OverrideCreateFlags
+			if staging {
+				// The staged entries are merged in the same transaction
+				// if the whole snapshot fit in the first one, and
+				// otherwise in a separate short one.
+				if !stagedAll || (!stagedBefore && nBatches > 1) {
+					dtLoad += time.Since(t)
+					return nil
 				}
-				if !schemaTracksChanges {
-					// Only flags like MDB_INTEGERKEY must be transferred
-					// to shadow DBIs.
-					flags &= AllowedShadowDBIFlagsMask
+				dtLoad += time.Since(t)
+				if err := copyShadow(); err != nil {
+					return err
 				}
-				ld.WithField("dbi", targetDBIName).
-					WithField("flags", flags).Warn("Creating new DBI from snapshot")
-				_, err := txn.OpenDBI(targetDBIName, lmdb.Create|uint(flags))
+				t = time.Now()
+				err := s.applyStaged(txn, l, sr, instance)
+				dtMerge += time.Since(t)
 				if err != nil {
 					return err
 				}
+				done = true
 			}
+			dtLoad += time.Since(t)
 
-			// Open the DBI now. It has been created if it did not exist yet.
-			targetDBI, err := txn.OpenDBI(targetDBIName, 0)
-			if err != nil {
-				return err
+			// Apply state of shadow dbs to main data. This is also done for
+			// the DBIs of every batch before the last one, because the main
+			// DBIs and the shadow DBIs must be in sync between transactions.
+			// Otherwise a local change between two batches would have the
+			// mainToShadow of the next batch overwrite the remote entries
+			// of the earlier batches with the old values in the main DBIs.
+			t = time.Now()
+			if !schemaTracksChanges {
+				ctx, shadowSpan := tracer.Start(ctx, "shadow_to_main")
+				var err error
+				if done {
+					err = s.shadowToMain(ctx, txn)
+				} else {
+					err = s.shadowToMainDBIs(ctx, txn, batchDBIs)
+				}
+				endSpan(shadowSpan, err)
+				if err != nil {
+					return err
+				}
+			}
+			dtShadow2 += time.Since(t)
+
+			if s.c.LMDBPersistSyncState && done {
+				if err := writeSyncState(txn, instance, ni, ts); err != nil {
+					return err
+				}
 			}
 
-			it, err := NewNativeIterator(
-				snap.FormatVersion,
-				snap.CompatVersion,
-				dbiMsg,
-				0, // no default timestamp
-				header.TxnID(txn.ID()),
-			)
+			return nil
+		})
+		if err != nil {
+			// We always return LMDB reading errors, as these are really unexpected
+			return 0, false, err
+		}
+
+		// If no actual changes were made, LMDB will not record the transaction
+		// and reuse the ID the next time, so we need to adjust the txnID we return.
+		info, err := env.Info()
+		if err != nil {
+			return 0, false, err
+		}
+		if header.TxnID(info.LastTxnID) < txnID {
+			// Transaction was empty, no changes
+			s.l.WithField("prevTxnID", txnID).WithField("txnID", info.LastTxnID).
+				Debug("Adjusting TxnID (no changes)")
+			txnID = header.TxnID(info.LastTxnID)
+		}
+		lastTxnID = txnID
+		if s.loadBatchDone != nil && !done {
+			s.loadBatchDone()
+		}
+	}
+	tLoaded := time.Now()
+
+	// Older versions do not record the compression in the Meta
+	compression := sr.Meta.Compression
+	if compression == "" {
+		compression = ni.Compression()
+	}
+
+	l = l.WithFields(logrus.Fields{
+		"time_total":      utils.TimeDiff(tLoaded, t0),
+		"time_write_lock": dtWriteLock.Round(time.Millisecond),
+		"txnID":           txnID,
+		"shorthash":       ni.ShortHash(),
+		"batches":         nBatches,
+		"compression":     compression,
+	})
+	if s.opt.DryRun {
+		l.Info("Dry run: remote snapshot would be loaded")
+		return txnID, localChanged, nil
+	}
+	l.Info("Loaded remote snapshot")
+
+	l.WithFields(logrus.Fields{
+		"time_acquire":      utils.TimeDiff(tTxnAcquire, t0),
+		"time_copy_shadow1": dtShadow1.Round(time.Millisecond),
+		"time_copy_shadow2": dtShadow2.Round(time.Millisecond),
+		"time_load":         dtLoad.Round(time.Millisecond),
+	}).Debug("Loaded remote snapshot (with timings)")
+
+	s.lastByInstance[instance] = ni.Timestamp
+	s.loadedBy[instance] = loadedByInstance(sr.Meta.Loaded)
+	s.clock.Observe(instance, ni.Timestamp, tLoaded)
+	if ni.Timestamp.After(s.newestApplied.Load()) {
+		s.newestApplied.Store(ni.Timestamp)
+	}
+
+	metricSnapshotsMerged.WithLabelValues(s.name, instance).Inc()
+	metricSnapshotsMergedLastTimestamp.WithLabelValues(s.name, instance).
+		Set(float64(tLoaded.UnixNano()) / 1e9)
+	metricSnapshotsMergedLastSnapshotTimestamp.WithLabelValues(s.name, instance).
+		Set(float64(ni.Timestamp.UnixNano()) / 1e9)
+	metricSnapshotsMergeDuration.WithLabelValues(s.name).Observe(tLoaded.Sub(t0).Seconds())
+	metricSnapshotsMergedByCompression.WithLabelValues(s.name, compression).Inc()
+
+	webhook.Notify(webhook.Event{
+		Event:            webhook.EventSnapshotLoaded,
+		LMDB:             s.name,
+		SnapshotName:     ni.FullName,
+		SnapshotInstance: instance,
+	})
+	if len(s.loadConflicts) > 0 {
+		webhook.Notify(webhook.Event{
+			Event:            webhook.EventConflict,
+			LMDB:             s.name,
+			SnapshotName:     ni.FullName,
+			SnapshotInstance: instance,
+			Conflicts:        s.loadConflicts,
+		})
+	}
+	s.runPostApplyCommand(ctx, instance, ni)
+	pdns.Changed(s.loadZones)
+	s.loadFilter.done(s)
+	if _, total := s.mergedDBIs(); total > 0 {
+		sidecar.Changed(s.name)
+	}
+
+	return txnID, localChanged, nil
+}
+
+// splitDBI splits a DBI message after n entries, see snapshot.DBI.Split.
+// The tail is nil if the message fits.
+func splitDBI(dbiMsg *snapshot.DBI, n int) (head, tail *snapshot.DBI, err error) {
+	head, tail, err = dbiMsg.Split(n)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: dbi %s: %v", snapshot.ErrCorrupt, dbiMsg.Name(), err)
+	}
+	return head, tail, nil
+}
+
+// loadDBI merges a single snapshot DBI message from the given instance
+// into the LMDB
+func (s *Syncer) loadDBI(txn *lmdb.Txn, l logrus.FieldLogger, sr *snapshot.StreamReader, dbiMsg *snapshot.DBI, instance string) error {
+	dbiMsg, err := s.prepareDBI(txn, l, sr, dbiMsg)
+	if err != nil || dbiMsg == nil {
+		return err
+	}
+	return s.mergeDBI(txn, l, sr, dbiMsg, instance)
+}
+
+// prepareDBI converts a snapshot DBI message to the format of the local DBI
+// and filters its entries. It returns nil if the DBI must not be merged.
+func (s *Syncer) prepareDBI(txn *lmdb.Txn, l logrus.FieldLogger, sr *snapshot.StreamReader, dbiMsg *snapshot.DBI) (*snapshot.DBI, error) {
+	schemaTracksChanges := s.lc.SchemaTracksChanges
+	dbiName := dbiMsg.Name()
+	ld := l.WithField("dbi", dbiName)
+
+	if strings.HasPrefix(dbiName, SyncDBIPrefix) {
+		ld.Warn("Remote snapshot contains private DBI, ignoring")
+		return nil, nil // skip our own special dbs
+	}
+	if !s.lc.IsDBIIncluded(dbiName) {
+		ld.Debug("Remote snapshot contains DBI excluded from sync, ignoring")
+		return nil, nil
+	}
+
+	err := dbiMsg.ValidateTransform(sr.FormatVersion, schemaTracksChanges)
+	if err != nil {
+		return nil, err
+	}
+	if !schemaTracksChanges {
+		dbiMsg, err = s.dupSortConvert(dbiMsg)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+	}
+	dbiMsg, err = s.decodeDBI(dbiMsg)
+	if err != nil {
+		return nil, err
+	}
+	if s.c.PDNS.Zones.Enabled() && pdns.IsSchemaDBI(dbiName) {
+		// The filter is created once per snapshot, from the zones in the
+		// LMDB before the merge
+		if s.loadFilter == nil {
+			s.loadFilter, err = s.newZoneFilter(txn, "load")
 			if err != nil {
-				return fmt.Errorf("create native iterator: %w", err)
+				return nil, err
 			}
-			if s.lc.HeaderExtraPaddingBlock {
-				it.HeaderPaddingBlock = true
+		}
+		dbiMsg, err = s.loadFilter.filterDBI(dbiMsg)
+		if err != nil {
+			return nil, fmt.Errorf("dbi %s: %w", dbiName, err)
+		}
+	}
+	return dbiMsg, nil
+}
+
+// mergeDBI merges a snapshot DBI message prepared by prepareDBI into the
+// LMDB, creating the DBIs if needed
+func (s *Syncer) mergeDBI(txn *lmdb.Txn, l logrus.FieldLogger, sr *snapshot.StreamReader, dbiMsg *snapshot.DBI, instance string) error {
+	schemaTracksChanges := s.lc.SchemaTracksChanges
+	dbiName := dbiMsg.Name()
+	dbiOpt := s.lc.DBIOptions[dbiName]
+	ld := l.WithField("dbi", dbiName)
+	isDupSortNative := dbiMsg.Transform() == snapshot.TransformDupSortNativeV1
+
+	var err error
+
+	ld.Debug("Starting merge of snapshot into DBI")
+	targetDBIName := dbiName
+	if !schemaTracksChanges {
+		targetDBIName, err = s.shadowDBIName(dbiName)
+		if err != nil {
+			return err
+		}
+
+		// We need to create the actual data DBI too if it does not
+		// exist yet.
+		exists, err := lmdbenv.DBIExists(txn, dbiName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if sr.FormatVersion < 3 && dbiOpt.OverrideCreateFlags == nil {
+				// Earlier versions stored the DBI flags from the shadow
+				// DBI instead of the flags from the original DBI.
+				return fmt.Errorf(
+					"DBI %s does not exist yet, and we cannot safely "+
+						"create it from a formatVersion=%d snapshot, "+
+						"only a formatVersion 3+ snapshot contains the "+
+						"information we need for this; you can explicitly "+
+						"override the flags through `override_create_flags` "+
+						"in `dbi_options`, but only attempt this if you "+
+						"are sure you need it",
+					dbiName, sr.FormatVersion)
+			}
+
+			var flags = dbiflags.Flags(dbiMsg.Flags())
+			if dbiOpt.OverrideCreateFlags != nil {
+				flags = *dbiOpt.OverrideCreateFlags
 			}
-			err = strategy.Update(txn, targetDBI, it)
+			ld.WithField("flags", flags).Warn("Creating new DBI from snapshot")
+			_, err := txn.OpenDBI(dbiName, lmdb.Create|uint(flags))
 			if err != nil {
 				return err
 			}
-			ld.Debug("Merge successful")
-
-			if utils.IsCanceled(ctx) {
-				return context.Canceled
-			}
 		}
-		tLoadEnd = time.Now()
+	}
 
-		// Apply state of shadow dbs to main data
-		tShadow2Start = time.Now()
+	// Create the target DBI if needed
+	exists, err := lmdbenv.DBIExists(txn, targetDBIName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// The formatVersion does not matter here, because the DBI flags
+		// stored in earlier versions will be the correct ones for the
+		// DBI that we are creating here (shadow or native).
+		var flags = dbiflags.Flags(dbiMsg.Flags())
+		if dbiOpt.OverrideCreateFlags != nil {
+			flags = *dbiOpt.OverrideCreateFlags
+		}
 		if !schemaTracksChanges {
-			err := s.shadowToMain(ctx, txn)
-			if err != nil {
-				return err
+			// Only flags like MDB_INTEGERKEY must be transferred
+			// to shadow DBIs.
+			flags &= AllowedShadowDBIFlagsMask
+			if isDupSortNative {
+				flags |= dbiflags.DupSort
 			}
 		}
-		tShadow2End = time.Now()
+		ld.WithField("dbi", targetDBIName).
+			WithField("flags", flags).Warn("Creating new DBI from snapshot")
+		_, err := txn.OpenDBI(targetDBIName, lmdb.Create|uint(flags))
+		if err != nil {
+			return err
+		}
+	}
 
-		return nil
-	})
+	// Open the DBI now. It has been created if it did not exist yet.
+	targetDBI, err := txn.OpenDBI(targetDBIName, 0)
 	if err != nil {
-		// We always return LMDB reading errors, as these are really unexpected
-		return 0, false, err
+		return err
 	}
-	tLoaded := time.Now()
 
-	// If no actual changes were made, LMDB will not record the transaction
-	// and reuse the ID the next time, so we need to adjust the txnID we return.
-	info, err := env.Info()
+	// The entries are merged in the order of the snapshot, which is the key
+	// order of the DBI on the instance that created it. Earlier format
+	// versions did not store the right flags.
+	targetFlags, err := txn.Flags(targetDBI)
 	if err != nil {
-		return 0, false, err
+		return err
 	}
-	if header.TxnID(info.LastTxnID) < txnID {
-		// Transaction was empty, no changes
-		s.l.WithField("prevTxnID", txnID).WithField("txnID", info.LastTxnID).
-			Debug("Adjusting TxnID (no changes)")
-		txnID = header.TxnID(info.LastTxnID)
+	snapshotOrder := dbiflags.Flags(dbiMsg.Flags()) & keyOrderFlagsMask
+	targetOrder := dbiflags.Flags(targetFlags) & keyOrderFlagsMask
+	if sr.FormatVersion >= 3 && dbiOpt.OverrideCreateFlags == nil && snapshotOrder != targetOrder {
+		return fmt.Errorf("dbi %s: key order flags %q of the snapshot do not match the flags %q of the local DBI",
+			dbiName, snapshotOrder, targetOrder)
 	}
 
-	ts := snapshot.NameTimestampFromNano(header.Timestamp(snap.Meta.TimestampNano))
-	l := s.l.WithFields(logrus.Fields{
-		"time_total":        utils.TimeDiff(tLoaded, t0),
-		"time_write_lock":   utils.TimeDiff(tLoaded, tTxnAcquire),
-		"txnID":             txnID,
-		"snapshot_instance": instance,
-		"shorthash":         snapshot.ShortHash(snap.Meta.InstanceID, ts),
-		"timestamp":         ts,
-	})
-	l.Info("Loaded remote snapshot")
-
-	l.WithFields(logrus.Fields{
-		"time_acquire":      utils.TimeDiff(tTxnAcquire, t0),
-		"time_copy_shadow1": utils.TimeDiff(tShadow1End, tShadow1Start),
-		"time_copy_shadow2": utils.TimeDiff(tShadow2End, tShadow2Start),
-		"time_load":         utils.TimeDiff(tLoadEnd, tLoadStart),
-	}).Debug("Loaded remote snapshot (with timings)")
+	if !schemaTracksChanges {
+		// A DupSort shadow DBI can only be merged into one value at a time
+		if (targetFlags&lmdb.DupSort > 0) != isDupSortNative {
+			return fmt.Errorf("dbi %s: snapshot transform %q does not match the dupsort mode of the shadow DBI",
+				dbiName, dbiMsg.Transform())
+		}
+		if isDupSortNative {
+			if s.opt.VerifyOnly {
+				ld.Warn("Verify: changes to DupSort DBIs with dupsort_native are not compared")
+			}
+			n, err := loadDupSort(txn, targetDBI, targetDBIName, dbiMsg)
+			if err != nil {
+				return fmt.Errorf("dbi %s: %w", dbiName, err)
+			}
+			s.countMerged(dbiName, n)
+			ld.Debug("Merge successful")
+			return nil
+		}
+	}
 
-	s.lastByInstance[instance] = update.NameInfo.Timestamp
+	it, err := NewNativeIterator(
+		sr.FormatVersion,
+		sr.CompatVersion,
+		dbiMsg,
+		0, // no default timestamp
+		header.TxnID(txn.ID()),
+	)
+	if err != nil {
+		return fmt.Errorf("create native iterator: %w", err)
+	}
+	if s.lc.HeaderExtraPaddingBlock {
+		it.HeaderPaddingBlock = true
+	}
+	it.PurgedBefore = s.purgedBefore
+	it.DBIName = dbiName
+	it.RemoteInstance = instance
+	crStrategy := conflict.StrategyLastWriterWins
+	if r := s.resolvers[dbiName]; r != nil {
+		if dbiMsg.Transform() != "" {
+			ld.Debug("Conflict resolution not supported for DupSort DBI, using last-writer-wins")
+		} else {
+			it.Resolver = r
+			crStrategy = dbiOpt.ConflictResolution.Strategy
+		}
+	}
+	if s.opt.ConflictLog != nil && !s.opt.DryRun {
+		it.OnConflict = s.conflictLogger(ld, crStrategy)
+	}
+	if s.opt.DryRun {
+		rec := &changeRecorder{Iterator: it, verify: s.verifyDBIKeys(dbiName)}
+		if err := strategy.Update(txn, targetDBI, rec); err != nil {
+			return err
+		}
+		if rec.changed > 0 && !s.opt.VerifyOnly {
+			ld.WithField("changed", rec.changed).WithField("keys", rec.keys).
+				Info("Dry run: keys would change")
+		}
+	} else if s.loadZones != nil && pdns.IsZoneDBI(dbiName) {
+		rec := &zoneRecorder{NativeIterator: it, dbiName: dbiName, zones: s.loadZones}
+		if err := strategy.Update(txn, targetDBI, rec); err != nil {
+			return err
+		}
+	} else {
+		err = strategy.Update(txn, targetDBI, it)
+		if err != nil {
+			return err
+		}
+	}
+	if !s.opt.DryRun {
+		s.recordMergeStats(dbiName, it.Stats)
+	}
+	if it.Conflicts > 0 {
+		if s.loadConflicts == nil {
+			s.loadConflicts = make(map[string]int)
+		}
+		s.loadConflicts[dbiName] += it.Conflicts
+	}
+	s.countMerged(dbiName, it.Count())
+	ld.Debug("Merge successful")
+	return nil
+}
 
-	return txnID, localChanged, nil
+// countMerged records the number of entries merged into a DBI during a load
+func (s *Syncer) countMerged(dbiName string, n int) {
+	metricDBIEntriesMerged.WithLabelValues(s.name, dbiName).Add(float64(n))
+	if s.loadEntries == nil {
+		s.loadEntries = make(map[string]int)
+	}
+	s.loadEntries[dbiName] += n
 }
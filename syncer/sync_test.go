@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -14,8 +15,13 @@ import (
 	"github.com/PowerDNS/lmdb-go/lmdb"
 	"github.com/PowerDNS/simpleblob"
 	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/c2h5oh/datasize"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"powerdns.com/platform/lightningstream/backends/fs"
 	"powerdns.com/platform/lightningstream/config"
 	"powerdns.com/platform/lightningstream/config/logger"
 	"powerdns.com/platform/lightningstream/lmdbenv"
@@ -135,6 +141,121 @@ func doTest(t *testing.T, withHeader bool) {
 	t.Log("Done")
 }
 
+func TestSyncer_LoadOnce_batches(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		t.Run(fmt.Sprintf("withHeader=%v", withHeader), func(t *testing.T) {
+			ctx := context.Background()
+			st := memory.New()
+			syncerA, envA := createInstance(t, "a", st, withHeader)
+			syncerB, envB := createInstance(t, "b", st, withHeader)
+			syncerA.c.MemorySnapshotChunkSize = 4 * datasize.KB
+			syncerB.c.LMDBLoadBatchSize = 8 * datasize.KB
+
+			// Has an older value for a key of a, see below
+			syncerE, envE := createInstance(t, "e", st, withHeader)
+			setKey(t, envE, "key-000", "old", withHeader)
+			eTxnID, err := syncerE.SendOnce(ctx, envE)
+			require.NoError(t, err)
+
+			exp := make(map[string]string)
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key-%03d", i)
+				exp[key] = strings.Repeat("x", 500)
+				setKey(t, envA, key, exp[key], withHeader)
+			}
+			_, err = syncerA.SendOnce(ctx, envA)
+			require.NoError(t, err)
+
+			list := listInstanceSnapshots(st, "a")
+			require.Len(t, list, 1)
+			data, err := st.Load(ctx, list[0].Name)
+			require.NoError(t, err)
+			ni, err := snapshot.ParseName(list[0].Name)
+			require.NoError(t, err)
+
+			// Loaded in multiple transactions
+			merged := metricSnapshotsMerged.WithLabelValues(syncerB.name, "a")
+			nMerged := testutil.ToFloat64(merged)
+			txnID, localChanged, err := syncerB.LoadOnce(ctx, envB, "a", snapshot.Update{
+				Data:     data,
+				NameInfo: ni,
+			}, 0)
+			require.NoError(t, err)
+			assert.False(t, localChanged)
+			assert.Greater(t, int(txnID), 4)
+			kv, err := dumpData(envB, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, exp, kv)
+
+			// Metrics for monitoring sync lag
+			assert.Equal(t, nMerged+1, testutil.ToFloat64(merged))
+			assert.Equal(t, float64(ni.Timestamp.UnixNano())/1e9, testutil.ToFloat64(
+				metricSnapshotsMergedLastSnapshotTimestamp.WithLabelValues(syncerB.name, "a")))
+
+			// Corrupt snapshots are reported as such
+			_, _, err = syncerB.LoadOnce(ctx, envB, "a", snapshot.Update{
+				Data:     data[:len(data)/2],
+				NameInfo: ni,
+			}, txnID)
+			assert.ErrorIs(t, err, snapshot.ErrCorrupt)
+
+			// Limited by the number of entries, which splits DBI messages
+			syncerC, envC := createInstance(t, "c", st, withHeader)
+			syncerC.c.LMDBLoadBatchSize = 0
+			syncerC.c.LMDBLoadBatchEntries = 7
+			txnID, _, err = syncerC.LoadOnce(ctx, envC, "a", snapshot.Update{
+				Data:     data,
+				NameInfo: ni,
+			}, 0)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, int(txnID), 100/7)
+			kv, err = dumpData(envC, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, exp, kv)
+
+			// Staged on disk when larger than the threshold
+			syncerD, envD := createInstance(t, "d", st, withHeader)
+			syncerD.c.MemoryStagingThreshold = 1
+			syncerD.c.MemorySpillDir = t.TempDir()
+			staged := metricSnapshotsStaged.WithLabelValues(syncerD.name)
+			nStaged := testutil.ToFloat64(staged)
+			_, _, err = syncerD.LoadOnce(ctx, envD, "a", snapshot.Update{
+				Data:     data,
+				NameInfo: ni,
+			}, 0)
+			require.NoError(t, err)
+			assert.Equal(t, nStaged+1, testutil.ToFloat64(staged))
+			kv, err = dumpData(envD, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, exp, kv)
+
+			// Local changes between batches do not undo the remote entries
+			// merged by the earlier batches
+			syncerE.c.LMDBLoadBatchSize = 0
+			syncerE.c.LMDBLoadBatchEntries = 7
+			expE := make(map[string]string)
+			for k, v := range exp {
+				expE[k] = v
+			}
+			syncerE.loadBatchDone = func() {
+				key := fmt.Sprintf("local-%d", len(expE)-len(exp))
+				expE[key] = "local"
+				setKey(t, envE, key, "local", withHeader)
+			}
+			_, localChanged, err = syncerE.LoadOnce(ctx, envE, "a", snapshot.Update{
+				Data:     data,
+				NameInfo: ni,
+			}, eTxnID)
+			require.NoError(t, err)
+			assert.True(t, localChanged)
+			assert.Greater(t, len(expE)-len(exp), 10)
+			kv, err = dumpData(envE, withHeader)
+			require.NoError(t, err)
+			assert.Equal(t, expE, kv)
+		})
+	}
+}
+
 func createInstance(t *testing.T, name string, st simpleblob.Interface, timestamped bool) (*Syncer, *lmdb.Env) {
 	env, tmp, err := createLMDB(t)
 	require.NoError(t, err)
@@ -352,3 +473,347 @@ func createLMDB(t *testing.T) (env *lmdb.Env, tmpdir string, err error) {
 
 	return env, tmpdir, nil
 }
+
+func TestSyncer_conflictResolution(t *testing.T) {
+	ts1 := testTS(1)
+	ts2 := testTS(2)
+
+	lc := config.LMDB{
+		DBIOptions: map[string]config.DBIOptions{
+			"foo": {ConflictResolution: config.ConflictResolution{
+				Strategy:        "prefer_instance",
+				PreferInstances: []string{"primary"},
+			}},
+		},
+	}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		s, err := New("test", env, nil, config.Config{}, lc, Options{})
+		require.NoError(t, err)
+
+		return env.Update(func(txn *lmdb.Txn) error {
+			ctx := context.Background()
+			dbi, err := txn.OpenDBI("foo", lmdb.Create)
+			require.NoError(t, err)
+			require.NoError(t, txn.Put(dbi, b("a"), b("local"), 0))
+			require.NoError(t, txn.Put(dbi, b("b"), b("local"), 0))
+			require.NoError(t, s.mainToShadow(ctx, txn, ts2))
+
+			remote := func(val string) *snapshot.DBI {
+				d := snapshot.NewDBI()
+				d.SetName("foo")
+				d.Append(snapshot.KV{Key: b("a"), Value: b(val), TimestampNano: uint64(ts1)})
+				return d
+			}
+			sr := &snapshot.StreamReader{FormatVersion: snapshot.CurrentFormatVersion}
+
+			// The older entry of another instance loses
+			require.NoError(t, s.loadDBI(txn, s.l, sr, remote("other"), "other"))
+			require.NoError(t, s.shadowToMain(ctx, txn))
+			val, err := txn.Get(dbi, b("a"))
+			require.NoError(t, err)
+			assert.Equal(t, "local", string(val))
+
+			// The older entry of the preferred instance wins
+			require.NoError(t, s.loadDBI(txn, s.l, sr, remote("primary"), "primary"))
+			require.NoError(t, s.shadowToMain(ctx, txn))
+			val, err = txn.Get(dbi, b("a"))
+			require.NoError(t, err)
+			assert.Equal(t, "primary", string(val))
+			val, err = txn.Get(dbi, b("b"))
+			require.NoError(t, err)
+			assert.Equal(t, "local", string(val))
+
+			stats := s.MergeStats()
+			require.Len(t, stats, 1)
+			assert.Equal(t, int64(1), stats[0].LocalWon)
+			assert.Equal(t, int64(1), stats[0].RemoteWon)
+			assert.Equal(t, int64(1), stats[0].Updated)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+
+	// Invalid configurations are rejected
+	lc.DBIOptions["foo"] = config.DBIOptions{ConflictResolution: config.ConflictResolution{
+		Strategy: "unknown",
+	}}
+	err = lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		_, err := New("test", env, nil, config.Config{}, lc, Options{})
+		return err
+	})
+	assert.ErrorContains(t, err, "dbi_options.foo.conflict_resolution")
+}
+
+func TestSyncer_sendOnly(t *testing.T) {
+	st := memory.New()
+
+	envA, tmpA, err := createLMDB(t)
+	require.NoError(t, err)
+	c := createConfig("a", tmpA, false)
+	syncerA, err := New(testLMDBName, envA, st, c, c.LMDBs[testLMDBName], Options{SendOnly: true})
+	require.NoError(t, err)
+	syncerB, envB := createInstance(t, "b", st, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Changes in A are sent to B
+	setKey(t, envA, "foo", "v1", false)
+	goRunSync(ctx, syncerA)
+	requireSnapshotsLenWait(t, st, 1, "A")
+	goRunSync(ctx, syncerB)
+	assertKeyWait(t, envB, "foo", "v1", false)
+
+	// Changes in B are never loaded into A
+	setKey(t, envB, "foo", "v2", false)
+	requireSnapshotsLenWait(t, st, 1, "B")
+	time.Sleep(10 * tick)
+	data, err := dumpData(envA, false)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", data["foo"])
+
+	// Cannot be combined with receive-only
+	_, err = New(testLMDBName, envA, st, c, c.LMDBs[testLMDBName], Options{SendOnly: true, ReceiveOnly: true})
+	assert.Error(t, err)
+}
+
+func TestSyncer_postApplyCommand(t *testing.T) {
+	st := memory.New()
+	out := filepath.Join(t.TempDir(), "env")
+
+	syncerA, envA := createInstance(t, "a", st, false)
+	envB, tmpB, err := createLMDB(t)
+	require.NoError(t, err)
+	c := createConfig("b", tmpB, false)
+	lc := c.LMDBs[testLMDBName]
+	lc.PostApplyCommand = []string{"sh", "-c", "env | grep ^LIGHTNINGSTREAM_ | sort > " + out}
+	syncerB, err := New(testLMDBName, envB, st, c, lc, Options{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	setKey(t, envA, "foo", "v1", false)
+	goRunSync(ctx, syncerA)
+	requireSnapshotsLenWait(t, st, 1, "A")
+	goRunSync(ctx, syncerB)
+	assertKeyWait(t, envB, "foo", "v1", false)
+
+	var data []byte
+	for i := 0; i < 50; i++ {
+		data, err = os.ReadFile(out)
+		if err == nil && len(data) > 0 {
+			break
+		}
+		time.Sleep(tick)
+	}
+	require.NoError(t, err)
+	env := string(data)
+	assert.Contains(t, env, "LIGHTNINGSTREAM_LMDB="+testLMDBName+"\n")
+	assert.Contains(t, env, "LIGHTNINGSTREAM_LMDB_PATH="+tmpB+"\n")
+	assert.Contains(t, env, "LIGHTNINGSTREAM_SNAPSHOT_INSTANCE=a\n")
+	assert.Contains(t, env, "LIGHTNINGSTREAM_CHANGED_DBIS="+testDBIName+"\n")
+	assert.Contains(t, env, "LIGHTNINGSTREAM_DBI_ENTRIES="+testDBIName+"=1\n")
+	assert.Contains(t, env, "LIGHTNINGSTREAM_TOTAL_ENTRIES=1\n")
+	assert.Contains(t, env, "LIGHTNINGSTREAM_SNAPSHOT_NAME="+testLMDBName+"__a__")
+}
+
+func TestSyncer_flushOnShutdown(t *testing.T) {
+	st := memory.New()
+	env, tmp, err := createLMDB(t)
+	require.NoError(t, err)
+	c := createConfig("a", tmp, false)
+	c.LMDBPollInterval = time.Hour // only the shutdown can write the second snapshot
+	c.ShutdownTimeout = 5 * time.Second
+	s, err := New(testLMDBName, env, st, c, c.LMDBs[testLMDBName], Options{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	setKey(t, env, "foo", "v1", false)
+	done := make(chan error)
+	go func() {
+		done <- s.Sync(ctx)
+	}()
+	requireSnapshotsLenWait(t, st, 1, "a")
+
+	// Changed after the last snapshot, written on shutdown
+	setKey(t, env, "foo", "v2", false)
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	requireSnapshotsLenWait(t, st, 2, "a")
+
+	// Loaded into another instance
+	syncerB, envB := createInstance(t, "b", st, false)
+	ctxB, cancelB := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelB()
+	goRunSync(ctxB, syncerB)
+	assertKeyWait(t, envB, "foo", "v2", false)
+}
+
+func TestSyncer_keyOrderFlags(t *testing.T) {
+	const dbiName = "ordered"
+	keys := []string{"ab", "ba", "ca", "b"}
+	for _, withHeader := range []bool{true, false} {
+		t.Run(fmt.Sprintf("withHeader=%v", withHeader), func(t *testing.T) {
+			ctx := context.Background()
+			st := memory.New()
+			syncerA, envA := createInstance(t, "a", st, withHeader)
+			syncerB, envB := createInstance(t, "b", st, withHeader)
+
+			err := envA.Update(func(txn *lmdb.Txn) error {
+				dbi, err := txn.OpenDBI(dbiName, lmdb.Create|lmdb.ReverseKey)
+				require.NoError(t, err)
+				for _, key := range keys {
+					val := []byte("v-" + key)
+					if withHeader {
+						var h [header.MinHeaderSize]byte
+						header.PutBasic(h[:], header.TimestampFromTime(time.Now()),
+							header.TxnID(txn.ID()), header.NoFlags)
+						val = append(h[:], val...)
+					}
+					require.NoError(t, txn.Put(dbi, []byte(key), val, 0))
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			_, err = syncerA.SendOnce(ctx, envA)
+			require.NoError(t, err)
+
+			list := listInstanceSnapshots(st, "a")
+			require.Len(t, list, 1)
+			data, err := st.Load(ctx, list[0].Name)
+			require.NoError(t, err)
+			ni, err := snapshot.ParseName(list[0].Name)
+			require.NoError(t, err)
+			_, _, err = syncerB.LoadOnce(ctx, envB, "a", snapshot.Update{
+				Data:     data,
+				NameInfo: ni,
+			}, 0)
+			require.NoError(t, err)
+
+			// The DBI is created with the same flags and contents
+			err = envB.View(func(txn *lmdb.Txn) error {
+				dbi, err := txn.OpenDBI(dbiName, 0)
+				require.NoError(t, err)
+				flags, err := txn.Flags(dbi)
+				require.NoError(t, err)
+				assert.Equal(t, uint(lmdb.ReverseKey), flags)
+				kvs, err := lmdbenv.ReadDBIString(txn, dbi)
+				require.NoError(t, err)
+				require.Len(t, kvs, len(keys))
+				for _, kv := range kvs {
+					val := kv.Val
+					if withHeader {
+						val = val[header.MinHeaderSize:]
+					}
+					assert.Equal(t, "v-"+kv.Key, val)
+				}
+				return nil
+			})
+			require.NoError(t, err)
+
+			// A local DBI with a different key order is not merged into
+			err = envB.Update(func(txn *lmdb.Txn) error {
+				dbi, err := txn.OpenDBI(dbiName, 0)
+				require.NoError(t, err)
+				require.NoError(t, txn.Drop(dbi, true))
+				if !withHeader {
+					shadowDBIName, err := syncerB.shadowDBIName(dbiName)
+					require.NoError(t, err)
+					dbi, err := txn.OpenDBI(shadowDBIName, 0)
+					require.NoError(t, err)
+					require.NoError(t, txn.Drop(dbi, true))
+					_, err = txn.OpenDBI(shadowDBIName, lmdb.Create)
+					require.NoError(t, err)
+				}
+				_, err = txn.OpenDBI(dbiName, lmdb.Create)
+				return err
+			})
+			require.NoError(t, err)
+			_, _, err = syncerB.LoadOnce(ctx, envB, "a", snapshot.Update{
+				Data:     data,
+				NameInfo: ni,
+			}, 0)
+			assert.ErrorContains(t, err, "key order flags")
+		})
+	}
+}
+
+// countingBackend counts the full and ranged loads
+type countingBackend struct {
+	*fs.Backend
+	loads       atomic.Int32
+	rangedLoads atomic.Int32
+}
+
+func (b *countingBackend) Load(ctx context.Context, name string) ([]byte, error) {
+	b.loads.Inc()
+	return b.Backend.Load(ctx, name)
+}
+
+func (b *countingBackend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	b.rangedLoads.Inc()
+	return b.Backend.LoadRange(ctx, name, offset, length)
+}
+
+func TestSyncer_partialDownloads(t *testing.T) {
+	fsb, err := fs.New(fs.Options{RootPath: t.TempDir()})
+	require.NoError(t, err)
+	st := &countingBackend{Backend: fsb}
+
+	envA, tmpA, err := createLMDB(t)
+	require.NoError(t, err)
+	c := createConfig("a", tmpA, false)
+	c.Storage.Compression.Framed = true
+	syncerA, err := New(testLMDBName, envA, st, c, c.LMDBs[testLMDBName], Options{SendOnly: true})
+	require.NoError(t, err)
+
+	envB, tmpB, err := createLMDB(t)
+	require.NoError(t, err)
+	c = createConfig("b", tmpB, false)
+	c.StoragePartialDownloads = true
+	c.StorageVerifyChecksums = true
+	syncerB, err := New(testLMDBName, envB, st, c, c.LMDBs[testLMDBName], Options{ReceiveOnly: true})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A second DBI that does not change
+	err = envA.Update(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenDBI("unchanged", lmdb.Create)
+		if err != nil {
+			return err
+		}
+		return txn.Put(dbi, []byte("bar"), []byte("baz"), 0)
+	})
+	require.NoError(t, err)
+	setKey(t, envA, "foo", "v1", false)
+	goRunSync(ctx, syncerA)
+	goRunSync(ctx, syncerB)
+	assertKeyWait(t, envB, "foo", "v1", false)
+	loads := st.loads.Load()
+
+	// Only the changed DBI is downloaded
+	setKey(t, envA, "foo", "v2", false)
+	assertKeyWait(t, envB, "foo", "v2", false)
+	assert.Equal(t, loads, st.loads.Load(), "no full download")
+	assert.Greater(t, st.rangedLoads.Load(), int32(0))
+	err = envB.View(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenDBI("unchanged", 0)
+		if err != nil {
+			return err
+		}
+		val, err := txn.Get(dbi, []byte("bar"))
+		assert.Equal(t, "baz", string(val))
+		return err
+	})
+	require.NoError(t, err)
+}
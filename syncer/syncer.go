@@ -2,21 +2,46 @@ package syncer
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/PowerDNS/lmdb-go/lmdb"
 	"github.com/PowerDNS/simpleblob"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 	"powerdns.com/platform/lightningstream/syncer/cleaner"
+	"powerdns.com/platform/lightningstream/syncer/conflict"
+	"powerdns.com/platform/lightningstream/syncer/lease"
+	"powerdns.com/platform/lightningstream/syncer/pdns"
+	"powerdns.com/platform/lightningstream/syncer/receiver"
+	"powerdns.com/platform/lightningstream/syncer/redact"
+	"powerdns.com/platform/lightningstream/syncer/schema"
 
 	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/status"
 	"powerdns.com/platform/lightningstream/status/healthtracker"
 	"powerdns.com/platform/lightningstream/status/starttracker"
+	"powerdns.com/platform/lightningstream/status/systemd"
 )
 
 func New(name string, env *lmdb.Env, st simpleblob.Interface, c config.Config, lc config.LMDB, opt Options) (*Syncer, error) {
 	l := logrus.WithField("db", name)
 
+	if opt.VerifyOnly {
+		opt.DryRun = true
+		opt.ReceiveOnly = true
+		opt.SendOnly = false
+	}
+	if opt.ReceiveOnly && opt.SendOnly {
+		return nil, fmt.Errorf("receive-only and send-only mode cannot be combined")
+	}
+	if opt.DryRun {
+		// A dry run never modifies anything, so a single pass is all it can do
+		c.OnlyOnce = true
+	}
+
 	// Start cleaner, but make sure it is disabled if we run in receive-only mode
 	var cleanupConf config.Cleanup
 	if opt.ReceiveOnly {
@@ -28,6 +53,49 @@ func New(name string, env *lmdb.Env, st simpleblob.Interface, c config.Config, l
 	}
 	cl := cleaner.New(name, st, cleanupConf, l)
 
+	dict, err := c.Storage.Compression.LoadDictionary()
+	if err != nil {
+		return nil, err
+	}
+	compression := snapshot.Compression{
+		Type:       c.Storage.Compression.Type,
+		Level:      c.Storage.Compression.Level,
+		Dictionary: dict,
+		Framed:     c.Storage.Compression.Framed,
+	}
+	if err := compression.Check(); err != nil {
+		return nil, fmt.Errorf("storage.compression: %w", err)
+	}
+
+	signer, err := c.Storage.Signing.LoadSigner()
+	if err != nil {
+		return nil, fmt.Errorf("storage.signing: %w", err)
+	}
+	verifier, err := c.Storage.Signing.LoadVerifier()
+	if err != nil {
+		return nil, fmt.Errorf("storage.signing: %w", err)
+	}
+
+	resolvers := make(map[string]conflict.Resolver)
+	for dbiName, dbiOpt := range lc.DBIOptions {
+		r, err := conflict.New(dbiOpt.ConflictResolution)
+		if err != nil {
+			return nil, fmt.Errorf("dbi_options.%s.conflict_resolution: %w", dbiName, err)
+		}
+		if r != nil {
+			resolvers[dbiName] = r
+		}
+	}
+
+	hooks, err := loadHooks(lc)
+	if err != nil {
+		return nil, err
+	}
+	redactors, err := loadRedactors(lc)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Syncer{
 		name:               name,
 		st:                 st,
@@ -38,20 +106,54 @@ func New(name string, env *lmdb.Env, st simpleblob.Interface, c config.Config, l
 		generation:         0,
 		env:                env,
 		lastByInstance:     make(map[string]time.Time),
+		loadedBy:           make(map[string]map[string]time.Time),
+		compression:        compression,
+		signer:             signer,
+		verifier:           verifier,
 		cleaner:            cl,
+		resolvers:          resolvers,
+		hooks:              hooks,
+		redactors:          redactors,
 		storageStoreHealth: healthtracker.New(c.Health.StorageStore, fmt.Sprintf("%s_storage_store", name), "write to storage backend"),
 		startTracker:       starttracker.New(c.Health.Start, name),
+		started:            time.Now(),
+		wake:               make(chan struct{}, 1),
 	}
+	s.lmdbPollInterval.Store(c.LMDBPollInterval)
+	s.forceSnapshotInterval.Store(c.StorageForceSnapshotInterval)
+	s.storagePollInterval = c.StoragePollInterval
 	if s.instanceID() == "" {
 		return nil, fmt.Errorf("instance name could not be determined, please provide one with --instance")
 	}
-	s.l = l.WithField("instance", s.instanceID())
+	s.l = l.WithFields(logrus.Fields{
+		"instance":   s.instanceID(),
+		"generation": s.generationID(),
+	})
+	if c.Storage.LeaderElection.Enabled && !opt.ReceiveOnly {
+		s.leader = lease.New(st, lease.Name(name), s.instanceID(), c.Storage.LeaderElection, s.l)
+		cl.SetLeader(s.leader.Held)
+	}
+	if c.Storage.InstanceLease.Enabled && !opt.ReceiveOnly && !opt.DryRun {
+		owner := hostname + "/" + s.generationID()
+		s.instanceLease = lease.NewInstance(st, name, s.instanceID(), owner, c.Storage.InstanceLease, s.l)
+	}
+	s.clock = &hybridClock{conf: c.HybridClock, name: name, l: s.l}
 	if !lc.SchemaTracksChanges {
 		s.l.Info("This LMDB has schema_tracks_changes disabled and will use " +
 			"shadow databases for version tracking.")
 	} else {
 		s.l.Info("schema_tracks_changes enabled")
 	}
+	if opt.ReceiveOnly {
+		s.l.Info("Running in receive-only mode, no snapshots will be written")
+	}
+	if opt.SendOnly {
+		s.l.Info("Running in send-only mode, no remote snapshots will be loaded")
+	}
+	s.registerSnapshotAgeCheck()
+	s.registerPauseCheck()
+	s.lastCycle.Store(time.Now())
+	systemd.Register(name, s.lastCycle.Load)
 	s.l.Info("Initialised syncer")
 	return s, nil
 }
@@ -65,16 +167,183 @@ type Syncer struct {
 	l          logrus.FieldLogger
 	shadow     bool // use shadow database for timestamps?
 	generation uint64
-	env        *lmdb.Env
 
 	// lastByInstance tracks the last snapshot loaded by instance, so that the
 	// cleaner can make safe decisions about when to remove stale snapshots.
 	lastByInstance map[string]time.Time
 
+	// loadedBy tracks by instance the snapshots of the other instances that
+	// were included in the last snapshot loaded from it, for the tombstone GC.
+	loadedBy map[string]map[string]time.Time
+
+	// newestApplied is the timestamp of the newest remote snapshot applied,
+	// for the snapshot age health check.
+	newestApplied atomic.Time
+
+	// lastStored is the time of the last snapshot we stored, and started is
+	// the time the syncer was created, both for the heartbeat.
+	lastStored atomic.Time
+	started    time.Time
+
+	// lastStoredSum is the DataSHA256 of the last snapshot stored, and
+	// lastStoredBase the time of its base if it was a delta, to skip
+	// unchanged snapshots. Only used by the sync loop.
+	lastStoredSum  []byte
+	lastStoredBase time.Time
+
+	// compression is used for the snapshots we write
+	compression snapshot.Compression
+
+	// signer signs the snapshots we write and verifier checks the signatures
+	// of the snapshots we load, if configured
+	signer   *snapshot.Signer
+	verifier *snapshot.Verifier
+
+	// delta tracks the full snapshot that delta snapshots are based on
+	delta deltaState
+
 	// cleaner cleans old snapshots in the background
 	cleaner *cleaner.Worker
 
+	// leader is the leader election lease, if enabled
+	leader *lease.Lease
+
+	// instanceLease is the lease on the instance name, if enabled
+	instanceLease *lease.Lease
+
+	// The settings that can be changed with Reload while running
+	lmdbPollInterval      atomic.Duration
+	forceSnapshotInterval atomic.Duration
+
+	// Runtime control through the admin API, see control.go. The wake channel
+	// interrupts the sleep between sync loop iterations.
+	pausedSend    atomic.Bool
+	pausedReceive atomic.Bool
+	forceFull     atomic.Bool
+	wake          chan struct{}
+
+	// syncedTxnID is the last local transaction that is included in a stored
+	// snapshot or that needs none, for Flush
+	syncedTxnID atomic.Uint64
+
+	// changesSince is the last local transaction whose changes were
+	// published to the change feed or need not be. Only accessed by the
+	// sync goroutine.
+	changesSince header.TxnID
+
+	// flushTxnID is the highest local transaction Flush waits for, which is
+	// stored right away even if the snapshot_trigger is not due yet
+	flushTxnID atomic.Uint64
+
+	// bulkLoading is set during the initial bulk load of an empty LMDB
+	bulkLoading atomic.Bool
+
+	// durabilitySet are the durability env flags set by setDurability, which
+	// are the only ones it removes again. Only accessed by the sync goroutine.
+	durabilitySet uint
+
+	// lastCycle is the time the last sync cycle completed, for the systemd
+	// watchdog
+	lastCycle atomic.Time
+
+	// mu protects env, which is replaced by Sync after an auto compaction,
+	// receiver, which is set by Sync, and storagePollInterval
+	mu                  sync.Mutex
+	env                 *lmdb.Env
+	receiver            *receiver.Receiver
+	storagePollInterval time.Duration
+
+	// purgedBefore is the cutoff of the last tombstone purge, as persisted in
+	// the SyncDBITombstones DBI
+	purgedBefore header.Timestamp
+
+	// loadEntries and loadConflicts count the entries merged and the
+	// conflicts per DBI during a LoadOnce
+	loadEntries   map[string]int
+	loadConflicts map[string]int
+
+	// loadZones collects the PowerDNS zones changed during a LoadOnce, if
+	// their caches are flushed
+	loadZones *pdns.Zones
+
+	// verifyKeys are the keys per DBI that merging the remote snapshots
+	// would change, in verify-only mode
+	verifyKeys map[string]map[string]*verifyEntry
+
+	// loadFilter is the PowerDNS zone filter used during a LoadOnce, created
+	// when the first DBI of the schema is merged
+	loadFilter *zoneFilter
+
+	// staged are the runs of entries in the SyncDBIStaging DBI during a
+	// staged LoadOnce, and stagedSeq is the key of the last entry
+	staged    []stagedDBI
+	stagedSeq uint64
+
+	// loadBatchDone is called between the transactions of a LoadOnce that
+	// is applied in batches, for tests
+	loadBatchDone func()
+
+	// convergence tracks the DBIs with different data on other instances
+	convergence convergenceState
+
+	// statsMu protects mergeStats, the totals of the changes and conflicts
+	// per DBI caused by merging remote snapshots
+	statsMu    sync.Mutex
+	mergeStats map[string]*status.MergeStats
+
+	// clock generates the timestamps for local changes
+	clock *hybridClock
+
+	// resolvers are the conflict resolvers configured per DBI
+	resolvers map[string]conflict.Resolver
+
+	// hooks are the value transformation hooks configured per DBI
+	hooks map[string]schema.Hook
+
+	// redactors redact the values of sensitive entries in snapshots per DBI
+	redactors map[string]*redact.Redactor
+
 	// Health trackers
 	storageStoreHealth *healthtracker.HealthTracker
 	startTracker       *starttracker.StartTracker
 }
+
+// Reload applies the settings of a reloaded configuration that can be changed
+// while running: the lmdb_poll_interval, storage_poll_interval,
+// storage_force_snapshot_interval and storage.cleanup. All other settings
+// only take effect after a restart.
+func (s *Syncer) Reload(c config.Config) {
+	s.lmdbPollInterval.Store(c.LMDBPollInterval)
+	s.forceSnapshotInterval.Store(c.StorageForceSnapshotInterval)
+	s.mu.Lock()
+	s.storagePollInterval = c.StoragePollInterval
+	if s.receiver != nil {
+		s.receiver.SetPollInterval(c.StoragePollInterval)
+	}
+	s.mu.Unlock()
+	if !s.opt.ReceiveOnly {
+		s.cleaner.SetConfig(c.Storage.Cleanup)
+	}
+	s.l.Info("Reloaded configuration")
+}
+
+// Env returns the LMDB env that is being synced. This is the env passed to
+// New, unless Sync reopened it after an auto compaction. The caller must close
+// the current env after Sync has returned.
+func (s *Syncer) Env() *lmdb.Env {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.env
+}
+
+// isLeader returns true if this instance should run the cluster-wide tasks,
+// which is always the case if leader election is disabled.
+func (s *Syncer) isLeader() bool {
+	return s.leader == nil || s.leader.Held()
+}
+
+// CaughtUp returns a channel that is closed once the syncer has loaded all
+// remote snapshots that existed at startup.
+func (s *Syncer) CaughtUp() <-chan struct{} {
+	return s.startTracker.Done()
+}
@@ -0,0 +1,80 @@
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// syncState is the value stored in the SyncDBIState DBI for an instance.
+// It is written in the same transaction as the last part of the snapshot, so
+// the LMDB always contains the data of the snapshot it names.
+type syncState struct {
+	Snapshot string    `json:"snapshot"` // name of the last snapshot applied
+	Applied  time.Time `json:"applied"`  // time it was applied
+}
+
+// writeSyncState records the snapshot as the last one applied from instance
+func writeSyncState(txn *lmdb.Txn, instance string, ni snapshot.NameInfo, now time.Time) error {
+	dbi, err := txn.OpenDBI(SyncDBIState, lmdb.Create)
+	if err != nil {
+		return fmt.Errorf("sync state: %w", err)
+	}
+	val, err := json.Marshal(syncState{
+		Snapshot: ni.FullName,
+		Applied:  now.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := txn.Put(dbi, []byte(instance), val, 0); err != nil {
+		return fmt.Errorf("sync state: %w", err)
+	}
+	return nil
+}
+
+// readSyncState returns the last snapshots applied by instance. Invalid
+// entries are ignored, these will just cause the snapshots to be loaded again.
+func (s *Syncer) readSyncState(env *lmdb.Env) (map[string]snapshot.NameInfo, error) {
+	applied := make(map[string]snapshot.NameInfo)
+	err := env.View(func(txn *lmdb.Txn) error {
+		exists, err := lmdbenv.DBIExists(txn, SyncDBIState)
+		if err != nil || !exists {
+			return err
+		}
+		dbi, err := txn.OpenDBI(SyncDBIState, 0)
+		if err != nil {
+			return err
+		}
+		kvs, err := lmdbenv.ReadDBI(txn, dbi)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			instance := string(kv.Key)
+			var st syncState
+			if err := json.Unmarshal(kv.Val, &st); err != nil {
+				s.l.WithError(err).WithField("snapshot_instance", instance).
+					Warn("Ignoring invalid sync state")
+				continue
+			}
+			ni, err := snapshot.ParseName(st.Snapshot)
+			if err != nil || ni.InstanceID != instance || ni.SyncerName != s.name {
+				s.l.WithField("snapshot_instance", instance).
+					WithField("snapshot_name", st.Snapshot).
+					Warn("Ignoring invalid sync state")
+				continue
+			}
+			applied[instance] = ni
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sync state: %w", err)
+	}
+	return applied, nil
+}
@@ -0,0 +1,54 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_persistSyncState(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		st := memory.New()
+		syncerA, envA := createInstance(t, "a", st, withHeader)
+		syncerB, envB := createInstance(t, "b", st, withHeader)
+		syncerB.c.LMDBPersistSyncState = true
+		syncerB.c.OnlyOnce = true
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		setKey(t, envA, "foo", "v1", withHeader)
+		_, err := syncerA.SendOnce(ctx, envA)
+		require.NoError(t, err)
+		list := listInstanceSnapshots(st, "a")
+		require.Len(t, list, 1)
+
+		merged := metricSnapshotsMerged.WithLabelValues(syncerB.name, "a")
+		nMerged := testutil.ToFloat64(merged)
+		require.NoError(t, syncerB.Sync(ctx))
+		assertKeyWait(t, envB, "foo", "v1", withHeader)
+		assert.Equal(t, nMerged+1, testutil.ToFloat64(merged))
+
+		applied, err := syncerB.readSyncState(envB)
+		require.NoError(t, err)
+		require.Contains(t, applied, "a")
+		assert.Equal(t, list[0].Name, applied["a"].FullName)
+
+		// Not loaded again after a restart
+		require.NoError(t, syncerB.Sync(ctx))
+		assert.Equal(t, nMerged+1, testutil.ToFloat64(merged))
+
+		// Newer snapshots are still loaded
+		setKey(t, envA, "foo", "v2", withHeader)
+		_, err = syncerA.SendOnce(ctx, envA)
+		require.NoError(t, err)
+		require.NoError(t, syncerB.Sync(ctx))
+		assertKeyWait(t, envB, "foo", "v2", withHeader)
+		assert.Equal(t, nMerged+2, testutil.ToFloat64(merged))
+	}
+}
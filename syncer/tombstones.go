@@ -0,0 +1,262 @@
+package syncer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/sirupsen/logrus"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+// tombstoneCutoff returns the time before which deleted entries can be purged,
+// or false if no tombstones can be purged yet.
+// Tombstones must be kept until every other instance has merged them,
+// otherwise an older snapshot of that instance that still contains the entry
+// would resurrect it. Every snapshot records the newest snapshot of each other
+// instance that it includes. A tombstone is in every snapshot of the instance
+// that deleted the entry from then on, so once the last snapshot we loaded
+// from an instance includes a snapshot of every other instance that is newer
+// than the tombstone, that instance has merged it.
+// The cutoff is the oldest of these snapshot times, and the configured
+// retention applies in addition.
+func (s *Syncer) tombstoneCutoff(now time.Time, seenInstances []string) (time.Time, bool) {
+	cutoff := now.Add(-s.c.TombstoneGC.Retention)
+	ownInstanceID := s.instanceID()
+	for _, instance := range seenInstances {
+		if instance == ownInstanceID {
+			continue
+		}
+		loaded, exists := s.loadedBy[instance]
+		if !exists {
+			return time.Time{}, false // not merged anything from this one yet
+		}
+		for _, other := range seenInstances {
+			if other == instance {
+				continue
+			}
+			last, ok := loaded[other]
+			if !ok {
+				return time.Time{}, false // it has not merged the other one yet
+			}
+			if last.Before(cutoff) {
+				cutoff = last
+			}
+		}
+	}
+	return cutoff, true
+}
+
+// loadedSnapshots returns the newest snapshot loaded from every other
+// instance, ordered by instance, for the snapshot Meta.
+func (s *Syncer) loadedSnapshots() []snapshot.LoadedSnapshot {
+	ownInstanceID := s.instanceID()
+	var res []snapshot.LoadedSnapshot
+	for instance, t := range s.lastByInstance {
+		if instance == ownInstanceID {
+			continue
+		}
+		res = append(res, snapshot.LoadedSnapshot{
+			InstanceID:    instance,
+			TimestampNano: uint64(t.UnixNano()),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].InstanceID < res[j].InstanceID
+	})
+	return res
+}
+
+// loadedByInstance converts the loaded snapshots of a snapshot Meta to
+// their times by instance
+func loadedByInstance(loaded []snapshot.LoadedSnapshot) map[string]time.Time {
+	res := make(map[string]time.Time, len(loaded))
+	for _, ls := range loaded {
+		res[ls.InstanceID] = time.Unix(0, int64(ls.TimestampNano))
+	}
+	return res
+}
+
+// purgedBeforeKey is the key of the purge cutoff in SyncDBITombstones
+var purgedBeforeKey = []byte("purged_before")
+
+// readPurgedBefore returns the cutoff of the last tombstone purge, or 0 if
+// tombstones were never purged.
+func readPurgedBefore(txn *lmdb.Txn) (header.Timestamp, error) {
+	exists, err := lmdbenv.DBIExists(txn, SyncDBITombstones)
+	if err != nil || !exists {
+		return 0, err
+	}
+	dbi, err := txn.OpenDBI(SyncDBITombstones, 0)
+	if err != nil {
+		return 0, err
+	}
+	val, err := txn.Get(dbi, purgedBeforeKey)
+	if lmdb.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("%s: invalid %s value", SyncDBITombstones, purgedBeforeKey)
+	}
+	return header.Timestamp(binary.BigEndian.Uint64(val)), nil
+}
+
+// writePurgedBefore records the cutoff of a tombstone purge, so that the
+// purged tombstones are not recreated from remote snapshots after a restart.
+// An older cutoff than the one recorded is ignored.
+func writePurgedBefore(txn *lmdb.Txn, cutoff header.Timestamp) error {
+	prev, err := readPurgedBefore(txn)
+	if err != nil || cutoff <= prev {
+		return err
+	}
+	dbi, err := txn.OpenDBI(SyncDBITombstones, lmdb.Create)
+	if err != nil {
+		return err
+	}
+	var val [8]byte
+	binary.BigEndian.PutUint64(val[:], uint64(cutoff))
+	return txn.Put(dbi, purgedBeforeKey, val[:], 0)
+}
+
+// purgeTombstones removes all deleted entries with a timestamp before the
+// cutoff from the DBIs that are included in snapshots. These are the shadow
+// DBIs, or the main DBIs when the schema tracks changes. The cutoff is
+// recorded in the SyncDBITombstones DBI.
+// It returns the number of entries removed.
+func (s *Syncer) purgeTombstones(txn *lmdb.Txn, cutoff header.Timestamp) (int, error) {
+	dbiNames, err := lmdbenv.ReadDBINames(txn)
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, dbiName := range dbiNames {
+		if strings.HasPrefix(dbiName, SyncDBIPrefix) || !s.lc.IsDBIIncluded(dbiName) {
+			continue
+		}
+		readDBIName := dbiName
+		if !s.lc.SchemaTracksChanges {
+			readDBIName, err = s.shadowDBIName(dbiName)
+			if err != nil {
+				return total, err
+			}
+			exists, err := lmdbenv.DBIExists(txn, readDBIName)
+			if err != nil {
+				return total, err
+			}
+			if !exists {
+				continue
+			}
+		}
+		n, err := s.purgeDBITombstones(txn, readDBIName, cutoff)
+		if err != nil {
+			return total, err
+		}
+		if n > 0 {
+			metricTombstonesPurged.WithLabelValues(s.name, dbiName).Add(float64(n))
+		}
+		total += n
+	}
+	if err := writePurgedBefore(txn, cutoff); err != nil {
+		return total, fmt.Errorf("%s: %w", SyncDBITombstones, err)
+	}
+	return total, nil
+}
+
+// PurgeTombstones removes all deleted entries with a timestamp before the
+// cutoff from an LMDB that is not being synced, like purgeTombstones. Unlike
+// the tombstone GC, it cannot check if every other instance has merged them,
+// so the caller is responsible for choosing a safe cutoff.
+// It returns the number of entries removed.
+func PurgeTombstones(txn *lmdb.Txn, name string, lc config.LMDB, cutoff time.Time) (int, error) {
+	s := &Syncer{name: name, lc: lc}
+	return s.purgeTombstones(txn, header.TimestampFromTime(cutoff))
+}
+
+// purgeDBITombstones removes the old deleted entries of a single DBI
+func (s *Syncer) purgeDBITombstones(txn *lmdb.Txn, dbiName string, cutoff header.Timestamp) (int, error) {
+	dbi, err := txn.OpenDBI(dbiName, 0)
+	if err != nil {
+		return 0, err
+	}
+	flags, err := txn.Flags(dbi)
+	if err != nil {
+		return 0, err
+	}
+	// In the native dupsort mode, the headers are stored in the DupSort values
+	// of the shadow DBI.
+	nativeDupSortShadow := !s.lc.SchemaTracksChanges && flags&lmdb.DupSort > 0
+
+	c, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	var n int
+	var op uint = lmdb.First
+	for {
+		_, val, err := c.Get(nil, nil, op)
+		if lmdb.IsNotFound(err) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		op = lmdb.Next
+
+		var h header.Header
+		if nativeDupSortShadow {
+			_, h, err = parseDupSortShadowValue(val)
+		} else {
+			h, _, err = header.Parse(val)
+		}
+		if err != nil {
+			return n, err
+		}
+		if !h.Flags.IsDeleted() || h.Timestamp >= cutoff {
+			continue
+		}
+		if err := c.Del(0); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// runTombstoneGC purges old tombstones if allowed
+func (s *Syncer) runTombstoneGC(env *lmdb.Env, seenInstances []string) error {
+	cutoff, ok := s.tombstoneCutoff(time.Now(), seenInstances)
+	if !ok {
+		s.l.Debug("Tombstone GC skipped, not all instances merged yet")
+		return nil
+	}
+	t0 := time.Now()
+	cutoffNano := header.TimestampFromTime(cutoff)
+	var n int
+	err := env.Update(func(txn *lmdb.Txn) error {
+		var err error
+		n, err = s.purgeTombstones(txn, cutoffNano)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if cutoffNano > s.purgedBefore {
+		s.purgedBefore = cutoffNano
+	}
+	s.l.WithFields(logrus.Fields{
+		"purged":     n,
+		"cutoff":     cutoff.UTC().Format(time.RFC3339),
+		"time_total": time.Since(t0).Round(time.Millisecond),
+	}).Info("Tombstone GC finished")
+	return nil
+}
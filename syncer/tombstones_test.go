@@ -0,0 +1,150 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/lmdbenv/header"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func TestSyncer_tombstoneCutoff(t *testing.T) {
+	now := time.Date(2022, 2, 10, 0, 0, 0, 0, time.UTC)
+	s := &Syncer{
+		c: config.Config{
+			Instance:    "self",
+			TombstoneGC: config.TombstoneGC{Retention: 24 * time.Hour},
+		},
+		loadedBy: map[string]map[string]time.Time{
+			"a": {"self": now.Add(-time.Hour), "b": now.Add(-2 * time.Hour)},
+			"b": {"self": now.Add(-48 * time.Hour), "a": now.Add(-time.Hour)},
+			"c": {"a": now},
+		},
+	}
+
+	cutoff, ok := s.tombstoneCutoff(now, []string{"self", "a"})
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(-24*time.Hour), cutoff)
+
+	// Limited by the oldest snapshot that another instance has merged, even
+	// if we loaded a recent snapshot from it
+	cutoff, ok = s.tombstoneCutoff(now, []string{"self", "a", "b"})
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(-48*time.Hour), cutoff)
+
+	// Nothing loaded yet from an instance
+	_, ok = s.tombstoneCutoff(now, []string{"self", "a", "d"})
+	assert.False(t, ok)
+
+	// An instance has not merged any snapshot of ours yet
+	_, ok = s.tombstoneCutoff(now, []string{"self", "a", "c"})
+	assert.False(t, ok)
+}
+
+func TestSyncer_tombstoneCutoff_loaded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st := memory.New()
+	syncerA, envA := createInstance(t, "a", st, true)
+	syncerB, envB := createInstance(t, "b", st, true)
+	syncerA.c.OnlyOnce = true
+	syncerB.c.OnlyOnce = true
+
+	setKey(t, envA, "foo", "v1", true)
+	_, err := syncerA.SendOnce(ctx, envA)
+	require.NoError(t, err)
+	list := listInstanceSnapshots(st, "a")
+	require.Len(t, list, 1)
+	ni, err := snapshot.ParseName(list[0].Name)
+	require.NoError(t, err)
+
+	// b merges the snapshot of a and includes it in its own snapshot
+	require.NoError(t, syncerB.Sync(ctx))
+	assertKeyWait(t, envB, "foo", "v1", true)
+	_, err = syncerB.SendOnce(ctx, envB)
+	require.NoError(t, err)
+
+	require.NoError(t, syncerA.Sync(ctx))
+	require.Contains(t, syncerA.loadedBy, "b")
+	assert.True(t, ni.Timestamp.Equal(syncerA.loadedBy["b"]["a"]))
+	cutoff, ok := syncerA.tombstoneCutoff(time.Now(), []string{"a", "b"})
+	assert.True(t, ok)
+	assert.True(t, ni.Timestamp.Equal(cutoff))
+}
+
+func TestSyncer_purgeTombstones(t *testing.T) {
+	for _, lc := range []config.LMDB{{DupSortHack: true}, {DupSortNative: true}} {
+		lc := lc
+		err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+			s, err := New("test", env, nil, config.Config{}, lc, Options{})
+			require.NoError(t, err)
+
+			return env.Update(func(txn *lmdb.Txn) error {
+				ctx := context.Background()
+				plain, err := txn.OpenDBI("plain", lmdb.Create)
+				require.NoError(t, err)
+				dup, err := txn.OpenDBI("dup", lmdb.Create|lmdb.DupSort)
+				require.NoError(t, err)
+				for _, k := range []string{"a", "b", "c"} {
+					require.NoError(t, txn.Put(plain, b(k), b("v"), 0))
+					require.NoError(t, txn.Put(dup, b("k"), b(k), 0))
+				}
+				require.NoError(t, s.mainToShadow(ctx, txn, testTS(1)))
+
+				// Delete one entry at ts 2 and one at ts 4
+				require.NoError(t, txn.Del(plain, b("a"), nil))
+				require.NoError(t, txn.Del(dup, b("k"), b("a")))
+				require.NoError(t, s.mainToShadow(ctx, txn, testTS(2)))
+				require.NoError(t, txn.Del(plain, b("b"), nil))
+				require.NoError(t, txn.Del(dup, b("k"), b("b")))
+				require.NoError(t, s.mainToShadow(ctx, txn, testTS(4)))
+
+				n, err := s.purgeTombstones(txn, testTS(3))
+				require.NoError(t, err)
+				assert.Equal(t, 2, n)
+
+				// The cutoff is persisted and never goes back
+				purgedBefore, err := readPurgedBefore(txn)
+				require.NoError(t, err)
+				assert.Equal(t, testTS(3), purgedBefore)
+				_, err = s.purgeTombstones(txn, testTS(1))
+				require.NoError(t, err)
+				purgedBefore, err = readPurgedBefore(txn)
+				require.NoError(t, err)
+				assert.Equal(t, testTS(3), purgedBefore)
+
+				for _, dbiName := range []string{"plain", "dup"} {
+					shadow, err := s.readDBI(txn, SyncDBIShadowPrefix+dbiName, dbiName, false, nil, nil, nil)
+					require.NoError(t, err)
+					kvs, err := shadow.AsInefficientKVList()
+					require.NoError(t, err)
+					assert.Len(t, kvs, 2, dbiName) // "b" deleted, "c"
+					for _, kv := range kvs {
+						assert.NotEqual(t, testTS(2), header.Timestamp(kv.TimestampNano))
+					}
+				}
+
+				// Purged tombstones in remote snapshots are not recreated
+				s.purgedBefore = testTS(3)
+				remote := snapshot.NewDBI()
+				remote.SetName("plain")
+				remote.Append(snapshot.KV{Key: b("a"), TimestampNano: uint64(testTS(2)), Flags: uint32(header.FlagDeleted)})
+				sr := &snapshot.StreamReader{FormatVersion: snapshot.CurrentFormatVersion}
+				require.NoError(t, s.loadDBI(txn, s.l, sr, remote, "remote"))
+				shadowDBI, err := txn.OpenDBI(SyncDBIShadowPrefix+"plain", 0)
+				require.NoError(t, err)
+				_, err = txn.Get(shadowDBI, b("a"))
+				assert.True(t, lmdb.IsNotFound(err))
+				return nil
+			})
+		})
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,30 @@
+package syncer
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the OpenTelemetry spans for the sync phases. Spans are
+// discarded unless tracing is enabled in the config.
+var tracer = otel.Tracer("powerdns.com/platform/lightningstream/syncer")
+
+// endSpan records any error and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// seconds returns a duration attribute in seconds. This is used for phases
+// that are interleaved with other phases and cannot have their own span,
+// like compression while DBIs are read.
+func seconds(key string, d time.Duration) attribute.KeyValue {
+	return attribute.Float64(key, d.Seconds())
+}
@@ -0,0 +1,87 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"powerdns.com/platform/lightningstream/config"
+	"powerdns.com/platform/lightningstream/lmdbenv"
+	"powerdns.com/platform/lightningstream/snapshot"
+)
+
+func TestSyncer_tracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(prev)
+
+	// spans returns the names of the ended spans and their parents
+	spans := func() map[string]string {
+		ended := rec.Ended()
+		names := make(map[[8]byte]string)
+		for _, s := range ended {
+			names[s.SpanContext().SpanID()] = s.Name()
+		}
+		res := make(map[string]string)
+		for _, s := range ended {
+			res[s.Name()] = names[s.Parent().SpanID()]
+		}
+		return res
+	}
+
+	ctx := context.Background()
+	st := memory.New()
+	c := config.Config{StorageRetryCount: 1}
+	err := lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		err := env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.OpenDBI("foo", lmdb.Create)
+			require.NoError(t, err)
+			return txn.Put(dbi, b("key"), b("val"), 0)
+		})
+		require.NoError(t, err)
+
+		s, err := New("test", env, st, c, config.LMDB{}, Options{})
+		require.NoError(t, err)
+		_, err = s.SendOnce(ctx, env)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"SendOnce":    "",
+			"copy_shadow": "SendOnce",
+			"dump":        "SendOnce",
+			"store":       "SendOnce",
+		}, spans())
+		return nil
+	})
+	require.NoError(t, err)
+
+	ls, err := st.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, ls, 1)
+	data, err := st.Load(ctx, ls[0].Name)
+	require.NoError(t, err)
+	ni, err := snapshot.ParseName(ls[0].Name)
+	require.NoError(t, err)
+
+	err = lmdbenv.TestEnv(func(env *lmdb.Env) error {
+		s, err := New("test", env, st, c, config.LMDB{}, Options{})
+		require.NoError(t, err)
+		_, _, err = s.LoadOnce(ctx, env, "other", snapshot.Update{
+			Data:     data,
+			NameInfo: ni,
+		}, 0)
+		require.NoError(t, err)
+		got := spans()
+		assert.Equal(t, "", got["LoadOnce"])
+		assert.Equal(t, "LoadOnce", got["load_batch"])
+		assert.Equal(t, "load_batch", got["shadow_to_main"])
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,48 @@
+package syncer
+
+import (
+	"time"
+
+	"powerdns.com/platform/lightningstream/config"
+)
+
+// Reasons for writing a snapshot of local changes, see snapshotTrigger
+const (
+	triggerChanges  = "changes"
+	triggerMaxDelay = "max_delay"
+)
+
+// snapshotTrigger decides when a snapshot of local changes is written, see
+// config.SnapshotTrigger.
+type snapshotTrigger struct {
+	c          config.SnapshotTrigger
+	dirtySince time.Time // when local changes not in a snapshot were first seen
+}
+
+// due returns true if a snapshot of the local changes must be written now,
+// with the reason. The changes are the number of LMDB write transactions
+// since the last snapshot, which was written at lastSnapshot.
+// If the trigger is disabled, a snapshot is always due.
+func (t *snapshotTrigger) due(now, lastSnapshot time.Time, changes uint64) (bool, string) {
+	if !t.c.Enabled {
+		return true, ""
+	}
+	if t.dirtySince.IsZero() {
+		t.dirtySince = now
+	}
+	if now.Sub(lastSnapshot) < t.c.MinInterval {
+		return false, ""
+	}
+	if t.c.Changes > 0 && changes >= t.c.Changes {
+		return true, triggerChanges
+	}
+	if now.Sub(t.dirtySince) >= t.c.MaxDelay {
+		return true, triggerMaxDelay
+	}
+	return false, ""
+}
+
+// stored records that all local changes were written to a snapshot
+func (t *snapshotTrigger) stored() {
+	t.dirtySince = time.Time{}
+}
@@ -0,0 +1,90 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PowerDNS/simpleblob/backends/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"powerdns.com/platform/lightningstream/config"
+)
+
+func TestSnapshotTrigger_due(t *testing.T) {
+	tr := snapshotTrigger{}
+	now := time.Now()
+	due, reason := tr.due(now, now, 1)
+	assert.True(t, due, "disabled")
+	assert.Equal(t, "", reason)
+
+	tr = snapshotTrigger{c: config.SnapshotTrigger{
+		Enabled:     true,
+		Changes:     10,
+		MaxDelay:    30 * time.Second,
+		MinInterval: 5 * time.Second,
+	}}
+	last := now.Add(-time.Minute)
+	due, _ = tr.due(now, last, 1)
+	assert.False(t, due)
+	due, reason = tr.due(now.Add(time.Second), last, 10)
+	assert.True(t, due)
+	assert.Equal(t, triggerChanges, reason)
+	due, reason = tr.due(now.Add(30*time.Second), last, 2)
+	assert.True(t, due)
+	assert.Equal(t, triggerMaxDelay, reason)
+
+	// The delay starts at the first change after a snapshot
+	tr.stored()
+	last = now.Add(30 * time.Second)
+	due, _ = tr.due(now.Add(40*time.Second), last, 1)
+	assert.False(t, due)
+	due, _ = tr.due(now.Add(69*time.Second), last, 1)
+	assert.False(t, due)
+	due, _ = tr.due(now.Add(70*time.Second), last, 1)
+	assert.True(t, due)
+
+	// Never more often than the min_interval
+	tr.stored()
+	due, _ = tr.due(last.Add(time.Second), last, 100)
+	assert.False(t, due)
+	due, _ = tr.due(last.Add(5*time.Second), last, 100)
+	assert.True(t, due)
+}
+
+func TestSyncer_snapshotTrigger(t *testing.T) {
+	st := memory.New()
+	env, tmp, err := createLMDB(t)
+	require.NoError(t, err)
+	c := createConfig("a", tmp, false)
+	c.LMDBPollInterval = 10 * time.Millisecond
+	c.SnapshotTrigger = config.SnapshotTrigger{
+		Enabled:  true,
+		Changes:  3,
+		MaxDelay: time.Hour,
+	}
+	s, err := New(testLMDBName, env, st, c, c.LMDBs[testLMDBName], Options{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	setKey(t, env, "foo", "v1", false)
+	setKey(t, env, "foo", "v2", false)
+	setKey(t, env, "foo", "v3", false)
+	goRunSync(ctx, s)
+	requireSnapshotsLenWait(t, st, 1, "a")
+
+	// Not enough changes for a snapshot
+	setKey(t, env, "foo", "v4", false)
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, listInstanceSnapshots(st, "a"), 1)
+	setKey(t, env, "foo", "v5", false)
+	setKey(t, env, "foo", "v6", false)
+	requireSnapshotsLenWait(t, st, 2, "a")
+
+	// Flush does not wait for the trigger
+	setKey(t, env, "foo", "v7", false)
+	require.NoError(t, s.Flush(ctx))
+	assert.Len(t, listInstanceSnapshots(st, "a"), 3)
+}
@@ -10,12 +10,15 @@ import (
 	"time"
 
 	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/PowerDNS/simpleblob"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"powerdns.com/platform/lightningstream/lmdbenv/dbiflags"
 	"powerdns.com/platform/lightningstream/lmdbenv/header"
 	"powerdns.com/platform/lightningstream/lmdbenv/stats"
 	"powerdns.com/platform/lightningstream/snapshot"
+	"powerdns.com/platform/lightningstream/syncer/redact"
+	"powerdns.com/platform/lightningstream/syncer/schema"
 	"powerdns.com/platform/lightningstream/utils"
 )
 
@@ -25,13 +28,25 @@ const (
 	SyncDBIPrefix = "_sync"
 	// SyncDBIShadowPrefix is the DBI name prefix of shadow databases.
 	SyncDBIShadowPrefix = "_sync_shadow_"
+	// SyncDBIState is the DBI with the last snapshot applied by instance.
+	SyncDBIState = "_sync_state"
+	// SyncDBITombstones is the DBI with the cutoff of the last tombstone purge.
+	SyncDBITombstones = "_sync_tombstones"
+	// SyncDBIStaging is the DBI with the entries of a staged load.
+	SyncDBIStaging = "_sync_staging"
 )
 
 const (
 	// AllowedShadowDBIFlagsMask is the set of LMDB DBI flags that we transfer
 	// to shadow DBIs.
-	// MDB_INTEGERKEY needs to be transferred for proper ordering of shadow DBIs.
-	AllowedShadowDBIFlagsMask = dbiflags.IntegerKey
+	// MDB_INTEGERKEY and MDB_REVERSEKEY need to be transferred for proper
+	// ordering of shadow DBIs. The flags for duplicates are not, because the
+	// values of DupSort shadow DBIs include the header.
+	AllowedShadowDBIFlagsMask = dbiflags.IntegerKey | dbiflags.ReverseKey
+
+	// keyOrderFlagsMask is the set of LMDB DBI flags that change the order
+	// of keys.
+	keyOrderFlagsMask = dbiflags.IntegerKey | dbiflags.ReverseKey
 )
 
 // ErrEntry is returned when an entry is invalid, for example due to a missing
@@ -69,12 +84,7 @@ var reUnsafe = regexp.MustCompile("[^a-zA-Z0-9-]")
 
 // instanceID returns a safe instance name
 func (s *Syncer) instanceID() string {
-	n := s.c.Instance
-	if n == "" {
-		n = hostname
-	}
-	n = reUnsafe.ReplaceAllString(n, "-")
-	return n
+	return SafeInstanceID(s.c.Instance)
 }
 
 // instanceID returns a safe instance name
@@ -88,19 +98,112 @@ func (s *Syncer) generationID() string {
 // not be extracted. This is useful when reading a database without headers.
 // The origDBIName is used to ensure that the flags stored are those of the original
 // DBI, not of the shadow DBI, and to set the name field of DBI.
-func (s *Syncer) readDBI(txn *lmdb.Txn, dbiName, origDBIName string, rawValues bool) (dbiMsg *snapshot.DBI, err error) {
+// If base is not nil, only entries changed since that base snapshot are
+// included, for a delta snapshot. This requires headers.
+// If changes is not nil, the local changes found are added to it.
+func (s *Syncer) readDBI(txn *lmdb.Txn, dbiName, origDBIName string, rawValues bool, base *deltaBase, changes *changeSet, filter *zoneFilter) (dbiMsg *snapshot.DBI, err error) {
+	var sizeHint float64
+	err = s.scanDBI(txn, dbiName, origDBIName, rawValues, base, changes, filter,
+		func(info dbiScanInfo) error {
+			sizeHint = info.sizeHint
+			dbiMsg = snapshot.NewDBISize(int(sizeHint))
+			dbiMsg.SetName(origDBIName)
+			if info.transform != "" {
+				dbiMsg.SetTransform(info.transform)
+			}
+			dbiMsg.SetFlags(info.flags)
+			return nil
+		},
+		func(kv snapshot.KV) error {
+			dbiMsg.Append(kv)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check how close our hint was
+	var efficiency float64
+	actualSize := dbiMsg.Size()
+	if sizeHint > 0 {
+		efficiency = math.Round(100*float64(actualSize)/sizeHint) / 100
+	}
+	s.l.WithFields(logrus.Fields{
+		"size_hint_used":   int(sizeHint),
+		"actual_data_size": actualSize,
+		"hint_efficiency":  efficiency,
+	}).Debug("Check our pre-alloc size estimate (<1 is OK)")
+
+	return dbiMsg, nil
+}
+
+// streamDBI reads a DBI with headers and directly writes its entries to a
+// snapshot StreamWriter, so that the DBI never needs to be held in memory
+// as a whole. The arguments are the same as for readDBI. It returns the
+// number of entries written.
+func (s *Syncer) streamDBI(txn *lmdb.Txn, dbiName, origDBIName string, base *deltaBase, changes *changeSet, filter *zoneFilter, sw *snapshot.StreamWriter) (int, error) {
+	var n int
+	var hook schema.Hook
+	var redactor *redact.Redactor
+	err := s.scanDBI(txn, dbiName, origDBIName, false, base, changes, filter,
+		func(info dbiScanInfo) error {
+			var err error
+			if hook, err = s.dbiHook(origDBIName, info.transform); err != nil {
+				return err
+			}
+			if redactor, err = s.dbiRedactor(origDBIName, info.transform); err != nil {
+				return err
+			}
+			return sw.StartDBI(origDBIName, info.flags, info.transform)
+		},
+		func(kv snapshot.KV) error {
+			kv, ok, err := encodeKV(redactor, hook, origDBIName, kv)
+			if err != nil || !ok {
+				return err
+			}
+			n++
+			return sw.Append(kv)
+		},
+	)
+	if err != nil {
+		return n, err
+	}
+	return n, sw.EndDBI()
+}
+
+// dbiScanInfo is passed by scanDBI before any entries are read
+type dbiScanInfo struct {
+	flags     uint64  // flags of the original DBI
+	transform string  // snapshot transform to set, if any
+	sizeHint  float64 // estimate of the snapshot DBI size in bytes
+}
+
+// scanDBI reads all entries of a DBI for readDBI and streamDBI. It first
+// calls start with information about the DBI, and then calls add for every
+// entry to include. The KV data may point directly into LMDB pages, so add
+// must copy them if they are used after it returns. Entries that do not pass
+// the zone filter are skipped entirely, including for the changes.
+func (s *Syncer) scanDBI(
+	txn *lmdb.Txn, dbiName, origDBIName string, rawValues bool, base *deltaBase, changes *changeSet, filter *zoneFilter,
+	start func(info dbiScanInfo) error, add func(kv snapshot.KV) error,
+) error {
+	if rawValues && base != nil {
+		return fmt.Errorf("readDBI: delta snapshots require headers")
+	}
+
 	l := s.l.WithField("dbi", dbiName)
 
 	l.Debug("Opening DBI")
 	dbi, err := txn.OpenDBI(dbiName, 0)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Get some DBI stats for optimisation
 	stat, err := txn.Stat(dbi)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	l.WithField("entries", stat.Entries).Debug("Reading DBI")
 
@@ -126,8 +229,6 @@ func (s *Syncer) readDBI(txn *lmdb.Txn, dbiName, origDBIName string, rawValues b
 		// For rawValues, we do not have this header padding, so add a bit more.
 		sizeHint = (1.2 * sizeHint) + 4*float64(stat.Entries)
 	}
-	dbiMsg = snapshot.NewDBISize(int(sizeHint))
-	dbiMsg.SetName(origDBIName)
 
 	// Flags of the original DBI (not the shadow DBI)
 	var dbiFlags uint
@@ -137,32 +238,45 @@ func (s *Syncer) readDBI(txn *lmdb.Txn, dbiName, origDBIName string, rawValues b
 		l.Debug("Opening original DBI for flags")
 		origDBI, err := txn.OpenDBI(origDBIName, 0)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		dbiFlags, err = txn.Flags(origDBI)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	} else {
 		// This is the original DBI
 		dbiFlags, err = txn.Flags(dbi)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
+	info := dbiScanInfo{
+		flags:    uint64(dbiFlags),
+		sizeHint: sizeHint,
+	}
 	isDupSort := dbiFlags&lmdb.DupSort > 0
 	if isDupSort {
-		if !s.lc.DupSortHack {
-			return nil, fmt.Errorf("readDBI: dupsort db %q found and dupsort_hack disabled", dbiName)
+		switch {
+		case s.lc.DupSortNative:
+			info.transform = snapshot.TransformDupSortNativeV1
+		case s.lc.DupSortHack:
+			info.transform = snapshot.TransformDupSortHackV1
+		default:
+			return fmt.Errorf("readDBI: dupsort db %q found and neither dupsort_hack nor dupsort_native enabled", dbiName)
 		}
-		dbiMsg.SetTransform(snapshot.TransformDupSortHackV1)
 	}
-	dbiMsg.SetFlags(uint64(dbiFlags))
+	// The shadow DBI of a DupSort DBI with dupsort_native has the header
+	// after the value.
+	dupSortShadow := isDupSort && s.lc.DupSortNative && dbiName != origDBIName
+	if err := start(info); err != nil {
+		return err
+	}
 
 	// Read all entries
 	c, err := txn.OpenCursor(dbi)
 	if err != nil {
-		return nil, errors.Wrap(err, "open cursor")
+		return errors.Wrap(err, "open cursor")
 	}
 	defer c.Close()
 
@@ -174,85 +288,98 @@ func (s *Syncer) readDBI(txn *lmdb.Txn, dbiName, origDBIName string, rawValues b
 			if lmdb.IsNotFound(err) {
 				break
 			} else {
-				return nil, errors.Wrap(err, "cursor next")
+				return errors.Wrap(err, "cursor next")
 			}
 		}
 
 		// Not checking wrong order to support native integer and reverse ordering
 		if prev != nil && !isDupSort && bytes.Equal(prev, key) {
-			return nil, fmt.Errorf(
+			return fmt.Errorf(
 				"duplicate key detected in DBI %q without dupsort_hack, refusing to continue",
 				dbiName)
 		}
 		prev = key
 
-		var ts header.Timestamp
-		var flags header.Flags
+		if !filter.include(origDBIName, key) {
+			flag = lmdb.Next
+			continue
+		}
+
+		var h header.Header
 		if !rawValues {
-			h, appVal, err := header.Parse(val)
+			var appVal []byte
+			if dupSortShadow {
+				appVal, h, err = parseDupSortShadowValue(val)
+			} else {
+				h, appVal, err = header.Parse(val)
+			}
 			if err != nil {
-				return nil, ErrEntry{
+				return ErrEntry{
 					DBIName: dbiName,
 					Key:     key,
 					Err:     err,
 				}
 			}
-			ts = h.Timestamp
-			flags = h.Flags
 			val = appVal
+			if changes != nil {
+				changes.add(origDBIName, key, val, h)
+			}
 		}
 
 		flag = lmdb.Next
-		dbiMsg.Append(snapshot.KV{
+		if base != nil && !base.includes(h) {
+			continue // unchanged since base snapshot
+		}
+		err = add(snapshot.KV{
 			Key:           key,
 			Value:         val,
-			TimestampNano: uint64(ts),
-			Flags:         uint32(flags.Masked()),
+			TimestampNano: uint64(h.Timestamp),
+			Flags:         uint32(h.Flags.Masked()),
 		})
+		if err != nil {
+			return err
+		}
 	}
-
-	// Check how close our hint was
-	var efficiency float64
-	actualSize := dbiMsg.Size()
-	if sizeHint > 0 {
-		efficiency = math.Round(100*float64(actualSize)/sizeHint) / 100
-	}
-	s.l.WithFields(logrus.Fields{
-		"size_hint_used":   int(sizeHint),
-		"actual_data_size": actualSize,
-		"hint_efficiency":  efficiency,
-	}).Debug("Check our pre-alloc size estimate (<1 is OK)")
-
-	return dbiMsg, nil
+	return nil
 }
 
-func (s *Syncer) startStatsLogger(ctx context.Context, env *lmdb.Env) {
-	// Log LMDB stats every configured interval
+// runStatsLogger logs the LMDB stats every configured interval until the
+// context is cancelled.
+func (s *Syncer) runStatsLogger(ctx context.Context, env *lmdb.Env) error {
 	interval := s.c.LMDBLogStatsInterval
-	if interval <= 0 {
-		s.l.Info("LMDB stats logging disabled")
-		return
-	}
 	s.l.WithField("interval", interval).Info("Enabled LMDB stats logging")
-	go func() {
-		logStatsTicker := time.NewTicker(interval)
-		defer logStatsTicker.Stop()
-		logStatsCtx, cancel := context.WithCancel(ctx)
-		defer cancel()
-		for {
-			select {
-			case <-logStatsCtx.Done():
-				return
-			case <-logStatsTicker.C:
-				// Skip the meta db, not that interesting
-				stats.Log(env, nil, s.c.LMDBScrapeSmaps, s.l)
-			}
+	logStatsTicker := time.NewTicker(interval)
+	defer logStatsTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logStatsTicker.C:
+			// Skip the meta db, not that interesting
+			stats.Log(env, nil, s.c.LMDBScrapeSmaps, s.l)
 		}
-	}()
-
+	}
 }
 
 func (s *Syncer) registerCollector(env *lmdb.Env) {
 	lmdbCollector.EnableSmaps(s.c.LMDBScrapeSmaps)
 	lmdbCollector.AddTarget(s.name, nil, env)
 }
+
+// storeWithRetry stores a blob that is not a regular snapshot, retrying
+// failures like SendOnce does, but without the snapshot metrics.
+func (s *Syncer) storeWithRetry(ctx context.Context, st simpleblob.Interface, name string, data []byte) error {
+	for i := 1; ; i++ {
+		err := st.Store(ctx, name, data)
+		if err == nil {
+			return nil
+		}
+		if i >= s.c.StorageRetryCount && !s.c.StorageRetryForever {
+			return err
+		}
+		s.l.WithError(err).WithField("name", name).Warn("Store failed, retrying")
+		if err := utils.SleepContext(ctx, s.c.StorageRetryInterval); err != nil {
+			return err
+		}
+	}
+}
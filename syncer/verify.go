@@ -0,0 +1,72 @@
+package syncer
+
+import (
+	"errors"
+	"sort"
+
+	"powerdns.com/platform/lightningstream/utils"
+)
+
+// ErrVerifyDifferences is returned by Sync in verify-only mode if merging the
+// remote snapshots would change the LMDB
+var ErrVerifyDifferences = errors.New("verify: the LMDB differs from the merged remote snapshots")
+
+// verifyDBIKeys returns the keys of the DBI changed by the remote snapshots
+// merged so far in verify-only mode, or nil otherwise
+func (s *Syncer) verifyDBIKeys(dbiName string) map[string]*verifyEntry {
+	if !s.opt.VerifyOnly {
+		return nil
+	}
+	if s.verifyKeys == nil {
+		s.verifyKeys = make(map[string]map[string]*verifyEntry)
+	}
+	keys := s.verifyKeys[dbiName]
+	if keys == nil {
+		keys = make(map[string]*verifyEntry)
+		s.verifyKeys[dbiName] = keys
+	}
+	return keys
+}
+
+// reportVerify logs the keys per DBI for which the data after merging all
+// remote snapshots would differ from the LMDB, and returns
+// ErrVerifyDifferences if there are any. Timestamps are not compared.
+func (s *Syncer) reportVerify() error {
+	differs := make(map[string][]string)
+	var dbiNames []string
+	for dbiName, entries := range s.verifyKeys {
+		var keys []string
+		for key, e := range entries {
+			if e.differs() {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			differs[dbiName] = keys
+			dbiNames = append(dbiNames, dbiName)
+		}
+	}
+	sort.Strings(dbiNames)
+	total := 0
+	for _, dbiName := range dbiNames {
+		keys := differs[dbiName]
+		sort.Strings(keys)
+		total += len(keys)
+		n := len(keys)
+		if n > DryRunMaxKeys {
+			keys = keys[:DryRunMaxKeys]
+		}
+		for i, key := range keys {
+			keys[i] = utils.DisplayASCII([]byte(key))
+		}
+		s.l.WithField("dbi", dbiName).WithField("changed", n).
+			WithField("keys", keys).Warn("Verify: keys differ from the merged remote snapshots")
+	}
+	if total > 0 {
+		s.l.WithField("dbis", len(dbiNames)).WithField("changed", total).
+			Error("Verify: the LMDB differs from the merged remote snapshots")
+		return ErrVerifyDifferences
+	}
+	s.l.Info("Verify: the LMDB matches the merged remote snapshots")
+	return nil
+}
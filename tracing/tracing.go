@@ -0,0 +1,64 @@
+// Package tracing sets up the export of OpenTelemetry traces.
+//
+// Other packages create spans with otel.Tracer, which are discarded until
+// Setup installs a TracerProvider.
+package tracing
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+
+	"powerdns.com/platform/lightningstream/config"
+)
+
+// Setup installs a global TracerProvider that exports traces to the
+// configured OTLP/HTTP collector. The returned function flushes any pending
+// spans and must be called before exit. If tracing is disabled, this does
+// nothing.
+func Setup(ctx context.Context, conf config.Tracing, instance, version string) (shutdown func(context.Context) error, err error) {
+	if !conf.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(conf.Endpoint),
+	}
+	if conf.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(conf.URLPath))
+	}
+	if conf.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(conf.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(conf.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(conf.ServiceName),
+		semconv.ServiceVersion(version),
+		semconv.ServiceInstanceID(instance),
+	)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	logrus.WithField("endpoint", conf.Endpoint).
+		WithField("sample_ratio", conf.SampleRatio).
+		Info("OpenTelemetry tracing enabled")
+	return tp.Shutdown, nil
+}
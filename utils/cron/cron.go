@@ -0,0 +1,166 @@
+// Package cron parses cron-like schedules and computes when they are due
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shortcuts are the supported schedule shortcuts
+var Shortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// field is a bit set of the values allowed for a field
+type field uint64
+
+func (f field) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+type fieldRange struct {
+	name     string
+	min, max int
+}
+
+var fieldRanges = []fieldRange{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are both Sunday
+}
+
+// Schedule is a parsed cron schedule with the standard five fields:
+// minute, hour, day of month, month and day of week.
+type Schedule struct {
+	spec   string
+	fields [5]field
+
+	// Like in cron, if both the day of month and day of week are restricted,
+	// a day matches if either of them matches.
+	domStar, dowStar bool
+}
+
+// Parse parses a schedule with five space separated fields, like
+// "30 3 * * 1-5", or one of the Shortcuts. Every field is either a '*', a
+// number, a range like '1-5' or a comma separated list of these, and can be
+// followed by a step like '*/15'. Names of months and days are not supported.
+func Parse(spec string) (*Schedule, error) {
+	expanded := spec
+	if sc, ok := Shortcuts[spec]; ok {
+		expanded = sc
+	}
+	parts := strings.Fields(expanded)
+	if len(parts) != len(fieldRanges) {
+		return nil, fmt.Errorf("cron schedule %q: expected %d fields, got %d",
+			spec, len(fieldRanges), len(parts))
+	}
+	s := &Schedule{
+		spec:    spec,
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}
+	for i, p := range parts {
+		f, err := parseField(p, fieldRanges[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron schedule %q: %w", spec, err)
+		}
+		s.fields[i] = f
+	}
+	// Sunday can be written as 7
+	if s.fields[4].has(7) {
+		s.fields[4] |= 1
+	}
+	return s, nil
+}
+
+func parseField(s string, r fieldRange) (field, error) {
+	var f field
+	for _, item := range strings.Split(s, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("%s: invalid step %q", r.name, stepStr)
+			}
+			step = n
+		}
+		lo, hi := r.min, r.max
+		if rangeStr != "*" {
+			loStr, hiStr, isRange := strings.Cut(rangeStr, "-")
+			var err error
+			if lo, err = parseValue(loStr, r); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseValue(hiStr, r); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = r.max // "5/10" means "5-max/10"
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("%s: invalid range %q", r.name, rangeStr)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+func parseValue(s string, r fieldRange) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < r.min || v > r.max {
+		return 0, fmt.Errorf("%s: invalid value %q (must be %d-%d)", r.name, s, r.min, r.max)
+	}
+	return v, nil
+}
+
+// String returns the schedule as it was parsed
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Next returns the first time after t that matches the schedule, in the
+// location of t. It returns the zero time if there is no such time within
+// five years, e.g. for February 31.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case !s.fields[3].has(int(m)):
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !s.fields[1].has(t.Hour()):
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case !s.fields[0].has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.fields[2].has(t.Day())
+	dow := s.fields[4].has(int(t.Weekday()))
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,59 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule_Next(t *testing.T) {
+	// Wednesday
+	now := time.Date(2023, 3, 15, 10, 20, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"* * * * *", "2023-03-15T10:21:00Z"},
+		{"*/15 * * * *", "2023-03-15T10:30:00Z"},
+		{"0 3 * * *", "2023-03-16T03:00:00Z"},
+		{"@daily", "2023-03-16T00:00:00Z"},
+		{"@hourly", "2023-03-15T11:00:00Z"},
+		{"@monthly", "2023-04-01T00:00:00Z"},
+		{"20 10 * * *", "2023-03-16T10:20:00Z"},
+		{"0 0 * * 0", "2023-03-19T00:00:00Z"},
+		{"0 0 * * 7", "2023-03-19T00:00:00Z"},
+		{"0 12 * * 1-5", "2023-03-15T12:00:00Z"},
+		{"0 0 1,15 * 6", "2023-03-18T00:00:00Z"}, // either day field
+		{"30 4 29 2 *", "2024-02-29T04:30:00Z"},
+		{"0 0 31 2 *", "0001-01-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, s.Next(now).Format(time.RFC3339))
+			assert.Equal(t, tt.spec, s.String())
+		})
+	}
+}
+
+func TestParse_errors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@yearly",
+	} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,182 @@
+// Package membudget limits the total size of the snapshot data that is held
+// in memory by all syncers, so that many large snapshots that arrive at the
+// same time cannot run the process out of memory.
+//
+// Downloads reserve the size of a snapshot before they start, and wait while
+// the budget is used up, which applies backpressure on the downloads. A
+// snapshot larger than the whole budget is only downloaded when nothing else
+// is reserved.
+package membudget
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricLimit = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_memory_budget_limit_bytes",
+			Help: "Configured memory budget for snapshot data, 0 for no limit",
+		},
+		func() float64 { return float64(shared.Limit()) },
+	)
+	metricUsed = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_memory_budget_used_bytes",
+			Help: "Snapshot data currently reserved in the memory budget",
+		},
+		func() float64 { return float64(shared.Used()) },
+	)
+	metricWaiting = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "lightningstream_memory_budget_waiting",
+			Help: "Number of downloads waiting for the memory budget",
+		},
+		func() float64 { return float64(shared.Waiting()) },
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricLimit)
+	prometheus.MustRegister(metricUsed)
+	prometheus.MustRegister(metricWaiting)
+}
+
+// shared is the budget of all syncers in this process
+var shared = New(0)
+
+// Shared returns the budget shared by all syncers in this process. It has
+// no limit until SetLimit is called.
+func Shared() *Budget {
+	return shared
+}
+
+// Budget is a memory budget in bytes
+type Budget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	waiting int
+	changed chan struct{} // closed and replaced when memory is released
+}
+
+// New returns a new Budget. A zero limit means no limit.
+func New(limit int64) *Budget {
+	return &Budget{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// SetLimit changes the limit. A zero limit means no limit.
+func (b *Budget) SetLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+	b.notify()
+}
+
+// Limit returns the limit
+func (b *Budget) Limit() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit
+}
+
+// Used returns the number of bytes reserved
+func (b *Budget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Waiting returns the number of Reserve calls waiting for memory
+func (b *Budget) Waiting() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.waiting
+}
+
+// Reserve reserves n bytes, and waits until these fit in the budget or the
+// context is cancelled. The Reservation must be released after use.
+func (b *Budget) Reserve(ctx context.Context, n int64) (*Reservation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	waited := false
+	for !b.fits(n) {
+		if !waited {
+			b.waiting++
+			waited = true
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		b.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			b.waiting--
+			return nil, err
+		}
+	}
+	if waited {
+		b.waiting--
+	}
+	b.used += n
+	return &Reservation{b: b, n: n}, nil
+}
+
+// fits returns true if n more bytes fit in the budget. Amounts larger than
+// the limit fit when nothing is reserved. Must be called with the lock held.
+func (b *Budget) fits(n int64) bool {
+	return b.limit <= 0 || b.used == 0 || b.used+n <= b.limit
+}
+
+// notify wakes up the waiting Reserve calls. Must be called with the lock
+// held.
+func (b *Budget) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Reservation is memory reserved in a Budget
+type Reservation struct {
+	b *Budget
+
+	mu sync.Mutex
+	n  int64
+}
+
+// Resize changes the size of the reservation to the actual size of the data,
+// without waiting. It may exceed the budget.
+func (r *Reservation) Resize(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.b.mu.Lock()
+	defer r.b.mu.Unlock()
+	r.b.used += n - r.n
+	r.n = n
+	r.b.notify()
+}
+
+// Release returns the memory to the budget. It can safely be called more
+// than once.
+func (r *Reservation) Release() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.b == nil {
+		return
+	}
+	r.b.mu.Lock()
+	r.b.used -= r.n
+	r.b.notify()
+	r.b.mu.Unlock()
+	r.b = nil
+}
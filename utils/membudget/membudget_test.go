@@ -0,0 +1,67 @@
+package membudget
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudget(t *testing.T) {
+	ctx := context.Background()
+	b := New(100)
+
+	r1, err := b.Reserve(ctx, 60)
+	require.NoError(t, err)
+	r2, err := b.Reserve(ctx, 40)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), b.Used())
+
+	// Waits until enough memory is released
+	done := make(chan *Reservation)
+	go func() {
+		r, err := b.Reserve(ctx, 50)
+		assert.NoError(t, err)
+		done <- r
+	}()
+	require.Eventually(t, func() bool { return b.Waiting() == 1 }, time.Second, time.Millisecond)
+	r2.Release()
+	r2.Release()
+	select {
+	case <-done:
+		t.Fatal("reserved while over budget")
+	case <-time.After(10 * time.Millisecond):
+	}
+	r1.Release()
+	r3 := <-done
+	assert.Equal(t, 0, b.Waiting())
+	assert.Equal(t, int64(50), b.Used())
+
+	// Larger than the budget only when nothing else is reserved
+	ctxTimeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = b.Reserve(ctxTimeout, 200)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, b.Waiting())
+	r3.Resize(10)
+	assert.Equal(t, int64(10), b.Used())
+	r3.Release()
+	r4, err := b.Reserve(ctx, 200)
+	require.NoError(t, err)
+	r4.Release()
+	assert.Equal(t, int64(0), b.Used())
+
+	// No limit
+	b.SetLimit(0)
+	r5, err := b.Reserve(ctx, 1000)
+	require.NoError(t, err)
+	r6, err := b.Reserve(ctx, 1000)
+	require.NoError(t, err)
+	r5.Release()
+	r6.Release()
+
+	var nilReservation *Reservation
+	nilReservation.Release()
+}
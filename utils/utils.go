@@ -85,6 +85,25 @@ func DisplayASCII(b []byte) string {
 	return string(ret)
 }
 
+// EscapeASCII represents a key or value as ascii without losing information.
+// Safe ascii characters are kept, backslashes are doubled and all other bytes
+// are replaced by a backslash, 'x' and their hex representation.
+func EscapeASCII(b []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(b))
+	for _, ch := range b {
+		switch {
+		case ch == '\\':
+			sb.WriteString(`\\`)
+		case ch < 32 || ch > 126:
+			_, _ = fmt.Fprintf(&sb, `\x%02x`, ch)
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
 // Cut cuts s around the first instance of sep,
 // returning the text before and after sep.
 // The found result reports whether sep appears in s.
@@ -29,3 +29,9 @@ func TestDisplayASCII(t *testing.T) {
 		})
 	}
 }
+
+func TestEscapeASCII(t *testing.T) {
+	assert.Equal(t, "", EscapeASCII(nil))
+	assert.Equal(t, "abc def", EscapeASCII([]byte("abc def")))
+	assert.Equal(t, `a\\b\x00\x0a\xf0`, EscapeASCII([]byte("a\\b\x00\n\xf0")))
+}